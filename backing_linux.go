@@ -0,0 +1,63 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// OpenBackingFile registers f with the kernel for passthrough I/O, returning
+// an ID that may be returned in the BackingID fields of OpenFileOp,
+// CreateFileOp and CreateTmpfileOp until it is closed with CloseBackingFile.
+// The kernel holds its own reference to the file, so f may be closed once
+// registered.
+//
+// This requires MountConfig.MaxStackDepth, Linux 6.9 or later, and
+// CAP_SYS_ADMIN in the initial user namespace. The kernel fails with ELOOP if
+// f's file system is stacked as deeply as MaxStackDepth allows.
+func (c *Connection) OpenBackingFile(f *os.File) (fuseops.BackingID, error) {
+	m := fusekernel.BackingMap{Fd: int32(f.Fd())}
+	id, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		c.dev.Fd(),
+		fusekernel.DevIocBackingOpen,
+		uintptr(unsafe.Pointer(&m)))
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return fuseops.BackingID(id), nil
+}
+
+// CloseBackingFile releases a backing file registered with OpenBackingFile.
+// Handles already opened with it keep using it until they are released.
+func (c *Connection) CloseBackingFile(id fuseops.BackingID) error {
+	raw := uint32(id)
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		c.dev.Fd(),
+		fusekernel.DevIocBackingClose,
+		uintptr(unsafe.Pointer(&raw)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// CachePreset is a coherent combination of the settings controlling how much
+// the kernel caches, some of which are given at mount time and some of which
+// are returned by the file system in individual ops. Use Apply to configure a
+// MountConfig, and the remaining methods when responding to ops.
+//
+// The predefined presets cover common consistency models. Copy one and modify
+// it if none fits exactly.
+type CachePreset struct {
+	// How long the kernel may cache inode attributes and directory entries.
+	// See fuseops.ChildInodeEntry for details.
+	AttributeTTL time.Duration
+	EntryTTL     time.Duration
+
+	// Values for the like-named fields of fuseops.OpenFileOp.
+	KeepPageCache bool
+	UseDirectIO   bool
+
+	// Values for the like-named fields of fuseops.OpenDirOp.
+	CacheDir  bool
+	KeepCache bool
+
+	// Values for the like-named fields of MountConfig.
+	DisableWritebackCaching bool
+	EnableAutoInvalData     bool
+}
+
+var (
+	// CacheStrict disables kernel caching altogether: every stat(2), lookup,
+	// read(2), and write(2) reaches the file system. This is the right choice
+	// for files that may change at any time behind the kernel's back, at a
+	// considerable cost in performance. Note that shared mmap(2) of files
+	// opened with direct I/O requires MountConfig.EnableDirectIOMmap.
+	CacheStrict = CachePreset{
+		UseDirectIO:             true,
+		DisableWritebackCaching: true,
+	}
+
+	// CacheCloseToOpen gives the consistency model of NFS: a process that
+	// opens a file sees everything written by processes that closed it
+	// earlier, whichever machine they ran on. Opening a file drops its cached
+	// pages, attributes are cached only briefly, and writes reach the file
+	// system before close(2) returns.
+	CacheCloseToOpen = CachePreset{
+		AttributeTTL:            time.Second,
+		EntryTTL:                time.Second,
+		DisableWritebackCaching: true,
+		EnableAutoInvalData:     true,
+	}
+
+	// CacheAggressive caches everything for a long time, and is suitable for
+	// file systems that either are changed only through the kernel or tell the
+	// kernel about every other change with Connection.NotifyInvalInode and
+	// Connection.NotifyInvalEntry. Without those notifications, readers may see
+	// stale data for up to an hour.
+	CacheAggressive = CachePreset{
+		AttributeTTL:            time.Hour,
+		EntryTTL:                time.Hour,
+		KeepPageCache:           true,
+		CacheDir:                true,
+		KeepCache:               true,
+		DisableWritebackCaching: true,
+	}
+
+	// CacheWriteback is CacheAggressive with writeback caching of file contents
+	// in addition, so that write(2) returns as soon as the data is in the
+	// kernel's page cache. See MountConfig.DisableWritebackCaching for the
+	// caveats; in particular the kernel then trusts its own idea of file sizes
+	// and mtimes, so this is suitable only for files that are changed solely
+	// through this mount.
+	CacheWriteback = CachePreset{
+		AttributeTTL:  time.Hour,
+		EntryTTL:      time.Hour,
+		KeepPageCache: true,
+		CacheDir:      true,
+		KeepCache:     true,
+	}
+)
+
+// Apply sets the mount-time fields of cfg controlled by the preset.
+func (p *CachePreset) Apply(cfg *MountConfig) {
+	cfg.DisableWritebackCaching = p.DisableWritebackCaching
+	cfg.EnableAutoInvalData = p.EnableAutoInvalData
+}
+
+// SetExpirations sets the expiration times of the entry, relative to now.
+func (p *CachePreset) SetExpirations(
+	e *fuseops.ChildInodeEntry,
+	now time.Time) {
+	e.AttributesExpiration = now.Add(p.AttributeTTL)
+	e.EntryExpiration = now.Add(p.EntryTTL)
+}
+
+// AttributesExpiration returns a value for the AttributesExpiration field of
+// GetInodeAttributesOp and SetInodeAttributesOp, relative to now.
+func (p *CachePreset) AttributesExpiration(now time.Time) time.Time {
+	return now.Add(p.AttributeTTL)
+}
+
+// OpenFile sets the caching fields of the op.
+func (p *CachePreset) OpenFile(op *fuseops.OpenFileOp) {
+	op.KeepPageCache = p.KeepPageCache
+	op.UseDirectIO = p.UseDirectIO
+}
+
+// OpenDir sets the caching fields of the op.
+func (p *CachePreset) OpenDir(op *fuseops.OpenDirOp) {
+	op.CacheDir = p.CacheDir
+	op.KeepCache = p.KeepCache
+}
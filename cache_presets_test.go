@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func Test_CachePresetStrict(t *testing.T) {
+	p := CacheStrict
+	now := time.Now()
+
+	var cfg MountConfig
+	p.Apply(&cfg)
+	if !cfg.DisableWritebackCaching || cfg.EnableAutoInvalData {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+
+	var e fuseops.ChildInodeEntry
+	p.SetExpirations(&e, now)
+	if !e.AttributesExpiration.Equal(now) || !e.EntryExpiration.Equal(now) {
+		t.Errorf("Expirations: %v, %v", e.AttributesExpiration, e.EntryExpiration)
+	}
+
+	var open fuseops.OpenFileOp
+	p.OpenFile(&open)
+	if open.KeepPageCache || !open.UseDirectIO {
+		t.Errorf("Unexpected OpenFileOp: %+v", open)
+	}
+
+	var openDir fuseops.OpenDirOp
+	p.OpenDir(&openDir)
+	if openDir.CacheDir || openDir.KeepCache {
+		t.Errorf("Unexpected OpenDirOp: %+v", openDir)
+	}
+}
+
+func Test_CachePresetWriteback(t *testing.T) {
+	cfg := MountConfig{DisableWritebackCaching: true}
+	CacheWriteback.Apply(&cfg)
+
+	out := initConnection(t, cfg, fusekernel.InitIn{
+		Flags: uint32(fusekernel.InitWritebackCache | fusekernel.InitAutoInvalData),
+	}, 0)
+
+	flags := fusekernel.InitFlags(out.Flags)
+	if flags&fusekernel.InitWritebackCache == 0 {
+		t.Errorf("Writeback caching not enabled: %v", flags)
+	}
+
+	if flags&fusekernel.InitAutoInvalData != 0 {
+		t.Errorf("Auto invalidation enabled: %v", flags)
+	}
+
+	var open fuseops.OpenFileOp
+	CacheWriteback.OpenFile(&open)
+	if !open.KeepPageCache || open.UseDirectIO {
+		t.Errorf("Unexpected OpenFileOp: %+v", open)
+	}
+}
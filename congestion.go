@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The limits on background requests that we give the kernel unless
+// MountConfig says otherwise, which are also the kernel's defaults. Background
+// requests are those that no process waits for directly, like readahead and
+// writeback. Once congestionThreshold of them are outstanding the kernel
+// considers the connection congested, and once maxBackground are, it holds
+// back further ones until some are answered.
+const (
+	defaultMaxBackground       = 12
+	defaultCongestionThreshold = 9
+)
+
+// Return the limits on background requests to give the kernel.
+func (c *Connection) backgroundLimits() (maxBackground, congestionThreshold uint16) {
+	maxBackground = c.cfg.MaxBackground
+	congestionThreshold = c.cfg.CongestionThreshold
+	if maxBackground == 0 {
+		maxBackground = defaultMaxBackground
+	}
+
+	// As libfuse does, default to congestion at three quarters of the limit.
+	if congestionThreshold == 0 {
+		congestionThreshold = defaultCongestionThreshold
+		if c.cfg.MaxBackground != 0 {
+			congestionThreshold = uint16(uint32(maxBackground) * 3 / 4)
+		}
+	}
+
+	return maxBackground, congestionThreshold
+}
+
+// Return true if the kernel may have sent the op in the background. The kernel
+// doesn't say, so this is a guess from the op type and the configuration.
+func (c *Connection) isBackground(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ReadFileOp:
+		// Readahead.
+		return c.cfg.EnableAsyncReads
+
+	case *fuseops.WriteFileOp:
+		// Writeback.
+		return !c.cfg.DisableWritebackCaching
+
+	case *fuseops.ReleaseFileHandleOp, *fuseops.ReleaseDirHandleOp:
+		return true
+	}
+
+	return false
+}
+
+// Account for a new op, returning whether it is a background op and whether
+// the connection is congested.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) beginBackground(op interface{}) (background, congested bool) {
+	background = c.isBackground(op)
+
+	// The threshold negotiated at init time, or for a resumed session, the
+	// one configured.
+	threshold := c.info.CongestionThreshold
+	if threshold == 0 {
+		_, threshold = c.backgroundLimits()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if background {
+		c.background++
+	}
+
+	return background, c.background >= int(threshold)
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) finishBackground() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.background--
+}
+
+// IsCongested reports whether the kernel's queue of background requests to the
+// file system, such as readahead and writeback, was congested when the op
+// whose context is supplied was received. File systems may use it to shed
+// load, e.g. by serving cached or degraded data, while the kernel is backed
+// up. The queue length is estimated from the ops in flight in this process.
+func IsCongested(ctx context.Context) bool {
+	state, ok := ctx.Value(contextKey).(opState)
+	return ok && state.congested
+}
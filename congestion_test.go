@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A server that reports whether each op arrived congested, and answers once
+// release is closed.
+type congestionServer struct {
+	congested chan bool
+	release   chan struct{}
+}
+
+func (s congestionServer) ServeOps(c *Connection) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		ctx, _, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		s.congested <- IsCongested(ctx)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-s.release
+			c.Reply(ctx, nil)
+		}()
+	}
+}
+
+func Test_Congestion(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	server := congestionServer{
+		congested: make(chan bool, 1),
+		release:   make(chan struct{}),
+	}
+
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		server,
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	send := func(opcode uint32, unique uint64, body []byte) {
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + len(body)),
+			Opcode: opcode,
+			Unique: unique,
+			Nodeid: 2,
+		})
+		msg.Write(body)
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// Releases are background ops. The connection is congested once the
+	// threshold is reached.
+	release := make([]byte, 24)
+	for i := 1; i <= defaultCongestionThreshold; i++ {
+		send(fusekernel.OpRelease, uint64(i), release)
+		if got, want := <-server.congested, i >= defaultCongestionThreshold; got != want {
+			t.Errorf("Release %d: congested = %v, want %v", i, got, want)
+		}
+	}
+
+	send(fusekernel.OpGetattr, 100, make([]byte, 16))
+	if !<-server.congested {
+		t.Errorf("GetInodeAttributes not congested")
+	}
+
+	// Once the ops are answered, it no longer is.
+	close(server.release)
+	for i := 0; i < defaultCongestionThreshold+1; i++ {
+		if _, err := kernel.Read(make([]byte, 4096)); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+
+	send(fusekernel.OpGetattr, 101, make([]byte, 16))
+	if <-server.congested {
+		t.Errorf("Congested after answering")
+	}
+
+	if _, err := kernel.Read(make([]byte, 4096)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_BackgroundLimits(t *testing.T) {
+	testCases := []struct {
+		maxBackground       uint16
+		congestionThreshold uint16
+		wantMax             uint16
+		wantThreshold       uint16
+	}{
+		{0, 0, 12, 9},
+		{64, 0, 64, 48},
+		{64, 16, 64, 16},
+		{0, 4, 12, 4},
+	}
+
+	for _, tc := range testCases {
+		cfg := MountConfig{
+			MaxBackground:       tc.maxBackground,
+			CongestionThreshold: tc.congestionThreshold,
+		}
+
+		out := initConnection(t, cfg, fusekernel.InitIn{Major: 7, Minor: 31}, 0)
+		if out.MaxBackground != tc.wantMax || out.CongestionThreshold != tc.wantThreshold {
+			t.Errorf("%+v: max_background %d, congestion_threshold %d",
+				tc, out.MaxBackground, out.CongestionThreshold)
+		}
+	}
+
+	// Without an init request, as for a resumed session, congestion is judged
+	// by the configured threshold.
+	c := &Connection{cfg: MountConfig{CongestionThreshold: 2}}
+	for i := 1; i <= 2; i++ {
+		if _, congested := c.beginBackground(&fuseops.ReleaseFileHandleOp{}); congested != (i == 2) {
+			t.Errorf("Release %d: congested = %v", i, congested)
+		}
+	}
+}
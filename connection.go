@@ -19,11 +19,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path"
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
@@ -35,6 +37,9 @@ type contextKeyType uint64
 
 var contextKey interface{} = contextKeyType(0)
 
+// The key under which ops' contexts carry MountConfig.Labels.
+var labelsKey interface{} = contextKeyType(1)
+
 // Ask the Linux kernel for larger read requests.
 //
 // As of 2015-03-26, the behavior in the kernel is:
@@ -51,7 +56,8 @@ var contextKey interface{} = contextKeyType(0)
 //
 //   - (http://goo.gl/JnhbdL) Don't read ahead at all if that field is zero.
 //
-// Reading a page at a time is a drag. Ask for a larger size.
+// Reading a page at a time is a drag. Ask for a larger size, unless
+// MountConfig.MaxReadahead says otherwise.
 const maxReadahead = 1 << 20
 
 // Connection represents a connection to the fuse kernel process. It is used to
@@ -66,6 +72,21 @@ type Connection struct {
 	dev      *os.File
 	protocol fusekernel.Protocol
 
+	// Whether the kernel agreed to resend unanswered requests on request. See
+	// NotifyResend.
+	resend bool
+
+	// Whether the kernel agreed to allow shared mappings of files opened with
+	// direct I/O. See MountConfig.EnableDirectIOMmap.
+	directIOMmap bool
+
+	// What was negotiated at init time, for MountedFileSystem.ConnectionInfo.
+	// Constant after Init.
+	info ConnectionInfo
+
+	// The server's InitHandler, if it has one. See init_hook.go.
+	initHandler InitHandler
+
 	mu sync.Mutex
 
 	// A map from fuse "unique" request ID (*not* the op ID for logging used
@@ -74,28 +95,95 @@ type Connection struct {
 	// GUARDED_BY(mu)
 	cancelFuncs map[uint64]func()
 
+	// The number of background ops read and not yet answered.
+	//
+	// GUARDED_BY(mu)
+	background int
+
+	// The number of ops read and not yet replied to, including forgets, and a
+	// channel to be closed when it next drops to zero, if anybody is waiting
+	// for that. See quiescence.go.
+	//
+	// GUARDED_BY(mu)
+	inFlight int
+	idle     chan struct{}
+
+	// State for deduplicating requests that the kernel sends again, used only
+	// if resend is set. See resend.go.
+	//
+	// unanswered maps the unique ID of each request being worked on, without
+	// fusekernel.UniqueResend, to the ID with which to answer it. unclaimed
+	// holds answers that the kernel rejected, keyed the same way, and
+	// unclaimedOrder records the order in which they were added, including
+	// some that have since been claimed. unclaimedBytes is the total size of
+	// the answers in unclaimed. resendEpoch counts the calls to NotifyResend.
+	//
+	// GUARDED_BY(mu)
+	unanswered     map[uint64]unansweredRequest
+	unclaimed      map[uint64][]byte
+	unclaimedOrder []uint64
+	unclaimedBytes int
+	resendEpoch    uint64
+
+	// Callers of NotifyRetrieve waiting for the kernel's reply, keyed by the
+	// unique ID sent with the notification, and the last such ID used. See
+	// notify.go.
+	//
+	// GUARDED_BY(mu)
+	retrieves    map[uint64]chan []byte
+	lastRetrieve uint64
+
 	// Freelists, serviced by freelists.go.
 	inMessages  freelist.Freelist // GUARDED_BY(mu)
 	outMessages freelist.Freelist // GUARDED_BY(mu)
+
+	// The bytes of inbound buffers handed out by getInMessage and not yet put
+	// back, and of those on the freelist. See memory.go.
+	//
+	// GUARDED_BY(mu)
+	inBytesInUse int64
+	inBytesFree  int64
+
+	// Why the kernel hung up, if not because the file system was unmounted:
+	// ErrConnectionAborted or ErrMountpointGone. Returned by close.
+	//
+	// GUARDED_BY(mu)
+	hangupCause error
 }
 
 // State that is maintained for each in-flight op. This is stuffed into the
 // context that the user uses to reply to the op.
 type opState struct {
+	conn   *Connection
 	inMsg  *buffer.InMessage
 	outMsg *buffer.OutMessage
 	op     interface{}
+
+	// A copy of inMsg's header, which remains valid once inMsg is released
+	// early, and the state of the op's buffers. See memory.go.
+	header fusekernel.InHeader
+	mem    *opMemory
+
+	// Whether the op counts as a background op, and whether the connection
+	// was congested when it arrived. See congestion.go.
+	background bool
+	congested  bool
+
+	// When the op was read from the device. See ReceivedAt.
+	received time.Time
 }
 
 // Create a connection wrapping the supplied file descriptor connected to the
-// kernel. You must eventually call c.close().
+// kernel, to be served by the supplied server. You must eventually call
+// c.close().
 //
 // The loggers may be nil.
 func newConnection(
 	cfg MountConfig,
 	debugLogger *log.Logger,
 	errorLogger *log.Logger,
-	dev *os.File) (*Connection, error) {
+	dev *os.File,
+	server Server) (*Connection, error) {
 	c := &Connection{
 		cfg:         cfg,
 		debugLogger: debugLogger,
@@ -104,6 +192,8 @@ func newConnection(
 		cancelFuncs: make(map[uint64]func()),
 	}
 
+	c.initHandler, _ = server.(InitHandler)
+
 	// Initialize.
 	if err := c.Init(); err != nil {
 		c.close()
@@ -148,16 +238,36 @@ func (c *Connection) Init() error {
 		c.protocol = initOp.Kernel
 	}
 
+	kernelFlags := uint64(initOp.Flags) | uint64(initOp.Flags2)<<32
+	writebackCache := initOp.Flags&fusekernel.InitWritebackCache > 0
 	cacheSymlinks := initOp.Flags&fusekernel.InitCacheSymlinks > 0
 	noOpenSupport := initOp.Flags&fusekernel.InitNoOpenSupport > 0
 	noOpendirSupport := initOp.Flags&fusekernel.InitNoOpendirSupport > 0
+	autoInvalData := initOp.Flags&fusekernel.InitAutoInvalData > 0
+	readdirplus := initOp.Flags&fusekernel.InitDoReaddirplus > 0
+	directIOAllowMmap := initOp.Flags2&fusekernel.InitDirectIOAllowMmap > 0
+	passthrough := initOp.Flags2&fusekernel.InitPassthrough > 0
+	hasResend := initOp.Flags2&fusekernel.InitHasResend > 0
+	inodeDAX := initOp.Flags2&fusekernel.InitHasInodeDAX > 0
+	createSuppGroup := initOp.Flags2&fusekernel.InitCreateSuppGroup > 0
+	flockLocks := initOp.Flags&fusekernel.InitFlockLocks > 0
+	posixLocks := initOp.Flags&fusekernel.InitPosixLocks > 0
+	volRename := initOp.Flags&fusekernel.InitVolRename > 0
+	xtimes := initOp.Flags&fusekernel.InitXtimes > 0
+	caseInsensitive := initOp.Flags&fusekernel.InitCaseSensitive > 0
+	exportSupport := initOp.Flags&fusekernel.InitExportSupport > 0
 
 	// Respond to the init op.
 	initOp.Library = c.protocol
 	initOp.MaxReadahead = maxReadahead
-	initOp.MaxWrite = buffer.MaxWriteSize
+	if c.cfg.MaxReadahead != 0 {
+		initOp.MaxReadahead = c.cfg.MaxReadahead
+	}
+	initOp.MaxWrite = uint32(c.maxWrite())
+	initOp.MaxBackground, initOp.CongestionThreshold = c.backgroundLimits()
 
 	initOp.Flags = 0
+	initOp.Flags2 = 0
 
 	// Tell the kernel not to use pitifully small 4 KiB writes.
 	initOp.Flags |= fusekernel.InitBigWrites
@@ -166,18 +276,35 @@ func (c *Connection) Init() error {
 		initOp.Flags |= fusekernel.InitAsyncRead
 	}
 
-	// kernel 4.20 increases the max from 32 -> 256
+	// kernel 4.20 increases the max from 32 -> 256, which also bounds reads.
+	// Ask for more if MountConfig.MaxWrite needs it.
 	initOp.Flags |= fusekernel.InitMaxPages
 	initOp.MaxPages = 256
+	if pages := c.maxWrite() / os.Getpagesize(); pages > int(initOp.MaxPages) {
+		initOp.MaxPages = uint16(pages)
+	}
 
-	// Enable writeback caching if the user hasn't asked us not to.
-	if !c.cfg.DisableWritebackCaching {
+	// Keep messages small enough to relay (see MountSharded).
+	if c.cfg.maxMessage > 0 {
+		pages := messagePages(c.cfg.maxMessage)
+		if pages < int(initOp.MaxPages) {
+			initOp.MaxPages = uint16(pages)
+		}
+
+		if w := uint32(pages * os.Getpagesize()); w < initOp.MaxWrite {
+			initOp.MaxWrite = w
+		}
+	}
+
+	// Enable writeback caching if the user hasn't asked us not to and the
+	// kernel supports it (Linux >= 3.15).
+	if !c.cfg.DisableWritebackCaching && !c.cfg.DisableKernelCaching && writebackCache {
 		initOp.Flags |= fusekernel.InitWritebackCache
 	}
 
 	// Enable caching symlink targets in the kernel page cache if the user opted
 	// into it (might require fixing the size field of inode attributes first):
-	if c.cfg.EnableSymlinkCaching && cacheSymlinks {
+	if c.cfg.EnableSymlinkCaching && !c.cfg.DisableKernelCaching && cacheSymlinks {
 		initOp.Flags |= fusekernel.InitCacheSymlinks
 	}
 
@@ -198,9 +325,141 @@ func (c *Connection) Init() error {
 		initOp.Flags |= fusekernel.InitParallelDirOps
 	}
 
+	// List directories with their entries' attributes (Linux >= 3.9).
+	if c.cfg.EnableReaddirplus && readdirplus {
+		initOp.Flags |= fusekernel.InitDoReaddirplus
+		if c.cfg.EnableReaddirplusAuto {
+			initOp.Flags |= fusekernel.InitReaddirplusAuto
+		}
+	}
+
+	// Drop cached pages when the kernel sees mtime or size change.
+	if c.cfg.EnableAutoInvalData && autoInvalData {
+		initOp.Flags |= fusekernel.InitAutoInvalData
+	}
+
+	// Allow shared mmap(2) of files opened with direct I/O (Linux >= 6.6).
+	if c.cfg.EnableDirectIOMmap && directIOAllowMmap {
+		initOp.Flags2 |= fusekernel.InitDirectIOAllowMmap
+		c.directIOMmap = true
+	}
+
+	// Allow passthrough to backing files, possibly on stacked file systems
+	// (Linux >= 6.9).
+	if c.cfg.MaxStackDepth > 0 && c.cfg.DisableWritebackCaching && passthrough {
+		initOp.Flags2 |= fusekernel.InitPassthrough
+		initOp.MaxStackDepth = c.cfg.MaxStackDepth
+		if initOp.MaxStackDepth > fusekernel.MaxStackDepth {
+			initOp.MaxStackDepth = fusekernel.MaxStackDepth
+		}
+	}
+
+	// Allow a successor to recover unanswered requests (Linux >= 6.9).
+	if c.cfg.EnableResend && hasResend {
+		initOp.Flags2 |= fusekernel.InitHasResend
+		c.resend = true
+	}
+
+	// Let InodeAttributes.DAX choose which files are mapped directly, on
+	// virtiofs mounts with dax=inode (Linux >= 5.17).
+	if c.cfg.EnablePerFileDAX && inodeDAX {
+		initOp.Flags2 |= fusekernel.InitHasInodeDAX
+	}
+
+	// Tell create ops about the caller's supplementary groups (Linux >= 6.3).
+	if c.cfg.EnableCreateSuppGroup && createSuppGroup {
+		initOp.Flags2 |= fusekernel.InitCreateSuppGroup
+	}
+
+	// Pass flock(2) locks to the file system (Linux >= 3.1).
+	if c.cfg.EnableFlockLocks && flockLocks {
+		initOp.Flags |= fusekernel.InitFlockLocks
+	}
+
+	// Pass fcntl(2) record locks to the file system.
+	if c.cfg.EnablePosixLocks && posixLocks {
+		initOp.Flags |= fusekernel.InitPosixLocks
+	}
+
+	// Allow export over NFS.
+	if c.cfg.EnableExportSupport && exportSupport {
+		initOp.Flags |= fusekernel.InitExportSupport
+	}
+
+	// OS X volume capabilities. These bits mean something else on Linux.
+	if runtime.GOOS == "darwin" {
+		if c.cfg.EnableVolumeRename && volRename {
+			initOp.Flags |= fusekernel.InitVolRename
+		}
+
+		if c.cfg.EnableXtimes && xtimes {
+			initOp.Flags |= fusekernel.InitXtimes
+		}
+
+		if c.cfg.EnableCaseInsensitive && caseInsensitive {
+			initOp.Flags |= fusekernel.InitCaseSensitive
+		}
+	}
+
+	// Let the server have its say.
+	if c.initHandler != nil {
+		if err := c.runInitHandler(initOp, kernelFlags); err != nil {
+			c.Reply(ctx, syscall.EPROTO)
+			return fmt.Errorf("OnInit: %v", err)
+		}
+	}
+
+	// The kernel only looks at the upper flags if told they're there.
+	if initOp.Flags2 != 0 {
+		initOp.Flags |= fusekernel.InitExt
+	}
+
+	c.info = ConnectionInfo{
+		KernelProtocolMajor: initOp.Kernel.Major,
+		KernelProtocolMinor: initOp.Kernel.Minor,
+		ProtocolMajor:       c.protocol.Major,
+		ProtocolMinor:       c.protocol.Minor,
+		KernelFlags:         kernelFlags,
+		Flags:               uint64(initOp.Flags) | uint64(initOp.Flags2)<<32,
+		MaxWrite:            initOp.MaxWrite,
+		MaxReadahead:        initOp.MaxReadahead,
+		MaxPages:            initOp.MaxPages,
+		MaxBackground:       initOp.MaxBackground,
+		CongestionThreshold: initOp.CongestionThreshold,
+	}
+
 	return c.Reply(ctx, nil)
 }
 
+// Return the largest write to ask the kernel for, and to make room for in
+// inbound buffers.
+func (c *Connection) maxWrite() int {
+	if c.cfg.MaxWrite == 0 || runtime.GOOS != "linux" {
+		return buffer.MaxWriteSize
+	}
+
+	pageSize := os.Getpagesize()
+	n := int(c.cfg.MaxWrite) / pageSize * pageSize
+	if max := math.MaxUint16 * pageSize; n > max {
+		n = max
+	}
+
+	if n < pageSize {
+		n = pageSize
+	}
+
+	return n
+}
+
+// Return the current time according to the configured clock.
+func (c *Connection) now() time.Time {
+	if c.cfg.Clock == nil {
+		return time.Now()
+	}
+
+	return c.cfg.Clock.Now()
+}
+
 // Log information for an operation with the given ID. calldepth is the depth
 // to use when recovering file:line information with runtime.Caller.
 func (c *Connection) debugLog(
@@ -275,6 +534,9 @@ func (c *Connection) beginOp(
 		c.recordCancelFunc(fuseID, cancel)
 	}
 
+	c.beginInFlight()
+	c.beginUnanswered(opCode, fuseID)
+
 	return ctx
 }
 
@@ -305,6 +567,8 @@ func (c *Connection) finishOp(
 		cancel()
 		delete(c.cancelFuncs, fuseID)
 	}
+
+	c.finishInFlightLocked()
 }
 
 // LOCKS_EXCLUDED(c.mu)
@@ -327,6 +591,11 @@ func (c *Connection) handleInterrupt(fuseID uint64) {
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
 	// Cf. http://comments.gmane.org/gmane.comp.file-systems.fuse.devel/14675
 	cancel, ok := c.cancelFuncs[fuseID]
+	if !ok && fuseID&fusekernel.UniqueResend != 0 {
+		// The request may have been sent again while we were working on it.
+		cancel, ok = c.cancelFuncs[fuseID&^fusekernel.UniqueResend]
+	}
+
 	if !ok {
 		return
 	}
@@ -349,15 +618,25 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 		//
 		//  *  ENODEV means fuse has hung up.
 		//
+		//  *  ECONNABORTED means the connection was aborted, and every read
+		//     from now on fails the same way. Hang up too, rather than spin.
+		//
 		//  *  EINTR means we should try again. (This seems to happen often on
 		//     OS X, cf. http://golang.org/issue/11180)
 		//
+		//  *  ENOENT means the request we were about to be given was
+		//     interrupted and dropped. Try again, as libfuse does.
+		//
 		if pe, ok := err.(*os.PathError); ok {
 			switch pe.Err {
 			case syscall.ENODEV:
 				err = io.EOF
 
-			case syscall.EINTR:
+			case syscall.ECONNABORTED:
+				c.setHangupCause(ErrConnectionAborted)
+				err = io.EOF
+
+			case syscall.EINTR, syscall.ENOENT:
 				err = nil
 				continue
 			}
@@ -374,17 +653,7 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 
 // Write the supplied message to the kernel.
 func (c *Connection) writeMessage(msg []byte) error {
-	// Avoid the retry loop in os.File.Write.
-	n, err := syscall.Write(int(c.dev.Fd()), msg)
-	if err != nil {
-		return err
-	}
-
-	if n != len(msg) {
-		return fmt.Errorf("Wrote %d bytes; expected %d", n, len(msg))
-	}
-
-	return nil
+	return c.writeDevice([][]byte{msg})
 }
 
 // ReadOp consumes the next op from the kernel process, returning the op and a
@@ -397,6 +666,10 @@ func (c *Connection) writeMessage(msg []byte) error {
 // This function delivers ops in exactly the order they are received from
 // /dev/fuse. It must not be called multiple times concurrently.
 //
+// While no op arrives, ReadOp waits in a single read(2), or in the runtime's
+// poller if MountConfig.PollDevice is set, without waking up: an idle mount
+// makes no system calls and starts no timers.
+//
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 	// Keep going until we find a request we know how to convert.
@@ -407,10 +680,19 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 			return nil, nil, err
 		}
 
+		received := c.now()
+
+		// Special case: drop copies of requests sent again that we've seen.
+		if c.absorbResent(inMsg) {
+			c.putInMessage(inMsg)
+			continue
+		}
+
 		// Convert the message to an op.
 		outMsg := c.getOutMessage()
 		op, err = convertInMessage(&c.cfg, inMsg, outMsg, c.protocol)
 		if err != nil {
+			c.putInMessage(inMsg)
 			c.putOutMessage(outMsg)
 			return nil, nil, fmt.Errorf("convertInMessage: %v", err)
 		}
@@ -423,18 +705,118 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 		// Special case: handle interrupt requests inline.
 		if interruptOp, ok := op.(*interruptOp); ok {
 			c.handleInterrupt(interruptOp.FuseID)
+			c.putInMessage(inMsg)
+			c.putOutMessage(outMsg)
+			continue
+		}
+
+		// Special case: hand replies to NotifyRetrieve to whoever is waiting.
+		if replyOp, ok := op.(*notifyReplyOp); ok {
+			c.handleNotifyReply(replyOp)
+			c.putInMessage(inMsg)
+			c.putOutMessage(outMsg)
 			continue
 		}
 
 		// Set up a context that remembers information about this op.
 		ctx := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
-		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op})
+		background, congested := c.beginBackground(op)
+		ctx = context.WithValue(ctx, contextKey, opState{
+			conn:       c,
+			inMsg:      inMsg,
+			outMsg:     outMsg,
+			op:         op,
+			header:     *inMsg.Header(),
+			mem:        new(opMemory),
+			background: background,
+			congested:  congested,
+			received:   received,
+		})
+
+		// Tell the file system what the kernel allows for the file it opens.
+		if openOp, ok := op.(*fuseops.OpenFileOp); ok {
+			openOp.DirectIOMmap = c.directIOMmap
+		}
+
+		// Turn away users that allow_root doesn't let in.
+		if !c.allowed(op, inMsg.Header().Uid) {
+			c.Reply(ctx, syscall.EACCES)
+			continue
+		}
+
+		// Reject names the file system has told us it can't store.
+		if err := c.checkLimits(op); err != nil {
+			c.Reply(ctx, err)
+			continue
+		}
 
 		// Return the op to the user.
 		return ctx, op, nil
 	}
 }
 
+// Is the user allowed to send the op? With MountConfig.AllowRoot on Linux,
+// where the kernel is told allow_other, only root and the user the process
+// runs as are, as in libfuse. Ops on handles already open, which may have
+// been passed to another user, and those that take no reply are let through.
+func (c *Connection) allowed(op interface{}, uid uint32) bool {
+	if !c.cfg.AllowRoot || runtime.GOOS == "darwin" {
+		return true
+	}
+
+	if uid == 0 || uid == uint32(os.Getuid()) {
+		return true
+	}
+
+	switch op.(type) {
+	case *initOp,
+		*fuseops.ReadFileOp,
+		*fuseops.WriteFileOp,
+		*fuseops.SyncFileOp,
+		*fuseops.ReleaseFileHandleOp,
+		*fuseops.ReadDirOp,
+		*fuseops.ReadDirPlusOp,
+		*fuseops.ReleaseDirHandleOp,
+		*fuseops.ForgetInodeOp,
+		*fuseops.BatchForgetOp,
+		*fuseops.DestroyOp:
+		return true
+	}
+
+	return false
+}
+
+// Return ENAMETOOLONG if the op involves a new or looked-up name or a symlink
+// target longer than configured.
+func (c *Connection) checkLimits(op interface{}) error {
+	var name string
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		name = typed.Name
+	case *fuseops.MkDirOp:
+		name = typed.Name
+	case *fuseops.MkNodeOp:
+		name = typed.Name
+	case *fuseops.CreateFileOp:
+		name = typed.Name
+	case *fuseops.CreateLinkOp:
+		name = typed.Name
+	case *fuseops.RenameOp:
+		name = typed.NewName
+	case *fuseops.CreateSymlinkOp:
+		name = typed.Name
+		if max := c.cfg.MaxSymlinkLength; max != 0 && uint32(len(typed.Target)) > max {
+			return syscall.ENAMETOOLONG
+		}
+	}
+
+	if max := c.cfg.MaxNameLength; max != 0 && uint32(len(name)) > max {
+		return syscall.ENAMETOOLONG
+	}
+
+	return nil
+}
+
 // Skip errors that happen as a matter of course, since they spook users.
 func (c *Connection) shouldLogError(
 	op interface{},
@@ -458,7 +840,7 @@ func (c *Connection) shouldLogError(
 			return false
 		}
 	case *fuseops.GetXattrOp, *fuseops.ListXattrOp:
-		if err == syscall.ENOSYS || err == syscall.ENODATA || err == syscall.ERANGE {
+		if err == syscall.ENOSYS || err == ENOATTR || err == syscall.ERANGE {
 			return false
 		}
 	case *unknownOp:
@@ -471,8 +853,6 @@ func (c *Connection) shouldLogError(
 	return true
 }
 
-var writeLock sync.Mutex
-
 // Reply replies to an op previously read using ReadOp, with the supplied error
 // (or nil if successful). The context must be the context returned by ReadOp.
 //
@@ -489,7 +869,7 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 	op := state.op
 	inMsg := state.inMsg
 	outMsg := state.outMsg
-	fuseID := inMsg.Header().Unique
+	fuseID := state.header.Unique
 
 	defer func() {
 		// Invoke any callbacks set by the FUSE server after the response to the kernel is
@@ -499,13 +879,19 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 			callback()
 		}
 
-		// Make sure we destroy the messages when we're done.
-		c.putInMessage(inMsg)
+		// Make sure we destroy the messages when we're done, unless the file
+		// system released the inbound one already.
+		if !state.mem.released.Swap(true) {
+			c.putInMessage(inMsg)
+		}
 		c.putOutMessage(outMsg)
 	}()
 
 	// Clean up state for this op.
-	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
+	c.finishOp(state.header.Opcode, fuseID)
+	if state.background {
+		c.finishBackground()
+	}
 
 	// Debug logging
 	if c.debugLogger != nil {
@@ -522,20 +908,17 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 	}
 
 	// Send the reply to the kernel, if one is required.
-	noResponse := c.kernelResponse(outMsg, inMsg.Header().Unique, op, opErr)
+	noResponse := c.kernelResponse(outMsg, fuseID, op, opErr)
+	fixReleasedResponse(outMsg, op, state.mem)
 
 	if !noResponse {
 		var err error
-		if outMsg.Sglist != nil {
-			if fusekernel.IsPlatformFuseT {
-				// writev is not atomic on macos, restrict to fuse-t platform
-				writeLock.Lock()
-				defer writeLock.Unlock()
-			}
-			_, err = writev(int(c.dev.Fd()), outMsg.Sglist)
+		if c.resend {
+			err = c.sendAnswer(outMsg, fuseID)
 		} else {
-			err = c.writeMessage(outMsg.OutHeaderBytes())
+			err = c.writeOutMessage(outMsg)
 		}
+
 		if err != nil {
 			writeErrMsg := fmt.Sprintf("writeMessage: %v %v", err, outMsg.OutHeaderBytes())
 			if c.errorLogger != nil {
@@ -549,6 +932,15 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 	return nil
 }
 
+// Write a complete message to the kernel.
+func (c *Connection) writeOutMessage(outMsg *buffer.OutMessage) error {
+	if outMsg.Sglist == nil {
+		return c.writeMessage(outMsg.OutHeaderBytes())
+	}
+
+	return c.writeDevice(outMsg.Sglist)
+}
+
 func (c *Connection) callbackForOp(op interface{}) func() {
 	switch o := op.(type) {
 	case *fuseops.ReadFileOp:
@@ -565,5 +957,24 @@ func (c *Connection) close() error {
 	// Posix doesn't say that close can be called concurrently with read or
 	// write, but luckily we exclude the possibility of a race by requiring the
 	// user to respond to all ops first.
-	return c.dev.Close()
+	if err := c.dev.Close(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hangupCause
+}
+
+// Record why the kernel is hanging up, unless that is already known.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) setHangupCause(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hangupCause == nil {
+		c.hangupCause = err
+	}
 }
@@ -0,0 +1,2490 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+// Run the init handshake for a connection with the supplied config against a
+// fake kernel offering the supplied flags, returning the reply.
+func initConnection(
+	t *testing.T,
+	cfg MountConfig,
+	in fusekernel.InitIn,
+	flags2 fusekernel.InitFlags2) fusekernel.InitOut {
+	t.Helper()
+	return initConnectionWithHandler(t, cfg, in, flags2, nil)
+}
+
+// Like initConnection, but with the supplied InitHandler, which may be nil.
+func initConnectionWithHandler(
+	t *testing.T,
+	cfg MountConfig,
+	in fusekernel.InitIn,
+	flags2 fusekernel.InitFlags2,
+	h InitHandler) fusekernel.InitOut {
+	t.Helper()
+
+	// Datagram sockets preserve message boundaries, like the fuse device.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+	defer dev.Close()
+
+	if cfg.OpContext == nil {
+		cfg.OpContext = context.Background()
+	}
+
+	if in.Major == 0 {
+		in.Major = 7
+		in.Minor = 31
+	}
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, in)
+	if fusekernel.InitFlags(in.Flags)&fusekernel.InitExt != 0 {
+		binary.Write(&body, binary.LittleEndian, fusekernel.InitInExt{Flags2: uint32(flags2)})
+	}
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + body.Len()),
+		Opcode: uint32(fusekernel.OpInit),
+		Unique: 1,
+	})
+	msg.Write(body.Bytes())
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	c := &Connection{
+		cfg:         cfg,
+		dev:         dev,
+		cancelFuncs: make(map[uint64]func()),
+		initHandler: h,
+	}
+
+	if err := c.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	r := bytes.NewReader(buf[:n])
+
+	var header fusekernel.OutHeader
+	var out fusekernel.InitOut
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		t.Fatalf("Reading header: %v", err)
+	}
+
+	if header.Error != 0 || header.Unique != 1 {
+		t.Fatalf("Unexpected header: %+v", header)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &out); err != nil {
+		t.Fatalf("Reading InitOut: %v", err)
+	}
+
+	return out
+}
+
+func Test_InitDirectIOMmap(t *testing.T) {
+	withExt := fusekernel.InitIn{
+		Major: 7,
+		Minor: 39,
+		Flags: uint32(fusekernel.InitExt),
+	}
+
+	testCases := []struct {
+		name   string
+		enable bool
+		in     fusekernel.InitIn
+		want   bool
+	}{
+		{"disabled", false, withExt, false},
+		{"enabled", true, withExt, true},
+		{"old kernel", true, fusekernel.InitIn{}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := initConnection(
+				t,
+				MountConfig{EnableDirectIOMmap: tc.enable},
+				tc.in,
+				fusekernel.InitDirectIOAllowMmap)
+
+			got := fusekernel.InitFlags2(out.Flags2)&fusekernel.InitDirectIOAllowMmap != 0
+			if got != tc.want {
+				t.Errorf("InitDirectIOAllowMmap = %v, want %v", got, tc.want)
+			}
+
+			ext := fusekernel.InitFlags(out.Flags)&fusekernel.InitExt != 0
+			if ext != tc.want {
+				t.Errorf("InitExt = %v, want %v", ext, tc.want)
+			}
+		})
+	}
+}
+
+func Test_InitReaddirplus(t *testing.T) {
+	offered := fusekernel.InitIn{
+		Flags: uint32(fusekernel.InitDoReaddirplus | fusekernel.InitReaddirplusAuto),
+	}
+
+	testCases := []struct {
+		name     string
+		cfg      MountConfig
+		in       fusekernel.InitIn
+		wantPlus bool
+		wantAuto bool
+	}{
+		{"disabled", MountConfig{}, offered, false, false},
+		{"enabled", MountConfig{EnableReaddirplus: true}, offered, true, false},
+		{"auto", MountConfig{EnableReaddirplus: true, EnableReaddirplusAuto: true}, offered, true, true},
+		{"not offered", MountConfig{EnableReaddirplus: true}, fusekernel.InitIn{}, false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := initConnection(t, tc.cfg, tc.in, 0)
+			flags := fusekernel.InitFlags(out.Flags)
+
+			if got := flags&fusekernel.InitDoReaddirplus != 0; got != tc.wantPlus {
+				t.Errorf("InitDoReaddirplus = %v, want %v", got, tc.wantPlus)
+			}
+
+			if got := flags&fusekernel.InitReaddirplusAuto != 0; got != tc.wantAuto {
+				t.Errorf("InitReaddirplusAuto = %v, want %v", got, tc.wantAuto)
+			}
+		})
+	}
+}
+
+func Test_WritebackCache(t *testing.T) {
+	offered := fusekernel.InitIn{
+		Flags: uint32(fusekernel.InitWritebackCache),
+	}
+
+	testCases := []struct {
+		name string
+		cfg  MountConfig
+		in   fusekernel.InitIn
+		want bool
+	}{
+		{"enabled", MountConfig{}, offered, true},
+		{"disabled", MountConfig{DisableWritebackCaching: true}, offered, false},
+		{"not offered", MountConfig{}, fusekernel.InitIn{}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := initConnection(t, tc.cfg, tc.in, 0)
+
+			got := fusekernel.InitFlags(out.Flags)&fusekernel.InitWritebackCache != 0
+			if got != tc.want {
+				t.Errorf("InitWritebackCache = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	convert := func(opcode uint32, args []byte) interface{} {
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + len(args)),
+			Opcode: opcode,
+			Unique: 1,
+			Nodeid: 2,
+		})
+		msg.Write(args)
+
+		inMsg := buffer.NewInMessage()
+		if err := inMsg.Init(&msg); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		var outMsg buffer.OutMessage
+		outMsg.Reset()
+		op, err := convertInMessage(&MountConfig{}, inMsg, &outMsg, fusekernel.Protocol{Major: 7, Minor: 31})
+		if err != nil {
+			t.Fatalf("convertInMessage(%d): %v", opcode, err)
+		}
+
+		return op
+	}
+
+	// Pages written back are marked as such.
+	for _, flags := range []fusekernel.WriteFlags{0, fusekernel.WriteCache} {
+		var args bytes.Buffer
+		binary.Write(&args, binary.LittleEndian, fusekernel.WriteIn{Size: 4, WriteFlags: uint32(flags)})
+		args.WriteString("taco")
+
+		write := convert(fusekernel.OpWrite, args.Bytes()).(*fuseops.WriteFileOp)
+		if write.Cached != (flags != 0) || string(write.Data) != "taco" {
+			t.Errorf("WriteFileOp with flags %v: %+v", flags, write)
+		}
+	}
+
+	// And the times of the pages are sent afterwards.
+	var in fusekernel.SetattrIn
+	in.Valid = uint32(fusekernel.SetattrMtime | fusekernel.SetattrCtime)
+	in.Mtime, in.MtimeNsec = 100, 1
+	in.Ctime, in.CtimeNsec = 200, 2
+
+	var args bytes.Buffer
+	binary.Write(&args, binary.LittleEndian, in)
+
+	setattr := convert(fusekernel.OpSetattr, args.Bytes()).(*fuseops.SetInodeAttributesOp)
+	if setattr.Mtime == nil || !setattr.Mtime.Equal(time.Unix(100, 1)) ||
+		setattr.Ctime == nil || !setattr.Ctime.Equal(time.Unix(200, 2)) {
+		t.Errorf("SetInodeAttributesOp: %v, %v", setattr.Mtime, setattr.Ctime)
+	}
+}
+
+// A server that answers every op with ENOSYS, after handing it to the test.
+type opRecorder chan interface{}
+
+func (r opRecorder) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		r <- op
+		c.Reply(ctx, ENOSYS)
+	}
+}
+
+func Test_DirectIOMmapSession(t *testing.T) {
+	for _, allowed := range []bool{false, true} {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+		if err != nil {
+			t.Fatalf("Socketpair: %v", err)
+		}
+
+		kernel := os.NewFile(uintptr(fds[0]), "kernel")
+		dev := os.NewFile(uintptr(fds[1]), "dev")
+
+		ops := make(opRecorder, 1)
+		mfs, err := Resume(
+			"/mnt",
+			dev,
+			Session{ProtocolMajor: 7, ProtocolMinor: 31, DirectIOMmap: allowed},
+			ops,
+			&MountConfig{})
+		if err != nil {
+			t.Fatalf("Resume: %v", err)
+		}
+
+		if _, s := mfs.Session(); s.DirectIOMmap != allowed {
+			t.Errorf("Session: %+v", s)
+		}
+
+		// File systems learn the capability when opening files.
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + 8),
+			Opcode: uint32(fusekernel.OpOpen),
+			Unique: 1,
+			Nodeid: 2,
+		})
+		binary.Write(&msg, binary.LittleEndian, fusekernel.OpenIn{})
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		op := (<-ops).(*fuseops.OpenFileOp)
+		if op.DirectIOMmap != allowed {
+			t.Errorf("Session.DirectIOMmap = %v: OpenFileOp.DirectIOMmap = %v", allowed, op.DirectIOMmap)
+		}
+
+		kernel.Close()
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}
+}
+
+func Test_InitPassthrough(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 40,
+		Flags: uint32(fusekernel.InitExt),
+	}
+
+	testCases := []struct {
+		name      string
+		cfg       MountConfig
+		wantDepth uint32
+	}{
+		{"disabled", MountConfig{DisableWritebackCaching: true}, 0},
+		{"writeback", MountConfig{MaxStackDepth: 1}, 0},
+		{"enabled", MountConfig{MaxStackDepth: 1, DisableWritebackCaching: true}, 1},
+		{"clamped", MountConfig{MaxStackDepth: 5, DisableWritebackCaching: true}, 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := initConnection(t, tc.cfg, in, fusekernel.InitPassthrough)
+
+			got := fusekernel.InitFlags2(out.Flags2)&fusekernel.InitPassthrough != 0
+			if got != (tc.wantDepth != 0) {
+				t.Errorf("InitPassthrough = %v", got)
+			}
+
+			if out.MaxStackDepth != tc.wantDepth {
+				t.Errorf("MaxStackDepth = %d, want %d", out.MaxStackDepth, tc.wantDepth)
+			}
+		})
+	}
+}
+
+func Test_InitPerFileDAX(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 36,
+		Flags: uint32(fusekernel.InitExt),
+	}
+
+	for _, enable := range []bool{false, true} {
+		out := initConnection(t, MountConfig{EnablePerFileDAX: enable}, in, fusekernel.InitHasInodeDAX)
+
+		got := fusekernel.InitFlags2(out.Flags2)&fusekernel.InitHasInodeDAX != 0
+		if got != enable {
+			t.Errorf("EnablePerFileDAX = %v: InitHasInodeDAX = %v", enable, got)
+		}
+	}
+}
+
+func Test_InitMaxReadahead(t *testing.T) {
+	testCases := []struct {
+		configured uint32
+		want       uint32
+	}{
+		{0, 1 << 20},
+		{4 << 20, 4 << 20},
+		{64 << 10, 64 << 10},
+		{1, 1},
+	}
+
+	for _, tc := range testCases {
+		in := fusekernel.InitIn{Major: 7, Minor: 31, MaxReadahead: 128 << 10}
+		out := initConnection(t, MountConfig{MaxReadahead: tc.configured}, in, 0)
+
+		if out.MaxReadahead != tc.want {
+			t.Errorf("%d: MaxReadahead = %d, want %d", tc.configured, out.MaxReadahead, tc.want)
+		}
+	}
+}
+
+func Test_InitMaxWrite(t *testing.T) {
+	page := uint32(os.Getpagesize())
+	testCases := []struct {
+		configured uint32
+		maxWrite   uint32
+		maxPages   uint16
+	}{
+		{0, 1 << 20, 256},
+		{4 << 20, 4 << 20, uint16((4 << 20) / page)},
+		{64*page + 1, 64 * page, 256},
+		{1, page, 256},
+	}
+
+	for _, tc := range testCases {
+		cfg := MountConfig{MaxWrite: tc.configured}
+		out := initConnection(t, cfg, fusekernel.InitIn{Major: 7, Minor: 31}, 0)
+
+		if out.MaxWrite != tc.maxWrite || out.MaxPages != tc.maxPages {
+			t.Errorf("%d: max_write %d, max_pages %d; want %d, %d",
+				tc.configured, out.MaxWrite, out.MaxPages, tc.maxWrite, tc.maxPages)
+		}
+
+		// Inbound buffers have room for the largest write.
+		c := &Connection{cfg: cfg}
+		if got, want := c.getInMessage().Cap(), int(page+tc.maxWrite); got != want {
+			t.Errorf("%d: buffer of %d bytes, want %d", tc.configured, got, want)
+		}
+	}
+}
+
+func Test_InitExportSupport(t *testing.T) {
+	testCases := []struct {
+		enable  bool
+		offered bool
+		want    bool
+	}{
+		{false, true, false},
+		{true, false, false},
+		{true, true, true},
+	}
+
+	for _, tc := range testCases {
+		in := fusekernel.InitIn{Major: 7, Minor: 31}
+		if tc.offered {
+			in.Flags = uint32(fusekernel.InitExportSupport)
+		}
+
+		out := initConnection(t, MountConfig{EnableExportSupport: tc.enable}, in, 0)
+
+		got := fusekernel.InitFlags(out.Flags)&fusekernel.InitExportSupport != 0
+		if got != tc.want {
+			t.Errorf("%+v: InitExportSupport = %v", tc, got)
+		}
+	}
+}
+
+func Test_SyncDatasync(t *testing.T) {
+	for _, opcode := range []uint32{fusekernel.OpFsync, fusekernel.OpFsyncdir} {
+		for _, flags := range []uint32{0, fusekernel.FsyncFdatasync} {
+			in := fusekernel.FsyncIn{Fh: 3, FsyncFlags: flags}
+
+			var msg bytes.Buffer
+			binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+				Len:    uint32(fusekernel.InHeaderSize + binary.Size(in)),
+				Opcode: opcode,
+				Unique: 1,
+				Nodeid: 17,
+			})
+			binary.Write(&msg, binary.LittleEndian, in)
+
+			inMsg := buffer.NewInMessage()
+			if err := inMsg.Init(&msg); err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+
+			var outMsg buffer.OutMessage
+			outMsg.Reset()
+			op, err := convertInMessage(&MountConfig{}, inMsg, &outMsg, fusekernel.Protocol{Major: 7, Minor: 31})
+			if err != nil {
+				t.Fatalf("convertInMessage(%d): %v", opcode, err)
+			}
+
+			sync := op.(*fuseops.SyncFileOp)
+			if sync.Inode != 17 || sync.Handle != 3 || sync.Datasync != (flags != 0) {
+				t.Errorf("Opcode %d, flags %d: %+v", opcode, flags, sync)
+			}
+		}
+	}
+}
+
+func Test_CreateSuppGroup(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 38,
+		Flags: uint32(fusekernel.InitExt),
+	}
+
+	for _, enable := range []bool{false, true} {
+		out := initConnection(t, MountConfig{EnableCreateSuppGroup: enable}, in, fusekernel.InitCreateSuppGroup)
+
+		got := fusekernel.InitFlags2(out.Flags2)&fusekernel.InitCreateSuppGroup != 0
+		if got != enable {
+			t.Errorf("EnableCreateSuppGroup = %v: InitCreateSuppGroup = %v", enable, got)
+		}
+	}
+
+	// The group extension follows the arguments of create requests.
+	convert := func(opcode uint32, args []byte) interface{} {
+		var ext bytes.Buffer
+		binary.Write(&ext, binary.LittleEndian, fusekernel.ExtHeader{Size: 16, Type: fusekernel.ExtGroups})
+		binary.Write(&ext, binary.LittleEndian, fusekernel.SuppGroups{NrGroups: 1})
+		binary.Write(&ext, binary.LittleEndian, uint32(1234))
+
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:         uint32(fusekernel.InHeaderSize + len(args) + ext.Len()),
+			Opcode:      opcode,
+			Unique:      1,
+			Nodeid:      1,
+			Gid:         100,
+			TotalExtlen: uint16(ext.Len() / 8),
+		})
+		msg.Write(args)
+		msg.Write(ext.Bytes())
+
+		inMsg := buffer.NewInMessage()
+		if err := inMsg.Init(&msg); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		var outMsg buffer.OutMessage
+		outMsg.Reset()
+		op, err := convertInMessage(&MountConfig{}, inMsg, &outMsg, fusekernel.Protocol{Major: 7, Minor: 31})
+		if err != nil {
+			t.Fatalf("convertInMessage(%d): %v", opcode, err)
+		}
+
+		return op
+	}
+
+	var mkdirArgs bytes.Buffer
+	binary.Write(&mkdirArgs, binary.LittleEndian, fusekernel.MkdirIn{Mode: 0755})
+	mkdirArgs.WriteString("dir\x00")
+
+	mkdir := convert(fusekernel.OpMkdir, mkdirArgs.Bytes()).(*fuseops.MkDirOp)
+	if mkdir.Name != "dir" || mkdir.OpContext.Gid != 100 || len(mkdir.OpContext.Groups) != 1 || mkdir.OpContext.Groups[0] != 1234 {
+		t.Errorf("MkDirOp: %q, %+v", mkdir.Name, mkdir.OpContext)
+	}
+
+	symlink := convert(fusekernel.OpSymlink, []byte("link\x00target\x00")).(*fuseops.CreateSymlinkOp)
+	if symlink.Name != "link" || symlink.Target != "target" || len(symlink.OpContext.Groups) != 1 {
+		t.Errorf("CreateSymlinkOp: %q -> %q, %+v", symlink.Name, symlink.Target, symlink.OpContext)
+	}
+}
+
+func Test_FlockLocks(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 31,
+		Flags: uint32(fusekernel.InitFlockLocks),
+	}
+
+	for _, enable := range []bool{false, true} {
+		out := initConnection(t, MountConfig{EnableFlockLocks: enable}, in, 0)
+
+		got := fusekernel.InitFlags(out.Flags)&fusekernel.InitFlockLocks != 0
+		if got != enable {
+			t.Errorf("EnableFlockLocks = %v: InitFlockLocks = %v", enable, got)
+		}
+	}
+
+	convert := func(opcode uint32, args interface{}) interface{} {
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + binary.Size(args)),
+			Opcode: opcode,
+			Unique: 1,
+			Nodeid: 17,
+		})
+		binary.Write(&msg, binary.LittleEndian, args)
+
+		inMsg := buffer.NewInMessage()
+		if err := inMsg.Init(&msg); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+
+		var outMsg buffer.OutMessage
+		outMsg.Reset()
+		op, err := convertInMessage(&MountConfig{}, inMsg, &outMsg, fusekernel.Protocol{Major: 7, Minor: 31})
+		if err != nil {
+			t.Fatalf("convertInMessage(%d): %v", opcode, err)
+		}
+
+		return op
+	}
+
+	lk := fusekernel.LkIn{Fh: 3, Owner: 0xabc, LkFlags: fusekernel.LkFlock}
+	lk.Lk.Type = fusekernel.LkWrite
+
+	flock, ok := convert(fusekernel.OpSetlkw, lk).(*fuseops.FlockOp)
+	if !ok {
+		t.Fatal("SETLKW with LkFlock not converted to FlockOp")
+	}
+
+	want := fuseops.FlockOp{
+		Inode:     17,
+		Handle:    3,
+		Owner:     0xabc,
+		Type:      fuseops.LockExclusive,
+		Wait:      true,
+		OpContext: fuseops.OpContext{FuseID: 1},
+	}
+
+	if !reflect.DeepEqual(*flock, want) {
+		t.Errorf("FlockOp = %+v, want %+v", *flock, want)
+	}
+
+	release := convert(fusekernel.OpRelease, fusekernel.ReleaseIn{
+		Fh:           3,
+		ReleaseFlags: uint32(fusekernel.ReleaseFlockUnlock),
+		LockOwner:    0xabc,
+	}).(*fuseops.ReleaseFileHandleOp)
+
+	if !release.UnlockFlocks || release.LockOwner != 0xabc {
+		t.Errorf("ReleaseFileHandleOp = %+v", *release)
+	}
+}
+
+// A server that records the ops it reads, reporting a conflict for every
+// GetLkOp and waiting for every SetLkWaitOp to be interrupted.
+type lockServer struct {
+	ops chan<- interface{}
+}
+
+func (s lockServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		s.ops <- op
+		switch typed := op.(type) {
+		case *fuseops.GetLkOp:
+			typed.Conflict = fuseops.FileLock{Start: 10, End: 19, Type: fuseops.LockExclusive, Pid: 1234}
+			c.Reply(ctx, nil)
+
+		case *fuseops.SetLkWaitOp:
+			go func() {
+				<-ctx.Done()
+				c.Reply(ctx, syscall.EINTR)
+			}()
+
+		default:
+			c.Reply(ctx, nil)
+		}
+	}
+}
+
+func Test_PosixLocks(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 31,
+		Flags: uint32(fusekernel.InitPosixLocks),
+	}
+
+	for _, enable := range []bool{false, true} {
+		out := initConnection(t, MountConfig{EnablePosixLocks: enable}, in, 0)
+
+		got := fusekernel.InitFlags(out.Flags)&fusekernel.InitPosixLocks != 0
+		if got != enable {
+			t.Errorf("EnablePosixLocks = %v: InitPosixLocks = %v", enable, got)
+		}
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	ops := make(chan interface{}, 10)
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		lockServer{ops},
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	send := func(opcode uint32, unique uint64, args interface{}) {
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + binary.Size(args)),
+			Opcode: opcode,
+			Unique: unique,
+			Nodeid: 17,
+		})
+		binary.Write(&msg, binary.LittleEndian, args)
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	reply := func() []byte {
+		buf := make([]byte, 4096)
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		return buf[:n]
+	}
+
+	lk := fusekernel.LkIn{Fh: 3, Owner: 0xabc}
+	lk.Lk.Start = 0
+	lk.Lk.End = 99
+	lk.Lk.Type = fusekernel.LkWrite
+	lk.Lk.Pid = 42
+
+	// GETLK is answered with the conflicting lock.
+	send(fusekernel.OpGetlk, 2, lk)
+	getlk := (<-ops).(*fuseops.GetLkOp)
+	want := fuseops.FileLock{Start: 0, End: 99, Type: fuseops.LockExclusive, Pid: 42}
+	if getlk.Inode != 17 || getlk.Handle != 3 || getlk.Owner != 0xabc || getlk.Lock != want {
+		t.Errorf("GetLkOp = %+v", getlk)
+	}
+
+	got := reply()
+	var out fusekernel.LkOut
+	if len(got) != int(unsafe.Sizeof(fusekernel.OutHeader{})+unsafe.Sizeof(out)) {
+		t.Fatalf("GETLK reply is %d bytes", len(got))
+	}
+
+	out = *(*fusekernel.LkOut)(unsafe.Pointer(&got[unsafe.Sizeof(fusekernel.OutHeader{})]))
+	if out.Lk.Start != 10 || out.Lk.End != 19 || out.Lk.Type != fusekernel.LkWrite || out.Lk.Pid != 1234 {
+		t.Errorf("LkOut = %+v", out)
+	}
+
+	// SETLK and SETLKW become different ops.
+	lk.Lk.Type = fusekernel.LkUnlock
+	send(fusekernel.OpSetlk, 3, lk)
+	if setlk := (<-ops).(*fuseops.SetLkOp); setlk.Lock.Type != fuseops.LockUnlock {
+		t.Errorf("SetLkOp = %+v", setlk)
+	}
+
+	reply()
+
+	lk.Lk.Type = fusekernel.LkRead
+	send(fusekernel.OpSetlkw, 4, lk)
+	if setlkw := (<-ops).(*fuseops.SetLkWaitOp); setlkw.Lock.Type != fuseops.LockShared {
+		t.Errorf("SetLkWaitOp = %+v", setlkw)
+	}
+
+	// Interrupting the waiter cancels its context.
+	send(fusekernel.OpInterrupt, 5, fusekernel.InterruptIn{Unique: 4})
+	got = reply()
+	header := *(*fusekernel.OutHeader)(unsafe.Pointer(&got[0]))
+	if header.Unique != 4 || header.Error != -int32(syscall.EINTR) {
+		t.Errorf("SETLKW reply = %+v", header)
+	}
+
+	// Flushes carry the lock owner, whose locks are to be released.
+	send(fusekernel.OpFlush, 6, fusekernel.FlushIn{Fh: 3, LockOwner: 0xabc})
+	if flush := (<-ops).(*fuseops.FlushFileOp); flush.LockOwner != 0xabc {
+		t.Errorf("FlushFileOp = %+v", flush)
+	}
+
+	reply()
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_InitDisableKernelCaching(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 31,
+		Flags: uint32(fusekernel.InitWritebackCache | fusekernel.InitCacheSymlinks),
+	}
+
+	for _, disable := range []bool{false, true} {
+		cfg := MountConfig{EnableSymlinkCaching: true, DisableKernelCaching: disable}
+		out := initConnection(t, cfg, in, 0)
+
+		flags := fusekernel.InitFlags(out.Flags)
+		for _, f := range []fusekernel.InitFlags{fusekernel.InitWritebackCache, fusekernel.InitCacheSymlinks} {
+			if got := flags&f != 0; got == disable {
+				t.Errorf("DisableKernelCaching %v: %v = %v", disable, f, got)
+			}
+		}
+	}
+}
+
+func Test_DisableKernelCaching(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	later := clock.Now().Add(time.Hour)
+
+	for _, disable := range []bool{false, true} {
+		c := &Connection{
+			cfg:      MountConfig{Clock: clock, DisableKernelCaching: disable},
+			protocol: fusekernel.Protocol{Major: 7, Minor: 31},
+		}
+
+		want := uint64(3600)
+		if disable {
+			want = 0
+		}
+
+		// Entries and attributes.
+		var m buffer.OutMessage
+		m.Reset()
+		c.kernelResponseForOp(&m, &fuseops.LookUpInodeOp{
+			Entry: fuseops.ChildInodeEntry{
+				Child:                17,
+				EntryExpiration:      later,
+				AttributesExpiration: later,
+			},
+		})
+
+		e := (*fusekernel.EntryOut)(unsafe.Pointer(&m.Sglist[1][0]))
+		if e.EntryValid != want || e.AttrValid != want {
+			t.Errorf("DisableKernelCaching %v: lookup valid for %d, %d", disable, e.EntryValid, e.AttrValid)
+		}
+
+		m.Reset()
+		c.kernelResponseForOp(&m, &fuseops.GetInodeAttributesOp{Inode: 17, AttributesExpiration: later})
+
+		a := (*fusekernel.AttrOut)(unsafe.Pointer(&m.Sglist[1][0]))
+		if a.AttrValid != want {
+			t.Errorf("DisableKernelCaching %v: attributes valid for %d", disable, a.AttrValid)
+		}
+
+		// Page cache.
+		m.Reset()
+		c.kernelResponseForOp(&m, &fuseops.OpenFileOp{KeepPageCache: true})
+
+		o := (*fusekernel.OpenOut)(unsafe.Pointer(&m.Sglist[1][0]))
+		if got := o.OpenFlags&uint32(fusekernel.OpenKeepCache) != 0; got == disable {
+			t.Errorf("DisableKernelCaching %v: OpenKeepCache = %v", disable, got)
+		}
+
+		// Entries returned by ReadDirPlusOp, written at the end of the message
+		// as fuseutil.WriteDirentPlus would: a fuse_entry_out and a
+		// fuse_dirent, padded to 8 bytes.
+		const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+		const size = entrySize + fusekernel.DirentSize + 8
+		dst := make([]byte, 2*size)
+		for i, name := range []string{"foo", "barbaz"} {
+			entry := dst[i*size:]
+			e := (*fusekernel.EntryOut)(unsafe.Pointer(&entry[0]))
+			e.Nodeid = uint64(i + 2)
+			e.EntryValid = 3600
+			e.AttrValid = 3600
+
+			d := (*fusekernel.Dirent)(unsafe.Pointer(&entry[entrySize]))
+			d.Ino = e.Nodeid
+			d.Namelen = uint32(len(name))
+			copy(entry[entrySize+fusekernel.DirentSize:], name)
+		}
+
+		m.Reset()
+		m.Append(dst)
+		c.kernelResponseForOp(&m, &fuseops.ReadDirPlusOp{Dst: dst, BytesRead: len(dst)})
+
+		for i := 0; i < 2; i++ {
+			e := (*fusekernel.EntryOut)(unsafe.Pointer(&dst[i*size]))
+			if e.EntryValid != want || e.AttrValid != want {
+				t.Errorf("DisableKernelCaching %v: dirent %d valid for %d, %d", disable, i, e.EntryValid, e.AttrValid)
+			}
+		}
+	}
+}
+
+func Test_InitAutoInvalData(t *testing.T) {
+	in := fusekernel.InitIn{
+		Flags: uint32(fusekernel.InitAutoInvalData),
+	}
+
+	for _, enable := range []bool{false, true} {
+		out := initConnection(t, MountConfig{EnableAutoInvalData: enable}, in, 0)
+
+		got := fusekernel.InitFlags(out.Flags)&fusekernel.InitAutoInvalData != 0
+		if got != enable {
+			t.Errorf("Enabled %v: InitAutoInvalData = %v", enable, got)
+		}
+	}
+
+	// The flag isn't sent to kernels that don't offer it.
+	out := initConnection(t, MountConfig{EnableAutoInvalData: true}, fusekernel.InitIn{}, 0)
+	if fusekernel.InitFlags(out.Flags)&fusekernel.InitAutoInvalData != 0 {
+		t.Errorf("InitAutoInvalData sent unsolicited")
+	}
+}
+
+// A server that answers every op with ENOSYS.
+type enosysServer struct{}
+
+func (enosysServer) ServeOps(c *Connection) {
+	for {
+		ctx, _, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		c.Reply(ctx, ENOSYS)
+	}
+}
+
+func Test_Resume(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	// Versions we don't speak are rejected.
+	_, err = Resume("/mnt", dev, Session{ProtocolMajor: 8}, enosysServer{}, &MountConfig{})
+	if err == nil {
+		t.Fatalf("Resume with bad protocol succeeded")
+	}
+
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		enosysServer{},
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	// The resumed connection serves requests without an init handshake.
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + 16),
+		Opcode: uint32(fusekernel.OpGetattr),
+		Unique: 17,
+		Nodeid: 1,
+	})
+	binary.Write(&msg, binary.LittleEndian, [16]byte{})
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var header fusekernel.OutHeader
+	if err := binary.Read(kernel, binary.LittleEndian, &header); err != nil {
+		t.Fatalf("Reading reply: %v", err)
+	}
+
+	if header.Unique != 17 || header.Error != -int32(syscall.ENOSYS) {
+		t.Errorf("Unexpected reply: %+v", header)
+	}
+
+	if _, s := mfs.Session(); s.ProtocolMinor != 31 {
+		t.Errorf("Session: %+v", s)
+	}
+
+	// Hanging up ends serving.
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_ServeDevice(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	send := func(opcode uint32, unique uint64, body interface{}) {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, body)
+
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + b.Len()),
+			Opcode: opcode,
+			Unique: unique,
+			Nodeid: 1,
+		})
+		msg.Write(b.Bytes())
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	receive := func() fusekernel.OutHeader {
+		buf := make([]byte, 4096)
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		var header fusekernel.OutHeader
+		binary.Read(bytes.NewReader(buf[:n]), binary.LittleEndian, &header)
+		return header
+	}
+
+	// Unlike Resume, ServeDevice expects an init handshake.
+	send(fusekernel.OpInit, 1, fusekernel.InitIn{Major: 7, Minor: 31})
+	mfs, err := ServeDevice("/mnt", dev, enosysServer{}, &MountConfig{})
+	if err != nil {
+		t.Fatalf("ServeDevice: %v", err)
+	}
+
+	if h := receive(); h.Unique != 1 || h.Error != 0 {
+		t.Errorf("Unexpected init reply: %+v", h)
+	}
+
+	send(fusekernel.OpGetattr, 2, [16]byte{})
+	if h := receive(); h.Unique != 2 || h.Error != -int32(syscall.ENOSYS) {
+		t.Errorf("Unexpected reply: %+v", h)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_SELinuxContextOption(t *testing.T) {
+	testCases := map[string]string{
+		"u:object_r:fuse:s0":           "u:object_r:fuse:s0",
+		"u:object_r:fuse:s0:c512,c768": `"u:object_r:fuse:s0:c512,c768"`,
+	}
+
+	for ctx, want := range testCases {
+		cfg := MountConfig{SELinuxContext: ctx}
+		if got := cfg.toMap()["context"]; got != want {
+			t.Errorf("%s: context=%s, want %s", ctx, got, want)
+		}
+	}
+}
+
+func Test_FSNameOptions(t *testing.T) {
+	cfg := MountConfig{FSName: `my,bucket\`, Subtype: "fuse.gcsfuse"}
+	s := cfg.toOptionsString()
+
+	for _, want := range []string{`fsname=my\,bucket\\`, "subtype=gcsfuse"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Options %q missing %q", s, want)
+		}
+	}
+}
+
+func Test_AllowOtherOptions(t *testing.T) {
+	testCases := []struct {
+		cfg  MountConfig
+		want string
+	}{
+		{MountConfig{}, ""},
+		{MountConfig{AllowOther: true}, "allow_other"},
+		{MountConfig{AllowRoot: true}, "allow_other"},
+	}
+
+	if runtime.GOOS == "darwin" {
+		testCases[2].want = "allow_root"
+	}
+
+	for _, tc := range testCases {
+		opts := tc.cfg.toMap()
+		for _, o := range []string{"allow_other", "allow_root"} {
+			if _, ok := opts[o]; ok != (o == tc.want) {
+				t.Errorf("%+v: %s set = %v", tc.cfg, o, ok)
+			}
+		}
+	}
+}
+
+func Test_AllowRoot(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("The kernel enforces allow_root on OS X")
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		enosysServer{},
+		&MountConfig{AllowRoot: true})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	owner := uint32(os.Getuid())
+	other := owner + 1
+	testCases := []struct {
+		opcode uint32
+		body   interface{}
+		uid    uint32
+		want   syscall.Errno
+	}{
+		{fusekernel.OpGetattr, fusekernel.GetattrIn{}, owner, syscall.ENOSYS},
+		{fusekernel.OpGetattr, fusekernel.GetattrIn{}, 0, syscall.ENOSYS},
+		{fusekernel.OpGetattr, fusekernel.GetattrIn{}, other, syscall.EACCES},
+
+		// Handles may have been passed on by those let in.
+		{fusekernel.OpRead, fusekernel.ReadIn{Size: 1}, other, syscall.ENOSYS},
+	}
+
+	for i, tc := range testCases {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, tc.body)
+
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + b.Len()),
+			Opcode: tc.opcode,
+			Unique: uint64(i + 1),
+			Nodeid: 1,
+			Uid:    tc.uid,
+		})
+		msg.Write(b.Bytes())
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		buf := make([]byte, 4096)
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		var h fusekernel.OutHeader
+		binary.Read(bytes.NewReader(buf[:n]), binary.LittleEndian, &h)
+		if h.Unique != uint64(i+1) || h.Error != -int32(tc.want) {
+			t.Errorf("Opcode %d from uid %d: reply %+v, want %v", tc.opcode, tc.uid, h, tc.want)
+		}
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+// A server for the OS X volume ops, recording the volume name it is given.
+type volumeServer struct {
+	names chan string
+}
+
+func (s volumeServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		switch typed := op.(type) {
+		case *fuseops.SetVolumeNameOp:
+			s.names <- typed.Name
+			c.Reply(ctx, nil)
+
+		case *fuseops.GetXtimesOp:
+			typed.CreationTime = time.Unix(1234, 5678)
+			c.Reply(ctx, nil)
+
+		default:
+			c.Reply(ctx, ENOSYS)
+		}
+	}
+}
+
+func Test_VolumeOps(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	server := volumeServer{names: make(chan string, 1)}
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		server,
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	send := func(opcode uint32, unique uint64, body []byte) {
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + len(body)),
+			Opcode: opcode,
+			Unique: unique,
+			Nodeid: 1,
+		})
+		msg.Write(body)
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	buf := make([]byte, 4096)
+	receive := func(unique uint64) *bytes.Reader {
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		r := bytes.NewReader(buf[:n])
+
+		var header fusekernel.OutHeader
+		binary.Read(r, binary.LittleEndian, &header)
+		if header.Unique != unique || header.Error != 0 {
+			t.Fatalf("Unexpected reply: %+v", header)
+		}
+
+		return r
+	}
+
+	// Set the volume name.
+	send(fusekernel.OpSetvolname, 2, []byte("Backup\x00"))
+	if r := receive(2); r.Len() != 0 {
+		t.Errorf("Unexpected SetVolumeName response body of %d bytes", r.Len())
+	}
+
+	if name := <-server.names; name != "Backup" {
+		t.Errorf("Name = %q", name)
+	}
+
+	// Get the times.
+	send(fusekernel.OpGetxtimes, 3, nil)
+
+	var out fusekernel.GetxtimesOut
+	if err := binary.Read(receive(3), binary.LittleEndian, &out); err != nil {
+		t.Fatalf("Reading GetxtimesOut: %v", err)
+	}
+
+	want := fusekernel.GetxtimesOut{Crtime: 1234, CrtimeNsec: 5678}
+	if out != want {
+		t.Errorf("GetxtimesOut = %+v, want %+v", out, want)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+// A server that reports the renames it is asked for.
+type renameServer struct {
+	renames chan *fuseops.RenameOp
+}
+
+func (s renameServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		if rename, ok := op.(*fuseops.RenameOp); ok {
+			s.renames <- rename
+			c.Reply(ctx, nil)
+			continue
+		}
+
+		c.Reply(ctx, ENOSYS)
+	}
+}
+
+func Test_RenameFlags(t *testing.T) {
+	testCases := []struct {
+		enable    bool
+		wantErr   int32
+		wantFlags fuseops.RenameFlags
+	}{
+		{false, -int32(syscall.ENOSYS), 0},
+		{true, 0, fuseops.RenameExchange},
+	}
+
+	for _, tc := range testCases {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+		if err != nil {
+			t.Fatalf("Socketpair: %v", err)
+		}
+
+		kernel := os.NewFile(uintptr(fds[0]), "kernel")
+		dev := os.NewFile(uintptr(fds[1]), "dev")
+
+		server := renameServer{renames: make(chan *fuseops.RenameOp, 1)}
+		mfs, err := Resume(
+			"/mnt",
+			dev,
+			Session{ProtocolMajor: 7, ProtocolMinor: 31},
+			server,
+			&MountConfig{EnableRenameFlags: tc.enable})
+		if err != nil {
+			t.Fatalf("Resume: %v", err)
+		}
+
+		var msg bytes.Buffer
+		body := append(make([]byte, 16), "foo\x00bar\x00"...)
+		binary.LittleEndian.PutUint64(body[0:], 7)
+		binary.LittleEndian.PutUint32(body[8:], fusekernel.RenameExchange)
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + len(body)),
+			Opcode: fusekernel.OpRename2,
+			Unique: 2,
+			Nodeid: 1,
+		})
+		msg.Write(body)
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		buf := make([]byte, 4096)
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		var header fusekernel.OutHeader
+		binary.Read(bytes.NewReader(buf[:n]), binary.LittleEndian, &header)
+		if header.Error != tc.wantErr {
+			t.Errorf("Enable %v: error %d, want %d", tc.enable, header.Error, tc.wantErr)
+		}
+
+		if tc.enable {
+			rename := <-server.renames
+			want := fuseops.RenameOp{
+				OldParent: 1,
+				OldName:   "foo",
+				NewParent: 7,
+				NewName:   "bar",
+				Flags:     tc.wantFlags,
+			}
+
+			rename.OpContext = fuseops.OpContext{}
+			if !reflect.DeepEqual(*rename, want) {
+				t.Errorf("RenameOp = %+v, want %+v", *rename, want)
+			}
+		}
+
+		kernel.Close()
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}
+}
+
+// A server that creates temporary files as inode 17 with handle 23, backed by
+// backing file 5.
+type tmpfileServer struct {
+	ops chan *fuseops.CreateTmpfileOp
+}
+
+func (s tmpfileServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		if tmp, ok := op.(*fuseops.CreateTmpfileOp); ok {
+			tmp.Entry.Child = 17
+			tmp.Entry.Attributes.Nlink = 1
+			tmp.Handle = 23
+			tmp.BackingID = 5
+			s.ops <- tmp
+			c.Reply(ctx, nil)
+			continue
+		}
+
+		c.Reply(ctx, ENOSYS)
+	}
+}
+
+func Test_Tmpfile(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	server := tmpfileServer{ops: make(chan *fuseops.CreateTmpfileOp, 1)}
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		server,
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	protocol := fusekernel.Protocol{Major: 7, Minor: 31}
+	in := make([]byte, fusekernel.CreateInSize(protocol))
+	binary.LittleEndian.PutUint32(in[0:], syscall.O_RDWR|syscall.O_EXCL)
+	binary.LittleEndian.PutUint32(in[4:], syscall.S_IFREG|0640)
+	body := append(in, "/\x00"...)
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + len(body)),
+		Opcode: fusekernel.OpTmpfile,
+		Unique: 2,
+		Nodeid: 1,
+	})
+	msg.Write(body)
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	tmp := <-server.ops
+	if tmp.Parent != 1 || tmp.Mode != 0640 {
+		t.Errorf("Parent %d and Mode %v, want 1 and 0640", tmp.Parent, tmp.Mode)
+	}
+
+	if want := fusekernel.OpenReadWrite | fusekernel.OpenExclusive; tmp.OpenFlags != want {
+		t.Errorf("OpenFlags %v, want %v", tmp.OpenFlags, want)
+	}
+
+	// The reply is an entry followed by an open handle, as for CreateFileOp.
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	r := bytes.NewReader(buf[:n])
+
+	var header fusekernel.OutHeader
+	var entry fusekernel.EntryOut
+	var open fusekernel.OpenOut
+	binary.Read(r, binary.LittleEndian, &header)
+	binary.Read(r, binary.LittleEndian, &entry)
+	if err := binary.Read(r, binary.LittleEndian, &open); err != nil {
+		t.Fatalf("Reading OpenOut: %v", err)
+	}
+
+	if header.Error != 0 || entry.Nodeid != 17 || entry.Attr.Nlink != 1 || open.Fh != 23 {
+		t.Errorf("Reply %+v, %+v, %+v", header, entry, open)
+	}
+
+	if open.OpenFlags&uint32(fusekernel.OpenPassthrough) == 0 || open.BackingID != 5 {
+		t.Errorf("Reply without passthrough: %+v", open)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+// A server that records each file system sync it sees.
+type syncServer struct {
+	ops chan *fuseops.SyncFSOp
+}
+
+func (s syncServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		if sync, ok := op.(*fuseops.SyncFSOp); ok {
+			s.ops <- sync
+			c.Reply(ctx, nil)
+			continue
+		}
+
+		c.Reply(ctx, ENOSYS)
+	}
+}
+
+func Test_SyncFS(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	server := syncServer{ops: make(chan *fuseops.SyncFSOp, 1)}
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		server,
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	body := make([]byte, unsafe.Sizeof(fusekernel.SyncfsIn{}))
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + len(body)),
+		Opcode: fusekernel.OpSyncfs,
+		Unique: 2,
+		Nodeid: 1,
+		Pid:    99,
+	})
+	msg.Write(body)
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	sync := <-server.ops
+	if sync.OpContext.Pid != 99 {
+		t.Errorf("Pid %d, want 99", sync.OpContext.Pid)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	var header fusekernel.OutHeader
+	if err := binary.Read(bytes.NewReader(buf[:n]), binary.LittleEndian, &header); err != nil {
+		t.Fatalf("binary.Read: %v", err)
+	}
+
+	if header.Error != 0 || header.Len != uint32(n) || n != int(unsafe.Sizeof(header)) {
+		t.Errorf("Reply %+v of %d bytes, want an empty success", header, n)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+// A server that lets callers read, but not write, anything.
+type accessServer struct {
+	ops chan *fuseops.AccessOp
+}
+
+func (s accessServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		access, ok := op.(*fuseops.AccessOp)
+		if !ok {
+			c.Reply(ctx, ENOSYS)
+			continue
+		}
+
+		s.ops <- access
+		if access.Mask&2 != 0 {
+			c.Reply(ctx, syscall.EACCES)
+			continue
+		}
+
+		c.Reply(ctx, nil)
+	}
+}
+
+func Test_Access(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	server := accessServer{ops: make(chan *fuseops.AccessOp, 1)}
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		server,
+		&MountConfig{DisableDefaultPermissions: true})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	testCases := []struct {
+		mask uint32
+		want int32
+	}{
+		{4, 0},
+		{6, -int32(syscall.EACCES)},
+	}
+
+	for i, tc := range testCases {
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + int(unsafe.Sizeof(fusekernel.AccessIn{}))),
+			Opcode: fusekernel.OpAccess,
+			Unique: uint64(i + 2),
+			Nodeid: 7,
+			Uid:    1000,
+		})
+		binary.Write(&msg, binary.LittleEndian, fusekernel.AccessIn{Mask: tc.mask})
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		access := <-server.ops
+		if access.Inode != 7 || access.Mask != tc.mask || access.OpContext.Uid != 1000 {
+			t.Errorf("Op %+v, want inode 7, mask %o and UID 1000", access, tc.mask)
+		}
+
+		buf := make([]byte, 4096)
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		var header fusekernel.OutHeader
+		if err := binary.Read(bytes.NewReader(buf[:n]), binary.LittleEndian, &header); err != nil {
+			t.Fatalf("binary.Read: %v", err)
+		}
+
+		if header.Error != tc.want || n != int(unsafe.Sizeof(header)) {
+			t.Errorf("Mask %o: reply %+v of %d bytes, want error %d", tc.mask, header, n, tc.want)
+		}
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+// A server that answers statx with a birth time, for a character device.
+type statxServer struct {
+	ops chan *fuseops.StatxOp
+}
+
+func (s statxServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		statx, ok := op.(*fuseops.StatxOp)
+		if !ok {
+			c.Reply(ctx, ENOSYS)
+			continue
+		}
+
+		s.ops <- statx
+		statx.Attributes = fuseops.InodeAttributes{
+			Size:  17,
+			Nlink: 1,
+			Mode:  os.ModeDevice | os.ModeCharDevice | 0600,
+			Rdev:  0x10502, // 261:2
+			Mtime: time.Unix(1000, 0),
+			Btime: time.Unix(500, 7),
+		}
+		statx.StatxAttributes = 0x10
+		statx.StatxAttributesMask = 0x30
+		c.Reply(ctx, nil)
+	}
+}
+
+func Test_Statx(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	server := statxServer{ops: make(chan *fuseops.StatxOp, 1)}
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		server,
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + int(unsafe.Sizeof(fusekernel.StatxIn{}))),
+		Opcode: fusekernel.OpStatx,
+		Unique: 2,
+		Nodeid: 7,
+	})
+	binary.Write(&msg, binary.LittleEndian, fusekernel.StatxIn{
+		GetattrFlags: uint32(fusekernel.GetattrFh),
+		Fh:           9,
+		SxMask:       uint32(fuseops.StatxBtime),
+	})
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	statx := <-server.ops
+	if statx.Inode != 7 || statx.Handle == nil || *statx.Handle != 9 || statx.Mask != fuseops.StatxBtime {
+		t.Errorf("Op %+v", statx)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	r := bytes.NewReader(buf[:n])
+
+	var header fusekernel.OutHeader
+	var out fusekernel.StatxOut
+	binary.Read(r, binary.LittleEndian, &header)
+	if err := binary.Read(r, binary.LittleEndian, &out); err != nil {
+		t.Fatalf("Reading StatxOut: %v", err)
+	}
+
+	sx := out.Stat
+	if header.Error != 0 {
+		t.Errorf("Error %d", header.Error)
+	}
+
+	// The basic fields and the birth time are reported.
+	if want := uint32(fuseops.StatxBasicStats | fuseops.StatxBtime); sx.Mask != want {
+		t.Errorf("Mask %v, want %v", fuseops.StatxMask(sx.Mask), fuseops.StatxMask(want))
+	}
+
+	if sx.Ino != 7 || sx.Size != 17 || sx.Mode != syscall.S_IFCHR|0600 {
+		t.Errorf("Ino %d, size %d and mode %#o", sx.Ino, sx.Size, sx.Mode)
+	}
+
+	if sx.Btime.Sec != 500 || sx.Btime.Nsec != 7 || sx.Mtime.Sec != 1000 {
+		t.Errorf("Btime %+v and mtime %+v", sx.Btime, sx.Mtime)
+	}
+
+	if sx.RdevMajor != 261 || sx.RdevMinor != 2 {
+		t.Errorf("Rdev %d:%d, want 261:2", sx.RdevMajor, sx.RdevMinor)
+	}
+
+	if sx.Attributes != 0x10 || sx.AttributesMask != 0x30 {
+		t.Errorf("Attributes %#x with mask %#x", sx.Attributes, sx.AttributesMask)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_convertStatxRdev(t *testing.T) {
+	testCases := []struct {
+		mode os.FileMode
+		rdev bool
+	}{
+		{os.ModeDevice | os.ModeCharDevice | 0600, true},
+		{os.ModeDevice | 0600, true},
+		{os.ModeDir | 0755, false},
+		{os.ModeSymlink | 0777, false},
+		{os.ModeSocket | 0600, false},
+		{0644, false},
+	}
+
+	for _, tc := range testCases {
+		op := &fuseops.StatxOp{
+			Attributes: fuseops.InodeAttributes{
+				Mode: tc.mode,
+				Rdev: 261<<8 | 2,
+			},
+		}
+
+		var sx fusekernel.Statx
+		convertStatx(op, &sx)
+		if got := sx.RdevMajor != 0 || sx.RdevMinor != 0; got != tc.rdev {
+			t.Errorf("%v: rdev %d:%d", tc.mode, sx.RdevMajor, sx.RdevMinor)
+		}
+
+		var attr fusekernel.Attr
+		convertAttributes(7, &op.Attributes, &attr)
+		if got := attr.Rdev != 0; got != tc.rdev {
+			t.Errorf("%v: attr rdev %d", tc.mode, attr.Rdev)
+		}
+	}
+}
+
+// A server that reports POLLIN on every poll, asking for a wakeup when the
+// kernel wants one.
+type pollServer struct{}
+
+func (pollServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		typed, ok := op.(*fuseops.PollOp)
+		if !ok {
+			c.Reply(ctx, ENOSYS)
+			continue
+		}
+
+		typed.Revents = typed.Events & 0x1
+		if typed.ScheduleNotify {
+			c.NotifyPollWakeup(typed.PollHandle)
+		}
+
+		c.Reply(ctx, nil)
+	}
+}
+
+func Test_Poll(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		pollServer{},
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + binary.Size(fusekernel.PollIn{})),
+		Opcode: fusekernel.OpPoll,
+		Unique: 2,
+		Nodeid: 17,
+	})
+	binary.Write(&msg, binary.LittleEndian, fusekernel.PollIn{
+		Fh:     3,
+		Kh:     19,
+		Flags:  fusekernel.PollScheduleNotify,
+		Events: 0x1 | 0x4,
+	})
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// The wakeup comes first, then the answer.
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	want := make([]byte, 24)
+	binary.LittleEndian.PutUint32(want[0:], 24)
+	binary.LittleEndian.PutUint32(want[4:], uint32(fusekernel.NotifyCodePoll))
+	binary.LittleEndian.PutUint64(want[16:], 19)
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("Notification = %x, want %x", buf[:n], want)
+	}
+
+	n, err = kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	want = make([]byte, 24)
+	binary.LittleEndian.PutUint32(want[0:], 24)
+	binary.LittleEndian.PutUint64(want[8:], 2)
+	binary.LittleEndian.PutUint32(want[16:], 0x1)
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("Reply = %x, want %x", buf[:n], want)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+// A server that answers lookups with expirations relative to its clock.
+type clockServer struct {
+	clock timeutil.Clock
+}
+
+func (s clockServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		typed, ok := op.(*fuseops.LookUpInodeOp)
+		if !ok {
+			c.Reply(ctx, ENOSYS)
+			continue
+		}
+
+		typed.Entry.Child = 2
+		typed.Entry.EntryExpiration = s.clock.Now().Add(5 * time.Second)
+		typed.Entry.AttributesExpiration = s.clock.Now().Add(1500 * time.Millisecond)
+		c.Reply(ctx, nil)
+	}
+}
+
+func Test_Clock(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		clockServer{&clock},
+		&MountConfig{Clock: &clock})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + 4),
+		Opcode: fusekernel.OpLookup,
+		Unique: 2,
+		Nodeid: 1,
+	})
+	msg.WriteString("foo\x00")
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// The TTLs are measured against the simulated clock, not the real one.
+	headerSize := int(unsafe.Sizeof(fusekernel.OutHeader{}))
+	if n < headerSize+int(unsafe.Sizeof(fusekernel.EntryOut{})) {
+		t.Fatalf("Reply is %d bytes", n)
+	}
+
+	out := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[headerSize]))
+	if out.EntryValid != 5 || out.EntryValidNsec != 0 || out.AttrValid != 1 || out.AttrValidNsec != 5e8 {
+		t.Errorf("EntryOut = %+v", *out)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_NameLimits(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	// The enosysServer replies ENOSYS to anything that gets through.
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		enosysServer{},
+		&MountConfig{MaxNameLength: 8, MaxSymlinkLength: 4})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	exchange := func(opcode uint32, unique uint64, body string) fusekernel.OutHeader {
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + len(body)),
+			Opcode: opcode,
+			Unique: unique,
+			Nodeid: 1,
+		})
+		msg.WriteString(body)
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		var header fusekernel.OutHeader
+		if err := binary.Read(kernel, binary.LittleEndian, &header); err != nil {
+			t.Fatalf("Reading reply: %v", err)
+		}
+
+		return header
+	}
+
+	testCases := []struct {
+		opcode uint32
+		body   string
+		want   syscall.Errno
+	}{
+		{fusekernel.OpLookup, "short\x00", syscall.ENOSYS},
+		{fusekernel.OpLookup, "muchtoolong\x00", syscall.ENAMETOOLONG},
+		{fusekernel.OpSymlink, "link\x00tgt\x00", syscall.ENOSYS},
+		{fusekernel.OpSymlink, "muchtoolong\x00tgt\x00", syscall.ENAMETOOLONG},
+		{fusekernel.OpSymlink, "link\x00../target\x00", syscall.ENAMETOOLONG},
+	}
+
+	for i, tc := range testCases {
+		header := exchange(tc.opcode, uint64(i+2), tc.body)
+		if header.Error != -int32(tc.want) {
+			t.Errorf("%d %q: error %d, want %v", tc.opcode, tc.body, header.Error, tc.want)
+		}
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_Resend(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 40,
+		Flags: uint32(fusekernel.InitExt),
+	}
+
+	out := initConnection(t, MountConfig{EnableResend: true}, in, fusekernel.InitHasResend)
+	if fusekernel.InitFlags2(out.Flags2)&fusekernel.InitHasResend == 0 {
+		t.Errorf("InitHasResend not negotiated")
+	}
+
+	out = initConnection(t, MountConfig{}, in, fusekernel.InitHasResend)
+	if fusekernel.InitFlags2(out.Flags2)&fusekernel.InitHasResend != 0 {
+		t.Errorf("InitHasResend sent unsolicited")
+	}
+
+	// A resumed session with resend asks the kernel to resend requests.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31, Resend: true},
+		enosysServer{},
+		&MountConfig{EnableResend: true})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	var header fusekernel.OutHeader
+	if err := binary.Read(kernel, binary.LittleEndian, &header); err != nil {
+		t.Fatalf("Reading notification: %v", err)
+	}
+
+	want := fusekernel.OutHeader{
+		Len:   uint32(binary.Size(header)),
+		Error: fusekernel.NotifyCodeResend,
+	}
+
+	if header != want {
+		t.Errorf("Notification = %+v, want %+v", header, want)
+	}
+
+	if _, s := mfs.Session(); !s.Resend {
+		t.Errorf("Session: %+v", s)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+// A server that reports each op it reads, and replies ENOSYS when told to.
+type gatedServer struct {
+	ops     chan uint64
+	release chan struct{}
+}
+
+func (s gatedServer) ServeOps(c *Connection) {
+	// The connection must not be closed until every op is answered.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		ctx, _, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		state := ctx.Value(contextKey).(opState)
+		s.ops <- state.inMsg.Header().Unique
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-s.release
+			c.Reply(ctx, ENOSYS)
+		}()
+	}
+}
+
+func Test_ResentRequestInProgress(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	server := gatedServer{
+		ops:     make(chan uint64, 10),
+		release: make(chan struct{}),
+	}
+
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31, Resend: true},
+		server,
+		&MountConfig{EnableResend: true})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	var header fusekernel.OutHeader
+	if err := binary.Read(kernel, binary.LittleEndian, &header); err != nil {
+		t.Fatalf("Reading notification: %v", err)
+	}
+
+	send := func(unique uint64) {
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + 16),
+			Opcode: uint32(fusekernel.OpGetattr),
+			Unique: unique,
+			Nodeid: 1,
+		})
+		binary.Write(&msg, binary.LittleEndian, [16]byte{})
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// While the server works on a request, the kernel sends it again, followed
+	// by another request.
+	const unique = 17
+	send(unique)
+	if got := <-server.ops; got != unique {
+		t.Fatalf("Server read %d", got)
+	}
+
+	send(unique | fusekernel.UniqueResend)
+	send(18)
+	if got := <-server.ops; got != 18 {
+		t.Fatalf("Server read %d, want 18", got)
+	}
+
+	// The answers use the latest IDs.
+	close(server.release)
+
+	got := make(map[uint64]bool)
+	for i := 0; i < 2; i++ {
+		if err := binary.Read(kernel, binary.LittleEndian, &header); err != nil {
+			t.Fatalf("Reading reply: %v", err)
+		}
+
+		got[header.Unique] = true
+	}
+
+	if !got[unique|fusekernel.UniqueResend] || !got[18] {
+		t.Errorf("Replies for %v", got)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_UnclaimedAnswersBounded(t *testing.T) {
+	c := &Connection{resend: true}
+	answer := func(n int) *buffer.OutMessage {
+		var m buffer.OutMessage
+		m.Reset()
+		m.Append(make([]byte, n))
+		return &m
+	}
+
+	// Answers are dropped, oldest first, to keep the total size bounded.
+	const size = maxUnclaimedBytes / 4
+	c.mu.Lock()
+	for base := uint64(1); base <= 5; base++ {
+		if !c.stashAnswerLocked(base, answer(size)) {
+			t.Fatalf("Answer %d not kept", base)
+		}
+	}
+
+	if _, ok := c.unclaimed[1]; ok || len(c.unclaimed) != 3 {
+		t.Errorf("Kept %d answers, including the first: %v", len(c.unclaimed), ok)
+	}
+
+	if c.unclaimedBytes > maxUnclaimedBytes {
+		t.Errorf("Kept %d bytes", c.unclaimedBytes)
+	}
+
+	// Answers larger than the bound aren't kept at all.
+	if c.stashAnswerLocked(6, answer(maxUnclaimedBytes)) {
+		t.Errorf("Oversized answer kept")
+	}
+	c.mu.Unlock()
+}
+
+func Test_WaitForQuiescence(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	server := gatedServer{
+		ops:     make(chan uint64, 10),
+		release: make(chan struct{}),
+	}
+
+	mfs, err := Resume("/mnt", dev, Session{ProtocolMajor: 7, ProtocolMinor: 31}, server, &MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	// Nothing has happened yet.
+	if err := mfs.WaitForQuiescence(context.Background()); err != nil {
+		t.Fatalf("WaitForQuiescence: %v", err)
+	}
+
+	// Forgets count too, though they are never answered.
+	send := func(opcode uint32, unique uint64) {
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + 16),
+			Opcode: opcode,
+			Unique: unique,
+			Nodeid: 1,
+		})
+		binary.Write(&msg, binary.LittleEndian, [16]byte{})
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	send(fusekernel.OpGetattr, 2)
+	send(fusekernel.OpForget, 3)
+	<-server.ops
+	<-server.ops
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := mfs.WaitForQuiescence(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitForQuiescence with ops in flight: %v", err)
+	}
+
+	close(server.release)
+	if err := mfs.WaitForQuiescence(context.Background()); err != nil {
+		t.Fatalf("WaitForQuiescence: %v", err)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_ConnectionInfo(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + fusekernel.InitInSize + 48),
+		Opcode: fusekernel.OpInit,
+		Unique: 1,
+	})
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InitIn{
+		Major: 7,
+		Minor: 40,
+		Flags: uint32(fusekernel.InitAsyncRead | fusekernel.InitExt),
+	})
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InitInExt{
+		Flags2: uint32(fusekernel.InitHasResend),
+	})
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	devFD := dev.Fd()
+	mfs, err := ServeDevice("/mnt", dev, enosysServer{}, &MountConfig{EnableResend: true})
+	if err != nil {
+		t.Fatalf("ServeDevice: %v", err)
+	}
+
+	info := mfs.ConnectionInfo()
+	if info.KernelProtocolMinor != 40 || info.ProtocolMajor != 7 || info.ProtocolMinor != fusekernel.ProtoVersionMaxMinor {
+		t.Errorf("Protocol: %v", info)
+	}
+
+	wantKernel := uint64(fusekernel.InitAsyncRead|fusekernel.InitExt) | uint64(fusekernel.InitHasResend)<<32
+	if info.KernelFlags != wantKernel {
+		t.Errorf("KernelFlags: %v", info)
+	}
+
+	if info.Flags&uint64(fusekernel.InitBigWrites) == 0 || info.Flags>>32 != uint64(fusekernel.InitHasResend) {
+		t.Errorf("Flags: %v", info)
+	}
+
+	if info.DeviceFD != devFD || info.MaxWrite == 0 || info.MaxBackground == 0 || info.MountOptions != "" {
+		t.Errorf("Info: %v", info)
+	}
+
+	if s := info.String(); !strings.Contains(s, "InitHasResend") || !strings.Contains(s, "kernel 7.40") {
+		t.Errorf("String: %s", s)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_LabelledLogs(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + fusekernel.InitInSize),
+		Opcode: fusekernel.OpInit,
+		Unique: 1,
+	})
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InitIn{Major: 7, Minor: 31})
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var debug, errors bytes.Buffer
+	cfg := &MountConfig{
+		Labels:      map[string]string{"volume": "home", "tenant": "acme"},
+		DebugLogger: log.New(&debug, "debug: ", 0),
+		ErrorLogger: log.New(&errors, "", 0),
+	}
+
+	mfs, err := ServeDevice("/mnt", dev, enosysServer{}, cfg)
+	if err != nil {
+		t.Fatalf("ServeDevice: %v", err)
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+
+	// The caller's loggers are left alone; lines are labelled on the way out.
+	cfg.ErrorLogger.Print("unlabelled")
+
+	lines := strings.Split(strings.TrimSuffix(debug.String(), "\n"), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Debug log: %q", debug.String())
+	}
+
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "{tenant=acme volume=home} debug: ") {
+			t.Errorf("Unlabelled debug line: %q", l)
+		}
+	}
+
+	labelled := cfg.withLabelledLoggers()
+	labelled.ErrorLogger.Printf("oops: %d", 17)
+	if got, want := errors.String(), "unlabelled\n{tenant=acme volume=home} oops: 17\n"; got != want {
+		t.Errorf("Error log: %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMountNotPropagated is the error wrapped by the ContainerError returned
+// from CheckMountPropagation.
+var ErrMountNotPropagated = errors.New("mounts are not propagated")
+
+// ContainerError describes a problem with the environment, typically a
+// container's configuration, that prevents mounting or makes a mount less
+// useful than expected. Advice says how to fix it.
+type ContainerError struct {
+	Op     string
+	Err    error
+	Advice string
+}
+
+func (e *ContainerError) Error() string {
+	return fmt.Sprintf("%s: %v (%s)", e.Op, e.Err, e.Advice)
+}
+
+func (e *ContainerError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// CheckDevice checks that /dev/fuse can be opened, returning a
+// *ContainerError if not. Containers usually need to be given access to the
+// device explicitly.
+func CheckDevice() error {
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0)
+	if err != nil {
+		return deviceError(err)
+	}
+
+	syscall.Close(fd)
+	return nil
+}
+
+func deviceError(err error) error {
+	e := &ContainerError{
+		Op:  "open /dev/fuse",
+		Err: err,
+	}
+
+	switch err {
+	case syscall.ENOENT:
+		e.Advice = "the device is missing; pass it into the container " +
+			"(e.g. docker run --device /dev/fuse)"
+
+	case syscall.EPERM, syscall.EACCES:
+		e.Advice = "access to the device is denied, probably by the device " +
+			"cgroup; allow it (e.g. docker run --device /dev/fuse)"
+
+	case syscall.ENODEV, syscall.ENXIO:
+		e.Advice = "the fuse kernel module is not loaded on the host " +
+			"(modprobe fuse)"
+
+	default:
+		e.Advice = "check that the device is available to this process"
+	}
+
+	return e
+}
+
+// InUserNamespace reports whether the process is running in a user namespace
+// other than the initial one, as rootless containers do. In a user namespace,
+// fusermount(1) can't help, but the process can mount directly if it has
+// CAP_SYS_ADMIN in the user namespace that owns its mount namespace (e.g.
+// after unshare -Urm) and the kernel is Linux 4.18 or later.
+func InUserNamespace() bool {
+	b, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+
+	// The initial namespace maps all IDs to themselves.
+	return strings.Join(strings.Fields(string(b)), " ") != "0 0 4294967295"
+}
+
+// CheckMountPropagation checks whether a file system mounted at dir will be
+// visible in other mount namespaces, in particular outside the container this
+// process runs in. It returns a *ContainerError wrapping
+// ErrMountNotPropagated if not.
+//
+// Mounting succeeds regardless; call this only if other namespaces need to
+// see the file system.
+func CheckMountPropagation(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mountPoint, propagation, err := findPropagation(f, dir)
+	if err != nil {
+		return err
+	}
+
+	if propagation == "shared" {
+		return nil
+	}
+
+	return &ContainerError{
+		Op:  "mount propagation",
+		Err: ErrMountNotPropagated,
+		Advice: fmt.Sprintf(
+			"%s is on mount %s, which has %s propagation; bind-mount it into "+
+				"the container with shared propagation (e.g. docker run --mount "+
+				"type=bind,...,bind-propagation=rshared, or mountPropagation: "+
+				"Bidirectional in Kubernetes)",
+			dir,
+			mountPoint,
+			propagation),
+	}
+}
+
+// Find the mount containing dir in the supplied /proc/self/mountinfo contents,
+// returning its mount point and its propagation type: "shared", "slave", or
+// "private".
+func findPropagation(r io.Reader, dir string) (mountPoint, propagation string, err error) {
+	best := -1
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Cf. proc(5). For example:
+		//
+		//     36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		//
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+
+		mp := unescapeMountInfo(fields[4])
+		if !pathContains(mp, dir) || len(mp) < best {
+			continue
+		}
+
+		// Later mounts on the same point hide earlier ones.
+		best = len(mp)
+		mountPoint = mp
+		propagation = "private"
+		for _, opt := range fields[6:] {
+			if opt == "-" {
+				break
+			}
+
+			switch {
+			case strings.HasPrefix(opt, "shared:"):
+				propagation = "shared"
+			case strings.HasPrefix(opt, "master:") && propagation != "shared":
+				propagation = "slave"
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	if best < 0 {
+		return "", "", fmt.Errorf("no mount contains %s", dir)
+	}
+
+	return mountPoint, propagation, nil
+}
+
+func pathContains(parent, p string) bool {
+	return parent == "/" ||
+		p == parent ||
+		strings.HasPrefix(p, parent+"/")
+}
+
+// Undo the octal escaping of spaces and the like in mountinfo paths.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
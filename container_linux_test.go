@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const testMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+23 22 0:5 / /dev rw,nosuid master:2 - devtmpfs udev rw
+24 22 0:6 / /mnt/with\040space rw - tmpfs tmpfs rw
+25 22 0:7 / /mnt/data rw shared:3 master:4 - tmpfs tmpfs rw
+26 25 0:8 / /mnt/data/private rw - tmpfs tmpfs rw
+`
+
+func Test_findPropagation(t *testing.T) {
+	testCases := []struct {
+		dir        string
+		mountPoint string
+		want       string
+	}{
+		{"/", "/", "shared"},
+		{"/home/user", "/", "shared"},
+		{"/dev/shm", "/dev", "slave"},
+		{"/devices", "/", "shared"},
+		{"/mnt/with space/x", "/mnt/with space", "private"},
+		{"/mnt/data", "/mnt/data", "shared"},
+		{"/mnt/data/private/x", "/mnt/data/private", "private"},
+	}
+
+	for _, tc := range testCases {
+		mp, got, err := findPropagation(strings.NewReader(testMountInfo), tc.dir)
+		if err != nil {
+			t.Errorf("%s: %v", tc.dir, err)
+			continue
+		}
+
+		if mp != tc.mountPoint || got != tc.want {
+			t.Errorf("%s: got (%q, %q), want (%q, %q)", tc.dir, mp, got, tc.mountPoint, tc.want)
+		}
+	}
+}
+
+func Test_deviceError(t *testing.T) {
+	err := deviceError(syscall.ENOENT)
+
+	var ce *ContainerError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Not a ContainerError: %#v", err)
+	}
+
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Doesn't wrap ENOENT: %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "--device /dev/fuse") {
+		t.Errorf("No advice: %v", err)
+	}
+}
+
+func Test_SendReceiveDevice(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socket")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("FileConn: %v", err)
+		}
+
+		defer c.Close()
+		conns[i] = c.(*net.UnixConn)
+	}
+
+	// Send one end of a pipe in place of a device.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+
+	if err := SendDevice(conns[0], w); err != nil {
+		t.Fatalf("SendDevice: %v", err)
+	}
+	w.Close()
+
+	dev, err := ReceiveDevice(conns[1])
+	if err != nil {
+		t.Fatalf("ReceiveDevice: %v", err)
+	}
+
+	if _, err := dev.Write([]byte("x")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	dev.Close()
+
+	buf := make([]byte, 2)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "x" {
+		t.Errorf("Read: %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+// CheckDevice checks that /dev/fuse can be opened. It is supported only on
+// Linux.
+func CheckDevice() error {
+	return ErrPlatformUnsupported
+}
+
+// InUserNamespace reports whether the process is running in a user namespace
+// other than the initial one. It is always false other than on Linux.
+func InUserNamespace() bool {
+	return false
+}
+
+// CheckMountPropagation checks whether a file system mounted at dir will be
+// visible in other mount namespaces. It is supported only on Linux.
+func CheckMountPropagation(dir string) error {
+	return ErrPlatformUnsupported
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"runtime"
 	"syscall"
 	"time"
 	"unsafe"
@@ -42,6 +43,14 @@ func convertInMessage(
 	inMsg *buffer.InMessage,
 	outMsg *buffer.OutMessage,
 	protocol fusekernel.Protocol) (o interface{}, err error) {
+	// Set aside any request extensions, which follow the arguments.
+	var ext []byte
+	if n := uintptr(inMsg.Header().TotalExtlen) * 8; n > 0 {
+		if ext = inMsg.ConsumeTrailing(n); ext == nil {
+			return nil, errors.New("Corrupt request extensions")
+		}
+	}
+
 	switch inMsg.Header().Opcode {
 	case fusekernel.OpLookup:
 		buf := inMsg.ConsumeBytes(inMsg.Len())
@@ -57,6 +66,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -67,6 +77,49 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+
+	case fusekernel.OpStatx:
+		type input fusekernel.StatxIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpStatx")
+		}
+
+		to := &fuseops.StatxOp{
+			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			Mask:  fuseops.StatxMask(in.SxMask),
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+		o = to
+
+		if fusekernel.GetattrFlags(in.GetattrFlags)&fusekernel.GetattrFh != 0 {
+			h := fuseops.HandleID(in.Fh)
+			to.Handle = &h
+		}
+
+	case fusekernel.OpAccess:
+		type input fusekernel.AccessIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpAccess")
+		}
+
+		o = &fuseops.AccessOp{
+			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			Mask:  in.Mask,
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -83,6 +136,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 		o = to
@@ -115,6 +169,11 @@ func convertInMessage(
 			to.Mtime = &t
 		}
 
+		if valid&fusekernel.SetattrCtime != 0 {
+			t := time.Unix(int64(in.Ctime), int64(in.CtimeNsec))
+			to.Ctime = &t
+		}
+
 		if valid.Handle() {
 			t := fuseops.HandleID(in.Fh)
 			to.Handle = &t
@@ -134,6 +193,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -164,6 +224,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -195,6 +256,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Groups: suppGroups(ext),
 			},
 		}
 
@@ -220,6 +283,8 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Groups: suppGroups(ext),
 			},
 		}
 
@@ -237,13 +302,36 @@ func convertInMessage(
 		name = name[:i]
 
 		o = &fuseops.CreateFileOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(name),
-			Mode:   ConvertFileMode(in.Mode),
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			Mode:      ConvertFileMode(in.Mode),
+			OpenFlags: fusekernel.OpenFlags(in.Flags),
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Groups: suppGroups(ext),
+			},
+		}
+
+	case fusekernel.OpTmpfile:
+		// The name that follows is a placeholder, since the file has none.
+		in := (*fusekernel.CreateIn)(inMsg.Consume(fusekernel.CreateInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpTmpfile")
+		}
+
+		o = &fuseops.CreateTmpfileOp{
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Mode:      ConvertFileMode(in.Mode),
+			OpenFlags: fusekernel.OpenFlags(in.Flags),
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Groups: suppGroups(ext),
 			},
 		}
 
@@ -267,14 +355,42 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+				Groups: suppGroups(ext),
 			},
 		}
 
-	case fusekernel.OpRename:
-		type input fusekernel.RenameIn
-		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
-		if in == nil {
-			return nil, errors.New("Corrupt OpRename")
+	case fusekernel.OpRename, fusekernel.OpRename2:
+		// Rename with flags is passed on only if the file system asked for it;
+		// otherwise the kernel is told ENOSYS, and fails such renames with
+		// EINVAL.
+		opcode := inMsg.Header().Opcode
+		if opcode == fusekernel.OpRename2 && !config.EnableRenameFlags {
+			o = &unknownOp{
+				OpCode: opcode,
+				Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			}
+			break
+		}
+
+		var newDir uint64
+		var flags uint32
+		if opcode == fusekernel.OpRename2 {
+			type input fusekernel.Rename2In
+			in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+			if in == nil {
+				return nil, errors.New("Corrupt OpRename2")
+			}
+
+			newDir, flags = in.Newdir, in.Flags
+		} else {
+			type input fusekernel.RenameIn
+			in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+			if in == nil {
+				return nil, errors.New("Corrupt OpRename")
+			}
+
+			newDir = in.Newdir
 		}
 
 		names := inMsg.ConsumeBytes(inMsg.Len())
@@ -307,12 +423,14 @@ func convertInMessage(
 		o = &fuseops.RenameOp{
 			OldParent: fuseops.InodeID(inMsg.Header().Nodeid),
 			OldName:   string(oldName),
-			NewParent: fuseops.InodeID(in.Newdir),
+			NewParent: fuseops.InodeID(newDir),
 			NewName:   string(newName),
+			Flags:     fuseops.RenameFlags(flags),
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -330,6 +448,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -347,6 +466,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -364,6 +484,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -374,6 +495,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -392,6 +514,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 		if !config.UseVectoredRead {
@@ -415,6 +538,37 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+		o = to
+
+		readSize := int(in.Size)
+		p := outMsg.Grow(readSize)
+		if p == nil {
+			return nil, fmt.Errorf("Can't grow for %d-byte read", readSize)
+		}
+
+		sh := (*reflect.SliceHeader)(unsafe.Pointer(&to.Dst))
+		sh.Data = uintptr(p)
+		sh.Len = readSize
+		sh.Cap = readSize
+
+	case fusekernel.OpReaddirplus:
+		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpReaddirplus")
+		}
+
+		to := &fuseops.ReadDirPlusOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Offset: fuseops.DirOffset(in.Offset),
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 		o = to
@@ -438,11 +592,14 @@ func convertInMessage(
 		}
 
 		o = &fuseops.ReleaseFileHandleOp{
-			Handle: fuseops.HandleID(in.Fh),
+			Handle:       fuseops.HandleID(in.Fh),
+			UnlockFlocks: fusekernel.ReleaseFlags(in.ReleaseFlags)&fusekernel.ReleaseFlockUnlock != 0,
+			LockOwner:    in.LockOwner,
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -459,6 +616,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -478,10 +636,12 @@ func convertInMessage(
 			Handle: fuseops.HandleID(in.Fh),
 			Data:   buf,
 			Offset: int64(in.Offset),
+			Cached: fusekernel.WriteFlags(in.WriteFlags)&fusekernel.WriteCache != 0,
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -493,12 +653,14 @@ func convertInMessage(
 		}
 
 		o = &fuseops.SyncFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:   fuseops.HandleID(in.Fh),
+			Datasync: in.FsyncFlags&fusekernel.FsyncFdatasync != 0,
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -510,12 +672,14 @@ func convertInMessage(
 		}
 
 		o = &fuseops.FlushFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			LockOwner: in.LockOwner,
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -526,12 +690,38 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
 	case fusekernel.OpStatfs:
 		o = &fuseops.StatFSOp{}
 
+	case fusekernel.OpSyncfs:
+		type input fusekernel.SyncfsIn
+		if in := (*input)(inMsg.Consume(unsafe.Sizeof(input{}))); in == nil {
+			return nil, errors.New("Corrupt OpSyncfs")
+		}
+
+		o = &fuseops.SyncFSOp{
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+
+	case fusekernel.OpDestroy:
+		o = &fuseops.DestroyOp{
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+
 	case fusekernel.OpInterrupt:
 		type input fusekernel.InterruptIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -543,6 +733,24 @@ func convertInMessage(
 			FuseID: in.Unique,
 		}
 
+	case fusekernel.OpNotifyReply:
+		type input fusekernel.NotifyRetrieveIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpNotifyReply")
+		}
+
+		buf := inMsg.ConsumeBytes(uintptr(in.Size))
+		if buf == nil && in.Size != 0 {
+			return nil, errors.New("Corrupt OpNotifyReply")
+		}
+
+		// The message is reused once converted, so keep a copy.
+		o = &notifyReplyOp{
+			NotifyUnique: inMsg.Header().Unique,
+			Data:         append([]byte(nil), buf...),
+		}
+
 	case fusekernel.OpInit:
 		type input fusekernel.InitIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -550,12 +758,26 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpInit")
 		}
 
-		o = &initOp{
+		initOp := &initOp{
 			Kernel:       fusekernel.Protocol{in.Major, in.Minor},
 			MaxReadahead: in.MaxReadahead,
 			Flags:        fusekernel.InitFlags(in.Flags),
 		}
 
+		// On OS X the bit used for InitExt instead means InitVolRename, and there
+		// are no upper flags.
+		if runtime.GOOS != "darwin" && initOp.Flags&fusekernel.InitExt != 0 {
+			type inputExt fusekernel.InitInExt
+			ext := (*inputExt)(inMsg.Consume(unsafe.Sizeof(inputExt{})))
+			if ext == nil {
+				return nil, errors.New("Corrupt OpInit")
+			}
+
+			initOp.Flags2 = fusekernel.InitFlags2(ext.Flags2)
+		}
+
+		o = initOp
+
 	case fusekernel.OpLink:
 		type input fusekernel.LinkIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -581,6 +803,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -598,6 +821,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -616,12 +840,14 @@ func convertInMessage(
 		name = name[:i]
 
 		to := &fuseops.GetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:     string(name),
+			Position: (*fusekernel.GetxattrIn)(in).GetPosition(),
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 		o = to
@@ -654,6 +880,7 @@ func convertInMessage(
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 		o = to
@@ -689,14 +916,16 @@ func convertInMessage(
 		name, value := payload[:i], payload[i+1:len(payload)]
 
 		o = &fuseops.SetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
-			Value: value,
-			Flags: in.Flags,
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:     string(name),
+			Value:    value,
+			Flags:    in.Flags,
+			Position: (*fusekernel.SetxattrIn)(in).GetPosition(),
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 	case fusekernel.OpFallocate:
@@ -711,11 +940,164 @@ func convertInMessage(
 			Handle: fuseops.HandleID(in.Fh),
 			Offset: in.Offset,
 			Length: in.Length,
-			Mode:   in.Mode,
+			Mode:   fuseops.FallocateMode(in.Mode),
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+
+	case fusekernel.OpLseek:
+		type input fusekernel.LseekIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpLseek")
+		}
+
+		o = &fuseops.LseekOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Offset: in.Offset,
+			Whence: fuseops.SeekWhence(in.Whence),
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+
+	case fusekernel.OpCopyFileRange:
+		type input fusekernel.CopyFileRangeIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpCopyFileRange")
+		}
+
+		o = &fuseops.CopyFileRangeOp{
+			InputInode:   fuseops.InodeID(inMsg.Header().Nodeid),
+			InputHandle:  fuseops.HandleID(in.FhIn),
+			InputOffset:  in.OffIn,
+			OutputInode:  fuseops.InodeID(in.NodeidOut),
+			OutputHandle: fuseops.HandleID(in.FhOut),
+			OutputOffset: in.OffOut,
+			Length:       in.Len,
+			Flags:        in.Flags,
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+
+	case fusekernel.OpPoll:
+		type input fusekernel.PollIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpPoll")
+		}
+
+		o = &fuseops.PollOp{
+			Inode:          fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:         fuseops.HandleID(in.Fh),
+			Events:         in.Events,
+			ScheduleNotify: in.Flags&fusekernel.PollScheduleNotify != 0,
+			PollHandle:     fuseops.PollHandle(in.Kh),
 			OpContext: fuseops.OpContext{
 				FuseID: inMsg.Header().Unique,
 				Pid:    inMsg.Header().Pid,
 				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+
+	case fusekernel.OpGetlk, fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpSetlk")
+		}
+
+		lock, err := convertFileLock(in)
+		if err != nil {
+			return nil, err
+		}
+
+		inode := fuseops.InodeID(inMsg.Header().Nodeid)
+		handle := fuseops.HandleID(in.Fh)
+		opContext := fuseops.OpContext{
+			FuseID: inMsg.Header().Unique,
+			Pid:    inMsg.Header().Pid,
+			Uid:    inMsg.Header().Uid,
+			Gid:    inMsg.Header().Gid,
+		}
+
+		switch {
+		case in.LkFlags&fusekernel.LkFlock != 0:
+			o = &fuseops.FlockOp{
+				Inode:     inode,
+				Handle:    handle,
+				Owner:     in.Owner,
+				Type:      lock.Type,
+				Wait:      inMsg.Header().Opcode == fusekernel.OpSetlkw,
+				OpContext: opContext,
+			}
+
+		case inMsg.Header().Opcode == fusekernel.OpGetlk:
+			o = &fuseops.GetLkOp{
+				Inode:     inode,
+				Handle:    handle,
+				Owner:     in.Owner,
+				Lock:      lock,
+				OpContext: opContext,
+			}
+
+		case inMsg.Header().Opcode == fusekernel.OpSetlk:
+			o = &fuseops.SetLkOp{
+				Inode:     inode,
+				Handle:    handle,
+				Owner:     in.Owner,
+				Lock:      lock,
+				OpContext: opContext,
+			}
+
+		default:
+			o = &fuseops.SetLkWaitOp{
+				Inode:     inode,
+				Handle:    handle,
+				Owner:     in.Owner,
+				Lock:      lock,
+				OpContext: opContext,
+			}
+		}
+
+	case fusekernel.OpSetvolname:
+		buf := inMsg.ConsumeBytes(inMsg.Len())
+		n := len(buf)
+		if n == 0 || buf[n-1] != '\x00' {
+			return nil, errors.New("Corrupt OpSetvolname")
+		}
+
+		o = &fuseops.SetVolumeNameOp{
+			Name: string(buf[:n-1]),
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
+			},
+		}
+
+	case fusekernel.OpGetxtimes:
+		o = &fuseops.GetXtimesOp{
+			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: fuseops.OpContext{
+				FuseID: inMsg.Header().Unique,
+				Pid:    inMsg.Header().Pid,
+				Uid:    inMsg.Header().Uid,
+				Gid:    inMsg.Header().Gid,
 			},
 		}
 
@@ -754,6 +1136,9 @@ func (c *Connection) kernelResponse(
 
 	case *interruptOp:
 		return true
+
+	case *notifyReplyOp:
+		return true
 	}
 
 	// If the user returned the error, fill in the error field of the outgoing
@@ -795,50 +1180,72 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.LookUpInodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.GetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
+		out.AttrValid, out.AttrValidNsec = c.convertExpirationTime(o.AttributesExpiration)
 		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
+	case *fuseops.StatxOp:
+		out := (*fusekernel.StatxOut)(m.Grow(int(unsafe.Sizeof(fusekernel.StatxOut{}))))
+		out.AttrValid, out.AttrValidNsec = c.convertExpirationTime(o.AttributesExpiration)
+		convertStatx(o, &out.Stat)
+
 	case *fuseops.SetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
+		out.AttrValid, out.AttrValidNsec = c.convertExpirationTime(o.AttributesExpiration)
 		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.MkDirOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.MkNodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.CreateFileOp:
 		eSize := int(fusekernel.EntryOutSize(c.protocol))
 
 		e := (*fusekernel.EntryOut)(m.Grow(eSize))
-		convertChildInodeEntry(&o.Entry, e)
+		c.convertChildInodeEntry(&o.Entry, e)
+
+		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
+		oo.Fh = uint64(o.Handle)
+
+		if o.BackingID != 0 {
+			oo.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+			oo.BackingID = int32(o.BackingID)
+		}
+
+	case *fuseops.CreateTmpfileOp:
+		eSize := int(fusekernel.EntryOutSize(c.protocol))
+
+		e := (*fusekernel.EntryOut)(m.Grow(eSize))
+		c.convertChildInodeEntry(&o.Entry, e)
 
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
 
+		if o.BackingID != 0 {
+			oo.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+			oo.BackingID = int32(o.BackingID)
+		}
+
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.CreateLinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.RenameOp:
 		// Empty response
@@ -853,11 +1260,11 @@ func (c *Connection) kernelResponseForOp(
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
 
-		if o.CacheDir {
+		if o.CacheDir && !c.cfg.DisableKernelCaching {
 			out.OpenFlags |= uint32(fusekernel.OpenCacheDir)
 		}
 
-		if o.KeepCache {
+		if o.KeepCache && !c.cfg.DisableKernelCaching {
 			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
 		}
 
@@ -867,6 +1274,13 @@ func (c *Connection) kernelResponseForOp(
 		// much the user read.
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
+	case *fuseops.ReadDirPlusOp:
+		// As for ReadDirOp.
+		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
+		if c.cfg.DisableKernelCaching {
+			expireDirentsPlus(o.Dst[:o.BytesRead])
+		}
+
 	case *fuseops.ReleaseDirHandleOp:
 		// Empty response
 
@@ -874,7 +1288,7 @@ func (c *Connection) kernelResponseForOp(
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
 
-		if o.KeepPageCache {
+		if o.KeepPageCache && !c.cfg.DisableKernelCaching {
 			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
 		}
 
@@ -882,6 +1296,15 @@ func (c *Connection) kernelResponseForOp(
 			out.OpenFlags |= uint32(fusekernel.OpenDirectIO)
 		}
 
+		if o.NonSeekable {
+			out.OpenFlags |= uint32(fusekernel.OpenNonSeekable)
+		}
+
+		if o.BackingID != 0 {
+			out.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+			out.BackingID = int32(o.BackingID)
+		}
+
 	case *fuseops.ReadFileOp:
 		if o.Dst != nil {
 			m.Append(o.Dst)
@@ -892,11 +1315,20 @@ func (c *Connection) kernelResponseForOp(
 
 	case *fuseops.WriteFileOp:
 		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
-		out.Size = uint32(len(o.Data))
+		out.Size = bytesWritten(o, len(o.Data))
 
 	case *fuseops.SyncFileOp:
 		// Empty response
 
+	case *fuseops.SyncFSOp:
+		// Empty response
+
+	case *fuseops.AccessOp:
+		// Empty response
+
+	case *fuseops.DestroyOp:
+		// Empty response
+
 	case *fuseops.FlushFileOp:
 		// Empty response
 
@@ -914,6 +1346,9 @@ func (c *Connection) kernelResponseForOp(
 		out.St.Files = o.Inodes
 		out.St.Ffree = o.InodesFree
 		out.St.Namelen = 255
+		if c.cfg.MaxNameLength != 0 {
+			out.St.Namelen = c.cfg.MaxNameLength
+		}
 
 		// The posix spec for sys/statvfs.h (http://goo.gl/LktgrF) defines the
 		// following fields of statvfs, among others:
@@ -969,6 +1404,47 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.FallocateOp:
 		// Empty response
 
+	case *fuseops.LseekOp:
+		out := (*fusekernel.LseekOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LseekOut{}))))
+		out.Offset = o.ResultOffset
+
+	case *fuseops.CopyFileRangeOp:
+		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
+		out.Size = uint32(o.BytesCopied)
+
+	case *fuseops.FlockOp:
+		// Empty response
+
+	case *fuseops.GetLkOp:
+		out := (*fusekernel.LkOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LkOut{}))))
+		out.Lk.Start = o.Conflict.Start
+		out.Lk.End = o.Conflict.End
+		out.Lk.Type = kernelLockType(o.Conflict.Type)
+		out.Lk.Pid = o.Conflict.Pid
+
+	case *fuseops.SetLkOp:
+		// Empty response
+
+	case *fuseops.SetLkWaitOp:
+		// Empty response
+
+	case *fuseops.PollOp:
+		out := (*fusekernel.PollOut)(m.Grow(int(unsafe.Sizeof(fusekernel.PollOut{}))))
+		out.Revents = o.Revents
+
+	case *fuseops.SetVolumeNameOp:
+		// Empty response
+
+	case *fuseops.GetXtimesOp:
+		out := (*fusekernel.GetxtimesOut)(m.Grow(int(unsafe.Sizeof(fusekernel.GetxtimesOut{}))))
+		if !o.BackupTime.IsZero() {
+			out.Bkuptime, out.BkuptimeNsec = convertTime(o.BackupTime)
+		}
+
+		if !o.CreationTime.IsZero() {
+			out.Crtime, out.CrtimeNsec = convertTime(o.CreationTime)
+		}
+
 	case *initOp:
 		out := (*fusekernel.InitOut)(m.Grow(int(unsafe.Sizeof(fusekernel.InitOut{}))))
 
@@ -976,9 +1452,10 @@ func (c *Connection) kernelResponseForOp(
 		out.Minor = o.Library.Minor
 		out.MaxReadahead = o.MaxReadahead
 		out.Flags = uint32(o.Flags)
-		// Default values
-		out.MaxBackground = 12
-		out.CongestionThreshold = 9
+		out.Flags2 = uint32(o.Flags2)
+		out.MaxStackDepth = o.MaxStackDepth
+		out.MaxBackground = o.MaxBackground
+		out.CongestionThreshold = o.CongestionThreshold
 		out.MaxWrite = o.MaxWrite
 		out.TimeGran = 1
 		out.MaxPages = o.MaxPages
@@ -1001,6 +1478,71 @@ func convertTime(t time.Time) (secs uint64, nsec uint32) {
 	return secs, nsec
 }
 
+func convertFileLock(in *fusekernel.LkIn) (fuseops.FileLock, error) {
+	lock := fuseops.FileLock{
+		Start: in.Lk.Start,
+		End:   in.Lk.End,
+		Pid:   in.Lk.Pid,
+	}
+
+	switch in.Lk.Type {
+	case fusekernel.LkUnlock:
+		lock.Type = fuseops.LockUnlock
+	case fusekernel.LkRead:
+		lock.Type = fuseops.LockShared
+	case fusekernel.LkWrite:
+		lock.Type = fuseops.LockExclusive
+	default:
+		return lock, fmt.Errorf("Unknown lock type %d", in.Lk.Type)
+	}
+
+	return lock, nil
+}
+
+func kernelLockType(t fuseops.LockType) uint32 {
+	switch t {
+	case fuseops.LockShared:
+		return fusekernel.LkRead
+	case fuseops.LockExclusive:
+		return fusekernel.LkWrite
+	}
+
+	return fusekernel.LkUnlock
+}
+
+// Return the groups in an ExtGroups request extension, if any.
+func suppGroups(ext []byte) []uint32 {
+	for len(ext) >= fusekernel.ExtHeaderSize {
+		h := (*fusekernel.ExtHeader)(unsafe.Pointer(&ext[0]))
+		if h.Size < uint32(fusekernel.ExtHeaderSize) || int(h.Size) > len(ext) {
+			return nil
+		}
+
+		if h.Type == fusekernel.ExtGroups {
+			body := ext[fusekernel.ExtHeaderSize:h.Size]
+			if len(body) < 4 {
+				return nil
+			}
+
+			n := int((*fusekernel.SuppGroups)(unsafe.Pointer(&body[0])).NrGroups)
+			if len(body) < 4+4*n {
+				return nil
+			}
+
+			groups := make([]uint32, n)
+			for i := range groups {
+				groups[i] = *(*uint32)(unsafe.Pointer(&body[4+4*i]))
+			}
+
+			return groups
+		}
+
+		ext = ext[h.Size:]
+	}
+
+	return nil
+}
+
 func convertAttributes(
 	inodeID fuseops.InodeID,
 	in *fuseops.InodeAttributes,
@@ -1014,25 +1556,70 @@ func convertAttributes(
 	out.Nlink = in.Nlink
 	out.Uid = in.Uid
 	out.Gid = in.Gid
+	out.SetDAX(in.DAX)
 	// round up to the nearest 512 boundary
 	out.Blocks = (in.Size + 512 - 1) / 512
 
 	// Set the mode.
 	out.Mode = ConvertGoMode(in.Mode)
 
-	if out.Mode&(syscall.S_IFCHR|syscall.S_IFBLK) != 0 {
+	// The file type bits overlap, so compare the type as a whole.
+	if t := out.Mode & syscall.S_IFMT; t == syscall.S_IFCHR || t == syscall.S_IFBLK {
 		out.Rdev = in.Rdev
 	}
 }
 
+func convertSxTime(t time.Time) fusekernel.SxTime {
+	return fusekernel.SxTime{
+		Sec:  t.Unix(),
+		Nsec: uint32(t.Nanosecond()),
+	}
+}
+
+func convertStatx(op *fuseops.StatxOp, out *fusekernel.Statx) {
+	in := &op.Attributes
+	btime := in.Btime
+	if btime.IsZero() {
+		btime = in.Crtime
+	}
+
+	out.Mask = uint32(op.ResultMask)
+	if out.Mask == 0 {
+		out.Mask = uint32(fuseops.StatxBasicStats)
+		if !btime.IsZero() {
+			out.Mask |= uint32(fuseops.StatxBtime)
+		}
+	}
+
+	out.Attributes = op.StatxAttributes
+	out.AttributesMask = op.StatxAttributesMask
+	out.Ino = uint64(op.Inode)
+	out.Size = in.Size
+	out.Blocks = (in.Size + 512 - 1) / 512
+	out.Nlink = in.Nlink
+	out.Uid = in.Uid
+	out.Gid = in.Gid
+	out.Mode = uint16(ConvertGoMode(in.Mode))
+	out.Atime = convertSxTime(in.Atime)
+	out.Btime = convertSxTime(btime)
+	out.Ctime = convertSxTime(in.Ctime)
+	out.Mtime = convertSxTime(in.Mtime)
+
+	// Split the device number as the kernel's new_decode_dev does.
+	if t := uint32(out.Mode) & syscall.S_IFMT; t == syscall.S_IFCHR || t == syscall.S_IFBLK {
+		out.RdevMajor = (in.Rdev & 0xfff00) >> 8
+		out.RdevMinor = (in.Rdev & 0xff) | ((in.Rdev >> 12) & 0xfff00)
+	}
+}
+
 // Convert an absolute cache expiration time to a relative time from now for
 // consumption by the fuse kernel module.
-func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
+func convertExpirationTime(t, now time.Time) (secs uint64, nsecs uint32) {
 	// Fuse represents durations as unsigned 64-bit counts of seconds and 32-bit
 	// counts of nanoseconds (cf. http://goo.gl/EJupJV). So negative durations
 	// are right out. There is no need to cap the positive magnitude, because
 	// 2^64 seconds is well longer than the 2^63 ns range of time.Duration.
-	d := t.Sub(time.Now())
+	d := t.Sub(now)
 	if d > 0 {
 		secs = uint64(d / time.Second)
 		nsecs = uint32((d % time.Second) / time.Nanosecond)
@@ -1041,13 +1628,44 @@ func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
 	return secs, nsecs
 }
 
-func convertChildInodeEntry(
+// Convert an expiration time in a response to the op being answered, which
+// is always now with MountConfig.DisableKernelCaching.
+func (c *Connection) convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
+	if c.cfg.DisableKernelCaching {
+		return 0, 0
+	}
+
+	return convertExpirationTime(t, c.now())
+}
+
+// Zero the cache lifetimes of the entries in a ReadDirPlusOp's response,
+// which has the layout of a sequence of fuse_direntplus structs: a
+// fuse_entry_out followed by a fuse_dirent and its name, padded to 8 bytes.
+func expireDirentsPlus(buf []byte) {
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	for len(buf) >= entrySize+fusekernel.DirentSize {
+		e := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+		e.EntryValid, e.EntryValidNsec = 0, 0
+		e.AttrValid, e.AttrValidNsec = 0, 0
+
+		d := (*fusekernel.Dirent)(unsafe.Pointer(&buf[entrySize]))
+		n := entrySize + fusekernel.DirentSize + int(d.Namelen)
+		n = (n + 7) &^ 7
+		if n > len(buf) {
+			break
+		}
+
+		buf = buf[n:]
+	}
+}
+
+func (c *Connection) convertChildInodeEntry(
 	in *fuseops.ChildInodeEntry,
 	out *fusekernel.EntryOut) {
 	out.Nodeid = uint64(in.Child)
 	out.Generation = uint64(in.Generation)
-	out.EntryValid, out.EntryValidNsec = convertExpirationTime(in.EntryExpiration)
-	out.AttrValid, out.AttrValidNsec = convertExpirationTime(in.AttributesExpiration)
+	out.EntryValid, out.EntryValidNsec = c.convertExpirationTime(in.EntryExpiration)
+	out.AttrValid, out.AttrValidNsec = c.convertExpirationTime(in.AttributesExpiration)
 
 	convertAttributes(in.Child, &in.Attributes, &out.Attr)
 }
@@ -1125,3 +1743,13 @@ func writeXattrSize(m *buffer.OutMessage, size uint32) {
 	out := (*fusekernel.GetxattrOut)(m.Grow(int(unsafe.Sizeof(fusekernel.GetxattrOut{}))))
 	out.Size = size
 }
+
+// Return the number of bytes to report written for a WriteFileOp of n bytes,
+// never more than n.
+func bytesWritten(o *fuseops.WriteFileOp, n int) uint32 {
+	if o.BytesWritten > 0 && o.BytesWritten < n {
+		n = o.BytesWritten
+	}
+
+	return uint32(n)
+}
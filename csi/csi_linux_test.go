@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeeperClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keeper.sock")
+	l, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		t.Fatalf("ListenUnix: %v", err)
+	}
+	defer l.Close()
+
+	var k Keeper
+	go k.Serve(l)
+
+	kc := KeeperClient(path)
+	if _, _, err := kc.Get("vol"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Get of missing entry: %v", err)
+	}
+
+	// Store one end of a pipe and close our copy.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+
+	if err := kc.Put("vol", w, []byte("state")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	w.Close()
+
+	// The keeper's copy still works.
+	f, data, err := kc.Get("vol")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if string(data) != "state" {
+		t.Errorf("Data = %q", data)
+	}
+
+	if _, err := f.Write([]byte("x")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f.Close()
+
+	buf := make([]byte, 1)
+	if _, err := r.Read(buf); err != nil || buf[0] != 'x' {
+		t.Errorf("Read: %q, %v", buf, err)
+	}
+
+	// Once deleted, the write end is closed everywhere.
+	if err := kc.Delete("vol"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if _, err := r.Read(buf); err == nil {
+		t.Errorf("Read after delete succeeded")
+	}
+}
+
+func TestFindFuseMount(t *testing.T) {
+	const mountInfo = `22 1 8:1 / / rw shared:1 - ext4 /dev/sda1 rw
+30 22 0:40 / /pods/a rw shared:5 - fuse.gcsfuse bucket rw
+31 22 0:41 / /pods/b rw - tmpfs tmpfs rw
+32 31 0:42 / /pods/b rw - fuse foo rw
+33 22 0:43 / /pods/c rw - fuse foo rw
+34 33 0:44 / /pods/c rw - tmpfs tmpfs rw
+`
+
+	testCases := map[string]bool{
+		"/pods/a": true,
+		"/pods/b": true,
+		"/pods/c": false,
+		"/pods/d": false,
+		"/":       false,
+	}
+
+	for target, want := range testCases {
+		got, err := findFuseMount(strings.NewReader(mountInfo), target)
+		if err != nil || got != want {
+			t.Errorf("%s: got %v, %v; want %v", target, got, err, want)
+		}
+	}
+}
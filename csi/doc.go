@@ -0,0 +1,28 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package csi contains helpers for serving fuse file systems from Kubernetes
+// CSI node plugins.
+//
+// A node plugin mounts a file system into a pod's volume directory when the
+// pod is scheduled, and must keep serving it for as long as the pod runs, even
+// if the plugin itself is restarted or upgraded in the meantime. The kernel
+// keeps a fuse mount alive for as long as some process holds its device open,
+// so the plugin hands the device to a long-lived keeper process (see Keeper)
+// and, when restarted, takes it back and resumes serving (see Mounter).
+//
+// The plugin's pods directory must be mounted into its container with
+// bidirectional propagation, so that mounts made by the plugin are visible to
+// the pods.
+package csi
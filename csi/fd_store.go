@@ -0,0 +1,329 @@
+//go:build unix
+// +build unix
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// FDStore keeps named file descriptors, each with some associated data, on
+// behalf of processes that may restart.
+type FDStore interface {
+	// Store a duplicate of f under the name, replacing any existing entry. The
+	// caller keeps ownership of f.
+	Put(name string, f *os.File, data []byte) error
+
+	// Return a duplicate of the file stored under the name, and its data. The
+	// caller must close the file. If there is none, the error satisfies
+	// errors.Is(err, os.ErrNotExist).
+	Get(name string) (*os.File, []byte, error)
+
+	// Close the file stored under the name, if any.
+	Delete(name string) error
+}
+
+////////////////////////////////////////////////////////////////////////
+// Keeper
+////////////////////////////////////////////////////////////////////////
+
+// Keeper is an FDStore that can also serve its contents to other processes
+// over a unix socket (see Serve and KeeperClient). Run it in a process that
+// outlives the node plugin, e.g. a separate container in the plugin's pod.
+//
+// The zero value is ready to use. It is safe for concurrent use.
+type Keeper struct {
+	mu sync.Mutex
+
+	entries map[string]keptFile // GUARDED_BY(mu)
+}
+
+type keptFile struct {
+	f    *os.File
+	data []byte
+}
+
+// Put implements FDStore.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *Keeper) Put(name string, f *os.File, data []byte) error {
+	dup, err := dupFile(f)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.entries == nil {
+		k.entries = make(map[string]keptFile)
+	}
+
+	if old, ok := k.entries[name]; ok {
+		old.f.Close()
+	}
+
+	k.entries[name] = keptFile{dup, append([]byte(nil), data...)}
+	return nil
+}
+
+// Get implements FDStore.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *Keeper) Get(name string) (*os.File, []byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	e, ok := k.entries[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("%q: %w", name, os.ErrNotExist)
+	}
+
+	dup, err := dupFile(e.f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dup, append([]byte(nil), e.data...), nil
+}
+
+// Delete implements FDStore.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *Keeper) Delete(name string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if e, ok := k.entries[name]; ok {
+		e.f.Close()
+		delete(k.entries, name)
+	}
+
+	return nil
+}
+
+func dupFile(f *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("Dup: %v", err)
+	}
+
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// The wire format of keeper requests and responses. Files are passed
+// alongside as SCM_RIGHTS.
+type keeperRequest struct {
+	Op   string // "put", "get", or "delete"
+	Name string
+	Data []byte
+}
+
+type keeperResponse struct {
+	Error    string
+	NotExist bool
+	Data     []byte
+}
+
+// The largest request or response we accept.
+const keeperMaxMessage = 1 << 16
+
+// Serve accepts connections on the listener, which must be of network type
+// "unixpacket", and answers FDStore requests from KeeperClients until the
+// listener is closed.
+func (k *Keeper) Serve(l *net.UnixListener) error {
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer c.Close()
+			k.handle(c)
+		}()
+	}
+}
+
+func (k *Keeper) handle(c *net.UnixConn) {
+	var req keeperRequest
+	f, err := readKeeperMessage(c, &req)
+	if err != nil {
+		return
+	}
+
+	if f != nil {
+		defer f.Close()
+	}
+
+	var resp keeperResponse
+	var out *os.File
+	switch req.Op {
+	case "put":
+		if f == nil {
+			err = errors.New("put without a file")
+			break
+		}
+
+		err = k.Put(req.Name, f, req.Data)
+
+	case "get":
+		out, resp.Data, err = k.Get(req.Name)
+		if out != nil {
+			defer out.Close()
+		}
+
+	case "delete":
+		err = k.Delete(req.Name)
+
+	default:
+		err = fmt.Errorf("unknown op %q", req.Op)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+		resp.NotExist = errors.Is(err, os.ErrNotExist)
+	}
+
+	writeKeeperMessage(c, &resp, out)
+}
+
+// KeeperClient is an FDStore backed by a Keeper serving on the unixpacket
+// socket at the given path.
+type KeeperClient string
+
+func (kc KeeperClient) call(req *keeperRequest, f *os.File) (*keeperResponse, *os.File, error) {
+	c, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: string(kc), Net: "unixpacket"})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+
+	if err := writeKeeperMessage(c, req, f); err != nil {
+		return nil, nil, err
+	}
+
+	var resp keeperResponse
+	out, err := readKeeperMessage(c, &resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case resp.NotExist:
+		err = fmt.Errorf("%s: %w", resp.Error, os.ErrNotExist)
+	case resp.Error != "":
+		err = errors.New(resp.Error)
+	}
+
+	if err != nil && out != nil {
+		out.Close()
+		out = nil
+	}
+
+	return &resp, out, err
+}
+
+// Put implements FDStore.
+func (kc KeeperClient) Put(name string, f *os.File, data []byte) error {
+	_, _, err := kc.call(&keeperRequest{Op: "put", Name: name, Data: data}, f)
+	return err
+}
+
+// Get implements FDStore.
+func (kc KeeperClient) Get(name string) (*os.File, []byte, error) {
+	resp, f, err := kc.call(&keeperRequest{Op: "get", Name: name}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if f == nil {
+		return nil, nil, errors.New("keeper returned no file")
+	}
+
+	return f, resp.Data, nil
+}
+
+// Delete implements FDStore.
+func (kc KeeperClient) Delete(name string) error {
+	_, _, err := kc.call(&keeperRequest{Op: "delete", Name: name}, nil)
+	return err
+}
+
+func writeKeeperMessage(c *net.UnixConn, v interface{}, f *os.File) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var oob []byte
+	if f != nil {
+		oob = syscall.UnixRights(int(f.Fd()))
+	}
+
+	_, _, err = c.WriteMsgUnix(b, oob, nil)
+	return err
+}
+
+func readKeeperMessage(c *net.UnixConn, v interface{}) (*os.File, error) {
+	buf := make([]byte, keeperMaxMessage)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := c.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	var f *os.File
+	if oobn > 0 {
+		scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, scm := range scms {
+			fds, err := syscall.ParseUnixRights(&scm)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, fd := range fds {
+				if f == nil {
+					f = os.NewFile(uintptr(fd), "kept")
+				} else {
+					syscall.Close(fd)
+				}
+			}
+		}
+	}
+
+	if err := json.Unmarshal(buf[:n], v); err != nil {
+		if f != nil {
+			f.Close()
+		}
+
+		return nil, err
+	}
+
+	return f, nil
+}
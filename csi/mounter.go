@@ -0,0 +1,168 @@
+//go:build linux
+// +build linux
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jacobsa/fuse"
+)
+
+// Mounter mounts file systems for a node plugin, keeping their devices in an
+// FDStore so that a restarted plugin can resume serving them.
+type Mounter struct {
+	// Where to keep devices. Typically a KeeperClient.
+	Store FDStore
+
+	// The configuration for new mounts and resumed ones.
+	Config fuse.MountConfig
+}
+
+// Publish makes the file system served by server available at target, for
+// example in NodePublishVolume. name identifies the mount in the store, and
+// is typically the volume ID.
+//
+// If the store has a device for the name and target is still a fuse mount,
+// the existing mount is resumed (see fuse.Resume). Otherwise the file system
+// is mounted afresh, after checking that target propagates mounts to the
+// host, and its device stored.
+func (m *Mounter) Publish(
+	name string,
+	target string,
+	server fuse.Server) (*fuse.MountedFileSystem, error) {
+	dev, data, err := m.Store.Get(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+
+	case err != nil:
+		return nil, fmt.Errorf("Get: %v", err)
+
+	default:
+		if mounted, err := isFuseMount(target); err != nil {
+			dev.Close()
+			return nil, err
+		} else if mounted {
+			return m.resume(target, dev, data, server)
+		}
+
+		// The mount went away while we weren't looking.
+		dev.Close()
+		if err := m.Store.Delete(name); err != nil {
+			return nil, fmt.Errorf("Delete: %v", err)
+		}
+	}
+
+	if err := fuse.CheckMountPropagation(target); err != nil {
+		return nil, err
+	}
+
+	mfs, err := fuse.Mount(target, server, &m.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, session := mfs.Session()
+	data, err = json.Marshal(session)
+	if err == nil {
+		err = m.Store.Put(name, dev, data)
+	}
+
+	if err != nil {
+		fuse.Unmount(target)
+		return nil, fmt.Errorf("Storing device: %v", err)
+	}
+
+	return mfs, nil
+}
+
+func (m *Mounter) resume(
+	target string,
+	dev *os.File,
+	data []byte,
+	server fuse.Server) (*fuse.MountedFileSystem, error) {
+	var session fuse.Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("Decoding session: %v", err)
+	}
+
+	mfs, err := fuse.Resume(target, dev, session, server, &m.Config)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	return mfs, nil
+}
+
+// Unpublish unmounts target and removes its device from the store, for
+// example in NodeUnpublishVolume. It succeeds if target is not mounted.
+func (m *Mounter) Unpublish(name string, target string) error {
+	mounted, err := isFuseMount(target)
+	if err != nil {
+		return err
+	}
+
+	if mounted {
+		if err := fuse.Unmount(target); err != nil {
+			return err
+		}
+	}
+
+	return m.Store.Delete(name)
+}
+
+// Is there a fuse file system mounted at exactly the given path?
+func isFuseMount(target string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	return findFuseMount(f, target)
+}
+
+func findFuseMount(r io.Reader, target string) (bool, error) {
+	found := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Cf. proc(5). The file system type follows the "-" separator.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 || fields[4] != target {
+			continue
+		}
+
+		for i := 6; i+1 < len(fields); i++ {
+			if fields[i] == "-" {
+				// Later mounts hide earlier ones.
+				fstype := fields[i+1]
+				found = fstype == "fuse" || strings.HasPrefix(fstype, "fuse.")
+				break
+			}
+		}
+	}
+
+	return found, scanner.Err()
+}
@@ -66,6 +66,9 @@ func describeRequest(op interface{}) (s string) {
 	case *interruptOp:
 		addComponent("fuseid 0x%08x", typed.FuseID)
 
+	case *notifyReplyOp:
+		addComponent("%d bytes", len(typed.Data))
+
 	case *unknownOp:
 		addComponent("opcode %d", typed.OpCode)
 
@@ -86,11 +89,26 @@ func describeRequest(op interface{}) (s string) {
 			addComponent("mtime %v", *typed.Mtime)
 		}
 
+	case *fuseops.StatxOp:
+		addComponent("mask %v", typed.Mask)
+
+	case *fuseops.AccessOp:
+		addComponent("mask %#o", typed.Mask)
+
 	case *fuseops.RenameOp:
 		addComponent("old_parent %v", typed.OldParent)
 		addComponent("old_name %q", typed.OldName)
 		addComponent("new_parent %v", typed.NewParent)
 		addComponent("new_name %q", typed.NewName)
+		if typed.Flags != 0 {
+			addComponent("flags %v", typed.Flags)
+		}
+
+	case *fuseops.SyncFileOp:
+		addComponent("handle %d", typed.Handle)
+		if typed.Datasync {
+			addComponent("datasync")
+		}
 
 	case *fuseops.ReadFileOp:
 		addComponent("handle %d", typed.Handle)
@@ -114,7 +132,35 @@ func describeRequest(op interface{}) (s string) {
 	case *fuseops.FallocateOp:
 		addComponent("offset %d", typed.Offset)
 		addComponent("length %d", typed.Length)
-		addComponent("mode %d", typed.Mode)
+		addComponent("mode %v", typed.Mode)
+
+	case *fuseops.LseekOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("offset %d", typed.Offset)
+		addComponent("%v", typed.Whence)
+
+	case *fuseops.FlockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.Owner)
+		addComponent("%v", typed.Type)
+		if typed.Wait {
+			addComponent("wait")
+		}
+
+	case *fuseops.GetLkOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.Owner)
+		addComponent("%v [%d, %d]", typed.Lock.Type, typed.Lock.Start, typed.Lock.End)
+
+	case *fuseops.SetLkOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.Owner)
+		addComponent("%v [%d, %d]", typed.Lock.Type, typed.Lock.Start, typed.Lock.End)
+
+	case *fuseops.SetLkWaitOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.Owner)
+		addComponent("%v [%d, %d]", typed.Lock.Type, typed.Lock.Start, typed.Lock.End)
 
 	case *fuseops.ReleaseFileHandleOp:
 		addComponent("handle %d", typed.Handle)
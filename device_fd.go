@@ -0,0 +1,80 @@
+//go:build unix
+// +build unix
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ReceiveDevice reads a message carrying a single file descriptor from the
+// socket, in the format used by fusermount(1), and returns the descriptor as
+// a file. It allows an unprivileged process (e.g. in a container) to serve a
+// file system mounted by a privileged helper, which opens /dev/fuse, mounts
+// it, and passes the device to the process with SendDevice.
+//
+// To serve the device, give Mount the path "/dev/fd/N", where N is the
+// descriptor's number (Linux only).
+func ReceiveDevice(uc *net.UnixConn) (*os.File, error) {
+	// Read a message.
+	buf := make([]byte, 32) // expect 1 byte
+	oob := make([]byte, 32) // expect 24 bytes
+	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("ReadMsgUnix: %v", err)
+	}
+
+	// Parse the message.
+	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("ParseSocketControlMessage: %v", err)
+	}
+
+	// We expect one message.
+	if len(scms) != 1 {
+		return nil, fmt.Errorf("expected 1 SocketControlMessage; got scms = %#v", scms)
+	}
+
+	scm := scms[0]
+
+	// Pull out the FD.
+	gotFds, err := syscall.ParseUnixRights(&scm)
+	if err != nil {
+		return nil, fmt.Errorf("syscall.ParseUnixRights: %v", err)
+	}
+
+	if len(gotFds) != 1 {
+		return nil, fmt.Errorf("wanted 1 fd; got %#v", gotFds)
+	}
+
+	// Turn the FD into an os.File.
+	return os.NewFile(uintptr(gotFds[0]), "/dev/fuse"), nil
+}
+
+// SendDevice sends the device over the socket in the format expected by
+// ReceiveDevice. The caller may close dev afterward.
+func SendDevice(uc *net.UnixConn, dev *os.File) error {
+	rights := syscall.UnixRights(int(dev.Fd()))
+	if _, _, err := uc.WriteMsgUnix([]byte{0}, rights, nil); err != nil {
+		return fmt.Errorf("WriteMsgUnix: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+)
+
+// Return a copy of the device in non-blocking mode, registered with the Go
+// runtime's poller (epoll), and close the original. Goroutines waiting for
+// requests on the copy park in the runtime rather than holding an OS thread
+// in read(2).
+//
+// This works only once the device is mounted: before that, the kernel
+// reports it as always in error to poll(2).
+func pollableDevice(dev *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(dev.Fd()))
+	if err != nil {
+		return nil, err
+	}
+
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// os.NewFile registers descriptors that are already non-blocking with the
+	// poller, and leaves them non-blocking when Fd is called.
+	pollable := os.NewFile(uintptr(fd), dev.Name())
+	dev.Close()
+
+	return pollable, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The most slices writev(2) accepts, IOV_MAX on Linux and OS X. More fail the
+// whole write with EINVAL.
+const maxIovecs = 1024
+
+var writeLock sync.Mutex
+
+// Write a message made of the supplied slices to the kernel.
+//
+// The kernel drivers' devices take a message in one write or not at all, but
+// the socket used by fuse-t may take only part of a large one, in which case
+// the rest is written after it; the lock keeps other messages from landing in
+// between. Writes interrupted by a signal before writing anything are tried
+// again.
+func (c *Connection) writeDevice(packet [][]byte) error {
+	if fusekernel.IsPlatformFuseT {
+		// writev is not atomic on macos, restrict to fuse-t platform
+		writeLock.Lock()
+		defer writeLock.Unlock()
+	}
+
+	packet = coalesce(packet, maxIovecs)
+	fd := int(c.dev.Fd())
+	for len(packet) != 0 {
+		n, err := writev(fd, packet)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+
+		packet = skipWritten(packet, n)
+	}
+
+	return nil
+}
+
+// Return the non-empty slices of the packet, copying the tail into a single
+// slice if there are more than max of them.
+func coalesce(packet [][]byte, max int) [][]byte {
+	out := make([][]byte, 0, len(packet))
+	for _, b := range packet {
+		if len(b) != 0 {
+			out = append(out, b)
+		}
+	}
+
+	if len(out) <= max {
+		return out
+	}
+
+	var tail []byte
+	for _, b := range out[max-1:] {
+		tail = append(tail, b...)
+	}
+
+	return append(out[:max-1], tail)
+}
+
+// Drop the first n bytes of the packet, whose slices must be non-empty.
+func skipWritten(packet [][]byte, n int) [][]byte {
+	for len(packet) != 0 && n >= len(packet[0]) {
+		n -= len(packet[0])
+		packet = packet[1:]
+	}
+
+	if n > 0 {
+		packet[0] = packet[0][n:]
+	}
+
+	return packet
+}
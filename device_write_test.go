@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func Test_coalesce(t *testing.T) {
+	packet := [][]byte{[]byte("a"), nil, []byte("bc"), []byte("d"), []byte("ef")}
+
+	if got, want := coalesce(packet, 10), [][]byte{[]byte("a"), []byte("bc"), []byte("d"), []byte("ef")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("coalesce(10) = %q, want %q", got, want)
+	}
+
+	if got, want := coalesce(packet, 2), [][]byte{[]byte("a"), []byte("bcdef")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("coalesce(2) = %q, want %q", got, want)
+	}
+}
+
+func Test_skipWritten(t *testing.T) {
+	testCases := []struct {
+		n    int
+		want [][]byte
+	}{
+		{0, [][]byte{[]byte("ab"), []byte("cd")}},
+		{1, [][]byte{[]byte("b"), []byte("cd")}},
+		{2, [][]byte{[]byte("cd")}},
+		{3, [][]byte{[]byte("d")}},
+		{4, [][]byte{}},
+	}
+
+	for _, tc := range testCases {
+		packet := [][]byte{[]byte("ab"), []byte("cd")}
+		if got := skipWritten(packet, tc.n); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("skipWritten(%d) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func Test_writeDeviceManySlices(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	defer kernel.Close()
+
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer dev.Close()
+
+	// More slices than writev accepts, e.g. from a vectored read, still make
+	// a single message.
+	var packet [][]byte
+	var want []byte
+	for i := 0; i < 3*maxIovecs; i++ {
+		b := []byte{byte(i), byte(i >> 8)}
+		packet = append(packet, b)
+		want = append(want, b...)
+	}
+
+	c := &Connection{dev: dev}
+	if err := c.writeDevice(packet); err != nil {
+		t.Fatalf("writeDevice: %v", err)
+	}
+
+	buf := make([]byte, 2*len(want))
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("Read %d bytes, want %d", n, len(want))
+	}
+}
@@ -14,7 +14,10 @@
 
 package fuse
 
-import "syscall"
+import (
+	"errors"
+	"syscall"
+)
 
 const (
 	// Errors corresponding to kernel error numbers. These may be treated
@@ -22,9 +25,37 @@ const (
 	EEXIST    = syscall.EEXIST
 	EINVAL    = syscall.EINVAL
 	EIO       = syscall.EIO
-	ENOATTR   = syscall.ENODATA
+	ENOATTR   = enoattr
 	ENOENT    = syscall.ENOENT
 	ENOSYS    = syscall.ENOSYS
 	ENOTDIR   = syscall.ENOTDIR
 	ENOTEMPTY = syscall.ENOTEMPTY
 )
+
+// ErrPlatformUnsupported is returned (possibly wrapped) by Mount and Unmount
+// on platforms without fuse support, so that programs that mount file systems
+// only optionally can compile everywhere and check for it with errors.Is.
+var ErrPlatformUnsupported = errors.New("fuse is not supported on this platform")
+
+// ErrUserAllowOther is returned (possibly wrapped) by Mount on Linux when
+// MountConfig.AllowOther or AllowRoot is set for a mount by an unprivileged
+// user, but fusermount won't allow it because /etc/fuse.conf doesn't contain
+// the line user_allow_other.
+var ErrUserAllowOther = errors.New(
+	"allow_other is only allowed if user_allow_other is set in /etc/fuse.conf")
+
+// ErrConnectionAborted is returned by MountedFileSystem.Join when the kernel's
+// connection to the file system was aborted, e.g. through the abort file in
+// the fuse control file system, rather than the file system being unmounted.
+// The kernel fails the requests it had sent with ENOTCONN, and so does every
+// later access to the mount, until it is unmounted.
+var ErrConnectionAborted = errors.New("fuse connection aborted")
+
+// ErrMountpointGone is returned by MountedFileSystem.Join on Linux when the
+// mountpoint disappeared while the file system was being served: the
+// directory was removed from another mount namespace, or the file system
+// containing it was lazily unmounted, taking the mount with it. Nothing can
+// reach the file system by its path any more, so rather than serve whatever
+// still has files open in it indefinitely, the connection is aborted, as for
+// ErrConnectionAborted.
+var ErrMountpointGone = errors.New("mountpoint disappeared")
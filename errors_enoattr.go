@@ -0,0 +1,9 @@
+//go:build freebsd || openbsd || dragonfly
+// +build freebsd openbsd dragonfly
+
+package fuse
+
+import "syscall"
+
+// These systems have no ENODATA; their xattr calls fail with ENOATTR instead.
+const enoattr = syscall.ENOATTR
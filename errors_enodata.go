@@ -0,0 +1,8 @@
+//go:build !freebsd && !openbsd && !dragonfly
+// +build !freebsd,!openbsd,!dragonfly
+
+package fuse
+
+import "syscall"
+
+const enoattr = syscall.ENODATA
@@ -28,12 +28,19 @@ import (
 func (c *Connection) getInMessage() *buffer.InMessage {
 	c.mu.Lock()
 	x := (*buffer.InMessage)(c.inMessages.Get())
+	if x != nil {
+		c.inBytesFree -= int64(x.Cap())
+	}
 	c.mu.Unlock()
 
 	if x == nil {
-		x = buffer.NewInMessage()
+		x = buffer.NewInMessageSize(c.maxWrite())
 	}
 
+	c.mu.Lock()
+	c.inBytesInUse += int64(x.Cap())
+	c.mu.Unlock()
+
 	return x
 }
 
@@ -41,6 +48,8 @@ func (c *Connection) getInMessage() *buffer.InMessage {
 func (c *Connection) putInMessage(x *buffer.InMessage) {
 	c.mu.Lock()
 	c.inMessages.Put(unsafe.Pointer(x))
+	c.inBytesInUse -= int64(x.Cap())
+	c.inBytesFree += int64(x.Cap())
 	c.mu.Unlock()
 }
 
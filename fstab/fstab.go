@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fstab reads fstab-style descriptions of several file systems and
+// keeps them mounted for the lifetime of a daemon.
+//
+// A table has one mount per line, with whitespace-separated fields:
+//
+//	# backend   mount point       options
+//	memfs       /mnt/scratch      fsname=scratch,subtype=memfs
+//	hellofs     /mnt/hello        ro
+//
+// The backend names a Backend registered with a Supervisor. The options field
+// is optional and is a comma-separated list of key=value pairs or bare keys.
+// Blank lines and lines beginning with '#' are ignored.
+package fstab
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Entry describes a single mount within a table.
+type Entry struct {
+	// The name of the backend serving the file system.
+	Backend string
+
+	// The directory on which to mount it.
+	MountPoint string
+
+	// Options from the table. Bare keys map to the empty string.
+	Options map[string]string
+}
+
+// Parse reads a table from r. Errors mention the offending line number.
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	seen := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected 2 or 3 fields, got %d", lineNum, len(fields))
+		}
+
+		e := Entry{
+			Backend:    fields[0],
+			MountPoint: fields[1],
+			Options:    make(map[string]string),
+		}
+
+		if prev, ok := seen[e.MountPoint]; ok {
+			return nil, fmt.Errorf("line %d: %s already mounted on line %d", lineNum, e.MountPoint, prev)
+		}
+
+		seen[e.MountPoint] = lineNum
+
+		if len(fields) == 3 {
+			for _, opt := range strings.Split(fields[2], ",") {
+				if opt == "" {
+					return nil, fmt.Errorf("line %d: empty option", lineNum)
+				}
+
+				k, v, _ := strings.Cut(opt, "=")
+				e.Options[k] = v
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// ReadFile parses the table in the named file.
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fstab_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fstab"
+)
+
+func TestParse(t *testing.T) {
+	const table = `
+# A comment.
+memfs    /mnt/scratch   fsname=scratch,subtype=memfs
+
+  hellofs  /mnt/hello     ro
+loopback /mnt/loop
+`
+
+	entries, err := fstab.Parse(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	want := []fstab.Entry{
+		{
+			Backend:    "memfs",
+			MountPoint: "/mnt/scratch",
+			Options:    map[string]string{"fsname": "scratch", "subtype": "memfs"},
+		},
+		{
+			Backend:    "hellofs",
+			MountPoint: "/mnt/hello",
+			Options:    map[string]string{"ro": ""},
+		},
+		{
+			Backend:    "loopback",
+			MountPoint: "/mnt/loop",
+			Options:    map[string]string{},
+		},
+	}
+
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Parse = %+v, want %+v", entries, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := []struct {
+		table string
+		want  string
+	}{
+		{"memfs\n", "line 1: expected 2 or 3 fields"},
+		{"a /m b c\n", "line 1: expected 2 or 3 fields"},
+		{"a /m\n\nb /m\n", "line 3: /m already mounted on line 1"},
+		{"a /m ro,,x\n", "line 1: empty option"},
+	}
+
+	for _, tc := range testCases {
+		_, err := fstab.Parse(strings.NewReader(tc.table))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Parse(%q): %v, want %q", tc.table, err, tc.want)
+		}
+	}
+}
+
+func TestRunRejectsUnknownBackend(t *testing.T) {
+	s := &fstab.Supervisor{
+		Backends: map[string]fstab.Backend{
+			"known": func(map[string]string) (fuse.Server, error) {
+				t.Fatal("Backend called")
+				return nil, nil
+			},
+		},
+	}
+
+	err := s.Run(context.Background(), []fstab.Entry{
+		{Backend: "known", MountPoint: "/a"},
+		{Backend: "unknown", MountPoint: "/b"},
+	})
+
+	if err == nil || !strings.Contains(err.Error(), `unknown backend "unknown"`) {
+		t.Errorf("Run: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fstab
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+// Backend creates a server for a mount, given the entry's options. It is
+// called again each time the mount is re-established, so must return a fresh
+// server each time.
+type Backend func(options map[string]string) (fuse.Server, error)
+
+// DefaultRemountDelay is the delay used when Supervisor.RemountDelay is zero.
+const DefaultRemountDelay = time.Second
+
+// Supervisor mounts the entries of a table and keeps them mounted. If a file
+// system is unmounted by anything other than the supervisor itself, e.g. by
+// `fusermount -u` or because its server exited, it is mounted again after
+// RemountDelay, retrying until that succeeds.
+//
+// The following options are interpreted by the supervisor, overriding the
+// corresponding fields of Config:
+//
+//	ro          MountConfig.ReadOnly
+//	fsname=X    MountConfig.FSName
+//	subtype=X   MountConfig.Subtype
+//	volname=X   MountConfig.VolumeName
+//
+// All options, including these, are passed to the backend.
+type Supervisor struct {
+	// The available backends, by the name used in the table.
+	Backends map[string]Backend
+
+	// The configuration on which each mount's is based.
+	Config fuse.MountConfig
+
+	// The delay before remounting a file system that went away. If zero,
+	// DefaultRemountDelay is used.
+	RemountDelay time.Duration
+
+	// A logger for unexpected unmounts and remount failures. If nil, nothing is
+	// logged.
+	Logger *log.Logger
+}
+
+// Run mounts every entry, then supervises the mounts until ctx is cancelled,
+// at which point it unmounts them all and returns. If any entry can't be
+// mounted initially, those already mounted are unmounted and the error is
+// returned.
+func (s *Supervisor) Run(ctx context.Context, entries []Entry) error {
+	for _, e := range entries {
+		if _, ok := s.Backends[e.Backend]; !ok {
+			return fmt.Errorf("%s: unknown backend %q", e.MountPoint, e.Backend)
+		}
+	}
+
+	// Mount everything up front, so that configuration problems are reported
+	// to the caller rather than retried forever.
+	mounted := make([]*fuse.MountedFileSystem, 0, len(entries))
+	for _, e := range entries {
+		mfs, err := s.mount(e)
+		if err != nil {
+			for i, mfs := range mounted {
+				s.unmount(entries[i], mfs)
+			}
+
+			return err
+		}
+
+		mounted = append(mounted, mfs)
+	}
+
+	var wg sync.WaitGroup
+	for i := range entries {
+		wg.Add(1)
+		go func(e Entry, mfs *fuse.MountedFileSystem) {
+			defer wg.Done()
+			s.supervise(ctx, e, mfs)
+		}(entries[i], mounted[i])
+	}
+
+	wg.Wait()
+	return nil
+}
+
+func (s *Supervisor) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+func (s *Supervisor) mount(e Entry) (*fuse.MountedFileSystem, error) {
+	server, err := s.Backends[e.Backend](e.Options)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %v", e.MountPoint, e.Backend, err)
+	}
+
+	cfg := s.Config
+	for k, v := range e.Options {
+		switch k {
+		case "ro":
+			cfg.ReadOnly = true
+		case "fsname":
+			cfg.FSName = v
+		case "subtype":
+			cfg.Subtype = v
+		case "volname":
+			cfg.VolumeName = v
+		}
+	}
+
+	mfs, err := fuse.Mount(e.MountPoint, server, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: Mount: %v", e.MountPoint, err)
+	}
+
+	return mfs, nil
+}
+
+// Unmount the file system and wait for its server to finish. If unmounting
+// fails, e.g. because the file system is busy, the error is logged and the
+// server is abandoned.
+func (s *Supervisor) unmount(e Entry, mfs *fuse.MountedFileSystem) {
+	if err := fuse.Unmount(e.MountPoint); err != nil {
+		s.logf("%s: Unmount: %v", e.MountPoint, err)
+		return
+	}
+
+	mfs.Join(context.Background())
+}
+
+// Keep the entry mounted until ctx is cancelled, then unmount it.
+func (s *Supervisor) supervise(
+	ctx context.Context,
+	e Entry,
+	mfs *fuse.MountedFileSystem) {
+	delay := s.RemountDelay
+	if delay == 0 {
+		delay = DefaultRemountDelay
+	}
+
+	for {
+		joined := make(chan error, 1)
+		go func() { joined <- mfs.Join(context.Background()) }()
+
+		select {
+		case <-ctx.Done():
+			if err := fuse.Unmount(e.MountPoint); err != nil {
+				s.logf("%s: Unmount: %v", e.MountPoint, err)
+				return
+			}
+
+			<-joined
+			return
+
+		case err := <-joined:
+			s.logf("%s: unmounted unexpectedly (%v); remounting", e.MountPoint, err)
+		}
+
+		// Retry until we're mounted again or told to stop.
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			var err error
+			if mfs, err = s.mount(e); err == nil {
+				break
+			}
+
+			s.logf("%v", err)
+		}
+	}
+}
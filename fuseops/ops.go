@@ -38,6 +38,21 @@ type OpContext struct {
 	// UID of the process that is invoking the operation.
 	// Not filled in case of a writepage operation.
 	Uid uint32
+
+	// GID of the process that is invoking the operation.
+	// Not filled in case of a writepage operation.
+	Gid uint32
+
+	// Supplementary groups of the process that is invoking the operation, as
+	// far as the kernel supplies them (Linux >= 6.3, with
+	// MountConfig.EnableCreateSuppGroup). Only filled in for ops that create
+	// entries, and then with the parent directory's group if the process
+	// belongs to it through a group other than Gid. A file system that checks
+	// permissions or chooses the new entry's group itself, e.g. by creating it
+	// with the caller's credentials, should count these groups as the
+	// caller's, so that creating entries in group-writable and setgid
+	// directories behaves as on a local file system.
+	Groups []uint32
 }
 
 // Return statistics about the file system's capacity and available resources.
@@ -111,6 +126,26 @@ type StatFSOp struct {
 	InodesFree uint64
 }
 
+// Write all of the file system's dirty state to storage, in response to
+// syncfs(2) or sync(2), after the kernel has written back its own dirty pages.
+// Where SyncFileOp covers one file, this covers everything, e.g. metadata
+// kept in memory and writes buffered for files no longer open.
+//
+// The kernel sends this only if it trusts the server not to hang sync(2),
+// which in practice means virtiofs; other mounts get nothing. It stops after
+// the file system returns ENOSYS.
+type SyncFSOp struct {
+	OpContext OpContext
+}
+
+// The kernel is tearing down the session, and will send nothing more. This is
+// sent when fuseblk and virtiofs mounts are unmounted, and umount(2) waits for
+// the reply, so it is the place to write out anything still buffered. Other
+// mounts just see the device close.
+type DestroyOp struct {
+	OpContext OpContext
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Inodes
 ////////////////////////////////////////////////////////////////////////
@@ -130,6 +165,11 @@ type LookUpInodeOp struct {
 	//
 	// the file system may receive a request to look up the child named "bar" for
 	// the parent foo/.
+	//
+	// If fuse.MountConfig.EnableExportSupport is set, the name may also be "."
+	// to look up Parent itself, from an NFS file handle naming an inode that
+	// the kernel no longer knows, or ".." to look up the directory containing
+	// Parent. Otherwise the kernel resolves these names itself.
 	Name string
 
 	// The resulting entry. Must be filled out by the file system.
@@ -156,6 +196,62 @@ type GetInodeAttributesOp struct {
 	OpContext            OpContext
 }
 
+// Get attributes for statx(2), which can carry more than GetInodeAttributesOp:
+// the birth time, and flags such as whether the file is immutable. Linux
+// (>= 6.6) sends this when statx(2) asks for fields that stat(2) doesn't
+// report, e.g. STATX_BTIME. If the file system returns ENOSYS, the kernel
+// stops sending it and makes do with GetInodeAttributesOp, reporting no birth
+// time.
+//
+// The kernel fills in the mount ID and device numbers itself.
+type StatxOp struct {
+	// The inode of interest, and the handle if the caller has it open, e.g. for
+	// fstat(2).
+	Inode  InodeID
+	Handle *HandleID
+
+	// The fields the caller asked for. The file system may report more, or
+	// fewer if it doesn't know them.
+	Mask StatxMask
+
+	// Set by the file system: attributes for the inode, including Btime, and
+	// the time at which they should expire, as for GetInodeAttributesOp.
+	Attributes           InodeAttributes
+	AttributesExpiration time.Time
+
+	// Set by the file system: the fields of Attributes that are valid. If
+	// zero, the basic fields are, and the birth time if Attributes has one.
+	ResultMask StatxMask
+
+	// Set by the file system: the STATX_ATTR_* flags that apply to the file,
+	// e.g. STATX_ATTR_IMMUTABLE, and the mask of those the file system knows
+	// about, so that the caller can tell unset flags from unsupported ones.
+	StatxAttributes     uint64
+	StatxAttributesMask uint64
+
+	OpContext OpContext
+}
+
+// Check whether the caller may access an inode in the ways given by Mask, in
+// response to access(2) and chdir(2). The kernel sends this only if the file
+// system was mounted with fuse.MountConfig.DisableDefaultPermissions, in which
+// case permissions are the file system's business; otherwise the kernel checks
+// the mode bits itself. Return nil to grant access, and EACCES to deny it.
+//
+// A file system that returns ENOSYS isn't asked again: access(2) succeeds
+// from then on. See fuseutil.CheckAccess for the checks the kernel would make.
+type AccessOp struct {
+	// The inode of interest.
+	Inode InodeID
+
+	// The kinds of access asked for, with the bits of access(2)'s mode:
+	// fuseutil.AccessRead, AccessWrite and AccessExecute. Zero asks only
+	// whether the inode exists.
+	Mask uint32
+
+	OpContext OpContext
+}
+
 // Change attributes for an inode.
 //
 // The kernel sends this for obvious cases like chmod(2), and for less obvious
@@ -175,6 +271,12 @@ type SetInodeAttributesOp struct {
 	Atime *time.Time
 	Mtime *time.Time
 
+	// The change time to record, sent under writeback caching (see
+	// fuse.MountConfig.DisableWritebackCaching) along with Mtime once the
+	// kernel has written back modified pages. Otherwise the file system
+	// chooses the ctime itself.
+	Ctime *time.Time
+
 	// Set by the file system: the new attributes for the inode, and the time at
 	// which they should expire. See notes on
 	// ChildInodeEntry.AttributesExpiration for more.
@@ -308,7 +410,8 @@ type MkNodeOp struct {
 	Name string
 	Mode os.FileMode
 
-	// The device number (only valid if created file is a device)
+	// The device number (only valid if created file is a device). A Mode of
+	// WhiteoutMode with an Rdev of zero creates a whiteout.
 	Rdev uint32
 
 	// Set by the file system: information about the inode that was created.
@@ -351,7 +454,55 @@ type CreateFileOp struct {
 	// The handle may be supplied in future ops like ReadFileOp that contain a
 	// file handle. The file system must ensure this ID remains valid until a
 	// later call to ReleaseFileHandle.
-	Handle    HandleID
+	Handle HandleID
+
+	// Set by the file system: a backing file for passthrough I/O. See
+	// OpenFileOp.BackingID.
+	BackingID BackingID
+
+	// The flags the file is being opened with, as for OpenFileOp.
+	OpenFlags fusekernel.OpenFlags
+
+	OpContext OpContext
+}
+
+// Create a file inode with no name and open it, in response to open(2) with
+// O_TMPFILE. The kernel sends this only to file systems that implement it,
+// failing O_TMPFILE with EOPNOTSUPP once one returns ENOSYS.
+//
+// The file system should regard the inode as having no links, so that it goes
+// away once forgotten, but report Nlink as 1 in Entry.Attributes: the kernel
+// drops a link from what it is told, as it does for disk file systems. If the
+// file was opened without O_EXCL, it may later be given a name with linkat(2)
+// and AT_EMPTY_PATH, which arrives as a CreateLinkOp whose Target is this
+// inode; the file system should then count the link as usual.
+type CreateTmpfileOp struct {
+	// The ID of the directory inode in which the file is created, e.g. to find
+	// the right backing file system. No entry is added to it.
+	Parent InodeID
+
+	// The mode with which to create the file.
+	Mode os.FileMode
+
+	// Set by the file system: information about the inode that was created.
+	//
+	// The lookup count for the inode is implicitly incremented. See notes on
+	// ForgetInodeOp for more information.
+	Entry ChildInodeEntry
+
+	// Set by the file system: an opaque ID that will be echoed in follow-up
+	// calls for this file. See CreateFileOp.Handle.
+	Handle HandleID
+
+	// Set by the file system: a backing file for passthrough I/O. See
+	// OpenFileOp.BackingID.
+	BackingID BackingID
+
+	// The flags the file is being opened with, as for OpenFileOp. Unless
+	// fusekernel.OpenExclusive is set, the file may later be given a name
+	// with linkat(2), which arrives as a CreateLinkOp.
+	OpenFlags fusekernel.OpenFlags
+
 	OpContext OpContext
 }
 
@@ -444,6 +595,12 @@ type RenameOp struct {
 	// overwritten within it.
 	NewParent InodeID
 	NewName   string
+
+	// Flags from renameat2(2), such as RenameNoReplace or RenameExchange. They
+	// are ever set only if MountConfig.EnableRenameFlags is. A file system that
+	// doesn't support a flag it is given should return EINVAL.
+	Flags RenameFlags
+
 	OpContext OpContext
 }
 
@@ -575,6 +732,11 @@ type ReadDirOp struct {
 	// something that looks like a newly-opened directory. So FUSE file systems
 	// may e.g. cache an entire fresh listing for each ReadDir with a zero
 	// offset, and return array offsets into that cached listing.
+	//
+	// Offsets into a listing that isn't cached must survive changes to the
+	// directory: array offsets shift when entries are removed, so a listing in
+	// progress skips entries or, if new ones keep appearing at the end, never
+	// finishes. fuseutil.DirSequence provides offsets that don't shift.
 	Offset DirOffset
 
 	// The destination buffer, whose length gives the size of the read.
@@ -603,6 +765,25 @@ type ReadDirOp struct {
 	OpContext OpContext
 }
 
+// Read entries from a directory previously opened with OpenDir, along with
+// the attributes of the inodes they refer to, saving the kernel from looking
+// each one up afterward. Sent in place of ReadDirOp when
+// MountConfig.EnableReaddirplus is set.
+//
+// The fields have the same meaning as those of ReadDirOp, except that Dst
+// should be filled with fuseutil.WriteDirentPlus. For each entry that names
+// an inode, other than "." and "..", the kernel increments the inode's lookup
+// count as for LookUpInodeOp.
+type ReadDirPlusOp struct {
+	Inode  InodeID
+	Handle HandleID
+	Offset DirOffset
+
+	Dst       []byte
+	BytesRead int
+	OpContext OpContext
+}
+
 // Release a previously-minted directory handle. The kernel sends this when
 // there are no more references to an open directory: all file descriptors are
 // closed and all memory mappings are unmapped.
@@ -629,6 +810,11 @@ type ReleaseDirHandleOp struct {
 // with type file, usually in response to an open(2) call from a user-space
 // process. On OS X it may not be sent for every open(2)
 // (cf.https://github.com/osxfuse/osxfuse/issues/199).
+//
+// The file system may take as long as it needs to answer, e.g. to wait for a
+// writer as open(2) of a FIFO does (see fuseutil.FIFOOpens). If the caller is
+// interrupted by a signal meanwhile, the op's context is cancelled, and the
+// file system should return EINTR promptly.
 type OpenFileOp struct {
 	// The ID of the inode to be opened.
 	Inode InodeID
@@ -665,8 +851,32 @@ type OpenFileOp struct {
 	// Enabling direct IO ensures that all client operations reach the fuse
 	// layer. This allows for filesystems whose file sizes are not known in
 	// advance, for example, because contents are generated on the fly.
+	//
+	// Reads and writes then carry the caller's offsets and sizes, without the
+	// alignment to pages or sectors that O_DIRECT requires elsewhere.
 	UseDirectIO bool
 
+	// Set by the library: whether a handle opened with UseDirectIO may be
+	// mapped with MAP_SHARED (Linux >= 6.6), because
+	// MountConfig.EnableDirectIOMmap is set and the kernel agreed. Otherwise
+	// such mmap(2) calls fail with ENODEV, so file systems whose clients map
+	// files, e.g. databases, may prefer not to use direct I/O.
+	DirectIOMmap bool
+
+	// Linux only.
+	//
+	// Whether the file is a stream that can't be seeked, like a pipe: lseek(2)
+	// fails with ESPIPE, as do pread(2) and pwrite(2) at other offsets.
+	NonSeekable bool
+
+	// Linux only, and only if MountConfig.MaxStackDepth is set.
+	//
+	// If non-zero, the kernel serves reads, writes and mmap(2) of this handle
+	// directly from the registered backing file, without sending ops to the
+	// file system. Other ops, e.g. FlushFileOp and ReleaseFileHandleOp, are
+	// still sent.
+	BackingID BackingID
+
 	OpenFlags fusekernel.OpenFlags
 
 	OpContext OpContext
@@ -707,7 +917,20 @@ type ReadFileOp struct {
 	// by a previous call to LookUpInode, GetInodeAttributes, etc.
 	//
 	// If direct IO is enabled, semantics should match those of read(2).
+	//
+	// A short read is therefore taken as the end of the file: the kernel fills
+	// the rest of the page with zeroes and, unless the handle uses direct IO,
+	// shrinks the size it has cached for the file to match. File systems whose
+	// backends may return fewer bytes than asked for without being at the end,
+	// e.g. network streams, should read again until they are, or set EOF and
+	// wrap themselves with fuseutil.NewFullIOFileSystem, which does so for them.
 	BytesRead int
+
+	// Set by the file system: whether BytesRead is less than Size because the
+	// read reached the end of the file. The kernel doesn't see this; it is for
+	// wrappers like fuseutil.NewFullIOFileSystem that complete short reads.
+	EOF bool
+
 	OpContext OpContext
 
 	// If set, this function will be invoked after the operation response has been
@@ -772,7 +995,34 @@ type WriteFileOp struct {
 	// be written, except on error (http://goo.gl/KUpwwn). This appears to be
 	// because it uses file mmapping machinery (http://goo.gl/SGxnaN) to write a
 	// page at a time.
-	Data      []byte
+	Data []byte
+
+	// Set by the file system, optionally: the number of bytes written, if it
+	// wrote fewer than len(Data). Zero means all of them; a write of none
+	// should fail instead.
+	//
+	// A short write is reported to the writer as such if the handle uses
+	// direct IO, as for write(2), and fails it with EIO otherwise, since the
+	// kernel can't tell which cached pages made it. File systems that may
+	// write short should prefer to complete the write themselves, e.g. with
+	// fuseutil.NewFullIOFileSystem.
+	BytesWritten int
+
+	// Set if the data comes from the kernel's page cache, written back under
+	// writeback caching (see fuse.MountConfig.DisableWritebackCaching), rather
+	// than straight from a write(2). In that case:
+	//
+	//  *  The data may have been written through any handle open for writing
+	//     on the inode, not necessarily Handle, and OpContext describes
+	//     whichever process is writing the page back, not the writer.
+	//
+	//  *  The kernel keeps track of the file's size and times itself. Writes
+	//     may extend the file, but shouldn't change its mtime or ctime: the
+	//     kernel sends those later with SetInodeAttributesOp.
+	//
+	//  *  Pages are written back whole, so the data may extend past what was
+	//     written, as far as the size the kernel believes the file to have.
+	Cached    bool
 	OpContext OpContext
 
 	// If set, this function will be invoked after the operation response has been
@@ -791,16 +1041,24 @@ type WriteFileOp struct {
 //
 //   - (http://goo.gl/5L2SMy) vfs_fsync_range calls f_op->fsync.
 //
-// Note that this is also sent by fdatasync(2) (cf. http://goo.gl/01R7rF), and
-// may be sent for msync(2) with the MS_SYNC flag (see the notes on
-// FlushFileOp).
+// Note that this is also sent by fdatasync(2) (cf. http://goo.gl/01R7rF), with
+// Datasync set, and may be sent for msync(2) with the MS_SYNC flag (see the
+// notes on FlushFileOp). fsync(2) of a directory handle sends it too, with
+// the handle from OpenDirOp.
 //
 // See also: FlushFileOp, which may perform a similar function when closing a
 // file (but which is not used in "real" file systems).
 type SyncFileOp struct {
 	// The file and handle being sync'd.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// Set for fdatasync(2): only the contents of the file, and the metadata
+	// needed to read them back such as its size, must reach storage. Other
+	// metadata such as the modification time may be left for later, which
+	// saves a write for databases that sync at high rates.
+	Datasync bool
+
 	OpContext OpContext
 }
 
@@ -854,8 +1112,15 @@ type SyncFileOp struct {
 // return any errors that occur.
 type FlushFileOp struct {
 	// The file and handle being flushed.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// The owner of the file descriptor being closed. POSIX locks are released
+	// when their owner closes any descriptor for the file, so if
+	// MountConfig.EnablePosixLocks is set the file system should release the
+	// locks on the inode held by LockOwner (see SetLkOp).
+	LockOwner uint64
+
 	OpContext OpContext
 }
 
@@ -871,7 +1136,14 @@ type ReleaseFileHandleOp struct {
 	// The handle ID to be released. The kernel guarantees that this ID will not
 	// be used in further calls to the file system (unless it is reissued by the
 	// file system).
-	Handle    HandleID
+	Handle HandleID
+
+	// Set if flock(2) locks were taken through the handle (see FlockOp), in
+	// which case the file system should release those held by LockOwner. The
+	// kernel doesn't send a separate FlockOp to do so.
+	UnlockFlocks bool
+	LockOwner    uint64
+
 	OpContext OpContext
 }
 
@@ -925,6 +1197,10 @@ type GetXattrOp struct {
 	// the number of bytes that would have been read into Dst if Dst was
 	// big enough (return ERANGE in this case).
 	BytesRead int
+
+	// OS X only. The offset within the attribute's value at which to start
+	// reading. This is non-zero only for com.apple.ResourceFork.
+	Position  uint32
 	OpContext OpContext
 }
 
@@ -967,10 +1243,23 @@ type SetXattrOp struct {
 	// If Flags is 0x2, and the attribute does not exist, ENOATTR should be returned.
 	// If Flags is 0x0, the extended attribute will be created if need be, or will
 	// simply replace the value if the attribute exists.
-	Flags     uint32
+	//
+	// On OS X the flags are those of setxattr(2) there: 0x2 for create and 0x4
+	// for replace.
+	Flags uint32
+
+	// OS X only. The offset within the attribute's value at which to write
+	// Value. This is non-zero only for com.apple.ResourceFork.
+	Position  uint32
 	OpContext OpContext
 }
 
+// Allocate or deallocate space within a range of a file.
+//
+// This is sent in response to fallocate(2). If the file system returns
+// ENOSYS, the kernel stops sending FallocateOp and fails every later
+// fallocate(2) with EOPNOTSUPP; to refuse only some modes, return
+// EOPNOTSUPP for those instead.
 type FallocateOp struct {
 	// The inode and handle we are fallocating
 	Inode  InodeID
@@ -982,11 +1271,214 @@ type FallocateOp struct {
 	// Length of the byte range
 	Length uint64
 
-	// If Mode is 0x0, allocate disk space within the range specified
-	// If Mode has 0x1, allocate the space but don't increase the file size
-	// If Mode has 0x2, deallocate space within the range specified
-	// If Mode has 0x2, it sbould also have 0x1 (deallocate should not increase
-	// file size)
-	Mode      uint32
+	// What to do with the range. Zero means to allocate space for it,
+	// extending the file if the range ends past its end. See FallocateMode for
+	// the other modes; the kernel sends no others.
+	Mode      FallocateMode
+	OpContext OpContext
+}
+
+// Find the next data or hole in an open file, in response to lseek(2) with
+// SEEK_DATA or SEEK_HOLE. This lets tools like cp, tar and rsync skip the
+// holes in sparse files rather than reading zeroes. Other kinds of seek are
+// handled by the kernel.
+//
+// If the file system returns ENOSYS, the kernel stops sending LseekOp and
+// treats every file as data with no holes but the one at its end.
+type LseekOp struct {
+	// The file to search.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset to search from, and what to look for.
+	Offset uint64
+	Whence SeekWhence
+
+	// Set by the file system: the offset found. Return ENXIO if Offset is at or
+	// past the end of the file, or if Whence is SeekData and there is no data
+	// after Offset.
+	ResultOffset uint64
+	OpContext    OpContext
+}
+
+// Copy a range of bytes from one open file to another, or within a file, in
+// response to copy_file_range(2). This lets file systems whose backends can
+// copy or clone data themselves avoid moving it through the kernel.
+//
+// The kernel flushes dirty pages of both files before sending the op, and
+// invalidates its cached pages of the output file afterwards. If the file
+// system returns ENOSYS, the kernel stops sending CopyFileRangeOp; if it
+// returns ENOSYS or EXDEV, the kernel copies the data itself with ReadFileOp
+// and WriteFileOp. Return EXDEV for pairs of files that can't be copied
+// between, e.g. because they are in different backends.
+type CopyFileRangeOp struct {
+	// The file and offset to copy from.
+	InputInode  InodeID
+	InputHandle HandleID
+	InputOffset uint64
+
+	// The file and offset to copy to. The output file is open for writing.
+	OutputInode  InodeID
+	OutputHandle HandleID
+	OutputOffset uint64
+
+	// The number of bytes to copy. The kernel caps this so that the number
+	// copied fits in 32 bits.
+	Length uint64
+
+	// Flags from copy_file_range(2). Currently always zero.
+	Flags uint64
+
+	// Set by the file system: the number of bytes copied, which may be less
+	// than Length, e.g. at the end of the input file.
+	BytesCopied uint64
+	OpContext   OpContext
+}
+
+// Report which I/O events are ready on a file handle, for poll(2), select(2)
+// and epoll(7). This lets files that behave like character devices, e.g. ones
+// that deliver events, be waited on rather than read in a loop.
+//
+// If the file system returns ENOSYS, the kernel stops sending PollOp and
+// treats every file as always ready for reading and writing.
+type PollOp struct {
+	// The inode and handle being polled.
+	Inode  InodeID
+	Handle HandleID
+
+	// The events the caller is interested in, as POLLIN etc. from
+	// golang.org/x/sys/unix. Zero from kernels older than protocol 7.21, which
+	// don't say; the file system should then report all ready events.
+	Events uint32
+
+	// If ScheduleNotify is set, the kernel wants to be told when events may
+	// have become ready, so that it can wake up the callers waiting on the
+	// handle rather than polling again itself. The file system should remember
+	// PollHandle and pass it to NotifyPollWakeup on the connection when the
+	// readiness of the handle changes. A PollHandle stays the same for the
+	// lifetime of the open file, so one wakeup may serve several polls.
+	ScheduleNotify bool
+	PollHandle     PollHandle
+
+	// Set by the file system: the events that are ready, as for Events.
+	Revents   uint32
 	OpContext OpContext
 }
+
+////////////////////////////////////////////////////////////////////////
+// File locks
+////////////////////////////////////////////////////////////////////////
+
+// Take, convert or release a BSD-style whole-file lock, in response to
+// flock(2). Sent only if MountConfig.EnableFlockLocks is set; otherwise the
+// kernel keeps track of such locks itself, and they don't extend to other
+// clients of a network file system.
+//
+// Locks belong to the open file, so are shared by file descriptors duplicated
+// from it, and are released when it is closed (see
+// ReleaseFileHandleOp.UnlockFlocks). If the lock can't be had and Wait is
+// false, return EAGAIN (EWOULDBLOCK).
+type FlockOp struct {
+	// The file to lock, and the handle through which it is locked.
+	Inode  InodeID
+	Handle HandleID
+
+	// An opaque ID for the open file that holds the lock.
+	Owner uint64
+
+	// The lock wanted. A file's holder may convert a shared lock to an
+	// exclusive one and vice versa, as for flock(2).
+	Type LockType
+
+	// Whether to wait for a conflicting lock to be released, rather than
+	// failing with EAGAIN. The op is interrupted if the caller gives up.
+	Wait bool
+
+	OpContext OpContext
+}
+
+// Find a POSIX byte-range lock that would conflict with the one described, in
+// response to fcntl(2) with F_GETLK or F_OFD_GETLK. This and the other POSIX
+// lock ops are sent only if MountConfig.EnablePosixLocks is set; otherwise
+// the kernel keeps track of such locks itself, and they don't extend to other
+// clients of a network file system.
+//
+// Locks held by Owner itself never conflict.
+type GetLkOp struct {
+	// The file of interest, and the handle through which it is asked about.
+	Inode  InodeID
+	Handle HandleID
+
+	// An opaque ID for the owner of the lock: a process for traditional POSIX
+	// locks, or an open file for open file description locks.
+	Owner uint64
+
+	// The lock that would be taken.
+	Lock FileLock
+
+	// Set by the file system: a lock held by another owner that conflicts with
+	// Lock, or one with Type LockUnlock if there is none.
+	Conflict  FileLock
+	OpContext OpContext
+}
+
+// Take, change or release a POSIX byte-range lock, in response to fcntl(2)
+// with F_SETLK or F_OFD_SETLK. A lock of type LockUnlock releases whatever
+// the owner holds in the range; other locks replace those the owner holds in
+// the range, splitting or merging them as necessary, as for fcntl(2).
+//
+// If the lock conflicts with one held by another owner, return EAGAIN.
+type SetLkOp struct {
+	// The file to lock, and the handle through which it is locked.
+	Inode  InodeID
+	Handle HandleID
+
+	// An opaque ID for the owner of the lock. See GetLkOp.
+	Owner uint64
+
+	// The lock wanted.
+	Lock      FileLock
+	OpContext OpContext
+}
+
+// As SetLkOp, in response to F_SETLKW or F_OFD_SETLKW: wait for conflicting
+// locks to be released rather than failing with EAGAIN. If the waiter is
+// interrupted, e.g. by a signal, the kernel cancels the op's context; the
+// file system should then stop waiting and return EINTR. File systems may
+// return EDEADLK rather than wait for a lock that could never be had.
+type SetLkWaitOp struct {
+	// The file to lock, and the handle through which it is locked.
+	Inode  InodeID
+	Handle HandleID
+
+	// An opaque ID for the owner of the lock. See GetLkOp.
+	Owner uint64
+
+	// The lock wanted.
+	Lock      FileLock
+	OpContext OpContext
+}
+
+// Set the name of the volume, as shown by the Finder. Sent only on OS X, and
+// only if MountConfig.EnableVolumeRename is set, in which case the kernel
+// advertises the volume as supporting renaming.
+type SetVolumeNameOp struct {
+	// The new name of the volume.
+	Name      string
+	OpContext OpContext
+}
+
+// Look up the backup and creation times of an inode, used on OS X to answer
+// getattrlist(2) queries for ATTR_CMN_BKUPTIME and ATTR_CMN_CRTIME. Sent only
+// if MountConfig.EnableXtimes is set; otherwise the kernel uses the Crtime
+// field of InodeAttributes and reports no backup time.
+type GetXtimesOp struct {
+	// The inode of interest.
+	Inode InodeID
+
+	// Set by the file system: the times at which the inode was last backed up
+	// (zero if never) and created.
+	BackupTime   time.Time
+	CreationTime time.Time
+	OpContext    OpContext
+}
@@ -17,6 +17,7 @@ package fuseops
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/jacobsa/fuse/internal/fusekernel"
@@ -37,6 +38,19 @@ type InodeID uint64
 // response.
 const RootInodeID = 1
 
+// IsRoot reports whether the ID is RootInodeID.
+func (id InodeID) IsRoot() bool {
+	return id == RootInodeID
+}
+
+// IsReserved reports whether the ID lies in the range that file systems must
+// not mint for their own inodes: zero, which is never a valid node ID in the
+// protocol, and RootInodeID, which the kernel assigns to the root at mount
+// time.
+func (id InodeID) IsReserved() bool {
+	return id <= RootInodeID
+}
+
 func init() {
 	// Make sure the constant above is correct. We do this at runtime rather than
 	// defining the constant in terms of fusekernel.RootID for two reasons:
@@ -96,9 +110,25 @@ type InodeAttributes struct {
 	Ctime  time.Time // Time of last modification to inode
 	Crtime time.Time // Time of creation (OS X only)
 
+	// Time of creation on Linux, where only statx(2) reports it, through
+	// StatxOp. If zero, Crtime is reported instead.
+	Btime time.Time
+
 	// Ownership information
 	Uid uint32
 	Gid uint32
+
+	// Whether the kernel should map the file's contents directly into guest
+	// memory rather than going through the page cache (Linux only). Only
+	// honored when MountConfig.EnablePerFileDAX is set and the file system is
+	// served over virtiofs and mounted with dax=inode; elsewhere it is ignored.
+	DAX bool
+}
+
+// IsWhiteout reports whether the attributes are those of a whiteout. See
+// WhiteoutMode.
+func (a *InodeAttributes) IsWhiteout() bool {
+	return a.Mode&os.ModeType == WhiteoutMode && a.Rdev == 0
 }
 
 func (a *InodeAttributes) DebugString() string {
@@ -111,10 +141,28 @@ func (a *InodeAttributes) DebugString() string {
 		a.Gid)
 }
 
+// WhiteoutMode is the type of a whiteout: a character device with device
+// number zero, which overlayfs places in an upper layer to hide the entry of
+// the same name in lower layers. overlayfs creates whiteouts with MkNodeOp,
+// and a file system serving as a lower layer, or implementing union semantics
+// itself, should store and list them like other device nodes.
+const WhiteoutMode = os.ModeDevice | os.ModeCharDevice
+
+// The extended attributes with which overlayfs marks a directory opaque,
+// hiding the contents of directories of the same name in lower layers, with
+// the value OverlayOpaqueValue. overlayfs mounts with the userxattr option use
+// the second.
+const (
+	OverlayOpaqueXattr     = "trusted.overlay.opaque"
+	UserOverlayOpaqueXattr = "user.overlay.opaque"
+	OverlayOpaqueValue     = "y"
+)
+
 // GenerationNumber represents a generation of an inode. It is irrelevant for
 // file systems that won't be exported over NFS. For those that will and that
 // reuse inode IDs when they become free, the generation number must change
-// when an ID is reused.
+// when an ID is reused, and must not change while the kernel knows the inode.
+// See fuseutil.ExportChecker.
 //
 // This corresponds to struct inode::i_generation in the VFS layer.
 // (Cf. http://goo.gl/tvYyQt)
@@ -134,6 +182,224 @@ type GenerationNumber uint64
 // This corresponds to fuse_file_info::fh.
 type HandleID uint64
 
+// FallocateMode holds the mode bits of a FallocateOp, with the values of the
+// FALLOC_FL_* constants for fallocate(2).
+type FallocateMode uint32
+
+const (
+	// Don't change the size of the file, even if the range ends past its end.
+	FallocateKeepSize FallocateMode = 0x01
+
+	// Deallocate the range, so that it reads as zeroes, as in a sparse file.
+	// Always combined with FallocateKeepSize.
+	FallocatePunchHole FallocateMode = 0x02
+
+	// Make the range read as zeroes, allocating space for it, and extending
+	// the file unless combined with FallocateKeepSize.
+	FallocateZeroRange FallocateMode = 0x10
+)
+
+func (m FallocateMode) String() string {
+	if m == 0 {
+		return "0"
+	}
+
+	var names []string
+	for _, f := range []struct {
+		bit  FallocateMode
+		name string
+	}{
+		{FallocateKeepSize, "KeepSize"},
+		{FallocatePunchHole, "PunchHole"},
+		{FallocateZeroRange, "ZeroRange"},
+	} {
+		if m&f.bit != 0 {
+			names = append(names, f.name)
+			m &^= f.bit
+		}
+	}
+
+	if m != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(m)))
+	}
+
+	return strings.Join(names, "+")
+}
+
+// StatxMask selects the fields of a StatxOp, with the values of the STATX_*
+// constants for statx(2).
+type StatxMask uint32
+
+const (
+	StatxType   StatxMask = 0x1
+	StatxMode   StatxMask = 0x2
+	StatxNlink  StatxMask = 0x4
+	StatxUid    StatxMask = 0x8
+	StatxGid    StatxMask = 0x10
+	StatxAtime  StatxMask = 0x20
+	StatxMtime  StatxMask = 0x40
+	StatxCtime  StatxMask = 0x80
+	StatxIno    StatxMask = 0x100
+	StatxSize   StatxMask = 0x200
+	StatxBlocks StatxMask = 0x400
+	StatxBtime  StatxMask = 0x800
+
+	// The fields that stat(2) reports.
+	StatxBasicStats StatxMask = 0x7ff
+)
+
+func (m StatxMask) String() string {
+	if m == 0 {
+		return "0"
+	}
+
+	var names []string
+	for _, f := range []struct {
+		bit  StatxMask
+		name string
+	}{
+		{StatxBasicStats, "BasicStats"},
+		{StatxType, "Type"},
+		{StatxMode, "Mode"},
+		{StatxNlink, "Nlink"},
+		{StatxUid, "Uid"},
+		{StatxGid, "Gid"},
+		{StatxAtime, "Atime"},
+		{StatxMtime, "Mtime"},
+		{StatxCtime, "Ctime"},
+		{StatxIno, "Ino"},
+		{StatxSize, "Size"},
+		{StatxBlocks, "Blocks"},
+		{StatxBtime, "Btime"},
+	} {
+		if m&f.bit == f.bit {
+			names = append(names, f.name)
+			m &^= f.bit
+		}
+	}
+
+	if m != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(m)))
+	}
+
+	return strings.Join(names, "+")
+}
+
+// SeekWhence says what a LseekOp looks for, with the values of the SEEK_*
+// constants for lseek(2).
+type SeekWhence uint32
+
+const (
+	// Find the start of the first range of data at or after the offset.
+	SeekData SeekWhence = 3
+
+	// Find the start of the first hole at or after the offset. There is an
+	// implicit hole at the end of every file.
+	SeekHole SeekWhence = 4
+)
+
+func (w SeekWhence) String() string {
+	switch w {
+	case SeekData:
+		return "SeekData"
+	case SeekHole:
+		return "SeekHole"
+	}
+
+	return fmt.Sprintf("SeekWhence(%d)", uint32(w))
+}
+
+// RenameFlags modify the behaviour of a rename, as for renameat2(2).
+type RenameFlags uint32
+
+const (
+	// Fail with EEXIST rather than replace an existing entry at the new name.
+	RenameNoReplace RenameFlags = 1 << 0
+
+	// Atomically swap the old and new entries, which must both exist. They may
+	// be of different types.
+	RenameExchange RenameFlags = 1 << 1
+
+	// Leave a whiteout, a character device with device number 0/0, at the old
+	// name, for overlay and union file systems.
+	RenameWhiteout RenameFlags = 1 << 2
+)
+
+func (f RenameFlags) String() string {
+	var names []string
+	for _, n := range []struct {
+		flag RenameFlags
+		name string
+	}{
+		{RenameNoReplace, "NoReplace"},
+		{RenameExchange, "Exchange"},
+		{RenameWhiteout, "Whiteout"},
+	} {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+			f &^= n.flag
+		}
+	}
+
+	if f != 0 || len(names) == 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(f)))
+	}
+
+	return strings.Join(names, "|")
+}
+
+// LockType is the kind of an advisory file lock, or a request to release one.
+type LockType uint32
+
+const (
+	// Release the lock: LOCK_UN for flock(2), F_UNLCK for fcntl(2).
+	LockUnlock LockType = iota
+
+	// A lock that others may share: LOCK_SH for flock(2), F_RDLCK for
+	// fcntl(2).
+	LockShared
+
+	// A lock that excludes all others: LOCK_EX for flock(2), F_WRLCK for
+	// fcntl(2).
+	LockExclusive
+)
+
+func (t LockType) String() string {
+	switch t {
+	case LockUnlock:
+		return "Unlock"
+	case LockShared:
+		return "Shared"
+	case LockExclusive:
+		return "Exclusive"
+	}
+
+	return fmt.Sprintf("LockType(%d)", uint32(t))
+}
+
+// FileLock describes a POSIX byte-range lock, as taken with fcntl(2).
+type FileLock struct {
+	// The range locked, [Start, End]. End is inclusive; a lock that extends to
+	// the end of the file, however long it grows, has End math.MaxInt64.
+	Start uint64
+	End   uint64
+
+	Type LockType
+
+	// The ID of the process holding the lock, for reporting conflicts. Zero if
+	// unknown, e.g. because it is on another client of a network file system.
+	Pid uint32
+}
+
+// PollHandle is an opaque 64-bit number chosen by the kernel to identify the
+// callers polling an open file, for use with fuse.Connection.NotifyPollWakeup.
+// See PollOp.
+type PollHandle uint64
+
+// BackingID identifies a file registered with the kernel for passthrough I/O
+// using fuse.Connection.OpenBackingFile. Zero means no passthrough.
+type BackingID uint32
+
 // DirOffset is an offset into an open directory handle. This is opaque to
 // FUSE, and can be used for whatever purpose the file system desires. See
 // notes on ReadDirOp.Offset for details.
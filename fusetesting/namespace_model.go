@@ -0,0 +1,534 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// CheckRenameAndLink runs a random sequence of namespace operations against
+// fileSystem, concentrating on rename (including onto existing targets and
+// into other directories) and on hard links, and compares the outcome of each
+// with an executable model of the POSIX semantics. After every operation the
+// whole tree is listed and looked up again, checking names, types, inode
+// identities and file link counts. It returns an error describing the first
+// divergence, along with the operations leading up to it, or nil.
+//
+// The file system must be empty, and is called directly as the kernel would
+// call it. Some requests never reach a file system, because the kernel
+// rejects them using what it has already looked up: renaming a directory into
+// itself, a directory onto a file or the reverse, creating an existing name,
+// linking a directory, unlinking a directory or removing a file with rmdir.
+// Renaming one name of a file onto another is a no-op that the kernel doesn't
+// send either. These are checked against the model but not sent. What is left
+// for the file system is keeping entries, inode IDs and link counts straight,
+// and refusing to remove or replace a non-empty directory with ENOTEMPTY.
+//
+// The same seed always gives the same sequence of operations.
+func CheckRenameAndLink(
+	fileSystem fuseutil.FileSystem,
+	seed int64,
+	steps int) error {
+	c := &modelChecker{
+		ctx:  context.Background(),
+		fs:   fileSystem,
+		iofs: fuseutil.NewIOFS(context.Background(), fileSystem),
+		rand: rand.New(rand.NewSource(seed)),
+		root: &modelNode{
+			inode:    fuseops.RootInodeID,
+			children: make(map[string]*modelNode),
+		},
+	}
+
+	for i := 0; i < steps; i++ {
+		err := c.step()
+		if err == nil {
+			err = c.compareDir(c.root, ".")
+		}
+
+		if err != nil {
+			first := 0
+			if len(c.history) > 20 {
+				first = len(c.history) - 20
+			}
+
+			return fmt.Errorf(
+				"seed %d, step %d: %v\nafter:\n\t%s",
+				seed,
+				i,
+				err,
+				strings.Join(c.history[first:], "\n\t"))
+		}
+	}
+
+	return nil
+}
+
+// A file or directory in the model.
+type modelNode struct {
+	// The ID given to the inode by the file system under test when it was
+	// created.
+	inode fuseops.InodeID
+
+	// For directories, the entries within it, and its parent and name in it.
+	// The root has no parent. Nil for files.
+	children map[string]*modelNode
+	parent   *modelNode
+	name     string
+
+	// For files, the number of names referring to it.
+	nlink int
+}
+
+func (n *modelNode) isDir() bool {
+	return n.children != nil
+}
+
+// Is n the directory d or a descendant of it?
+func (n *modelNode) within(d *modelNode) bool {
+	for ; n != nil; n = n.parent {
+		if n == d {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *modelNode) path() string {
+	if n.parent == nil {
+		return "/"
+	}
+
+	return path.Join(n.parent.path(), n.name)
+}
+
+// Names are drawn from a small set, so that operations often collide with
+// existing entries.
+var modelNames = []string{"a", "b", "c", "d"}
+
+// The most files and directories created, to keep the tree small enough that
+// operations keep running into each other.
+const maxModelNodes = 24
+
+type modelChecker struct {
+	ctx     context.Context
+	fs      fuseutil.FileSystem
+	iofs    fs.FS
+	rand    *rand.Rand
+	root    *modelNode
+	history []string
+}
+
+// Return every directory and every distinct file in the model.
+func (c *modelChecker) collect() (dirs, files []*modelNode) {
+	seen := make(map[*modelNode]bool)
+	var visit func(d *modelNode)
+	visit = func(d *modelNode) {
+		dirs = append(dirs, d)
+
+		names := make([]string, 0, len(d.children))
+		for name := range d.children {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		for _, name := range names {
+			child := d.children[name]
+			switch {
+			case child.isDir():
+				visit(child)
+
+			case !seen[child]:
+				seen[child] = true
+				files = append(files, child)
+			}
+		}
+	}
+
+	visit(c.root)
+	return dirs, files
+}
+
+func (c *modelChecker) pickName() string {
+	return modelNames[c.rand.Intn(len(modelNames))]
+}
+
+// Usually pick the name of an existing entry in d, if there is one.
+func (c *modelChecker) pickEntry(d *modelNode) string {
+	if len(d.children) == 0 || c.rand.Intn(5) == 0 {
+		return c.pickName()
+	}
+
+	names := make([]string, 0, len(d.children))
+	for name := range d.children {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names[c.rand.Intn(len(names))]
+}
+
+// Record an operation and what the model expects of it.
+func (c *modelChecker) record(format string, v ...interface{}) {
+	c.history = append(c.history, fmt.Sprintf(format, v...))
+}
+
+// Balance the lookup count gained from an op that returned an entry.
+func (c *modelChecker) forget(inode fuseops.InodeID) {
+	c.fs.ForgetInode(c.ctx, &fuseops.ForgetInodeOp{Inode: inode, N: 1})
+}
+
+// Check the result of an op against the expected error, or nil for success.
+func checkErr(desc string, got error, want error) error {
+	switch {
+	case want == nil && got != nil:
+		return fmt.Errorf("%s: %v, want success", desc, got)
+
+	case want != nil && !errors.Is(got, want):
+		return fmt.Errorf("%s: %v, want %v", desc, got, want)
+	}
+
+	return nil
+}
+
+func (c *modelChecker) step() error {
+	dirs, files := c.collect()
+	full := len(dirs)+len(files) >= maxModelNodes
+	dir := dirs[c.rand.Intn(len(dirs))]
+
+	switch r := c.rand.Intn(10); {
+	case r == 0 && !full:
+		return c.mkdir(dir, c.pickName())
+
+	case r == 1 && !full:
+		return c.create(dir, c.pickName())
+
+	case r == 2 && len(files) > 0:
+		return c.link(files[c.rand.Intn(len(files))], dir, c.pickName())
+
+	case r == 3:
+		return c.unlink(dir, c.pickEntry(dir))
+
+	case r == 4:
+		return c.rmdir(dir, c.pickEntry(dir))
+
+	default:
+		newDir := dirs[c.rand.Intn(len(dirs))]
+		return c.rename(dir, c.pickEntry(dir), newDir, c.pickName())
+	}
+}
+
+func (c *modelChecker) mkdir(parent *modelNode, name string) error {
+	desc := "mkdir " + path.Join(parent.path(), name)
+	if _, ok := parent.children[name]; ok {
+		c.record("%s: EEXIST (not sent)", desc)
+		return nil
+	}
+
+	c.record("%s", desc)
+	op := fuseops.MkDirOp{
+		Parent:    parent.inode,
+		Name:      name,
+		Mode:      0700 | os.ModeDir,
+		OpContext: NewOpContext(),
+	}
+
+	if err := checkErr(desc, c.fs.MkDir(c.ctx, &op), nil); err != nil {
+		return err
+	}
+
+	c.forget(op.Entry.Child)
+	parent.children[name] = &modelNode{
+		inode:    op.Entry.Child,
+		children: make(map[string]*modelNode),
+		parent:   parent,
+		name:     name,
+	}
+
+	return nil
+}
+
+func (c *modelChecker) create(parent *modelNode, name string) error {
+	desc := "create " + path.Join(parent.path(), name)
+	if _, ok := parent.children[name]; ok {
+		c.record("%s: EEXIST (not sent)", desc)
+		return nil
+	}
+
+	c.record("%s", desc)
+	op := fuseops.CreateFileOp{
+		Parent:    parent.inode,
+		Name:      name,
+		Mode:      0600,
+		OpContext: NewOpContext(),
+	}
+
+	if err := checkErr(desc, c.fs.CreateFile(c.ctx, &op), nil); err != nil {
+		return err
+	}
+
+	c.fs.ReleaseFileHandle(c.ctx, &fuseops.ReleaseFileHandleOp{Handle: op.Handle})
+	c.forget(op.Entry.Child)
+	parent.children[name] = &modelNode{
+		inode: op.Entry.Child,
+		nlink: 1,
+	}
+
+	return nil
+}
+
+func (c *modelChecker) link(file *modelNode, parent *modelNode, name string) error {
+	desc := fmt.Sprintf("link inode %d as %s", file.inode, path.Join(parent.path(), name))
+	if _, ok := parent.children[name]; ok {
+		c.record("%s: EEXIST (not sent)", desc)
+		return nil
+	}
+
+	c.record("%s", desc)
+	op := fuseops.CreateLinkOp{
+		Parent:    parent.inode,
+		Name:      name,
+		Target:    file.inode,
+		OpContext: NewOpContext(),
+	}
+
+	if err := checkErr(desc, c.fs.CreateLink(c.ctx, &op), nil); err != nil {
+		return err
+	}
+
+	c.forget(op.Entry.Child)
+	if op.Entry.Child != file.inode {
+		return fmt.Errorf("%s: entry for inode %d", desc, op.Entry.Child)
+	}
+
+	file.nlink++
+	parent.children[name] = file
+	return nil
+}
+
+func (c *modelChecker) unlink(parent *modelNode, name string) error {
+	desc := "unlink " + path.Join(parent.path(), name)
+	child, ok := parent.children[name]
+	switch {
+	case !ok:
+		c.record("%s: ENOENT (not sent)", desc)
+		return nil
+
+	case child.isDir():
+		c.record("%s: EISDIR (not sent)", desc)
+		return nil
+	}
+
+	c.record("%s", desc)
+	op := fuseops.UnlinkOp{
+		Parent:    parent.inode,
+		Name:      name,
+		OpContext: NewOpContext(),
+	}
+
+	if err := checkErr(desc, c.fs.Unlink(c.ctx, &op), nil); err != nil {
+		return err
+	}
+
+	child.nlink--
+	delete(parent.children, name)
+	return nil
+}
+
+func (c *modelChecker) rmdir(parent *modelNode, name string) error {
+	desc := "rmdir " + path.Join(parent.path(), name)
+	child, ok := parent.children[name]
+	switch {
+	case !ok:
+		c.record("%s: ENOENT (not sent)", desc)
+		return nil
+
+	case !child.isDir():
+		c.record("%s: ENOTDIR (not sent)", desc)
+		return nil
+	}
+
+	var want error
+	if len(child.children) != 0 {
+		want = syscall.ENOTEMPTY
+		desc += " (not empty)"
+	}
+
+	c.record("%s", desc)
+	op := fuseops.RmDirOp{
+		Parent:    parent.inode,
+		Name:      name,
+		OpContext: NewOpContext(),
+	}
+
+	if err := checkErr(desc, c.fs.RmDir(c.ctx, &op), want); err != nil || want != nil {
+		return err
+	}
+
+	delete(parent.children, name)
+	return nil
+}
+
+func (c *modelChecker) rename(
+	oldParent *modelNode,
+	oldName string,
+	newParent *modelNode,
+	newName string) error {
+	desc := fmt.Sprintf(
+		"rename %s to %s",
+		path.Join(oldParent.path(), oldName),
+		path.Join(newParent.path(), newName))
+
+	src, ok := oldParent.children[oldName]
+	if !ok {
+		c.record("%s: ENOENT (not sent)", desc)
+		return nil
+	}
+
+	if src.isDir() && newParent.within(src) {
+		c.record("%s: EINVAL (not sent)", desc)
+		return nil
+	}
+
+	dst := newParent.children[newName]
+	if dst != nil {
+		switch {
+		case dst == src:
+			c.record("%s: same inode (not sent)", desc)
+			return nil
+
+		case src.isDir() && !dst.isDir():
+			c.record("%s: ENOTDIR (not sent)", desc)
+			return nil
+
+		case !src.isDir() && dst.isDir():
+			c.record("%s: EISDIR (not sent)", desc)
+			return nil
+
+		case dst.isDir() && oldParent.within(dst):
+			c.record("%s: ENOTEMPTY (not sent)", desc)
+			return nil
+		}
+	}
+
+	var want error
+	switch {
+	case dst != nil && dst.isDir() && len(dst.children) != 0:
+		want = syscall.ENOTEMPTY
+		desc += " (replacing a non-empty directory)"
+
+	case dst != nil:
+		desc += " (replacing)"
+	}
+
+	c.record("%s", desc)
+	op := fuseops.RenameOp{
+		OldParent: oldParent.inode,
+		OldName:   oldName,
+		NewParent: newParent.inode,
+		NewName:   newName,
+		OpContext: NewOpContext(),
+	}
+
+	if err := checkErr(desc, c.fs.Rename(c.ctx, &op), want); err != nil || want != nil {
+		return err
+	}
+
+	if dst != nil && !dst.isDir() {
+		dst.nlink--
+	}
+
+	delete(oldParent.children, oldName)
+	newParent.children[newName] = src
+	if src.isDir() {
+		src.parent = newParent
+		src.name = newName
+	}
+
+	return nil
+}
+
+// Check that the directory d at the given slash-separated path, and
+// everything below it, is as the model says.
+func (c *modelChecker) compareDir(d *modelNode, dirPath string) error {
+	entries, err := fs.ReadDir(c.iofs, dirPath)
+	if err != nil {
+		return fmt.Errorf("listing %s: %v", d.path(), err)
+	}
+
+	var got, want []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+
+	for name := range d.children {
+		want = append(want, name)
+	}
+
+	sort.Strings(want)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		return fmt.Errorf("%s lists %q, want %q", d.path(), got, want)
+	}
+
+	for _, e := range entries {
+		child := d.children[e.Name()]
+		childPath := path.Join(d.path(), e.Name())
+
+		op := fuseops.LookUpInodeOp{
+			Parent:    d.inode,
+			Name:      e.Name(),
+			OpContext: NewOpContext(),
+		}
+
+		if err := c.fs.LookUpInode(c.ctx, &op); err != nil {
+			return fmt.Errorf("looking up %s: %v", childPath, err)
+		}
+
+		c.forget(op.Entry.Child)
+		attrs := op.Entry.Attributes
+
+		switch {
+		case op.Entry.Child != child.inode:
+			return fmt.Errorf("%s is inode %d, want %d", childPath, op.Entry.Child, child.inode)
+
+		case attrs.Mode.IsDir() != child.isDir() || e.IsDir() != child.isDir():
+			return fmt.Errorf("%s has mode %v and is listed as %v", childPath, attrs.Mode, e.Type())
+
+		case !child.isDir() && int(attrs.Nlink) != child.nlink:
+			return fmt.Errorf("%s has %d links, want %d", childPath, attrs.Nlink, child.nlink)
+		}
+
+		if child.isDir() {
+			if err := c.compareDir(child, path.Join(dirPath, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The functions in this file construct ops in the state in which
+// fuse.Connection.ReadOp would hand them to a file system, so that unit tests
+// may call fuseutil.FileSystem methods directly without mounting anything and
+// without knowing how the connection sets up destination buffers.
+
+// DefaultReadDirSize is the size of the destination buffer used by
+// NewReadDirOp. It matches the page-sized reads issued by the Linux kernel's
+// fuse_readdir.
+const DefaultReadDirSize = 4096
+
+var nextFuseID uint64
+
+// NewOpContext returns an OpContext with a FuseID that is unique within the
+// process, and the PID, UID and GID of the current process.
+func NewOpContext() fuseops.OpContext {
+	return fuseops.OpContext{
+		FuseID: atomic.AddUint64(&nextFuseID, 1),
+		Pid:    uint32(os.Getpid()),
+		Uid:    uint32(os.Getuid()),
+		Gid:    uint32(os.Getgid()),
+	}
+}
+
+// NewLookUpInodeOp returns an op looking up the given name within parent.
+func NewLookUpInodeOp(
+	parent fuseops.InodeID,
+	name string) *fuseops.LookUpInodeOp {
+	return &fuseops.LookUpInodeOp{
+		Parent:    parent,
+		Name:      name,
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewGetInodeAttributesOp returns an op fetching the attributes of inode.
+func NewGetInodeAttributesOp(
+	inode fuseops.InodeID) *fuseops.GetInodeAttributesOp {
+	return &fuseops.GetInodeAttributesOp{
+		Inode:     inode,
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewMkDirOp returns an op creating a directory. As the connection does,
+// os.ModeDir is added to the supplied mode.
+func NewMkDirOp(
+	parent fuseops.InodeID,
+	name string,
+	mode os.FileMode) *fuseops.MkDirOp {
+	return &fuseops.MkDirOp{
+		Parent:    parent,
+		Name:      name,
+		Mode:      mode | os.ModeDir,
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewCreateFileOp returns an op creating and opening a regular file.
+func NewCreateFileOp(
+	parent fuseops.InodeID,
+	name string,
+	mode os.FileMode) *fuseops.CreateFileOp {
+	return &fuseops.CreateFileOp{
+		Parent:    parent,
+		Name:      name,
+		Mode:      mode,
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewOpenDirOp returns an op opening the directory inode.
+func NewOpenDirOp(inode fuseops.InodeID) *fuseops.OpenDirOp {
+	return &fuseops.OpenDirOp{
+		Inode:     inode,
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewReadDirOp returns an op reading from a directory handle at the given
+// offset, with a destination buffer of DefaultReadDirSize bytes.
+func NewReadDirOp(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset fuseops.DirOffset) *fuseops.ReadDirOp {
+	return &fuseops.ReadDirOp{
+		Inode:     inode,
+		Handle:    handle,
+		Offset:    offset,
+		Dst:       make([]byte, DefaultReadDirSize),
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewReadDirPlusOp is like NewReadDirOp, for ReadDirPlus.
+func NewReadDirPlusOp(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset fuseops.DirOffset) *fuseops.ReadDirPlusOp {
+	return &fuseops.ReadDirPlusOp{
+		Inode:     inode,
+		Handle:    handle,
+		Offset:    offset,
+		Dst:       make([]byte, DefaultReadDirSize),
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewOpenFileOp returns an op opening the file inode with the given flags,
+// e.g. fusekernel.OpenReadOnly.
+func NewOpenFileOp(
+	inode fuseops.InodeID,
+	flags fusekernel.OpenFlags) *fuseops.OpenFileOp {
+	return &fuseops.OpenFileOp{
+		Inode:     inode,
+		OpenFlags: flags,
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewReadFileOp returns an op reading size bytes at offset, with a
+// destination buffer of that size. Use NewVectoredReadFileOp for file systems
+// mounted with MountConfig.UseVectoredRead.
+func NewReadFileOp(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset int64,
+	size int) *fuseops.ReadFileOp {
+	op := NewVectoredReadFileOp(inode, handle, offset, size)
+	op.Dst = make([]byte, size)
+	return op
+}
+
+// NewVectoredReadFileOp is like NewReadFileOp, but leaves Dst nil as the
+// connection does when vectored reads are enabled.
+func NewVectoredReadFileOp(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset int64,
+	size int) *fuseops.ReadFileOp {
+	return &fuseops.ReadFileOp{
+		Inode:     inode,
+		Handle:    handle,
+		Offset:    offset,
+		Size:      int64(size),
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewWriteFileOp returns an op writing data at offset.
+func NewWriteFileOp(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset int64,
+	data []byte) *fuseops.WriteFileOp {
+	return &fuseops.WriteFileOp{
+		Inode:     inode,
+		Handle:    handle,
+		Offset:    offset,
+		Data:      data,
+		OpContext: NewOpContext(),
+	}
+}
+
+// NewGetXattrOp returns an op reading the named extended attribute into a
+// buffer of the given size. A size of zero models the kernel asking for the
+// size of the value only.
+func NewGetXattrOp(
+	inode fuseops.InodeID,
+	name string,
+	size int) *fuseops.GetXattrOp {
+	op := &fuseops.GetXattrOp{
+		Inode:     inode,
+		Name:      name,
+		OpContext: NewOpContext(),
+	}
+
+	if size > 0 {
+		op.Dst = make([]byte, size)
+	}
+
+	return op
+}
+
+// NewListXattrOp returns an op listing extended attribute names into a buffer
+// of the given size, with the same zero-size convention as NewGetXattrOp.
+func NewListXattrOp(
+	inode fuseops.InodeID,
+	size int) *fuseops.ListXattrOp {
+	op := &fuseops.ListXattrOp{
+		Inode:     inode,
+		OpContext: NewOpContext(),
+	}
+
+	if size > 0 {
+		op.Dst = make([]byte, size)
+	}
+
+	return op
+}
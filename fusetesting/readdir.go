@@ -16,9 +16,11 @@ package fusetesting
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"sort"
+	"strings"
 )
 
 type sortedEntries []os.FileInfo
@@ -71,3 +73,96 @@ func ReadDirPicky(dirname string) (entries []os.FileInfo, err error) {
 
 	return entries, nil
 }
+
+// CheckListingDuringChanges checks that a directory in a mounted file system
+// can be listed while it changes, with the semantics described on
+// fuseutil.DirSequence. The directory should be empty, and is left empty.
+//
+// It fills the directory, then lists it the way `rm -rf` does, removing each
+// entry as it is listed, while adding a new entry for each one listed. It
+// fails if an entry is listed twice, if an entry present throughout isn't
+// listed, or if the listing is still returning new entries when many times
+// the original number have been added.
+func CheckListingDuringChanges(dir string) (err error) {
+	const n = 1000
+
+	for i := 0; i < n; i++ {
+		if err := createEmpty(path.Join(dir, fmt.Sprintf("old-%04d", i))); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	// Leave the directory empty however we finish.
+	defer func() {
+		names, readErr := ReadDirPicky(dir)
+		if readErr != nil && err == nil {
+			err = readErr
+		}
+
+		for _, fi := range names {
+			if removeErr := os.Remove(path.Join(dir, fi.Name())); removeErr != nil && err == nil {
+				err = removeErr
+			}
+		}
+	}()
+
+	listed := make(map[string]bool)
+	added := 0
+	for {
+		names, err := f.Readdirnames(100)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("Readdirnames: %v", err)
+		}
+
+		for _, name := range names {
+			if listed[name] {
+				return fmt.Errorf("%q listed twice", name)
+			}
+
+			listed[name] = true
+			if strings.HasPrefix(name, "old-") {
+				if err := os.Remove(path.Join(dir, name)); err != nil {
+					return err
+				}
+			}
+
+			if added == 10*n {
+				return fmt.Errorf("Listing didn't end after %d entries were added during it", added)
+			}
+
+			if err := createEmpty(path.Join(dir, fmt.Sprintf("new-%05d", added))); err != nil {
+				return err
+			}
+
+			added++
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		if name := fmt.Sprintf("old-%04d", i); !listed[name] {
+			return fmt.Errorf("%q not listed", name)
+		}
+	}
+
+	return nil
+}
+
+func createEmpty(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,33 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/fusetesting"
+)
+
+// The check must pass on a well-behaved file system.
+func TestCheckListingDuringChanges(t *testing.T) {
+	dir := t.TempDir()
+	if err := fusetesting.CheckListingDuringChanges(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := fusetesting.ReadDirPicky(dir); err != nil || len(entries) != 0 {
+		t.Errorf("Left behind: %v, %v", len(entries), err)
+	}
+}
@@ -0,0 +1,522 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SoakConfig configures Soak.
+type SoakConfig struct {
+	// The directory within the file system under test in which to work. Each
+	// worker uses a subdirectory of its own, which is removed at the end.
+	Dir string
+
+	// How long to run for. Soak also stops when its context is cancelled.
+	Duration time.Duration
+
+	// The number of goroutines running the workload. Defaults to 8.
+	Workers int
+
+	// How often to sample resource usage. Defaults to one minute.
+	SampleInterval time.Duration
+
+	// An operation that hasn't finished after this long is reported as stuck.
+	// Defaults to one minute.
+	StuckTimeout time.Duration
+
+	// The process serving the file system, whose file descriptors and memory
+	// are watched. Zero means the current process, for file systems served in
+	// process, in which case goroutines are counted too.
+	PID int
+
+	// If set, each sample is logged here as it is taken.
+	Logger *log.Logger
+}
+
+// SoakSample records resource usage at one point during a soak. Values that
+// can't be measured on the current platform are -1.
+type SoakSample struct {
+	Time time.Time
+
+	// The number of workload operations completed so far.
+	Ops uint64
+
+	// Goroutines in the current process, if it is the one being watched.
+	Goroutines int
+
+	// Open file descriptors and resident memory of the watched process.
+	FDs      int
+	RSSBytes int64
+}
+
+func (s SoakSample) String() string {
+	return fmt.Sprintf(
+		"%s: %d ops, %d goroutines, %d fds, %d KiB resident",
+		s.Time.Format(time.RFC3339),
+		s.Ops,
+		s.Goroutines,
+		s.FDs,
+		s.RSSBytes>>10)
+}
+
+// SoakReport is the outcome of Soak.
+type SoakReport struct {
+	// Samples of resource usage, the first taken once every worker has
+	// finished its first round of operations, and the last at the end.
+	Samples []SoakSample
+
+	// The number of operations run and failed, by kind of operation.
+	OpsByKind    map[string]uint64
+	ErrorsByKind map[string]uint64
+
+	// Operations that failed or returned the wrong data, at most ten per kind
+	// of operation, and the total number of failures.
+	Errors     []error
+	ErrorCount uint64
+
+	// Descriptions of operations that took longer than SoakConfig.StuckTimeout.
+	Stuck []string
+}
+
+// Check returns an error if the soak saw failed or stuck operations, or if
+// resource usage at the end exceeds that of the first sample by more than
+// the steady state accounts for: goroutines or file descriptors up by more
+// than half and by more than 16, or resident memory doubled and up by more
+// than 64 MiB. These thresholds catch leaks proportional to the number of
+// operations, which over hours dwarf any noise.
+func (r *SoakReport) Check() error {
+	var problems []string
+	if r.ErrorCount != 0 {
+		problems = append(problems, fmt.Sprintf("%d failed operations, first: %v", r.ErrorCount, r.Errors[0]))
+	}
+
+	if len(r.Stuck) != 0 {
+		problems = append(problems, fmt.Sprintf("stuck operations: %s", strings.Join(r.Stuck, "; ")))
+	}
+
+	if len(r.Samples) >= 2 {
+		first := r.Samples[0]
+		last := r.Samples[len(r.Samples)-1]
+
+		grew := func(before, after, slack int64) bool {
+			return before >= 0 && after >= 0 && after-before > slack && after > before+before/2
+		}
+
+		if grew(int64(first.Goroutines), int64(last.Goroutines), 16) {
+			problems = append(problems, fmt.Sprintf("goroutines grew from %d to %d", first.Goroutines, last.Goroutines))
+		}
+
+		if grew(int64(first.FDs), int64(last.FDs), 16) {
+			problems = append(problems, fmt.Sprintf("file descriptors grew from %d to %d", first.FDs, last.FDs))
+		}
+
+		if first.RSSBytes >= 0 && last.RSSBytes > 2*first.RSSBytes && last.RSSBytes-first.RSSBytes > 64<<20 {
+			problems = append(problems, fmt.Sprintf("resident memory grew from %d to %d KiB", first.RSSBytes>>10, last.RSSBytes>>10))
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("soak: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Soak runs a mixed workload of file and directory operations in a mounted
+// file system for a long time, sampling the resource usage of the process
+// serving it, to find the slow leaks and rare hangs that short tests miss.
+// It works through ordinary system calls, so may be pointed at any file
+// system, not just those built with this package; see samples/soak for a
+// command that does so.
+//
+// The workload creates, writes, reads back and verifies, truncates, renames,
+// lists, stats and removes files and directories. Each operation's data is
+// checked, so corruption is reported as a failure. Soak returns an error only
+// if it can't set up; use SoakReport.Check to judge the outcome.
+func Soak(ctx context.Context, cfg SoakConfig) (*SoakReport, error) {
+	if cfg.Workers == 0 {
+		cfg.Workers = 8
+	}
+
+	if cfg.SampleInterval == 0 {
+		cfg.SampleInterval = time.Minute
+	}
+
+	if cfg.StuckTimeout == 0 {
+		cfg.StuckTimeout = time.Minute
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	s := &soak{
+		cfg: cfg,
+		report: SoakReport{
+			OpsByKind:    make(map[string]uint64),
+			ErrorsByKind: make(map[string]uint64),
+		},
+		running: make(map[int]soakOp),
+	}
+
+	workers := make([]*soakWorker, cfg.Workers)
+	for i := range workers {
+		dir := path.Join(cfg.Dir, fmt.Sprintf("soak.%d.%d", os.Getpid(), i))
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return nil, fmt.Errorf("Mkdir: %v", err)
+		}
+
+		workers[i] = &soakWorker{
+			soak: s,
+			id:   i,
+			dir:  dir,
+			rand: rand.New(rand.NewSource(int64(i))),
+		}
+	}
+
+	// Start the workers, taking the first sample once each has warmed up.
+	var warm sync.WaitGroup
+	warm.Add(len(workers))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *soakWorker) {
+			defer wg.Done()
+			w.run(ctx, &warm)
+		}(w)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	warmed := make(chan struct{})
+	go func() {
+		warm.Wait()
+		close(warmed)
+	}()
+
+	// Sample periodically, and look for stuck operations.
+	sampleTicker := time.NewTicker(cfg.SampleInterval)
+	defer sampleTicker.Stop()
+
+	stuckTicker := time.NewTicker(cfg.StuckTimeout / 4)
+	defer stuckTicker.Stop()
+
+	reported := make(map[soakOp]bool)
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-warmed:
+			warmed = nil
+			s.sample()
+		case <-sampleTicker.C:
+			s.sample()
+		case <-stuckTicker.C:
+			s.findStuck(reported)
+		}
+	}
+
+	// Wait for the workers to notice, giving up on any that are stuck.
+	select {
+	case <-done:
+		for _, w := range workers {
+			os.RemoveAll(w.dir)
+		}
+
+	case <-time.After(cfg.StuckTimeout):
+		s.findStuck(reported)
+	}
+
+	s.sample()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := s.report
+	return &report, nil
+}
+
+type soakOp struct {
+	desc  string
+	start time.Time
+}
+
+type soak struct {
+	cfg SoakConfig
+
+	mu      sync.Mutex
+	ops     uint64         // GUARDED_BY(mu)
+	report  SoakReport     // GUARDED_BY(mu)
+	running map[int]soakOp // GUARDED_BY(mu)
+}
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *soak) sample() {
+	sample := SoakSample{
+		Time:       time.Now(),
+		Goroutines: -1,
+		FDs:        -1,
+		RSSBytes:   -1,
+	}
+
+	pid := "self"
+	if s.cfg.PID != 0 {
+		pid = strconv.Itoa(s.cfg.PID)
+	} else {
+		sample.Goroutines = runtime.NumGoroutine()
+	}
+
+	if fds, err := ioutil.ReadDir(path.Join("/proc", pid, "fd")); err == nil {
+		sample.FDs = len(fds)
+	} else if s.cfg.PID == 0 {
+		if fds, err := ioutil.ReadDir("/dev/fd"); err == nil {
+			sample.FDs = len(fds)
+		}
+	}
+
+	if status, err := ioutil.ReadFile(path.Join("/proc", pid, "status")); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			var kib int64
+			if _, err := fmt.Sscanf(line, "VmRSS: %d kB", &kib); err == nil {
+				sample.RSSBytes = kib << 10
+			}
+		}
+	}
+
+	s.mu.Lock()
+	sample.Ops = s.ops
+	s.report.Samples = append(s.report.Samples, sample)
+	s.mu.Unlock()
+
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Print(sample)
+	}
+}
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *soak) findStuck(reported map[soakOp]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, op := range s.running {
+		if time.Since(op.start) > s.cfg.StuckTimeout && !reported[op] {
+			reported[op] = true
+			s.report.Stuck = append(s.report.Stuck, fmt.Sprintf(
+				"%s, running since %s",
+				op.desc,
+				op.start.Format(time.RFC3339)))
+		}
+	}
+}
+
+type soakWorker struct {
+	soak *soak
+	id   int
+	dir  string
+	rand *rand.Rand
+}
+
+// Run operations until the context is done, marking warm once each kind has
+// run once, or on giving up before then.
+func (w *soakWorker) run(ctx context.Context, warm *sync.WaitGroup) {
+	ops := []struct {
+		kind string
+		f    func() error
+	}{
+		{"write", w.write},
+		{"read", w.read},
+		{"truncate", w.truncate},
+		{"rename", w.rename},
+		{"readdir", w.readdir},
+		{"mkdir", w.mkdir},
+		{"unlink", w.unlink},
+	}
+
+	i := 0
+	defer func() {
+		if i < len(ops) {
+			warm.Done()
+		}
+	}()
+
+	for ; ctx.Err() == nil; i++ {
+		op := ops[w.rand.Intn(len(ops))]
+		if i < len(ops) {
+			op = ops[i]
+		}
+
+		w.do(op.kind, op.f)
+		if i == len(ops)-1 {
+			warm.Done()
+		}
+	}
+}
+
+// LOCKS_EXCLUDED(w.soak.mu)
+func (w *soakWorker) do(kind string, f func() error) {
+	s := w.soak
+
+	s.mu.Lock()
+	s.running[w.id] = soakOp{
+		desc:  fmt.Sprintf("%s in %s", kind, w.dir),
+		start: time.Now(),
+	}
+	s.mu.Unlock()
+
+	err := f()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.running, w.id)
+	s.ops++
+	s.report.OpsByKind[kind]++
+
+	if err != nil {
+		s.report.ErrorCount++
+		s.report.ErrorsByKind[kind]++
+		if s.report.ErrorsByKind[kind] <= 10 {
+			s.report.Errors = append(s.report.Errors, fmt.Errorf("%s: %v", kind, err))
+		}
+	}
+}
+
+// The names a worker uses within its directory, few enough that operations
+// find each other's results.
+func (w *soakWorker) pick() string {
+	return path.Join(w.dir, strconv.Itoa(w.rand.Intn(8)))
+}
+
+// The contents that every file written by the workload has, for some length.
+func soakContents(name string, n int) []byte {
+	pattern := []byte(path.Base(name) + "-")
+	return bytes.Repeat(pattern, n/len(pattern)+1)[:n]
+}
+
+func (w *soakWorker) write() error {
+	name := w.pick()
+	if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+		return nil
+	}
+
+	return ioutil.WriteFile(name, soakContents(name, w.rand.Intn(256<<10)), 0600)
+}
+
+func (w *soakWorker) read() error {
+	name := w.pick()
+	contents, err := ioutil.ReadFile(name)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+
+	case err != nil:
+		// Reading a directory fails, as it should.
+		if fi, statErr := os.Stat(name); statErr == nil && fi.IsDir() {
+			return nil
+		}
+
+		return err
+	}
+
+	if !bytes.Equal(contents, soakContents(name, len(contents))) {
+		return fmt.Errorf("%s: unexpected contents", name)
+	}
+
+	return nil
+}
+
+func (w *soakWorker) truncate() error {
+	name := w.pick()
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) || err == nil && fi.IsDir() {
+		return nil
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	// Truncating to a shorter length keeps the contents valid.
+	if fi.Size() == 0 {
+		return nil
+	}
+
+	return f.Truncate(w.rand.Int63n(fi.Size()))
+}
+
+func (w *soakWorker) rename() error {
+	// A file renamed to a new name has the wrong contents for that name, so
+	// move it aside and back again.
+	from, to := w.pick(), path.Join(w.dir, "moving")
+	if err := os.Rename(from, to); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return os.Rename(to, from)
+}
+
+func (w *soakWorker) readdir() error {
+	_, err := ioutil.ReadDir(w.dir)
+	return err
+}
+
+func (w *soakWorker) mkdir() error {
+	name := w.pick()
+	if err := os.Mkdir(name, 0700); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(name, "0"), soakContents("0", 100), 0600); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *soakWorker) unlink() error {
+	err := os.RemoveAll(w.pick())
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fusetesting"
+)
+
+// The workload itself must be clean on a well-behaved file system, or every
+// soak would fail.
+func TestSoak(t *testing.T) {
+	report, err := fusetesting.Soak(context.Background(), fusetesting.SoakConfig{
+		Dir:            t.TempDir(),
+		Duration:       time.Second,
+		Workers:        4,
+		SampleInterval: 100 * time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatalf("Soak: %v", err)
+	}
+
+	if err := report.Check(); err != nil {
+		t.Error(err)
+	}
+
+	if len(report.Samples) < 5 || report.Samples[len(report.Samples)-1].Ops == 0 {
+		t.Errorf("Samples: %v", report.Samples)
+	}
+
+	for _, kind := range []string{"write", "read", "rename", "mkdir", "unlink"} {
+		if report.OpsByKind[kind] == 0 {
+			t.Errorf("No %s ops: %v", kind, report.OpsByKind)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"os"
+	"testing/fstest"
+
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// TestFS runs the standard library's conformance checks for fs.FS, as
+// implemented by fstest.TestFS, against the supplied file system without
+// mounting it, using fuseutil.NewIOFS. The file system must contain at least
+// the expected files, given as slash-separated paths relative to the root.
+// Run it from a file system's own tests:
+//
+//	if err := fusetesting.TestFS(fs, "foo", "dir/bar"); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// The checks only read, so the file system must already be populated.
+func TestFS(fs fuseutil.FileSystem, expected ...string) error {
+	return fstest.TestFS(fuseutil.NewIOFS(context.Background(), fs), expected...)
+}
+
+// TestMountedFS is like TestFS, but works through the kernel on a file system
+// mounted at dir.
+func TestMountedFS(dir string, expected ...string) error {
+	return fstest.TestFS(os.DirFS(dir), expected...)
+}
@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// AdaptiveTTLPolicy chooses entry and attribute cache TTLs from how recently
+// things have been observed to change, in the style of the NFS client's
+// acregmin/acregmax heuristic: something that has been stable for a long time
+// is likely to remain so, and gets a long TTL, while something that changed a
+// moment ago gets a short one.
+//
+// The TTL for an inode's attributes is a fraction of the time since the inode
+// last changed, clamped to [MinTTL, MaxTTL]. The TTL for entries within a
+// directory is computed the same way from the last change anywhere within the
+// directory's subtree, as reported by RecordChange and the parent links
+// registered with SetParent. Inodes for which no change has been seen are
+// treated as having changed when the policy first heard of them.
+//
+// The policy only computes TTLs; callers use them when filling in responses,
+// and may pass them to AttributeTTLs.SetTTL to affect attributes the kernel
+// already holds.
+//
+// It is safe for concurrent use.
+type AdaptiveTTLPolicy struct {
+	cfg AdaptiveTTLConfig
+
+	mu sync.Mutex
+
+	inodes map[fuseops.InodeID]*adaptiveInode // GUARDED_BY(mu)
+}
+
+// AdaptiveTTLConfig configures an AdaptiveTTLPolicy.
+type AdaptiveTTLConfig struct {
+	// The bounds on the TTLs returned.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// The TTL is the time since the last change divided by this. If zero, 10 is
+	// used, matching the NFS client.
+	Divisor int
+
+	// The clock used to measure time since changes. If nil,
+	// timeutil.RealClock() is used.
+	Clock timeutil.Clock
+}
+
+type adaptiveInode struct {
+	parent fuseops.InodeID // Zero if unknown
+
+	// The last change to the inode itself, and to anything in its subtree
+	// including itself.
+	changed        time.Time
+	subtreeChanged time.Time
+}
+
+// NewAdaptiveTTLPolicy creates a policy with the supplied configuration.
+func NewAdaptiveTTLPolicy(cfg AdaptiveTTLConfig) *AdaptiveTTLPolicy {
+	if cfg.Divisor == 0 {
+		cfg.Divisor = 10
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	return &AdaptiveTTLPolicy{
+		cfg:    cfg,
+		inodes: make(map[fuseops.InodeID]*adaptiveInode),
+	}
+}
+
+// LOCKS_REQUIRED(p.mu)
+func (p *AdaptiveTTLPolicy) getOrCreate(inode fuseops.InodeID) *adaptiveInode {
+	in := p.inodes[inode]
+	if in == nil {
+		now := p.cfg.Clock.Now()
+		in = &adaptiveInode{changed: now, subtreeChanged: now}
+		p.inodes[inode] = in
+	}
+
+	return in
+}
+
+// LOCKS_REQUIRED(p.mu)
+func (p *AdaptiveTTLPolicy) ttlSince(t time.Time) time.Duration {
+	ttl := p.cfg.Clock.Now().Sub(t) / time.Duration(p.cfg.Divisor)
+	if ttl < p.cfg.MinTTL {
+		ttl = p.cfg.MinTTL
+	}
+
+	if ttl > p.cfg.MaxTTL {
+		ttl = p.cfg.MaxTTL
+	}
+
+	return ttl
+}
+
+// SetParent records that inode lives within the directory parent, so that
+// changes to it count as changes to parent's subtree. Call it when handing an
+// inode to the kernel in a ChildInodeEntry.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *AdaptiveTTLPolicy) SetParent(inode, parent fuseops.InodeID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.getOrCreate(parent)
+	p.getOrCreate(inode).parent = parent
+}
+
+// RecordChange notes that the inode changed, whether its contents,
+// attributes, or (for a directory) its entries.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *AdaptiveTTLPolicy) RecordChange(inode fuseops.InodeID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.cfg.Clock.Now()
+	in := p.getOrCreate(inode)
+	in.changed = now
+
+	// Walk up the tree. Guard against cycles from stale parent links.
+	for steps := 0; in != nil && steps <= len(p.inodes); steps++ {
+		in.subtreeChanged = now
+		if in.parent == 0 {
+			break
+		}
+
+		in = p.inodes[in.parent]
+	}
+}
+
+// AttributeTTL returns the TTL to use for the inode's attributes.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *AdaptiveTTLPolicy) AttributeTTL(inode fuseops.InodeID) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.ttlSince(p.getOrCreate(inode).changed)
+}
+
+// EntryTTL returns the TTL to use for entries within the directory parent.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *AdaptiveTTLPolicy) EntryTTL(parent fuseops.InodeID) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.ttlSince(p.getOrCreate(parent).subtreeChanged)
+}
+
+// ForgetInode discards the history for the inode. Call it when the inode's
+// lookup count reaches zero.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *AdaptiveTTLPolicy) ForgetInode(inode fuseops.InodeID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.inodes, inode)
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestAdaptiveTTLPolicy(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	p := fuseutil.NewAdaptiveTTLPolicy(fuseutil.AdaptiveTTLConfig{
+		MinTTL: time.Second,
+		MaxTTL: time.Minute,
+		Clock:  &clock,
+	})
+
+	const dir = 2
+	const file = 3
+	p.SetParent(dir, fuseops.RootInodeID)
+	p.SetParent(file, dir)
+
+	// Everything starts out at the minimum, then grows with stability up to
+	// the maximum.
+	if got := p.AttributeTTL(file); got != time.Second {
+		t.Errorf("Initial TTL = %v", got)
+	}
+
+	clock.AdvanceTime(100 * time.Second)
+	if got := p.AttributeTTL(file); got != 10*time.Second {
+		t.Errorf("TTL after 100s = %v", got)
+	}
+
+	clock.AdvanceTime(time.Hour)
+	if got := p.EntryTTL(fuseops.RootInodeID); got != time.Minute {
+		t.Errorf("Root entry TTL after an hour = %v", got)
+	}
+
+	// A change to the file resets its TTL and those of entries in all its
+	// ancestors, but not the attribute TTLs of those ancestors.
+	p.RecordChange(file)
+
+	if got := p.AttributeTTL(file); got != time.Second {
+		t.Errorf("File TTL after change = %v", got)
+	}
+
+	if got := p.EntryTTL(fuseops.RootInodeID); got != time.Second {
+		t.Errorf("Root entry TTL after change = %v", got)
+	}
+
+	if got := p.AttributeTTL(dir); got != time.Minute {
+		t.Errorf("Dir attribute TTL after change = %v", got)
+	}
+}
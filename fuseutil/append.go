@@ -0,0 +1,228 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// NewAppendFileSystem wraps a file system so that writes through handles
+// opened with O_APPEND land at the end of the file as the file system sees
+// it, rather than at the offset the kernel chose from the size it last knew
+// of, which is stale once the file has grown through another mount or behind
+// the kernel's back. Otherwise concurrent appenders overwrite each other's
+// records, corrupting logs.
+//
+// Appends to an inode are serialized: each looks up the size of the file with
+// GetInodeAttributes and writes there, while other writes to the inode and
+// changes to its size wait. Other writes proceed concurrently as before.
+//
+// When the kernel's writeback cache is in use (see
+// fuse.MountConfig.DisableWritebackCaching), the kernel resolves appends
+// against the size it caches and writes pages back later at offsets that
+// must be kept, so writes are passed on untouched. The layer learns this in
+// OnInit, so it must be mounted directly, not behind another wrapper that
+// hides OnInit.
+func NewAppendFileSystem(wrapped FileSystem) FileSystem {
+	return &appendFS{
+		FileSystem: wrapped,
+		appending:  make(map[fuseops.HandleID]struct{}),
+		locks:      make(map[fuseops.InodeID]*inodeLock),
+	}
+}
+
+type appendFS struct {
+	FileSystem
+
+	// Whether the kernel negotiated its writeback cache.
+	writeback atomic.Bool
+
+	mu sync.Mutex
+
+	// The handles opened with O_APPEND.
+	//
+	// GUARDED_BY(mu)
+	appending map[fuseops.HandleID]struct{}
+
+	// A lock for each inode being written to, held exclusively by appends.
+	//
+	// GUARDED_BY(mu)
+	locks map[fuseops.InodeID]*inodeLock
+}
+
+type inodeLock struct {
+	sync.RWMutex
+
+	// The number of ops holding or waiting for the lock.
+	//
+	// GUARDED_BY(appendFS.mu)
+	refs int
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *appendFS) lockInode(inode fuseops.InodeID) *inodeLock {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	l := fs.locks[inode]
+	if l == nil {
+		l = &inodeLock{}
+		fs.locks[inode] = l
+	}
+
+	l.refs++
+	return l
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *appendFS) unlockInode(inode fuseops.InodeID, l *inodeLock) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(fs.locks, inode)
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *appendFS) opened(h fuseops.HandleID, flags fusekernel.OpenFlags) {
+	if flags&fusekernel.OpenAppend == 0 {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.appending[h] = struct{}{}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *appendFS) isAppending(h fuseops.HandleID) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, ok := fs.appending[h]
+	return ok
+}
+
+func (fs *appendFS) OnInit(p *fuse.InitParams) error {
+	if h, ok := fs.FileSystem.(fuse.InitHandler); ok {
+		if err := h.OnInit(p); err != nil {
+			return err
+		}
+	}
+
+	fs.writeback.Store(p.Flags&uint64(fusekernel.InitWritebackCache) != 0)
+	return nil
+}
+
+func (fs *appendFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := fs.FileSystem.OpenFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.opened(op.Handle, op.OpenFlags)
+	return nil
+}
+
+func (fs *appendFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.opened(op.Handle, op.OpenFlags)
+	return nil
+}
+
+func (fs *appendFS) CreateTmpfile(
+	ctx context.Context,
+	op *fuseops.CreateTmpfileOp) error {
+	if err := fs.FileSystem.CreateTmpfile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.opened(op.Handle, op.OpenFlags)
+	return nil
+}
+
+func (fs *appendFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	delete(fs.appending, op.Handle)
+	fs.mu.Unlock()
+
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
+
+func (fs *appendFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if fs.writeback.Load() {
+		return fs.FileSystem.WriteFile(ctx, op)
+	}
+
+	l := fs.lockInode(op.Inode)
+	defer fs.unlockInode(op.Inode, l)
+
+	if !fs.isAppending(op.Handle) {
+		l.RLock()
+		defer l.RUnlock()
+
+		return fs.FileSystem.WriteFile(ctx, op)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	attrs := &fuseops.GetInodeAttributesOp{
+		Inode:     op.Inode,
+		OpContext: op.OpContext,
+	}
+
+	if err := fs.FileSystem.GetInodeAttributes(ctx, attrs); err != nil {
+		return err
+	}
+
+	op.Offset = int64(attrs.Attributes.Size)
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *appendFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if op.Size == nil || fs.writeback.Load() {
+		return fs.FileSystem.SetInodeAttributes(ctx, op)
+	}
+
+	l := fs.lockInode(op.Inode)
+	defer fs.unlockInode(op.Inode, l)
+
+	l.RLock()
+	defer l.RUnlock()
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system with a single file, which writes wherever it is told to,
+// yielding partway through so that racing writes interleave.
+type logFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu         sync.Mutex
+	contents   []byte
+	lastHandle fuseops.HandleID
+}
+
+func (fs *logFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes.Size = uint64(len(fs.contents))
+	return nil
+}
+
+func (fs *logFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lastHandle++
+	op.Handle = fs.lastHandle
+	return nil
+}
+
+func (fs *logFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	runtime.Gosched()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if end := int(op.Offset) + len(op.Data); end > len(fs.contents) {
+		fs.contents = append(fs.contents, make([]byte, end-len(fs.contents))...)
+	}
+
+	copy(fs.contents[op.Offset:], op.Data)
+	return nil
+}
+
+// Append records of the same length through two handles at once, each at the
+// offset of the end of the file as it was when appending began.
+func appendRecords(t *testing.T, fs fuseutil.FileSystem, n int) {
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		op := &fuseops.OpenFileOp{
+			Inode:     2,
+			OpenFlags: fusekernel.OpenWriteOnly | fusekernel.OpenAppend,
+		}
+
+		if err := fs.OpenFile(ctx, op); err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+
+		wg.Add(1)
+		go func(h fuseops.HandleID) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				fs.WriteFile(ctx, &fuseops.WriteFileOp{
+					Inode:  2,
+					Handle: h,
+					Data:   []byte(fmt.Sprintf("%d:%03d\n", h, i)),
+				})
+			}
+		}(op.Handle)
+	}
+
+	wg.Wait()
+}
+
+func TestAppendFileSystem(t *testing.T) {
+	const n = 100
+	wrapped := &logFS{}
+	fs := fuseutil.NewAppendFileSystem(wrapped)
+
+	appendRecords(t, fs, n)
+
+	// Every record made it, whole.
+	lines := bytes.Split(bytes.TrimSuffix(wrapped.contents, []byte("\n")), []byte("\n"))
+	if len(lines) != 2*n {
+		t.Fatalf("%d records, want %d", len(lines), 2*n)
+	}
+
+	seen := make(map[string]bool)
+	for _, l := range lines {
+		seen[string(l)] = true
+	}
+
+	for h := 1; h <= 2; h++ {
+		for i := 0; i < n; i++ {
+			if r := fmt.Sprintf("%d:%03d", h, i); !seen[r] {
+				t.Errorf("Missing record %q", r)
+			}
+		}
+	}
+}
+
+func TestAppendFileSystem_Writeback(t *testing.T) {
+	wrapped := &logFS{}
+	fs := fuseutil.NewAppendFileSystem(wrapped)
+
+	p := &fuse.InitParams{Flags: uint64(fusekernel.InitWritebackCache)}
+	if err := fs.(fuse.InitHandler).OnInit(p); err != nil {
+		t.Fatalf("OnInit: %v", err)
+	}
+
+	// The kernel's offsets are kept, so the records land on top of each other.
+	appendRecords(t, fs, 10)
+
+	if len(wrapped.contents) != len("1:000\n") {
+		t.Errorf("Contents %q, want a single record", wrapped.contents)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// XattrStore stores extended attributes on behalf of a file system that
+// can't store them itself. See NewAppleXattrFileSystem.
+type XattrStore interface {
+	// Return the attribute's value, or fuse.ENOATTR if it doesn't exist.
+	Get(inode fuseops.InodeID, name string) ([]byte, error)
+
+	// Set the attribute's value. The store may retain value.
+	Set(inode fuseops.InodeID, name string, value []byte) error
+
+	// Remove the attribute, returning fuse.ENOATTR if it doesn't exist.
+	Remove(inode fuseops.InodeID, name string) error
+
+	// Return the names of the inode's attributes.
+	List(inode fuseops.InodeID) ([]string, error)
+}
+
+// NewMemXattrStore returns an XattrStore that keeps attributes in memory, for
+// as long as the process lives.
+func NewMemXattrStore() XattrStore {
+	return &memXattrStore{
+		attrs: make(map[fuseops.InodeID]map[string][]byte),
+	}
+}
+
+type memXattrStore struct {
+	mu    sync.Mutex
+	attrs map[fuseops.InodeID]map[string][]byte // GUARDED_BY(mu)
+}
+
+func (s *memXattrStore) Get(inode fuseops.InodeID, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.attrs[inode][name]
+	if !ok {
+		return nil, fuse.ENOATTR
+	}
+
+	return v, nil
+}
+
+func (s *memXattrStore) Set(inode fuseops.InodeID, name string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.attrs[inode]
+	if m == nil {
+		m = make(map[string][]byte)
+		s.attrs[inode] = m
+	}
+
+	m[name] = value
+	return nil
+}
+
+func (s *memXattrStore) Remove(inode fuseops.InodeID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.attrs[inode][name]; !ok {
+		return fuse.ENOATTR
+	}
+
+	delete(s.attrs[inode], name)
+	if len(s.attrs[inode]) == 0 {
+		delete(s.attrs, inode)
+	}
+
+	return nil
+}
+
+func (s *memXattrStore) List(inode fuseops.InodeID) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.attrs[inode] {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// The prefix of the extended attributes that macOS uses for Finder info,
+// resource forks, quarantine flags and the like.
+const appleXattrPrefix = "com.apple."
+
+// NewAppleXattrFileSystem wraps a file system so that the extended
+// attributes that macOS applications rely on (com.apple.FinderInfo,
+// com.apple.ResourceFork, and the rest of com.apple.*) are kept in the
+// supplied store rather than passed to the wrapped file system. Other
+// attributes are passed through unchanged.
+//
+// This lets Finder copies, Office saves and the like succeed against
+// backends that can't store extended attributes. Without it, macOS falls back
+// to AppleDouble files (._foo), which MountConfig disables, or fails outright.
+//
+// The store is keyed by inode ID, so attributes outlive the kernel forgetting
+// an inode but follow the ID if the wrapped file system re-uses it for
+// another file.
+func NewAppleXattrFileSystem(wrapped FileSystem, store XattrStore) FileSystem {
+	return &appleXattrFS{
+		FileSystem: wrapped,
+		store:      store,
+	}
+}
+
+type appleXattrFS struct {
+	FileSystem
+	store XattrStore
+}
+
+func isAppleXattr(name string) bool {
+	return strings.HasPrefix(name, appleXattrPrefix)
+}
+
+// The values of the setxattr(2) flags seen in SetXattrOp.Flags.
+func xattrFlags() (create, replace uint32) {
+	if runtime.GOOS == "darwin" {
+		return 0x2, 0x4
+	}
+
+	return 0x1, 0x2
+}
+
+func (fs *appleXattrFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	if !isAppleXattr(op.Name) {
+		return fs.FileSystem.GetXattr(ctx, op)
+	}
+
+	value, err := fs.store.Get(op.Inode, op.Name)
+	if err != nil {
+		return err
+	}
+
+	// Resource forks are read in pieces.
+	if int(op.Position) > len(value) {
+		value = nil
+	} else {
+		value = value[op.Position:]
+	}
+
+	op.BytesRead = len(value)
+	if len(op.Dst) == 0 {
+		return nil
+	}
+
+	if len(op.Dst) < len(value) {
+		return syscall.ERANGE
+	}
+
+	copy(op.Dst, value)
+	return nil
+}
+
+func (fs *appleXattrFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if !isAppleXattr(op.Name) {
+		return fs.FileSystem.SetXattr(ctx, op)
+	}
+
+	old, err := fs.store.Get(op.Inode, op.Name)
+	exists := err == nil
+	if err != nil && err != fuse.ENOATTR {
+		return err
+	}
+
+	create, replace := xattrFlags()
+	switch {
+	case op.Flags&create != 0 && exists:
+		return fuse.EEXIST
+	case op.Flags&replace != 0 && !exists:
+		return fuse.ENOATTR
+	}
+
+	// Resource forks are written in pieces, each at a position within the
+	// existing value. Anything else replaces the value.
+	var value []byte
+	if op.Position == 0 {
+		value = append([]byte(nil), op.Value...)
+	} else {
+		end := int(op.Position) + len(op.Value)
+		if end < len(old) {
+			end = len(old)
+		}
+
+		value = make([]byte, end)
+		copy(value, old)
+		copy(value[op.Position:], op.Value)
+	}
+
+	return fs.store.Set(op.Inode, op.Name, value)
+}
+
+func (fs *appleXattrFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if !isAppleXattr(op.Name) {
+		return fs.FileSystem.RemoveXattr(ctx, op)
+	}
+
+	return fs.store.Remove(op.Inode, op.Name)
+}
+
+func (fs *appleXattrFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	names, err := fs.store.List(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	var ours []byte
+	for _, name := range names {
+		ours = append(ours, name...)
+		ours = append(ours, 0)
+	}
+
+	// Let the wrapped file system list its own attributes first, treating a
+	// lack of support as having none.
+	err = fs.FileSystem.ListXattr(ctx, op)
+	switch err {
+	case nil:
+	case syscall.ENOSYS, syscall.ENOTSUP:
+		op.BytesRead = 0
+	case syscall.ERANGE:
+		op.BytesRead += len(ours)
+		return err
+	default:
+		return err
+	}
+
+	n := op.BytesRead
+	op.BytesRead += len(ours)
+	if len(op.Dst) == 0 {
+		return nil
+	}
+
+	if len(op.Dst) < op.BytesRead {
+		return syscall.ERANGE
+	}
+
+	copy(op.Dst[n:], ours)
+	return nil
+}
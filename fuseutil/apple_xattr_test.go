@@ -0,0 +1,156 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with one native extended attribute on every inode.
+type oneXattrFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *oneXattrFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	const names = "user.native\x00"
+	op.BytesRead = len(names)
+	if len(op.Dst) == 0 {
+		return nil
+	}
+
+	if len(op.Dst) < len(names) {
+		return syscall.ERANGE
+	}
+
+	copy(op.Dst, names)
+	return nil
+}
+
+func TestAppleXattrFileSystem(t *testing.T) {
+	ctx := context.Background()
+	fs := fuseutil.NewAppleXattrFileSystem(&oneXattrFS{}, fuseutil.NewMemXattrStore())
+
+	create := uint32(0x1)
+	if runtime.GOOS == "darwin" {
+		create = 0x2
+	}
+
+	// Other attributes go to the wrapped file system.
+	err := fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: 2, Name: "user.foo", Value: []byte("x")})
+	if err != fuse.ENOSYS {
+		t.Errorf("SetXattr(user.foo): %v", err)
+	}
+
+	finderInfo := make([]byte, 32)
+	finderInfo[0] = 'T'
+	err = fs.SetXattr(ctx, &fuseops.SetXattrOp{
+		Inode: 2,
+		Name:  "com.apple.FinderInfo",
+		Value: finderInfo,
+		Flags: create,
+	})
+	if err != nil {
+		t.Fatalf("SetXattr: %v", err)
+	}
+
+	err = fs.SetXattr(ctx, &fuseops.SetXattrOp{
+		Inode: 2,
+		Name:  "com.apple.FinderInfo",
+		Value: finderInfo,
+		Flags: create,
+	})
+	if err != fuse.EEXIST {
+		t.Errorf("Exclusive SetXattr of existing attribute: %v", err)
+	}
+
+	// Resource forks arrive in pieces.
+	for _, piece := range []struct {
+		pos   uint32
+		value string
+	}{{0, "abc"}, {3, "def"}, {1, "B"}} {
+		err = fs.SetXattr(ctx, &fuseops.SetXattrOp{
+			Inode:    2,
+			Name:     "com.apple.ResourceFork",
+			Value:    []byte(piece.value),
+			Position: piece.pos,
+		})
+		if err != nil {
+			t.Fatalf("SetXattr(ResourceFork, %d): %v", piece.pos, err)
+		}
+	}
+
+	get := &fuseops.GetXattrOp{Inode: 2, Name: "com.apple.ResourceFork", Dst: make([]byte, 64), Position: 2}
+	if err := fs.GetXattr(ctx, get); err != nil {
+		t.Fatalf("GetXattr: %v", err)
+	}
+
+	if got := string(get.Dst[:get.BytesRead]); got != "cdef" {
+		t.Errorf("ResourceFork from 2 = %q", got)
+	}
+
+	// Size queries and short buffers.
+	get = &fuseops.GetXattrOp{Inode: 2, Name: "com.apple.FinderInfo"}
+	if err := fs.GetXattr(ctx, get); err != nil || get.BytesRead != 32 {
+		t.Errorf("Size query: %d, %v", get.BytesRead, err)
+	}
+
+	get = &fuseops.GetXattrOp{Inode: 2, Name: "com.apple.FinderInfo", Dst: make([]byte, 8)}
+	if err := fs.GetXattr(ctx, get); err != syscall.ERANGE {
+		t.Errorf("Short buffer: %v", err)
+	}
+
+	get = &fuseops.GetXattrOp{Inode: 3, Name: "com.apple.FinderInfo"}
+	if err := fs.GetXattr(ctx, get); err != fuse.ENOATTR {
+		t.Errorf("Other inode: %v", err)
+	}
+
+	// Listing merges both sources.
+	list := &fuseops.ListXattrOp{Inode: 2}
+	if err := fs.ListXattr(ctx, list); err != nil {
+		t.Fatalf("ListXattr size: %v", err)
+	}
+
+	list.Dst = make([]byte, list.BytesRead)
+	if err := fs.ListXattr(ctx, list); err != nil {
+		t.Fatalf("ListXattr: %v", err)
+	}
+
+	want := "user.native\x00com.apple.FinderInfo\x00com.apple.ResourceFork\x00"
+	if got := string(list.Dst[:list.BytesRead]); got != want {
+		t.Errorf("ListXattr = %q, want %q", got, want)
+	}
+
+	list.Dst = make([]byte, len(want)-1)
+	if err := fs.ListXattr(ctx, list); err != syscall.ERANGE {
+		t.Errorf("Short list buffer: %v", err)
+	}
+
+	if err := fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: 2, Name: "com.apple.ResourceFork"}); err != nil {
+		t.Errorf("RemoveXattr: %v", err)
+	}
+
+	if err := fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: 2, Name: "com.apple.ResourceFork"}); err != fuse.ENOATTR {
+		t.Errorf("Second RemoveXattr: %v", err)
+	}
+}
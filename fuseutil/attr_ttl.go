@@ -0,0 +1,187 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// AttributeTTLs chooses the attribute cache lifetime for each inode, allowing
+// the lifetime of a particular inode to be changed after the fact. For
+// example, a file system may lengthen the TTL of a file once it is known to be
+// immutable, or shorten it for one that has started changing.
+//
+// File systems call Expiration when filling in AttributesExpiration for
+// any response, and ForgetInode when an inode's lookup count reaches zero.
+// AttributeTTLs remembers the latest expiration handed to the kernel for each
+// inode. When a TTL is shortened such that the kernel may hold attributes for
+// longer than the new TTL allows, it asks the kernel to drop them (but not the
+// inode's cached data), so that the next access fetches fresh attributes with
+// the new expiration. Lengthening a TTL needs no notification; the kernel picks
+// up the new TTL the next time its cached attributes expire.
+//
+// It is safe for concurrent use.
+type AttributeTTLs struct {
+	notifier   Notifier
+	clock      timeutil.Clock
+	defaultTTL time.Duration
+
+	mu sync.Mutex
+
+	// Overridden TTLs.
+	ttls map[fuseops.InodeID]time.Duration // GUARDED_BY(mu)
+
+	// The latest expiration returned by Expiration for each inode, where that
+	// is in the future.
+	issued map[fuseops.InodeID]time.Time // GUARDED_BY(mu)
+}
+
+// NewAttributeTTLs creates an AttributeTTLs using defaultTTL for inodes without
+// an override, and sending notifications via n.
+func NewAttributeTTLs(
+	n Notifier,
+	clock timeutil.Clock,
+	defaultTTL time.Duration) *AttributeTTLs {
+	return &AttributeTTLs{
+		notifier:   n,
+		clock:      clock,
+		defaultTTL: defaultTTL,
+		ttls:       make(map[fuseops.InodeID]time.Duration),
+		issued:     make(map[fuseops.InodeID]time.Time),
+	}
+}
+
+// TTL returns the current TTL for the inode.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *AttributeTTLs) TTL(inode fuseops.InodeID) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.ttl(inode)
+}
+
+// LOCKS_REQUIRED(a.mu)
+func (a *AttributeTTLs) ttl(inode fuseops.InodeID) time.Duration {
+	if ttl, ok := a.ttls[inode]; ok {
+		return ttl
+	}
+
+	return a.defaultTTL
+}
+
+// Expiration returns the attribute expiration time to send to the kernel for
+// the inode, and records that it has been sent. A zero TTL gives the zero
+// time, disabling caching.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *AttributeTTLs) Expiration(inode fuseops.InodeID) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ttl := a.ttl(inode)
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	exp := a.clock.Now().Add(ttl)
+	if exp.After(a.issued[inode]) {
+		a.issued[inode] = exp
+	}
+
+	return exp
+}
+
+// SetTTL overrides the TTL for the inode, notifying the kernel if it may be
+// caching attributes for longer than the new TTL allows.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *AttributeTTLs) SetTTL(
+	inode fuseops.InodeID,
+	ttl time.Duration) error {
+	a.mu.Lock()
+	a.ttls[inode] = ttl
+	notify := a.shortenedLocked(inode, ttl)
+	a.mu.Unlock()
+
+	return a.maybeNotify(inode, notify)
+}
+
+// ResetTTL removes any override for the inode, reverting to the default TTL.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *AttributeTTLs) ResetTTL(inode fuseops.InodeID) error {
+	a.mu.Lock()
+	delete(a.ttls, inode)
+	notify := a.shortenedLocked(inode, a.defaultTTL)
+	a.mu.Unlock()
+
+	return a.maybeNotify(inode, notify)
+}
+
+// ForgetInode discards all state for the inode. Call it when the inode's
+// lookup count reaches zero; see fuseops.ForgetInodeOp.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *AttributeTTLs) ForgetInode(inode fuseops.InodeID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.ttls, inode)
+	delete(a.issued, inode)
+}
+
+// Report whether the kernel may hold attributes for the inode that outlive the
+// supplied TTL, updating our record of what it holds on the assumption that
+// we'll tell it to drop them.
+//
+// LOCKS_REQUIRED(a.mu)
+func (a *AttributeTTLs) shortenedLocked(
+	inode fuseops.InodeID,
+	ttl time.Duration) bool {
+	issued, ok := a.issued[inode]
+	if !ok {
+		return false
+	}
+
+	now := a.clock.Now()
+	if !issued.After(now) {
+		delete(a.issued, inode)
+		return false
+	}
+
+	if !issued.After(now.Add(ttl)) {
+		return false
+	}
+
+	delete(a.issued, inode)
+	return true
+}
+
+func (a *AttributeTTLs) maybeNotify(
+	inode fuseops.InodeID,
+	notify bool) error {
+	if !notify {
+		return nil
+	}
+
+	// A negative offset invalidates attributes while leaving cached pages
+	// alone.
+	return a.notifier.NotifyInvalInode(inode, -1, 0)
+}
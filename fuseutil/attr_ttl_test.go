@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestAttributeTTLs(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	n := newRecordingNotifier()
+	a := fuseutil.NewAttributeTTLs(n, &clock, time.Minute)
+
+	const inode = 17
+
+	if got, want := a.Expiration(inode), clock.Now().Add(time.Minute); !got.Equal(want) {
+		t.Errorf("Expiration = %v, want %v", got, want)
+	}
+
+	// Lengthening needs no notification.
+	if err := a.SetTTL(inode, time.Hour); err != nil {
+		t.Fatalf("SetTTL: %v", err)
+	}
+
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+
+	if got, want := a.Expiration(inode), clock.Now().Add(time.Hour); !got.Equal(want) {
+		t.Errorf("Expiration = %v, want %v", got, want)
+	}
+
+	// Shortening below what the kernel holds invalidates attributes only.
+	if err := a.SetTTL(inode, time.Second); err != nil {
+		t.Fatalf("SetTTL: %v", err)
+	}
+
+	if got, want := n.next(), "inode 17 [-1, +0)"; got != want {
+		t.Errorf("Notification = %q, want %q", got, want)
+	}
+
+	// Once the kernel's copy has expired, shortening further is free.
+	a.Expiration(inode)
+	clock.AdvanceTime(2 * time.Second)
+	if err := a.SetTTL(inode, 0); err != nil {
+		t.Fatalf("SetTTL: %v", err)
+	}
+
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+
+	if got := a.Expiration(inode); !got.IsZero() {
+		t.Errorf("Expiration with zero TTL = %v", got)
+	}
+
+	// Resetting restores the default.
+	if err := a.ResetTTL(inode); err != nil {
+		t.Fatalf("ResetTTL: %v", err)
+	}
+
+	if got := a.TTL(inode); got != time.Minute {
+		t.Errorf("TTL after reset = %v", got)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// BatchInvalidatorConfig configures a BatchInvalidator.
+type BatchInvalidatorConfig struct {
+	// How long to collect invalidations before sending them. Requests for the
+	// same inode or entry within this period are sent once.
+	Interval time.Duration
+
+	// The most notifications to send per interval. Any beyond this are held
+	// until the next interval, still subject to coalescing. Zero means no
+	// limit.
+	MaxPerInterval int
+
+	// A logger for failed notifications. If nil, nothing is logged.
+	ErrorLogger *log.Logger
+}
+
+// BatchInvalidator collects cache invalidations and sends them to the kernel
+// periodically, coalescing repeated invalidations of the same inode or entry.
+// This suits file systems that learn about changes from a stream of events
+// from their backing store, which may contain bursts of changes to the same
+// objects that would otherwise each become a write to the device.
+//
+// Invalidations of the same inode are merged into a single notification
+// covering the union of the requested ranges.
+//
+// It is safe for concurrent use.
+type BatchInvalidator struct {
+	notifier Notifier
+	cfg      BatchInvalidatorConfig
+
+	mu sync.Mutex
+
+	inodes  map[fuseops.InodeID]invalRange // GUARDED_BY(mu)
+	entries map[invalEntry]struct{}        // GUARDED_BY(mu)
+
+	// The pending flush, if any. It is armed only while invalidations are
+	// pending, so that an idle file system has no timer wakeups.
+	timer *time.Timer // GUARDED_BY(mu)
+
+	closed bool // GUARDED_BY(mu)
+}
+
+// A range of an inode to invalidate, in the terms of NotifyInvalInode except
+// that an end of -1 means "to the end of the file".
+type invalRange struct {
+	off int64 // Negative for attributes only
+	end int64
+}
+
+type invalEntry struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// NewBatchInvalidator creates a BatchInvalidator sending notifications via n.
+func NewBatchInvalidator(
+	n Notifier,
+	cfg BatchInvalidatorConfig) *BatchInvalidator {
+	return &BatchInvalidator{
+		notifier: n,
+		cfg:      cfg,
+		inodes:   make(map[fuseops.InodeID]invalRange),
+		entries:  make(map[invalEntry]struct{}),
+	}
+}
+
+// InvalidateInode queues an invalidation with the semantics of
+// fuse.Connection.NotifyInvalInode.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *BatchInvalidator) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) {
+	r := invalRange{off: off, end: -1}
+	if off >= 0 && length > 0 {
+		r.end = off + length
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if prev, ok := b.inodes[inode]; ok {
+		r = mergeInvalRanges(prev, r)
+	}
+
+	b.inodes[inode] = r
+	b.scheduleLocked()
+}
+
+func mergeInvalRanges(a, b invalRange) invalRange {
+	// Invalidating attributes only is subsumed by any data invalidation.
+	switch {
+	case a.off < 0:
+		return b
+	case b.off < 0:
+		return a
+	}
+
+	r := a
+	if b.off < r.off {
+		r.off = b.off
+	}
+
+	if a.end == -1 || b.end == -1 {
+		r.end = -1
+	} else if b.end > r.end {
+		r.end = b.end
+	}
+
+	return r
+}
+
+// InvalidateEntry queues an invalidation with the semantics of
+// fuse.Connection.NotifyInvalEntry.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *BatchInvalidator) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries[invalEntry{parent, name}] = struct{}{}
+	b.scheduleLocked()
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *BatchInvalidator) scheduleLocked() {
+	if b.timer != nil || b.closed {
+		return
+	}
+
+	b.timer = time.AfterFunc(b.cfg.Interval, func() {
+		b.mu.Lock()
+		b.timer = nil
+		b.mu.Unlock()
+
+		b.flush(b.cfg.MaxPerInterval)
+	})
+}
+
+// Flush sends all pending invalidations now, ignoring MaxPerInterval, and
+// returns the first error encountered.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *BatchInvalidator) Flush() error {
+	return b.flush(0)
+}
+
+// Close flushes pending invalidations and stops the background timer. Later
+// invalidations are held until the next call to Flush.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *BatchInvalidator) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	return b.Flush()
+}
+
+// Send up to max pending invalidations (all of them if max is zero), entries
+// first, in a deterministic order.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *BatchInvalidator) flush(max int) error {
+	b.mu.Lock()
+
+	entries := make([]invalEntry, 0, len(b.entries))
+	for e := range b.entries {
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].parent != entries[j].parent {
+			return entries[i].parent < entries[j].parent
+		}
+
+		return entries[i].name < entries[j].name
+	})
+
+	inodes := make([]fuseops.InodeID, 0, len(b.inodes))
+	for inode := range b.inodes {
+		inodes = append(inodes, inode)
+	}
+
+	sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+
+	if max > 0 && len(entries) > max {
+		entries = entries[:max]
+	}
+
+	if max > 0 && len(entries)+len(inodes) > max {
+		inodes = inodes[:max-len(entries)]
+	}
+
+	ranges := make([]invalRange, len(inodes))
+	for i, inode := range inodes {
+		ranges[i] = b.inodes[inode]
+		delete(b.inodes, inode)
+	}
+
+	for _, e := range entries {
+		delete(b.entries, e)
+	}
+
+	// Anything left over waits for the next interval.
+	if len(b.inodes)+len(b.entries) != 0 {
+		b.scheduleLocked()
+	}
+
+	b.mu.Unlock()
+
+	var firstErr error
+	record := func(err error) {
+		if err == nil {
+			return
+		}
+
+		if b.cfg.ErrorLogger != nil {
+			b.cfg.ErrorLogger.Printf("BatchInvalidator: %v", err)
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, e := range entries {
+		record(b.notifier.NotifyInvalEntry(e.parent, e.name))
+	}
+
+	for i, inode := range inodes {
+		r := ranges[i]
+		var length int64
+		if r.off >= 0 && r.end != -1 {
+			length = r.end - r.off
+		}
+
+		record(b.notifier.NotifyInvalInode(inode, r.off, length))
+	}
+
+	return firstErr
+}
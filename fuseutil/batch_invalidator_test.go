@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestBatchInvalidatorCoalesces(t *testing.T) {
+	n := newRecordingNotifier()
+	b := fuseutil.NewBatchInvalidator(n, fuseutil.BatchInvalidatorConfig{
+		Interval: time.Hour,
+	})
+
+	b.InvalidateInode(17, -1, 0)
+	b.InvalidateInode(17, 4096, 100)
+	b.InvalidateInode(17, 0, 10)
+	b.InvalidateInode(18, -1, 0)
+	b.InvalidateInode(19, 100, 0)
+	b.InvalidateInode(19, 0, 10)
+	b.InvalidateEntry(1, "foo")
+	b.InvalidateEntry(1, "foo")
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want := []string{
+		"entry 1/foo",
+		"inode 17 [0, +4196)",
+		"inode 18 [-1, +0)",
+		"inode 19 [0, +0)",
+	}
+
+	for _, w := range want {
+		if got := n.next(); got != w {
+			t.Errorf("Notification = %q, want %q", got, w)
+		}
+	}
+
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+}
+
+func TestBatchInvalidatorRateLimits(t *testing.T) {
+	n := newRecordingNotifier()
+	b := fuseutil.NewBatchInvalidator(n, fuseutil.BatchInvalidatorConfig{
+		Interval:       10 * time.Millisecond,
+		MaxPerInterval: 2,
+	})
+
+	defer b.Close()
+
+	for i := 0; i < 5; i++ {
+		b.InvalidateEntry(1, string(rune('a'+i)))
+	}
+
+	// All are sent eventually, in order, across several intervals.
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if got, want := n.next(), "entry 1/"+name; got != want {
+			t.Errorf("Notification = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewCaseInsensitiveFileSystem wraps a case-sensitive file system, giving it
+// the case-insensitive, case-preserving semantics that macOS and Windows
+// clients expect: "README" finds a file created as "readme", creating "README"
+// next to it fails with EEXIST, and renaming "readme" to "README" changes the
+// case of the stored name. Names are compared with Unicode simple case
+// folding, as by strings.EqualFold.
+//
+// Names that don't match exactly are found by listing the parent directory
+// through the wrapped file system, so lookups of differently-cased names
+// cost a full listing. Namespace changes made through the wrapper are
+// serialized, so that two names differing only in case can't be created
+// concurrently.
+//
+// The kernel's dentry cache is case-sensitive. The wrapper therefore never
+// returns negative entries, which would keep "README" missing after "readme"
+// is created, and if n is non-nil, it invalidates the other spellings under
+// which it has returned an entry when the entry is removed or renamed. Set
+// MountConfig.EnableCaseInsensitive too on OS X, where the kernel can fold
+// names itself.
+func NewCaseInsensitiveFileSystem(wrapped FileSystem, n Notifier) FileSystem {
+	return &caseInsensitiveFS{
+		FileSystem: wrapped,
+		notifier:   n,
+		aliases:    make(map[fuseops.InodeID]map[string]map[string]struct{}),
+	}
+}
+
+type caseInsensitiveFS struct {
+	FileSystem
+	notifier Notifier // May be nil
+
+	// Held while resolving and then changing a name, so that the resolution
+	// stays valid.
+	namespaceMu sync.Mutex
+
+	mu sync.Mutex
+
+	// For each parent directory and folded name, the spellings other than the
+	// stored one under which LookUpInode has returned the entry.
+	aliases map[fuseops.InodeID]map[string]map[string]struct{} // GUARDED_BY(mu)
+}
+
+// Fold a name so that two names are equal under strings.EqualFold exactly
+// when their folds are equal, by mapping each rune to the smallest rune in
+// its case folding orbit.
+func foldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+
+		return min
+	}, name)
+}
+
+// Find the stored name in the directory that matches the supplied one,
+// preferring an exact match. Return the empty string if there is none.
+func (fs *caseInsensitiveFS) resolve(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string) (string, error) {
+	entries, err := listDir(ctx, fs.FileSystem, parent)
+	if err != nil {
+		return "", err
+	}
+
+	var match string
+	for _, e := range entries {
+		if e.Name == name {
+			return name, nil
+		}
+
+		if match == "" && strings.EqualFold(e.Name, name) {
+			match = e.Name
+		}
+	}
+
+	return match, nil
+}
+
+// Fail with EEXIST if the directory already has an entry matching the name.
+//
+// LOCKS_REQUIRED(fs.namespaceMu)
+func (fs *caseInsensitiveFS) checkFree(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string) error {
+	stored, err := fs.resolve(ctx, parent, name)
+	if err != nil {
+		return err
+	}
+
+	if stored != "" {
+		return fuse.EEXIST
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *caseInsensitiveFS) addAlias(parent fuseops.InodeID, alias string) {
+	if fs.notifier == nil {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	byFold := fs.aliases[parent]
+	if byFold == nil {
+		byFold = make(map[string]map[string]struct{})
+		fs.aliases[parent] = byFold
+	}
+
+	folded := foldName(alias)
+	if byFold[folded] == nil {
+		byFold[folded] = make(map[string]struct{})
+	}
+
+	byFold[folded][alias] = struct{}{}
+}
+
+// Invalidate the spellings of a removed or renamed entry that the kernel may
+// have cached, other than the one it used for the op: the stored name and the
+// aliases. The kernel holds the parent's lock during the op, so the
+// notifications are sent afterward, in the background.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *caseInsensitiveFS) dropAliases(
+	parent fuseops.InodeID,
+	stored string,
+	used string) {
+	if fs.notifier == nil {
+		return
+	}
+
+	fs.mu.Lock()
+	folded := foldName(stored)
+	aliases := fs.aliases[parent][folded]
+	delete(fs.aliases[parent], folded)
+	if len(fs.aliases[parent]) == 0 {
+		delete(fs.aliases, parent)
+	}
+	fs.mu.Unlock()
+
+	var stale []string
+	for alias := range aliases {
+		if alias != used {
+			stale = append(stale, alias)
+		}
+	}
+
+	if stored != used {
+		stale = append(stale, stored)
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+
+	go func() {
+		for _, name := range stale {
+			fs.notifier.NotifyInvalEntry(parent, name)
+		}
+	}()
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *caseInsensitiveFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	if err == nil && op.Entry.Child != 0 {
+		return nil
+	}
+
+	if err != nil && err != fuse.ENOENT {
+		return err
+	}
+
+	stored, err := fs.resolve(ctx, op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if stored == "" || stored == op.Name {
+		op.Entry = fuseops.ChildInodeEntry{}
+		return fuse.ENOENT
+	}
+
+	sub := *op
+	sub.Name = stored
+	sub.Entry = fuseops.ChildInodeEntry{}
+	if err := fs.FileSystem.LookUpInode(ctx, &sub); err != nil {
+		return err
+	}
+
+	if sub.Entry.Child == 0 {
+		return fuse.ENOENT
+	}
+
+	op.Entry = sub.Entry
+	fs.addAlias(op.Parent, op.Name)
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *caseInsensitiveFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	if err := fs.checkFree(ctx, op.Parent, op.Name); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *caseInsensitiveFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	if err := fs.checkFree(ctx, op.Parent, op.Name); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *caseInsensitiveFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	if err := fs.checkFree(ctx, op.Parent, op.Name); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *caseInsensitiveFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	if err := fs.checkFree(ctx, op.Parent, op.Name); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *caseInsensitiveFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	if err := fs.checkFree(ctx, op.Parent, op.Name); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *caseInsensitiveFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	oldName, err := fs.resolve(ctx, op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+
+	if oldName == "" {
+		return fuse.ENOENT
+	}
+
+	newName, err := fs.resolve(ctx, op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	sub := *op
+	sub.OldName = oldName
+	switch {
+	case newName == "":
+		// A fresh name.
+
+	case op.NewParent == op.OldParent && newName == oldName:
+		// A change of case only, or nothing at all.
+		if op.NewName == oldName {
+			return nil
+		}
+
+	default:
+		// Replace the existing entry, under its stored name.
+		sub.NewName = newName
+	}
+
+	if err := fs.FileSystem.Rename(ctx, &sub); err != nil {
+		return err
+	}
+
+	fs.dropAliases(op.OldParent, oldName, op.OldName)
+	if newName != "" && newName != oldName {
+		fs.dropAliases(op.NewParent, newName, op.NewName)
+	}
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *caseInsensitiveFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	stored, err := fs.resolve(ctx, op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if stored == "" {
+		return fuse.ENOENT
+	}
+
+	sub := *op
+	sub.Name = stored
+	if err := fs.FileSystem.RmDir(ctx, &sub); err != nil {
+		return err
+	}
+
+	fs.dropAliases(op.Parent, stored, op.Name)
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *caseInsensitiveFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	stored, err := fs.resolve(ctx, op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if stored == "" {
+		return fuse.ENOENT
+	}
+
+	sub := *op
+	sub.Name = stored
+	if err := fs.FileSystem.Unlink(ctx, &sub); err != nil {
+		return err
+	}
+
+	fs.dropAliases(op.Parent, stored, op.Name)
+	return nil
+}
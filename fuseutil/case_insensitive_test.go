@@ -0,0 +1,207 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A case-sensitive file system with a single flat directory of files.
+type flatFS struct {
+	fuseutil.NotImplementedFileSystem
+	children map[string]fuseops.InodeID
+	next     fuseops.InodeID
+}
+
+func newFlatFS() *flatFS {
+	return &flatFS{
+		children: make(map[string]fuseops.InodeID),
+		next:     2,
+	}
+}
+
+func (fs *flatFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	child, ok := fs.children[op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = child
+	return nil
+}
+
+func (fs *flatFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if _, ok := fs.children[op.Name]; ok {
+		return fuse.EEXIST
+	}
+
+	fs.children[op.Name] = fs.next
+	op.Entry.Child = fs.next
+	fs.next++
+	return nil
+}
+
+func (fs *flatFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if _, ok := fs.children[op.Name]; !ok {
+		return fuse.ENOENT
+	}
+
+	delete(fs.children, op.Name)
+	return nil
+}
+
+func (fs *flatFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	child, ok := fs.children[op.OldName]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	delete(fs.children, op.OldName)
+	fs.children[op.NewName] = child
+	return nil
+}
+
+func (fs *flatFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	var names []string
+	for name := range fs.children {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for i := int(op.Offset); i < len(names); i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fs.children[names[i]],
+			Name:   names[i],
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *flatFS) names() (names []string) {
+	for name := range fs.children {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func TestCaseInsensitiveFileSystem(t *testing.T) {
+	ctx := context.Background()
+	n := newRecordingNotifier()
+	wrapped := newFlatFS()
+	fs := fuseutil.NewCaseInsensitiveFileSystem(wrapped, n)
+
+	if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: 1, Name: "ReadMe"}); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	// Names differing only in case can't be created.
+	err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: 1, Name: "README"})
+	if err != fuse.EEXIST {
+		t.Errorf("CreateFile(README): %v", err)
+	}
+
+	// Lookups are case-insensitive.
+	for _, name := range []string{"ReadMe", "readme", "README"} {
+		op := &fuseops.LookUpInodeOp{Parent: 1, Name: name}
+		if err := fs.LookUpInode(ctx, op); err != nil || op.Entry.Child != 2 {
+			t.Errorf("LookUpInode(%s): %v, %v", name, err, op.Entry.Child)
+		}
+	}
+
+	err = fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: 1, Name: "readme.txt"})
+	if err != fuse.ENOENT {
+		t.Errorf("LookUpInode(readme.txt): %v", err)
+	}
+
+	// Renaming changes the case of the stored name, and invalidates the other
+	// spellings the kernel has seen.
+	err = fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: 1,
+		OldName:   "readme",
+		NewParent: 1,
+		NewName:   "README",
+	})
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if got := wrapped.names(); len(got) != 1 || got[0] != "README" {
+		t.Errorf("Names after rename: %v", got)
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		got = append(got, n.next())
+	}
+
+	sort.Strings(got)
+	if got[0] != "entry 1/README" || got[1] != "entry 1/ReadMe" {
+		t.Errorf("Notifications: %v", got)
+	}
+
+	// Renaming over a differently-cased name replaces it.
+	if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: 1, Name: "new"}); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	err = fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: 1,
+		OldName:   "NEW",
+		NewParent: 1,
+		NewName:   "readme",
+	})
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if got := wrapped.names(); len(got) != 1 || got[0] != "README" || wrapped.children["README"] != 3 {
+		t.Errorf("Names after replacing rename: %v", got)
+	}
+
+	// Unlinking resolves the name too.
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "ReadMe"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	if got := wrapped.names(); len(got) != 0 {
+		t.Errorf("Names after unlink: %v", got)
+	}
+}
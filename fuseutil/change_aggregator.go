@@ -0,0 +1,280 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ChangeKind is the kind of a ChangeEvent.
+type ChangeKind int
+
+const (
+	// The inode's metadata changed (mode, ownership, times), but not its
+	// contents.
+	ChangeAttributes ChangeKind = iota
+
+	// The inode's contents changed in the range [Offset, Offset+Length), with
+	// a Length of zero or less meaning "to the end of the file". Size changes
+	// are data changes.
+	ChangeData
+
+	// The name Name was added to the directory Parent, pointing at Inode.
+	ChangeCreated
+
+	// The name Name was removed from the directory Parent. Inode is the inode
+	// it pointed at, if known, or zero.
+	ChangeDeleted
+)
+
+// ChangeEvent describes a change to a file system made behind the kernel's
+// back, e.g. by another client of a network file system.
+type ChangeEvent struct {
+	Kind  ChangeKind
+	Inode fuseops.InodeID
+
+	// For ChangeData.
+	Offset int64
+	Length int64
+
+	// For ChangeCreated and ChangeDeleted.
+	Parent fuseops.InodeID
+	Name   string
+}
+
+// ChangeAggregator turns events describing changes to the backing store into
+// the smallest set of kernel notifications that makes the kernel's caches
+// consistent with them.
+//
+// Notifications about inodes that the kernel doesn't know about are wasted
+// effort, and with a careless implementation can race with the kernel
+// forgetting an inode and the file system re-using its ID. ChangeAggregator
+// therefore tracks the lookup count of each inode, and only sends
+// notifications concerning inodes whose count is non-zero. File systems must
+// call AddLookup for every ChildInodeEntry they return and Forget for every
+// forget op, holding whatever lock they use to serialize lookups against
+// Apply, so that the count is exact. A forget for more lookups than were
+// recorded means one was missed; the count is then taken to be zero and the
+// mismatch logged, or in debug mode Forget panics.
+//
+// Within a single call to Apply, events for the same inode are merged:
+// repeated data changes become a single invalidation covering their union,
+// attribute changes are subsumed by data changes, and an inode that is both
+// changed and deleted receives only an attribute invalidation (for its link
+// count). Entry invalidations are sent before inode invalidations, so that
+// lookups racing with the notifications see the new names.
+//
+// It is safe for concurrent use.
+type ChangeAggregator struct {
+	notifier    Notifier
+	errorLogger *log.Logger // May be nil
+	debug       bool
+
+	mu sync.Mutex
+
+	// The kernel's lookup count for each inode, as reported to AddLookup and
+	// Forget. The root is always known and does not appear.
+	//
+	// INVARIANT: All values are non-zero.
+	lookups map[fuseops.InodeID]uint64 // GUARDED_BY(mu)
+}
+
+// NewChangeAggregator creates an aggregator sending notifications via n.
+// Lookup count mismatches are logged to errorLogger, which may be nil, or
+// cause a panic if debug is set.
+func NewChangeAggregator(
+	n Notifier,
+	errorLogger *log.Logger,
+	debug bool) *ChangeAggregator {
+	return &ChangeAggregator{
+		notifier:    n,
+		errorLogger: errorLogger,
+		debug:       debug,
+		lookups:     make(map[fuseops.InodeID]uint64),
+	}
+}
+
+// AddLookup increments the lookup count for the inode.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *ChangeAggregator) AddLookup(inode fuseops.InodeID) {
+	if inode == fuseops.RootInodeID {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.lookups[inode]++
+}
+
+// Forget decrements the lookup count for the inode by n. If the count would
+// go negative, which indicates a bookkeeping error, it is set to zero instead,
+// or in debug mode Forget panics.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *ChangeAggregator) Forget(inode fuseops.InodeID, n uint64) {
+	if inode == fuseops.RootInodeID {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	count := a.lookups[inode]
+	switch {
+	case n > count:
+		msg := fmt.Sprintf("Forget(%v, %d) with lookup count %d", inode, n, count)
+		if a.debug {
+			panic(msg)
+		}
+
+		if a.errorLogger != nil {
+			a.errorLogger.Printf("ChangeAggregator: %s", msg)
+		}
+
+		delete(a.lookups, inode)
+
+	case n == count:
+		delete(a.lookups, inode)
+	default:
+		a.lookups[inode] = count - n
+	}
+}
+
+// LOCKS_REQUIRED(a.mu)
+func (a *ChangeAggregator) knownLocked(inode fuseops.InodeID) bool {
+	return inode == fuseops.RootInodeID || a.lookups[inode] != 0
+}
+
+// Apply sends the notifications required by the supplied events, returning
+// the first error encountered. All notifications are attempted regardless.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *ChangeAggregator) Apply(events []ChangeEvent) error {
+	type inodeState struct {
+		rng     invalRange
+		data    bool
+		deleted bool
+	}
+
+	a.mu.Lock()
+
+	inodes := make(map[fuseops.InodeID]*inodeState)
+	entries := make(map[invalEntry]struct{})
+
+	getInode := func(id fuseops.InodeID) *inodeState {
+		s := inodes[id]
+		if s == nil {
+			s = &inodeState{rng: invalRange{off: -1, end: -1}}
+			inodes[id] = s
+		}
+
+		return s
+	}
+
+	for _, e := range events {
+		switch e.Kind {
+		case ChangeAttributes:
+			if a.knownLocked(e.Inode) {
+				getInode(e.Inode)
+			}
+
+		case ChangeData:
+			if !a.knownLocked(e.Inode) {
+				break
+			}
+
+			r := invalRange{off: e.Offset, end: -1}
+			if e.Length > 0 {
+				r.end = e.Offset + e.Length
+			}
+
+			s := getInode(e.Inode)
+			s.rng = mergeInvalRanges(s.rng, r)
+			s.data = true
+
+		case ChangeCreated, ChangeDeleted:
+			// The kernel may hold a (possibly negative) dentry for the name only
+			// if it knows the parent.
+			if a.knownLocked(e.Parent) {
+				entries[invalEntry{e.Parent, e.Name}] = struct{}{}
+
+				// The parent's size and times changed too.
+				getInode(e.Parent)
+			}
+
+			if e.Kind == ChangeDeleted && e.Inode != 0 && a.knownLocked(e.Inode) {
+				getInode(e.Inode).deleted = true
+			}
+		}
+	}
+
+	a.mu.Unlock()
+
+	// Send entry invalidations first, in a deterministic order.
+	sortedEntries := make([]invalEntry, 0, len(entries))
+	for e := range entries {
+		sortedEntries = append(sortedEntries, e)
+	}
+
+	sort.Slice(sortedEntries, func(i, j int) bool {
+		if sortedEntries[i].parent != sortedEntries[j].parent {
+			return sortedEntries[i].parent < sortedEntries[j].parent
+		}
+
+		return sortedEntries[i].name < sortedEntries[j].name
+	})
+
+	var firstErr error
+	for _, e := range sortedEntries {
+		if err := a.notifier.NotifyInvalEntry(e.parent, e.name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	ids := make([]fuseops.InodeID, 0, len(inodes))
+	for id := range inodes {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		s := inodes[id]
+
+		// There's no point dropping pages of a deleted inode that the kernel
+		// may still have open; readers of an unlinked file see its old
+		// contents.
+		off, length := int64(-1), int64(0)
+		if s.data && !s.deleted {
+			off = s.rng.off
+			if s.rng.end != -1 {
+				length = s.rng.end - s.rng.off
+			}
+		}
+
+		if err := a.notifier.NotifyInvalInode(id, off, length); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
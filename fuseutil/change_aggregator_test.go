@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestChangeAggregator(t *testing.T) {
+	n := newRecordingNotifier()
+	a := fuseutil.NewChangeAggregator(n, nil, true)
+
+	const dir = 2
+	const file = 3
+	const deleted = 4
+	const unknown = 5
+
+	a.AddLookup(dir)
+	a.AddLookup(file)
+	a.AddLookup(file)
+	a.AddLookup(deleted)
+
+	err := a.Apply([]fuseutil.ChangeEvent{
+		{Kind: fuseutil.ChangeAttributes, Inode: file},
+		{Kind: fuseutil.ChangeData, Inode: file, Offset: 100, Length: 10},
+		{Kind: fuseutil.ChangeData, Inode: file, Offset: 0, Length: 10},
+		{Kind: fuseutil.ChangeData, Inode: deleted, Offset: 0, Length: 10},
+		{Kind: fuseutil.ChangeDeleted, Inode: deleted, Parent: dir, Name: "gone"},
+		{Kind: fuseutil.ChangeCreated, Inode: unknown, Parent: fuseops.RootInodeID, Name: "new"},
+		{Kind: fuseutil.ChangeData, Inode: unknown, Offset: 0, Length: 10},
+		{Kind: fuseutil.ChangeCreated, Inode: 6, Parent: unknown, Name: "x"},
+	})
+
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	want := []string{
+		"entry 1/new",
+		"entry 2/gone",
+		"inode 1 [-1, +0)",
+		"inode 2 [-1, +0)",
+		"inode 3 [0, +110)",
+		"inode 4 [-1, +0)",
+	}
+
+	for _, w := range want {
+		if got := n.next(); got != w {
+			t.Errorf("Notification = %q, want %q", got, w)
+		}
+	}
+
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+
+	// Once forgotten, an inode gets no more notifications.
+	a.Forget(file, 2)
+	if err := a.Apply([]fuseutil.ChangeEvent{{Kind: fuseutil.ChangeData, Inode: file}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+
+	expectPanic(t, "over-forget", func() { a.Forget(dir, 2) })
+}
+
+func TestChangeAggregatorOverForget(t *testing.T) {
+	n := newRecordingNotifier()
+	var logged bytes.Buffer
+	a := fuseutil.NewChangeAggregator(n, log.New(&logged, "", 0), false)
+
+	// A forget for more lookups than were recorded is logged, and leaves the
+	// inode unknown.
+	const file = 3
+	a.AddLookup(file)
+	a.Forget(file, 2)
+	if !strings.Contains(logged.String(), "Forget(3, 2) with lookup count 1") {
+		t.Errorf("Logged: %q", logged.String())
+	}
+
+	if err := a.Apply([]fuseutil.ChangeEvent{{Kind: fuseutil.ChangeData, Inode: file}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+}
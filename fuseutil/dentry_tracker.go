@@ -0,0 +1,431 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+// DentryTracker reconstructs what the kernel most likely has cached of a file
+// system: the directory entries and inodes it has been handed, their lookup
+// counts, and when their entries and attributes expire. This helps when
+// investigating cache consistency bugs, e.g. a file that stays invisible
+// after being created behind the kernel's back, without tracing the kernel.
+//
+// Install it with NewFileSystemServerWithHooks, and send invalidations
+// through the Notifier it returns so that it sees them. The reconstruction is
+// an upper bound: the kernel may also drop entries and inodes on its own, e.g.
+// under memory pressure. Call Dump to see it, e.g. from a debug endpoint:
+//
+//	http.HandleFunc("/debug/fuse/dentries", func(w http.ResponseWriter, r *http.Request) {
+//		tracker.Dump().WriteTo(w)
+//	})
+//
+// It is safe for concurrent use.
+type DentryTracker struct {
+	clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	entries map[dentryKey]*CachedEntry
+
+	// INVARIANT: For each v, v.Lookups > 0
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*CachedInode
+}
+
+type dentryKey struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// CachedEntry is a directory entry the kernel may have cached.
+type CachedEntry struct {
+	Parent fuseops.InodeID
+	Name   string
+
+	// The inode the entry refers to, or zero for a negative entry, i.e. one
+	// recording that the name doesn't exist.
+	Child fuseops.InodeID
+
+	// When the kernel next asks the file system about the entry. Until then it
+	// trusts its cached answer.
+	Expiration time.Time
+}
+
+// CachedInode is an inode the kernel may know about.
+type CachedInode struct {
+	ID fuseops.InodeID
+
+	// The inode's lookup count: the number of times the kernel has been handed
+	// the inode, less those it has forgotten.
+	Lookups uint64
+
+	// When the kernel's cached attributes for the inode expire. Zero if they
+	// have been invalidated.
+	AttributesExpiration time.Time
+}
+
+// KernelCacheDump is a snapshot of a DentryTracker.
+type KernelCacheDump struct {
+	// The time of the snapshot.
+	Time time.Time
+
+	// Sorted by parent, then name.
+	Entries []CachedEntry
+
+	// Sorted by ID.
+	Inodes []CachedInode
+}
+
+var _ Hooks = &DentryTracker{}
+
+// NewDentryTracker creates a DentryTracker for a newly mounted file system,
+// which the kernel knows nothing about but the root.
+func NewDentryTracker(clock timeutil.Clock) *DentryTracker {
+	return &DentryTracker{
+		clock:   clock,
+		entries: make(map[dentryKey]*CachedEntry),
+		inodes:  make(map[fuseops.InodeID]*CachedInode),
+	}
+}
+
+// Notifier returns a Notifier that sends invalidations via n, recording them
+// in the tracker.
+func (t *DentryTracker) Notifier(n Notifier) Notifier {
+	return &trackingNotifier{wrapped: n, tracker: t}
+}
+
+// Dump returns a snapshot of what the kernel most likely has cached.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *DentryTracker) Dump() *KernelCacheDump {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d := &KernelCacheDump{Time: t.clock.Now()}
+	for _, e := range t.entries {
+		d.Entries = append(d.Entries, *e)
+	}
+
+	for _, in := range t.inodes {
+		d.Inodes = append(d.Inodes, *in)
+	}
+
+	sort.Slice(d.Entries, func(i, j int) bool {
+		a, b := d.Entries[i], d.Entries[j]
+		if a.Parent != b.Parent {
+			return a.Parent < b.Parent
+		}
+
+		return a.Name < b.Name
+	})
+
+	sort.Slice(d.Inodes, func(i, j int) bool {
+		return d.Inodes[i].ID < d.Inodes[j].ID
+	})
+
+	return d
+}
+
+// WriteTo writes the snapshot to w in a form meant for people, with
+// expirations relative to the time of the snapshot.
+func (d *KernelCacheDump) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Kernel cache as of %v\n", d.Time.Format(time.RFC3339Nano))
+
+	fmt.Fprintf(&b, "\nEntries (%d):\n", len(d.Entries))
+	for _, e := range d.Entries {
+		child := "negative"
+		if e.Child != 0 {
+			child = fmt.Sprint(e.Child)
+		}
+
+		fmt.Fprintf(
+			&b,
+			"  %d/%q -> %s, %s\n",
+			e.Parent,
+			e.Name,
+			child,
+			describeExpiration(d.Time, e.Expiration))
+	}
+
+	fmt.Fprintf(&b, "\nInodes (%d):\n", len(d.Inodes))
+	for _, in := range d.Inodes {
+		fmt.Fprintf(
+			&b,
+			"  %d: %d lookups, attributes %s\n",
+			in.ID,
+			in.Lookups,
+			describeExpiration(d.Time, in.AttributesExpiration))
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func describeExpiration(now, t time.Time) string {
+	switch {
+	case t.IsZero():
+		return "invalidated"
+	case t.After(now):
+		return fmt.Sprintf("expires in %v", t.Sub(now))
+	default:
+		return fmt.Sprintf("expired %v ago", now.Sub(t))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Hooks methods
+////////////////////////////////////////////////////////////////////////
+
+func (t *DentryTracker) BeforeOp(ctx context.Context, op interface{}) error {
+	return nil
+}
+
+func (t *DentryTracker) AfterOp(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		t.addEntry(typed.Parent, typed.Name, &typed.Entry)
+	case *fuseops.MkDirOp:
+		t.addEntry(typed.Parent, typed.Name, &typed.Entry)
+	case *fuseops.MkNodeOp:
+		t.addEntry(typed.Parent, typed.Name, &typed.Entry)
+	case *fuseops.CreateFileOp:
+		t.addEntry(typed.Parent, typed.Name, &typed.Entry)
+	case *fuseops.CreateTmpfileOp:
+		// An inode without an entry.
+		t.lookUp(typed.Entry.Child).AttributesExpiration = typed.Entry.AttributesExpiration
+	case *fuseops.CreateSymlinkOp:
+		t.addEntry(typed.Parent, typed.Name, &typed.Entry)
+	case *fuseops.CreateLinkOp:
+		t.addEntry(typed.Parent, typed.Name, &typed.Entry)
+
+	case *fuseops.ReadDirPlusOp:
+		t.addDirentsPlus(typed.Inode, typed.Dst[:typed.BytesRead])
+
+	case *fuseops.GetInodeAttributesOp:
+		t.setAttributesExpiration(typed.Inode, typed.AttributesExpiration)
+	case *fuseops.SetInodeAttributesOp:
+		t.setAttributesExpiration(typed.Inode, typed.AttributesExpiration)
+
+	case *fuseops.UnlinkOp:
+		delete(t.entries, dentryKey{typed.Parent, typed.Name})
+	case *fuseops.RmDirOp:
+		delete(t.entries, dentryKey{typed.Parent, typed.Name})
+
+	case *fuseops.RenameOp:
+		// The kernel moves the entry, keeping its expiration.
+		oldKey := dentryKey{typed.OldParent, typed.OldName}
+		newKey := dentryKey{typed.NewParent, typed.NewName}
+		if typed.Flags&fuseops.RenameExchange != 0 {
+			// Or swaps the two entries.
+			oldEntry, oldOK := t.entries[oldKey]
+			newEntry, newOK := t.entries[newKey]
+			delete(t.entries, oldKey)
+			delete(t.entries, newKey)
+			if oldOK {
+				oldEntry.Parent, oldEntry.Name = newKey.parent, newKey.name
+				t.entries[newKey] = oldEntry
+			}
+			if newOK {
+				newEntry.Parent, newEntry.Name = oldKey.parent, oldKey.name
+				t.entries[oldKey] = newEntry
+			}
+			break
+		}
+
+		delete(t.entries, newKey)
+		if e, ok := t.entries[oldKey]; ok {
+			delete(t.entries, oldKey)
+			e.Parent = typed.NewParent
+			e.Name = typed.NewName
+			t.entries[newKey] = e
+		}
+
+	case *fuseops.ForgetInodeOp:
+		t.forget(typed.Inode, typed.N)
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range typed.Entries {
+			t.forget(e.Inode, e.N)
+		}
+	}
+
+	return nil
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *DentryTracker) addEntry(
+	parent fuseops.InodeID,
+	name string,
+	e *fuseops.ChildInodeEntry) {
+	// Negative entries are cached only if they have an expiration, and don't
+	// count as lookups.
+	if e.Child == 0 && e.EntryExpiration.IsZero() {
+		delete(t.entries, dentryKey{parent, name})
+		return
+	}
+
+	t.entries[dentryKey{parent, name}] = &CachedEntry{
+		Parent:     parent,
+		Name:       name,
+		Child:      e.Child,
+		Expiration: e.EntryExpiration,
+	}
+
+	if e.Child != 0 {
+		in := t.lookUp(e.Child)
+		in.AttributesExpiration = e.AttributesExpiration
+	}
+}
+
+// Record the entries in a ReadDirPlusOp response.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *DentryTracker) addDirentsPlus(parent fuseops.InodeID, buf []byte) {
+	now := t.clock.Now()
+	for _, raw := range splitDirentsPlus(buf) {
+		d := parseDirents(raw[entryOutSize:])
+		if len(d) == 0 {
+			break
+		}
+
+		// The kernel skips these, as well as entries without inodes.
+		out := (*fusekernel.EntryOut)(unsafe.Pointer(&raw[0]))
+		if d[0].Name == "." || d[0].Name == ".." || out.Nodeid == 0 {
+			continue
+		}
+
+		t.addEntry(parent, d[0].Name, &fuseops.ChildInodeEntry{
+			Child:                fuseops.InodeID(out.Nodeid),
+			EntryExpiration:      now.Add(validity(out.EntryValid, out.EntryValidNsec)),
+			AttributesExpiration: now.Add(validity(out.AttrValid, out.AttrValidNsec)),
+		})
+	}
+}
+
+func validity(secs uint64, nsecs uint32) time.Duration {
+	return time.Duration(secs)*time.Second + time.Duration(nsecs)
+}
+
+// Count a lookup of the inode, returning its record.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *DentryTracker) lookUp(id fuseops.InodeID) *CachedInode {
+	in := t.inodes[id]
+	if in == nil {
+		in = &CachedInode{ID: id}
+		t.inodes[id] = in
+	}
+
+	in.Lookups++
+	return in
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *DentryTracker) setAttributesExpiration(
+	id fuseops.InodeID,
+	expiration time.Time) {
+	if in := t.inodes[id]; in != nil {
+		in.AttributesExpiration = expiration
+	}
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *DentryTracker) forget(id fuseops.InodeID, n uint64) {
+	in := t.inodes[id]
+	if in == nil {
+		return
+	}
+
+	if in.Lookups > n {
+		in.Lookups -= n
+		return
+	}
+
+	// The kernel no longer has the inode, so neither has it any entries
+	// referring to it or in it.
+	delete(t.inodes, id)
+	for k, e := range t.entries {
+		if e.Child == id || e.Parent == id {
+			delete(t.entries, k)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// trackingNotifier
+////////////////////////////////////////////////////////////////////////
+
+type trackingNotifier struct {
+	wrapped Notifier
+	tracker *DentryTracker
+}
+
+func (n *trackingNotifier) NotifyInvalInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) error {
+	if err := n.wrapped.NotifyInvalInode(inode, off, length); err != nil {
+		return err
+	}
+
+	// The kernel drops the inode's attributes whatever the range.
+	t := n.tracker
+	t.mu.Lock()
+	t.setAttributesExpiration(inode, time.Time{})
+	t.mu.Unlock()
+
+	return nil
+}
+
+func (n *trackingNotifier) NotifyInvalEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	if err := n.wrapped.NotifyInvalEntry(parent, name); err != nil {
+		return err
+	}
+
+	t := n.tracker
+	t.mu.Lock()
+	delete(t.entries, dentryKey{parent, name})
+	t.mu.Unlock()
+
+	return nil
+}
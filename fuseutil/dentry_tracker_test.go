@@ -0,0 +1,141 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestDentryTracker(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+	now := clock.Now()
+
+	tracker := fuseutil.NewDentryTracker(&clock)
+	n := tracker.Notifier(newRecordingNotifier())
+	ctx := context.Background()
+
+	entry := func(child fuseops.InodeID, ttl time.Duration) fuseops.ChildInodeEntry {
+		return fuseops.ChildInodeEntry{
+			Child:                child,
+			EntryExpiration:      now.Add(ttl),
+			AttributesExpiration: now.Add(ttl),
+		}
+	}
+
+	ops := []interface{}{
+		&fuseops.MkDirOp{Parent: 1, Name: "dir", Entry: entry(2, time.Minute)},
+		&fuseops.LookUpInodeOp{Parent: 1, Name: "dir", Entry: entry(2, time.Minute)},
+		&fuseops.CreateFileOp{Parent: 2, Name: "foo", Entry: entry(3, time.Second)},
+		&fuseops.LookUpInodeOp{Parent: 1, Name: "missing", Entry: fuseops.ChildInodeEntry{EntryExpiration: now.Add(time.Hour)}},
+		&fuseops.RenameOp{OldParent: 2, OldName: "foo", NewParent: 1, NewName: "bar"},
+		&fuseops.CreateFileOp{Parent: 2, Name: "gone", Entry: entry(4, time.Second)},
+		&fuseops.UnlinkOp{Parent: 2, Name: "gone"},
+		&fuseops.ForgetInodeOp{Inode: 4, N: 1},
+		&fuseops.ForgetInodeOp{Inode: 2, N: 1},
+	}
+
+	for _, op := range ops {
+		tracker.AfterOp(ctx, op, nil)
+	}
+
+	// Failed ops change nothing.
+	tracker.AfterOp(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "bar"}, syscall.EPERM)
+
+	clock.AdvanceTime(2 * time.Second)
+	if err := n.NotifyInvalInode(3, -1, 0); err != nil {
+		t.Fatalf("NotifyInvalInode: %v", err)
+	}
+
+	var buf bytes.Buffer
+	tracker.Dump().WriteTo(&buf)
+
+	want := `Kernel cache as of 2015-04-05T02:15:02Z
+
+Entries (3):
+  1/"bar" -> 3, expired 1s ago
+  1/"dir" -> 2, expires in 58s
+  1/"missing" -> negative, expires in 59m58s
+
+Inodes (2):
+  2: 1 lookups, attributes expires in 58s
+  3: 1 lookups, attributes invalidated
+`
+
+	if got := buf.String(); got != want {
+		t.Errorf("Dump:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Forgetting an inode drops the entries in and for it, and invalidating an
+	// entry drops it.
+	tracker.AfterOp(ctx, &fuseops.BatchForgetOp{Entries: []fuseops.BatchForgetEntry{{Inode: 2, N: 1}}}, nil)
+	if err := n.NotifyInvalEntry(1, "missing"); err != nil {
+		t.Fatalf("NotifyInvalEntry: %v", err)
+	}
+
+	d := tracker.Dump()
+	if len(d.Entries) != 1 || d.Entries[0].Name != "bar" || len(d.Inodes) != 1 {
+		t.Errorf("Dump after forgetting: %+v", d)
+	}
+}
+
+func TestDentryTrackerReadDirPlus(t *testing.T) {
+	tracker := fuseutil.NewDentryTracker(timeutil.RealClock())
+
+	buf := make([]byte, 1024)
+	var n int
+	for _, d := range []fuseutil.DirentPlus{
+		{
+			Dirent: fuseutil.Dirent{Offset: 1, Inode: 1, Name: ".."},
+			Entry:  fuseops.ChildInodeEntry{Child: 1},
+		},
+		{
+			Dirent: fuseutil.Dirent{Offset: 2, Inode: 5, Name: "foo"},
+			Entry: fuseops.ChildInodeEntry{
+				Child:           5,
+				EntryExpiration: time.Now().Add(time.Minute),
+			},
+		},
+		{
+			Dirent: fuseutil.Dirent{Offset: 3, Inode: 6, Name: "bar"},
+		},
+	} {
+		n += fuseutil.WriteDirentPlus(buf[n:], d)
+	}
+
+	op := &fuseops.ReadDirPlusOp{Inode: 2, Dst: buf, BytesRead: n}
+	tracker.AfterOp(context.Background(), op, nil)
+
+	d := tracker.Dump()
+	if len(d.Entries) != 1 || d.Entries[0].Name != "foo" || d.Entries[0].Child != 5 {
+		t.Fatalf("Entries: %+v", d.Entries)
+	}
+
+	if ttl := d.Entries[0].Expiration.Sub(d.Time); ttl < 50*time.Second || ttl > time.Minute {
+		t.Errorf("Entry TTL = %v", ttl)
+	}
+
+	if len(d.Inodes) != 1 || d.Inodes[0].ID != 5 || d.Inodes[0].Lookups != 1 {
+		t.Errorf("Inodes: %+v", d.Inodes)
+	}
+}
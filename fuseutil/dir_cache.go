@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// DirCache caches rendered directory listings, for file systems whose
+// listings are expensive to produce (e.g. they require a round trip to a
+// remote store) but change rarely. Each listing is rendered once, with
+// WriteDirent, and later ReadDirOps are served by copying from the rendered
+// buffer.
+//
+// When a directory changes, call Invalidate. This discards the cached
+// listing and, if the DirCache was given a Notifier, also asks the kernel to
+// drop its own cached copy of the directory's contents (see
+// fuseops.OpenDirOp.CacheDir), so that the next readdir(3) sees the change
+// end to end.
+//
+// Directory offsets are indices into the listing. A listing that is in
+// progress when the directory is invalidated continues at the same index in
+// the new listing, so entries added or removed concurrently may or may not be
+// seen, as POSIX permits.
+//
+// It is safe for concurrent use.
+type DirCache struct {
+	notifier Notifier // May be nil
+
+	mu sync.Mutex
+
+	dirs map[fuseops.InodeID]*renderedDir // GUARDED_BY(mu)
+
+	// Incremented for each directory each time it is invalidated.
+	versions map[fuseops.InodeID]uint64 // GUARDED_BY(mu)
+}
+
+type renderedDir struct {
+	// The dirents, back to back, and the position in buf of the start of each
+	// one. starts has a final element equal to len(buf).
+	buf    []byte
+	starts []int
+}
+
+// NewDirCache creates an empty cache. n may be nil, in which case the kernel
+// is not notified on invalidation.
+func NewDirCache(n Notifier) *DirCache {
+	return &DirCache{
+		notifier: n,
+		dirs:     make(map[fuseops.InodeID]*renderedDir),
+		versions: make(map[fuseops.InodeID]uint64),
+	}
+}
+
+// ReadDir serves the op from the cached listing of op.Inode, first calling
+// list to produce the listing if it isn't cached. The Offset fields of the
+// entries returned by list are ignored and replaced with indices.
+//
+// list is called without any locks held; if the directory is invalidated
+// while it runs, its result is used for this op but not cached.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *DirCache) ReadDir(
+	op *fuseops.ReadDirOp,
+	list func() ([]Dirent, error)) error {
+	c.mu.Lock()
+	d := c.dirs[op.Inode]
+	version := c.versions[op.Inode]
+	c.mu.Unlock()
+
+	if d == nil {
+		entries, err := list()
+		if err != nil {
+			return err
+		}
+
+		d = renderDir(entries)
+
+		c.mu.Lock()
+		if c.versions[op.Inode] == version {
+			c.dirs[op.Inode] = d
+		}
+		c.mu.Unlock()
+	}
+
+	// Copy as many whole entries as fit.
+	i := int(op.Offset)
+	if i >= len(d.starts)-1 {
+		return nil
+	}
+
+	j := i
+	for j < len(d.starts)-1 && d.starts[j+1]-d.starts[i] <= len(op.Dst) {
+		j++
+	}
+
+	op.BytesRead = copy(op.Dst, d.buf[d.starts[i]:d.starts[j]])
+	return nil
+}
+
+func renderDir(entries []Dirent) *renderedDir {
+	d := &renderedDir{
+		starts: make([]int, 0, len(entries)+1),
+	}
+
+	for i, e := range entries {
+		e.Offset = fuseops.DirOffset(i + 1)
+
+		// Grow the buffer to fit the entry, with room for padding.
+		need := len(d.buf) + direntSize + len(e.Name) + direntAlignment
+		if cap(d.buf) < need {
+			buf := make([]byte, len(d.buf), 2*need)
+			copy(buf, d.buf)
+			d.buf = buf
+		}
+
+		d.starts = append(d.starts, len(d.buf))
+		n := WriteDirent(d.buf[len(d.buf):cap(d.buf)], e)
+		d.buf = d.buf[:len(d.buf)+n]
+	}
+
+	d.starts = append(d.starts, len(d.buf))
+	return d
+}
+
+// Invalidate discards the cached listing for the directory and, if
+// configured, notifies the kernel. Don't call it from within an op on the
+// same directory, since the kernel may be holding locks that the notification
+// needs.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *DirCache) Invalidate(dir fuseops.InodeID) error {
+	c.mu.Lock()
+	delete(c.dirs, dir)
+	c.versions[dir]++
+	c.mu.Unlock()
+
+	if c.notifier == nil {
+		return nil
+	}
+
+	// Invalidating the directory's data drops the kernel's cached readdir
+	// pages along with its attributes.
+	return c.notifier.NotifyInvalInode(dir, 0, 0)
+}
+
+// Version returns the number of times the directory has been invalidated.
+// File systems may use it to detect changes between two points in time.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *DirCache) Version(dir fuseops.InodeID) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.versions[dir]
+}
+
+// ForgetInode discards all state for the directory. Call it when the inode's
+// lookup count reaches zero.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *DirCache) ForgetInode(dir fuseops.InodeID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.dirs, dir)
+	delete(c.versions, dir)
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestDirCache(t *testing.T) {
+	n := newRecordingNotifier()
+	c := fuseutil.NewDirCache(n)
+
+	const dir = 2
+	calls := 0
+	names := []string{"a", "bb", "ccc", "dddd"}
+	list := func() ([]fuseutil.Dirent, error) {
+		calls++
+		var entries []fuseutil.Dirent
+		for i, name := range names {
+			entries = append(entries, fuseutil.Dirent{
+				Inode: fuseops.InodeID(10 + i),
+				Name:  fmt.Sprintf("%s%d", name, i),
+				Type:  fuseutil.DT_File,
+			})
+		}
+
+		return entries, nil
+	}
+
+	// Read the listing a couple of entries at a time, as a kernel with a small
+	// buffer would.
+	var got []string
+	offset := 0
+	for {
+		op := fusetesting.NewReadDirOp(dir, 0, 0)
+		op.Offset = fuseops.DirOffset(offset)
+		op.Dst = op.Dst[:64]
+		if err := c.ReadDir(op, list); err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+
+		if op.BytesRead == 0 {
+			break
+		}
+
+		entries, err := parseDirents(op.Dst[:op.BytesRead])
+		if err != nil {
+			t.Fatalf("parseDirents: %v", err)
+		}
+
+		for _, e := range entries {
+			got = append(got, e.Name)
+			offset = int(e.Offset)
+		}
+	}
+
+	if fmt.Sprint(got) != "[a0 bb1 ccc2 dddd3]" || calls != 1 {
+		t.Errorf("Listing = %v after %d calls", got, calls)
+	}
+
+	// Invalidation re-lists and tells the kernel.
+	names = names[:1]
+	if err := c.Invalidate(dir); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+
+	if got, want := n.next(), "inode 2 [0, +0)"; got != want {
+		t.Errorf("Notification = %q, want %q", got, want)
+	}
+
+	op := fusetesting.NewReadDirOp(dir, 0, 0)
+	if err := c.ReadDir(op, list); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	entries, _ := parseDirents(op.Dst[:op.BytesRead])
+	if len(entries) != 1 || calls != 2 || c.Version(dir) != 1 {
+		t.Errorf("After invalidation: %+v, %d calls, version %d", entries, calls, c.Version(dir))
+	}
+}
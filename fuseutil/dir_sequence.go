@@ -0,0 +1,202 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// DirSequence holds the entries of a directory that may change while it is
+// being listed, in the order they were added, numbering each addition. The
+// numbers serve as directory offsets, so unlike array indices they don't
+// shift when entries are removed, and a listing through a DirCursor taken at
+// opendir time has defined semantics:
+//
+//   - Each entry present throughout the listing is returned exactly once.
+//
+//   - Entries removed during the listing may or may not be returned.
+//
+//   - Entries added after the cursor was taken, including under a new name
+//     by a rename, are omitted.
+//
+// In particular, listing a directory that is being written to concurrently
+// always comes to an end, which with array offsets it need not: `rm -rf`
+// keeps listing a directory until it finds it empty, and a listing that keeps
+// picking up new entries, or skips old ones as removals shift the rest, may
+// never get there. fusetesting.CheckListingDuringChanges checks for these
+// semantics.
+//
+// Keep a DirSequence for each directory, calling Add and Remove as entries
+// come and go. Take a cursor with Cursor in OpenDirOp, and again for a
+// ReadDirOp with a zero offset if rewinddir should see a fresh listing, and
+// serve ReadDirOp with ReadDir or ReadDirPlusOp with Entries.
+//
+// It is safe for concurrent use.
+type DirSequence struct {
+	mu sync.Mutex
+
+	// The number given to the last entry added.
+	last uint64 // GUARDED_BY(mu)
+
+	// The entries added, in order, with those that have since been removed
+	// until there are enough to be worth compacting.
+	//
+	// INVARIANT: entries is sorted by seq
+	// INVARIANT: For each e in entries with !e.removed, index[e.d.Name] is its
+	// position
+	entries []sequencedDirent // GUARDED_BY(mu)
+	index   map[string]int    // GUARDED_BY(mu)
+	removed int               // GUARDED_BY(mu)
+}
+
+type sequencedDirent struct {
+	d       Dirent
+	seq     uint64
+	removed bool
+}
+
+// A DirCursor marks the end of a directory listing: entries added to the
+// DirSequence after it was taken are not listed.
+type DirCursor uint64
+
+// NewDirSequence creates an empty sequence.
+func NewDirSequence() *DirSequence {
+	return &DirSequence{
+		index: make(map[string]int),
+	}
+}
+
+// Add appends an entry, replacing any entry with the same name. The Offset
+// field is ignored.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirSequence) Add(d Dirent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeLocked(d.Name)
+
+	s.last++
+	s.index[d.Name] = len(s.entries)
+	s.entries = append(s.entries, sequencedDirent{d: d, seq: s.last})
+}
+
+// Remove removes the entry with the given name, returning false if there is
+// none.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirSequence) Remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.removeLocked(name)
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *DirSequence) removeLocked(name string) bool {
+	i, ok := s.index[name]
+	if !ok {
+		return false
+	}
+
+	delete(s.index, name)
+	s.entries[i].removed = true
+	s.removed++
+
+	// Compact once most entries are gone. Removed entries would be skipped
+	// anyway, so listings in progress are unaffected.
+	if s.removed > len(s.entries)/2 {
+		live := s.entries[:0]
+		for _, e := range s.entries {
+			if !e.removed {
+				s.index[e.d.Name] = len(live)
+				live = append(live, e)
+			}
+		}
+
+		s.entries = live
+		s.removed = 0
+	}
+
+	return true
+}
+
+// Cursor returns a cursor marking the end of a listing of the current
+// entries.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirSequence) Cursor() DirCursor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return DirCursor(s.last)
+}
+
+// Entries returns the entries following the given offset, up to the cursor,
+// with their offsets filled in.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirSequence) Entries(c DirCursor, after fuseops.DirOffset) []Dirent {
+	var entries []Dirent
+	s.each(c, after, func(d Dirent) bool {
+		entries = append(entries, d)
+		return true
+	})
+
+	return entries
+}
+
+// ReadDir serves the op from the entries up to the cursor.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirSequence) ReadDir(op *fuseops.ReadDirOp, c DirCursor) {
+	op.BytesRead = 0
+	s.each(c, op.Offset, func(d Dirent) bool {
+		n := WriteDirent(op.Dst[op.BytesRead:], d)
+		op.BytesRead += n
+		return n != 0
+	})
+}
+
+// Call f for each entry following the given offset, up to the cursor, until
+// it returns false.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *DirSequence) each(
+	c DirCursor,
+	after fuseops.DirOffset,
+	f func(d Dirent) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].seq > uint64(after)
+	})
+
+	for ; i < len(s.entries) && s.entries[i].seq <= uint64(c); i++ {
+		e := s.entries[i]
+		if e.removed {
+			continue
+		}
+
+		e.d.Offset = fuseops.DirOffset(e.seq)
+		if !f(e.d) {
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestDirSequence(t *testing.T) {
+	s := fuseutil.NewDirSequence()
+	for i := 0; i < 10; i++ {
+		s.Add(fuseutil.Dirent{Name: fmt.Sprint(i), Inode: fuseops.InodeID(i + 2)})
+	}
+
+	// List the directory a few entries at a time, removing each entry listed
+	// and adding a new one, as `rm -rf` might while something else writes.
+	c := s.Cursor()
+	var listed []string
+	var offset fuseops.DirOffset
+	for {
+		entries := s.Entries(c, offset)
+		if len(entries) == 0 {
+			break
+		}
+
+		d := entries[0]
+		listed = append(listed, d.Name)
+		offset = d.Offset
+
+		s.Remove(d.Name)
+		s.Add(fuseutil.Dirent{Name: "new" + d.Name})
+	}
+
+	if fmt.Sprint(listed) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Errorf("Listed: %v", listed)
+	}
+
+	// A new cursor sees the new entries, including after compaction.
+	s.Remove("new0")
+	if got := s.Entries(s.Cursor(), 0); len(got) != 9 || got[0].Name != "new1" {
+		t.Errorf("Entries: %v", got)
+	}
+
+	// Renaming over an entry moves it to the end.
+	s.Add(fuseutil.Dirent{Name: "new1"})
+	got := s.Entries(s.Cursor(), 0)
+	if len(got) != 9 || got[8].Name != "new1" || got[8].Offset <= got[7].Offset {
+		t.Errorf("Entries: %v", got)
+	}
+
+	// ReadDir renders entries until the buffer is full.
+	op := &fuseops.ReadDirOp{Dst: make([]byte, 64)}
+	s.ReadDir(op, s.Cursor())
+	if op.BytesRead == 0 || op.BytesRead > 64 {
+		t.Errorf("BytesRead: %d", op.BytesRead)
+	}
+
+	if s.Remove("missing") {
+		t.Errorf("Remove of a missing entry succeeded")
+	}
+}
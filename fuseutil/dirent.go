@@ -15,23 +15,36 @@
 package fuseutil
 
 import (
+	"context"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
 type DirentType uint32
 
+// The values of DT_* from <dirent.h>, which are the same on every platform
+// that has them and are what the kernel expects.
 const (
 	DT_Unknown   DirentType = 0
-	DT_Socket    DirentType = syscall.DT_SOCK
-	DT_Link      DirentType = syscall.DT_LNK
-	DT_File      DirentType = syscall.DT_REG
-	DT_Block     DirentType = syscall.DT_BLK
-	DT_Directory DirentType = syscall.DT_DIR
-	DT_Char      DirentType = syscall.DT_CHR
-	DT_FIFO      DirentType = syscall.DT_FIFO
+	DT_Socket    DirentType = 12
+	DT_Link      DirentType = 10
+	DT_File      DirentType = 8
+	DT_Block     DirentType = 6
+	DT_Directory DirentType = 4
+	DT_Char      DirentType = 2
+	DT_FIFO      DirentType = 1
+)
+
+// The size of the fixed part of a fuse_dirent, and the alignment required of
+// each entry.
+const (
+	direntSize      = 8 + 8 + 4 + 4
+	direntAlignment = 8
 )
 
 // A struct representing an entry within a directory file, describing a child.
@@ -66,9 +79,6 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 		name    [0]byte
 	}
 
-	const direntAlignment = 8
-	const direntSize = 8 + 8 + 4 + 4
-
 	// Compute the number of bytes of padding we'll need to maintain alignment
 	// for the next entry.
 	var padLen int
@@ -103,3 +113,211 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 
 	return n
 }
+
+// A struct representing an entry within a directory file along with the
+// inode it refers to. See notes on fuseops.ReadDirPlusOp and on
+// WriteDirentPlus for details.
+type DirentPlus struct {
+	Dirent
+
+	// The entry for the child, as would be returned by LookUpInode. If Child is
+	// zero, the kernel uses only the Dirent, as for ReadDir.
+	Entry fuseops.ChildInodeEntry
+}
+
+// The size of a fuse_entry_out, which precedes the fuse_dirent in each entry
+// written by WriteDirentPlus.
+const entryOutSize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+
+// Write the supplied directory entry into the given buffer in the format
+// expected in fuseops.ReadDirPlusOp.Dst, returning the number of bytes
+// written. Return zero if the entry would not fit.
+func WriteDirentPlus(buf []byte, d DirentPlus) (n int) {
+	// We want to write bytes with the layout of fuse_direntplus from
+	// fuse_kernel.h: a fuse_entry_out followed by a fuse_dirent.
+	var out fusekernel.EntryOut
+	convertChildInodeEntry(&d.Entry, &out)
+
+	return writeDirentPlus(
+		buf,
+		(*[unsafe.Sizeof(out)]byte)(unsafe.Pointer(&out))[:],
+		d.Dirent)
+}
+
+// Write an entry from a fuse_entry_out in wire format and a dirent.
+func writeDirentPlus(buf []byte, entryOut []byte, d Dirent) (n int) {
+	if len(buf) < entryOutSize {
+		return 0
+	}
+
+	n = WriteDirent(buf[entryOutSize:], d)
+	if n == 0 {
+		return 0
+	}
+
+	copy(buf, entryOut)
+	return entryOutSize + n
+}
+
+// The same as the conversion used for LookUpInodeOp in package fuse.
+func convertChildInodeEntry(
+	in *fuseops.ChildInodeEntry,
+	out *fusekernel.EntryOut) {
+	if in.Child == 0 {
+		return
+	}
+
+	expiration := func(t time.Time) (secs uint64, nsecs uint32) {
+		if d := time.Until(t); d > 0 {
+			secs = uint64(d / time.Second)
+			nsecs = uint32(d % time.Second)
+		}
+
+		return secs, nsecs
+	}
+
+	timestamp := func(t time.Time) (secs uint64, nsecs uint32) {
+		totalNano := t.UnixNano()
+		return uint64(totalNano / 1e9), uint32(totalNano % 1e9)
+	}
+
+	attrs := &in.Attributes
+	out.Nodeid = uint64(in.Child)
+	out.Generation = uint64(in.Generation)
+	out.EntryValid, out.EntryValidNsec = expiration(in.EntryExpiration)
+	out.AttrValid, out.AttrValidNsec = expiration(in.AttributesExpiration)
+
+	out.Attr.Ino = uint64(in.Child)
+	out.Attr.Size = attrs.Size
+	out.Attr.Blocks = (attrs.Size + 512 - 1) / 512
+	out.Attr.Atime, out.Attr.AtimeNsec = timestamp(attrs.Atime)
+	out.Attr.Mtime, out.Attr.MtimeNsec = timestamp(attrs.Mtime)
+	out.Attr.Ctime, out.Attr.CtimeNsec = timestamp(attrs.Ctime)
+	out.Attr.SetCrtime(timestamp(attrs.Crtime))
+	out.Attr.Nlink = attrs.Nlink
+	out.Attr.Uid = attrs.Uid
+	out.Attr.Gid = attrs.Gid
+	out.Attr.SetDAX(attrs.DAX)
+	out.Attr.Mode = fuse.ConvertGoMode(attrs.Mode)
+
+	if out.Attr.Mode&(syscall.S_IFCHR|syscall.S_IFBLK) != 0 {
+		out.Attr.Rdev = attrs.Rdev
+	}
+}
+
+// Split a buffer written by WriteDirentPlus into entries, each a
+// fuse_entry_out followed by a fuse_dirent, ignoring any trailing partial
+// entry.
+func splitDirentsPlus(buf []byte) (entries [][]byte) {
+	for len(buf) >= entryOutSize+direntSize {
+		namelen := int(*(*uint32)(unsafe.Pointer(&buf[entryOutSize+16])))
+		n := entryOutSize + direntSize + namelen
+		if n > len(buf) {
+			break
+		}
+
+		if n%direntAlignment != 0 {
+			n += direntAlignment - n%direntAlignment
+		}
+
+		if n > len(buf) {
+			n = len(buf)
+		}
+
+		entries = append(entries, buf[:n])
+		buf = buf[n:]
+	}
+
+	return entries
+}
+
+// Parse the entries in a buffer written by WriteDirentPlus, returning their
+// dirents and the inodes they refer to.
+func parseDirentsPlus(buf []byte) (entries []DirentPlus) {
+	for _, e := range splitDirentsPlus(buf) {
+		d := parseDirents(e[entryOutSize:])
+		if len(d) == 0 {
+			break
+		}
+
+		out := (*fusekernel.EntryOut)(unsafe.Pointer(&e[0]))
+		entries = append(entries, DirentPlus{
+			Dirent: d[0],
+			Entry: fuseops.ChildInodeEntry{
+				Child:      fuseops.InodeID(out.Nodeid),
+				Generation: fuseops.GenerationNumber(out.Generation),
+			},
+		})
+	}
+
+	return entries
+}
+
+// Parse the dirents in a buffer written by WriteDirent, ignoring any trailing
+// partial entry.
+func parseDirents(buf []byte) (entries []Dirent) {
+	for len(buf) >= direntSize {
+		namelen := int(*(*uint32)(unsafe.Pointer(&buf[16])))
+		if direntSize+namelen > len(buf) {
+			break
+		}
+
+		entries = append(entries, Dirent{
+			Inode:  fuseops.InodeID(*(*uint64)(unsafe.Pointer(&buf[0]))),
+			Offset: fuseops.DirOffset(*(*uint64)(unsafe.Pointer(&buf[8]))),
+			Type:   DirentType(*(*uint32)(unsafe.Pointer(&buf[20]))),
+			Name:   string(buf[direntSize : direntSize+namelen]),
+		})
+
+		n := direntSize + namelen
+		if n%direntAlignment != 0 {
+			n += direntAlignment - n%direntAlignment
+		}
+
+		if n > len(buf) {
+			break
+		}
+
+		buf = buf[n:]
+	}
+
+	return entries
+}
+
+// List the whole of a directory by opening and reading it through the file
+// system, as the kernel would.
+func listDir(
+	ctx context.Context,
+	fs FileSystem,
+	dir fuseops.InodeID) ([]Dirent, error) {
+	openOp := fuseops.OpenDirOp{Inode: dir}
+	if err := fs.OpenDir(ctx, &openOp); err != nil && err != fuse.ENOSYS {
+		return nil, err
+	}
+
+	defer fs.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+
+	var entries []Dirent
+	buf := make([]byte, 64<<10)
+	var offset fuseops.DirOffset
+	for {
+		readOp := fuseops.ReadDirOp{
+			Inode:  dir,
+			Handle: openOp.Handle,
+			Offset: offset,
+			Dst:    buf,
+		}
+
+		if err := fs.ReadDir(ctx, &readOp); err != nil {
+			return nil, err
+		}
+
+		page := parseDirents(buf[:readOp.BytesRead])
+		if len(page) == 0 {
+			return entries, nil
+		}
+
+		entries = append(entries, page...)
+		offset = page[len(page)-1].Offset
+	}
+}
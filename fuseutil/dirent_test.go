@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestWriteDirentPlus(t *testing.T) {
+	buf := make([]byte, 4096)
+	entry := func(name string, child fuseops.InodeID) DirentPlus {
+		return DirentPlus{
+			Dirent: Dirent{Offset: 1, Inode: child, Name: name, Type: DT_File},
+			Entry: fuseops.ChildInodeEntry{
+				Child:                child,
+				Attributes:           fuseops.InodeAttributes{Size: 1000, Nlink: 1, Mode: 0644},
+				AttributesExpiration: time.Now().Add(time.Hour),
+			},
+		}
+	}
+
+	var n int
+	for _, d := range []DirentPlus{
+		entry(".", 1),
+		entry("foo", 2),
+		{Dirent: Dirent{Offset: 3, Inode: 3, Name: "bar", Type: DT_Directory}},
+	} {
+		m := WriteDirentPlus(buf[n:], d)
+		if m%direntAlignment != 0 {
+			t.Errorf("Entry %q: %d bytes, not aligned", d.Name, m)
+		}
+
+		n += m
+	}
+
+	if got, want := n, 3*(entryOutSize+direntSize+8); got != want {
+		t.Fatalf("Wrote %d bytes, want %d", got, want)
+	}
+
+	out := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[entryOutSize+direntSize+8]))
+	if out.Nodeid != 2 || out.Attr.Ino != 2 || out.Attr.Size != 1000 || out.Attr.Blocks != 2 ||
+		out.Attr.Mode != 0100644 || out.AttrValid == 0 || out.EntryValid != 0 {
+		t.Errorf("Entry: %+v", out)
+	}
+
+	entries := parseDirentsPlus(buf[:n])
+	if len(entries) != 3 || entries[1].Name != "foo" || entries[1].Entry.Child != 2 ||
+		entries[2].Name != "bar" || entries[2].Entry.Child != 0 {
+		t.Errorf("Parsed: %+v", entries)
+	}
+
+	// Entries that don't fit aren't written.
+	if m := WriteDirentPlus(buf[:entryOutSize+direntSize], entry("foo", 2)); m != 0 {
+		t.Errorf("Wrote %d bytes into too small a buffer", m)
+	}
+
+	// The kernel counts a lookup for each entry naming an inode, except ".".
+	cs := &connectionState{lookups: make(map[fuseops.InodeID]uint64)}
+	cs.track(&fuseops.ReadDirPlusOp{Dst: buf, BytesRead: n}, nil)
+	if len(cs.lookups) != 1 || cs.lookups[2] != 1 {
+		t.Errorf("Lookups: %v", cs.lookups)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// EmbedFS serves the contents of an embed.FS, or any other fs.FS whose
+// contents never change, as a read-only file system. Create one with
+// NewEmbedFS and serve it with NewFileSystemServer.
+//
+// Because the contents are immutable, everything is computed once up front:
+// the inode table, the attributes, the directory listings, and the file
+// contents themselves. Reads then slice directly into those contents, with no
+// copying at all when the file system is mounted with
+// MountConfig.UseVectoredRead. The kernel is allowed to cache attributes,
+// entries, and file pages indefinitely.
+//
+// Typical use:
+//
+//	//go:embed assets
+//	var assets embed.FS
+//
+//	fs, err := fuseutil.NewEmbedFS(assets)
+//	...
+//	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+//		ReadOnly:        true,
+//		UseVectoredRead: true,
+//	})
+type EmbedFS struct {
+	NotImplementedFileSystem
+
+	// Indexed by inode ID. Entries below RootInodeID are unused.
+	//
+	// Constant after construction.
+	inodes []embedInode
+}
+
+type embedInode struct {
+	attrs    fuseops.InodeAttributes
+	contents []byte   // Files only
+	children []Dirent // Directories only
+}
+
+// How long the kernel may cache anything we tell it. Nothing ever changes, so
+// this is simply "a long time".
+const embedCacheTTL = 365 * 24 * time.Hour
+
+// NewEmbedFS walks fsys, reading every file into memory, and returns a file
+// system serving it. Only regular files and directories are supported.
+// Everything is owned by the current user, with the permission bits reported
+// by fsys (0444 and 0555 for embed.FS).
+func NewEmbedFS(fsys fs.FS) (*EmbedFS, error) {
+	efs := &EmbedFS{
+		inodes: make([]embedInode, fuseops.RootInodeID),
+	}
+
+	uid := uint32(os.Getuid())
+	gid := uint32(os.Getgid())
+
+	// fs.WalkDir visits a directory before its children, so parents always
+	// have inode IDs by the time their children are added.
+	ids := make(map[string]fuseops.InodeID)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		in := embedInode{
+			attrs: fuseops.InodeAttributes{
+				Nlink: 1,
+				Mode:  info.Mode(),
+				Atime: info.ModTime(),
+				Mtime: info.ModTime(),
+				Ctime: info.ModTime(),
+				Uid:   uid,
+				Gid:   gid,
+			},
+		}
+
+		var direntType DirentType
+		switch {
+		case info.Mode().IsDir():
+			direntType = DT_Directory
+
+		case info.Mode().IsRegular():
+			direntType = DT_File
+			if in.contents, err = fs.ReadFile(fsys, p); err != nil {
+				return err
+			}
+
+			in.attrs.Size = uint64(len(in.contents))
+
+		default:
+			return fmt.Errorf("%s: unsupported file type %v", p, info.Mode().Type())
+		}
+
+		id := fuseops.InodeID(len(efs.inodes))
+		efs.inodes = append(efs.inodes, in)
+		ids[p] = id
+
+		if p == "." {
+			return nil
+		}
+
+		parent := &efs.inodes[ids[path.Dir(p)]]
+		parent.children = append(parent.children, Dirent{
+			Offset: fuseops.DirOffset(len(parent.children) + 1),
+			Inode:  id,
+			Name:   d.Name(),
+			Type:   direntType,
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return efs, nil
+}
+
+func (efs *EmbedFS) inode(id fuseops.InodeID) (*embedInode, error) {
+	if id < fuseops.RootInodeID || uint64(id) >= uint64(len(efs.inodes)) {
+		return nil, fuse.ENOENT
+	}
+
+	return &efs.inodes[id], nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (efs *EmbedFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (efs *EmbedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := efs.inode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	// fs.ReadDir returns entries sorted by name, so we could binary search
+	// here. Directories in embedded assets are small enough not to bother.
+	for _, d := range parent.children {
+		if d.Name == op.Name {
+			op.Entry.Child = d.Inode
+			op.Entry.Attributes = efs.inodes[d.Inode].attrs
+			op.Entry.AttributesExpiration = time.Now().Add(embedCacheTTL)
+			op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+			return nil
+		}
+	}
+
+	return fuse.ENOENT
+}
+
+func (efs *EmbedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	in, err := efs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes = in.attrs
+	op.AttributesExpiration = time.Now().Add(embedCacheTTL)
+	return nil
+}
+
+func (efs *EmbedFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (efs *EmbedFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return nil
+}
+
+func (efs *EmbedFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	in, err := efs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if !in.attrs.Mode.IsDir() {
+		return fuse.ENOTDIR
+	}
+
+	op.CacheDir = true
+	op.KeepCache = true
+	return nil
+}
+
+func (efs *EmbedFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	in, err := efs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Offset > fuseops.DirOffset(len(in.children)) {
+		return nil
+	}
+
+	for _, d := range in.children[op.Offset:] {
+		n := WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (efs *EmbedFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (efs *EmbedFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	in, err := efs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if in.attrs.Mode.IsDir() {
+		return syscall.EISDIR
+	}
+
+	if !op.OpenFlags.IsReadOnly() {
+		return syscall.EROFS
+	}
+
+	op.KeepPageCache = true
+	return nil
+}
+
+func (efs *EmbedFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	in, err := efs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Offset >= int64(len(in.contents)) {
+		return nil
+	}
+
+	b := in.contents[op.Offset:]
+	if op.Dst != nil {
+		op.BytesRead = copy(op.Dst, b)
+		return nil
+	}
+
+	if int64(len(b)) > op.Size {
+		b = b[:op.Size]
+	}
+
+	op.Data = [][]byte{b}
+	op.BytesRead = len(b)
+	return nil
+}
+
+func (efs *EmbedFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (efs *EmbedFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func (efs *EmbedFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fuse.ENOATTR
+}
+
+func (efs *EmbedFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestEmbedFS(t *testing.T) {
+	fs, err := fuseutil.NewEmbedFS(fstest.MapFS{
+		"index.html":     {Data: []byte("<html>"), Mode: 0444},
+		"css/site.css":   {Data: []byte("body {}"), Mode: 0444},
+		"css/print.css":  {Data: []byte("@media print {}"), Mode: 0444},
+		"img/.gitignore": {Mode: 0444},
+	})
+
+	if err != nil {
+		t.Fatalf("NewEmbedFS: %v", err)
+	}
+
+	ctx := context.Background()
+
+	// The root lists its children in name order.
+	op := fusetesting.NewReadDirOp(fuseops.RootInodeID, 0, 0)
+	if err := fs.ReadDir(ctx, op); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	entries, err := parseDirents(op.Dst[:op.BytesRead])
+	if err != nil {
+		t.Fatalf("parseDirents: %v", err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+
+	if len(names) != 3 || names[0] != "css" || names[1] != "img" || names[2] != "index.html" {
+		t.Errorf("Root listing = %v", names)
+	}
+
+	css := lookUp(t, fs, fuseops.RootInodeID, "css")
+	printCSS := lookUp(t, fs, css, "print.css")
+
+	attrs := fusetesting.NewGetInodeAttributesOp(printCSS)
+	if err := fs.GetInodeAttributes(ctx, attrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if attrs.Attributes.Size != uint64(len("@media print {}")) || attrs.Attributes.Mode != 0444 {
+		t.Errorf("Attributes = %s", attrs.Attributes.DebugString())
+	}
+
+	if attrs.AttributesExpiration.IsZero() {
+		t.Error("Attributes are not cacheable")
+	}
+
+	// Plain reads copy into Dst.
+	read := fusetesting.NewReadFileOp(printCSS, 0, 7, 100)
+	if err := fs.ReadFile(ctx, read); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got := string(read.Dst[:read.BytesRead]); got != "print {}" {
+		t.Errorf("ReadFile = %q", got)
+	}
+
+	// Vectored reads hand back a slice of the contents, truncated to Size.
+	read = fusetesting.NewVectoredReadFileOp(printCSS, 0, 1, 5)
+	if err := fs.ReadFile(ctx, read); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if len(read.Data) != 1 || string(read.Data[0]) != "media" || read.BytesRead != 5 {
+		t.Errorf("Vectored ReadFile = %q, %d bytes", read.Data, read.BytesRead)
+	}
+
+	// Reading past the end gives nothing.
+	read = fusetesting.NewVectoredReadFileOp(printCSS, 0, 100, 5)
+	if err := fs.ReadFile(ctx, read); err != nil || read.BytesRead != 0 {
+		t.Errorf("ReadFile past EOF: %v, %d bytes", err, read.BytesRead)
+	}
+}
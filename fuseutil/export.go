@@ -0,0 +1,263 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// InodeResolver finds inodes from their IDs alone, without a path from the
+// root, as exporting a file system over NFS requires. File systems whose IDs
+// come from their backing store's own identifiers, e.g. inode numbers of an
+// underlying file system or keys in a database, can usually do this.
+//
+// Both methods fill in entry as a LookUpInodeOp would, with the generation
+// number the inode had when the kernel first learned of it, and increment
+// the inode's lookup count. They return ENOENT if there is no such inode any
+// more, which NFS clients see as a stale file handle.
+type InodeResolver interface {
+	// Fill in the entry for the inode with the given ID.
+	ResolveInode(
+		ctx context.Context,
+		inode fuseops.InodeID,
+		entry *fuseops.ChildInodeEntry) error
+
+	// Fill in the entry for the directory containing the given directory.
+	ResolveParent(
+		ctx context.Context,
+		dir fuseops.InodeID,
+		entry *fuseops.ChildInodeEntry) error
+}
+
+// NewExportFileSystem wraps a file system so that it can be exported over NFS
+// with fuse.MountConfig.EnableExportSupport, answering the lookups of "." and
+// ".." that the kernel then sends with the supplied resolver. Other lookups
+// are passed on.
+func NewExportFileSystem(wrapped FileSystem, resolver InodeResolver) FileSystem {
+	return &exportFS{
+		FileSystem: wrapped,
+		resolver:   resolver,
+	}
+}
+
+type exportFS struct {
+	FileSystem
+	resolver InodeResolver
+}
+
+func (fs *exportFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	switch op.Name {
+	case ".":
+		if err := fs.resolver.ResolveInode(ctx, op.Parent, &op.Entry); err != nil {
+			return err
+		}
+
+		op.Entry.Child = op.Parent
+		return nil
+
+	case "..":
+		return fs.resolver.ResolveParent(ctx, op.Parent, &op.Entry)
+	}
+
+	return fs.FileSystem.LookUpInode(ctx, op)
+}
+
+// ExportChecker is a Hooks that checks that a file system hands out inode IDs
+// and generation numbers as NFS export requires. knfsd gives clients file
+// handles made of the two, which they keep across reboots of the server and
+// present again at any time, so:
+//
+//   - The same ID and generation must never be returned for two different
+//     files, even after the first is deleted and forgotten, or the server
+//     restarted. IDs from StableInodeIDs are safe. So are those from
+//     InodeIDAllocator.AllocateGeneration, but across restarts only with an
+//     epoch (see NewInodeIDAllocatorWithEpoch).
+//
+//   - An inode's generation must stay the same for as long as the kernel
+//     knows the inode, i.e. until its lookup count drops to zero.
+//
+// Ops that would return an ID with a generation that changed while the kernel
+// knew it, or that is lower than one it was returned with before, are failed
+// with EIO, and the reason logged; the file system's lookup count for the
+// inode is then one too high. Reuse with an unchanged generation can't be told
+// apart from a file looked up again, so it isn't caught. It remembers every ID
+// it has seen, so it is meant for tests and debugging, not for production.
+//
+// It is safe for concurrent use.
+type ExportChecker struct {
+	errorLogger *log.Logger // May be nil
+
+	mu sync.Mutex
+
+	// For each ID the file system has returned, the latest generation it was
+	// returned with, and the kernel's lookup count.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*exportedInode
+
+	// GUARDED_BY(mu)
+	violations uint64
+}
+
+type exportedInode struct {
+	generation fuseops.GenerationNumber
+	lookups    uint64
+}
+
+var _ Hooks = &ExportChecker{}
+
+// NewExportChecker creates an ExportChecker for a newly mounted file system,
+// logging violations to errorLogger, which may be nil.
+func NewExportChecker(errorLogger *log.Logger) *ExportChecker {
+	return &ExportChecker{
+		errorLogger: errorLogger,
+		inodes:      make(map[fuseops.InodeID]*exportedInode),
+	}
+}
+
+// Violations returns the number of ops failed so far.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *ExportChecker) Violations() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.violations
+}
+
+func (c *ExportChecker) BeforeOp(ctx context.Context, op interface{}) error {
+	return nil
+}
+
+func (c *ExportChecker) AfterOp(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var bad error
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		if typed.Name == "." && typed.Entry.Child != typed.Parent {
+			bad = fmt.Errorf("lookup of \".\" in %v returned inode %v", typed.Parent, typed.Entry.Child)
+			break
+		}
+
+		bad = c.returned(&typed.Entry)
+	case *fuseops.MkDirOp:
+		bad = c.returned(&typed.Entry)
+	case *fuseops.MkNodeOp:
+		bad = c.returned(&typed.Entry)
+	case *fuseops.CreateFileOp:
+		bad = c.returned(&typed.Entry)
+	case *fuseops.CreateTmpfileOp:
+		bad = c.returned(&typed.Entry)
+	case *fuseops.CreateSymlinkOp:
+		bad = c.returned(&typed.Entry)
+	case *fuseops.CreateLinkOp:
+		bad = c.returned(&typed.Entry)
+
+	case *fuseops.ReadDirPlusOp:
+		// The kernel skips these, as well as entries without inodes.
+		for _, e := range parseDirentsPlus(typed.Dst[:typed.BytesRead]) {
+			if e.Entry.Child == 0 || e.Name == "." || e.Name == ".." {
+				continue
+			}
+
+			if bad = c.returned(&e.Entry); bad != nil {
+				break
+			}
+		}
+
+	case *fuseops.ForgetInodeOp:
+		c.forget(typed.Inode, typed.N)
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range typed.Entries {
+			c.forget(e.Inode, e.N)
+		}
+	}
+
+	if bad != nil {
+		c.violations++
+		if c.errorLogger != nil {
+			c.errorLogger.Printf("ExportChecker: %T: %v", op, bad)
+		}
+
+		return syscall.EIO
+	}
+
+	return nil
+}
+
+// Check an entry about to be returned to the kernel, counting a lookup if it
+// is good.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *ExportChecker) returned(e *fuseops.ChildInodeEntry) error {
+	// Negative entries name no inode.
+	if e.Child == 0 {
+		return nil
+	}
+
+	in := c.inodes[e.Child]
+	if in == nil {
+		c.inodes[e.Child] = &exportedInode{generation: e.Generation, lookups: 1}
+		return nil
+	}
+
+	switch {
+	case in.lookups > 0 && e.Generation != in.generation:
+		return fmt.Errorf(
+			"inode %v returned with generation %d while the kernel knows it with %d",
+			e.Child, e.Generation, in.generation)
+
+	case e.Generation < in.generation:
+		return fmt.Errorf(
+			"inode %v returned with generation %d after %d",
+			e.Child, e.Generation, in.generation)
+	}
+
+	in.generation = e.Generation
+	in.lookups++
+	return nil
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *ExportChecker) forget(id fuseops.InodeID, n uint64) {
+	in := c.inodes[id]
+	if in == nil {
+		return
+	}
+
+	if in.lookups > n {
+		in.lookups -= n
+	} else {
+		in.lookups = 0
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system whose directories are numbered, each the parent of the next,
+// and which can find any of them by ID.
+type chainFS struct {
+	fuseutil.NotImplementedFileSystem
+	depth   fuseops.InodeID
+	lookups map[fuseops.InodeID]int
+}
+
+func (fs *chainFS) fill(id fuseops.InodeID, entry *fuseops.ChildInodeEntry) error {
+	if id < fuseops.RootInodeID || id > fs.depth {
+		return syscall.ENOENT
+	}
+
+	entry.Child = id
+	entry.Generation = fuseops.GenerationNumber(id * 10)
+	entry.Attributes = fuseops.InodeAttributes{Nlink: 2, Mode: os.ModeDir | 0755}
+	fs.lookups[id]++
+	return nil
+}
+
+func (fs *chainFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Name != "next" {
+		return syscall.ENOENT
+	}
+
+	return fs.fill(op.Parent+1, &op.Entry)
+}
+
+func (fs *chainFS) ResolveInode(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	entry *fuseops.ChildInodeEntry) error {
+	return fs.fill(inode, entry)
+}
+
+func (fs *chainFS) ResolveParent(
+	ctx context.Context,
+	dir fuseops.InodeID,
+	entry *fuseops.ChildInodeEntry) error {
+	if dir == fuseops.RootInodeID {
+		return fs.fill(dir, entry)
+	}
+
+	return fs.fill(dir-1, entry)
+}
+
+func TestExportFileSystem(t *testing.T) {
+	chain := &chainFS{depth: 5, lookups: make(map[fuseops.InodeID]int)}
+	fs := fuseutil.NewExportFileSystem(chain, chain)
+
+	testCases := []struct {
+		parent fuseops.InodeID
+		name   string
+		want   fuseops.InodeID
+		err    error
+	}{
+		{3, "next", 4, nil},
+		{4, ".", 4, nil},
+		{4, "..", 3, nil},
+		{fuseops.RootInodeID, "..", fuseops.RootInodeID, nil},
+
+		// Inodes that are gone make for stale NFS handles.
+		{9, ".", 0, syscall.ENOENT},
+		{3, "foo", 0, syscall.ENOENT},
+	}
+
+	for _, tc := range testCases {
+		op := &fuseops.LookUpInodeOp{Parent: tc.parent, Name: tc.name}
+		err := fs.LookUpInode(context.Background(), op)
+		if err != tc.err {
+			t.Errorf("%d/%s: error %v, want %v", tc.parent, tc.name, err, tc.err)
+			continue
+		}
+
+		if err == nil && (op.Entry.Child != tc.want || op.Entry.Generation != fuseops.GenerationNumber(tc.want*10)) {
+			t.Errorf("%d/%s: entry %+v, want inode %d", tc.parent, tc.name, op.Entry, tc.want)
+		}
+	}
+
+	// Each entry returned counts as a lookup.
+	if chain.lookups[4] != 2 || chain.lookups[3] != 1 {
+		t.Errorf("Lookups %v", chain.lookups)
+	}
+}
+
+func TestExportChecker(t *testing.T) {
+	ctx := context.Background()
+	var logged bytes.Buffer
+	c := fuseutil.NewExportChecker(log.New(&logged, "", 0))
+
+	lookUp := func(parent fuseops.InodeID, name string, child fuseops.InodeID, gen fuseops.GenerationNumber) error {
+		op := &fuseops.LookUpInodeOp{
+			Parent: parent,
+			Name:   name,
+			Entry:  fuseops.ChildInodeEntry{Child: child, Generation: gen},
+		}
+
+		c.BeforeOp(ctx, op)
+		return c.AfterOp(ctx, op, nil)
+	}
+
+	forget := func(inode fuseops.InodeID, n uint64) {
+		op := &fuseops.ForgetInodeOp{Inode: inode, N: n}
+		c.BeforeOp(ctx, op)
+		c.AfterOp(ctx, op, nil)
+	}
+
+	testCases := []struct {
+		desc   string
+		run    func() error
+		wantOK bool
+	}{
+		{"first lookup", func() error { return lookUp(1, "foo", 2, 5) }, true},
+		{"same generation", func() error { return lookUp(1, "foo", 2, 5) }, true},
+		{"changed while known", func() error { return lookUp(1, "foo", 2, 6) }, false},
+		{"dot", func() error { return lookUp(2, ".", 2, 5) }, true},
+		{"dot naming another inode", func() error { return lookUp(2, ".", 3, 0) }, false},
+		{"negative entry", func() error { return lookUp(1, "bar", 0, 0) }, true},
+
+		// Once forgotten, the ID may be reused with a later generation.
+		{"reuse", func() error { forget(2, 3); return lookUp(1, "baz", 2, 6) }, true},
+		{"generation went back", func() error { forget(2, 1); return lookUp(1, "qux", 2, 5) }, false},
+	}
+
+	var failures uint64
+	for _, tc := range testCases {
+		err := tc.run()
+		if tc.wantOK && err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+		}
+
+		if !tc.wantOK {
+			failures++
+			if err != syscall.EIO {
+				t.Errorf("%s: error %v, want EIO", tc.desc, err)
+			}
+		}
+	}
+
+	if got := c.Violations(); got != failures {
+		t.Errorf("Violations() = %d, want %d", got, failures)
+	}
+
+	if got := uint64(bytes.Count(logged.Bytes(), []byte("\n"))); got != failures {
+		t.Errorf("Logged %q", logged.String())
+	}
+}
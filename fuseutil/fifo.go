@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// FIFOOpens keeps track of the readers and writers of pipe-like files, so
+// that file systems can make open(2) of them block as it does for a FIFO (see
+// fifo(7)). The kernel handles FIFOs created with MkNodeOp itself; this is
+// for files whose contents the file system streams, e.g. from another host.
+//
+// Call Open from OpenFile, after choosing the handle, and Release from
+// ReleaseFileHandle. Opens block on the goroutine serving them, so this can't
+// be used with NewSingleThreadedFileSystemServer.
+//
+// A zero FIFOOpens is ready to use.
+type FIFOOpens struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	fifos   map[fuseops.InodeID]*fifoState
+	handles map[fuseops.HandleID]fifoHandle
+}
+
+// The openers of one file.
+type fifoState struct {
+	// The handles open for reading and for writing, including those whose
+	// opens are still waiting.
+	readers int
+	writers int
+
+	// The number of opens for reading and for writing so far, so that an open
+	// waiting for the other end isn't left waiting by one that opens and
+	// closes before it wakes.
+	readOpens  uint64
+	writeOpens uint64
+
+	// Closed and replaced whenever an open arrives.
+	changed chan struct{}
+}
+
+type fifoHandle struct {
+	inode  fuseops.InodeID
+	reads  bool
+	writes bool
+}
+
+// Open records the opening of op.Handle and waits as open(2) of a FIFO does:
+//
+//   - An open for reading waits for a writer, unless O_NONBLOCK is set.
+//
+//   - An open for writing waits for a reader, or fails with ENXIO if there is
+//     none and O_NONBLOCK is set.
+//
+//   - An open for both reading and writing doesn't wait.
+//
+// If the open is interrupted while it waits, it returns EINTR, recording
+// nothing. Open also sets op.UseDirectIO and op.NonSeekable, so that the
+// kernel passes every read and write on in order.
+//
+// LOCKS_EXCLUDED(f.mu)
+func (f *FIFOOpens) Open(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	h := fifoHandle{
+		inode:  op.Inode,
+		reads:  !op.OpenFlags.IsWriteOnly(),
+		writes: !op.OpenFlags.IsReadOnly(),
+	}
+	nonblocking := op.OpenFlags&fusekernel.OpenNonblock != 0
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fifos == nil {
+		f.fifos = make(map[fuseops.InodeID]*fifoState)
+		f.handles = make(map[fuseops.HandleID]fifoHandle)
+	}
+
+	st := f.fifos[op.Inode]
+	if st == nil {
+		st = &fifoState{changed: make(chan struct{})}
+		f.fifos[op.Inode] = st
+	}
+
+	if h.writes && !h.reads && nonblocking && st.readers == 0 {
+		return syscall.ENXIO
+	}
+
+	f.add(st, h, 1)
+
+	// Wait for the other end, if there is nobody there.
+	var partner func() uint64
+	switch {
+	case h.reads && h.writes, nonblocking:
+	case h.reads && st.writers == 0:
+		partner = func() uint64 { return st.writeOpens }
+	case h.writes && st.readers == 0:
+		partner = func() uint64 { return st.readOpens }
+	}
+
+	if partner != nil {
+		start := partner()
+		for partner() == start {
+			changed := st.changed
+			f.mu.Unlock()
+
+			select {
+			case <-changed:
+				f.mu.Lock()
+
+			case <-ctx.Done():
+				f.mu.Lock()
+				f.add(st, h, -1)
+				f.forgetIfUnused(op.Inode, st)
+				return syscall.EINTR
+			}
+		}
+	}
+
+	f.handles[op.Handle] = h
+	op.UseDirectIO = true
+	op.NonSeekable = true
+
+	return nil
+}
+
+// Release forgets a handle recorded by Open. Handles it doesn't know are
+// ignored.
+//
+// LOCKS_EXCLUDED(f.mu)
+func (f *FIFOOpens) Release(op *fuseops.ReleaseFileHandleOp) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	h, ok := f.handles[op.Handle]
+	if !ok {
+		return
+	}
+
+	delete(f.handles, op.Handle)
+	st := f.fifos[h.inode]
+	f.add(st, h, -1)
+	f.forgetIfUnused(h.inode, st)
+}
+
+// Counts returns the number of handles open on the inode for reading and for
+// writing, including opens still waiting. A reader should see the end of the
+// file once there are no writers, and a writer should fail with EPIPE once
+// there are no readers.
+//
+// LOCKS_EXCLUDED(f.mu)
+func (f *FIFOOpens) Counts(inode fuseops.InodeID) (readers, writers int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if st := f.fifos[inode]; st != nil {
+		return st.readers, st.writers
+	}
+
+	return 0, 0
+}
+
+// Add n to the counts for the handle's ends, waking waiting opens if it opens
+// any.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FIFOOpens) add(st *fifoState, h fifoHandle, n int) {
+	if h.reads {
+		st.readers += n
+	}
+
+	if h.writes {
+		st.writers += n
+	}
+
+	if n > 0 {
+		if h.reads {
+			st.readOpens++
+		}
+
+		if h.writes {
+			st.writeOpens++
+		}
+
+		close(st.changed)
+		st.changed = make(chan struct{})
+	}
+}
+
+// LOCKS_REQUIRED(f.mu)
+func (f *FIFOOpens) forgetIfUnused(inode fuseops.InodeID, st *fifoState) {
+	if st.readers == 0 && st.writers == 0 {
+		delete(f.fifos, inode)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func fifoOpenOp(handle fuseops.HandleID, flags int) *fuseops.OpenFileOp {
+	return &fuseops.OpenFileOp{
+		Inode:     2,
+		Handle:    handle,
+		OpenFlags: fusekernel.OpenFlags(flags),
+	}
+}
+
+func TestFIFOOpens(t *testing.T) {
+	ctx := context.Background()
+	var f fuseutil.FIFOOpens
+
+	// A reader waits for a writer.
+	readerDone := make(chan error, 1)
+	reader := fifoOpenOp(1, syscall.O_RDONLY)
+	go func() { readerDone <- f.Open(ctx, reader) }()
+
+	select {
+	case err := <-readerDone:
+		t.Fatalf("Reader didn't wait: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	writer := fifoOpenOp(2, syscall.O_WRONLY)
+	if err := f.Open(ctx, writer); err != nil {
+		t.Fatalf("Open for writing: %v", err)
+	}
+
+	if err := <-readerDone; err != nil {
+		t.Fatalf("Open for reading: %v", err)
+	}
+
+	if !reader.UseDirectIO || !reader.NonSeekable {
+		t.Errorf("Reader not opened as a stream: %+v", reader)
+	}
+
+	if r, w := f.Counts(2); r != 1 || w != 1 {
+		t.Errorf("Counts = %d, %d, want 1, 1", r, w)
+	}
+
+	// Once the reader goes, a non-blocking writer can't open.
+	f.Release(&fuseops.ReleaseFileHandleOp{Handle: 1})
+	if err := f.Open(ctx, fifoOpenOp(3, syscall.O_WRONLY|syscall.O_NONBLOCK)); err != syscall.ENXIO {
+		t.Errorf("Non-blocking open for writing: %v, want ENXIO", err)
+	}
+
+	// A non-blocking reader, or one opening for both, doesn't wait.
+	if err := f.Open(ctx, fifoOpenOp(4, syscall.O_RDONLY|syscall.O_NONBLOCK)); err != nil {
+		t.Errorf("Non-blocking open for reading: %v", err)
+	}
+
+	if err := f.Open(ctx, fifoOpenOp(5, syscall.O_RDWR)); err != nil {
+		t.Errorf("Open for reading and writing: %v", err)
+	}
+
+	for _, h := range []fuseops.HandleID{2, 4, 5} {
+		f.Release(&fuseops.ReleaseFileHandleOp{Handle: h})
+	}
+
+	// An interrupted open records nothing.
+	cancelled, cancel := context.WithCancel(ctx)
+	writerDone := make(chan error, 1)
+	go func() { writerDone <- f.Open(cancelled, fifoOpenOp(6, syscall.O_WRONLY)) }()
+	cancel()
+
+	if err := <-writerDone; err != syscall.EINTR {
+		t.Errorf("Interrupted open: %v, want EINTR", err)
+	}
+
+	if r, w := f.Counts(2); r != 0 || w != 0 {
+		t.Errorf("Counts = %d, %d, want 0, 0", r, w)
+	}
+}
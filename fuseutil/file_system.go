@@ -35,14 +35,18 @@ import (
 // implementations for methods you don't care about.
 type FileSystem interface {
 	StatFS(context.Context, *fuseops.StatFSOp) error
+	SyncFS(context.Context, *fuseops.SyncFSOp) error
 	LookUpInode(context.Context, *fuseops.LookUpInodeOp) error
 	GetInodeAttributes(context.Context, *fuseops.GetInodeAttributesOp) error
+	Statx(context.Context, *fuseops.StatxOp) error
 	SetInodeAttributes(context.Context, *fuseops.SetInodeAttributesOp) error
+	Access(context.Context, *fuseops.AccessOp) error
 	ForgetInode(context.Context, *fuseops.ForgetInodeOp) error
 	BatchForget(context.Context, *fuseops.BatchForgetOp) error
 	MkDir(context.Context, *fuseops.MkDirOp) error
 	MkNode(context.Context, *fuseops.MkNodeOp) error
 	CreateFile(context.Context, *fuseops.CreateFileOp) error
+	CreateTmpfile(context.Context, *fuseops.CreateTmpfileOp) error
 	CreateLink(context.Context, *fuseops.CreateLinkOp) error
 	CreateSymlink(context.Context, *fuseops.CreateSymlinkOp) error
 	Rename(context.Context, *fuseops.RenameOp) error
@@ -50,6 +54,7 @@ type FileSystem interface {
 	Unlink(context.Context, *fuseops.UnlinkOp) error
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
 	ReadDir(context.Context, *fuseops.ReadDirOp) error
+	ReadDirPlus(context.Context, *fuseops.ReadDirPlusOp) error
 	ReleaseDirHandle(context.Context, *fuseops.ReleaseDirHandleOp) error
 	OpenFile(context.Context, *fuseops.OpenFileOp) error
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
@@ -63,6 +68,15 @@ type FileSystem interface {
 	ListXattr(context.Context, *fuseops.ListXattrOp) error
 	SetXattr(context.Context, *fuseops.SetXattrOp) error
 	Fallocate(context.Context, *fuseops.FallocateOp) error
+	Lseek(context.Context, *fuseops.LseekOp) error
+	CopyFileRange(context.Context, *fuseops.CopyFileRangeOp) error
+	Poll(context.Context, *fuseops.PollOp) error
+	Flock(context.Context, *fuseops.FlockOp) error
+	GetLk(context.Context, *fuseops.GetLkOp) error
+	SetLk(context.Context, *fuseops.SetLkOp) error
+	SetLkWait(context.Context, *fuseops.SetLkWaitOp) error
+	SetVolumeName(context.Context, *fuseops.SetVolumeNameOp) error
+	GetXtimes(context.Context, *fuseops.GetXtimesOp) error
 
 	// Regard all inodes (including the root inode) as having their lookup counts
 	// decremented to zero, and clean up any resources associated with the file
@@ -70,6 +84,22 @@ type FileSystem interface {
 	Destroy()
 }
 
+// A FileSystem may also implement fuse.InitHandler to see, and possibly
+// narrow, what has been negotiated with the kernel each time it is mounted.
+// Returning an error from OnInit fails that mount.
+
+// DestroyHandler may be implemented by a FileSystem that wants to hear when
+// the kernel tears down a mount's session (see fuseops.DestroyOp). Only
+// fuseblk and virtiofs mounts send this, and the unmount waits for OnDestroy
+// to return, so it is the place to write out anything still buffered; the
+// file system must keep serving ops from other mounts afterwards.
+//
+// Destroy, by contrast, is called for every file system, once the devices of
+// all of its mounts have been closed, and nothing is called after it.
+type DestroyHandler interface {
+	OnDestroy()
+}
+
 // Create a fuse.Server that handles ops by calling the associated FileSystem
 // method.Respond with the resulting error. Unsupported ops are responded to
 // directly with ENOSYS.
@@ -83,23 +113,210 @@ type FileSystem interface {
 // guarantees to serialize operations that the user expects to happen in order,
 // cf. http://goo.gl/jnkHPO, fuse-devel thread "Fuse guarantees on concurrent
 // requests").
+//
+// The server may be mounted at several mountpoints at once, sharing the file
+// system between them; use MountConfig.Labels to tell the mounts apart. Each
+// kernel keeps its own lookup counts, which the file system sees the sum of.
+// Destroy is called once the last mount goes away. Inodes that a mount had
+// looked up and not yet forgotten when it went away while others remained
+// are never forgotten; use NewSharedFileSystemServer if that matters.
 func NewFileSystemServer(fs FileSystem) fuse.Server {
 	return &fileSystemServer{
 		fs: fs,
 	}
 }
 
+// NewFileSystemServerWithHooks is like NewFileSystemServer, but calls the
+// supplied hooks around every op, including those the file system doesn't
+// implement.
+func NewFileSystemServerWithHooks(fs FileSystem, hooks Hooks) fuse.Server {
+	return &fileSystemServer{
+		fs:    fs,
+		hooks: hooks,
+	}
+}
+
+// NewSharedFileSystemServer is like NewFileSystemServerWithHooks, with hooks
+// that may be nil, for file systems mounted at several mountpoints at once.
+// It keeps track of the lookup count held by each mount's kernel, so that
+// when one mount goes away while others remain, it can forget on its behalf
+// every inode it had looked up and not yet forgotten. That costs a map of
+// counts for each mount, and a lock taken for every op that returns entries
+// or forgets them.
+func NewSharedFileSystemServer(fs FileSystem, hooks Hooks) fuse.Server {
+	return &fileSystemServer{
+		fs:           fs,
+		hooks:        hooks,
+		trackLookups: true,
+	}
+}
+
+// NewSingleThreadedFileSystemServer is like NewFileSystemServer, but calls
+// every FileSystem method on the goroutine that called ServeOps, one op at a
+// time in the order the kernel sent them, rather than on a goroutine per op.
+// The file system needs no locking and behaves deterministically, at the cost
+// of parallelism: a slow op holds up all the others, an op that waits for
+// another op to arrive deadlocks, and interrupts are only seen once the op
+// they are for has been answered. See also MountConfig.PollDevice.
+//
+// Mounted at several mountpoints at once, each mount is served on its own
+// goroutine, so the file system sees one op at a time per mount.
+func NewSingleThreadedFileSystemServer(fs FileSystem) fuse.Server {
+	return &fileSystemServer{
+		fs:             fs,
+		singleThreaded: true,
+	}
+}
+
 type fileSystemServer struct {
-	fs          FileSystem
+	fs             FileSystem
+	hooks          Hooks // May be nil
+	singleThreaded bool
+	trackLookups   bool
+
+	mu sync.Mutex
+
+	// The number of connections being served.
+	//
+	// GUARDED_BY(mu)
+	connections int
+}
+
+// State for one of the connections being served.
+type connectionState struct {
 	opsInFlight sync.WaitGroup
+
+	mu sync.Mutex
+
+	// The lookup count that the connection's kernel holds for each inode: the
+	// entries it has been given less those it has forgotten. Nil unless the
+	// server tracks lookups.
+	//
+	// GUARDED_BY(mu)
+	lookups map[fuseops.InodeID]uint64
+}
+
+// Update lookup counts for an op that has been handled, before replying to it.
+//
+// LOCKS_EXCLUDED(cs.mu)
+func (cs *connectionState) track(op interface{}, err error) {
+	// Constant after construction.
+	if cs.lookups == nil {
+		return
+	}
+
+	var entry *fuseops.ChildInodeEntry
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		entry = &typed.Entry
+	case *fuseops.MkDirOp:
+		entry = &typed.Entry
+	case *fuseops.MkNodeOp:
+		entry = &typed.Entry
+	case *fuseops.CreateFileOp:
+		entry = &typed.Entry
+	case *fuseops.CreateTmpfileOp:
+		entry = &typed.Entry
+	case *fuseops.CreateSymlinkOp:
+		entry = &typed.Entry
+	case *fuseops.CreateLinkOp:
+		entry = &typed.Entry
+
+	case *fuseops.ReadDirPlusOp:
+		if err == nil {
+			cs.lookedUpInDir(typed.Dst[:typed.BytesRead])
+		}
+
+		return
+
+	case *fuseops.ForgetInodeOp:
+		cs.forget(typed.Inode, typed.N)
+		return
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range typed.Entries {
+			cs.forget(e.Inode, e.N)
+		}
+
+		return
+	}
+
+	if entry == nil || err != nil || entry.Child == 0 {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.lookups[entry.Child]++
+}
+
+// Count the lookups the kernel makes for the entries returned by
+// ReadDirPlus, which skip "." and "..".
+//
+// LOCKS_EXCLUDED(cs.mu)
+func (cs *connectionState) lookedUpInDir(buf []byte) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for _, e := range parseDirentsPlus(buf) {
+		if e.Entry.Child != 0 && e.Name != "." && e.Name != ".." {
+			cs.lookups[e.Entry.Child]++
+		}
+	}
+}
+
+// LOCKS_EXCLUDED(cs.mu)
+func (cs *connectionState) forget(inode fuseops.InodeID, n uint64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.lookups[inode] <= n {
+		delete(cs.lookups, inode)
+	} else {
+		cs.lookups[inode] -= n
+	}
+}
+
+func (s *fileSystemServer) OnInit(p *fuse.InitParams) error {
+	if h, ok := s.fs.(fuse.InitHandler); ok {
+		return h.OnInit(p)
+	}
+
+	return nil
 }
 
 func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
+	cs := &connectionState{}
+	if s.trackLookups {
+		cs.lookups = make(map[fuseops.InodeID]uint64)
+	}
+
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+
 	// When we are done, we clean up by waiting for all in-flight ops then
-	// destroying the file system.
+	// destroying the file system, or if other connections are still being
+	// served, forgetting what this connection's kernel had looked up.
 	defer func() {
-		s.opsInFlight.Wait()
-		s.fs.Destroy()
+		cs.opsInFlight.Wait()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.connections--
+		if s.connections == 0 {
+			s.fs.Destroy()
+			return
+		}
+
+		for inode, n := range cs.lookups {
+			s.fs.ForgetInode(context.Background(), &fuseops.ForgetInodeOp{
+				Inode: inode,
+				N:     n,
+			})
+		}
 	}()
 
 	for {
@@ -112,25 +329,49 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 			panic(err)
 		}
 
-		s.opsInFlight.Add(1)
-		if _, ok := op.(*fuseops.ForgetInodeOp); ok {
+		cs.opsInFlight.Add(1)
+		if _, ok := op.(*fuseops.ForgetInodeOp); ok || s.singleThreaded {
 			// Special case: call in this goroutine for
 			// forget inode ops, which may come in a
 			// flurry from the kernel and are generally
 			// cheap for the file system to handle
-			s.handleOp(c, ctx, op)
+			s.handleOp(c, cs, ctx, op)
 		} else {
-			go s.handleOp(c, ctx, op)
+			go s.handleOp(c, cs, ctx, op)
 		}
 	}
 }
 
 func (s *fileSystemServer) handleOp(
 	c *fuse.Connection,
+	cs *connectionState,
 	ctx context.Context,
 	op interface{}) {
-	defer s.opsInFlight.Done()
+	defer cs.opsInFlight.Done()
+
+	err := s.runHooksAndDispatch(ctx, op)
+	cs.track(op, err)
+	c.Reply(ctx, err)
+}
 
+func (s *fileSystemServer) runHooksAndDispatch(
+	ctx context.Context,
+	op interface{}) error {
+	if s.hooks == nil {
+		return s.dispatch(ctx, op)
+	}
+
+	err := s.hooks.BeforeOp(ctx, op)
+	if err == nil {
+		err = s.dispatch(ctx, op)
+	}
+
+	return s.hooks.AfterOp(ctx, op, err)
+}
+
+func (s *fileSystemServer) dispatch(
+	ctx context.Context,
+	op interface{}) error {
 	// Dispatch to the appropriate method.
 	var err error
 	switch typed := op.(type) {
@@ -140,6 +381,14 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.StatFSOp:
 		err = s.fs.StatFS(ctx, typed)
 
+	case *fuseops.SyncFSOp:
+		err = s.fs.SyncFS(ctx, typed)
+
+	case *fuseops.DestroyOp:
+		if h, ok := s.fs.(DestroyHandler); ok {
+			h.OnDestroy()
+		}
+
 	case *fuseops.LookUpInodeOp:
 		err = s.fs.LookUpInode(ctx, typed)
 
@@ -149,21 +398,30 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.SetInodeAttributesOp:
 		err = s.fs.SetInodeAttributes(ctx, typed)
 
+	case *fuseops.StatxOp:
+		err = s.fs.Statx(ctx, typed)
+
+	case *fuseops.AccessOp:
+		err = s.fs.Access(ctx, typed)
+
 	case *fuseops.ForgetInodeOp:
 		err = s.fs.ForgetInode(ctx, typed)
 
 	case *fuseops.BatchForgetOp:
 		err = s.fs.BatchForget(ctx, typed)
 		if err == fuse.ENOSYS {
-			// Handle as a series of single-inode forget operations
+			// Handle as a series of single-inode forget operations. Every inode
+			// is forgotten even if some fail, since the kernel won't say again
+			// and their lookup counts would otherwise leak.
+			err = nil
 			for _, entry := range typed.Entries {
-				err = s.fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+				forgetErr := s.fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{
 					Inode:     entry.Inode,
 					N:         entry.N,
 					OpContext: typed.OpContext,
 				})
-				if err != nil {
-					break
+				if err == nil {
+					err = forgetErr
 				}
 			}
 		}
@@ -177,6 +435,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.CreateFileOp:
 		err = s.fs.CreateFile(ctx, typed)
 
+	case *fuseops.CreateTmpfileOp:
+		err = s.fs.CreateTmpfile(ctx, typed)
+
 	case *fuseops.CreateLinkOp:
 		err = s.fs.CreateLink(ctx, typed)
 
@@ -198,6 +459,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.ReadDirOp:
 		err = s.fs.ReadDir(ctx, typed)
 
+	case *fuseops.ReadDirPlusOp:
+		err = s.fs.ReadDirPlus(ctx, typed)
+
 	case *fuseops.ReleaseDirHandleOp:
 		err = s.fs.ReleaseDirHandle(ctx, typed)
 
@@ -236,7 +500,34 @@ func (s *fileSystemServer) handleOp(
 
 	case *fuseops.FallocateOp:
 		err = s.fs.Fallocate(ctx, typed)
+
+	case *fuseops.LseekOp:
+		err = s.fs.Lseek(ctx, typed)
+
+	case *fuseops.CopyFileRangeOp:
+		err = s.fs.CopyFileRange(ctx, typed)
+
+	case *fuseops.PollOp:
+		err = s.fs.Poll(ctx, typed)
+
+	case *fuseops.FlockOp:
+		err = s.fs.Flock(ctx, typed)
+
+	case *fuseops.GetLkOp:
+		err = s.fs.GetLk(ctx, typed)
+
+	case *fuseops.SetLkOp:
+		err = s.fs.SetLk(ctx, typed)
+
+	case *fuseops.SetLkWaitOp:
+		err = s.fs.SetLkWait(ctx, typed)
+
+	case *fuseops.SetVolumeNameOp:
+		err = s.fs.SetVolumeName(ctx, typed)
+
+	case *fuseops.GetXtimesOp:
+		err = s.fs.GetXtimes(ctx, typed)
 	}
 
-	c.Reply(ctx, err)
+	return err
 }
@@ -0,0 +1,243 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system in which every name is inode 2, recording the mounts ops
+// arrive through and the lookup counts forgotten.
+type sharedFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu        sync.Mutex
+	mounts    []string
+	forgotten uint64
+	destroyed int
+}
+
+func (fs *sharedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.mounts = append(fs.mounts, fuse.MountLabels(ctx)["mount"])
+	op.Entry.Child = 2
+	return nil
+}
+
+func (fs *sharedFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forgotten += op.N
+	return nil
+}
+
+func (fs *sharedFS) state() (mounts []string, forgotten uint64, destroyed int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return append([]string(nil), fs.mounts...), fs.forgotten, fs.destroyed
+}
+
+func (fs *sharedFS) Destroy() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.destroyed++
+}
+
+// Serve the server on a new connection with the given label, returning the
+// kernel's end of it.
+func serveShared(
+	t *testing.T,
+	server fuse.Server,
+	label string) (*os.File, *fuse.MountedFileSystem) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+
+	sendRequest(t, kernel, fusekernel.OpInit, 1, fusekernel.InitIn{Major: 7, Minor: 31})
+	mfs, err := fuse.ServeDevice("/mnt", dev, server, &fuse.MountConfig{
+		Labels: map[string]string{"mount": label},
+	})
+
+	if err != nil {
+		t.Fatalf("ServeDevice: %v", err)
+	}
+
+	readReply(t, kernel)
+	return kernel, mfs
+}
+
+func sendRequest(
+	t *testing.T,
+	kernel *os.File,
+	opcode uint32,
+	unique uint64,
+	body interface{}) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, body)
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + b.Len()),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: 1,
+	})
+	msg.Write(b.Bytes())
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+func readReply(t *testing.T, kernel *os.File) {
+	buf := make([]byte, 4096)
+	if _, err := kernel.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+}
+
+func TestFileSystemServerAtSeveralMounts(t *testing.T) {
+	testCases := []struct {
+		name    string
+		newFunc func(fuseutil.FileSystem) fuse.Server
+
+		// The number of lookups forgotten when the first mount goes away.
+		wantForgotten uint64
+	}{
+		{"plain", fuseutil.NewFileSystemServer, 0},
+		{"shared", func(fs fuseutil.FileSystem) fuse.Server {
+			return fuseutil.NewSharedFileSystemServer(fs, nil)
+		}, 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &sharedFS{}
+			server := tc.newFunc(fs)
+
+			kernelA, mfsA := serveShared(t, server, "a")
+			kernelB, mfsB := serveShared(t, server, "b")
+
+			// Each mount looks something up, and the first one does so twice.
+			lookUp := func(kernel *os.File, unique uint64) {
+				sendRequest(t, kernel, fusekernel.OpLookup, unique, [2]byte{'x', 0})
+				readReply(t, kernel)
+			}
+
+			lookUp(kernelA, 2)
+			lookUp(kernelB, 2)
+			lookUp(kernelA, 3)
+
+			if got, _, _ := fs.state(); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "a" {
+				t.Errorf("Mounts seen: %q", got)
+			}
+
+			// When the first mount goes away, what it looked up is forgotten if
+			// the server keeps track, and the file system lives on.
+			kernelA.Close()
+			if err := mfsA.Join(context.Background()); err != nil {
+				t.Fatalf("Join: %v", err)
+			}
+
+			if _, forgotten, destroyed := fs.state(); forgotten != tc.wantForgotten || destroyed != 0 {
+				t.Errorf("After the first unmount: forgotten %d, destroyed %d", forgotten, destroyed)
+			}
+
+			// When the last goes, it is destroyed instead.
+			kernelB.Close()
+			if err := mfsB.Join(context.Background()); err != nil {
+				t.Fatalf("Join: %v", err)
+			}
+
+			if _, forgotten, destroyed := fs.state(); forgotten != tc.wantForgotten || destroyed != 1 {
+				t.Errorf("After the last unmount: forgotten %d, destroyed %d", forgotten, destroyed)
+			}
+		})
+	}
+}
+
+// A sharedFS that also implements the optional lifecycle hooks.
+type lifecycleFS struct {
+	sharedFS
+
+	inits      int
+	onDestroys int
+}
+
+func (fs *lifecycleFS) OnInit(p *fuse.InitParams) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.inits++
+	return nil
+}
+
+func (fs *lifecycleFS) OnDestroy() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.onDestroys++
+}
+
+func TestFileSystemServerLifecycleHooks(t *testing.T) {
+	fs := &lifecycleFS{}
+	kernel, mfs := serveShared(t, fuseutil.NewFileSystemServer(fs), "a")
+
+	// The kernel tearing down the session calls OnDestroy, but not Destroy.
+	sendRequest(t, kernel, fusekernel.OpDestroy, 2, struct{}{})
+	readReply(t, kernel)
+
+	fs.mu.Lock()
+	inits, onDestroys, destroyed := fs.inits, fs.onDestroys, fs.destroyed
+	fs.mu.Unlock()
+
+	if inits != 1 || onDestroys != 1 || destroyed != 0 {
+		t.Errorf("After the destroy op: inits %d, OnDestroy %d, Destroy %d", inits, onDestroys, destroyed)
+	}
+
+	// Destroy follows once the device is closed.
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	if _, _, destroyed := fs.state(); destroyed != 1 {
+		t.Errorf("After the device closed: Destroy %d", destroyed)
+	}
+}
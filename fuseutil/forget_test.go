@@ -0,0 +1,62 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A file system that forgets inodes one at a time, failing for inode 3.
+type singleForgetFS struct {
+	NotImplementedFileSystem
+	forgotten map[fuseops.InodeID]uint64
+}
+
+func (fs *singleForgetFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	if op.Inode == 3 {
+		return syscall.EIO
+	}
+
+	fs.forgotten[op.Inode] += op.N
+	return nil
+}
+
+func TestBatchForgetFanOut(t *testing.T) {
+	fs := &singleForgetFS{forgotten: make(map[fuseops.InodeID]uint64)}
+	s := NewFileSystemServer(fs).(*fileSystemServer)
+
+	op := &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{
+			{Inode: 2, N: 1},
+			{Inode: 3, N: 4},
+			{Inode: 5, N: 9},
+		},
+	}
+
+	// Every inode is forgotten, and the failure reported.
+	if err := s.dispatch(context.Background(), op); err != syscall.EIO {
+		t.Errorf("BatchForget: %v, want EIO", err)
+	}
+
+	if fs.forgotten[2] != 1 || fs.forgotten[5] != 9 {
+		t.Errorf("Forgotten: %v", fs.forgotten)
+	}
+}
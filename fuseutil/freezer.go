@@ -0,0 +1,126 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A FreezeMode says what a Freezer does with ops that would change the file
+// system.
+type FreezeMode int32
+
+const (
+	// Pass all ops on, as if there were no Freezer.
+	FreezeOff FreezeMode = iota
+
+	// Log ops that would change the file system, but pass them on anyway, to
+	// see what a file system is doing before freezing it.
+	FreezeDryRun
+
+	// Log ops that would change the file system and fail them with EROFS, as
+	// a read-only mount would. Reads, lookups and the like are still served.
+	FreezeReject
+)
+
+func (m FreezeMode) String() string {
+	switch m {
+	case FreezeOff:
+		return "Off"
+	case FreezeDryRun:
+		return "DryRun"
+	case FreezeReject:
+		return "Reject"
+	}
+
+	return fmt.Sprintf("FreezeMode(%d)", int32(m))
+}
+
+// Freezer is a Hooks that can stop a live file system from changing, e.g. to
+// investigate one that misbehaves without unmounting it. Install it with
+// NewFileSystemServerWithHooks, then call SetMode at any time, say from a
+// signal handler or a debug endpoint.
+//
+// Ops that change files or the namespace are affected, as are opens for
+// writing. Ops already passed to the file system when the mode changes
+// finish as usual. The kernel may still accept writes into its cache with
+// MountConfig.EnableWritebackCache; writing them back then fails.
+//
+// It is safe for concurrent use.
+type Freezer struct {
+	logger *log.Logger // May be nil
+	mode   atomic.Int32
+}
+
+var _ Hooks = &Freezer{}
+
+// NewFreezer creates a Freezer in FreezeOff mode that logs the ops it affects
+// to logger, which may be nil.
+func NewFreezer(logger *log.Logger) *Freezer {
+	return &Freezer{logger: logger}
+}
+
+// SetMode changes the mode, returning the previous one.
+func (f *Freezer) SetMode(m FreezeMode) FreezeMode {
+	return FreezeMode(f.mode.Swap(int32(m)))
+}
+
+// Mode returns the current mode.
+func (f *Freezer) Mode() FreezeMode {
+	return FreezeMode(f.mode.Load())
+}
+
+func (f *Freezer) BeforeOp(ctx context.Context, op interface{}) error {
+	m := f.Mode()
+	if m == FreezeOff || !mutates(op) {
+		return nil
+	}
+
+	if f.logger != nil {
+		f.logger.Printf("Freezer (%v): %T", m, op)
+	}
+
+	if m == FreezeReject {
+		return syscall.EROFS
+	}
+
+	return nil
+}
+
+func (f *Freezer) AfterOp(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	return err
+}
+
+// Would the op change the file system, or allow it to be changed later?
+func mutates(op interface{}) bool {
+	switch typed := op.(type) {
+	case *fuseops.OpenFileOp:
+		return !typed.OpenFlags.IsReadOnly()
+
+	case *fuseops.SetVolumeNameOp:
+		return true
+	}
+
+	return modifies(op)
+}
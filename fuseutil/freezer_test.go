@@ -0,0 +1,91 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestFreezer(t *testing.T) {
+	ctx := context.Background()
+	var logged bytes.Buffer
+	f := fuseutil.NewFreezer(log.New(&logged, "", 0))
+
+	read := &fuseops.ReadFileOp{Inode: 2}
+	readOnlyOpen := &fuseops.OpenFileOp{Inode: 2, OpenFlags: fusekernel.OpenReadOnly}
+	writableOpen := &fuseops.OpenFileOp{Inode: 2, OpenFlags: fusekernel.OpenReadWrite}
+	write := &fuseops.WriteFileOp{Inode: 2}
+	unlink := &fuseops.UnlinkOp{Parent: 1, Name: "foo"}
+
+	testCases := []struct {
+		op       interface{}
+		off      error
+		dryRun   error
+		rejected error
+	}{
+		{read, nil, nil, nil},
+		{readOnlyOpen, nil, nil, nil},
+		{writableOpen, nil, nil, syscall.EROFS},
+		{write, nil, nil, syscall.EROFS},
+		{unlink, nil, nil, syscall.EROFS},
+	}
+
+	for _, mode := range []fuseutil.FreezeMode{fuseutil.FreezeOff, fuseutil.FreezeDryRun, fuseutil.FreezeReject} {
+		f.SetMode(mode)
+		logged.Reset()
+
+		for _, tc := range testCases {
+			want := tc.off
+			switch mode {
+			case fuseutil.FreezeDryRun:
+				want = tc.dryRun
+			case fuseutil.FreezeReject:
+				want = tc.rejected
+			}
+
+			err := f.BeforeOp(ctx, tc.op)
+			if err != want {
+				t.Errorf("%v: BeforeOp(%T) = %v, want %v", mode, tc.op, err, want)
+			}
+
+			if err := f.AfterOp(ctx, tc.op, err); err != want {
+				t.Errorf("%v: AfterOp(%T) = %v, want %v", mode, tc.op, err, want)
+			}
+		}
+
+		// Only changes are logged, and only while frozen.
+		lines := strings.Count(logged.String(), "\n")
+		if mode == fuseutil.FreezeOff && lines != 0 || mode != fuseutil.FreezeOff && lines != 3 {
+			t.Errorf("%v: logged %q", mode, logged.String())
+		}
+	}
+
+	if prev := f.SetMode(fuseutil.FreezeOff); prev != fuseutil.FreezeReject {
+		t.Errorf("SetMode returned %v", prev)
+	}
+
+	if m := f.Mode(); m != fuseutil.FreezeOff {
+		t.Errorf("Mode() = %v", m)
+	}
+}
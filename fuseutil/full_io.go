@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewFullIOFileSystem wraps a file system whose reads and writes may stop
+// short, e.g. one backed by network streams, so that the kernel sees only
+// complete ones, since it takes a short read as the end of the file and fails
+// a short cached write with EIO:
+//
+//   - A read that returns fewer bytes than asked for without setting
+//     fuseops.ReadFileOp.EOF is continued where it stopped, until it is
+//     complete, EOF is set, or a call returns no bytes, which counts as the
+//     end of the file. If a call fails, the read fails.
+//
+//   - A write that sets fuseops.WriteFileOp.BytesWritten is continued with
+//     the rest of the data, until it is all written. If a call fails after
+//     some data was written, the write reports what was.
+//
+// Each call sees the op as if it were the whole request, with Offset, Size
+// and the buffers adjusted. Callbacks set by the calls are all run.
+func NewFullIOFileSystem(wrapped FileSystem) FileSystem {
+	return &fullIOFS{
+		FileSystem: wrapped,
+	}
+}
+
+type fullIOFS struct {
+	FileSystem
+}
+
+// Return a function calling each of the callbacks, or nil if there are none.
+func chainCallbacks(callbacks []func()) func() {
+	switch len(callbacks) {
+	case 0:
+		return nil
+	case 1:
+		return callbacks[0]
+	}
+
+	return func() {
+		for _, f := range callbacks {
+			f()
+		}
+	}
+}
+
+// Return the prefix of the slices holding n bytes.
+func truncateData(data [][]byte, n int) [][]byte {
+	var out [][]byte
+	for _, b := range data {
+		if n == 0 {
+			break
+		}
+
+		if len(b) > n {
+			b = b[:n]
+		}
+
+		out = append(out, b)
+		n -= len(b)
+	}
+
+	return out
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fullIOFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	size := op.Size
+	if op.Dst != nil {
+		size = int64(len(op.Dst))
+	}
+
+	var callbacks []func()
+	defer func() { op.Callback = chainCallbacks(callbacks) }()
+
+	op.BytesRead = 0
+	op.Data = nil
+	op.EOF = false
+	for {
+		sub := *op
+		sub.Offset = op.Offset + int64(op.BytesRead)
+		sub.Size = size - int64(op.BytesRead)
+		sub.Data = nil
+		sub.BytesRead = 0
+		sub.EOF = false
+		sub.Callback = nil
+		if op.Dst != nil {
+			sub.Dst = op.Dst[op.BytesRead:]
+		}
+
+		err := fs.FileSystem.ReadFile(ctx, &sub)
+		if sub.Callback != nil {
+			callbacks = append(callbacks, sub.Callback)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		n := sub.BytesRead
+		if op.Dst == nil {
+			op.Data = append(op.Data, truncateData(sub.Data, n)...)
+		}
+
+		op.BytesRead += n
+		switch {
+		case int64(op.BytesRead) >= size:
+			op.EOF = sub.EOF
+			return nil
+
+		case sub.EOF || n == 0:
+			op.EOF = true
+			return nil
+		}
+	}
+}
+
+func (fs *fullIOFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	var callbacks []func()
+	defer func() { op.Callback = chainCallbacks(callbacks) }()
+
+	written := 0
+	for {
+		sub := *op
+		sub.Offset = op.Offset + int64(written)
+		sub.Data = op.Data[written:]
+		sub.BytesWritten = 0
+		sub.Callback = nil
+
+		err := fs.FileSystem.WriteFile(ctx, &sub)
+		if sub.Callback != nil {
+			callbacks = append(callbacks, sub.Callback)
+		}
+
+		if err != nil {
+			if written == 0 {
+				return err
+			}
+
+			break
+		}
+
+		n := len(sub.Data)
+		if sub.BytesWritten > 0 && sub.BytesWritten < n {
+			n = sub.BytesWritten
+		}
+
+		written += n
+		if written >= len(op.Data) {
+			break
+		}
+	}
+
+	op.BytesWritten = 0
+	if written < len(op.Data) {
+		op.BytesWritten = written
+	}
+
+	return nil
+}
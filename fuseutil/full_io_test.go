@@ -0,0 +1,178 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with a single file, which reads and writes at most three bytes
+// at a time.
+type trickleFS struct {
+	fuseutil.NotImplementedFileSystem
+	contents  []byte
+	setEOF    bool
+	vectored  bool
+	failAt    int64
+	callbacks int
+}
+
+func (fs *trickleFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if op.Offset >= int64(len(fs.contents)) {
+		op.EOF = fs.setEOF
+		return nil
+	}
+
+	end := op.Offset + 3
+	if end > op.Offset+op.Size {
+		end = op.Offset + op.Size
+	}
+	if end > int64(len(fs.contents)) {
+		end = int64(len(fs.contents))
+	}
+
+	data := fs.contents[op.Offset:end]
+	if fs.vectored {
+		op.Data = [][]byte{data}
+		op.BytesRead = len(data)
+	} else {
+		op.BytesRead = copy(op.Dst, data)
+	}
+
+	op.EOF = fs.setEOF && end == int64(len(fs.contents))
+	op.Callback = func() { fs.callbacks++ }
+	return nil
+}
+
+func (fs *trickleFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if fs.failAt != 0 && op.Offset >= fs.failAt {
+		return syscall.EIO
+	}
+
+	n := len(op.Data)
+	if n > 3 {
+		n = 3
+		op.BytesWritten = n
+	}
+
+	if end := int(op.Offset) + n; end > len(fs.contents) {
+		fs.contents = append(fs.contents, make([]byte, end-len(fs.contents))...)
+	}
+
+	copy(fs.contents[op.Offset:], op.Data[:n])
+	return nil
+}
+
+func TestFullIOFileSystem_Read(t *testing.T) {
+	ctx := context.Background()
+	for _, setEOF := range []bool{false, true} {
+		for _, vectored := range []bool{false, true} {
+			wrapped := &trickleFS{
+				contents: []byte("taco burrito"),
+				setEOF:   setEOF,
+				vectored: vectored,
+			}
+			fs := fuseutil.NewFullIOFileSystem(wrapped)
+
+			read := func(offset, size int64) (string, bool) {
+				op := &fuseops.ReadFileOp{Offset: offset, Size: size}
+				if !vectored {
+					op.Dst = make([]byte, size)
+				}
+
+				if err := fs.ReadFile(ctx, op); err != nil {
+					t.Fatalf("ReadFile: %v", err)
+				}
+
+				if op.Callback != nil {
+					op.Callback()
+				}
+
+				if vectored {
+					var data []byte
+					for _, b := range op.Data {
+						data = append(data, b...)
+					}
+					return string(data[:op.BytesRead]), op.EOF
+				}
+
+				return string(op.Dst[:op.BytesRead]), op.EOF
+			}
+
+			desc := func() string {
+				if vectored {
+					return "vectored"
+				}
+				return "into Dst"
+			}
+
+			// A read within the file is completed.
+			if got, eof := read(1, 7); got != "aco bur" || eof {
+				t.Errorf("EOF %v, %s: read %q, EOF %v", setEOF, desc(), got, eof)
+			}
+
+			// One past the end stops there.
+			if got, eof := read(5, 100); got != "burrito" || !eof {
+				t.Errorf("EOF %v, %s: read %q, EOF %v", setEOF, desc(), got, eof)
+			}
+
+			if wrapped.callbacks != 6 {
+				t.Errorf("EOF %v, %s: %d callbacks, want 6", setEOF, desc(), wrapped.callbacks)
+			}
+		}
+	}
+}
+
+func TestFullIOFileSystem_Write(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &trickleFS{}
+	fs := fuseutil.NewFullIOFileSystem(wrapped)
+
+	// A write is completed.
+	op := &fuseops.WriteFileOp{Data: []byte("taco burrito")}
+	if err := fs.WriteFile(ctx, op); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if op.BytesWritten != 0 || string(wrapped.contents) != "taco burrito" {
+		t.Errorf("BytesWritten %d, contents %q", op.BytesWritten, wrapped.contents)
+	}
+
+	// A failure partway reports what was written.
+	wrapped.failAt = 16
+	op = &fuseops.WriteFileOp{Offset: 12, Data: []byte(" enchilada")}
+	if err := fs.WriteFile(ctx, op); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if op.BytesWritten != 6 || string(wrapped.contents) != "taco burrito enchi" {
+		t.Errorf("BytesWritten %d, contents %q", op.BytesWritten, wrapped.contents)
+	}
+
+	// A failure at the start is reported.
+	op = &fuseops.WriteFileOp{Offset: 20, Data: []byte("x")}
+	if err := fs.WriteFile(ctx, op); err != syscall.EIO {
+		t.Errorf("WriteFile: %v, want EIO", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+)
+
+// Hooks observes, and may modify, each op handled by a server created with
+// NewFileSystemServerWithHooks. This is intended for small tweaks that apply
+// across a file system, such as rewriting the ownership in returned
+// attributes, hiding extended attributes, or injecting latency in tests,
+// without wrapping every FileSystem method.
+//
+// Ops are the pointer types defined in package fuseops, e.g.
+// *fuseops.LookUpInodeOp; use a type switch to pick out those of interest.
+// The methods are called on the same goroutine as the file system method,
+// concurrently for different ops.
+//
+// Hooks are also the place to record metrics and trace spans for ops. The
+// context carries the labels of the mount the op arrived through (see
+// fuse.MountLabels), which should be attached to them. LatencyRecorder
+// measures ops' latency.
+type Hooks interface {
+	// BeforeOp is called before the op is passed to the file system, and may
+	// modify its inputs. If it returns an error, the file system is not called
+	// and the error is passed on to AfterOp.
+	BeforeOp(ctx context.Context, op interface{}) error
+
+	// AfterOp is called with the error returned by the file system, or by
+	// BeforeOp, and may modify the op's outputs. The error it returns is the
+	// one sent to the kernel.
+	AfterOp(ctx context.Context, op interface{}, err error) error
+}
+
+// HookFuncs implements Hooks with optional functions. A nil Before does
+// nothing, and a nil After returns the error it is given.
+type HookFuncs struct {
+	Before func(ctx context.Context, op interface{}) error
+	After  func(ctx context.Context, op interface{}, err error) error
+}
+
+var _ Hooks = HookFuncs{}
+
+func (h HookFuncs) BeforeOp(ctx context.Context, op interface{}) error {
+	if h.Before == nil {
+		return nil
+	}
+
+	return h.Before(ctx, op)
+}
+
+func (h HookFuncs) AfterOp(ctx context.Context, op interface{}, err error) error {
+	if h.After == nil {
+		return err
+	}
+
+	return h.After(ctx, op, err)
+}
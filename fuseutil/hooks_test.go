@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type uidFS struct {
+	NotImplementedFileSystem
+	calls int
+}
+
+func (fs *uidFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.calls++
+	op.Attributes.Uid = 1000
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	fs := &uidFS{}
+	hooks := HookFuncs{
+		Before: func(ctx context.Context, op interface{}) error {
+			if _, ok := op.(*fuseops.GetXattrOp); ok {
+				return syscall.EPERM
+			}
+
+			return nil
+		},
+
+		After: func(ctx context.Context, op interface{}, err error) error {
+			switch typed := op.(type) {
+			case *fuseops.GetInodeAttributesOp:
+				typed.Attributes.Uid = 0
+			case *fuseops.ListXattrOp:
+				return nil
+			}
+
+			return err
+		},
+	}
+
+	s := NewFileSystemServerWithHooks(fs, hooks).(*fileSystemServer)
+	ctx := context.Background()
+
+	// AfterOp may rewrite results.
+	attrs := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err := s.runHooksAndDispatch(ctx, attrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if fs.calls != 1 || attrs.Attributes.Uid != 0 {
+		t.Errorf("calls = %d, Uid = %d", fs.calls, attrs.Attributes.Uid)
+	}
+
+	// BeforeOp may short-circuit the file system.
+	if err := s.runHooksAndDispatch(ctx, &fuseops.GetXattrOp{}); err != syscall.EPERM {
+		t.Errorf("GetXattr: %v, want EPERM", err)
+	}
+
+	// AfterOp may replace errors, including ENOSYS for unimplemented ops.
+	if err := s.runHooksAndDispatch(ctx, &fuseops.ListXattrOp{}); err != nil {
+		t.Errorf("ListXattr: %v, want nil", err)
+	}
+
+	if err := s.runHooksAndDispatch(ctx, &fuseops.RemoveXattrOp{}); err != fuse.ENOSYS {
+		t.Errorf("RemoveXattr: %v, want ENOSYS", err)
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Inode IDs
+////////////////////////////////////////////////////////////////////////
+
+// InodeIDAllocator mints inode IDs for a file system, never returning an ID
+// for which fuseops.InodeID.IsReserved is true. IDs that have been released
+// (typically once their lookup count hits zero; see fuseops.ForgetInodeOp)
+// may be handed out again. File systems to be exported over NFS should use
+// AllocateGeneration, so that a reused ID comes with a new generation number.
+//
+// The allocator's state lives only as long as the process, and a new one
+// hands out the same IDs again. NFS clients keep file handles across restarts
+// of the server, so an allocator from NewInodeIDAllocator is not safe for NFS
+// export across restarts; use NewInodeIDAllocatorWithEpoch instead.
+//
+// It is safe for concurrent use.
+type InodeIDAllocator struct {
+	mu sync.Mutex
+
+	// The next never-before-used ID.
+	//
+	// INVARIANT: !next.IsReserved()
+	next fuseops.InodeID // GUARDED_BY(mu)
+
+	// IDs that have been released and may be re-used, and the same IDs as a
+	// set, for catching double releases.
+	//
+	// INVARIANT: For each id, !id.IsReserved() && id < next
+	// INVARIANT: len(freeSet) == len(free), and each id in free is in freeSet
+	free    []fuseops.InodeID            // GUARDED_BY(mu)
+	freeSet map[fuseops.InodeID]struct{} // GUARDED_BY(mu)
+
+	// The generation given to IDs the first time they are handed out.
+	firstGeneration fuseops.GenerationNumber
+
+	// The number of times each ID has been released, for those that have.
+	generations map[fuseops.InodeID]fuseops.GenerationNumber // GUARDED_BY(mu)
+}
+
+// NewInodeIDAllocator creates an allocator whose first ID is the one
+// immediately following fuseops.RootInodeID.
+func NewInodeIDAllocator() *InodeIDAllocator {
+	return NewInodeIDAllocatorWithEpoch(0)
+}
+
+// NewInodeIDAllocatorWithEpoch is like NewInodeIDAllocator, but the
+// generation numbers it returns start at epoch<<32 rather than zero. A file
+// system exported over NFS should store an epoch that it increments each time
+// it starts, so that IDs handed out again after a restart come with
+// generations higher than any from before. This holds as long as no ID is
+// released 2^32 times in one run.
+func NewInodeIDAllocatorWithEpoch(epoch uint32) *InodeIDAllocator {
+	return &InodeIDAllocator{
+		next:            fuseops.RootInodeID + 1,
+		freeSet:         make(map[fuseops.InodeID]struct{}),
+		firstGeneration: fuseops.GenerationNumber(epoch) << 32,
+		generations:     make(map[fuseops.InodeID]fuseops.GenerationNumber),
+	}
+}
+
+// Allocate returns an ID that is not currently in use.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *InodeIDAllocator) Allocate() fuseops.InodeID {
+	id, _ := a.AllocateGeneration()
+	return id
+}
+
+// AllocateGeneration is like Allocate, but also returns the generation number
+// to give the kernel with the ID: zero (or the epoch's first; see
+// NewInodeIDAllocatorWithEpoch) the first time the ID is handed out, and one
+// more each time it is reused. No ID and generation are returned twice by the
+// allocator, so NFS file handles for inodes deleted while it lives go stale
+// rather than naming new ones. Without an epoch, that doesn't hold across
+// restarts.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *InodeIDAllocator) AllocateGeneration() (fuseops.InodeID, fuseops.GenerationNumber) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if n := len(a.free); n != 0 {
+		id := a.free[n-1]
+		a.free = a.free[:n-1]
+		delete(a.freeSet, id)
+		return id, a.firstGeneration + a.generations[id]
+	}
+
+	id := a.next
+	a.next++
+	return id, a.firstGeneration
+}
+
+// Release makes the supplied ID, previously returned by Allocate, available
+// for re-use. It panics if the ID is reserved, was never allocated, or has
+// already been released since it was last allocated.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *InodeIDAllocator) Release(id fuseops.InodeID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if id.IsReserved() {
+		panic(fmt.Sprintf("Release of reserved inode ID %v", id))
+	}
+
+	if id >= a.next {
+		panic(fmt.Sprintf("Release of never-allocated inode ID %v", id))
+	}
+
+	if _, ok := a.freeSet[id]; ok {
+		panic(fmt.Sprintf("Double release of inode ID %v", id))
+	}
+
+	a.free = append(a.free, id)
+	a.freeSet[id] = struct{}{}
+	a.generations[id]++
+}
+
+////////////////////////////////////////////////////////////////////////
+// Stable inode IDs
+////////////////////////////////////////////////////////////////////////
+
+// StableInodeIDs derives inode IDs from backend identifiers such as paths,
+// object keys or content hashes, for stateless backends that have nowhere to
+// store IDs of their own. A key's ID is a hash of the key, so it is the same
+// each time the key is looked up, across restarts, and in every process
+// serving the same backend.
+//
+// Two keys may hash to the same ID. The kernel would take them for the same
+// inode, so the IDs that the kernel knows about are tracked, from LookUp
+// until they are forgotten, and a key whose ID is held by another key is
+// given an ID from a further hash instead. Such IDs depend on the order in
+// which keys were looked up, so they aren't stable; Collisions reports how
+// many have been handed out.
+//
+// The generation number returned with each ID is a second hash of the key,
+// so it is stable too. IDs that have been involved in collisions are the only
+// ones that can come to identify a different key; they are remembered, and
+// their generation is bumped each time they do (see
+// fuseops.GenerationNumber). They are remembered for as long as the
+// StableInodeIDs lives, so its memory grows with the number of IDs that have
+// ever collided, even once their keys are forgotten.
+//
+// It is safe for concurrent use.
+type StableInodeIDs struct {
+	hash func(key string, attempt uint32) uint64
+
+	mu sync.Mutex
+
+	// The keys of the IDs the kernel knows about, and vice versa.
+	//
+	// INVARIANT: For each id, in: ids[in.key] == id && in.lookups > 0
+	inodes map[fuseops.InodeID]*stableInode // GUARDED_BY(mu)
+	ids    map[string]fuseops.InodeID       // GUARDED_BY(mu)
+
+	// IDs that have been involved in collisions, with the key and generation
+	// they had when last unbound, or nil if they haven't been. Never shrinks.
+	contested map[fuseops.InodeID]*stableBinding // GUARDED_BY(mu)
+
+	collisions uint64 // GUARDED_BY(mu)
+}
+
+type stableInode struct {
+	key        string
+	generation fuseops.GenerationNumber
+	lookups    uint64
+}
+
+type stableBinding struct {
+	key        string
+	generation fuseops.GenerationNumber
+}
+
+// NewStableInodeIDs creates a set of IDs derived with the supplied hash
+// function, which must return well-distributed values that differ for each
+// attempt. If hash is nil, FNV-1a of the attempt and key is used.
+func NewStableInodeIDs(hash func(key string, attempt uint32) uint64) *StableInodeIDs {
+	if hash == nil {
+		hash = stableHash
+	}
+
+	return &StableInodeIDs{
+		hash:      hash,
+		inodes:    make(map[fuseops.InodeID]*stableInode),
+		ids:       make(map[string]fuseops.InodeID),
+		contested: make(map[fuseops.InodeID]*stableBinding),
+	}
+}
+
+func stableHash(key string, attempt uint32) uint64 {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], attempt)
+
+	h := fnv.New64a()
+	h.Write(b[:])
+	io.WriteString(h, key)
+	return h.Sum64()
+}
+
+func stableGeneration(key string) fuseops.GenerationNumber {
+	return fuseops.GenerationNumber(stableHash(key, math.MaxUint32))
+}
+
+// Record that the ID has been involved in a collision.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *StableInodeIDs) contest(id fuseops.InodeID) {
+	if _, ok := s.contested[id]; !ok {
+		s.contested[id] = nil
+	}
+}
+
+// LookUp returns the ID and generation for the key, never a reserved ID.
+// Call it each time an entry for the key is returned to the kernel (e.g. by
+// LookUpInodeOp or MkDirOp), since each adds to the kernel's lookup count;
+// the ID stays bound to the key until Forget takes the count back to zero.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *StableInodeIDs) LookUp(key string) (fuseops.InodeID, fuseops.GenerationNumber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.ids[key]; ok {
+		in := s.inodes[id]
+		in.lookups++
+		return id, in.generation
+	}
+
+	// Skipping reserved IDs depends only on the key, so only IDs held by other
+	// keys count as collisions.
+	var id fuseops.InodeID
+	var collided bool
+	for attempt := uint32(0); ; attempt++ {
+		id = fuseops.InodeID(s.hash(key, attempt))
+		if id.IsReserved() {
+			continue
+		}
+
+		if _, ok := s.inodes[id]; !ok {
+			break
+		}
+
+		collided = true
+		s.contest(id)
+	}
+
+	if collided {
+		s.collisions++
+		s.contest(id)
+	}
+
+	generation := stableGeneration(key)
+	if prev := s.contested[id]; prev != nil {
+		generation = prev.generation
+		if prev.key != key {
+			generation++
+		}
+	}
+
+	s.inodes[id] = &stableInode{
+		key:        key,
+		generation: generation,
+		lookups:    1,
+	}
+
+	s.ids[key] = id
+	return id, generation
+}
+
+// Key returns the key to which the ID is bound, or false if the kernel
+// doesn't know about the ID.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *StableInodeIDs) Key(id fuseops.InodeID) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	in, ok := s.inodes[id]
+	if !ok {
+		return "", false
+	}
+
+	return in.key, true
+}
+
+// Forget takes n from the lookup count of the ID, as in
+// fuseops.ForgetInodeOp, unbinding it from its key once the count reaches
+// zero. It panics if the ID is not bound.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *StableInodeIDs) Forget(id fuseops.InodeID, n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	in, ok := s.inodes[id]
+	if !ok {
+		panic(fmt.Sprintf("Forget of unknown inode ID %v", id))
+	}
+
+	if in.lookups > n {
+		in.lookups -= n
+		return
+	}
+
+	delete(s.inodes, id)
+	delete(s.ids, in.key)
+
+	if _, ok := s.contested[id]; ok {
+		s.contested[id] = &stableBinding{in.key, in.generation}
+	}
+}
+
+// Collisions returns the number of times a key has been given an ID other
+// than its first non-reserved choice, because another key held it.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *StableInodeIDs) Collisions() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.collisions
+}
+
+////////////////////////////////////////////////////////////////////////
+// Handle IDs
+////////////////////////////////////////////////////////////////////////
+
+// HandleIDAllocator mints file and directory handle IDs. The zero handle is
+// never returned, so file systems may use it to mean "no handle".
+//
+// In debug mode the allocator remembers every handle it has minted and
+// released. Released handles are never re-used, and Release and Check panic
+// when handed a handle that is not live. This catches double releases and
+// handles used after a ReleaseFileHandleOp or ReleaseDirHandleOp, at the
+// cost of memory proportional to the number of handles ever minted.
+//
+// It is safe for concurrent use.
+type HandleIDAllocator struct {
+	debug bool
+
+	mu sync.Mutex
+
+	// The next never-before-used ID.
+	next fuseops.HandleID // GUARDED_BY(mu)
+
+	// Released IDs available for re-use. Always empty in debug mode.
+	free []fuseops.HandleID // GUARDED_BY(mu)
+
+	// In debug mode, the set of handles that are currently live. Nil
+	// otherwise.
+	//
+	// INVARIANT: For each h, 0 < h < next
+	live map[fuseops.HandleID]struct{} // GUARDED_BY(mu)
+}
+
+// NewHandleIDAllocator creates an allocator, enabling the use-after-release
+// tracking described on HandleIDAllocator if debug is set.
+func NewHandleIDAllocator(debug bool) *HandleIDAllocator {
+	a := &HandleIDAllocator{
+		debug: debug,
+		next:  1,
+	}
+
+	if debug {
+		a.live = make(map[fuseops.HandleID]struct{})
+	}
+
+	return a
+}
+
+// Allocate returns a handle ID that is not currently in use.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *HandleIDAllocator) Allocate() fuseops.HandleID {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var h fuseops.HandleID
+	if n := len(a.free); n != 0 {
+		h = a.free[n-1]
+		a.free = a.free[:n-1]
+	} else {
+		h = a.next
+		a.next++
+	}
+
+	if a.debug {
+		a.live[h] = struct{}{}
+	}
+
+	return h
+}
+
+// Release makes the supplied handle available for re-use. In debug mode it
+// panics if the handle is not live.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *HandleIDAllocator) Release(h fuseops.HandleID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.debug {
+		a.free = append(a.free, h)
+		return
+	}
+
+	a.checkLive(h, "Release")
+	delete(a.live, h)
+}
+
+// Check panics if debug mode is enabled and the supplied handle is not live,
+// i.e. it was never returned by Allocate or has since been released. File
+// systems may call this at the top of every op that carries a handle. It
+// does nothing when debug mode is disabled.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *HandleIDAllocator) Check(h fuseops.HandleID) {
+	if !a.debug {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.checkLive(h, "Check")
+}
+
+// LOCKS_REQUIRED(a.mu)
+func (a *HandleIDAllocator) checkLive(h fuseops.HandleID, caller string) {
+	if _, ok := a.live[h]; ok {
+		return
+	}
+
+	if h != 0 && h < a.next {
+		panic(fmt.Sprintf("%s: handle %v used after release", caller, h))
+	}
+
+	panic(fmt.Sprintf("%s: handle %v was never allocated", caller, h))
+}
@@ -0,0 +1,222 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func expectPanic(t *testing.T, desc string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s: expected a panic", desc)
+		}
+	}()
+
+	f()
+}
+
+func TestInodeIDAllocator(t *testing.T) {
+	a := fuseutil.NewInodeIDAllocator()
+
+	first := a.Allocate()
+	if first.IsReserved() {
+		t.Fatalf("Allocate returned reserved ID %v", first)
+	}
+
+	second := a.Allocate()
+	if second == first {
+		t.Fatalf("Allocate returned %v twice", first)
+	}
+
+	a.Release(first)
+	if got := a.Allocate(); got != first {
+		t.Errorf("Allocate after Release = %v, want %v", got, first)
+	}
+
+	expectPanic(t, "release root", func() { a.Release(fuseops.RootInodeID) })
+	expectPanic(t, "release zero", func() { a.Release(0) })
+	expectPanic(t, "release unknown", func() { a.Release(second + 100) })
+
+	// Releasing an ID twice would have it handed out twice.
+	a.Release(second)
+	expectPanic(t, "double release", func() { a.Release(second) })
+	if got, other := a.Allocate(), a.Allocate(); got != second || other == second {
+		t.Errorf("Allocate after double release = %v, %v", got, other)
+	}
+}
+
+func TestInodeIDAllocatorGenerations(t *testing.T) {
+	a := fuseutil.NewInodeIDAllocator()
+
+	id, gen := a.AllocateGeneration()
+	if gen != 0 {
+		t.Errorf("First generation of %v = %d", id, gen)
+	}
+
+	// Each reuse of the ID comes with a new generation.
+	for want := fuseops.GenerationNumber(1); want <= 3; want++ {
+		a.Release(id)
+		got, gen := a.AllocateGeneration()
+		if got != id || gen != want {
+			t.Errorf("AllocateGeneration = (%v, %d), want (%v, %d)", got, gen, id, want)
+		}
+	}
+
+	if other, gen := a.AllocateGeneration(); other == id || gen != 0 {
+		t.Errorf("AllocateGeneration = (%v, %d)", other, gen)
+	}
+}
+
+func TestInodeIDAllocatorEpoch(t *testing.T) {
+	// A first run reuses an ID a few times.
+	a := fuseutil.NewInodeIDAllocatorWithEpoch(7)
+	id, first := a.AllocateGeneration()
+	if first != 7<<32 {
+		t.Errorf("First generation = %#x", first)
+	}
+
+	var last fuseops.GenerationNumber
+	for i := 0; i < 3; i++ {
+		a.Release(id)
+		_, last = a.AllocateGeneration()
+	}
+
+	// After a restart with the next epoch, the same ID comes back with a
+	// higher generation than any from before.
+	b := fuseutil.NewInodeIDAllocatorWithEpoch(8)
+	if got, gen := b.AllocateGeneration(); got != id || gen <= last {
+		t.Errorf("AllocateGeneration after restart = (%v, %#x), last was (%v, %#x)", got, gen, id, last)
+	}
+}
+
+func TestHandleIDAllocator(t *testing.T) {
+	t.Run("non-debug", func(t *testing.T) {
+		a := fuseutil.NewHandleIDAllocator(false)
+
+		h := a.Allocate()
+		if h == 0 {
+			t.Fatal("Allocate returned the zero handle")
+		}
+
+		a.Release(h)
+
+		// Without debug mode nothing is tracked, so these must not panic.
+		a.Check(h)
+		if got := a.Allocate(); got != h {
+			t.Errorf("Allocate after Release = %v, want %v", got, h)
+		}
+	})
+
+	t.Run("debug", func(t *testing.T) {
+		a := fuseutil.NewHandleIDAllocator(true)
+
+		h := a.Allocate()
+		a.Check(h)
+		a.Release(h)
+
+		if got := a.Allocate(); got == h {
+			t.Errorf("Released handle %v was re-used in debug mode", h)
+		}
+
+		expectPanic(t, "check after release", func() { a.Check(h) })
+		expectPanic(t, "double release", func() { a.Release(h) })
+		expectPanic(t, "check unknown", func() { a.Check(h + 100) })
+	})
+}
+
+func TestStableInodeIDs(t *testing.T) {
+	s := fuseutil.NewStableInodeIDs(nil)
+
+	a, genA := s.LookUp("a")
+	if a.IsReserved() {
+		t.Fatalf("LookUp returned reserved ID %v", a)
+	}
+
+	// The same key gets the same ID and generation, even after it has been
+	// forgotten or in another set.
+	if id, gen := s.LookUp("a"); id != a || gen != genA {
+		t.Errorf("LookUp again: %v, %v", id, gen)
+	}
+
+	s.Forget(a, 2)
+	if _, ok := s.Key(a); ok {
+		t.Errorf("Key bound after Forget")
+	}
+
+	if id, gen := fuseutil.NewStableInodeIDs(nil).LookUp("a"); id != a || gen != genA {
+		t.Errorf("LookUp in another set: %v, %v", id, gen)
+	}
+
+	expectPanic(t, "forget unknown", func() { s.Forget(a, 1) })
+}
+
+func TestStableInodeIDsCollisions(t *testing.T) {
+	// Every key's first choice is the same.
+	s := fuseutil.NewStableInodeIDs(func(key string, attempt uint32) uint64 {
+		return 10 + uint64(attempt)
+	})
+
+	a, genA := s.LookUp("a")
+	b, genB := s.LookUp("b")
+	if a != 10 || b != 11 || s.Collisions() != 1 {
+		t.Fatalf("IDs %v, %v with %d collisions", a, b, s.Collisions())
+	}
+
+	if key, _ := s.Key(b); key != "b" {
+		t.Errorf("Key(%v) = %q", b, key)
+	}
+
+	// Once the IDs are free, they may identify other keys, but with new
+	// generations.
+	s.Forget(a, 1)
+	s.Forget(b, 1)
+
+	if id, gen := s.LookUp("b"); id != a || gen != genA+1 {
+		t.Errorf("LookUp(b): %v, %v", id, gen)
+	}
+
+	if id, gen := s.LookUp("a"); id != b || gen != genB+1 {
+		t.Errorf("LookUp(a): %v, %v", id, gen)
+	}
+}
+
+func TestStableInodeIDsCollisionsAfterReserved(t *testing.T) {
+	// Key b's first choice is reserved, and its second is key a's.
+	s := fuseutil.NewStableInodeIDs(func(key string, attempt uint32) uint64 {
+		if key == "b" {
+			return []uint64{uint64(fuseops.RootInodeID), 10, 11}[attempt]
+		}
+
+		return 10 + uint64(attempt)
+	})
+
+	a, _ := s.LookUp("a")
+	b, _ := s.LookUp("b")
+	if a != 10 || b != 11 || s.Collisions() != 1 {
+		t.Fatalf("IDs %v, %v with %d collisions", a, b, s.Collisions())
+	}
+
+	// Skipping a reserved ID alone isn't a collision.
+	s.Forget(a, 1)
+	s.Forget(b, 1)
+	if id, _ := s.LookUp("b"); id != 10 || s.Collisions() != 1 {
+		t.Errorf("LookUp(b): %v with %d collisions", id, s.Collisions())
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"log"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Notifier sends cache invalidation notifications to the kernel. It is
+// implemented by *fuse.MountedFileSystem and *fuse.Connection.
+type Notifier interface {
+	NotifyInvalInode(inode fuseops.InodeID, off int64, length int64) error
+	NotifyInvalEntry(parent fuseops.InodeID, name string) error
+}
+
+// WriteInvalidator keeps the kernel's page cache coherent for file systems
+// that open some handles with direct I/O (fuseops.OpenFileOp.UseDirectIO) and
+// others without. Writes through a direct handle bypass the page cache, so
+// pages cached on behalf of the other handles for the same inode go stale.
+// WriteInvalidator tracks which handles are open on each inode, and when a
+// direct write lands on an inode that also has cached handles open, it sends
+// NotifyInvalInode for the range written.
+//
+// Call Opened from OpenFileOp and CreateFileOp, Released from
+// ReleaseFileHandleOp, and Wrote from WriteFileOp after the write succeeds.
+//
+// It is safe for concurrent use.
+type WriteInvalidator struct {
+	notifier    Notifier
+	errorLogger *log.Logger
+
+	mu sync.Mutex
+
+	// For each inode with open handles, whether each handle uses the page
+	// cache.
+	//
+	// INVARIANT: No inner map is empty.
+	handles map[fuseops.InodeID]map[fuseops.HandleID]bool // GUARDED_BY(mu)
+}
+
+// NewWriteInvalidator creates a WriteInvalidator sending notifications via n.
+// Failed notifications are logged to errorLogger, which may be nil.
+func NewWriteInvalidator(
+	n Notifier,
+	errorLogger *log.Logger) *WriteInvalidator {
+	return &WriteInvalidator{
+		notifier:    n,
+		errorLogger: errorLogger,
+		handles:     make(map[fuseops.InodeID]map[fuseops.HandleID]bool),
+	}
+}
+
+// Opened records that handle was opened on inode. directIO should match the
+// UseDirectIO field of the op's response.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *WriteInvalidator) Opened(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	directIO bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	m := w.handles[inode]
+	if m == nil {
+		m = make(map[fuseops.HandleID]bool)
+		w.handles[inode] = m
+	}
+
+	m[handle] = !directIO
+}
+
+// Released records that handle, previously passed to Opened, was released.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *WriteInvalidator) Released(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	m := w.handles[inode]
+	delete(m, handle)
+	if len(m) == 0 {
+		delete(w.handles, inode)
+	}
+}
+
+// Wrote records that n bytes were written at off through handle, and
+// invalidates the kernel's cached pages for that range if necessary.
+//
+// The notification is sent on a separate goroutine: the kernel may need to
+// wait for the write op that triggered it to complete before it can drop the
+// affected pages, so sending it synchronously from the op could deadlock.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *WriteInvalidator) Wrote(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	off int64,
+	n int) {
+	if n == 0 || !w.needsInvalidation(inode, handle) {
+		return
+	}
+
+	go func() {
+		err := w.notifier.NotifyInvalInode(inode, off, int64(n))
+		if err != nil && w.errorLogger != nil {
+			w.errorLogger.Printf("NotifyInvalInode(%v, %d, %d): %v", inode, off, n, err)
+		}
+	}()
+}
+
+// A write through the supplied handle needs invalidation if it bypassed the
+// page cache and some other handle may be reading through it.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *WriteInvalidator) needsInvalidation(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	m := w.handles[inode]
+	if cached, ok := m[handle]; ok && cached {
+		// The kernel updated its own cache as part of the write.
+		return false
+	}
+
+	for h, cached := range m {
+		if h != handle && cached {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RenameInvalidator drops what the kernel has cached that a rename made
+// stale, beyond the entries it moves itself. Left in place, these show up as
+// "ghost files" and wrong link counts:
+//
+//   - The inode whose entry at the new name was overwritten has lost a link,
+//     which the kernel knows only if it had that entry cached. Its other
+//     names, if any, show the old link count.
+//
+//   - The parent directories' modification times and link counts changed.
+//
+//   - If the rename fails, the kernel keeps both entries as they were, unless
+//     the error is ENOENT or EINTR. A rename that went partly through, e.g.
+//     one that moved the entry before failing to update an index, leaves the
+//     old name showing.
+//
+// Call Renamed from RenameOp with the op's outcome.
+//
+// It is safe for concurrent use.
+type RenameInvalidator struct {
+	notifier    Notifier
+	errorLogger *log.Logger
+}
+
+// NewRenameInvalidator creates a RenameInvalidator sending notifications via
+// n. Failed notifications are logged to errorLogger, which may be nil.
+func NewRenameInvalidator(
+	n Notifier,
+	errorLogger *log.Logger) *RenameInvalidator {
+	return &RenameInvalidator{
+		notifier:    n,
+		errorLogger: errorLogger,
+	}
+}
+
+// Renamed records that the file system handled op, returning err, and
+// overwrote the entry for the inode replaced at the new name, which is zero
+// if there was none or the op failed.
+//
+// The notifications are sent on a separate goroutine, since the kernel holds
+// the locks of both directories until the op is answered.
+func (r *RenameInvalidator) Renamed(
+	op *fuseops.RenameOp,
+	replaced fuseops.InodeID,
+	err error) {
+	// The kernel drops both entries itself when told they are gone, or that
+	// it can't know what happened.
+	if err == syscall.ENOENT || err == syscall.EINTR {
+		return
+	}
+
+	inodes := []fuseops.InodeID{op.OldParent}
+	if op.NewParent != op.OldParent {
+		inodes = append(inodes, op.NewParent)
+	}
+
+	if replaced != 0 {
+		inodes = append(inodes, replaced)
+	}
+
+	go func() {
+		if err != nil {
+			r.invalEntry(op.OldParent, op.OldName)
+			r.invalEntry(op.NewParent, op.NewName)
+		}
+
+		for _, inode := range inodes {
+			r.invalInode(inode)
+		}
+	}()
+}
+
+func (r *RenameInvalidator) invalEntry(parent fuseops.InodeID, name string) {
+	err := r.notifier.NotifyInvalEntry(parent, name)
+	if err != nil && r.errorLogger != nil {
+		r.errorLogger.Printf("NotifyInvalEntry(%v, %q): %v", parent, name, err)
+	}
+}
+
+// Invalidate the inode's attributes only.
+func (r *RenameInvalidator) invalInode(inode fuseops.InodeID) {
+	err := r.notifier.NotifyInvalInode(inode, -1, 0)
+	if err != nil && r.errorLogger != nil {
+		r.errorLogger.Printf("NotifyInvalInode(%v): %v", inode, err)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A Notifier that records notifications on a channel.
+type recordingNotifier struct {
+	notifications chan string
+}
+
+func newRecordingNotifier() *recordingNotifier {
+	return &recordingNotifier{notifications: make(chan string, 100)}
+}
+
+func (n *recordingNotifier) NotifyInvalInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) error {
+	n.notifications <- fmt.Sprintf("inode %d [%d, +%d)", inode, off, length)
+	return nil
+}
+
+func (n *recordingNotifier) NotifyInvalEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	n.notifications <- fmt.Sprintf("entry %d/%s", parent, name)
+	return nil
+}
+
+// Return the next notification, or the empty string if none arrives soon.
+func (n *recordingNotifier) next() string {
+	select {
+	case s := <-n.notifications:
+		return s
+	case <-time.After(100 * time.Millisecond):
+		return ""
+	}
+}
+
+func TestWriteInvalidator(t *testing.T) {
+	n := newRecordingNotifier()
+	w := fuseutil.NewWriteInvalidator(n, nil)
+
+	const inode = 17
+	const direct = 1
+	const cached = 2
+
+	// With only a direct handle open there is nothing to invalidate.
+	w.Opened(inode, direct, true)
+	w.Wrote(inode, direct, 0, 10)
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+
+	// Once a cached handle is open, direct writes invalidate the range.
+	w.Opened(inode, cached, false)
+	w.Wrote(inode, direct, 4096, 10)
+	if got, want := n.next(), "inode 17 [4096, +10)"; got != want {
+		t.Errorf("Notification = %q, want %q", got, want)
+	}
+
+	// Writes through the cached handle don't.
+	w.Wrote(inode, cached, 0, 10)
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+
+	// Nor do direct writes after the cached handle is released.
+	w.Released(inode, cached)
+	w.Wrote(inode, direct, 0, 10)
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+}
+
+func TestRenameInvalidator(t *testing.T) {
+	n := newRecordingNotifier()
+	r := fuseutil.NewRenameInvalidator(n, nil)
+
+	testCases := []struct {
+		op       fuseops.RenameOp
+		replaced fuseops.InodeID
+		err      error
+		want     []string
+	}{
+		// Within a directory, without replacing anything.
+		{
+			op:   fuseops.RenameOp{OldParent: 2, OldName: "a", NewParent: 2, NewName: "b"},
+			want: []string{"inode 2 [-1, +0)"},
+		},
+
+		// Across directories, replacing an inode.
+		{
+			op:       fuseops.RenameOp{OldParent: 2, OldName: "a", NewParent: 3, NewName: "b"},
+			replaced: 7,
+			want: []string{
+				"inode 2 [-1, +0)",
+				"inode 3 [-1, +0)",
+				"inode 7 [-1, +0)",
+			},
+		},
+
+		// Failures may have gone partly through.
+		{
+			op:  fuseops.RenameOp{OldParent: 2, OldName: "a", NewParent: 3, NewName: "b"},
+			err: errors.New("taco"),
+			want: []string{
+				"entry 2/a",
+				"entry 3/b",
+				"inode 2 [-1, +0)",
+				"inode 3 [-1, +0)",
+			},
+		},
+
+		// The kernel handles these itself.
+		{
+			op:  fuseops.RenameOp{OldParent: 2, OldName: "a", NewParent: 3, NewName: "b"},
+			err: syscall.ENOENT,
+		},
+	}
+
+	for i, tc := range testCases {
+		r.Renamed(&tc.op, tc.replaced, tc.err)
+		for _, want := range tc.want {
+			if got := n.next(); got != want {
+				t.Errorf("Case %d: notification = %q, want %q", i, got, want)
+			}
+		}
+
+		if got := n.next(); got != "" {
+			t.Errorf("Case %d: unexpected notification: %s", i, got)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewIOFS returns an fs.FS whose contents are those of the supplied file
+// system, read by calling its methods directly rather than through a mount.
+// This lets code that works with fs.FS, such as testing/fstest, look at a
+// file system without needing FUSE.
+//
+// Each path is resolved with LookUpInode from the root, and every lookup is
+// matched by a ForgetInode once the inode is no longer in use, as the kernel
+// would do. Files are opened read-only. The ops carry no caller information;
+// ctx is passed to every method.
+func NewIOFS(ctx context.Context, fileSystem FileSystem) fs.FS {
+	return &ioFS{
+		ctx: ctx,
+		fs:  fileSystem,
+	}
+}
+
+type ioFS struct {
+	ctx context.Context
+	fs  FileSystem
+}
+
+// Drop the reference to an inode gained from a lookup.
+func (f *ioFS) forget(inode fuseops.InodeID) {
+	if inode != fuseops.RootInodeID {
+		f.fs.ForgetInode(f.ctx, &fuseops.ForgetInodeOp{Inode: inode, N: 1})
+	}
+}
+
+// Look up the inode with the given valid path, returning it along with its
+// attributes. The caller must forget it when done.
+func (f *ioFS) walk(name string) (fuseops.InodeID, fuseops.InodeAttributes, error) {
+	if name == "." {
+		op := fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+		err := f.fs.GetInodeAttributes(f.ctx, &op)
+		return fuseops.RootInodeID, op.Attributes, err
+	}
+
+	inode := fuseops.InodeID(fuseops.RootInodeID)
+	var attrs fuseops.InodeAttributes
+	for _, component := range strings.Split(name, "/") {
+		op := fuseops.LookUpInodeOp{Parent: inode, Name: component}
+		err := f.fs.LookUpInode(f.ctx, &op)
+		f.forget(inode)
+
+		switch {
+		case err != nil:
+			return 0, attrs, err
+
+		// A negative entry.
+		case op.Entry.Child == 0:
+			return 0, attrs, fuse.ENOENT
+		}
+
+		inode = op.Entry.Child
+		attrs = op.Entry.Attributes
+	}
+
+	return inode, attrs, nil
+}
+
+func (f *ioFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	inode, attrs, err := f.walk(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	file := ioFile{
+		fsys:  f,
+		name:  name,
+		inode: inode,
+		attrs: attrs,
+	}
+
+	if attrs.Mode.IsDir() {
+		op := fuseops.OpenDirOp{Inode: inode}
+		if err := f.fs.OpenDir(f.ctx, &op); err != nil && err != fuse.ENOSYS {
+			f.forget(inode)
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		file.handle = op.Handle
+		return &ioDir{ioFile: file}, nil
+	}
+
+	op := fuseops.OpenFileOp{Inode: inode}
+	if err := f.fs.OpenFile(f.ctx, &op); err != nil && err != fuse.ENOSYS {
+		f.forget(inode)
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	file.handle = op.Handle
+	return &file, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Files
+////////////////////////////////////////////////////////////////////////
+
+type ioFile struct {
+	fsys   *ioFS
+	name   string
+	inode  fuseops.InodeID
+	handle fuseops.HandleID
+	attrs  fuseops.InodeAttributes
+
+	offset int64
+	closed bool
+}
+
+func (f *ioFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	op := fuseops.GetInodeAttributesOp{Inode: f.inode}
+	if err := f.fsys.fs.GetInodeAttributes(f.fsys.ctx, &op); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+
+	return ioFileInfo{name: path.Base(f.name), attrs: op.Attributes}, nil
+}
+
+func (f *ioFile) Read(b []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	op := fuseops.ReadFileOp{
+		Inode:  f.inode,
+		Handle: f.handle,
+		Offset: f.offset,
+		Size:   int64(len(b)),
+		Dst:    b,
+	}
+
+	if err := f.fsys.fs.ReadFile(f.fsys.ctx, &op); err != nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+
+	// File systems mounted with vectored reads may hand back their own
+	// buffers instead.
+	n := op.BytesRead
+	if op.Data != nil {
+		n = 0
+		for _, d := range op.Data {
+			n += copy(b[n:], d)
+		}
+	}
+
+	if op.Callback != nil {
+		op.Callback()
+	}
+
+	if n == 0 {
+		return 0, io.EOF
+	}
+
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *ioFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	f.closed = true
+	f.fsys.fs.ReleaseFileHandle(f.fsys.ctx, &fuseops.ReleaseFileHandleOp{Handle: f.handle})
+	f.fsys.forget(f.inode)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directories
+////////////////////////////////////////////////////////////////////////
+
+type ioDir struct {
+	ioFile
+
+	// The entries not yet returned by ReadDir, once the directory has been
+	// listed.
+	listed  bool
+	entries []Dirent
+}
+
+func (d *ioDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: fs.ErrClosed}
+	}
+
+	if !d.listed {
+		entries, err := d.list()
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+
+		d.listed = true
+		d.entries = entries
+	}
+
+	count := len(d.entries)
+	if n > 0 && n < count {
+		count = n
+	}
+
+	result := make([]fs.DirEntry, count)
+	for i, e := range d.entries[:count] {
+		result[i] = ioDirEntry{dir: d, dirent: e}
+	}
+
+	d.entries = d.entries[count:]
+	if n > 0 && count == 0 {
+		return result, io.EOF
+	}
+
+	return result, nil
+}
+
+// Read the whole directory through our handle, leaving out "." and "..".
+func (d *ioDir) list() ([]Dirent, error) {
+	var entries []Dirent
+	buf := make([]byte, 64<<10)
+	var offset fuseops.DirOffset
+	for {
+		op := fuseops.ReadDirOp{
+			Inode:  d.inode,
+			Handle: d.handle,
+			Offset: offset,
+			Dst:    buf,
+		}
+
+		if err := d.fsys.fs.ReadDir(d.fsys.ctx, &op); err != nil {
+			return nil, err
+		}
+
+		page := parseDirents(buf[:op.BytesRead])
+		if len(page) == 0 {
+			return entries, nil
+		}
+
+		for _, e := range page {
+			if e.Name != "." && e.Name != ".." {
+				entries = append(entries, e)
+			}
+		}
+
+		offset = page[len(page)-1].Offset
+	}
+}
+
+func (d *ioDir) Close() error {
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.name, Err: fs.ErrClosed}
+	}
+
+	d.closed = true
+	d.fsys.fs.ReleaseDirHandle(d.fsys.ctx, &fuseops.ReleaseDirHandleOp{Handle: d.handle})
+	d.fsys.forget(d.inode)
+	return nil
+}
+
+type ioDirEntry struct {
+	dir    *ioDir
+	dirent Dirent
+}
+
+func (e ioDirEntry) Name() string {
+	return e.dirent.Name
+}
+
+func (e ioDirEntry) IsDir() bool {
+	return e.Type().IsDir()
+}
+
+func (e ioDirEntry) Type() fs.FileMode {
+	switch e.dirent.Type {
+	case DT_Directory:
+		return fs.ModeDir
+	case DT_Link:
+		return fs.ModeSymlink
+	case DT_Socket:
+		return fs.ModeSocket
+	case DT_FIFO:
+		return fs.ModeNamedPipe
+	case DT_Char:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case DT_Block:
+		return fs.ModeDevice
+	case DT_Unknown:
+		if info, err := e.Info(); err == nil {
+			return info.Mode().Type()
+		}
+	}
+
+	return 0
+}
+
+func (e ioDirEntry) Info() (fs.FileInfo, error) {
+	f := e.dir.fsys
+	op := fuseops.LookUpInodeOp{Parent: e.dir.inode, Name: e.dirent.Name}
+	if err := f.fs.LookUpInode(f.ctx, &op); err != nil {
+		return nil, err
+	}
+
+	if op.Entry.Child == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	f.forget(op.Entry.Child)
+	return ioFileInfo{name: e.dirent.Name, attrs: op.Entry.Attributes}, nil
+}
+
+type ioFileInfo struct {
+	name  string
+	attrs fuseops.InodeAttributes
+}
+
+func (i ioFileInfo) Name() string       { return i.name }
+func (i ioFileInfo) Size() int64        { return int64(i.attrs.Size) }
+func (i ioFileInfo) Mode() fs.FileMode  { return i.attrs.Mode }
+func (i ioFileInfo) ModTime() time.Time { return i.attrs.Mtime }
+func (i ioFileInfo) IsDir() bool        { return i.attrs.Mode.IsDir() }
+
+// Sys returns the fuseops.InodeAttributes.
+func (i ioFileInfo) Sys() interface{} { return i.attrs }
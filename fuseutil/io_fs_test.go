@@ -0,0 +1,92 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Counts the lookups not yet matched by a forget.
+type lookupCountingFS struct {
+	fuseutil.FileSystem
+
+	mu          sync.Mutex
+	outstanding int
+}
+
+func (fs *lookupCountingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	if err == nil && op.Entry.Child != 0 {
+		fs.mu.Lock()
+		fs.outstanding++
+		fs.mu.Unlock()
+	}
+
+	return err
+}
+
+func (fs *lookupCountingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	fs.outstanding -= int(op.N)
+	fs.mu.Unlock()
+
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func TestIOFS(t *testing.T) {
+	embedded, err := fuseutil.NewEmbedFS(fstest.MapFS{
+		"hello":          {Data: []byte("Hello, world!"), Mode: 0444},
+		"dir/world":      {Data: []byte("Hello again"), Mode: 0444},
+		"dir/sub/empty":  {Mode: 0444},
+		"other/.dotfile": {Data: []byte("x"), Mode: 0444},
+	})
+
+	if err != nil {
+		t.Fatalf("NewEmbedFS: %v", err)
+	}
+
+	wrapped := &lookupCountingFS{FileSystem: embedded}
+	if err := fusetesting.TestFS(wrapped, "hello", "dir/world", "dir/sub/empty", "other/.dotfile"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every lookup was forgotten again.
+	if wrapped.outstanding != 0 {
+		t.Errorf("Outstanding lookups: %d", wrapped.outstanding)
+	}
+
+	// Missing files are reported in the usual way.
+	fsys := fuseutil.NewIOFS(context.Background(), wrapped)
+	if _, err := fs.ReadFile(fsys, "dir/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFile(missing): %v", err)
+	}
+
+	if err := fusetesting.TestFS(wrapped, "nonexistent"); err == nil {
+		t.Errorf("TestFS didn't notice a missing file")
+	}
+}
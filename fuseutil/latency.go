@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/timeutil"
+)
+
+// OpLatency splits the time taken to answer an op into the time it waited in
+// the process after being read from the kernel (see fuse.ReceivedAt) and the
+// time spent serving it.
+type OpLatency struct {
+	Queued time.Duration
+	Served time.Duration
+}
+
+// Total returns the time from the op being read to it being answered.
+func (l OpLatency) Total() time.Duration {
+	return l.Queued + l.Served
+}
+
+// LatencyRecorder is a Hooks that measures how long each op waits to be
+// served and how long serving it takes, so that latency can be attributed to
+// the file system's code or to a dispatch backlog. It passes the measurements
+// to a function that may record them as metrics, and logs ops that take at
+// least a threshold, e.g.
+//
+//	LatencyRecorder: slow *fuseops.ReadFileOp: 1.2s (queued 1.1s, served 100ms)
+//
+// Serving starts when BeforeOp is called and ends when AfterOp is. The clock
+// must be the one given in fuse.MountConfig.Clock, or timeutil.RealClock() if
+// there is none. Ops whose context has no time of receipt, as in tests, count
+// as not having waited.
+//
+// It is safe for concurrent use.
+type LatencyRecorder struct {
+	clock     timeutil.Clock
+	record    func(context.Context, interface{}, OpLatency, error) // May be nil
+	logger    *log.Logger                                          // May be nil
+	threshold time.Duration
+
+	mu sync.Mutex
+
+	// When each op in progress started being served.
+	//
+	// GUARDED_BY(mu)
+	started map[interface{}]time.Time
+}
+
+var _ Hooks = &LatencyRecorder{}
+
+// NewLatencyRecorder creates a LatencyRecorder that calls record, if it is
+// non-nil, with the latency of each op and the error returned for it, and
+// logs to slowOpLogger, if it is non-nil, ops that took a total of at least
+// slowOpThreshold.
+func NewLatencyRecorder(
+	clock timeutil.Clock,
+	record func(ctx context.Context, op interface{}, l OpLatency, err error),
+	slowOpLogger *log.Logger,
+	slowOpThreshold time.Duration) *LatencyRecorder {
+	return &LatencyRecorder{
+		clock:     clock,
+		record:    record,
+		logger:    slowOpLogger,
+		threshold: slowOpThreshold,
+		started:   make(map[interface{}]time.Time),
+	}
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *LatencyRecorder) BeforeOp(ctx context.Context, op interface{}) error {
+	now := r.clock.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.started[op] = now
+	return nil
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *LatencyRecorder) AfterOp(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	now := r.clock.Now()
+
+	r.mu.Lock()
+	started, ok := r.started[op]
+	delete(r.started, op)
+	r.mu.Unlock()
+
+	if !ok {
+		return err
+	}
+
+	var l OpLatency
+	l.Served = now.Sub(started)
+	if received := fuse.ReceivedAt(ctx); !received.IsZero() && received.Before(started) {
+		l.Queued = started.Sub(received)
+	}
+
+	if r.record != nil {
+		r.record(ctx, op, l, err)
+	}
+
+	if r.logger != nil && l.Total() >= r.threshold {
+		r.logger.Printf(
+			"LatencyRecorder: slow %T: %v (queued %v, served %v)",
+			op, l.Total(), l.Queued, l.Served)
+	}
+
+	return err
+}
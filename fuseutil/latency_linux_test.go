@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system whose lookups take a second.
+type slowLookupFS struct {
+	fuseutil.NotImplementedFileSystem
+	clock *timeutil.SimulatedClock
+}
+
+func (fs *slowLookupFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.clock.AdvanceTime(time.Second)
+	op.Entry.Child = 2
+	return nil
+}
+
+func TestLatencyRecorder(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	var got []fuseutil.OpLatency
+	var logged bytes.Buffer
+	recorder := fuseutil.NewLatencyRecorder(
+		clock,
+		func(ctx context.Context, op interface{}, l fuseutil.OpLatency, err error) {
+			if _, ok := op.(*fuseops.LookUpInodeOp); ok {
+				got = append(got, l)
+			}
+		},
+		log.New(&logged, "", 0),
+		2500*time.Millisecond)
+
+	// Ops wait two seconds between being read and being served.
+	hooks := fuseutil.HookFuncs{
+		Before: func(ctx context.Context, op interface{}) error {
+			clock.AdvanceTime(2 * time.Second)
+			return recorder.BeforeOp(ctx, op)
+		},
+		After: recorder.AfterOp,
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+
+	sendRequest(t, kernel, fusekernel.OpInit, 1, fusekernel.InitIn{Major: 7, Minor: 31})
+	mfs, err := fuse.ServeDevice(
+		"/mnt",
+		dev,
+		fuseutil.NewFileSystemServerWithHooks(&slowLookupFS{clock: clock}, hooks),
+		&fuse.MountConfig{Clock: clock})
+
+	if err != nil {
+		t.Fatalf("ServeDevice: %v", err)
+	}
+
+	readReply(t, kernel)
+	sendRequest(t, kernel, fusekernel.OpLookup, 2, [2]byte{'x', 0})
+	readReply(t, kernel)
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	want := fuseutil.OpLatency{Queued: 2 * time.Second, Served: time.Second}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("Recorded %v, want [%v]", got, want)
+	}
+
+	const wantLog = "LatencyRecorder: slow *fuseops.LookUpInodeOp: 3s (queued 2s, served 1s)\n"
+	if logged.String() != wantLog {
+		t.Errorf("Logged %q, want %q", logged.String(), wantLog)
+	}
+}
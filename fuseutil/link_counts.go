@@ -0,0 +1,242 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// LinkCounts maintains the link counts (InodeAttributes.Nlink) of a file
+// system's inodes from the changes made to its namespace, following the
+// conventions of disk file systems:
+//
+//   - A file, symlink or device node has a link for each name it has.
+//
+//   - A directory has a link for its name, one for its own "." entry, and one
+//     for the ".." entry of each subdirectory.
+//
+// Tools like find(1) rely on the latter to skip looking for subdirectories of
+// directories that have none, so getting it wrong makes them miss files. Call
+// the method for each change from the FileSystem method making it, once it
+// has succeeded, and Apply to the attributes returned for an inode.
+//
+// Inodes it hasn't been told about have no links. The root directory starts
+// with two. It is safe for concurrent use.
+type LinkCounts struct {
+	mu sync.Mutex
+
+	// INVARIANT: For each v, v.n > 0
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*linkCount
+}
+
+type linkCount struct {
+	n   uint32
+	dir bool
+}
+
+// NewLinkCounts creates a LinkCounts knowing only of the root directory.
+func NewLinkCounts() *LinkCounts {
+	return &LinkCounts{
+		inodes: map[fuseops.InodeID]*linkCount{
+			fuseops.RootInodeID: {n: 2, dir: true},
+		},
+	}
+}
+
+// Set records the link count of an inode that exists already, e.g. one loaded
+// from a backend, replacing what was known of it. A count of zero forgets it.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) Set(inode fuseops.InodeID, n uint32, dir bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if n == 0 {
+		delete(lc.inodes, inode)
+		return
+	}
+
+	lc.inodes[inode] = &linkCount{n: n, dir: dir}
+}
+
+// Create records a new file, symlink or device node with a single name, as
+// for CreateFileOp, CreateSymlinkOp and MkNodeOp.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) Create(child fuseops.InodeID) {
+	lc.Set(child, 1, false)
+}
+
+// MkDir records a new directory within parent, as for MkDirOp.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) MkDir(parent, child fuseops.InodeID) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.inodes[child] = &linkCount{n: 2, dir: true}
+	lc.addLocked(parent, 1)
+}
+
+// Link records a new name for an existing inode, as for CreateLinkOp. This
+// includes naming a temporary file from CreateTmpfileOp, which has no links
+// until then.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) Link(target fuseops.InodeID) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if c := lc.inodes[target]; c != nil {
+		c.n++
+		return
+	}
+
+	lc.inodes[target] = &linkCount{n: 1}
+}
+
+// Unlink records the removal of a name of a non-directory, as for UnlinkOp,
+// returning the links left. Once there are none, the inode should go away
+// when the kernel forgets it and its handles are released.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) Unlink(child fuseops.InodeID) uint32 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	return lc.addLocked(child, -1)
+}
+
+// RmDir records the removal of an empty directory from parent, as for
+// RmDirOp.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) RmDir(parent, child fuseops.InodeID) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.removeLocked(parent, child)
+}
+
+// Rename records the move of child from oldParent to newParent, replacing
+// the inode replaced there, or zero if the new name was free, as for
+// RenameOp without RenameExchange.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) Rename(
+	oldParent fuseops.InodeID,
+	newParent fuseops.InodeID,
+	child fuseops.InodeID,
+	replaced fuseops.InodeID) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if replaced != 0 && replaced != child {
+		lc.removeLocked(newParent, replaced)
+	}
+
+	lc.moveLocked(oldParent, newParent, child)
+}
+
+// Exchange records the swap of a in oldParent with b in newParent, as for
+// RenameOp with RenameExchange.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) Exchange(
+	oldParent fuseops.InodeID,
+	newParent fuseops.InodeID,
+	a fuseops.InodeID,
+	b fuseops.InodeID) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.moveLocked(oldParent, newParent, a)
+	lc.moveLocked(newParent, oldParent, b)
+}
+
+// Nlink returns the link count of the inode.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) Nlink(inode fuseops.InodeID) uint32 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if c := lc.inodes[inode]; c != nil {
+		return c.n
+	}
+
+	return 0
+}
+
+// Apply sets attrs.Nlink to the link count of the inode.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *LinkCounts) Apply(
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes) {
+	attrs.Nlink = lc.Nlink(inode)
+}
+
+// Add delta to the inode's count, forgetting it if that leaves none, and
+// return the new count.
+//
+// LOCKS_REQUIRED(lc.mu)
+func (lc *LinkCounts) addLocked(inode fuseops.InodeID, delta int) uint32 {
+	c := lc.inodes[inode]
+	if c == nil {
+		return 0
+	}
+
+	if delta < 0 && c.n <= uint32(-delta) {
+		delete(lc.inodes, inode)
+		return 0
+	}
+
+	c.n = uint32(int(c.n) + delta)
+	return c.n
+}
+
+// Remove a name of child from parent.
+//
+// LOCKS_REQUIRED(lc.mu)
+func (lc *LinkCounts) removeLocked(parent, child fuseops.InodeID) {
+	c := lc.inodes[child]
+	if c == nil {
+		return
+	}
+
+	if c.dir {
+		delete(lc.inodes, child)
+		lc.addLocked(parent, -1)
+		return
+	}
+
+	lc.addLocked(child, -1)
+}
+
+// Move child from oldParent to newParent, taking the ".." link of a
+// directory with it.
+//
+// LOCKS_REQUIRED(lc.mu)
+func (lc *LinkCounts) moveLocked(oldParent, newParent, child fuseops.InodeID) {
+	if c := lc.inodes[child]; c != nil && c.dir && oldParent != newParent {
+		lc.addLocked(oldParent, -1)
+		lc.addLocked(newParent, 1)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestLinkCounts(t *testing.T) {
+	const (
+		root = fuseops.RootInodeID
+		dirA = fuseops.InodeID(2)
+		dirB = fuseops.InodeID(3)
+		file = fuseops.InodeID(4)
+		sub  = fuseops.InodeID(5)
+	)
+
+	lc := fuseutil.NewLinkCounts()
+	check := func(desc string, want map[fuseops.InodeID]uint32) {
+		t.Helper()
+		for inode, n := range want {
+			if got := lc.Nlink(inode); got != n {
+				t.Errorf("%s: inode %d has %d links, want %d", desc, inode, got, n)
+			}
+		}
+	}
+
+	lc.MkDir(root, dirA)
+	lc.MkDir(root, dirB)
+	lc.Create(file)
+	check("created", map[fuseops.InodeID]uint32{root: 4, dirA: 2, dirB: 2, file: 1})
+
+	// Hard links count per name.
+	lc.Link(file)
+	check("linked", map[fuseops.InodeID]uint32{file: 2})
+
+	if n := lc.Unlink(file); n != 1 {
+		t.Errorf("Unlink left %d links, want 1", n)
+	}
+
+	// Moving a directory takes its ".." with it.
+	lc.MkDir(dirA, sub)
+	lc.Rename(dirA, dirB, sub, 0)
+	check("moved", map[fuseops.InodeID]uint32{dirA: 2, dirB: 3, sub: 2})
+
+	// Replacing an empty directory drops it.
+	lc.MkDir(root, 6)
+	lc.Rename(root, root, dirA, 6)
+	check("replaced", map[fuseops.InodeID]uint32{root: 4, dirA: 2, 6: 0})
+
+	// Swapping a directory for a file moves one ".." link.
+	lc.Exchange(dirB, root, sub, file)
+	check("exchanged", map[fuseops.InodeID]uint32{root: 5, dirB: 2, file: 1})
+
+	lc.RmDir(root, sub)
+	if n := lc.Unlink(file); n != 0 {
+		t.Errorf("Unlink left %d links, want 0", n)
+	}
+
+	check("removed", map[fuseops.InodeID]uint32{root: 4, sub: 0, file: 0})
+
+	var attrs fuseops.InodeAttributes
+	lc.Apply(dirB, &attrs)
+	if attrs.Nlink != 2 {
+		t.Errorf("Applied Nlink = %d, want 2", attrs.Nlink)
+	}
+}
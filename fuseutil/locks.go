@@ -0,0 +1,486 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// LockManager keeps track of flock(2) and fcntl(2) locks for a file system
+// that handles them itself (see fuse.MountConfig.EnableFlockLocks and
+// EnablePosixLocks) but needs them to exclude only the users of the process's
+// own mounts, e.g. because it serves the same files through several of them,
+// or wants to see the locks taken. It implements the semantics the kernel
+// would:
+//
+//   - flock locks belong to an open file and cover the whole file. Converting
+//     one gives it up first, so a conversion that fails leaves none, as on
+//     Linux. They are released when the open file is released.
+//
+//   - POSIX locks belong to their owner and cover a range of the file. Taking
+//     or releasing a range splits the owner's locks that overlap it, and
+//     merges those of the same type that touch. They are released when the
+//     owner closes any descriptor for the file, i.e. on FlushFileOp.
+//
+//   - Waiting for a lock ends with EINTR if the op's context is cancelled,
+//     and with EDEADLK instead of starting if POSIX owners would end up
+//     waiting for each other.
+//
+// Call its methods from the FileSystem methods of the same names, or use
+// NewLockingFileSystem to do so.
+//
+// It is safe for concurrent use.
+type LockManager struct {
+	mu sync.Mutex
+
+	// The locks on each inode with locks or waiters.
+	//
+	// GUARDED_BY(mu)
+	files map[fuseops.InodeID]*fileLocks
+
+	// The inode on which each open file holds a flock lock.
+	//
+	// GUARDED_BY(mu)
+	flockInodes map[uint64]fuseops.InodeID
+
+	// For each POSIX owner waiting in SetLkWait, the owner it waits for.
+	//
+	// GUARDED_BY(mu)
+	waitingFor map[uint64]uint64
+}
+
+type fileLocks struct {
+	// The flock lock held by each open file.
+	flocks map[uint64]fuseops.LockType
+
+	// POSIX locks, of which those of each owner are sorted by start and don't
+	// overlap or, for the same type, touch.
+	posix []posixLock
+
+	// Closed and replaced when locks are released or weakened, if there are
+	// waiters.
+	changed chan struct{}
+	waiters int
+}
+
+type posixLock struct {
+	owner uint64
+	fuseops.FileLock
+}
+
+// NewLockManager creates a LockManager with no locks held.
+func NewLockManager() *LockManager {
+	return &LockManager{
+		files:       make(map[fuseops.InodeID]*fileLocks),
+		flockInodes: make(map[uint64]fuseops.InodeID),
+		waitingFor:  make(map[uint64]uint64),
+	}
+}
+
+// Return the locks for the inode, creating an empty record if necessary.
+//
+// LOCKS_REQUIRED(m.mu)
+func (m *LockManager) file(inode fuseops.InodeID) *fileLocks {
+	f := m.files[inode]
+	if f == nil {
+		f = &fileLocks{
+			flocks:  make(map[uint64]fuseops.LockType),
+			changed: make(chan struct{}),
+		}
+
+		m.files[inode] = f
+	}
+
+	return f
+}
+
+// Forget the inode's record if there's nothing left in it.
+//
+// LOCKS_REQUIRED(m.mu)
+func (m *LockManager) tidy(inode fuseops.InodeID) {
+	f := m.files[inode]
+	if f != nil && len(f.flocks) == 0 && len(f.posix) == 0 && f.waiters == 0 {
+		delete(m.files, inode)
+	}
+}
+
+// Wait for the locks on the file to change, or for ctx to be cancelled.
+//
+// LOCKS_REQUIRED(m.mu)
+func (m *LockManager) wait(ctx context.Context, f *fileLocks) error {
+	changed := f.changed
+	f.waiters++
+	m.mu.Unlock()
+
+	var err error
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		err = syscall.EINTR
+	}
+
+	m.mu.Lock()
+	f.waiters--
+	return err
+}
+
+// Wake up those waiting for the file's locks to change.
+func (f *fileLocks) wake() {
+	if f.waiters > 0 {
+		close(f.changed)
+		f.changed = make(chan struct{})
+	}
+}
+
+func conflicts(a, b fuseops.LockType) bool {
+	return a == fuseops.LockExclusive || b == fuseops.LockExclusive
+}
+
+////////////////////////////////////////////////////////////////////////
+// flock(2)
+////////////////////////////////////////////////////////////////////////
+
+// Flock takes, converts or releases a flock lock as described by the op.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LockManager) Flock(ctx context.Context, op *fuseops.FlockOp) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.tidy(op.Inode)
+
+	f := m.file(op.Inode)
+	if _, ok := f.flocks[op.Owner]; ok {
+		delete(f.flocks, op.Owner)
+		delete(m.flockInodes, op.Owner)
+		f.wake()
+	}
+
+	if op.Type == fuseops.LockUnlock {
+		return nil
+	}
+
+	for f.flockConflict(op.Owner, op.Type) {
+		if !op.Wait {
+			return syscall.EAGAIN
+		}
+
+		if err := m.wait(ctx, f); err != nil {
+			return err
+		}
+	}
+
+	f.flocks[op.Owner] = op.Type
+	m.flockInodes[op.Owner] = op.Inode
+	return nil
+}
+
+func (f *fileLocks) flockConflict(owner uint64, t fuseops.LockType) bool {
+	for o, held := range f.flocks {
+		if o != owner && conflicts(t, held) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReleaseFileHandle releases the flock lock held through the handle, if the
+// op says there is one.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LockManager) ReleaseFileHandle(op *fuseops.ReleaseFileHandleOp) {
+	if !op.UnlockFlocks {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inode, ok := m.flockInodes[op.LockOwner]
+	if !ok {
+		return
+	}
+
+	f := m.files[inode]
+	delete(f.flocks, op.LockOwner)
+	delete(m.flockInodes, op.LockOwner)
+	f.wake()
+	m.tidy(inode)
+}
+
+////////////////////////////////////////////////////////////////////////
+// fcntl(2)
+////////////////////////////////////////////////////////////////////////
+
+// GetLk sets op.Conflict to a lock held by another owner that conflicts with
+// op.Lock, if any.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LockManager) GetLk(op *fuseops.GetLkOp) error {
+	if op.Lock.Start > op.Lock.End {
+		return syscall.EINVAL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op.Conflict = fuseops.FileLock{Type: fuseops.LockUnlock}
+	if f := m.files[op.Inode]; f != nil {
+		if c := f.posixConflict(op.Owner, op.Lock); c != nil {
+			op.Conflict = c.FileLock
+		}
+	}
+
+	return nil
+}
+
+// SetLk takes, changes or releases a POSIX lock as described by the op,
+// returning EAGAIN if another owner holds a conflicting one.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LockManager) SetLk(op *fuseops.SetLkOp) error {
+	if op.Lock.Start > op.Lock.End {
+		return syscall.EINVAL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.tidy(op.Inode)
+
+	f := m.file(op.Inode)
+	if op.Lock.Type != fuseops.LockUnlock && f.posixConflict(op.Owner, op.Lock) != nil {
+		return syscall.EAGAIN
+	}
+
+	f.setPosix(op.Owner, op.Lock)
+	return nil
+}
+
+// SetLkWait is like SetLk, but waits for conflicting locks to be released.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LockManager) SetLkWait(ctx context.Context, op *fuseops.SetLkWaitOp) error {
+	if op.Lock.Start > op.Lock.End {
+		return syscall.EINVAL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.tidy(op.Inode)
+
+	f := m.file(op.Inode)
+	for op.Lock.Type != fuseops.LockUnlock {
+		c := f.posixConflict(op.Owner, op.Lock)
+		if c == nil {
+			break
+		}
+
+		if m.wouldDeadlock(op.Owner, c.owner) {
+			return syscall.EDEADLK
+		}
+
+		m.waitingFor[op.Owner] = c.owner
+		err := m.wait(ctx, f)
+		delete(m.waitingFor, op.Owner)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	f.setPosix(op.Owner, op.Lock)
+	return nil
+}
+
+// FlushFile releases the POSIX locks on the file held by the owner of the
+// descriptor being closed.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LockManager) FlushFile(op *fuseops.FlushFileOp) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f := m.files[op.Inode]
+	if f == nil {
+		return
+	}
+
+	f.setPosix(op.LockOwner, fuseops.FileLock{
+		Start: 0,
+		End:   math.MaxUint64,
+		Type:  fuseops.LockUnlock,
+	})
+
+	m.tidy(op.Inode)
+}
+
+// Would the owner waiting for the holder close a cycle of waiting owners?
+//
+// LOCKS_REQUIRED(m.mu)
+func (m *LockManager) wouldDeadlock(owner, holder uint64) bool {
+	for i := 0; i <= len(m.waitingFor); i++ {
+		if holder == owner {
+			return true
+		}
+
+		next, ok := m.waitingFor[holder]
+		if !ok {
+			return false
+		}
+
+		holder = next
+	}
+
+	return false
+}
+
+// Return a lock held by another owner that conflicts with l, or nil.
+func (f *fileLocks) posixConflict(owner uint64, l fuseops.FileLock) *posixLock {
+	for i := range f.posix {
+		p := &f.posix[i]
+		if p.owner != owner && p.Start <= l.End && l.Start <= p.End && conflicts(l.Type, p.Type) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// Replace the owner's locks in the range of l with l, which may be an unlock.
+func (f *fileLocks) setPosix(owner uint64, l fuseops.FileLock) {
+	var out, mine []posixLock
+	for _, p := range f.posix {
+		switch {
+		case p.owner != owner:
+			out = append(out, p)
+
+		case p.End < l.Start || p.Start > l.End:
+			mine = append(mine, p)
+
+		default:
+			// Keep the parts outside the range.
+			if p.Start < l.Start {
+				left := p
+				left.End = l.Start - 1
+				mine = append(mine, left)
+			}
+
+			if p.End > l.End {
+				right := p
+				right.Start = l.End + 1
+				mine = append(mine, right)
+			}
+		}
+	}
+
+	if l.Type != fuseops.LockUnlock {
+		mine = append(mine, posixLock{owner, l})
+	}
+
+	// Merge locks of the same type that touch.
+	sort.Slice(mine, func(i, j int) bool { return mine[i].Start < mine[j].Start })
+	for _, p := range mine {
+		if n := len(out); n > 0 {
+			last := &out[n-1]
+			if last.owner == owner && last.Type == p.Type && last.End != math.MaxUint64 && last.End+1 >= p.Start {
+				if p.End > last.End {
+					last.End = p.End
+				}
+
+				continue
+			}
+		}
+
+		out = append(out, p)
+	}
+
+	f.posix = out
+	f.wake()
+}
+
+////////////////////////////////////////////////////////////////////////
+// NewLockingFileSystem
+////////////////////////////////////////////////////////////////////////
+
+// NewLockingFileSystem wraps a file system so that flock(2) and fcntl(2)
+// locks are handled by a LockManager. Mount it with
+// fuse.MountConfig.EnableFlockLocks and EnablePosixLocks.
+//
+// FlushFileOp and ReleaseFileHandleOp are passed on after releasing locks. An
+// ENOSYS from FlushFile is turned into success, since the kernel would
+// otherwise stop sending FlushFileOp, and with it the releases of POSIX locks
+// on close.
+func NewLockingFileSystem(wrapped FileSystem) FileSystem {
+	return &lockingFS{
+		FileSystem: wrapped,
+		locks:      NewLockManager(),
+	}
+}
+
+type lockingFS struct {
+	FileSystem
+	locks *LockManager
+}
+
+func (fs *lockingFS) Flock(
+	ctx context.Context,
+	op *fuseops.FlockOp) error {
+	return fs.locks.Flock(ctx, op)
+}
+
+func (fs *lockingFS) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	return fs.locks.GetLk(op)
+}
+
+func (fs *lockingFS) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	return fs.locks.SetLk(op)
+}
+
+func (fs *lockingFS) SetLkWait(
+	ctx context.Context,
+	op *fuseops.SetLkWaitOp) error {
+	return fs.locks.SetLkWait(ctx, op)
+}
+
+func (fs *lockingFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.locks.FlushFile(op)
+
+	err := fs.FileSystem.FlushFile(ctx, op)
+	if err == fuse.ENOSYS {
+		return nil
+	}
+
+	return err
+}
+
+func (fs *lockingFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.locks.ReleaseFileHandle(op)
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
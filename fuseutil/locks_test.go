@@ -0,0 +1,259 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"math"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestLockManagerFlock(t *testing.T) {
+	ctx := context.Background()
+	m := fuseutil.NewLockManager()
+
+	flock := func(owner uint64, typ fuseops.LockType) error {
+		return m.Flock(ctx, &fuseops.FlockOp{Inode: 2, Owner: owner, Type: typ})
+	}
+
+	if err := flock(1, fuseops.LockShared); err != nil {
+		t.Fatalf("Shared: %v", err)
+	}
+
+	if err := flock(2, fuseops.LockShared); err != nil {
+		t.Fatalf("Second shared: %v", err)
+	}
+
+	if err := flock(3, fuseops.LockExclusive); err != syscall.EAGAIN {
+		t.Errorf("Exclusive over shared: got %v, want EAGAIN", err)
+	}
+
+	// Other inodes are unaffected.
+	if err := m.Flock(ctx, &fuseops.FlockOp{Inode: 3, Owner: 3, Type: fuseops.LockExclusive}); err != nil {
+		t.Errorf("Exclusive on another inode: %v", err)
+	}
+
+	// A conversion that fails leaves no lock.
+	if err := flock(1, fuseops.LockExclusive); err != syscall.EAGAIN {
+		t.Errorf("Conversion: got %v, want EAGAIN", err)
+	}
+
+	m.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{LockOwner: 2, UnlockFlocks: true})
+
+	if err := flock(3, fuseops.LockExclusive); err != nil {
+		t.Errorf("Exclusive after release: %v", err)
+	}
+
+	// Waiting ends when the lock is released, or when the context is.
+	done := make(chan error)
+	go func() {
+		done <- m.Flock(ctx, &fuseops.FlockOp{Inode: 2, Owner: 1, Type: fuseops.LockShared, Wait: true})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Wait returned early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := flock(3, fuseops.LockUnlock); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("Wait: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		done <- m.Flock(cancelled, &fuseops.FlockOp{Inode: 2, Owner: 3, Type: fuseops.LockExclusive, Wait: true})
+	}()
+
+	cancel()
+	if err := <-done; err != syscall.EINTR {
+		t.Errorf("Cancelled wait: got %v, want EINTR", err)
+	}
+}
+
+func TestLockManagerPosix(t *testing.T) {
+	ctx := context.Background()
+	m := fuseutil.NewLockManager()
+
+	set := func(owner uint64, start, end uint64, typ fuseops.LockType) error {
+		return m.SetLk(&fuseops.SetLkOp{
+			Inode: 2,
+			Owner: owner,
+			Lock:  fuseops.FileLock{Start: start, End: end, Type: typ, Pid: uint32(owner)},
+		})
+	}
+
+	get := func(owner uint64, start, end uint64, typ fuseops.LockType) fuseops.FileLock {
+		op := &fuseops.GetLkOp{
+			Inode: 2,
+			Owner: owner,
+			Lock:  fuseops.FileLock{Start: start, End: end, Type: typ},
+		}
+
+		if err := m.GetLk(op); err != nil {
+			t.Fatalf("GetLk: %v", err)
+		}
+
+		return op.Conflict
+	}
+
+	// Owner 1 locks [0, 99] exclusively, then unlocks the middle, splitting it.
+	if err := set(1, 0, 99, fuseops.LockExclusive); err != nil {
+		t.Fatalf("SetLk: %v", err)
+	}
+
+	if err := set(1, 40, 59, fuseops.LockUnlock); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	if err := set(2, 40, 59, fuseops.LockExclusive); err != nil {
+		t.Errorf("Lock in the gap: %v", err)
+	}
+
+	if err := set(2, 30, 45, fuseops.LockShared); err != syscall.EAGAIN {
+		t.Errorf("Overlapping lock: got %v, want EAGAIN", err)
+	}
+
+	got := get(2, 0, math.MaxInt64, fuseops.LockShared)
+	want := fuseops.FileLock{Start: 0, End: 39, Type: fuseops.LockExclusive, Pid: 1}
+	if got != want {
+		t.Errorf("Conflict: got %+v, want %+v", got, want)
+	}
+
+	// An owner doesn't conflict with itself.
+	if got := get(1, 0, 39, fuseops.LockExclusive); got.Type != fuseops.LockUnlock {
+		t.Errorf("Own conflict: %+v", got)
+	}
+
+	// Owner 2 gives up its lock; owner 1 relocks the gap, merging its locks
+	// back into one.
+	if err := set(2, 0, math.MaxInt64, fuseops.LockUnlock); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	if err := set(1, 40, 59, fuseops.LockExclusive); err != nil {
+		t.Fatalf("Relock: %v", err)
+	}
+
+	got = get(2, 50, 50, fuseops.LockShared)
+	want = fuseops.FileLock{Start: 0, End: 99, Type: fuseops.LockExclusive, Pid: 1}
+	if got != want {
+		t.Errorf("Merged conflict: got %+v, want %+v", got, want)
+	}
+
+	// Downgrading part of the range lets others share it.
+	if err := set(1, 0, 9, fuseops.LockShared); err != nil {
+		t.Fatalf("Downgrade: %v", err)
+	}
+
+	if err := set(2, 5, 9, fuseops.LockShared); err != nil {
+		t.Errorf("Shared over downgraded range: %v", err)
+	}
+
+	if err := set(2, 5, 10, fuseops.LockShared); err != syscall.EAGAIN {
+		t.Errorf("Shared over exclusive: got %v, want EAGAIN", err)
+	}
+
+	if err := set(2, 10, 5, fuseops.LockShared); err != syscall.EINVAL {
+		t.Errorf("Reversed range: got %v, want EINVAL", err)
+	}
+
+	// Closing a descriptor releases all of the owner's locks on the file.
+	m.FlushFile(&fuseops.FlushFileOp{Inode: 2, LockOwner: 1})
+
+	if got := get(3, 0, math.MaxInt64, fuseops.LockExclusive); got.Pid != 2 {
+		t.Errorf("Conflict after flush: %+v", got)
+	}
+
+	m.FlushFile(&fuseops.FlushFileOp{Inode: 2, LockOwner: 2})
+
+	if err := m.SetLkWait(ctx, &fuseops.SetLkWaitOp{
+		Inode: 2,
+		Owner: 3,
+		Lock:  fuseops.FileLock{Start: 0, End: math.MaxInt64, Type: fuseops.LockExclusive},
+	}); err != nil {
+		t.Errorf("SetLkWait on unlocked file: %v", err)
+	}
+}
+
+func TestLockManagerDeadlock(t *testing.T) {
+	ctx := context.Background()
+	m := fuseutil.NewLockManager()
+
+	lock := func(owner uint64, start uint64) *fuseops.SetLkWaitOp {
+		return &fuseops.SetLkWaitOp{
+			Inode: 2,
+			Owner: owner,
+			Lock:  fuseops.FileLock{Start: start, End: start, Type: fuseops.LockExclusive},
+		}
+	}
+
+	if err := m.SetLkWait(ctx, lock(1, 0)); err != nil {
+		t.Fatalf("SetLkWait: %v", err)
+	}
+
+	if err := m.SetLkWait(ctx, lock(2, 1)); err != nil {
+		t.Fatalf("SetLkWait: %v", err)
+	}
+
+	// Owner 1 waits for owner 2's byte, and owner 2 for owner 1's. Whichever
+	// of them starts waiting second is refused. Until owner 1 is waiting,
+	// owner 2 gives up after a moment and tries again.
+	done := make(chan error, 1)
+	go func() {
+		done <- m.SetLkWait(ctx, lock(1, 1))
+	}()
+
+	for i := 0; i < 100; i++ {
+		attempt, cancel := context.WithTimeout(ctx, time.Millisecond)
+		err := m.SetLkWait(attempt, lock(2, 0))
+		cancel()
+
+		switch err {
+		case syscall.EDEADLK:
+			m.FlushFile(&fuseops.FlushFileOp{Inode: 2, LockOwner: 2})
+			if err := <-done; err != nil {
+				t.Errorf("Owner 1: %v", err)
+			}
+
+			return
+
+		case syscall.EINTR:
+		default:
+			t.Fatalf("Owner 2: got %v, want EDEADLK or EINTR", err)
+		}
+
+		select {
+		case err := <-done:
+			if err != syscall.EDEADLK {
+				t.Fatalf("Owner 1: got %v, want EDEADLK", err)
+			}
+
+			return
+		default:
+		}
+	}
+
+	t.Fatal("No deadlock detected")
+}
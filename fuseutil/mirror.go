@@ -0,0 +1,630 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The most shadow ops waiting to be run. Beyond this, comparisons are dropped
+// rather than slowing down the primary file system.
+const mirrorQueueSize = 1024
+
+// MirrorStats counts the ops a Mirror has compared.
+type MirrorStats struct {
+	// Ops answered the same way by both file systems.
+	Matched uint64
+
+	// Ops answered differently, each of which has been logged.
+	Diverged uint64
+
+	// Ops not compared, because the shadow file system had fallen behind or
+	// had not looked up the inode concerned.
+	Skipped uint64
+}
+
+// Mirror wraps a primary file system, which serves every op, and sends copies
+// of the read-only ops it serves to a shadow file system, comparing the
+// answers and logging any differences. This lets a new implementation of a
+// file system be checked under real traffic, e.g. while migrating between
+// backends, before it serves any. What the kernel sees comes only from the
+// primary.
+//
+// The shadow is given lookups, in order to learn its own inode IDs, and then
+// GetInodeAttributes, ReadSymlink, GetXattr, ListXattr and ReadFile, the last
+// with its own open file handle. Directory listings are compared when the
+// primary returns a whole directory in one ReadDir, by listing the shadow's
+// copy in full. Inode and handle IDs, expirations, and access and change
+// times are not compared, since they legitimately differ. The shadow is sent
+// forgets for everything it has looked up once the kernel has forgotten the
+// inode, and is destroyed along with the primary.
+//
+// The shadow runs on a single goroutine of its own, after the primary has
+// answered, so it can't slow the primary down. While it is behind, further
+// comparisons are skipped. The two file systems must see the same data, e.g.
+// by sharing a backend, and ops that change it are sent only to the primary,
+// so comparisons racing with changes may diverge spuriously.
+//
+// It is safe for concurrent use.
+type Mirror struct {
+	FileSystem
+	shadow FileSystem
+	logger *log.Logger // May be nil
+
+	// Shadow ops waiting to be run by the shadow goroutine, which closes done
+	// when the channel is closed and drained.
+	queue chan func()
+	done  chan struct{}
+
+	mu sync.Mutex
+
+	// Inodes returned by the primary's LookUpInode, keyed by the primary's ID.
+	inodes map[fuseops.InodeID]*mirroredInode // GUARDED_BY(mu)
+
+	stats MirrorStats // GUARDED_BY(mu)
+}
+
+type mirroredInode struct {
+	// The number of lookups by the primary seen, less forgets.
+	lookups uint64
+
+	// The shadow's ID for the inode, and the number of times it has returned
+	// it from LookUpInode. Zero until the shadow has looked it up.
+	shadow        fuseops.InodeID
+	shadowLookups uint64
+}
+
+// NewMirror wraps primary, mirroring to shadow and logging differences to
+// logger, which may be nil.
+func NewMirror(primary, shadow FileSystem, logger *log.Logger) *Mirror {
+	m := &Mirror{
+		FileSystem: primary,
+		shadow:     shadow,
+		logger:     logger,
+		queue:      make(chan func(), mirrorQueueSize),
+		done:       make(chan struct{}),
+		inodes: map[fuseops.InodeID]*mirroredInode{
+			fuseops.RootInodeID: {shadow: fuseops.RootInodeID},
+		},
+	}
+
+	go m.runShadow()
+	return m
+}
+
+// Stats returns the number of ops compared so far.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) Stats() MirrorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// WaitForShadow waits for the shadow file system to finish the ops mirrored so
+// far, e.g. before checking Stats in a test.
+func (m *Mirror) WaitForShadow() {
+	flushed := make(chan struct{})
+	m.queue <- func() { close(flushed) }
+	<-flushed
+}
+
+func (m *Mirror) runShadow() {
+	for f := range m.queue {
+		f()
+	}
+
+	close(m.done)
+}
+
+// Queue a shadow op, or count it as skipped if the shadow is too far behind.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) enqueue(f func()) {
+	select {
+	case m.queue <- f:
+	default:
+		m.skip()
+	}
+}
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) skip() {
+	m.mu.Lock()
+	m.stats.Skipped++
+	m.mu.Unlock()
+}
+
+// Return the shadow's ID for the primary's inode, or zero if it has none.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) shadowInode(inode fuseops.InodeID) fuseops.InodeID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e := m.inodes[inode]; e != nil {
+		return e.shadow
+	}
+
+	return 0
+}
+
+// Record the outcome of a comparison, logging the answers if they differ.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) compare(
+	desc string,
+	match bool,
+	primary interface{},
+	shadow interface{}) {
+	m.mu.Lock()
+	if match {
+		m.stats.Matched++
+	} else {
+		m.stats.Diverged++
+	}
+	m.mu.Unlock()
+
+	if !match && m.logger != nil {
+		m.logger.Printf("Mirror: %s: primary %v, shadow %v", desc, primary, shadow)
+	}
+}
+
+// Compare the answers to an op that returns only an error and attributes.
+func (m *Mirror) compareAttributes(
+	desc string,
+	primaryErr error,
+	primary fuseops.InodeAttributes,
+	shadowErr error,
+	shadow fuseops.InodeAttributes) {
+	match := primaryErr == shadowErr
+	if primaryErr == nil && shadowErr == nil {
+		match = primary.Size == shadow.Size &&
+			primary.Nlink == shadow.Nlink &&
+			primary.Mode == shadow.Mode &&
+			primary.Rdev == shadow.Rdev &&
+			primary.Mtime.Equal(shadow.Mtime) &&
+			primary.Uid == shadow.Uid &&
+			primary.Gid == shadow.Gid
+	}
+
+	m.compare(
+		desc,
+		match,
+		describeAnswer(primaryErr, primary.DebugString()),
+		describeAnswer(shadowErr, shadow.DebugString()))
+}
+
+func describeAnswer(err error, answer interface{}) string {
+	if err != nil {
+		return fmt.Sprintf("error %v", err)
+	}
+
+	return fmt.Sprint(answer)
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	err := m.FileSystem.LookUpInode(ctx, op)
+	child := op.Entry.Child
+	if err == nil && child != 0 {
+		m.mu.Lock()
+		e := m.inodes[child]
+		if e == nil {
+			e = &mirroredInode{}
+			m.inodes[child] = e
+		}
+		e.lookups++
+		m.mu.Unlock()
+	}
+
+	// Negative entries are answers like ENOENT.
+	primaryErr := err
+	if err == nil && child == 0 {
+		primaryErr = fuse.ENOENT
+	}
+
+	parent, name, attrs := op.Parent, op.Name, op.Entry.Attributes
+	m.enqueue(func() {
+		shadowParent := m.shadowInode(parent)
+		if shadowParent == 0 {
+			m.skip()
+			return
+		}
+
+		sub := fuseops.LookUpInodeOp{Parent: shadowParent, Name: name}
+		shadowErr := m.shadow.LookUpInode(context.Background(), &sub)
+		shadowChild := sub.Entry.Child
+		if shadowErr == nil && shadowChild == 0 {
+			shadowErr = fuse.ENOENT
+		}
+
+		m.compareAttributes(
+			fmt.Sprintf("LookUpInode(%v, %q)", parent, name),
+			primaryErr,
+			attrs,
+			shadowErr,
+			sub.Entry.Attributes)
+
+		if shadowErr != nil {
+			return
+		}
+
+		// Remember the shadow's ID while the primary's inode is still known.
+		// Otherwise, or if the shadow has changed its mind about the ID, give
+		// the lookup back.
+		m.mu.Lock()
+		e := m.inodes[child]
+		keep := primaryErr == nil && e != nil && (e.shadow == 0 || e.shadow == shadowChild)
+		if keep {
+			e.shadow = shadowChild
+			e.shadowLookups++
+		}
+		m.mu.Unlock()
+
+		if !keep {
+			m.shadow.ForgetInode(
+				context.Background(),
+				&fuseops.ForgetInodeOp{Inode: shadowChild, N: 1})
+		}
+	})
+
+	return err
+}
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	err := m.FileSystem.GetInodeAttributes(ctx, op)
+
+	inode, attrs := op.Inode, op.Attributes
+	m.enqueue(func() {
+		shadowInode := m.shadowInode(inode)
+		if shadowInode == 0 {
+			m.skip()
+			return
+		}
+
+		sub := fuseops.GetInodeAttributesOp{Inode: shadowInode}
+		shadowErr := m.shadow.GetInodeAttributes(context.Background(), &sub)
+		m.compareAttributes(
+			fmt.Sprintf("GetInodeAttributes(%v)", inode),
+			err,
+			attrs,
+			shadowErr,
+			sub.Attributes)
+	})
+
+	return err
+}
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	err := m.FileSystem.ReadSymlink(ctx, op)
+
+	inode, target := op.Inode, op.Target
+	m.enqueue(func() {
+		shadowInode := m.shadowInode(inode)
+		if shadowInode == 0 {
+			m.skip()
+			return
+		}
+
+		sub := fuseops.ReadSymlinkOp{Inode: shadowInode}
+		shadowErr := m.shadow.ReadSymlink(context.Background(), &sub)
+		m.compare(
+			fmt.Sprintf("ReadSymlink(%v)", inode),
+			err == shadowErr && (err != nil || target == sub.Target),
+			describeAnswer(err, fmt.Sprintf("%q", target)),
+			describeAnswer(shadowErr, fmt.Sprintf("%q", sub.Target)))
+	})
+
+	return err
+}
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	err := m.FileSystem.GetXattr(ctx, op)
+
+	// An empty buffer asks for the size only.
+	inode, name, size := op.Inode, op.Name, len(op.Dst)
+	var value []byte
+	if err == nil && size > 0 {
+		value = append(value, op.Dst[:op.BytesRead]...)
+	}
+
+	bytesRead := op.BytesRead
+	m.enqueue(func() {
+		shadowInode := m.shadowInode(inode)
+		if shadowInode == 0 {
+			m.skip()
+			return
+		}
+
+		sub := fuseops.GetXattrOp{
+			Inode: shadowInode,
+			Name:  name,
+			Dst:   make([]byte, size),
+		}
+
+		shadowErr := m.shadow.GetXattr(context.Background(), &sub)
+		shadowValue := sub.Dst[:0]
+		if shadowErr == nil && size > 0 {
+			shadowValue = sub.Dst[:sub.BytesRead]
+		}
+
+		m.compare(
+			fmt.Sprintf("GetXattr(%v, %q)", inode, name),
+			err == shadowErr && (err != nil || bytesRead == sub.BytesRead && bytes.Equal(value, shadowValue)),
+			describeAnswer(err, fmt.Sprintf("%d bytes %q", bytesRead, value)),
+			describeAnswer(shadowErr, fmt.Sprintf("%d bytes %q", sub.BytesRead, shadowValue)))
+	})
+
+	return err
+}
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	err := m.FileSystem.ListXattr(ctx, op)
+
+	inode, size := op.Inode, len(op.Dst)
+	var names []string
+	if err == nil && size > 0 {
+		names = xattrNames(op.Dst[:op.BytesRead])
+	}
+
+	bytesRead := op.BytesRead
+	m.enqueue(func() {
+		shadowInode := m.shadowInode(inode)
+		if shadowInode == 0 {
+			m.skip()
+			return
+		}
+
+		sub := fuseops.ListXattrOp{Inode: shadowInode, Dst: make([]byte, size)}
+		shadowErr := m.shadow.ListXattr(context.Background(), &sub)
+
+		var shadowNames []string
+		if shadowErr == nil && size > 0 {
+			shadowNames = xattrNames(sub.Dst[:sub.BytesRead])
+		}
+
+		// The order of the names doesn't matter.
+		m.compare(
+			fmt.Sprintf("ListXattr(%v)", inode),
+			err == shadowErr && (err != nil || bytesRead == sub.BytesRead && fmt.Sprint(names) == fmt.Sprint(shadowNames)),
+			describeAnswer(err, names),
+			describeAnswer(shadowErr, shadowNames))
+	})
+
+	return err
+}
+
+// Split a list of NUL-terminated extended attribute names, in sorted order.
+func xattrNames(buf []byte) []string {
+	var names []string
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	err := m.FileSystem.ReadFile(ctx, op)
+
+	// Copy the data now, as the buffers are reused once the op is answered.
+	inode, offset, size := op.Inode, op.Offset, op.Size
+	var data []byte
+	if err == nil {
+		data = readData(op)
+	}
+
+	m.enqueue(func() {
+		shadowInode := m.shadowInode(inode)
+		if shadowInode == 0 {
+			m.skip()
+			return
+		}
+
+		ctx := context.Background()
+		openOp := fuseops.OpenFileOp{Inode: shadowInode}
+		if err := m.shadow.OpenFile(ctx, &openOp); err != nil && err != fuse.ENOSYS {
+			m.compare(
+				fmt.Sprintf("ReadFile(%v) opening", inode),
+				false,
+				"open",
+				describeAnswer(err, nil))
+			return
+		}
+
+		defer m.shadow.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+		sub := fuseops.ReadFileOp{
+			Inode:  shadowInode,
+			Handle: openOp.Handle,
+			Offset: offset,
+			Size:   size,
+			Dst:    make([]byte, size),
+		}
+
+		shadowErr := m.shadow.ReadFile(ctx, &sub)
+		var shadowData []byte
+		if shadowErr == nil {
+			shadowData = readData(&sub)
+		}
+
+		if sub.Callback != nil {
+			sub.Callback()
+		}
+
+		m.compare(
+			fmt.Sprintf("ReadFile(%v, %d, %d)", inode, offset, size),
+			err == shadowErr && bytes.Equal(data, shadowData),
+			describeAnswer(err, fmt.Sprintf("%d bytes", len(data))),
+			describeAnswer(shadowErr, fmt.Sprintf("%d bytes", len(shadowData))))
+	})
+
+	return err
+}
+
+// Return a copy of the data read by a ReadFileOp, whether into Dst or as Data.
+func readData(op *fuseops.ReadFileOp) []byte {
+	var data []byte
+	if op.Dst != nil {
+		data = append(data, op.Dst[:op.BytesRead]...)
+	}
+
+	for _, b := range op.Data {
+		data = append(data, b...)
+	}
+
+	return data
+}
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	err := m.FileSystem.ReadDir(ctx, op)
+
+	// Compare only listings that are known to be complete: those starting at
+	// the beginning that left room for an entry with the longest name.
+	const maxDirentSize = direntSize + 256
+	if err != nil || op.Offset != 0 || len(op.Dst)-op.BytesRead < maxDirentSize {
+		return err
+	}
+
+	inode := op.Inode
+	entries := direntNames(parseDirents(op.Dst[:op.BytesRead]))
+	m.enqueue(func() {
+		shadowInode := m.shadowInode(inode)
+		if shadowInode == 0 {
+			m.skip()
+			return
+		}
+
+		shadowDirents, shadowErr := listDir(context.Background(), m.shadow, shadowInode)
+		shadowEntries := direntNames(shadowDirents)
+		m.compare(
+			fmt.Sprintf("ReadDir(%v)", inode),
+			shadowErr == nil && fmt.Sprint(entries) == fmt.Sprint(shadowEntries),
+			entries,
+			describeAnswer(shadowErr, shadowEntries))
+	})
+
+	return err
+}
+
+// Describe each entry other than "." and ".." by its name and type, in sorted
+// order.
+func direntNames(dirents []Dirent) []string {
+	var entries []string
+	for _, d := range dirents {
+		if d.Name != "." && d.Name != ".." {
+			entries = append(entries, fmt.Sprintf("%s (%v)", d.Name, d.Type))
+		}
+	}
+
+	sort.Strings(entries)
+	return entries
+}
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	m.forget(op.Inode, op.N)
+	return m.FileSystem.ForgetInode(ctx, op)
+}
+
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		m.forget(e.Inode, e.N)
+	}
+
+	return m.FileSystem.BatchForget(ctx, op)
+}
+
+// Once the kernel has forgotten all the lookups of an inode that we have
+// seen, give back the shadow's lookups. Lookups by ops other than
+// LookUpInode are not seen, so the count is floored at zero.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *Mirror) forget(inode fuseops.InodeID, n uint64) {
+	m.mu.Lock()
+	e := m.inodes[inode]
+	if e == nil || inode == fuseops.RootInodeID {
+		m.mu.Unlock()
+		return
+	}
+
+	if n < e.lookups {
+		e.lookups -= n
+		m.mu.Unlock()
+		return
+	}
+
+	delete(m.inodes, inode)
+	shadow, shadowLookups := e.shadow, e.shadowLookups
+	m.mu.Unlock()
+
+	// Forgets are never dropped, so wait for room if need be.
+	if shadowLookups > 0 {
+		m.queue <- func() {
+			m.shadow.ForgetInode(
+				context.Background(),
+				&fuseops.ForgetInodeOp{Inode: shadow, N: shadowLookups})
+		}
+	}
+}
+
+func (m *Mirror) Destroy() {
+	m.FileSystem.Destroy()
+
+	close(m.queue)
+	<-m.done
+	m.shadow.Destroy()
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	mtime := time.Unix(1234, 0)
+	content := func(s string) func() ([]byte, error) {
+		return func() ([]byte, error) { return []byte(s), nil }
+	}
+
+	// The same tree, with one file's contents changed, and the entries in a
+	// different order so that the inode IDs differ.
+	primary, err := fuseutil.NewStaticFS(&fuseutil.StaticNode{
+		Mode: os.ModeDir | 0755,
+		Children: []*fuseutil.StaticNode{
+			{Name: "taco", Mtime: mtime, Content: content("carnitas")},
+			{Name: "burrito", Mtime: mtime, Content: content("asada")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewStaticFS: %v", err)
+	}
+
+	shadow, err := fuseutil.NewStaticFS(&fuseutil.StaticNode{
+		Mode: os.ModeDir | 0755,
+		Children: []*fuseutil.StaticNode{
+			{Name: "burrito", Mtime: mtime, Content: content("asada")},
+			{Name: "taco", Mtime: mtime, Content: content("pastor!!")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewStaticFS: %v", err)
+	}
+
+	var logs bytes.Buffer
+	m := fuseutil.NewMirror(primary, shadow, log.New(&logs, "", 0))
+
+	read := func(name string) string {
+		lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+		if err := m.LookUpInode(ctx, lookUp); err != nil {
+			t.Fatalf("LookUpInode: %v", err)
+		}
+
+		// Let the shadow learn its inode ID before reading.
+		m.WaitForShadow()
+
+		open := &fuseops.OpenFileOp{Inode: lookUp.Entry.Child}
+		if err := m.OpenFile(ctx, open); err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+
+		op := &fuseops.ReadFileOp{
+			Inode:  lookUp.Entry.Child,
+			Handle: open.Handle,
+			Size:   100,
+			Dst:    make([]byte, 100),
+		}
+
+		if err := m.ReadFile(ctx, op); err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+
+		return string(op.Dst[:op.BytesRead])
+	}
+
+	// What is returned comes from the primary.
+	if got := read("burrito"); got != "asada" {
+		t.Errorf("burrito: %q", got)
+	}
+
+	if got := read("taco"); got != "carnitas" {
+		t.Errorf("taco: %q", got)
+	}
+
+	m.WaitForShadow()
+	if s := m.Stats(); s.Matched != 3 || s.Diverged != 1 || s.Skipped != 0 {
+		t.Errorf("Stats: %+v", s)
+	}
+
+	if !strings.Contains(logs.String(), "ReadFile") || strings.Count(logs.String(), "\n") != 1 {
+		t.Errorf("Logs: %s", logs.String())
+	}
+
+	// Ops on inodes the shadow hasn't looked up are skipped.
+	if err := m.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: 17}); err == nil {
+		t.Errorf("GetInodeAttributes succeeded for unknown inode")
+	}
+
+	m.WaitForShadow()
+	if s := m.Stats(); s.Skipped != 1 {
+		t.Errorf("Stats: %+v", s)
+	}
+
+	m.Destroy()
+}
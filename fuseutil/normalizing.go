@@ -0,0 +1,249 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewNormalizingFileSystem wraps a file system so that the names it sees and
+// returns are in a single Unicode normalization form, given by normalize. For
+// example, pass norm.NFC.String from golang.org/x/text/unicode/norm.
+//
+// macOS applications tend to use decomposed names (NFD) where Linux ones use
+// precomposed names (NFC), so without this a file created as "café" by one
+// client of a shared backend may not be found by the other, and the other may
+// create a second file that looks the same. With it:
+//
+//   - Names in ops that create entries are normalized, so the backend only
+//     gains names in the chosen form.
+//
+//   - Names in ops that refer to existing entries are normalized, and if the
+//     wrapped file system reports ENOENT, the parent directory is listed to
+//     find an entry whose name normalizes to the same thing, for backends that
+//     already hold names in other forms.
+//
+//   - Names returned by ReadDir are normalized.
+//
+//   - Negative entries from LookUpInode become ENOENT, since the kernel would
+//     cache them under the form it asked for, hiding an entry later created
+//     in another form.
+//
+// Directories that already hold two names normalizing to the same thing list
+// both, and only one of them can be looked up.
+func NewNormalizingFileSystem(
+	wrapped FileSystem,
+	normalize func(string) string) FileSystem {
+	return &normalizingFS{
+		FileSystem: wrapped,
+		normalize:  normalize,
+	}
+}
+
+type normalizingFS struct {
+	FileSystem
+	normalize func(string) string
+}
+
+// Find the name of an entry in the directory whose normalized form is the
+// supplied (normalized) name, other than the name itself. Return the empty
+// string if there is none.
+func (fs *normalizingFS) resolve(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string) (string, error) {
+	entries, err := listDir(ctx, fs.FileSystem, parent)
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range entries {
+		if e.Name != name && fs.normalize(e.Name) == name {
+			return e.Name, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Call f with the normalized name and, if it reports ENOENT and the directory
+// holds the name in another form, again with that form.
+func (fs *normalizingFS) withExisting(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string,
+	f func(name string) error) error {
+	normalized := fs.normalize(name)
+	err := f(normalized)
+	if err != fuse.ENOENT {
+		return err
+	}
+
+	stored, resolveErr := fs.resolve(ctx, parent, normalized)
+	if resolveErr != nil || stored == "" {
+		return err
+	}
+
+	return f(stored)
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *normalizingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.withExisting(ctx, op.Parent, op.Name, func(name string) error {
+		sub := *op
+		sub.Name = name
+		if err := fs.FileSystem.LookUpInode(ctx, &sub); err != nil {
+			return err
+		}
+
+		// Treat a negative entry as not found, so the other form is tried.
+		if sub.Entry.Child == 0 {
+			return fuse.ENOENT
+		}
+
+		op.Entry = sub.Entry
+		return nil
+	})
+}
+
+func (fs *normalizingFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	op.Name = fs.normalize(op.Name)
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+func (fs *normalizingFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	op.Name = fs.normalize(op.Name)
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+func (fs *normalizingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	op.Name = fs.normalize(op.Name)
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func (fs *normalizingFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	op.Name = fs.normalize(op.Name)
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+func (fs *normalizingFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	op.Name = fs.normalize(op.Name)
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+func (fs *normalizingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	// The new name is normalized; an existing entry under another form is
+	// left alone rather than replaced.
+	newName := fs.normalize(op.NewName)
+	return fs.withExisting(ctx, op.OldParent, op.OldName, func(name string) error {
+		sub := *op
+		sub.OldName = name
+		sub.NewName = newName
+		return fs.FileSystem.Rename(ctx, &sub)
+	})
+}
+
+func (fs *normalizingFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.withExisting(ctx, op.Parent, op.Name, func(name string) error {
+		sub := *op
+		sub.Name = name
+		return fs.FileSystem.RmDir(ctx, &sub)
+	})
+}
+
+func (fs *normalizingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.withExisting(ctx, op.Parent, op.Name, func(name string) error {
+		sub := *op
+		sub.Name = name
+		return fs.FileSystem.Unlink(ctx, &sub)
+	})
+}
+
+func (fs *normalizingFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	// Normalization may lengthen names, so read into a scratch buffer and
+	// re-render as many entries as fit. Each entry carries its own offset, so
+	// those that don't fit are read again next time.
+	dst := op.Dst
+	sub := *op
+	sub.Dst = make([]byte, len(dst))
+	if err := fs.FileSystem.ReadDir(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.BytesRead = 0
+	for _, e := range parseDirents(sub.Dst[:sub.BytesRead]) {
+		e.Name = fs.normalize(e.Name)
+		n := WriteDirent(dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *normalizingFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	// As for ReadDir, keeping each entry's inode as it is.
+	dst := op.Dst
+	sub := *op
+	sub.Dst = make([]byte, len(dst))
+	if err := fs.FileSystem.ReadDirPlus(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.BytesRead = 0
+	for _, e := range splitDirentsPlus(sub.Dst[:sub.BytesRead]) {
+		d := parseDirents(e[entryOutSize:])[0]
+		d.Name = fs.normalize(d.Name)
+		n := writeDirentPlus(dst[op.BytesRead:], e[:entryOutSize], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const (
+	cafeNFC = "caf\u00e9"
+	cafeNFD = "cafe\u0301"
+)
+
+// A stand-in for norm.NFC.String that knows about one character.
+var toNFC = strings.NewReplacer("e\u0301", "\u00e9").Replace
+
+func TestNormalizingFileSystem(t *testing.T) {
+	ctx := context.Background()
+	wrapped := newFlatFS()
+	fs := fuseutil.NewNormalizingFileSystem(wrapped, toNFC)
+
+	// Names are stored in the chosen form, whichever form they arrive in.
+	if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: 1, Name: cafeNFD}); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	if got := wrapped.names(); len(got) != 1 || got[0] != cafeNFC {
+		t.Errorf("Names: %q", got)
+	}
+
+	err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: 1, Name: cafeNFC})
+	if err != fuse.EEXIST {
+		t.Errorf("CreateFile(NFC): %v", err)
+	}
+
+	for _, name := range []string{cafeNFC, cafeNFD} {
+		op := &fuseops.LookUpInodeOp{Parent: 1, Name: name}
+		if err := fs.LookUpInode(ctx, op); err != nil || op.Entry.Child != 2 {
+			t.Errorf("LookUpInode(%q): %v, %v", name, err, op.Entry.Child)
+		}
+	}
+
+	// Names already stored in another form are found, and listed normalized.
+	delete(wrapped.children, cafeNFC)
+	wrapped.children["ne\u0301"] = 3
+
+	op := &fuseops.LookUpInodeOp{Parent: 1, Name: "n\u00e9"}
+	if err := fs.LookUpInode(ctx, op); err != nil || op.Entry.Child != 3 {
+		t.Errorf("LookUpInode(né): %v, %v", err, op.Entry.Child)
+	}
+
+	readOp := &fuseops.ReadDirOp{Inode: 1, Dst: make([]byte, 4096)}
+	if err := fs.ReadDir(ctx, readOp); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	if !strings.Contains(string(readOp.Dst[:readOp.BytesRead]), "n\u00e9") {
+		t.Errorf("Listing doesn't contain the normalized name: %q", readOp.Dst[:readOp.BytesRead])
+	}
+
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "n\u00e9"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	if _, ok := wrapped.children["ne\u0301"]; ok {
+		t.Errorf("Entry stored in another form not unlinked")
+	}
+}
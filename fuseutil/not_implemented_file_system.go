@@ -25,6 +25,9 @@ import (
 // struct to inherit default implementations for the methods you don't care
 // about, ensuring your struct will continue to implement FileSystem even as
 // new methods are added.
+//
+// To answer some of those ops otherwise, e.g. to make syncs succeed, see
+// UnsupportedOps.
 type NotImplementedFileSystem struct {
 }
 
@@ -36,6 +39,12 @@ func (fs *NotImplementedFileSystem) StatFS(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) error {
@@ -54,6 +63,18 @@ func (fs *NotImplementedFileSystem) SetInodeAttributes(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) Statx(
+	ctx context.Context,
+	op *fuseops.StatxOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) ForgetInode(
 	ctx context.Context,
 	op *fuseops.ForgetInodeOp) error {
@@ -84,6 +105,12 @@ func (fs *NotImplementedFileSystem) CreateFile(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) CreateTmpfile(
+	ctx context.Context,
+	op *fuseops.CreateTmpfileOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) CreateSymlink(
 	ctx context.Context,
 	op *fuseops.CreateSymlinkOp) error {
@@ -126,6 +153,12 @@ func (fs *NotImplementedFileSystem) ReadDir(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) error {
@@ -204,5 +237,59 @@ func (fs *NotImplementedFileSystem) Fallocate(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Flock(
+	ctx context.Context,
+	op *fuseops.FlockOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetLkWait(
+	ctx context.Context,
+	op *fuseops.SetLkWaitOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetVolumeName(
+	ctx context.Context,
+	op *fuseops.SetVolumeNameOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) GetXtimes(
+	ctx context.Context,
+	op *fuseops.GetXtimesOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) Destroy() {
 }
@@ -0,0 +1,211 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Bits of the mask passed to CheckAccess, with the same values as for
+// access(2).
+const (
+	AccessExecute uint32 = 1
+	AccessWrite   uint32 = 2
+	AccessRead    uint32 = 4
+)
+
+// The functions below make the permission checks that the kernel makes when
+// the file system is mounted with default_permissions, for file systems that
+// set MountConfig.DisableDefaultPermissions but still want POSIX semantics,
+// e.g. to apply them selectively or to check against attributes fresher than
+// the kernel's. They follow generic_permission and friends in the Linux
+// kernel:
+//
+//   - A caller whose UID is the inode's owner gets the owner's permission
+//     bits, and no others. Otherwise one belonging to the inode's group gets
+//     the group's bits, and anybody else the rest.
+//
+//   - A caller with UID zero may read and write anything, and execute
+//     anything that is a directory or executable by somebody.
+//
+//   - A caller belongs to its GID and to OpContext.Groups. The kernel supplies
+//     supplementary groups only for ops that create entries, so a file system
+//     that wants them counted elsewhere must fill them in itself, e.g. from
+//     /proc/<pid>/status.
+//
+// Access control lists are not consulted.
+
+// CheckAccess returns nil if the caller may access the inode in all of the
+// ways given by mask, and EACCES otherwise.
+func CheckAccess(
+	attrs *fuseops.InodeAttributes,
+	caller *fuseops.OpContext,
+	mask uint32) error {
+	if caller.Uid == 0 {
+		if mask&AccessExecute == 0 || attrs.Mode.IsDir() || attrs.Mode&0111 != 0 {
+			return nil
+		}
+
+		return syscall.EACCES
+	}
+
+	var perm uint32
+	switch {
+	case caller.Uid == attrs.Uid:
+		perm = uint32(attrs.Mode>>6) & 7
+	case inGroup(caller, attrs.Gid):
+		perm = uint32(attrs.Mode>>3) & 7
+	default:
+		perm = uint32(attrs.Mode) & 7
+	}
+
+	if mask&^perm != 0 {
+		return syscall.EACCES
+	}
+
+	return nil
+}
+
+// CheckRemove returns nil if the caller may remove the child from the
+// directory, as for UnlinkOp and RmDirOp, and for RenameOp for the entry
+// being renamed and any entry it replaces. That takes write and search access
+// to the directory, and, if the directory is sticky, ownership of the
+// directory or the child. The error is EACCES or, for a sticky directory,
+// EPERM.
+func CheckRemove(
+	dir *fuseops.InodeAttributes,
+	child *fuseops.InodeAttributes,
+	caller *fuseops.OpContext) error {
+	if err := CheckAccess(dir, caller, AccessWrite|AccessExecute); err != nil {
+		return err
+	}
+
+	if dir.Mode&os.ModeSticky != 0 &&
+		caller.Uid != 0 &&
+		caller.Uid != dir.Uid &&
+		caller.Uid != child.Uid {
+		return syscall.EPERM
+	}
+
+	return nil
+}
+
+// CheckSetAttributes returns nil if the caller of the op may make the changes
+// it asks for to an inode with the given attributes, and EPERM or EACCES
+// otherwise:
+//
+//   - Only the owner may change the mode. If the owner doesn't belong to the
+//     inode's group, the setgid bit is silently cleared from *op.Mode, as
+//     chmod(2) does.
+//
+//   - Only UID zero may change the owner. The owner may change the group to
+//     one it belongs to.
+//
+//   - Truncating a file other than through a handle takes write access.
+//
+//   - The times may be changed by the owner, or by anybody with write access.
+//     The op doesn't say whether they are being set to the current time,
+//     which needs only write access, or to given values, which needs
+//     ownership, so the latter is allowed too.
+//
+// In each case UID zero may do anything. Changing the owner or group of a
+// file doesn't clear its setuid and setgid bits; see KillSetID.
+func CheckSetAttributes(
+	attrs *fuseops.InodeAttributes,
+	op *fuseops.SetInodeAttributesOp) error {
+	caller := &op.OpContext
+	if caller.Uid == 0 {
+		return nil
+	}
+
+	owner := caller.Uid == attrs.Uid
+
+	if op.Uid != nil && *op.Uid != attrs.Uid {
+		return syscall.EPERM
+	}
+
+	if op.Gid != nil && *op.Gid != attrs.Gid && !(owner && inGroup(caller, *op.Gid)) {
+		return syscall.EPERM
+	}
+
+	if op.Mode != nil {
+		if !owner {
+			return syscall.EPERM
+		}
+
+		gid := attrs.Gid
+		if op.Gid != nil {
+			gid = *op.Gid
+		}
+
+		if !inGroup(caller, gid) {
+			*op.Mode &^= os.ModeSetgid
+		}
+	}
+
+	if op.Size != nil && op.Handle == nil {
+		if err := CheckAccess(attrs, caller, AccessWrite); err != nil {
+			return err
+		}
+	}
+
+	if (op.Atime != nil || op.Mtime != nil) && !owner {
+		if err := CheckAccess(attrs, caller, AccessWrite); err != nil {
+			return syscall.EPERM
+		}
+	}
+
+	return nil
+}
+
+// KillSetID returns the mode that an inode should be left with after the
+// caller writes to or truncates it, or, with chown set, changes the owner or
+// group of a file other than a directory: without the setuid bit, and without
+// the setgid bit if the file is group-executable (otherwise the bit marks
+// mandatory locking rather than a setgid program). Writes by UID zero leave
+// the mode unchanged, as the kernel does for callers with CAP_FSETID.
+func KillSetID(
+	mode os.FileMode,
+	caller *fuseops.OpContext,
+	chown bool) os.FileMode {
+	if caller.Uid == 0 && !chown {
+		return mode
+	}
+
+	mode &^= os.ModeSetuid
+	if mode&0010 != 0 {
+		mode &^= os.ModeSetgid
+	}
+
+	return mode
+}
+
+// Does the caller belong to the group?
+func inGroup(caller *fuseops.OpContext, gid uint32) bool {
+	if caller.Gid == gid {
+		return true
+	}
+
+	for _, g := range caller.Groups {
+		if g == gid {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestCheckAccess(t *testing.T) {
+	file := &fuseops.InodeAttributes{Mode: 0640, Uid: 1000, Gid: 100}
+	dir := &fuseops.InodeAttributes{Mode: os.ModeDir | 0700, Uid: 1000, Gid: 100}
+
+	owner := &fuseops.OpContext{Uid: 1000, Gid: 1000}
+	member := &fuseops.OpContext{Uid: 1001, Gid: 1001, Groups: []uint32{100}}
+	other := &fuseops.OpContext{Uid: 1002, Gid: 1002}
+	root := &fuseops.OpContext{}
+
+	testCases := []struct {
+		attrs  *fuseops.InodeAttributes
+		caller *fuseops.OpContext
+		mask   uint32
+		want   error
+	}{
+		{file, owner, fuseutil.AccessRead | fuseutil.AccessWrite, nil},
+		{file, owner, fuseutil.AccessExecute, syscall.EACCES},
+		{file, member, fuseutil.AccessRead, nil},
+		{file, member, fuseutil.AccessWrite, syscall.EACCES},
+		{file, other, fuseutil.AccessRead, syscall.EACCES},
+		{file, root, fuseutil.AccessRead | fuseutil.AccessWrite, nil},
+		{file, root, fuseutil.AccessExecute, syscall.EACCES},
+		{dir, root, fuseutil.AccessExecute, nil},
+		{dir, member, fuseutil.AccessExecute, syscall.EACCES},
+
+		// The owner gets the owner's bits even if the group's are more
+		// generous.
+		{&fuseops.InodeAttributes{Mode: 0070, Uid: 1000, Gid: 1000}, owner, fuseutil.AccessRead, syscall.EACCES},
+	}
+
+	for i, tc := range testCases {
+		if got := fuseutil.CheckAccess(tc.attrs, tc.caller, tc.mask); got != tc.want {
+			t.Errorf("Case %d: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestCheckRemove(t *testing.T) {
+	tmp := &fuseops.InodeAttributes{Mode: os.ModeDir | os.ModeSticky | 0777}
+	child := &fuseops.InodeAttributes{Mode: 0600, Uid: 1000}
+
+	if err := fuseutil.CheckRemove(tmp, child, &fuseops.OpContext{Uid: 1000}); err != nil {
+		t.Errorf("Owner: %v", err)
+	}
+
+	if err := fuseutil.CheckRemove(tmp, child, &fuseops.OpContext{Uid: 1001}); err != syscall.EPERM {
+		t.Errorf("Other: %v", err)
+	}
+
+	tmp.Mode &^= os.ModeSticky
+	if err := fuseutil.CheckRemove(tmp, child, &fuseops.OpContext{Uid: 1001}); err != nil {
+		t.Errorf("Other, not sticky: %v", err)
+	}
+
+	tmp.Mode = os.ModeDir | 0755
+	if err := fuseutil.CheckRemove(tmp, child, &fuseops.OpContext{Uid: 1000}); err != syscall.EACCES {
+		t.Errorf("Read-only directory: %v", err)
+	}
+}
+
+func TestCheckSetAttributes(t *testing.T) {
+	attrs := &fuseops.InodeAttributes{Mode: 0664, Uid: 1000, Gid: 100}
+	owner := fuseops.OpContext{Uid: 1000, Gid: 1000}
+	member := fuseops.OpContext{Uid: 1001, Gid: 100}
+
+	// The owner may chmod, but can't make the file setgid for a group it
+	// doesn't belong to.
+	mode := os.ModeSetgid | 0755
+	op := &fuseops.SetInodeAttributesOp{Mode: &mode, OpContext: owner}
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != nil || mode != 0755 {
+		t.Errorf("chmod by owner: %v, %v", err, mode)
+	}
+
+	op = &fuseops.SetInodeAttributesOp{Mode: &mode, OpContext: member}
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != syscall.EPERM {
+		t.Errorf("chmod by member: %v", err)
+	}
+
+	// Only root may give the file away.
+	uid := uint32(1001)
+	op = &fuseops.SetInodeAttributesOp{Uid: &uid, OpContext: owner}
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != syscall.EPERM {
+		t.Errorf("chown by owner: %v", err)
+	}
+
+	op.OpContext = fuseops.OpContext{}
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != nil {
+		t.Errorf("chown by root: %v", err)
+	}
+
+	// The owner may change the group to one it belongs to.
+	gid := uint32(1000)
+	op = &fuseops.SetInodeAttributesOp{Gid: &gid, OpContext: owner}
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != nil {
+		t.Errorf("chgrp to own group: %v", err)
+	}
+
+	gid = 1001
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != syscall.EPERM {
+		t.Errorf("chgrp to other group: %v", err)
+	}
+
+	// Truncating and touching take write access.
+	size := uint64(0)
+	op = &fuseops.SetInodeAttributesOp{Size: &size, OpContext: member}
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != nil {
+		t.Errorf("truncate by member: %v", err)
+	}
+
+	attrs.Mode = 0644
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != syscall.EACCES {
+		t.Errorf("truncate by member without write access: %v", err)
+	}
+
+	handle := fuseops.HandleID(1)
+	op.Handle = &handle
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != nil {
+		t.Errorf("ftruncate by member: %v", err)
+	}
+
+	now := time.Now()
+	op = &fuseops.SetInodeAttributesOp{Mtime: &now, OpContext: member}
+	if err := fuseutil.CheckSetAttributes(attrs, op); err != syscall.EPERM {
+		t.Errorf("touch by member without write access: %v", err)
+	}
+}
+
+func TestKillSetID(t *testing.T) {
+	user := &fuseops.OpContext{Uid: 1000}
+	root := &fuseops.OpContext{}
+
+	testCases := []struct {
+		mode   os.FileMode
+		caller *fuseops.OpContext
+		chown  bool
+		want   os.FileMode
+	}{
+		{os.ModeSetuid | os.ModeSetgid | 0755, user, false, 0755},
+		{os.ModeSetuid | os.ModeSetgid | 0755, root, false, os.ModeSetuid | os.ModeSetgid | 0755},
+		{os.ModeSetuid | os.ModeSetgid | 0755, root, true, 0755},
+
+		// Without group execute permission, setgid marks mandatory locking.
+		{os.ModeSetgid | 0644, user, false, os.ModeSetgid | 0644},
+	}
+
+	for i, tc := range testCases {
+		if got := fuseutil.KillSetID(tc.mode, tc.caller, tc.chown); got != tc.want {
+			t.Errorf("Case %d: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Storer pushes data into the kernel's page cache. It is implemented by
+// *fuse.MountedFileSystem and *fuse.Connection.
+type Storer interface {
+	NotifyStore(inode fuseops.InodeID, offset uint64, data []byte) error
+}
+
+// The largest store notification sent by PrewarmFile. Each notification is a
+// single write to the device, so keep them to a size the kernel handles
+// comfortably.
+const prewarmChunkSize = 128 << 10
+
+// PrewarmFile places data, which must be the contents of the inode starting
+// at offset, into the kernel's page cache, so that subsequent reads of that
+// range are served without a ReadFileOp. The inode must be known to the kernel
+// (i.e. have a non-zero lookup count).
+func PrewarmFile(
+	s Storer,
+	inode fuseops.InodeID,
+	offset int64,
+	data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > prewarmChunkSize {
+			n = prewarmChunkSize
+		}
+
+		if err := s.NotifyStore(inode, uint64(offset), data[:n]); err != nil {
+			return err
+		}
+
+		offset += int64(n)
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// FetchFunc reads up to size bytes of the inode's contents at offset from a
+// file system's backing store. A short result means end of file.
+type FetchFunc func(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	offset int64,
+	size int) ([]byte, error)
+
+// Prefetcher prewarms the kernel's page cache ahead of readers. It detects
+// sequential reads of each inode, as reported to ObserveRead, and once a
+// reader has made two consecutive reads it fetches the next window of the
+// file in the background and stores it with PrewarmFile. File systems may
+// also request a prefetch explicitly with Hint, e.g. in response to an
+// application-level hint or a known access pattern.
+//
+// It is safe for concurrent use.
+type Prefetcher struct {
+	storer      Storer
+	fetch       FetchFunc
+	window      int
+	errorLogger *log.Logger
+
+	mu sync.Mutex
+
+	streams map[fuseops.InodeID]*readStream // GUARDED_BY(mu)
+}
+
+type readStream struct {
+	// The offset at which the next read would be sequential.
+	next int64
+
+	// The number of consecutive sequential reads seen, including the first.
+	run int
+
+	// The end of the range already prefetched or being prefetched.
+	prefetchedTo int64
+}
+
+// NewPrefetcher creates a Prefetcher that reads from the backing store with
+// fetch and keeps window bytes prefetched ahead of sequential readers. Errors
+// from background prefetches are logged to errorLogger, which may be nil.
+func NewPrefetcher(
+	s Storer,
+	fetch FetchFunc,
+	window int,
+	errorLogger *log.Logger) *Prefetcher {
+	return &Prefetcher{
+		storer:      s,
+		fetch:       fetch,
+		window:      window,
+		errorLogger: errorLogger,
+		streams:     make(map[fuseops.InodeID]*readStream),
+	}
+}
+
+// ObserveRead records that n bytes of the inode were read at offset. Call it
+// from ReadFileOp after a successful read.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Prefetcher) ObserveRead(
+	inode fuseops.InodeID,
+	offset int64,
+	n int) {
+	end := offset + int64(n)
+
+	p.mu.Lock()
+	s := p.streams[inode]
+	if s == nil || s.next != offset {
+		s = &readStream{prefetchedTo: end}
+		p.streams[inode] = s
+	}
+
+	s.next = end
+	s.run++
+
+	// Top up the window once the reader looks sequential.
+	var start, size int64
+	if s.run >= 2 && s.prefetchedTo < end+int64(p.window) {
+		start = s.prefetchedTo
+		if start < end {
+			start = end
+		}
+
+		size = end + int64(p.window) - start
+		s.prefetchedTo = start + size
+	}
+	p.mu.Unlock()
+
+	if size > 0 {
+		go func() {
+			err := p.Hint(context.Background(), inode, start, int(size))
+			if err != nil && p.errorLogger != nil {
+				p.errorLogger.Printf("Prefetching inode %v at %d: %v", inode, start, err)
+			}
+		}()
+	}
+}
+
+// Hint fetches size bytes of the inode at offset from the backing store and
+// stores them in the kernel's page cache, returning when done.
+func (p *Prefetcher) Hint(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	offset int64,
+	size int) error {
+	data, err := p.fetch(ctx, inode, offset, size)
+	if err != nil {
+		return err
+	}
+
+	return PrewarmFile(p.storer, inode, offset, data)
+}
+
+// ForgetInode discards the read history for the inode. Call it when the
+// inode's lookup count reaches zero, or when its contents change.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Prefetcher) ForgetInode(inode fuseops.InodeID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.streams, inode)
+}
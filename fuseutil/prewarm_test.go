@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func (n *recordingNotifier) NotifyStore(
+	inode fuseops.InodeID,
+	offset uint64,
+	data []byte) error {
+	n.notifications <- fmt.Sprintf("store %d [%d, +%d)", inode, offset, len(data))
+	return nil
+}
+
+func TestPrewarmFileChunks(t *testing.T) {
+	n := newRecordingNotifier()
+	if err := fuseutil.PrewarmFile(n, 17, 10, make([]byte, 300<<10)); err != nil {
+		t.Fatalf("PrewarmFile: %v", err)
+	}
+
+	want := []string{
+		"store 17 [10, +131072)",
+		"store 17 [131082, +131072)",
+		"store 17 [262154, +45056)",
+	}
+
+	for _, w := range want {
+		if got := n.next(); got != w {
+			t.Errorf("Notification = %q, want %q", got, w)
+		}
+	}
+}
+
+func TestPrefetcher(t *testing.T) {
+	n := newRecordingNotifier()
+	fetch := func(
+		ctx context.Context,
+		inode fuseops.InodeID,
+		offset int64,
+		size int) ([]byte, error) {
+		return make([]byte, size), nil
+	}
+
+	p := fuseutil.NewPrefetcher(n, fetch, 1000, nil)
+
+	// A single read doesn't trigger anything.
+	p.ObserveRead(17, 0, 100)
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+
+	// A second sequential read fills the window.
+	p.ObserveRead(17, 100, 100)
+	if got, want := n.next(), "store 17 [200, +1000)"; got != want {
+		t.Errorf("Notification = %q, want %q", got, want)
+	}
+
+	// Further reads top it up.
+	p.ObserveRead(17, 200, 100)
+	if got, want := n.next(), "store 17 [1200, +100)"; got != want {
+		t.Errorf("Notification = %q, want %q", got, want)
+	}
+
+	// A seek starts over.
+	p.ObserveRead(17, 5000, 100)
+	if got := n.next(); got != "" {
+		t.Errorf("Unexpected notification: %s", got)
+	}
+}
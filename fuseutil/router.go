@@ -0,0 +1,1327 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The inode and handle spaces of the router are partitioned by route: the top
+// routerShiftBits bits of an ID identify the route (with zero meaning the
+// router itself), and the remaining bits are the ID minted by the route's
+// file system.
+const (
+	routerRouteBits = 8
+	routerShiftBits = 64 - routerRouteBits
+	routerMaxRoutes = 1<<routerRouteBits - 1
+	routerLocalMask = 1<<routerShiftBits - 1
+)
+
+type route struct {
+	name  string
+	index uint64
+	fs    FileSystem
+}
+
+// NewRouter returns a file system whose root directory contains one
+// directory per entry in routes. The contents of each directory are served by
+// the corresponding file system, so that for example a tool may mount /logs
+// from one backend and /config from another under a single mount point.
+//
+// Keys are single path components, optionally with a leading slash ("logs"
+// or "/logs"). Nested prefixes are not supported. At most 255 routes may be
+// supplied, and the file systems they map to must mint inode and handle IDs
+// that fit in 56 bits; the router uses the remaining bits to tell the routes
+// apart. Operations that would span routes, such as renaming from one to
+// another, fail with EXDEV. The root directory itself is read-only.
+//
+// Each route's file system sees an ordinary mount: its root is
+// fuseops.RootInodeID, and it is never sent a ForgetInodeOp for its root.
+func NewRouter(routes map[string]FileSystem) (FileSystem, error) {
+	if len(routes) > routerMaxRoutes {
+		return nil, fmt.Errorf("Too many routes: %d > %d", len(routes), routerMaxRoutes)
+	}
+
+	r := &router{
+		byName:       make(map[string]*route),
+		rootLookups:  make(map[uint64]uint64),
+		rootUid:      uint32(os.Getuid()),
+		rootGid:      uint32(os.Getgid()),
+		rootChildren: make([]*route, 0, len(routes)),
+	}
+
+	for prefix, fs := range routes {
+		name := strings.TrimPrefix(prefix, "/")
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("Invalid route prefix %q", prefix)
+		}
+
+		if _, ok := r.byName[name]; ok {
+			return nil, fmt.Errorf("Duplicate route prefix %q", prefix)
+		}
+
+		rt := &route{name: name, fs: fs}
+		r.byName[name] = rt
+		r.rootChildren = append(r.rootChildren, rt)
+	}
+
+	// Assign indices in name order, so that inode IDs and directory offsets
+	// are stable for a given configuration.
+	sort.Slice(r.rootChildren, func(i, j int) bool {
+		return r.rootChildren[i].name < r.rootChildren[j].name
+	})
+
+	r.byIndex = make([]*route, len(r.rootChildren)+1)
+	for i, rt := range r.rootChildren {
+		rt.index = uint64(i + 1)
+		r.byIndex[rt.index] = rt
+	}
+
+	return r, nil
+}
+
+type router struct {
+	byName       map[string]*route
+	byIndex      []*route // Index zero is unused
+	rootChildren []*route // Sorted by name
+
+	rootUid uint32
+	rootGid uint32
+
+	mu sync.Mutex
+
+	// The lookup count the kernel holds for each route's root, keyed by route
+	// index. We absorb these rather than forwarding them, since from the
+	// route's point of view its root is never looked up.
+	rootLookups map[uint64]uint64 // GUARDED_BY(mu)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func encodeRouterID(index uint64, local uint64) (uint64, error) {
+	if local&^routerLocalMask != 0 {
+		return 0, fmt.Errorf("ID %#x does not fit in the router's partition", local)
+	}
+
+	return index<<routerShiftBits | local, nil
+}
+
+func (r *router) encodeInode(rt *route, id fuseops.InodeID) (fuseops.InodeID, error) {
+	v, err := encodeRouterID(rt.index, uint64(id))
+	return fuseops.InodeID(v), err
+}
+
+func (r *router) encodeHandle(rt *route, h fuseops.HandleID) (fuseops.HandleID, error) {
+	v, err := encodeRouterID(rt.index, uint64(h))
+	return fuseops.HandleID(v), err
+}
+
+// Find the route for the supplied router inode ID, returning the inode ID as
+// the route's file system knows it. Returns a nil route for the router root.
+func (r *router) decodeInode(id fuseops.InodeID) (*route, fuseops.InodeID, error) {
+	if id == fuseops.RootInodeID {
+		return nil, id, nil
+	}
+
+	index := uint64(id) >> routerShiftBits
+	if index == 0 || index >= uint64(len(r.byIndex)) {
+		return nil, 0, fuse.ENOENT
+	}
+
+	return r.byIndex[index], fuseops.InodeID(uint64(id) & routerLocalMask), nil
+}
+
+// Like decodeInode, but also decode a handle, which must belong to the same
+// route.
+func (r *router) decodeInodeAndHandle(
+	id fuseops.InodeID,
+	h fuseops.HandleID) (*route, fuseops.InodeID, fuseops.HandleID, error) {
+	rt, local, err := r.decodeInode(id)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if rt == nil {
+		return nil, local, h, nil
+	}
+
+	if uint64(h)>>routerShiftBits != rt.index {
+		return nil, 0, 0, syscall.EBADF
+	}
+
+	return rt, local, fuseops.HandleID(uint64(h) & routerLocalMask), nil
+}
+
+func (r *router) decodeHandle(h fuseops.HandleID) (*route, fuseops.HandleID, error) {
+	index := uint64(h) >> routerShiftBits
+	if index == 0 {
+		return nil, h, nil
+	}
+
+	if index >= uint64(len(r.byIndex)) {
+		return nil, 0, syscall.EBADF
+	}
+
+	return r.byIndex[index], fuseops.HandleID(uint64(h) & routerLocalMask), nil
+}
+
+func (r *router) encodeEntry(rt *route, e *fuseops.ChildInodeEntry) error {
+	var err error
+	e.Child, err = r.encodeInode(rt, e.Child)
+	return err
+}
+
+func (r *router) rootAttributes() fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Nlink: uint32(2 + len(r.rootChildren)),
+		Mode:  0555 | os.ModeDir,
+		Uid:   r.rootUid,
+		Gid:   r.rootGid,
+	}
+}
+
+// Rewrite the inode IDs in a buffer of dirents produced by a route's
+// ReadDir, so that they are expressed in the router's inode space. See
+// WriteDirent for the layout, which is in host order.
+func (r *router) rewriteDirents(rt *route, buf []byte) error {
+	for len(buf) >= direntSize {
+		ino := (*uint64)(unsafe.Pointer(&buf[0]))
+		encoded, err := encodeRouterID(rt.index, *ino)
+		if err != nil {
+			return err
+		}
+
+		*ino = encoded
+
+		n := direntSize + int(*(*uint32)(unsafe.Pointer(&buf[16])))
+		if n%direntAlignment != 0 {
+			n += direntAlignment - n%direntAlignment
+		}
+
+		if n > len(buf) {
+			break
+		}
+
+		buf = buf[n:]
+	}
+
+	return nil
+}
+
+// Likewise for a buffer of entries produced by a route's ReadDirPlus, where
+// each entry also names its inode in its fuse_entry_out.
+func (r *router) rewriteDirentsPlus(rt *route, buf []byte) error {
+	var out fusekernel.EntryOut
+	for _, e := range splitDirentsPlus(buf) {
+		for _, off := range []uintptr{
+			unsafe.Offsetof(out.Nodeid),
+			unsafe.Offsetof(out.Attr) + unsafe.Offsetof(out.Attr.Ino),
+		} {
+			id := (*uint64)(unsafe.Pointer(&e[off]))
+			if *id == 0 {
+				continue
+			}
+
+			encoded, err := encodeRouterID(rt.index, *id)
+			if err != nil {
+				return err
+			}
+
+			*id = encoded
+		}
+
+		if err := r.rewriteDirents(rt, e[entryOutSize:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (r *router) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	// Report the sum of what the routes report. Block sizes can't be summed, so
+	// use the first one offered.
+	for _, rt := range r.rootChildren {
+		var sub fuseops.StatFSOp
+		if err := rt.fs.StatFS(ctx, &sub); err != nil {
+			if err == fuse.ENOSYS {
+				continue
+			}
+
+			return err
+		}
+
+		if op.BlockSize == 0 {
+			op.BlockSize = sub.BlockSize
+			op.IoSize = sub.IoSize
+		}
+
+		op.Blocks += sub.Blocks
+		op.BlocksFree += sub.BlocksFree
+		op.BlocksAvailable += sub.BlocksAvailable
+		op.Inodes += sub.Inodes
+		op.InodesFree += sub.InodesFree
+	}
+
+	return nil
+}
+
+func (r *router) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	// Sync every route, even if some fail. If none of them can, say so, so that
+	// the kernel stops asking.
+	var err error = fuse.ENOSYS
+	for _, rt := range r.rootChildren {
+		sub := *op
+		subErr := rt.fs.SyncFS(ctx, &sub)
+		switch {
+		case subErr == fuse.ENOSYS:
+		case err == fuse.ENOSYS || err == nil:
+			err = subErr
+		}
+	}
+
+	return err
+}
+
+func (r *router) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	rt, parent, err := r.decodeInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	// Lookups within a route are forwarded.
+	if rt != nil {
+		sub := *op
+		sub.Parent = parent
+		if err := rt.fs.LookUpInode(ctx, &sub); err != nil {
+			return err
+		}
+
+		op.Entry = sub.Entry
+		return r.encodeEntry(rt, &op.Entry)
+	}
+
+	// Lookups within the root resolve to a route's root.
+	rt, ok := r.byName[op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	attrsOp := fuseops.GetInodeAttributesOp{
+		Inode:     fuseops.RootInodeID,
+		OpContext: op.OpContext,
+	}
+
+	if err := rt.fs.GetInodeAttributes(ctx, &attrsOp); err != nil {
+		return err
+	}
+
+	op.Entry = fuseops.ChildInodeEntry{
+		Attributes:           attrsOp.Attributes,
+		AttributesExpiration: attrsOp.AttributesExpiration,
+	}
+
+	op.Entry.Child, _ = r.encodeInode(rt, fuseops.RootInodeID)
+
+	r.mu.Lock()
+	r.rootLookups[rt.index]++
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *router) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		op.Attributes = r.rootAttributes()
+		return nil
+	}
+
+	sub := *op
+	sub.Inode = inode
+	err = rt.fs.GetInodeAttributes(ctx, &sub)
+	op.Attributes = sub.Attributes
+	op.AttributesExpiration = sub.AttributesExpiration
+	return err
+}
+
+func (r *router) Statx(
+	ctx context.Context,
+	op *fuseops.StatxOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		op.Attributes = r.rootAttributes()
+		return nil
+	}
+
+	sub := *op
+	sub.Inode = inode
+	if op.Handle != nil {
+		var h fuseops.HandleID
+		if _, _, h, err = r.decodeInodeAndHandle(op.Inode, *op.Handle); err != nil {
+			return err
+		}
+
+		sub.Handle = &h
+	}
+
+	err = rt.fs.Statx(ctx, &sub)
+	op.Attributes = sub.Attributes
+	op.AttributesExpiration = sub.AttributesExpiration
+	op.ResultMask = sub.ResultMask
+	op.StatxAttributes = sub.StatxAttributes
+	op.StatxAttributesMask = sub.StatxAttributesMask
+	return err
+}
+
+func (r *router) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		attrs := r.rootAttributes()
+		return CheckAccess(&attrs, &op.OpContext, op.Mask)
+	}
+
+	sub := *op
+	sub.Inode = inode
+	return rt.fs.Access(ctx, &sub)
+}
+
+func (r *router) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EPERM
+	}
+
+	sub := *op
+	sub.Inode = inode
+	if op.Handle != nil {
+		var h fuseops.HandleID
+		if _, _, h, err = r.decodeInodeAndHandle(op.Inode, *op.Handle); err != nil {
+			return err
+		}
+
+		sub.Handle = &h
+	}
+
+	err = rt.fs.SetInodeAttributes(ctx, &sub)
+	op.Attributes = sub.Attributes
+	op.AttributesExpiration = sub.AttributesExpiration
+	return err
+}
+
+// Forward a forget for the given router inode, absorbing forgets for route
+// roots.
+func (r *router) forget(
+	ctx context.Context,
+	id fuseops.InodeID,
+	n uint64,
+	opCtx fuseops.OpContext) error {
+	rt, inode, err := r.decodeInode(id)
+	if err != nil || rt == nil {
+		return err
+	}
+
+	if inode == fuseops.RootInodeID {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if r.rootLookups[rt.index] <= n {
+			delete(r.rootLookups, rt.index)
+		} else {
+			r.rootLookups[rt.index] -= n
+		}
+
+		return nil
+	}
+
+	return rt.fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+		Inode:     inode,
+		N:         n,
+		OpContext: opCtx,
+	})
+}
+
+func (r *router) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return r.forget(ctx, op.Inode, op.N, op.OpContext)
+}
+
+func (r *router) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	// Split the batch by route, preserving the route's ability to handle it as
+	// a batch.
+	batches := make(map[*route][]fuseops.BatchForgetEntry)
+	for _, e := range op.Entries {
+		rt, inode, err := r.decodeInode(e.Inode)
+		if err != nil || rt == nil {
+			continue
+		}
+
+		if inode == fuseops.RootInodeID {
+			r.forget(ctx, e.Inode, e.N, op.OpContext)
+			continue
+		}
+
+		batches[rt] = append(batches[rt], fuseops.BatchForgetEntry{Inode: inode, N: e.N})
+	}
+
+	var firstErr error
+	for rt, entries := range batches {
+		sub := &fuseops.BatchForgetOp{Entries: entries, OpContext: op.OpContext}
+		err := rt.fs.BatchForget(ctx, sub)
+		if err == fuse.ENOSYS {
+			for _, e := range entries {
+				err = rt.fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+					Inode:     e.Inode,
+					N:         e.N,
+					OpContext: op.OpContext,
+				})
+				if err != nil {
+					break
+				}
+			}
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (r *router) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	rt, parent, err := r.decodeInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EPERM
+	}
+
+	sub := *op
+	sub.Parent = parent
+	if err := rt.fs.MkDir(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.Entry = sub.Entry
+	return r.encodeEntry(rt, &op.Entry)
+}
+
+func (r *router) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	rt, parent, err := r.decodeInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EPERM
+	}
+
+	sub := *op
+	sub.Parent = parent
+	if err := rt.fs.MkNode(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.Entry = sub.Entry
+	return r.encodeEntry(rt, &op.Entry)
+}
+
+func (r *router) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	rt, parent, err := r.decodeInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EPERM
+	}
+
+	sub := *op
+	sub.Parent = parent
+	if err := rt.fs.CreateFile(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.Entry = sub.Entry
+	if err := r.encodeEntry(rt, &op.Entry); err != nil {
+		return err
+	}
+
+	op.Handle, err = r.encodeHandle(rt, sub.Handle)
+	return err
+}
+
+func (r *router) CreateTmpfile(
+	ctx context.Context,
+	op *fuseops.CreateTmpfileOp) error {
+	rt, parent, err := r.decodeInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EPERM
+	}
+
+	sub := *op
+	sub.Parent = parent
+	if err := rt.fs.CreateTmpfile(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.Entry = sub.Entry
+	if err := r.encodeEntry(rt, &op.Entry); err != nil {
+		return err
+	}
+
+	op.Handle, err = r.encodeHandle(rt, sub.Handle)
+	return err
+}
+
+func (r *router) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	rt, parent, err := r.decodeInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	targetRoute, target, err := r.decodeInode(op.Target)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil || targetRoute == nil {
+		return syscall.EPERM
+	}
+
+	if rt != targetRoute {
+		return syscall.EXDEV
+	}
+
+	sub := *op
+	sub.Parent = parent
+	sub.Target = target
+	if err := rt.fs.CreateLink(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.Entry = sub.Entry
+	return r.encodeEntry(rt, &op.Entry)
+}
+
+func (r *router) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	rt, parent, err := r.decodeInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EPERM
+	}
+
+	sub := *op
+	sub.Parent = parent
+	if err := rt.fs.CreateSymlink(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.Entry = sub.Entry
+	return r.encodeEntry(rt, &op.Entry)
+}
+
+func (r *router) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	oldRoute, oldParent, err := r.decodeInode(op.OldParent)
+	if err != nil {
+		return err
+	}
+
+	newRoute, newParent, err := r.decodeInode(op.NewParent)
+	if err != nil {
+		return err
+	}
+
+	if oldRoute == nil || newRoute == nil {
+		return syscall.EPERM
+	}
+
+	if oldRoute != newRoute {
+		return syscall.EXDEV
+	}
+
+	sub := *op
+	sub.OldParent = oldParent
+	sub.NewParent = newParent
+	return oldRoute.fs.Rename(ctx, &sub)
+}
+
+func (r *router) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	rt, parent, err := r.decodeInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EPERM
+	}
+
+	sub := *op
+	sub.Parent = parent
+	return rt.fs.RmDir(ctx, &sub)
+}
+
+func (r *router) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	rt, parent, err := r.decodeInode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EPERM
+	}
+
+	sub := *op
+	sub.Parent = parent
+	return rt.fs.Unlink(ctx, &sub)
+}
+
+func (r *router) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// The root needs no handle state.
+	if rt == nil {
+		op.Handle = 0
+		return nil
+	}
+
+	sub := *op
+	sub.Inode = inode
+	if err := rt.fs.OpenDir(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.CacheDir = sub.CacheDir
+	op.KeepCache = sub.KeepCache
+	op.Handle, err = r.encodeHandle(rt, sub.Handle)
+	return err
+}
+
+func (r *router) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt != nil {
+		sub := *op
+		sub.Inode = inode
+		sub.Handle = h
+		if err := rt.fs.ReadDir(ctx, &sub); err != nil {
+			return err
+		}
+
+		op.BytesRead = sub.BytesRead
+		return r.rewriteDirents(rt, op.Dst[:op.BytesRead])
+	}
+
+	// List the routes, using their position in the sorted list as offsets.
+	if op.Offset > fuseops.DirOffset(len(r.rootChildren)) {
+		return nil
+	}
+
+	for i, rt := range r.rootChildren[op.Offset:] {
+		child, _ := r.encodeInode(rt, fuseops.RootInodeID)
+		n := WriteDirent(op.Dst[op.BytesRead:], Dirent{
+			Offset: op.Offset + fuseops.DirOffset(i+1),
+			Inode:  child,
+			Name:   rt.name,
+			Type:   DT_Directory,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (r *router) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt != nil {
+		sub := *op
+		sub.Inode = inode
+		sub.Handle = h
+		if err := rt.fs.ReadDirPlus(ctx, &sub); err != nil {
+			return err
+		}
+
+		op.BytesRead = sub.BytesRead
+		return r.rewriteDirentsPlus(rt, op.Dst[:op.BytesRead])
+	}
+
+	// List the routes as for ReadDir, leaving the kernel to look them up.
+	readOp := fuseops.ReadDirOp{
+		Inode:  op.Inode,
+		Offset: op.Offset,
+		Dst:    make([]byte, len(op.Dst)),
+	}
+
+	if err := r.ReadDir(ctx, &readOp); err != nil {
+		return err
+	}
+
+	op.BytesRead = 0
+	for _, d := range parseDirents(readOp.Dst[:readOp.BytesRead]) {
+		n := WriteDirentPlus(op.Dst[op.BytesRead:], DirentPlus{Dirent: d})
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (r *router) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	rt, h, err := r.decodeHandle(op.Handle)
+	if err != nil || rt == nil {
+		return err
+	}
+
+	sub := *op
+	sub.Handle = h
+	return rt.fs.ReleaseDirHandle(ctx, &sub)
+}
+
+func (r *router) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	if err := rt.fs.OpenFile(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.KeepPageCache = sub.KeepPageCache
+	op.UseDirectIO = sub.UseDirectIO
+	op.Handle, err = r.encodeHandle(rt, sub.Handle)
+	return err
+}
+
+func (r *router) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	err = rt.fs.ReadFile(ctx, &sub)
+	op.Data = sub.Data
+	op.BytesRead = sub.BytesRead
+	op.EOF = sub.EOF
+	op.Callback = sub.Callback
+	return err
+}
+
+func (r *router) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	err = rt.fs.WriteFile(ctx, &sub)
+	op.BytesWritten = sub.BytesWritten
+	op.Callback = sub.Callback
+	return err
+}
+
+func (r *router) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil || rt == nil {
+		return err
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	return rt.fs.SyncFile(ctx, &sub)
+}
+
+func (r *router) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil || rt == nil {
+		return err
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	return rt.fs.FlushFile(ctx, &sub)
+}
+
+func (r *router) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	rt, h, err := r.decodeHandle(op.Handle)
+	if err != nil || rt == nil {
+		return err
+	}
+
+	sub := *op
+	sub.Handle = h
+	return rt.fs.ReleaseFileHandle(ctx, &sub)
+}
+
+func (r *router) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return fuse.EINVAL
+	}
+
+	sub := *op
+	sub.Inode = inode
+	err = rt.fs.ReadSymlink(ctx, &sub)
+	op.Target = sub.Target
+	return err
+}
+
+func (r *router) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return fuse.ENOATTR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	return rt.fs.RemoveXattr(ctx, &sub)
+}
+
+func (r *router) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return fuse.ENOATTR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	err = rt.fs.GetXattr(ctx, &sub)
+	op.BytesRead = sub.BytesRead
+	return err
+}
+
+func (r *router) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return nil
+	}
+
+	sub := *op
+	sub.Inode = inode
+	err = rt.fs.ListXattr(ctx, &sub)
+	op.BytesRead = sub.BytesRead
+	return err
+}
+
+func (r *router) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EPERM
+	}
+
+	sub := *op
+	sub.Inode = inode
+	return rt.fs.SetXattr(ctx, &sub)
+}
+
+func (r *router) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	return rt.fs.Fallocate(ctx, &sub)
+}
+
+func (r *router) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	if err := rt.fs.Lseek(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.ResultOffset = sub.ResultOffset
+	return nil
+}
+
+func (r *router) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	rt, in, hIn, err := r.decodeInodeAndHandle(op.InputInode, op.InputHandle)
+	if err != nil {
+		return err
+	}
+
+	outRt, out, hOut, err := r.decodeInodeAndHandle(op.OutputInode, op.OutputHandle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil || outRt == nil {
+		return syscall.EISDIR
+	}
+
+	// Let the kernel copy between routes itself.
+	if rt != outRt {
+		return syscall.EXDEV
+	}
+
+	sub := *op
+	sub.InputInode = in
+	sub.InputHandle = hIn
+	sub.OutputInode = out
+	sub.OutputHandle = hOut
+	if err := rt.fs.CopyFileRange(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.BytesCopied = sub.BytesCopied
+	return nil
+}
+
+func (r *router) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	if err := rt.fs.Poll(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.Revents = sub.Revents
+	return nil
+}
+
+func (r *router) Flock(
+	ctx context.Context,
+	op *fuseops.FlockOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	return rt.fs.Flock(ctx, &sub)
+}
+
+func (r *router) GetLk(
+	ctx context.Context,
+	op *fuseops.GetLkOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	if err := rt.fs.GetLk(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.Conflict = sub.Conflict
+	return nil
+}
+
+func (r *router) SetLk(
+	ctx context.Context,
+	op *fuseops.SetLkOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	return rt.fs.SetLk(ctx, &sub)
+}
+
+func (r *router) SetLkWait(
+	ctx context.Context,
+	op *fuseops.SetLkWaitOp) error {
+	rt, inode, h, err := r.decodeInodeAndHandle(op.Inode, op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if rt == nil {
+		return syscall.EISDIR
+	}
+
+	sub := *op
+	sub.Inode = inode
+	sub.Handle = h
+	return rt.fs.SetLkWait(ctx, &sub)
+}
+
+func (r *router) SetVolumeName(
+	ctx context.Context,
+	op *fuseops.SetVolumeNameOp) error {
+	// The volume is ours, not any one route's.
+	return fuse.ENOSYS
+}
+
+func (r *router) GetXtimes(
+	ctx context.Context,
+	op *fuseops.GetXtimesOp) error {
+	rt, inode, err := r.decodeInode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// The root has no interesting times.
+	if rt == nil {
+		return nil
+	}
+
+	sub := *op
+	sub.Inode = inode
+	if err := rt.fs.GetXtimes(ctx, &sub); err != nil {
+		return err
+	}
+
+	op.BackupTime = sub.BackupTime
+	op.CreationTime = sub.CreationTime
+	return nil
+}
+
+func (r *router) OnInit(p *fuse.InitParams) error {
+	// Each route may narrow what the others agreed to.
+	for _, rt := range r.rootChildren {
+		h, ok := rt.fs.(fuse.InitHandler)
+		if !ok {
+			continue
+		}
+
+		if err := h.OnInit(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *router) OnDestroy() {
+	for _, rt := range r.rootChildren {
+		if h, ok := rt.fs.(DestroyHandler); ok {
+			h.OnDestroy()
+		}
+	}
+}
+
+func (r *router) Destroy() {
+	for _, rt := range r.rootChildren {
+		rt.fs.Destroy()
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system whose root contains a single file named "f" with inode 2.
+type oneFileFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+const oneFileInode = 2
+
+func (fs *oneFileFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	switch op.Inode {
+	case fuseops.RootInodeID:
+		op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0755 | os.ModeDir}
+	case oneFileInode:
+		op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0644}
+	default:
+		return fuse.ENOENT
+	}
+
+	return nil
+}
+
+func (fs *oneFileFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "f" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = oneFileInode
+	op.Entry.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0644}
+	return nil
+}
+
+func (fs *oneFileFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	op.Handle = 7
+	return nil
+}
+
+func (fs *oneFileFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Handle != 7 {
+		return syscall.EBADF
+	}
+
+	if op.Offset == 0 {
+		op.BytesRead = fuseutil.WriteDirent(op.Dst, fuseutil.Dirent{
+			Offset: 1,
+			Inode:  oneFileInode,
+			Name:   "f",
+			Type:   fuseutil.DT_File,
+		})
+	}
+
+	return nil
+}
+
+func (fs *oneFileFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if op.Offset == 0 {
+		op.BytesRead = fuseutil.WriteDirentPlus(op.Dst, fuseutil.DirentPlus{
+			Dirent: fuseutil.Dirent{
+				Offset: 1,
+				Inode:  oneFileInode,
+				Name:   "f",
+				Type:   fuseutil.DT_File,
+			},
+			Entry: fuseops.ChildInodeEntry{Child: oneFileInode},
+		})
+	}
+
+	return nil
+}
+
+// Parse the output of fuseutil.WriteDirent.
+func parseDirents(buf []byte) ([]fuseutil.Dirent, error) {
+	const direntSize = 8 + 8 + 4 + 4
+
+	var entries []fuseutil.Dirent
+	for len(buf) > 0 {
+		if len(buf) < direntSize {
+			return nil, fmt.Errorf("Short dirent: %d bytes", len(buf))
+		}
+
+		namelen := int(*(*uint32)(unsafe.Pointer(&buf[16])))
+		if direntSize+namelen > len(buf) {
+			return nil, fmt.Errorf("Name overruns buffer")
+		}
+
+		entries = append(entries, fuseutil.Dirent{
+			Inode:  fuseops.InodeID(*(*uint64)(unsafe.Pointer(&buf[0]))),
+			Offset: fuseops.DirOffset(*(*uint64)(unsafe.Pointer(&buf[8]))),
+			Type:   fuseutil.DirentType(*(*uint32)(unsafe.Pointer(&buf[20]))),
+			Name:   string(buf[direntSize : direntSize+namelen]),
+		})
+
+		n := (direntSize + namelen + 7) &^ 7
+		if n > len(buf) {
+			n = len(buf)
+		}
+
+		buf = buf[n:]
+	}
+
+	return entries, nil
+}
+
+func newTestRouter(t *testing.T) fuseutil.FileSystem {
+	t.Helper()
+	r, err := fuseutil.NewRouter(map[string]fuseutil.FileSystem{
+		"/logs":  &oneFileFS{},
+		"config": &oneFileFS{},
+	})
+
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+
+	return r
+}
+
+func lookUp(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	parent fuseops.InodeID,
+	name string) fuseops.InodeID {
+	t.Helper()
+	op := fusetesting.NewLookUpInodeOp(parent, name)
+	if err := fs.LookUpInode(context.Background(), op); err != nil {
+		t.Fatalf("LookUpInode(%v, %q): %v", parent, name, err)
+	}
+
+	return op.Entry.Child
+}
+
+func TestRouterInvalidPrefixes(t *testing.T) {
+	for _, prefix := range []string{"", "/", "a/b", ".."} {
+		_, err := fuseutil.NewRouter(map[string]fuseutil.FileSystem{
+			prefix: &oneFileFS{},
+		})
+
+		if err == nil {
+			t.Errorf("NewRouter accepted prefix %q", prefix)
+		}
+	}
+
+	_, err := fuseutil.NewRouter(map[string]fuseutil.FileSystem{
+		"a":  &oneFileFS{},
+		"/a": &oneFileFS{},
+	})
+
+	if err == nil {
+		t.Error("NewRouter accepted duplicate prefixes")
+	}
+}
+
+func TestRouterRootListing(t *testing.T) {
+	r := newTestRouter(t)
+	ctx := context.Background()
+
+	open := fusetesting.NewOpenDirOp(fuseops.RootInodeID)
+	if err := r.OpenDir(ctx, open); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	op := fusetesting.NewReadDirOp(fuseops.RootInodeID, open.Handle, 0)
+	if err := r.ReadDir(ctx, op); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	entries, err := parseDirents(op.Dst[:op.BytesRead])
+	if err != nil {
+		t.Fatalf("parseDirents: %v", err)
+	}
+
+	if len(entries) != 2 || entries[0].Name != "config" || entries[1].Name != "logs" {
+		t.Fatalf("Unexpected root listing: %+v", entries)
+	}
+
+	if got := lookUp(t, r, fuseops.RootInodeID, "logs"); got != entries[1].Inode {
+		t.Errorf("LookUpInode(logs) = %v, listing says %v", got, entries[1].Inode)
+	}
+
+	lookUpOp := fusetesting.NewLookUpInodeOp(fuseops.RootInodeID, "missing")
+	if err := r.LookUpInode(ctx, lookUpOp); err != fuse.ENOENT {
+		t.Errorf("LookUpInode(missing): %v, want ENOENT", err)
+	}
+}
+
+func TestRouterPartitionsInodes(t *testing.T) {
+	r := newTestRouter(t)
+	ctx := context.Background()
+
+	logs := lookUp(t, r, fuseops.RootInodeID, "logs")
+	config := lookUp(t, r, fuseops.RootInodeID, "config")
+	logsFile := lookUp(t, r, logs, "f")
+	configFile := lookUp(t, r, config, "f")
+
+	if logsFile == configFile {
+		t.Fatalf("Both routes' files have inode %v", logsFile)
+	}
+
+	attrs := fusetesting.NewGetInodeAttributesOp(logsFile)
+	if err := r.GetInodeAttributes(ctx, attrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if attrs.Attributes.Mode != 0644 {
+		t.Errorf("Mode = %v, want 0644", attrs.Attributes.Mode)
+	}
+
+	// Dirents from a route must use the router's inode IDs.
+	open := fusetesting.NewOpenDirOp(logs)
+	if err := r.OpenDir(ctx, open); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	op := fusetesting.NewReadDirOp(logs, open.Handle, 0)
+	if err := r.ReadDir(ctx, op); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	entries, err := parseDirents(op.Dst[:op.BytesRead])
+	if err != nil {
+		t.Fatalf("parseDirents: %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].Inode != logsFile {
+		t.Errorf("Unexpected listing: %+v, want inode %v", entries, logsFile)
+	}
+
+	// As must entries from ReadDirPlus, in both the dirent and the entry.
+	plusOp := fusetesting.NewReadDirPlusOp(logs, open.Handle, 0)
+	if err := r.ReadDirPlus(ctx, plusOp); err != nil {
+		t.Fatalf("ReadDirPlus: %v", err)
+	}
+
+	var entryOut fusekernel.EntryOut
+	buf := plusOp.Dst[:plusOp.BytesRead]
+	if len(buf) < int(unsafe.Sizeof(entryOut)) {
+		t.Fatalf("Short ReadDirPlus output: %d bytes", len(buf))
+	}
+
+	entryOut = *(*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+	entries, err = parseDirents(buf[unsafe.Sizeof(entryOut):])
+	if err != nil {
+		t.Fatalf("parseDirents: %v", err)
+	}
+
+	if fuseops.InodeID(entryOut.Nodeid) != logsFile || fuseops.InodeID(entryOut.Attr.Ino) != logsFile ||
+		len(entries) != 1 || entries[0].Inode != logsFile {
+		t.Errorf("Unexpected listing: %+v %+v, want inode %v", entryOut, entries, logsFile)
+	}
+
+	// A handle from one route can't be used with another.
+	op = fusetesting.NewReadDirOp(config, open.Handle, 0)
+	if err := r.ReadDir(ctx, op); err != syscall.EBADF {
+		t.Errorf("ReadDir with foreign handle: %v, want EBADF", err)
+	}
+
+	// Renames between routes are cross-device.
+	rename := &fuseops.RenameOp{
+		OldParent: logs,
+		OldName:   "f",
+		NewParent: config,
+		NewName:   "g",
+	}
+
+	if err := r.Rename(ctx, rename); err != syscall.EXDEV {
+		t.Errorf("Rename across routes: %v, want EXDEV", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// ShapingRule describes how to slow down a kind of op. See NewShapingHooks.
+type ShapingRule struct {
+	// If non-nil, called for each op to find how long to delay it before
+	// passing it to the file system. See FixedLatency, UniformLatency and
+	// ExponentialLatency.
+	Latency func() time.Duration
+
+	// If positive, the rate in bytes per second at which the data of ops using
+	// this rule is transferred: that written by WriteFileOp before the file
+	// system is called, and that returned by ReadFileOp afterward. The rate is
+	// shared by all ops using the rule, so that concurrent reads queue behind
+	// each other as they would on a slow link.
+	BytesPerSecond int64
+}
+
+// NewShapingHooks returns hooks, for NewFileSystemServerWithHooks, that slow
+// down ops as described by the rule returned for each of them, so that
+// applications can be tried out against a slow file system without network
+// simulation. rule may return nil for ops to leave alone, and should return
+// the same *ShapingRule for ops that share a bandwidth cap, e.g.:
+//
+//	link := &fuseutil.ShapingRule{
+//		Latency:        fuseutil.ExponentialLatency(20 * time.Millisecond),
+//		BytesPerSecond: 1 << 20,
+//	}
+//
+//	hooks := fuseutil.NewShapingHooks(func(op interface{}) *fuseutil.ShapingRule {
+//		switch op.(type) {
+//		case *fuseops.ReadFileOp, *fuseops.WriteFileOp:
+//			return link
+//		}
+//
+//		return nil
+//	})
+//
+// An op interrupted while delayed fails with EINTR.
+func NewShapingHooks(rule func(op interface{}) *ShapingRule) Hooks {
+	return &shapingHooks{
+		rule:     rule,
+		clock:    timeutil.RealClock(),
+		sleep:    sleepContext,
+		nextIdle: make(map[*ShapingRule]time.Time),
+	}
+}
+
+// FixedLatency returns a latency function for ShapingRule that always returns
+// d.
+func FixedLatency(d time.Duration) func() time.Duration {
+	return func() time.Duration { return d }
+}
+
+// UniformLatency returns a latency function for ShapingRule that returns
+// durations spread evenly over [min, max).
+func UniformLatency(min, max time.Duration) func() time.Duration {
+	return func() time.Duration {
+		if max <= min {
+			return min
+		}
+
+		return min + time.Duration(rand.Int63n(int64(max-min)))
+	}
+}
+
+// ExponentialLatency returns a latency function for ShapingRule that returns
+// exponentially distributed durations with the given mean: mostly short, with
+// the occasional long stall.
+func ExponentialLatency(mean time.Duration) func() time.Duration {
+	return func() time.Duration {
+		return time.Duration(rand.ExpFloat64() * float64(mean))
+	}
+}
+
+type shapingHooks struct {
+	rule  func(op interface{}) *ShapingRule
+	clock timeutil.Clock
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu sync.Mutex
+
+	// The time at which each rule's bandwidth is next free, i.e. at which the
+	// transfers already scheduled for it finish.
+	//
+	// GUARDED_BY(mu)
+	nextIdle map[*ShapingRule]time.Time
+}
+
+func (h *shapingHooks) BeforeOp(ctx context.Context, op interface{}) error {
+	r := h.rule(op)
+	if r == nil {
+		return nil
+	}
+
+	var d time.Duration
+	if r.Latency != nil {
+		d = r.Latency()
+	}
+
+	if op, ok := op.(*fuseops.WriteFileOp); ok {
+		d += h.transfer(r, len(op.Data))
+	}
+
+	return h.sleep(ctx, d)
+}
+
+func (h *shapingHooks) AfterOp(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	if err != nil {
+		return err
+	}
+
+	readOp, ok := op.(*fuseops.ReadFileOp)
+	if !ok {
+		return nil
+	}
+
+	r := h.rule(op)
+	if r == nil {
+		return nil
+	}
+
+	n := readOp.BytesRead
+	if readOp.Data != nil {
+		n = 0
+		for _, b := range readOp.Data {
+			n += len(b)
+		}
+	}
+
+	return h.sleep(ctx, h.transfer(r, n))
+}
+
+// Schedule the transfer of n bytes using the rule's bandwidth, returning how
+// long to wait for it to finish.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *shapingHooks) transfer(r *ShapingRule, n int) time.Duration {
+	if r.BytesPerSecond <= 0 || n == 0 {
+		return 0
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.clock.Now()
+	start := h.nextIdle[r]
+	if start.Before(now) {
+		start = now
+	}
+
+	end := start.Add(time.Duration(n) * time.Second / time.Duration(r.BytesPerSecond))
+	h.nextIdle[r] = end
+
+	return end.Sub(now)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestShapingHooks(t *testing.T) {
+	link := &ShapingRule{
+		Latency:        FixedLatency(10 * time.Millisecond),
+		BytesPerSecond: 1000,
+	}
+
+	hooks := NewShapingHooks(func(op interface{}) *ShapingRule {
+		switch op.(type) {
+		case *fuseops.ReadFileOp, *fuseops.WriteFileOp:
+			return link
+		}
+
+		return nil
+	}).(*shapingHooks)
+
+	// Record the delays rather than sleeping, without moving the clock, as if
+	// the ops ran concurrently.
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	hooks.clock = &clock
+
+	var slept []time.Duration
+	hooks.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	ctx := context.Background()
+
+	// Unshaped ops aren't delayed.
+	if err := hooks.BeforeOp(ctx, &fuseops.LookUpInodeOp{}); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	// Writes wait for the latency and their data before the file system is
+	// called.
+	write := &fuseops.WriteFileOp{Data: make([]byte, 100)}
+	if err := hooks.BeforeOp(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// Reads wait for the latency first and their data afterward, queued behind
+	// the write's.
+	read := &fuseops.ReadFileOp{}
+	if err := hooks.BeforeOp(ctx, read); err != nil {
+		t.Fatalf("ReadFile before: %v", err)
+	}
+
+	read.Data = [][]byte{make([]byte, 30), make([]byte, 20)}
+	if err := hooks.AfterOp(ctx, read, nil); err != nil {
+		t.Fatalf("ReadFile after: %v", err)
+	}
+
+	// Once the link is idle, transfers start afresh.
+	clock.AdvanceTime(time.Second)
+	read = &fuseops.ReadFileOp{BytesRead: 10}
+	if err := hooks.AfterOp(ctx, read, nil); err != nil {
+		t.Fatalf("ReadFile after idle: %v", err)
+	}
+
+	want := []time.Duration{
+		110 * time.Millisecond,
+		10 * time.Millisecond,
+		150 * time.Millisecond,
+		10 * time.Millisecond,
+	}
+
+	if len(slept) != len(want) {
+		t.Fatalf("slept %v, want %v", slept, want)
+	}
+
+	for i := range want {
+		if slept[i] != want[i] {
+			t.Errorf("slept %v, want %v", slept, want)
+			break
+		}
+	}
+
+	// Failed ops aren't delayed further.
+	slept = nil
+	if err := hooks.AfterOp(ctx, read, syscall.EIO); err != syscall.EIO {
+		t.Errorf("AfterOp error: %v", err)
+	}
+
+	if len(slept) != 0 {
+		t.Errorf("slept %v after failure", slept)
+	}
+}
+
+func TestShapingHooksInterrupted(t *testing.T) {
+	hooks := NewShapingHooks(func(op interface{}) *ShapingRule {
+		return &ShapingRule{Latency: FixedLatency(time.Hour)}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := hooks.BeforeOp(ctx, &fuseops.LookUpInodeOp{}); err != syscall.EINTR {
+		t.Errorf("BeforeOp: %v, want EINTR", err)
+	}
+}
+
+func TestLatencyDistributions(t *testing.T) {
+	uniform := UniformLatency(time.Millisecond, 2*time.Millisecond)
+	exponential := ExponentialLatency(time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		if d := uniform(); d < time.Millisecond || d >= 2*time.Millisecond {
+			t.Fatalf("UniformLatency returned %v", d)
+		}
+
+		if d := exponential(); d < 0 {
+			t.Fatalf("ExponentialLatency returned %v", d)
+		}
+	}
+}
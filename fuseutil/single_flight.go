@@ -0,0 +1,226 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewSingleFlightFileSystem wraps a file system so that concurrent LookUpInode
+// calls for the same parent and name, and concurrent GetInodeAttributes calls
+// for the same inode, are collapsed into a single call to the wrapped file
+// system whose result they all share. Without it, stat storms from parallel
+// builds and similar workloads multiply the load on the backend.
+//
+// Only calls that overlap in time are collapsed, and nothing is cached, so a
+// call may see a result the wrapped file system produced for a call that
+// began a little earlier, as if it had raced with whatever changed since.
+// Results are shared regardless of the caller, so don't use this for file
+// systems whose answers depend on the OpContext.
+//
+// The kernel counts a lookup for every reply carrying an entry, while the
+// wrapped file system sees one call for all of them. The wrapper remembers
+// the difference and takes it out of later forgets, so that the wrapped file
+// system's lookup counts stay correct.
+func NewSingleFlightFileSystem(wrapped FileSystem) FileSystem {
+	return &singleFlightFS{
+		FileSystem: wrapped,
+		lookUps:    make(map[lookUpKey]*lookUpFlight),
+		attrs:      make(map[fuseops.InodeID]*attrFlight),
+		extra:      make(map[fuseops.InodeID]uint64),
+	}
+}
+
+type lookUpKey struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// A call to the wrapped file system in progress. The results are valid once
+// done is closed.
+type lookUpFlight struct {
+	done    chan struct{}
+	waiters uint64 // GUARDED_BY(singleFlightFS.mu)
+
+	entry fuseops.ChildInodeEntry
+	err   error
+}
+
+type attrFlight struct {
+	done chan struct{}
+
+	attributes fuseops.InodeAttributes
+	expiration time.Time
+	err        error
+}
+
+type singleFlightFS struct {
+	FileSystem
+
+	mu sync.Mutex
+
+	lookUps map[lookUpKey]*lookUpFlight     // GUARDED_BY(mu)
+	attrs   map[fuseops.InodeID]*attrFlight // GUARDED_BY(mu)
+
+	// For each inode, the lookups the kernel has counted that the wrapped file
+	// system hasn't, because they were shared.
+	extra map[fuseops.InodeID]uint64 // GUARDED_BY(mu)
+}
+
+// Take the shared lookups of the inode out of a forget count, returning what
+// remains to pass on.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *singleFlightFS) absorb(inode fuseops.InodeID, n uint64) uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	extra := fs.extra[inode]
+	if extra > n {
+		fs.extra[inode] = extra - n
+		return 0
+	}
+
+	delete(fs.extra, inode)
+	return n - extra
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *singleFlightFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	key := lookUpKey{op.Parent, op.Name}
+
+	fs.mu.Lock()
+	if f, ok := fs.lookUps[key]; ok {
+		f.waiters++
+		fs.mu.Unlock()
+
+		<-f.done
+		op.Entry = f.entry
+		return f.err
+	}
+
+	f := &lookUpFlight{done: make(chan struct{})}
+	fs.lookUps[key] = f
+	fs.mu.Unlock()
+
+	err := fs.FileSystem.LookUpInode(ctx, op)
+
+	// Record the waiters' lookups before any reply can reach the kernel, so
+	// that a forget can't overtake them.
+	fs.mu.Lock()
+	delete(fs.lookUps, key)
+	if err == nil && op.Entry.Child != 0 && f.waiters != 0 {
+		fs.extra[op.Entry.Child] += f.waiters
+	}
+	fs.mu.Unlock()
+
+	f.entry, f.err = op.Entry, err
+	close(f.done)
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *singleFlightFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	if f, ok := fs.attrs[op.Inode]; ok {
+		fs.mu.Unlock()
+
+		<-f.done
+		op.Attributes = f.attributes
+		op.AttributesExpiration = f.expiration
+		return f.err
+	}
+
+	f := &attrFlight{done: make(chan struct{})}
+	fs.attrs[op.Inode] = f
+	fs.mu.Unlock()
+
+	err := fs.FileSystem.GetInodeAttributes(ctx, op)
+
+	fs.mu.Lock()
+	delete(fs.attrs, op.Inode)
+	fs.mu.Unlock()
+
+	f.attributes, f.expiration, f.err = op.Attributes, op.AttributesExpiration, err
+	close(f.done)
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *singleFlightFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	n := fs.absorb(op.Inode, op.N)
+	if n == 0 {
+		return nil
+	}
+
+	sub := *op
+	sub.N = n
+	return fs.FileSystem.ForgetInode(ctx, &sub)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *singleFlightFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	var entries []fuseops.BatchForgetEntry
+	for _, e := range op.Entries {
+		if e.N = fs.absorb(e.Inode, e.N); e.N != 0 {
+			entries = append(entries, e)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	sub := *op
+	sub.Entries = entries
+	err := fs.FileSystem.BatchForget(ctx, &sub)
+	if err != fuse.ENOSYS {
+		return err
+	}
+
+	// The forgets have been absorbed already, so don't let the server fall
+	// back to calling ForgetInode with the original counts.
+	for _, e := range entries {
+		err := fs.FileSystem.ForgetInode(ctx, &fuseops.ForgetInodeOp{
+			Inode:     e.Inode,
+			N:         e.N,
+			OpContext: op.OpContext,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
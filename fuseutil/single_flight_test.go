@@ -0,0 +1,145 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system whose lookups and attribute reads wait for gate to be closed.
+type gatedFS struct {
+	fuseutil.NotImplementedFileSystem
+	gate    chan struct{}
+	entered chan struct{}
+	calls   int32
+
+	mu      sync.Mutex
+	forgets map[fuseops.InodeID]uint64
+}
+
+func (fs *gatedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	atomic.AddInt32(&fs.calls, 1)
+	fs.entered <- struct{}{}
+	<-fs.gate
+
+	op.Entry.Child = 7
+	return nil
+}
+
+func (fs *gatedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	atomic.AddInt32(&fs.calls, 1)
+	fs.entered <- struct{}{}
+	<-fs.gate
+
+	op.Attributes.Size = 42
+	return nil
+}
+
+func (fs *gatedFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forgets[op.Inode] += op.N
+	return nil
+}
+
+// Run f concurrently n times, once the first call has reached the wrapped
+// file system.
+func runConcurrently(wrapped *gatedFS, n int, f func()) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+
+		if i == 0 {
+			<-wrapped.entered
+		}
+	}
+
+	// Give the others time to join the first before letting it finish.
+	time.Sleep(100 * time.Millisecond)
+	close(wrapped.gate)
+	wg.Wait()
+}
+
+func TestSingleFlightFileSystem(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &gatedFS{
+		gate:    make(chan struct{}),
+		entered: make(chan struct{}, 10),
+		forgets: make(map[fuseops.InodeID]uint64),
+	}
+	fs := fuseutil.NewSingleFlightFileSystem(wrapped)
+
+	// Concurrent lookups of the same name are collapsed.
+	var children int32
+	runConcurrently(wrapped, 5, func() {
+		op := &fuseops.LookUpInodeOp{Parent: 1, Name: "foo"}
+		if err := fs.LookUpInode(ctx, op); err != nil {
+			t.Errorf("LookUpInode: %v", err)
+		}
+
+		if op.Entry.Child == 7 {
+			atomic.AddInt32(&children, 1)
+		}
+	})
+
+	if wrapped.calls != 1 || children != 5 {
+		t.Errorf("%d calls for %d results", wrapped.calls, children)
+	}
+
+	// The kernel counted five lookups, and the wrapped file system one, so a
+	// forget of all five is passed on as a forget of one.
+	err := fs.BatchForget(ctx, &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{{Inode: 7, N: 5}},
+	})
+	if err != nil {
+		t.Fatalf("BatchForget: %v", err)
+	}
+
+	if got := wrapped.forgets[7]; got != 1 {
+		t.Errorf("Forgot %d lookups", got)
+	}
+
+	// So are concurrent attribute reads.
+	wrapped.gate = make(chan struct{})
+	wrapped.calls = 0
+	runConcurrently(wrapped, 3, func() {
+		op := &fuseops.GetInodeAttributesOp{Inode: 7}
+		if err := fs.GetInodeAttributes(ctx, op); err != nil || op.Attributes.Size != 42 {
+			t.Errorf("GetInodeAttributes: %v, %v", err, op.Attributes.Size)
+		}
+	})
+
+	if wrapped.calls != 1 {
+		t.Errorf("%d calls to GetInodeAttributes", wrapped.calls)
+	}
+}
@@ -0,0 +1,562 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The prefix of the PAX records holding extended attributes, as written by
+// GNU tar and bsdtar.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// The size of the reads and writes used to copy file contents.
+const snapshotChunkSize = 1 << 20
+
+// WriteTar writes the contents of a file system to w as a tar archive, by
+// calling its methods directly rather than through a mount, e.g. to save an
+// in-memory file system on shutdown or to compare it with a golden archive.
+// ReadTar restores it.
+//
+// The archive holds directories, regular files, symlinks, FIFOs and device
+// nodes, with their permissions, owners, access and modification times, and
+// extended attributes. Files with more than one link are archived once and
+// then as hard links to their first path. Sockets can't be archived, so are
+// skipped. The root directory is archived as "./", and entries are written
+// in name order, so that the same tree always gives the same archive.
+//
+// Every lookup is matched by a ForgetInode, as the kernel would do. The file
+// system must not change while it is being archived.
+func WriteTar(ctx context.Context, fileSystem FileSystem, w io.Writer) error {
+	sw := snapshotWriter{
+		ctx:   ctx,
+		fs:    fileSystem,
+		tw:    tar.NewWriter(w),
+		links: make(map[fuseops.InodeID]string),
+	}
+
+	attrsOp := fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err := fileSystem.GetInodeAttributes(ctx, &attrsOp); err != nil {
+		return fmt.Errorf("GetInodeAttributes: %w", err)
+	}
+
+	if err := sw.write(fuseops.RootInodeID, ".", attrsOp.Attributes); err != nil {
+		return err
+	}
+
+	return sw.tw.Close()
+}
+
+type snapshotWriter struct {
+	ctx context.Context
+	fs  FileSystem
+	tw  *tar.Writer
+
+	// The path at which each inode with more than one link was first written.
+	links map[fuseops.InodeID]string
+}
+
+// Write the entry for an inode, and those of its children if it is a
+// directory.
+func (sw *snapshotWriter) write(
+	inode fuseops.InodeID,
+	name string,
+	attrs fuseops.InodeAttributes) error {
+	if attrs.Mode&os.ModeSocket != 0 {
+		return nil
+	}
+
+	if first, ok := sw.links[inode]; ok {
+		return sw.tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     name,
+			Linkname: first,
+			Format:   tar.FormatPAX,
+		})
+	}
+
+	if !attrs.Mode.IsDir() && attrs.Nlink > 1 {
+		sw.links[inode] = name
+	}
+
+	var target string
+	if attrs.Mode&os.ModeSymlink != 0 {
+		op := fuseops.ReadSymlinkOp{Inode: inode}
+		if err := sw.fs.ReadSymlink(sw.ctx, &op); err != nil {
+			return fmt.Errorf("ReadSymlink(%q): %w", name, err)
+		}
+
+		target = op.Target
+	}
+
+	hdr, err := tar.FileInfoHeader(ioFileInfo{name: path.Base(name), attrs: attrs}, target)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	hdr.Name = name
+	hdr.Uid = int(attrs.Uid)
+	hdr.Gid = int(attrs.Gid)
+	hdr.AccessTime = attrs.Atime
+	hdr.Format = tar.FormatPAX
+	if attrs.Mode.IsDir() {
+		hdr.Name += "/"
+	}
+
+	if attrs.Mode&os.ModeDevice != 0 {
+		hdr.Devmajor = int64(rdevMajor(attrs.Rdev))
+		hdr.Devminor = int64(rdevMinor(attrs.Rdev))
+	}
+
+	if hdr.PAXRecords, err = sw.xattrs(inode, name); err != nil {
+		return err
+	}
+
+	if err := sw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	switch {
+	case attrs.Mode.IsRegular():
+		return sw.writeContents(inode, name, int64(attrs.Size))
+
+	case attrs.Mode.IsDir():
+		return sw.writeChildren(inode, name)
+	}
+
+	return nil
+}
+
+// Return the extended attributes of an inode as PAX records.
+func (sw *snapshotWriter) xattrs(
+	inode fuseops.InodeID,
+	name string) (map[string]string, error) {
+	listOp := fuseops.ListXattrOp{
+		Inode: inode,
+		Dst:   make([]byte, 64<<10),
+	}
+
+	switch err := sw.fs.ListXattr(sw.ctx, &listOp); err {
+	case nil:
+	case fuse.ENOSYS, syscall.EOPNOTSUPP:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("ListXattr(%q): %w", name, err)
+	}
+
+	var records map[string]string
+	buf := make([]byte, 64<<10)
+	for _, attr := range strings.Split(string(listOp.Dst[:listOp.BytesRead]), "\x00") {
+		if attr == "" {
+			continue
+		}
+
+		getOp := fuseops.GetXattrOp{
+			Inode: inode,
+			Name:  attr,
+			Dst:   buf,
+		}
+
+		if err := sw.fs.GetXattr(sw.ctx, &getOp); err != nil {
+			return nil, fmt.Errorf("GetXattr(%q, %q): %w", name, attr, err)
+		}
+
+		if records == nil {
+			records = make(map[string]string)
+		}
+
+		records[paxXattrPrefix+attr] = string(buf[:getOp.BytesRead])
+	}
+
+	return records, nil
+}
+
+// Copy the contents of a regular file into the archive.
+func (sw *snapshotWriter) writeContents(
+	inode fuseops.InodeID,
+	name string,
+	size int64) error {
+	openOp := fuseops.OpenFileOp{
+		Inode:     inode,
+		OpenFlags: fusekernel.OpenReadOnly,
+	}
+
+	if err := sw.fs.OpenFile(sw.ctx, &openOp); err != nil && err != fuse.ENOSYS {
+		return fmt.Errorf("OpenFile(%q): %w", name, err)
+	}
+
+	defer sw.fs.ReleaseFileHandle(sw.ctx, &fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	buf := make([]byte, snapshotChunkSize)
+	for offset := int64(0); offset < size; {
+		op := fuseops.ReadFileOp{
+			Inode:  inode,
+			Handle: openOp.Handle,
+			Offset: offset,
+			Size:   int64(len(buf)),
+			Dst:    buf,
+		}
+
+		if size-offset < op.Size {
+			op.Size = size - offset
+			op.Dst = buf[:op.Size]
+		}
+
+		if err := sw.fs.ReadFile(sw.ctx, &op); err != nil {
+			return fmt.Errorf("ReadFile(%q): %w", name, err)
+		}
+
+		data := readData(&op)
+		if op.Callback != nil {
+			op.Callback()
+		}
+
+		if len(data) == 0 {
+			return fmt.Errorf("ReadFile(%q): %w at %d of %d bytes", name, io.ErrUnexpectedEOF, offset, size)
+		}
+
+		if _, err := sw.tw.Write(data); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		offset += int64(len(data))
+	}
+
+	return nil
+}
+
+// Write the entries of a directory's children in name order.
+func (sw *snapshotWriter) writeChildren(dir fuseops.InodeID, name string) error {
+	entries, err := listDir(sw.ctx, sw.fs, dir)
+	if err != nil {
+		return fmt.Errorf("ReadDir(%q): %w", name, err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+
+		op := fuseops.LookUpInodeOp{Parent: dir, Name: e.Name}
+		if err := sw.fs.LookUpInode(sw.ctx, &op); err != nil {
+			return fmt.Errorf("LookUpInode(%q): %w", path.Join(name, e.Name), err)
+		}
+
+		if op.Entry.Child == 0 {
+			continue
+		}
+
+		err := sw.write(op.Entry.Child, snapshotPath(name, e.Name), op.Entry.Attributes)
+		sw.fs.ForgetInode(sw.ctx, &fuseops.ForgetInodeOp{Inode: op.Entry.Child, N: 1})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Return the name in the archive of a directory's child.
+func snapshotPath(dir string, child string) string {
+	if dir == "." {
+		return child
+	}
+
+	return dir + "/" + child
+}
+
+// ReadTar restores a file system from a tar archive written by WriteTar, or
+// by tar(1) from a directory, by calling its methods directly before it is
+// mounted. The file system should be empty; entries in the archive whose
+// names already exist fail with the file system's error, usually EEXIST.
+//
+// Directories must appear in the archive before their contents, and the
+// targets of hard links before the links. Permissions, owners, times and
+// extended attributes are restored once all entries have been created, so
+// that directory times aren't disturbed by the creation of their children.
+// The entry for "./", if any, applies to the root directory.
+//
+// Every inode returned by the file system is forgotten again at the end,
+// even if restoring fails part way.
+func ReadTar(ctx context.Context, fileSystem FileSystem, r io.Reader) (err error) {
+	sr := snapshotReader{
+		ctx:     ctx,
+		fs:      fileSystem,
+		inodes:  map[string]fuseops.InodeID{".": fuseops.RootInodeID},
+		lookups: make(map[fuseops.InodeID]uint64),
+	}
+
+	defer sr.forget()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := sr.create(hdr, tr); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range sr.created {
+		if err := sr.setAttributes(e.inode, e.hdr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type snapshotReader struct {
+	ctx context.Context
+	fs  FileSystem
+
+	// The inode created for each cleaned name in the archive.
+	inodes map[string]fuseops.InodeID
+
+	// The number of lookups of each inode returned by the file system.
+	lookups map[fuseops.InodeID]uint64
+
+	// The entries whose attributes are still to be set, in archive order.
+	created []snapshotEntry
+}
+
+type snapshotEntry struct {
+	inode fuseops.InodeID
+	hdr   *tar.Header
+}
+
+// Create the inode for an entry in the archive.
+func (sr *snapshotReader) create(hdr *tar.Header, contents io.Reader) error {
+	name := path.Clean(hdr.Name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("%s: name outside the file system", hdr.Name)
+	}
+
+	if name == "." {
+		if hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("%s: root is not a directory", hdr.Name)
+		}
+
+		sr.created = append(sr.created, snapshotEntry{fuseops.RootInodeID, hdr})
+		return nil
+	}
+
+	parent, ok := sr.inodes[path.Dir(name)]
+	if !ok {
+		return fmt.Errorf("%s: %w", hdr.Name, fuse.ENOENT)
+	}
+
+	base := path.Base(name)
+	mode := hdr.FileInfo().Mode()
+
+	var entry *fuseops.ChildInodeEntry
+	var err error
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		op := fuseops.MkDirOp{Parent: parent, Name: base, Mode: mode}
+		err = sr.fs.MkDir(sr.ctx, &op)
+		entry = &op.Entry
+
+	case tar.TypeReg, tar.TypeRegA:
+		var op *fuseops.CreateFileOp
+		op, err = sr.createFile(parent, base, mode, contents)
+		if op != nil {
+			entry = &op.Entry
+		}
+
+	case tar.TypeSymlink:
+		op := fuseops.CreateSymlinkOp{Parent: parent, Name: base, Target: hdr.Linkname}
+		err = sr.fs.CreateSymlink(sr.ctx, &op)
+		entry = &op.Entry
+
+	case tar.TypeLink:
+		target, ok := sr.inodes[path.Clean(hdr.Linkname)]
+		if !ok {
+			return fmt.Errorf("%s: link to %s: %w", hdr.Name, hdr.Linkname, fuse.ENOENT)
+		}
+
+		op := fuseops.CreateLinkOp{Parent: parent, Name: base, Target: target}
+		if err = sr.fs.CreateLink(sr.ctx, &op); err == nil {
+			sr.inodes[name] = target
+			sr.lookups[target]++
+			return nil
+		}
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		op := fuseops.MkNodeOp{
+			Parent: parent,
+			Name:   base,
+			Mode:   mode,
+			Rdev:   mkRdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)),
+		}
+
+		err = sr.fs.MkNode(sr.ctx, &op)
+		entry = &op.Entry
+
+	default:
+		return fmt.Errorf("%s: unsupported type %q", hdr.Name, hdr.Typeflag)
+	}
+
+	if entry != nil && entry.Child != 0 {
+		sr.inodes[name] = entry.Child
+		sr.lookups[entry.Child]++
+		sr.created = append(sr.created, snapshotEntry{entry.Child, hdr})
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", hdr.Name, err)
+	}
+
+	return nil
+}
+
+// Create a regular file and copy its contents in. The op is returned if the
+// file was created, even if writing to it failed.
+func (sr *snapshotReader) createFile(
+	parent fuseops.InodeID,
+	name string,
+	mode os.FileMode,
+	contents io.Reader) (*fuseops.CreateFileOp, error) {
+	op := &fuseops.CreateFileOp{
+		Parent:    parent,
+		Name:      name,
+		Mode:      mode,
+		OpenFlags: fusekernel.OpenWriteOnly,
+	}
+
+	if err := sr.fs.CreateFile(sr.ctx, op); err != nil {
+		return nil, err
+	}
+
+	defer sr.fs.ReleaseFileHandle(sr.ctx, &fuseops.ReleaseFileHandleOp{Handle: op.Handle})
+
+	buf := make([]byte, snapshotChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(contents, buf)
+		if n > 0 {
+			writeOp := fuseops.WriteFileOp{
+				Inode:  op.Entry.Child,
+				Handle: op.Handle,
+				Offset: offset,
+				Data:   buf[:n],
+			}
+
+			if err := sr.fs.WriteFile(sr.ctx, &writeOp); err != nil {
+				return op, err
+			}
+
+			if writeOp.Callback != nil {
+				writeOp.Callback()
+			}
+
+			offset += int64(n)
+		}
+
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return op, nil
+
+		case err != nil:
+			return op, err
+		}
+	}
+}
+
+// Set the attributes recorded in the archive for an inode that has been
+// created.
+func (sr *snapshotReader) setAttributes(inode fuseops.InodeID, hdr *tar.Header) error {
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+
+		op := fuseops.SetXattrOp{
+			Inode: inode,
+			Name:  strings.TrimPrefix(key, paxXattrPrefix),
+			Value: []byte(value),
+		}
+
+		if err := sr.fs.SetXattr(sr.ctx, &op); err != nil {
+			return fmt.Errorf("SetXattr(%q, %q): %w", hdr.Name, op.Name, err)
+		}
+	}
+
+	uid := uint32(hdr.Uid)
+	gid := uint32(hdr.Gid)
+	op := fuseops.SetInodeAttributesOp{
+		Inode: inode,
+		Uid:   &uid,
+		Gid:   &gid,
+		Mtime: &hdr.ModTime,
+	}
+
+	// The kernel never changes the permissions of symlinks.
+	if hdr.Typeflag != tar.TypeSymlink {
+		mode := hdr.FileInfo().Mode()
+		op.Mode = &mode
+	}
+
+	if !hdr.AccessTime.IsZero() {
+		op.Atime = &hdr.AccessTime
+	}
+
+	if err := sr.fs.SetInodeAttributes(sr.ctx, &op); err != nil {
+		return fmt.Errorf("SetInodeAttributes(%q): %w", hdr.Name, err)
+	}
+
+	return nil
+}
+
+// Drop the references to the inodes the file system returned.
+func (sr *snapshotReader) forget() {
+	for inode, n := range sr.lookups {
+		sr.fs.ForgetInode(sr.ctx, &fuseops.ForgetInodeOp{Inode: inode, N: n})
+	}
+}
+
+// Split and join the device numbers in fuseops.InodeAttributes.Rdev, which
+// uses the kernel's encoding of 32-bit dev_t values (new_encode_dev).
+func rdevMajor(rdev uint32) uint32 {
+	return (rdev >> 8) & 0xfff
+}
+
+func rdevMinor(rdev uint32) uint32 {
+	return rdev&0xff | (rdev>>12)&0xfff00
+}
+
+func mkRdev(major uint32, minor uint32) uint32 {
+	return minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12
+}
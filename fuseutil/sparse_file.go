@@ -0,0 +1,277 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"io"
+	"sort"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An Extent is a range of a SparseFile that has space allocated for it.
+type Extent struct {
+	Offset uint64
+	Length uint64
+}
+
+// SparseFile holds the contents of a file in memory as a list of extents,
+// with holes between and after them that read as zeroes and take no space.
+// Its Fallocate and Seek methods are the reference for how file systems
+// should answer fuseops.FallocateOp and fuseops.LseekOp: writing or
+// allocating a range fills it in, punching a hole empties it, and SeekData
+// and SeekHole find the boundaries between the two. Extents lie within the
+// file; space allocated past its end is dropped.
+//
+// The zero value is an empty file. External synchronization is required.
+type SparseFile struct {
+	size uint64
+
+	// INVARIANT: Sorted by offset, with none empty, overlapping or adjacent.
+	// INVARIANT: Each ends at or before size.
+	extents []sparseExtent
+}
+
+type sparseExtent struct {
+	off  uint64
+	data []byte
+}
+
+func (x *sparseExtent) end() uint64 {
+	return x.off + uint64(len(x.data))
+}
+
+// Size returns the size of the file.
+func (f *SparseFile) Size() uint64 {
+	return f.size
+}
+
+// Extents returns the ranges of the file that have space allocated.
+func (f *SparseFile) Extents() []Extent {
+	out := make([]Extent, len(f.extents))
+	for i, x := range f.extents {
+		out[i] = Extent{Offset: x.off, Length: uint64(len(x.data))}
+	}
+
+	return out
+}
+
+// Return the index of the first extent ending at or after off.
+func (f *SparseFile) search(off uint64) int {
+	return sort.Search(len(f.extents), func(i int) bool {
+		return f.extents[i].end() >= off
+	})
+}
+
+// Make sure [off, end) is allocated, returning the extent that covers it.
+//
+// REQUIRES: off < end <= f.size
+func (f *SparseFile) allocate(off, end uint64) *sparseExtent {
+	// Find the extents overlapping or adjacent to the range, which are merged
+	// into one. Grow the first of them in place if it starts early enough, so
+	// that appending is cheap.
+	i := f.search(off)
+	j := i
+	for j < len(f.extents) && f.extents[j].off <= end {
+		j++
+	}
+
+	merged := sparseExtent{off: off}
+	rest := f.extents[i:j]
+	if i < j && f.extents[i].off <= off {
+		merged = f.extents[i]
+		rest = rest[1:]
+	}
+
+	if j > i && f.extents[j-1].end() > end {
+		end = f.extents[j-1].end()
+	}
+
+	if n := end - merged.off; uint64(len(merged.data)) < n {
+		merged.data = append(merged.data, make([]byte, n-uint64(len(merged.data)))...)
+	}
+
+	for _, x := range rest {
+		copy(merged.data[x.off-merged.off:], x.data)
+	}
+
+	f.extents = append(f.extents[:i], append([]sparseExtent{merged}, f.extents[j:]...)...)
+	return &f.extents[i]
+}
+
+// Release the space for [off, end), which then reads as zeroes.
+func (f *SparseFile) deallocate(off, end uint64) {
+	var out []sparseExtent
+	for _, x := range f.extents {
+		if x.end() <= off || x.off >= end {
+			out = append(out, x)
+			continue
+		}
+
+		// Keep the parts outside the range. The part before it must not be able
+		// to grow into the part after it.
+		if x.off < off {
+			n := off - x.off
+			out = append(out, sparseExtent{off: x.off, data: x.data[:n:n]})
+		}
+
+		if x.end() > end {
+			out = append(out, sparseExtent{off: end, data: x.data[end-x.off:]})
+		}
+	}
+
+	f.extents = out
+}
+
+// ReadAt reads from the file as described by io.ReaderAt, reading zeroes from
+// holes.
+func (f *SparseFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	if uint64(off) >= f.size {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if avail := f.size - uint64(off); uint64(n) > avail {
+		n = int(avail)
+	}
+
+	start, end := uint64(off), uint64(off)+uint64(n)
+	for i := range p[:n] {
+		p[i] = 0
+	}
+
+	for i := f.search(start + 1); i < len(f.extents) && f.extents[i].off < end; i++ {
+		x := &f.extents[i]
+		if x.off > start {
+			copy(p[x.off-start:n], x.data)
+		} else {
+			copy(p[:n], x.data[start-x.off:])
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteAt writes to the file as described by io.WriterAt, growing it if the
+// data ends past its end.
+func (f *SparseFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	start, end := uint64(off), uint64(off)+uint64(len(p))
+	if end > f.size {
+		f.size = end
+	}
+
+	x := f.allocate(start, end)
+	return copy(x.data[start-x.off:], p), nil
+}
+
+// Truncate changes the size of the file. Growing it adds a hole at the end.
+func (f *SparseFile) Truncate(size uint64) {
+	if size < f.size {
+		f.deallocate(size, f.size)
+	}
+
+	f.size = size
+}
+
+// Fallocate changes the allocation of [offset, offset+length) as described by
+// fuseops.FallocateOp, returning EOPNOTSUPP for modes the kernel doesn't send.
+func (f *SparseFile) Fallocate(
+	mode fuseops.FallocateMode,
+	offset uint64,
+	length uint64) error {
+	end := offset + length
+	if length == 0 || end < offset {
+		return syscall.EINVAL
+	}
+
+	switch mode {
+	case 0, fuseops.FallocateKeepSize:
+	case fuseops.FallocatePunchHole | fuseops.FallocateKeepSize:
+	case fuseops.FallocateZeroRange, fuseops.FallocateZeroRange | fuseops.FallocateKeepSize:
+	default:
+		return syscall.EOPNOTSUPP
+	}
+
+	if mode&fuseops.FallocateKeepSize == 0 && end > f.size {
+		f.size = end
+	}
+
+	if end > f.size {
+		end = f.size
+	}
+
+	if offset >= end {
+		return nil
+	}
+
+	if mode&(fuseops.FallocatePunchHole|fuseops.FallocateZeroRange) != 0 {
+		f.deallocate(offset, end)
+	}
+
+	if mode&fuseops.FallocatePunchHole == 0 {
+		f.allocate(offset, end)
+	}
+
+	return nil
+}
+
+// Seek finds the next data or hole at or after offset, as described by
+// fuseops.LseekOp. The end of the file counts as a hole.
+func (f *SparseFile) Seek(offset uint64, whence fuseops.SeekWhence) (uint64, error) {
+	if whence != fuseops.SeekData && whence != fuseops.SeekHole {
+		return 0, syscall.EINVAL
+	}
+
+	if offset >= f.size {
+		return 0, syscall.ENXIO
+	}
+
+	// Find the first extent ending after offset. Since extents aren't
+	// adjacent, a hole follows each of them.
+	i := f.search(offset + 1)
+	if whence == fuseops.SeekData {
+		switch {
+		case i == len(f.extents):
+			return 0, syscall.ENXIO
+		case f.extents[i].off > offset:
+			return f.extents[i].off, nil
+		}
+
+		return offset, nil
+	}
+
+	if i < len(f.extents) && f.extents[i].off <= offset {
+		return f.extents[i].end(), nil
+	}
+
+	return offset, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestSparseFile(t *testing.T) {
+	var f fuseutil.SparseFile
+
+	// Two runs of data with a hole between them and one after.
+	f.WriteAt([]byte("taco"), 0)
+	f.WriteAt([]byte("burrito"), 10)
+	f.Truncate(20)
+
+	want := []fuseutil.Extent{{Offset: 0, Length: 4}, {Offset: 10, Length: 7}}
+	if got := f.Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Extents = %v, want %v", got, want)
+	}
+
+	buf := make([]byte, 32)
+	n, err := f.ReadAt(buf, 2)
+	if n != 18 || err != io.EOF {
+		t.Errorf("ReadAt = %d, %v, want 18, EOF", n, err)
+	}
+
+	if got := string(buf[:n]); got != "co\x00\x00\x00\x00\x00\x00burrito\x00\x00\x00" {
+		t.Errorf("ReadAt read %q", got)
+	}
+
+	seeks := []struct {
+		offset  uint64
+		whence  fuseops.SeekWhence
+		want    uint64
+		wantErr error
+	}{
+		{0, fuseops.SeekData, 0, nil},
+		{4, fuseops.SeekData, 10, nil},
+		{12, fuseops.SeekData, 12, nil},
+		{17, fuseops.SeekData, 0, syscall.ENXIO},
+		{0, fuseops.SeekHole, 4, nil},
+		{5, fuseops.SeekHole, 5, nil},
+		{10, fuseops.SeekHole, 17, nil},
+		{20, fuseops.SeekHole, 0, syscall.ENXIO},
+	}
+
+	for _, s := range seeks {
+		got, err := f.Seek(s.offset, s.whence)
+		if got != s.want || err != s.wantErr {
+			t.Errorf("Seek(%d, %v) = %d, %v, want %d, %v", s.offset, s.whence, got, err, s.want, s.wantErr)
+		}
+	}
+
+	// Punching a hole splits an extent, and filling it joins them again.
+	f.Fallocate(fuseops.FallocatePunchHole|fuseops.FallocateKeepSize, 12, 2)
+	want = []fuseutil.Extent{{Offset: 0, Length: 4}, {Offset: 10, Length: 2}, {Offset: 14, Length: 3}}
+	if got := f.Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("After punching, Extents = %v, want %v", got, want)
+	}
+
+	f.WriteAt([]byte("ZZZZZZ"), 4)
+	want = []fuseutil.Extent{{Offset: 0, Length: 12}, {Offset: 14, Length: 3}}
+	if got := f.Extents(); !reflect.DeepEqual(got, want) {
+		t.Errorf("After filling, Extents = %v, want %v", got, want)
+	}
+
+	// Space allocated past the end is dropped unless the file grows.
+	f.Fallocate(fuseops.FallocateKeepSize, 18, 10)
+	f.Fallocate(0, 25, 5)
+	want = []fuseutil.Extent{{Offset: 0, Length: 12}, {Offset: 14, Length: 3}, {Offset: 18, Length: 2}, {Offset: 25, Length: 5}}
+	if got := f.Extents(); !reflect.DeepEqual(got, want) || f.Size() != 30 {
+		t.Errorf("After allocating, Extents = %v with size %d, want %v with size 30", got, f.Size(), want)
+	}
+
+	if err := f.Fallocate(fuseops.FallocatePunchHole, 0, 1); err != syscall.EOPNOTSUPP {
+		t.Errorf("Punching without KeepSize: %v, want EOPNOTSUPP", err)
+	}
+}
+
+// Check that a SparseFile reads the same as a plain byte slice after a random
+// sequence of changes.
+func TestSparseFile_Random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	var f fuseutil.SparseFile
+	var model []byte
+
+	grow := func(end int) {
+		if end > len(model) {
+			model = append(model, make([]byte, end-len(model))...)
+		}
+	}
+
+	for i := 0; i < 5000; i++ {
+		off := r.Intn(256)
+		length := 1 + r.Intn(32)
+
+		switch r.Intn(5) {
+		case 0, 1:
+			data := make([]byte, length)
+			r.Read(data)
+			f.WriteAt(data, int64(off))
+			grow(off + length)
+			copy(model[off:], data)
+
+		case 2:
+			f.Fallocate(fuseops.FallocatePunchHole|fuseops.FallocateKeepSize, uint64(off), uint64(length))
+			for j := off; j < off+length && j < len(model); j++ {
+				model[j] = 0
+			}
+
+		case 3:
+			f.Fallocate(fuseops.FallocateZeroRange, uint64(off), uint64(length))
+			grow(off + length)
+			for j := off; j < off+length; j++ {
+				model[j] = 0
+			}
+
+		case 4:
+			f.Truncate(uint64(off))
+			if off < len(model) {
+				model = model[:off]
+			}
+			grow(off)
+		}
+
+		buf := make([]byte, len(model))
+		if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+			t.Fatalf("Step %d: ReadAt: %v", i, err)
+		}
+
+		if f.Size() != uint64(len(model)) || !bytes.Equal(buf, model) {
+			t.Fatalf("Step %d: contents differ from model", i)
+		}
+
+		// Extents are sorted, separated, and within the file.
+		var end uint64
+		for j, x := range f.Extents() {
+			if x.Length == 0 || (j > 0 && x.Offset <= end) || x.Offset+x.Length > f.Size() {
+				t.Fatalf("Step %d: bad extents %v with size %d", i, f.Extents(), f.Size())
+			}
+
+			end = x.Offset + x.Length
+		}
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// StaticNode declares a file or directory within a StaticFS.
+type StaticNode struct {
+	// The name of the node within its parent. Ignored for the root.
+	Name string
+
+	// The permission bits of the node. os.ModeDir must be set for
+	// directories; any other type bits are an error. If zero, 0444 is used for
+	// files and 0555 for directories.
+	Mode os.FileMode
+
+	// The modification time reported for the node. If zero, the time at which
+	// the StaticFS was created is used.
+	Mtime time.Time
+
+	// For files, a function returning the file's contents. It is called when
+	// the file is opened and when its size is needed, and may return different
+	// contents each time. A nil function gives an empty file. Errors are
+	// returned to the kernel, so should be syscall.Errno values.
+	Content func() ([]byte, error)
+
+	// For directories, the children in the order they should be listed.
+	Children []*StaticNode
+}
+
+func (n *StaticNode) isDir() bool {
+	return n.Mode&os.ModeDir != 0
+}
+
+// StaticFS is a read-only file system serving a fixed tree of StaticNodes,
+// taking care of inode IDs, directory entries, and handles so that simple
+// informational file systems need no knowledge of the protocol. Create one
+// with NewStaticFS and serve it with NewFileSystemServer.
+//
+// Each open file handle serves the contents returned by the node's Content
+// function at open time, and is opened with direct I/O so that the kernel
+// doesn't truncate reads to a stale size.
+type StaticFS struct {
+	NotImplementedFileSystem
+
+	uid uint32
+	gid uint32
+
+	// The nodes of the tree, indexed by inode ID. Entries below RootInodeID
+	// are unused.
+	//
+	// Constant after construction.
+	inodes []*staticInode
+
+	handles *HandleIDAllocator
+
+	mu sync.Mutex
+
+	// The contents served by each open file handle.
+	contents map[fuseops.HandleID][]byte // GUARDED_BY(mu)
+}
+
+type staticInode struct {
+	node     *StaticNode
+	mtime    time.Time
+	children []Dirent
+}
+
+// NewStaticFS creates a file system whose root directory is the supplied
+// node. Files and directories are owned by the current user. An error is
+// returned if the tree is malformed, e.g. if a directory contains two
+// children with the same name.
+func NewStaticFS(root *StaticNode) (*StaticFS, error) {
+	if !root.isDir() {
+		return nil, fmt.Errorf("Root node must be a directory")
+	}
+
+	fs := &StaticFS{
+		uid:      uint32(os.Getuid()),
+		gid:      uint32(os.Getgid()),
+		inodes:   make([]*staticInode, fuseops.RootInodeID),
+		handles:  NewHandleIDAllocator(false),
+		contents: make(map[fuseops.HandleID][]byte),
+	}
+
+	if _, err := fs.addNode(root, "", time.Now()); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// Assign an inode ID to n and its descendants, depth first.
+func (fs *StaticFS) addNode(
+	n *StaticNode,
+	path string,
+	now time.Time) (fuseops.InodeID, error) {
+	if n.Mode&os.ModeType&^os.ModeDir != 0 {
+		return 0, fmt.Errorf("%s: unsupported mode %v", path, n.Mode)
+	}
+
+	if n.isDir() && n.Content != nil {
+		return 0, fmt.Errorf("%s: directory has content", path)
+	}
+
+	if !n.isDir() && len(n.Children) != 0 {
+		return 0, fmt.Errorf("%s: file has children", path)
+	}
+
+	in := &staticInode{
+		node:  n,
+		mtime: n.Mtime,
+	}
+
+	if in.mtime.IsZero() {
+		in.mtime = now
+	}
+
+	id := fuseops.InodeID(len(fs.inodes))
+	fs.inodes = append(fs.inodes, in)
+
+	seen := make(map[string]bool)
+	for i, child := range n.Children {
+		childPath := path + "/" + child.Name
+		if child.Name == "" ||
+			child.Name == "." ||
+			child.Name == ".." ||
+			strings.Contains(child.Name, "/") {
+			return 0, fmt.Errorf("%s: invalid name", childPath)
+		}
+
+		if seen[child.Name] {
+			return 0, fmt.Errorf("%s: duplicate name", childPath)
+		}
+
+		seen[child.Name] = true
+
+		childID, err := fs.addNode(child, childPath, now)
+		if err != nil {
+			return 0, err
+		}
+
+		d := Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  childID,
+			Name:   child.Name,
+			Type:   DT_File,
+		}
+
+		if child.isDir() {
+			d.Type = DT_Directory
+		}
+
+		in.children = append(in.children, d)
+	}
+
+	return id, nil
+}
+
+func (fs *StaticFS) inode(id fuseops.InodeID) (*staticInode, error) {
+	if id < fuseops.RootInodeID || uint64(id) >= uint64(len(fs.inodes)) {
+		return nil, fuse.ENOENT
+	}
+
+	return fs.inodes[id], nil
+}
+
+func (fs *StaticFS) attributes(in *staticInode) (fuseops.InodeAttributes, error) {
+	attrs := fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  in.node.Mode,
+		Atime: in.mtime,
+		Mtime: in.mtime,
+		Ctime: in.mtime,
+		Uid:   fs.uid,
+		Gid:   fs.gid,
+	}
+
+	if in.node.isDir() {
+		if attrs.Mode.Perm() == 0 {
+			attrs.Mode |= 0555
+		}
+
+		return attrs, nil
+	}
+
+	if attrs.Mode == 0 {
+		attrs.Mode = 0444
+	}
+
+	if in.node.Content != nil {
+		b, err := in.node.Content()
+		if err != nil {
+			return attrs, err
+		}
+
+		attrs.Size = uint64(len(b))
+	}
+
+	return attrs, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *StaticFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *StaticFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.inode(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range parent.children {
+		if d.Name == op.Name {
+			op.Entry.Child = d.Inode
+			op.Entry.Attributes, err = fs.attributes(fs.inodes[d.Inode])
+			return err
+		}
+	}
+
+	return fuse.ENOENT
+}
+
+func (fs *StaticFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, err = fs.attributes(in)
+	return err
+}
+
+func (fs *StaticFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	// Inodes live as long as the file system.
+	return nil
+}
+
+func (fs *StaticFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return nil
+}
+
+func (fs *StaticFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if !in.node.isDir() {
+		return fuse.ENOTDIR
+	}
+
+	return nil
+}
+
+func (fs *StaticFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Offset > fuseops.DirOffset(len(in.children)) {
+		return nil
+	}
+
+	for _, d := range in.children[op.Offset:] {
+		n := WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *StaticFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *StaticFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if in.node.isDir() {
+		return syscall.EISDIR
+	}
+
+	if !op.OpenFlags.IsReadOnly() {
+		return syscall.EROFS
+	}
+
+	var b []byte
+	if in.node.Content != nil {
+		if b, err = in.node.Content(); err != nil {
+			return err
+		}
+	}
+
+	op.Handle = fs.handles.Allocate()
+	op.UseDirectIO = true
+
+	fs.mu.Lock()
+	fs.contents[op.Handle] = b
+	fs.mu.Unlock()
+
+	return nil
+}
+
+func (fs *StaticFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	b, ok := fs.contents[op.Handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	if op.Offset < int64(len(b)) {
+		if op.Dst != nil {
+			op.BytesRead = copy(op.Dst, b[op.Offset:])
+		} else {
+			end := op.Offset + op.Size
+			if end > int64(len(b)) {
+				end = int64(len(b))
+			}
+
+			op.Data = [][]byte{b[op.Offset:end]}
+			op.BytesRead = int(end - op.Offset)
+		}
+	}
+
+	return nil
+}
+
+func (fs *StaticFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *StaticFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	delete(fs.contents, op.Handle)
+	fs.mu.Unlock()
+
+	fs.handles.Release(op.Handle)
+	return nil
+}
+
+func (fs *StaticFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fuse.ENOATTR
+}
+
+func (fs *StaticFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return nil
+}
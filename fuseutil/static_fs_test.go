@@ -0,0 +1,165 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func newTestStaticFS(t *testing.T, version *string) *fuseutil.StaticFS {
+	t.Helper()
+	fs, err := fuseutil.NewStaticFS(&fuseutil.StaticNode{
+		Mode: os.ModeDir,
+		Children: []*fuseutil.StaticNode{
+			{
+				Name:    "version",
+				Content: func() ([]byte, error) { return []byte(*version), nil },
+			},
+			{
+				Name: "dir",
+				Mode: 0500 | os.ModeDir,
+				Children: []*fuseutil.StaticNode{
+					{Name: "empty", Mode: 0400},
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("NewStaticFS: %v", err)
+	}
+
+	return fs
+}
+
+func TestStaticFSInvalidTrees(t *testing.T) {
+	testCases := map[string]*fuseutil.StaticNode{
+		"file root": {Name: "f"},
+		"duplicate names": {
+			Mode: os.ModeDir,
+			Children: []*fuseutil.StaticNode{
+				{Name: "a"},
+				{Name: "a"},
+			},
+		},
+		"slash in name": {
+			Mode:     os.ModeDir,
+			Children: []*fuseutil.StaticNode{{Name: "a/b"}},
+		},
+		"file with children": {
+			Mode: os.ModeDir,
+			Children: []*fuseutil.StaticNode{
+				{Name: "a", Children: []*fuseutil.StaticNode{{Name: "b"}}},
+			},
+		},
+		"symlink": {
+			Mode:     os.ModeDir,
+			Children: []*fuseutil.StaticNode{{Name: "a", Mode: os.ModeSymlink}},
+		},
+	}
+
+	for desc, root := range testCases {
+		if _, err := fuseutil.NewStaticFS(root); err == nil {
+			t.Errorf("%s: NewStaticFS succeeded", desc)
+		}
+	}
+}
+
+func TestStaticFS(t *testing.T) {
+	version := "v1"
+	fs := newTestStaticFS(t, &version)
+	ctx := context.Background()
+
+	// Walk to the nested file.
+	dir := lookUp(t, fs, fuseops.RootInodeID, "dir")
+	empty := lookUp(t, fs, dir, "empty")
+
+	attrs := fusetesting.NewGetInodeAttributesOp(dir)
+	if err := fs.GetInodeAttributes(ctx, attrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if attrs.Attributes.Mode != 0500|os.ModeDir {
+		t.Errorf("dir mode = %v", attrs.Attributes.Mode)
+	}
+
+	attrs = fusetesting.NewGetInodeAttributesOp(empty)
+	if err := fs.GetInodeAttributes(ctx, attrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if attrs.Attributes.Mode != 0400 || attrs.Attributes.Size != 0 {
+		t.Errorf("empty attributes = %v", attrs.Attributes.DebugString())
+	}
+
+	// List the root.
+	op := fusetesting.NewReadDirOp(fuseops.RootInodeID, 0, 0)
+	if err := fs.ReadDir(ctx, op); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	entries, err := parseDirents(op.Dst[:op.BytesRead])
+	if err != nil {
+		t.Fatalf("parseDirents: %v", err)
+	}
+
+	if len(entries) != 2 ||
+		entries[0].Name != "version" || entries[0].Type != fuseutil.DT_File ||
+		entries[1].Name != "dir" || entries[1].Type != fuseutil.DT_Directory {
+		t.Errorf("Unexpected listing: %+v", entries)
+	}
+
+	// Open the dynamic file, then change its contents. The handle should keep
+	// serving what was there at open time, while attributes track the change.
+	f := lookUp(t, fs, fuseops.RootInodeID, "version")
+	open := fusetesting.NewOpenFileOp(f, fusekernel.OpenReadOnly)
+	if err := fs.OpenFile(ctx, open); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	version = "v22"
+
+	read := fusetesting.NewReadFileOp(f, open.Handle, 0, 100)
+	if err := fs.ReadFile(ctx, read); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got := string(read.Dst[:read.BytesRead]); got != "v1" {
+		t.Errorf("ReadFile = %q, want %q", got, "v1")
+	}
+
+	attrs = fusetesting.NewGetInodeAttributesOp(f)
+	if err := fs.GetInodeAttributes(ctx, attrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if attrs.Attributes.Size != 3 {
+		t.Errorf("Size = %d, want 3", attrs.Attributes.Size)
+	}
+
+	// Writing is refused.
+	open = fusetesting.NewOpenFileOp(f, fusekernel.OpenReadWrite)
+	if err := fs.OpenFile(ctx, open); err != syscall.EROFS {
+		t.Errorf("OpenFile for writing: %v, want EROFS", err)
+	}
+}
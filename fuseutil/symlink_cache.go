@@ -0,0 +1,308 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// SymlinkCache wraps a file system, caching the targets returned by its
+// ReadSymlink method, for backends where reading a symlink is expensive and
+// trees are full of them. Kernels since Linux 4.20 can cache targets
+// themselves (see MountConfig.EnableSymlinkCaching); this helps with older
+// ones, and with targets the kernel has evicted.
+//
+// Cached targets are discarded when, through the wrapper:
+//
+//   - the symlink's attributes are set,
+//
+//   - a name under which the wrapper has returned the symlink, from
+//     LookUpInode, CreateSymlink or CreateLink, is unlinked or renamed over,
+//
+//   - the kernel forgets the symlink, so inode IDs may be reused.
+//
+// Call Invalidate when a target changes by other means.
+//
+// It is safe for concurrent use.
+type SymlinkCache struct {
+	FileSystem
+	notifier Notifier // May be nil
+
+	mu sync.Mutex
+
+	targets map[fuseops.InodeID]string // GUARDED_BY(mu)
+
+	// The names under which symlinks have been returned, both ways round.
+	inodes map[lookUpKey]fuseops.InodeID   // GUARDED_BY(mu)
+	names  map[fuseops.InodeID][]lookUpKey // GUARDED_BY(mu)
+
+	// Incremented each time a target is discarded, so that a target read
+	// before then isn't cached after.
+	generation uint64 // GUARDED_BY(mu)
+}
+
+// NewSymlinkCache wraps the file system with an empty cache. n may be nil, in
+// which case Invalidate doesn't notify the kernel.
+func NewSymlinkCache(wrapped FileSystem, n Notifier) *SymlinkCache {
+	return &SymlinkCache{
+		FileSystem: wrapped,
+		notifier:   n,
+		targets:    make(map[fuseops.InodeID]string),
+		inodes:     make(map[lookUpKey]fuseops.InodeID),
+		names:      make(map[fuseops.InodeID][]lookUpKey),
+	}
+}
+
+// Invalidate discards the cached target of the symlink and, if configured,
+// asks the kernel to drop its own copy. Don't call it from within an op on
+// the same symlink, since the kernel may be holding locks that the
+// notification needs.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) Invalidate(inode fuseops.InodeID) error {
+	c.mu.Lock()
+	c.dropLocked(inode)
+	c.mu.Unlock()
+
+	if c.notifier == nil {
+		return nil
+	}
+
+	return c.notifier.NotifyInvalInode(inode, 0, 0)
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *SymlinkCache) dropLocked(inode fuseops.InodeID) {
+	delete(c.targets, inode)
+	c.generation++
+}
+
+// Record that the entry was returned under the name, if it is a symlink.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) learn(
+	parent fuseops.InodeID,
+	name string,
+	e fuseops.ChildInodeEntry) {
+	if e.Child == 0 || e.Attributes.Mode&os.ModeType != os.ModeSymlink {
+		return
+	}
+
+	key := lookUpKey{parent, name}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inodes[key] == e.Child {
+		return
+	}
+
+	c.removeNameLocked(key)
+	c.inodes[key] = e.Child
+	c.names[e.Child] = append(c.names[e.Child], key)
+}
+
+// Stop tracking the name, returning the symlink it referred to, if any.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *SymlinkCache) removeNameLocked(key lookUpKey) (fuseops.InodeID, bool) {
+	inode, ok := c.inodes[key]
+	if !ok {
+		return 0, false
+	}
+
+	delete(c.inodes, key)
+
+	names := c.names[inode]
+	for i, k := range names {
+		if k == key {
+			names = append(names[:i], names[i+1:]...)
+			break
+		}
+	}
+
+	if len(names) == 0 {
+		delete(c.names, inode)
+	} else {
+		c.names[inode] = names
+	}
+
+	return inode, true
+}
+
+// Discard the target of the symlink referred to by the name, which has gone.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) removed(parent fuseops.InodeID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if inode, ok := c.removeNameLocked(lookUpKey{parent, name}); ok {
+		c.dropLocked(inode)
+	}
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) forget(inode fuseops.InodeID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dropLocked(inode)
+	for _, key := range c.names[inode] {
+		delete(c.inodes, key)
+	}
+
+	delete(c.names, inode)
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	c.mu.Lock()
+	target, ok := c.targets[op.Inode]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if ok {
+		op.Target = target
+		return nil
+	}
+
+	if err := c.FileSystem.ReadSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.targets[op.Inode] = op.Target
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := c.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	c.learn(op.Parent, op.Name, op.Entry)
+	return nil
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := c.FileSystem.CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	c.learn(op.Parent, op.Name, op.Entry)
+	return nil
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := c.FileSystem.CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	c.learn(op.Parent, op.Name, op.Entry)
+	return nil
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	// Discard the target whether or not the change succeeded, since it may
+	// have been partly made.
+	defer func() {
+		c.mu.Lock()
+		c.dropLocked(op.Inode)
+		c.mu.Unlock()
+	}()
+
+	return c.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := c.FileSystem.Unlink(ctx, op); err != nil {
+		return err
+	}
+
+	c.removed(op.Parent, op.Name)
+	return nil
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := c.FileSystem.Rename(ctx, op); err != nil {
+		return err
+	}
+
+	c.removed(op.NewParent, op.NewName)
+
+	// A symlink keeps its target when it moves.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if inode, ok := c.removeNameLocked(lookUpKey{op.OldParent, op.OldName}); ok {
+		key := lookUpKey{op.NewParent, op.NewName}
+		c.inodes[key] = inode
+		c.names[inode] = append(c.names[inode], key)
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	c.forget(op.Inode)
+	return c.FileSystem.ForgetInode(ctx, op)
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SymlinkCache) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		c.forget(e.Inode)
+	}
+
+	return c.FileSystem.BatchForget(ctx, op)
+}
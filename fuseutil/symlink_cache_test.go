@@ -0,0 +1,154 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A directory of symlinks, counting reads of their targets.
+type symlinkFS struct {
+	fuseutil.NotImplementedFileSystem
+	children map[string]fuseops.InodeID
+	targets  map[fuseops.InodeID]string
+	reads    int
+}
+
+func (fs *symlinkFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	child, ok := fs.children[op.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = child
+	op.Entry.Attributes.Mode = os.ModeSymlink | 0777
+	return nil
+}
+
+func (fs *symlinkFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	fs.reads++
+	op.Target = fs.targets[op.Inode]
+	return nil
+}
+
+func (fs *symlinkFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	delete(fs.children, op.Name)
+	return nil
+}
+
+func (fs *symlinkFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.children[op.NewName] = fs.children[op.OldName]
+	delete(fs.children, op.OldName)
+	return nil
+}
+
+func (fs *symlinkFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return nil
+}
+
+func (fs *symlinkFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func TestSymlinkCache(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &symlinkFS{
+		children: map[string]fuseops.InodeID{"a": 2, "b": 3},
+		targets:  map[fuseops.InodeID]string{2: "x", 3: "y"},
+	}
+
+	c := fuseutil.NewSymlinkCache(wrapped, nil)
+
+	lookUp := func(name string) {
+		t.Helper()
+		if err := c.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: 1, Name: name}); err != nil {
+			t.Fatalf("LookUpInode(%q): %v", name, err)
+		}
+	}
+
+	// Read the target of the inode, checking whether the wrapped file system
+	// was asked.
+	readSymlink := func(inode fuseops.InodeID, want string, wantRead bool) {
+		t.Helper()
+
+		reads := wrapped.reads
+		op := &fuseops.ReadSymlinkOp{Inode: inode}
+		if err := c.ReadSymlink(ctx, op); err != nil || op.Target != want {
+			t.Fatalf("ReadSymlink(%d): %q, %v", inode, op.Target, err)
+		}
+
+		if read := wrapped.reads > reads; read != wantRead {
+			t.Errorf("ReadSymlink(%d): read from the wrapped file system: %v", inode, read)
+		}
+	}
+
+	lookUp("a")
+	lookUp("b")
+	readSymlink(2, "x", true)
+	readSymlink(2, "x", false)
+	readSymlink(3, "y", true)
+
+	// Setting attributes discards the target.
+	wrapped.targets[2] = "x2"
+	c.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: 2})
+	readSymlink(2, "x2", true)
+	readSymlink(3, "y", false)
+
+	// As does renaming over the symlink, but not renaming it.
+	if err := c.Rename(ctx, &fuseops.RenameOp{OldParent: 1, OldName: "a", NewParent: 1, NewName: "b"}); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	readSymlink(2, "x2", false)
+	readSymlink(3, "y", true)
+
+	// And unlinking it, under its new name.
+	if err := c.Unlink(ctx, &fuseops.UnlinkOp{Parent: 1, Name: "b"}); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	readSymlink(2, "x2", true)
+
+	// And forgetting it.
+	readSymlink(3, "y", false)
+	c.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 3, N: 1})
+	readSymlink(3, "y", true)
+
+	// And invalidating it.
+	wrapped.targets[3] = "y2"
+	if err := c.Invalidate(3); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+
+	readSymlink(3, "y2", true)
+}
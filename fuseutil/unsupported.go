@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An UnsupportedPolicy says how to answer an op that the file system doesn't
+// implement, i.e. one for which it returns fuse.ENOSYS, as
+// NotImplementedFileSystem does. See UnsupportedOps.
+type UnsupportedPolicy int
+
+const (
+	// Return ENOSYS, as NewFileSystemServer does without hooks. For the ops
+	// listed by KernelRemembersENOSYS the kernel then stops sending the op;
+	// other calls fail with "function not implemented" every time.
+	UnsupportedENOSYS UnsupportedPolicy = iota
+
+	// Return EOPNOTSUPP, failing the call with "operation not supported", and
+	// leaving the kernel to keep sending the op.
+	UnsupportedENOTSUP
+
+	// Succeed without doing anything, for ops with nothing to return: syncs
+	// and flushes of file systems that have nothing to write out, releases,
+	// forgets, and AccessOp, which then grants everything. For other ops this
+	// acts like UnsupportedENOTSUP.
+	UnsupportedSucceed
+
+	// Return ENOSYS for the ops listed by KernelRemembersENOSYS, so that the
+	// kernel stops sending them and saves the round trips, and EOPNOTSUPP for
+	// the rest.
+	UnsupportedNeverAgain
+)
+
+func (p UnsupportedPolicy) String() string {
+	switch p {
+	case UnsupportedENOSYS:
+		return "ENOSYS"
+	case UnsupportedENOTSUP:
+		return "ENOTSUP"
+	case UnsupportedSucceed:
+		return "Succeed"
+	case UnsupportedNeverAgain:
+		return "NeverAgain"
+	}
+
+	return fmt.Sprintf("UnsupportedPolicy(%d)", int(p))
+}
+
+// UnsupportedOps is a Hooks that answers ops for which the file system
+// returns fuse.ENOSYS according to the policy it returns for the op, e.g.
+//
+//	hooks := fuseutil.UnsupportedOps(func(op interface{}) fuseutil.UnsupportedPolicy {
+//		switch op.(type) {
+//		case *fuseops.SyncFileOp, *fuseops.FlushFileOp:
+//			return fuseutil.UnsupportedSucceed
+//		}
+//
+//		return fuseutil.UnsupportedNeverAgain
+//	})
+//
+//	server := fuseutil.NewFileSystemServerWithHooks(fs, hooks)
+//
+// Other errors are passed on unchanged.
+type UnsupportedOps func(op interface{}) UnsupportedPolicy
+
+var _ Hooks = UnsupportedOps(nil)
+
+func (u UnsupportedOps) BeforeOp(ctx context.Context, op interface{}) error {
+	return nil
+}
+
+func (u UnsupportedOps) AfterOp(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	if err != fuse.ENOSYS {
+		return err
+	}
+
+	switch u(op) {
+	case UnsupportedENOTSUP:
+		return syscall.EOPNOTSUPP
+
+	case UnsupportedSucceed:
+		if succeedsQuietly(op) {
+			return nil
+		}
+
+		return syscall.EOPNOTSUPP
+
+	case UnsupportedNeverAgain:
+		if KernelRemembersENOSYS(op) {
+			return fuse.ENOSYS
+		}
+
+		return syscall.EOPNOTSUPP
+	}
+
+	return err
+}
+
+// Does the op have nothing to return, so that succeeding does no harm?
+func succeedsQuietly(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.SyncFileOp,
+		*fuseops.FlushFileOp,
+		*fuseops.SyncFSOp,
+		*fuseops.ReleaseFileHandleOp,
+		*fuseops.ReleaseDirHandleOp,
+		*fuseops.ForgetInodeOp,
+		*fuseops.BatchForgetOp,
+		*fuseops.AccessOp:
+		return true
+	}
+
+	return false
+}
+
+// KernelRemembersENOSYS reports whether Linux stops sending ops of the same
+// kind as op once a file system returns ENOSYS for one, treating later calls
+// as it documents for each op: syncs, flushes and AccessOp then succeed,
+// xattr ops fail with EOPNOTSUPP, CreateFileOp becomes MkNodeOp followed by
+// OpenFileOp, and so on. OpenFileOp and OpenDirOp are remembered only with
+// fuse.MountConfig.EnableNoOpenSupport and EnableNoOpendirSupport.
+func KernelRemembersENOSYS(op interface{}) bool {
+	switch typed := op.(type) {
+	case *fuseops.RenameOp:
+		// Only renames with flags have their own opcode.
+		return typed.Flags != 0
+
+	case *fuseops.SyncFileOp,
+		*fuseops.FlushFileOp,
+		*fuseops.SyncFSOp,
+		*fuseops.AccessOp,
+		*fuseops.CreateFileOp,
+		*fuseops.CreateTmpfileOp,
+		*fuseops.OpenFileOp,
+		*fuseops.OpenDirOp,
+		*fuseops.GetXattrOp,
+		*fuseops.ListXattrOp,
+		*fuseops.SetXattrOp,
+		*fuseops.RemoveXattrOp,
+		*fuseops.FallocateOp,
+		*fuseops.LseekOp,
+		*fuseops.CopyFileRangeOp,
+		*fuseops.PollOp:
+		return true
+	}
+
+	return false
+}
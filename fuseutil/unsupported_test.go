@@ -0,0 +1,63 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestUnsupportedOps(t *testing.T) {
+	policy := func(p fuseutil.UnsupportedPolicy) fuseutil.UnsupportedOps {
+		return func(op interface{}) fuseutil.UnsupportedPolicy { return p }
+	}
+
+	testCases := []struct {
+		policy fuseutil.UnsupportedPolicy
+		op     interface{}
+		err    error
+		want   error
+	}{
+		// Other errors, and success, are left alone.
+		{fuseutil.UnsupportedSucceed, &fuseops.SyncFileOp{}, syscall.EIO, syscall.EIO},
+		{fuseutil.UnsupportedENOTSUP, &fuseops.MkDirOp{}, nil, nil},
+
+		{fuseutil.UnsupportedENOSYS, &fuseops.MkDirOp{}, fuse.ENOSYS, fuse.ENOSYS},
+		{fuseutil.UnsupportedENOTSUP, &fuseops.SyncFileOp{}, fuse.ENOSYS, syscall.EOPNOTSUPP},
+
+		// Only ops with nothing to return succeed.
+		{fuseutil.UnsupportedSucceed, &fuseops.SyncFileOp{}, fuse.ENOSYS, nil},
+		{fuseutil.UnsupportedSucceed, &fuseops.AccessOp{}, fuse.ENOSYS, nil},
+		{fuseutil.UnsupportedSucceed, &fuseops.GetXattrOp{}, fuse.ENOSYS, syscall.EOPNOTSUPP},
+
+		// ENOSYS is kept for ops the kernel stops sending.
+		{fuseutil.UnsupportedNeverAgain, &fuseops.FlushFileOp{}, fuse.ENOSYS, fuse.ENOSYS},
+		{fuseutil.UnsupportedNeverAgain, &fuseops.RenameOp{Flags: fuseops.RenameExchange}, fuse.ENOSYS, fuse.ENOSYS},
+		{fuseutil.UnsupportedNeverAgain, &fuseops.RenameOp{}, fuse.ENOSYS, syscall.EOPNOTSUPP},
+		{fuseutil.UnsupportedNeverAgain, &fuseops.MkNodeOp{}, fuse.ENOSYS, syscall.EOPNOTSUPP},
+	}
+
+	for _, tc := range testCases {
+		got := policy(tc.policy).AfterOp(context.Background(), tc.op, tc.err)
+		if got != tc.want {
+			t.Errorf("%v for %T returning %v: got %v, want %v", tc.policy, tc.op, tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Retriever reads the kernel's page cache. It is implemented by
+// *fuse.MountedFileSystem and *fuse.Connection.
+type Retriever interface {
+	NotifyRetrieve(
+		ctx context.Context,
+		inode fuseops.InodeID,
+		offset uint64,
+		size uint32) ([]byte, error)
+}
+
+// WriteBarrier divides the life of a file system into flush epochs, between
+// which it can take consistent snapshots even when the kernel caches writes
+// (MountConfig.EnableWritebackCache). Install it with
+// NewFileSystemServerWithHooks, then for each snapshot:
+//
+//  1. Call Begin, which holds back new ops that modify files or the namespace
+//     and waits for those in progress to finish.
+//
+//  2. For each inode returned by OpenForWriting, call RetrieveCached to read
+//     the dirty pages the kernel hasn't written back yet, and apply them to
+//     the snapshot.
+//
+//  3. Take the snapshot, then call End to let the held ops through.
+//
+// The kernel's own writeback, e.g. for sync(2), is held back like any other
+// write until End. Don't invalidate the page cache of open files during an
+// epoch: the kernel writes dirty pages back before dropping them, and waits
+// for those writes.
+//
+// It is safe for concurrent use.
+type WriteBarrier struct {
+	mu sync.Mutex
+
+	// The number of the current or last epoch.
+	//
+	// GUARDED_BY(mu)
+	epoch uint64
+
+	// Closed when the current epoch ends, or nil if there is none.
+	//
+	// GUARDED_BY(mu)
+	raised chan struct{}
+
+	// Modifying ops let through, and not yet finished.
+	//
+	// GUARDED_BY(mu)
+	inFlight map[interface{}]struct{}
+
+	// Closed when the last op in inFlight finishes, or nil if Begin isn't
+	// waiting for that.
+	//
+	// GUARDED_BY(mu)
+	drained chan struct{}
+
+	// The inode of each handle open for writing.
+	//
+	// GUARDED_BY(mu)
+	writable map[fuseops.HandleID]fuseops.InodeID
+}
+
+var _ Hooks = &WriteBarrier{}
+
+// NewWriteBarrier creates a WriteBarrier with no epoch in progress.
+func NewWriteBarrier() *WriteBarrier {
+	return &WriteBarrier{
+		inFlight: make(map[interface{}]struct{}),
+		writable: make(map[fuseops.HandleID]fuseops.InodeID),
+	}
+}
+
+// Begin starts a new epoch, returning its number, which counts up from one.
+// It waits for modifying ops in progress to finish; if ctx is cancelled
+// first, it ends the epoch and returns ctx.Err().
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *WriteBarrier) Begin(ctx context.Context) (uint64, error) {
+	b.mu.Lock()
+	if b.raised != nil {
+		b.mu.Unlock()
+		return 0, errors.New("fuseutil: flush epoch already in progress")
+	}
+
+	b.epoch++
+	epoch := b.epoch
+	b.raised = make(chan struct{})
+	if len(b.inFlight) == 0 {
+		b.mu.Unlock()
+		return epoch, nil
+	}
+
+	b.drained = make(chan struct{})
+	drained := b.drained
+	b.mu.Unlock()
+
+	select {
+	case <-drained:
+		return epoch, nil
+
+	case <-ctx.Done():
+		b.End()
+		return 0, ctx.Err()
+	}
+}
+
+// End ends the current epoch, letting held ops through. It does nothing if
+// there is no epoch in progress.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *WriteBarrier) End() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.raised == nil {
+		return
+	}
+
+	close(b.raised)
+	b.raised = nil
+	b.drained = nil
+}
+
+// OpenForWriting returns the inodes with handles open for writing, which are
+// those that may have dirty pages in the kernel's cache.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *WriteBarrier) OpenForWriting() []fuseops.InodeID {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seen := make(map[fuseops.InodeID]bool)
+	var inodes []fuseops.InodeID
+	for _, inode := range b.writable {
+		if !seen[inode] {
+			seen[inode] = true
+			inodes = append(inodes, inode)
+		}
+	}
+
+	return inodes
+}
+
+func (b *WriteBarrier) BeforeOp(ctx context.Context, op interface{}) error {
+	if !modifies(op) {
+		return nil
+	}
+
+	for {
+		b.mu.Lock()
+		raised := b.raised
+		if raised == nil {
+			b.inFlight[op] = struct{}{}
+			b.mu.Unlock()
+			return nil
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-raised:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+}
+
+func (b *WriteBarrier) AfterOp(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.inFlight[op]; ok {
+		delete(b.inFlight, op)
+		if len(b.inFlight) == 0 && b.drained != nil {
+			close(b.drained)
+			b.drained = nil
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch typed := op.(type) {
+	case *fuseops.CreateFileOp:
+		b.writable[typed.Handle] = typed.Entry.Child
+
+	case *fuseops.CreateTmpfileOp:
+		b.writable[typed.Handle] = typed.Entry.Child
+
+	case *fuseops.OpenFileOp:
+		if !typed.OpenFlags.IsReadOnly() {
+			b.writable[typed.Handle] = typed.Inode
+		}
+
+	case *fuseops.ReleaseFileHandleOp:
+		delete(b.writable, typed.Handle)
+	}
+
+	return nil
+}
+
+// Does the op change the contents of files or the namespace?
+func modifies(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.WriteFileOp,
+		*fuseops.SetInodeAttributesOp,
+		*fuseops.FallocateOp,
+		*fuseops.CopyFileRangeOp,
+		*fuseops.CreateFileOp,
+		*fuseops.CreateTmpfileOp,
+		*fuseops.MkDirOp,
+		*fuseops.MkNodeOp,
+		*fuseops.CreateSymlinkOp,
+		*fuseops.CreateLinkOp,
+		*fuseops.RenameOp,
+		*fuseops.RmDirOp,
+		*fuseops.UnlinkOp,
+		*fuseops.SetXattrOp,
+		*fuseops.RemoveXattrOp:
+		return true
+	}
+
+	return false
+}
+
+// RetrieveCached reads what the kernel has cached of the first size bytes of
+// the inode, including dirty pages not yet written back, and passes each
+// contiguous run to apply in order of offset. size bounds the search; the
+// kernel stops at the end of the file as it knows it, which with a writeback
+// cache may be past the end the file system knows. An inode the kernel has
+// forgotten has nothing cached.
+func RetrieveCached(
+	ctx context.Context,
+	r Retriever,
+	inode fuseops.InodeID,
+	size uint64,
+	apply func(offset uint64, data []byte) error) error {
+	page := uint64(os.Getpagesize())
+	for offset := uint64(0); offset < size; {
+		n := size - offset
+		if n > 1<<30 {
+			n = 1 << 30
+		}
+
+		data, err := r.NotifyRetrieve(ctx, inode, offset, uint32(n))
+		if err == fuse.ENOENT {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// The kernel stops at the first page it doesn't have, so skip to the
+		// next one.
+		if len(data) == 0 {
+			offset = (offset/page + 1) * page
+			continue
+		}
+
+		if err := apply(offset, data); err != nil {
+			return err
+		}
+
+		offset += uint64(len(data))
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestWriteBarrier(t *testing.T) {
+	ctx := context.Background()
+	b := fuseutil.NewWriteBarrier()
+
+	// Track handles open for writing.
+	open := []interface{}{
+		&fuseops.CreateFileOp{Entry: fuseops.ChildInodeEntry{Child: 2}, Handle: 1},
+		&fuseops.OpenFileOp{Inode: 3, Handle: 2, OpenFlags: fusekernel.OpenReadOnly},
+		&fuseops.OpenFileOp{Inode: 4, Handle: 3, OpenFlags: fusekernel.OpenReadWrite},
+	}
+
+	for _, op := range open {
+		if err := b.BeforeOp(ctx, op); err != nil {
+			t.Fatalf("BeforeOp(%T): %v", op, err)
+		}
+
+		b.AfterOp(ctx, op, nil)
+	}
+
+	release := &fuseops.ReleaseFileHandleOp{Handle: 1}
+	b.BeforeOp(ctx, release)
+	b.AfterOp(ctx, release, nil)
+
+	if got, want := b.OpenForWriting(), []fuseops.InodeID{4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OpenForWriting() = %v, want %v", got, want)
+	}
+
+	// Begin waits for writes in progress.
+	inProgress := &fuseops.WriteFileOp{Inode: 4}
+	if err := b.BeforeOp(ctx, inProgress); err != nil {
+		t.Fatalf("BeforeOp: %v", err)
+	}
+
+	begun := make(chan uint64)
+	go func() {
+		epoch, err := b.Begin(ctx)
+		if err != nil {
+			t.Errorf("Begin: %v", err)
+		}
+
+		begun <- epoch
+	}()
+
+	select {
+	case <-begun:
+		t.Fatal("Begin returned with a write in progress")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	b.AfterOp(ctx, inProgress, nil)
+	if epoch := <-begun; epoch != 1 {
+		t.Errorf("epoch = %d, want 1", epoch)
+	}
+
+	if _, err := b.Begin(ctx); err == nil {
+		t.Error("Begin succeeded during an epoch")
+	}
+
+	// New writes are held until the epoch ends, and reads aren't.
+	if err := b.BeforeOp(ctx, &fuseops.ReadFileOp{}); err != nil {
+		t.Errorf("BeforeOp(ReadFileOp): %v", err)
+	}
+
+	held := make(chan error)
+	go func() {
+		held <- b.BeforeOp(ctx, &fuseops.UnlinkOp{})
+	}()
+
+	select {
+	case <-held:
+		t.Fatal("Unlink let through during an epoch")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Held ops give up when interrupted.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.BeforeOp(cancelled, &fuseops.WriteFileOp{}); err != syscall.EINTR {
+		t.Errorf("Interrupted BeforeOp: %v, want EINTR", err)
+	}
+
+	b.End()
+	if err := <-held; err != nil {
+		t.Errorf("Held BeforeOp: %v", err)
+	}
+}
+
+type fakeRetriever struct {
+	pages map[uint64][]byte
+	size  uint64
+}
+
+func (r *fakeRetriever) NotifyRetrieve(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	offset uint64,
+	size uint32) ([]byte, error) {
+	if inode != 2 {
+		return nil, fuse.ENOENT
+	}
+
+	// Like the kernel, return pages up to the first missing one or the end.
+	page := uint64(os.Getpagesize())
+	var data []byte
+	for o := offset; o < offset+uint64(size) && o < r.size; o = (o/page + 1) * page {
+		p, ok := r.pages[o/page]
+		if !ok {
+			break
+		}
+
+		data = append(data, p[o%page:]...)
+	}
+
+	if uint64(len(data)) > uint64(size) {
+		data = data[:size]
+	}
+
+	if offset+uint64(len(data)) > r.size {
+		data = data[:r.size-offset]
+	}
+
+	return data, nil
+}
+
+func TestRetrieveCached(t *testing.T) {
+	page := os.Getpagesize()
+	fill := func(c byte) []byte {
+		b := make([]byte, page)
+		for i := range b {
+			b[i] = c
+		}
+
+		return b
+	}
+
+	r := &fakeRetriever{
+		pages: map[uint64][]byte{0: fill('a'), 1: fill('b'), 3: fill('d')},
+		size:  uint64(3*page + 10),
+	}
+
+	type run struct {
+		offset uint64
+		size   int
+	}
+
+	var runs []run
+	apply := func(offset uint64, data []byte) error {
+		runs = append(runs, run{offset, len(data)})
+		return nil
+	}
+
+	err := fuseutil.RetrieveCached(context.Background(), r, 2, uint64(4*page), apply)
+	if err != nil {
+		t.Fatalf("RetrieveCached: %v", err)
+	}
+
+	want := []run{{0, 2 * page}, {uint64(3 * page), 10}}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("runs = %v, want %v", runs, want)
+	}
+
+	// Inodes the kernel doesn't know about have nothing cached.
+	runs = nil
+	if err := fuseutil.RetrieveCached(context.Background(), r, 3, 100, apply); err != nil || runs != nil {
+		t.Errorf("Unknown inode: %v, %v", err, runs)
+	}
+}
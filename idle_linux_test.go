@@ -0,0 +1,158 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Sum the values of the fields with the supplied suffix in a /proc file made
+// of "name: value" lines. Return false if the file can't be read.
+func sumProcFields(t *testing.T, path string, suffix string) (int, bool) {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+
+	var total int
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasSuffix(fields[0], suffix+":") {
+			continue
+		}
+
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			t.Fatalf("Parsing %q: %v", line, err)
+		}
+
+		total += n
+	}
+
+	return total, true
+}
+
+// The number of read and write system calls the process has made.
+func ioSyscalls(t *testing.T) int {
+	t.Helper()
+
+	n, ok := sumProcFields(t, "/proc/self/io", "sysc")
+	if !ok {
+		t.Skip("No I/O accounting")
+	}
+
+	return n
+}
+
+// The number of times the process's threads have been switched out.
+func contextSwitches(t *testing.T) int {
+	t.Helper()
+
+	paths, _ := filepath.Glob("/proc/self/task/*/status")
+
+	var total int
+	for _, p := range paths {
+		// Threads may exit in the meantime.
+		n, _ := sumProcFields(t, p, "ctxt_switches")
+		total += n
+	}
+
+	return total
+}
+
+func Test_IdleConnection(t *testing.T) {
+	for _, poll := range []bool{false, true} {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+		if err != nil {
+			t.Fatalf("Socketpair: %v", err)
+		}
+
+		kernel := os.NewFile(uintptr(fds[0]), "kernel")
+		dev := os.NewFile(uintptr(fds[1]), "dev")
+
+		mfs, err := Resume(
+			"/mnt",
+			dev,
+			Session{ProtocolMajor: 7, ProtocolMinor: 31},
+			enosysServer{},
+			&MountConfig{PollDevice: poll})
+		if err != nil {
+			t.Fatalf("Resume: %v", err)
+		}
+
+		// Make sure the server is waiting for requests.
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + 16),
+			Opcode: uint32(fusekernel.OpGetattr),
+			Unique: 1,
+			Nodeid: 1,
+		})
+		binary.Write(&msg, binary.LittleEndian, [16]byte{})
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		if _, err := kernel.Read(make([]byte, 4096)); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		// While no requests arrive, nothing may read or write the device.
+		// Reading the counters takes a few calls of its own.
+		before := ioSyscalls(t)
+		cost := ioSyscalls(t) - before
+
+		before = ioSyscalls(t)
+		time.Sleep(200 * time.Millisecond)
+		if n := ioSyscalls(t) - before - cost; n != 0 {
+			t.Errorf("PollDevice = %v: %d I/O system calls while idle", poll, n)
+		}
+
+		// Nor may anything wake up periodically. The runtime itself wakes up
+		// now and then, so take the quietest of a few intervals; a polling
+		// loop or a ticker would show up in all of them.
+		quietest := -1
+		for i := 0; i < 5; i++ {
+			before := contextSwitches(t)
+			time.Sleep(200 * time.Millisecond)
+			if n := contextSwitches(t) - before; quietest < 0 || n < quietest {
+				quietest = n
+			}
+		}
+
+		if quietest > 50 {
+			t.Errorf("PollDevice = %v: %d context switches while idle", poll, quietest)
+		}
+
+		kernel.Close()
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}
+}
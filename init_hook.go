@@ -0,0 +1,120 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// InitParams describes what has been negotiated with the kernel when a file
+// system is mounted, just before the reply to its init request is sent. See
+// InitHandler.
+type InitParams struct {
+	// The protocol version offered by the kernel, and the one in use.
+	KernelProtocolMajor uint32
+	KernelProtocolMinor uint32
+	ProtocolMajor       uint32
+	ProtocolMinor       uint32
+
+	// The capability flags offered by the kernel, and those about to be
+	// enabled, laid out as in ConnectionInfo. Flags may be cleared to turn
+	// capabilities off; setting flags has no effect.
+	KernelFlags uint64
+	Flags       uint64
+
+	// The limits about to be given to the kernel. They may be lowered, but not
+	// raised or set to zero.
+	MaxWrite            uint32
+	MaxReadahead        uint32
+	MaxPages            uint16
+	MaxBackground       uint16
+	CongestionThreshold uint16
+}
+
+// InitHandler may be implemented by a Server that wants to see, and possibly
+// narrow, the capabilities negotiated with the kernel. fuseutil's file system
+// servers implement it by passing the call on to file systems that implement
+// it too.
+//
+// OnInit is called by Mount and ServeDevice before the init request is
+// answered and before ServeOps is called, once for each mount of the server.
+// It isn't called by Resume, where there is no init request. If it returns an
+// error, the kernel is told that the protocol isn't supported and the mount
+// fails.
+type InitHandler interface {
+	OnInit(*InitParams) error
+}
+
+// Give the server a chance to look at the reply to the init op, and apply
+// what it changed.
+func (c *Connection) runInitHandler(o *initOp, kernelFlags uint64) error {
+	flags := uint64(o.Flags) | uint64(o.Flags2)<<32
+	p := InitParams{
+		KernelProtocolMajor: o.Kernel.Major,
+		KernelProtocolMinor: o.Kernel.Minor,
+		ProtocolMajor:       c.protocol.Major,
+		ProtocolMinor:       c.protocol.Minor,
+		KernelFlags:         kernelFlags,
+		Flags:               flags,
+		MaxWrite:            o.MaxWrite,
+		MaxReadahead:        o.MaxReadahead,
+		MaxPages:            o.MaxPages,
+		MaxBackground:       o.MaxBackground,
+		CongestionThreshold: o.CongestionThreshold,
+	}
+
+	if err := c.initHandler.OnInit(&p); err != nil {
+		return err
+	}
+
+	flags &= p.Flags
+	o.Flags = fusekernel.InitFlags(flags)
+	o.Flags2 = fusekernel.InitFlags2(flags >> 32)
+
+	if p.MaxWrite > 0 && p.MaxWrite < o.MaxWrite {
+		o.MaxWrite = p.MaxWrite
+	}
+
+	if p.MaxReadahead > 0 && p.MaxReadahead < o.MaxReadahead {
+		o.MaxReadahead = p.MaxReadahead
+	}
+
+	if p.MaxPages > 0 && p.MaxPages < o.MaxPages {
+		o.MaxPages = p.MaxPages
+	}
+
+	if p.MaxBackground > 0 && p.MaxBackground < o.MaxBackground {
+		o.MaxBackground = p.MaxBackground
+	}
+
+	if p.CongestionThreshold > 0 && p.CongestionThreshold < o.CongestionThreshold {
+		o.CongestionThreshold = p.CongestionThreshold
+	}
+
+	// Forget about capabilities that were turned off.
+	if o.Flags2&fusekernel.InitDirectIOAllowMmap == 0 {
+		c.directIOMmap = false
+	}
+
+	if o.Flags2&fusekernel.InitHasResend == 0 {
+		c.resend = false
+	}
+
+	if o.Flags2&fusekernel.InitPassthrough == 0 {
+		o.MaxStackDepth = 0
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// An InitHandler that records what it was given and turns off writeback
+// caching and resends, and lowers MaxWrite.
+type narrowingHandler struct {
+	params InitParams
+}
+
+func (h *narrowingHandler) OnInit(p *InitParams) error {
+	h.params = *p
+	p.Flags &^= uint64(fusekernel.InitWritebackCache)
+	p.Flags &^= uint64(fusekernel.InitHasResend) << 32
+	p.Flags |= uint64(fusekernel.InitPosixLocks)
+	p.MaxWrite = 1 << 16
+	p.MaxPages = 0
+	return nil
+}
+
+func Test_InitHandler(t *testing.T) {
+	in := fusekernel.InitIn{
+		Major: 7,
+		Minor: 40,
+		Flags: uint32(fusekernel.InitExt | fusekernel.InitWritebackCache | fusekernel.InitPosixLocks),
+	}
+
+	h := &narrowingHandler{}
+	out := initConnectionWithHandler(
+		t,
+		MountConfig{EnableResend: true},
+		in,
+		fusekernel.InitHasResend,
+		h)
+
+	// The handler saw what was about to be sent.
+	if h.params.KernelProtocolMinor != 40 {
+		t.Errorf("KernelProtocolMinor = %d, want 40", h.params.KernelProtocolMinor)
+	}
+
+	if fusekernel.InitFlags(h.params.Flags)&fusekernel.InitWritebackCache == 0 {
+		t.Errorf("Handler didn't see InitWritebackCache: %v", fusekernel.InitFlags(h.params.Flags))
+	}
+
+	if fusekernel.InitFlags2(h.params.Flags>>32)&fusekernel.InitHasResend == 0 {
+		t.Errorf("Handler didn't see InitHasResend: %v", fusekernel.InitFlags2(h.params.Flags>>32))
+	}
+
+	// What it turned off stayed off, and what it turned on wasn't offered to
+	// it.
+	flags := fusekernel.InitFlags(out.Flags)
+	if flags&(fusekernel.InitWritebackCache|fusekernel.InitPosixLocks) != 0 {
+		t.Errorf("Flags = %v", flags)
+	}
+
+	if out.Flags2 != 0 || flags&fusekernel.InitExt != 0 {
+		t.Errorf("Flags2 = %v with flags %v, want nothing", fusekernel.InitFlags2(out.Flags2), flags)
+	}
+
+	// MaxWrite was lowered, and MaxPages wasn't zeroed.
+	if out.MaxWrite != 1<<16 || out.MaxPages != h.params.MaxPages {
+		t.Errorf("MaxWrite %d and MaxPages %d, want %d and %d", out.MaxWrite, out.MaxPages, 1<<16, h.params.MaxPages)
+	}
+}
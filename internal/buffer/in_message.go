@@ -28,13 +28,8 @@ import (
 // this.
 var pageSize int
 
-// We size the buffer to have enough room for a fuse request plus data
-// associated with a write request.
-var bufSize int
-
 func init() {
 	pageSize = syscall.Getpagesize()
-	bufSize = pageSize + MaxWriteSize
 }
 
 // An incoming message from the kernel, including leading fusekernel.InHeader
@@ -46,10 +41,17 @@ type InMessage struct {
 	size      int
 }
 
-// NewInMessage creates a new InMessage with its storage initialized.
+// NewInMessage creates a new InMessage with its storage initialized, with
+// room for a write request of MaxWriteSize bytes.
 func NewInMessage() *InMessage {
+	return NewInMessageSize(MaxWriteSize)
+}
+
+// NewInMessageSize is like NewInMessage, but makes room for the fuse request
+// plus the data of write requests of up to maxWrite bytes.
+func NewInMessageSize(maxWrite int) *InMessage {
 	return &InMessage{
-		storage: make([]byte, bufSize),
+		storage: make([]byte, pageSize+maxWrite),
 	}
 }
 
@@ -114,6 +116,11 @@ func (m *InMessage) Header() *fusekernel.InHeader {
 	return (*fusekernel.InHeader)(unsafe.Pointer(&m.storage[0]))
 }
 
+// Return the size of the message's storage, however much of it is in use.
+func (m *InMessage) Cap() int {
+	return len(m.storage)
+}
+
 // Return the number of bytes left to consume.
 func (m *InMessage) Len() uintptr {
 	return uintptr(len(m.remaining))
@@ -145,6 +152,20 @@ func (m *InMessage) ConsumeBytes(n uintptr) []byte {
 	return b
 }
 
+// Remove the last n bytes from the message, returning them. The result will be
+// nil if there are fewer than n bytes left to consume.
+func (m *InMessage) ConsumeTrailing(n uintptr) []byte {
+	if n > m.Len() {
+		return nil
+	}
+
+	end := m.Len() - n
+	b := m.remaining[end:]
+	m.remaining = m.remaining[:end]
+
+	return b
+}
+
 // Get the next n bytes after the message to use them as a temporary buffer
 func (m *InMessage) GetFree(n int) []byte {
 	if n <= 0 || n > len(m.storage)-m.size {
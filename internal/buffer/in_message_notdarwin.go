@@ -1,3 +1,6 @@
+//go:build !darwin
+// +build !darwin
+
 // Copyright 2015 Google Inc. All Rights Reserved.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
@@ -14,7 +17,9 @@
 
 package buffer
 
-// The maximum fuse write request size that InMessage can acommodate.
+// The maximum fuse write request size that InMessage can acommodate by
+// default. See NewInMessageSize for larger ones.
 //
-// As of kernel 4.20 Linux accepts writes up to 256 pages or 1MiB
+// As of kernel 4.20 Linux accepts writes up to 256 pages or 1MiB by default,
+// and more if fs.fuse.max_pages_limit is raised (Linux >= 6.13).
 const MaxWriteSize = 1 << 20
@@ -106,6 +106,7 @@ const (
 	SetattrAtimeNow  SetattrValid = 1 << 7
 	SetattrMtimeNow  SetattrValid = 1 << 8
 	SetattrLockOwner SetattrValid = 1 << 9 // http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
+	SetattrCtime     SetattrValid = 1 << 10
 
 	// OS X only
 	SetattrCrtime   SetattrValid = 1 << 28
@@ -124,6 +125,7 @@ func (fl SetattrValid) Handle() bool    { return fl&SetattrHandle != 0 }
 func (fl SetattrValid) AtimeNow() bool  { return fl&SetattrAtimeNow != 0 }
 func (fl SetattrValid) MtimeNow() bool  { return fl&SetattrMtimeNow != 0 }
 func (fl SetattrValid) LockOwner() bool { return fl&SetattrLockOwner != 0 }
+func (fl SetattrValid) Ctime() bool     { return fl&SetattrCtime != 0 }
 func (fl SetattrValid) Crtime() bool    { return fl&SetattrCrtime != 0 }
 func (fl SetattrValid) Chgtime() bool   { return fl&SetattrChgtime != 0 }
 func (fl SetattrValid) Bkuptime() bool  { return fl&SetattrBkuptime != 0 }
@@ -144,6 +146,7 @@ var setattrValidNames = []flagName{
 	{uint32(SetattrAtimeNow), "SetattrAtimeNow"},
 	{uint32(SetattrMtimeNow), "SetattrMtimeNow"},
 	{uint32(SetattrLockOwner), "SetattrLockOwner"},
+	{uint32(SetattrCtime), "SetattrCtime"},
 	{uint32(SetattrCrtime), "SetattrCrtime"},
 	{uint32(SetattrChgtime), "SetattrChgtime"},
 	{uint32(SetattrBkuptime), "SetattrBkuptime"},
@@ -162,13 +165,14 @@ const (
 	OpenAppend    OpenFlags = syscall.O_APPEND
 	OpenCreate    OpenFlags = syscall.O_CREAT
 	OpenExclusive OpenFlags = syscall.O_EXCL
+	OpenNonblock  OpenFlags = syscall.O_NONBLOCK
 	OpenSync      OpenFlags = syscall.O_SYNC
 	OpenTruncate  OpenFlags = syscall.O_TRUNC
 )
 
 // OpenAccessModeMask is a bitmask that separates the access mode
 // from the other flags in OpenFlags.
-const OpenAccessModeMask OpenFlags = syscall.O_ACCMODE
+const OpenAccessModeMask OpenFlags = OpenReadOnly | OpenWriteOnly | OpenReadWrite
 
 // OpenFlags are the O_FOO flags passed to open/create/etc calls. For
 // example, os.O_WRONLY | os.O_APPEND.
@@ -217,9 +221,16 @@ var openFlagNames = []flagName{
 	{uint32(OpenExclusive), "OpenExclusive"},
 	{uint32(OpenTruncate), "OpenTruncate"},
 	{uint32(OpenAppend), "OpenAppend"},
+	{uint32(OpenNonblock), "OpenNonblock"},
 	{uint32(OpenSync), "OpenSync"},
 }
 
+// Flags in Attr.Flags (Linux only).
+const (
+	AttrSubmount uint32 = 1 << 0 // the inode is the root of a submount
+	AttrDAX      uint32 = 1 << 1 // map the file's contents directly (virtiofs)
+)
+
 // The OpenResponseFlags are returned in the OpenResponse.
 type OpenResponseFlags uint32
 
@@ -228,6 +239,7 @@ const (
 	OpenKeepCache   OpenResponseFlags = 1 << 1 // don't invalidate the data cache on open
 	OpenNonSeekable OpenResponseFlags = 1 << 2 // mark the file as non-seekable (not supported on OS X)
 	OpenCacheDir    OpenResponseFlags = 1 << 3 // allow caching this directory
+	OpenPassthrough OpenResponseFlags = 1 << 7 // serve I/O from OpenOut.BackingID
 
 	OpenPurgeAttr OpenResponseFlags = 1 << 30 // OS X
 	OpenPurgeUBC  OpenResponseFlags = 1 << 31 // OS X
@@ -242,6 +254,7 @@ var openResponseFlagNames = []flagName{
 	{uint32(OpenKeepCache), "OpenKeepCache"},
 	{uint32(OpenNonSeekable), "OpenNonSeekable"},
 	{uint32(OpenCacheDir), "OpenCacheDir"},
+	{uint32(OpenPassthrough), "OpenPassthrough"},
 	{uint32(OpenPurgeAttr), "OpenPurgeAttr"},
 	{uint32(OpenPurgeUBC), "OpenPurgeUBC"},
 }
@@ -273,7 +286,12 @@ const (
 	InitCacheSymlinks    InitFlags = 1 << 23
 	InitNoOpendirSupport InitFlags = 1 << 24
 
-	InitCaseSensitive InitFlags = 1 << 29 // OS X only
+	// Linux only. Set when the Flags2 fields of InitIn and InitOut are valid.
+	InitExt InitFlags = 1 << 30
+
+	// OS X only. FUSE_CASE_INSENSITIVE: despite the name, set when the file
+	// system is case-insensitive.
+	InitCaseSensitive InitFlags = 1 << 29
 	InitVolRename     InitFlags = 1 << 30 // OS X only
 	InitXtimes        InitFlags = 1 << 31 // OS X only
 )
@@ -315,6 +333,36 @@ func (fl InitFlags) String() string {
 	return flagString(uint32(fl), initFlagNames)
 }
 
+// The InitFlags2 are the upper 32 bits of the Linux init flags, exchanged when
+// InitExt is set.
+type InitFlags2 uint32
+
+const (
+	InitSecurityCtx       InitFlags2 = 1 << 0
+	InitHasInodeDAX       InitFlags2 = 1 << 1
+	InitCreateSuppGroup   InitFlags2 = 1 << 2
+	InitHasExpireOnly     InitFlags2 = 1 << 3
+	InitDirectIOAllowMmap InitFlags2 = 1 << 4
+	InitPassthrough       InitFlags2 = 1 << 5
+	InitNoExportSupport   InitFlags2 = 1 << 6
+	InitHasResend         InitFlags2 = 1 << 7
+)
+
+var initFlags2Names = []flagName{
+	{uint32(InitSecurityCtx), "InitSecurityCtx"},
+	{uint32(InitHasInodeDAX), "InitHasInodeDAX"},
+	{uint32(InitCreateSuppGroup), "InitCreateSuppGroup"},
+	{uint32(InitHasExpireOnly), "InitHasExpireOnly"},
+	{uint32(InitDirectIOAllowMmap), "InitDirectIOAllowMmap"},
+	{uint32(InitPassthrough), "InitPassthrough"},
+	{uint32(InitNoExportSupport), "InitNoExportSupport"},
+	{uint32(InitHasResend), "InitHasResend"},
+}
+
+func (fl InitFlags2) String() string {
+	return flagString(uint32(fl), initFlags2Names)
+}
+
 func flagString(f uint32, names []flagName) string {
 	var s string
 
@@ -338,7 +386,8 @@ func flagString(f uint32, names []flagName) string {
 type ReleaseFlags uint32
 
 const (
-	ReleaseFlush ReleaseFlags = 1 << 0
+	ReleaseFlush       ReleaseFlags = 1 << 0
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1
 )
 
 func (fl ReleaseFlags) String() string {
@@ -347,50 +396,59 @@ func (fl ReleaseFlags) String() string {
 
 var releaseFlagNames = []flagName{
 	{uint32(ReleaseFlush), "ReleaseFlush"},
+	{uint32(ReleaseFlockUnlock), "ReleaseFlockUnlock"},
 }
 
 // Opcodes
 const (
-	OpLookup      = 1
-	OpForget      = 2 // no reply
-	OpGetattr     = 3
-	OpSetattr     = 4
-	OpReadlink    = 5
-	OpSymlink     = 6
-	OpMknod       = 8
-	OpMkdir       = 9
-	OpUnlink      = 10
-	OpRmdir       = 11
-	OpRename      = 12
-	OpLink        = 13
-	OpOpen        = 14
-	OpRead        = 15
-	OpWrite       = 16
-	OpStatfs      = 17
-	OpRelease     = 18
-	OpFsync       = 20
-	OpSetxattr    = 21
-	OpGetxattr    = 22
-	OpListxattr   = 23
-	OpRemovexattr = 24
-	OpFlush       = 25
-	OpInit        = 26
-	OpOpendir     = 27
-	OpReaddir     = 28
-	OpReleasedir  = 29
-	OpFsyncdir    = 30
-	OpGetlk       = 31
-	OpSetlk       = 32
-	OpSetlkw      = 33
-	OpAccess      = 34
-	OpCreate      = 35
-	OpInterrupt   = 36
-	OpBmap        = 37
-	OpDestroy     = 38
-	OpIoctl       = 39 // Linux?
-	OpPoll        = 40 // Linux?
-	OpBatchForget = 42
-	OpFallocate   = 43
+	OpLookup        = 1
+	OpForget        = 2 // no reply
+	OpGetattr       = 3
+	OpSetattr       = 4
+	OpReadlink      = 5
+	OpSymlink       = 6
+	OpMknod         = 8
+	OpMkdir         = 9
+	OpUnlink        = 10
+	OpRmdir         = 11
+	OpRename        = 12
+	OpLink          = 13
+	OpOpen          = 14
+	OpRead          = 15
+	OpWrite         = 16
+	OpStatfs        = 17
+	OpRelease       = 18
+	OpFsync         = 20
+	OpSetxattr      = 21
+	OpGetxattr      = 22
+	OpListxattr     = 23
+	OpRemovexattr   = 24
+	OpFlush         = 25
+	OpInit          = 26
+	OpOpendir       = 27
+	OpReaddir       = 28
+	OpReleasedir    = 29
+	OpFsyncdir      = 30
+	OpGetlk         = 31
+	OpSetlk         = 32
+	OpSetlkw        = 33
+	OpAccess        = 34
+	OpCreate        = 35
+	OpInterrupt     = 36
+	OpBmap          = 37
+	OpDestroy       = 38
+	OpIoctl         = 39 // Linux?
+	OpPoll          = 40 // Linux?
+	OpNotifyReply   = 41 // no reply
+	OpBatchForget   = 42
+	OpFallocate     = 43
+	OpReaddirplus   = 44
+	OpRename2       = 45
+	OpLseek         = 46
+	OpCopyFileRange = 47
+	OpSyncfs        = 50
+	OpTmpfile       = 51
+	OpStatx         = 52
 
 	// OS X
 	OpSetvolname = 61
@@ -498,6 +556,20 @@ type RenameIn struct {
 	// "oldname\x00newname\x00" follows
 }
 
+type Rename2In struct {
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+	// "oldname\x00newname\x00" follows
+}
+
+// Flags for Rename2In, as for renameat2(2).
+const (
+	RenameNoReplace = 1 << 0
+	RenameExchange  = 1 << 1
+	RenameWhiteout  = 1 << 2
+)
+
 // OS X
 type ExchangeIn struct {
 	Olddir  uint64
@@ -517,10 +589,10 @@ type setattrInCommon struct {
 	LockOwner uint64 // unused on OS X?
 	Atime     uint64
 	Mtime     uint64
-	Unused2   uint64
+	Ctime     uint64
 	AtimeNsec uint32
 	MtimeNsec uint32
-	Unused3   uint32
+	CtimeNsec uint32
 	Mode      uint32
 	Unused4   uint32
 	Uid       uint32
@@ -536,7 +608,7 @@ type OpenIn struct {
 type OpenOut struct {
 	Fh        uint64
 	OpenFlags uint32
-	Padding   uint32
+	BackingID int32
 }
 
 type CreateIn struct {
@@ -559,7 +631,7 @@ type ReleaseIn struct {
 	Fh           uint64
 	Flags        uint32
 	ReleaseFlags uint32
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 type FlushIn struct {
@@ -658,6 +730,11 @@ type FsyncIn struct {
 	Padding    uint32
 }
 
+// Flags in FsyncIn.FsyncFlags.
+const (
+	FsyncFdatasync = 1 << 0 // sync data only, not metadata
+)
+
 type setxattrInCommon struct {
 	Size  uint32
 	Flags uint32
@@ -694,6 +771,93 @@ type FallocateIn struct {
 	Padding uint32
 }
 
+type SyncfsIn struct {
+	Padding uint64
+}
+
+type StatxIn struct {
+	GetattrFlags uint32
+	Reserved     uint32
+	Fh           uint64
+	SxFlags      uint32
+	SxMask       uint32
+}
+
+type SxTime struct {
+	Sec      int64
+	Nsec     uint32
+	Reserved int32
+}
+
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	Spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          SxTime
+	Btime          SxTime
+	Ctime          SxTime
+	Mtime          SxTime
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	Spare2         [14]uint64
+}
+
+type StatxOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Flags         uint32
+	Spare         [2]uint64
+	Stat          Statx
+}
+
+type LseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+type LseekOut struct {
+	Offset uint64
+}
+
+type CopyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeidOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
+// Flags in PollIn.
+const PollScheduleNotify = 1 << 0
+
+// The Events field was introduced in 7.21; previously it was padding.
+type PollIn struct {
+	Fh     uint64
+	Kh     uint64
+	Flags  uint32
+	Events uint32
+}
+
+type PollOut struct {
+	Revents uint32
+	padding uint32
+}
+
 type LkIn struct {
 	Fh      uint64
 	Owner   uint64
@@ -702,6 +866,9 @@ type LkIn struct {
 	padding uint32
 }
 
+// Flags in LkIn.
+const LkFlock = 1 << 0
+
 func LkInSize(p Protocol) uintptr {
 	switch {
 	case p.LT(Protocol{7, 9}):
@@ -729,6 +896,12 @@ type InitIn struct {
 
 const InitInSize = int(unsafe.Sizeof(InitIn{}))
 
+// InitInExt follows InitIn when its Flags contain InitExt (Linux >= 5.17).
+type InitInExt struct {
+	Flags2 uint32
+	Unused [11]uint32
+}
+
 type InitOut struct {
 	Major               uint32
 	Minor               uint32
@@ -740,9 +913,33 @@ type InitOut struct {
 	TimeGran            uint32
 	MaxPages            uint16
 	MapAlignment        uint16
-	Unused              [8]uint32
+	Flags2              uint32
+	MaxStackDepth       uint32
+	Unused              [6]uint32
 }
 
+// The most FUSE file systems that may be stacked on top of each other using
+// passthrough (Linux FILESYSTEM_MAX_STACK_DEPTH).
+const MaxStackDepth = 2
+
+// BackingMap is the argument to the DevIocBackingOpen ioctl on the fuse
+// device, which registers a file for passthrough I/O (Linux >= 6.9).
+type BackingMap struct {
+	Fd      int32
+	Flags   uint32
+	Padding uint64
+}
+
+// ioctls on the fuse device, with the encoding of _IOW(229, n, T) on Linux.
+const (
+	DevIocBackingOpen  = 0x40000000 | 16<<16 | 229<<8 | 1 // BackingMap
+	DevIocBackingClose = 0x40000000 | 4<<16 | 229<<8 | 2  // uint32
+)
+
+// DevIocClone attaches a newly opened fuse device to the connection of the
+// device whose descriptor it is given. Encoded as _IOR(229, 0, uint32).
+const DevIocClone = 0x80000000 | 4<<16 | 229<<8 | 0
+
 type InterruptIn struct {
 	Unique uint64
 }
@@ -758,18 +955,39 @@ type BmapOut struct {
 }
 
 type InHeader struct {
-	Len     uint32
-	Opcode  uint32
-	Unique  uint64
-	Nodeid  uint64
-	Uid     uint32
-	Gid     uint32
-	Pid     uint32
-	Padding uint32
+	Len         uint32
+	Opcode      uint32
+	Unique      uint64
+	Nodeid      uint64
+	Uid         uint32
+	Gid         uint32
+	Pid         uint32
+	TotalExtlen uint16 // length of extensions in 8-byte units
+	Padding     uint16
 }
 
 const InHeaderSize = int(unsafe.Sizeof(InHeader{}))
 
+// Request extensions follow a request's arguments, making up the last
+// InHeader.TotalExtlen*8 bytes of the message. Each begins with an ExtHeader,
+// and its size, header included, is a multiple of 8.
+type ExtHeader struct {
+	Size uint32
+	Type uint32
+}
+
+const ExtHeaderSize = int(unsafe.Sizeof(ExtHeader{}))
+
+// Extension types. Types below ExtGroups are used for security contexts.
+const (
+	ExtGroups uint32 = 32 // SuppGroups
+)
+
+// The ExtGroups extension: the number of groups, followed by the groups.
+type SuppGroups struct {
+	NrGroups uint32
+}
+
 type OutHeader struct {
 	Len    uint32
 	Error  int32
@@ -790,8 +1008,19 @@ const (
 	NotifyCodePoll       int32 = 1
 	NotifyCodeInvalInode int32 = 2
 	NotifyCodeInvalEntry int32 = 3
+	NotifyCodeStore      int32 = 4
+	NotifyCodeRetrieve   int32 = 5
+	NotifyCodeResend     int32 = 7
 )
 
+// Set in the unique ID of requests that the kernel sends again in response to
+// NotifyCodeResend (Linux >= 6.9).
+const UniqueResend uint64 = 1 << 63
+
+type NotifyPollWakeupOut struct {
+	Kh uint64
+}
+
 type NotifyInvalInodeOut struct {
 	Ino uint64
 	Off int64
@@ -803,3 +1032,28 @@ type NotifyInvalEntryOut struct {
 	Namelen uint32
 	padding uint32
 }
+
+type NotifyStoreOut struct {
+	Nodeid  uint64
+	Offset  uint64
+	Size    uint32
+	padding uint32
+}
+
+type NotifyRetrieveOut struct {
+	NotifyUnique uint64
+	Nodeid       uint64
+	Offset       uint64
+	Size         uint32
+	padding      uint32
+}
+
+// Matches the size of WriteIn.
+type NotifyRetrieveIn struct {
+	Dummy1 uint64
+	Offset uint64
+	Size   uint32
+	Dummy2 uint32
+	Dummy3 uint64
+	Dummy4 uint64
+}
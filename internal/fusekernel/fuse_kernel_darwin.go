@@ -34,6 +34,10 @@ func (a *Attr) SetFlags(f uint32) {
 	a.Flags_ = f
 }
 
+func (a *Attr) SetDAX(dax bool) {
+	// Ignored on OS X.
+}
+
 type SetattrIn struct {
 	setattrInCommon
 
@@ -59,6 +63,13 @@ func (in *SetattrIn) Flags() uint32 {
 	return in.Flags_
 }
 
+// Lock types in fileLock, as for fcntl(2).
+const (
+	LkRead   = 1
+	LkUnlock = 2
+	LkWrite  = 3
+)
+
 func openFlags(flags uint32) OpenFlags {
 	return OpenFlags(flags)
 }
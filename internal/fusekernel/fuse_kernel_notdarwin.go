@@ -1,3 +1,6 @@
+//go:build !darwin
+// +build !darwin
+
 package fusekernel
 
 import "time"
@@ -18,7 +21,7 @@ type Attr struct {
 	Gid       uint32
 	Rdev      uint32
 	Blksize   uint32
-	padding   uint32
+	Flags     uint32 // AttrSubmount, AttrDAX
 }
 
 func (a *Attr) Crtime() time.Time {
@@ -33,6 +36,14 @@ func (a *Attr) SetFlags(f uint32) {
 	// Ignored on Linux.
 }
 
+func (a *Attr) SetDAX(dax bool) {
+	if dax {
+		a.Flags |= AttrDAX
+	} else {
+		a.Flags &^= AttrDAX
+	}
+}
+
 type SetattrIn struct {
 	setattrInCommon
 }
@@ -49,6 +60,13 @@ func (in *SetattrIn) Flags() uint32 {
 	return 0
 }
 
+// Lock types in fileLock, as for fcntl(2).
+const (
+	LkRead   = 0
+	LkWrite  = 1
+	LkUnlock = 2
+)
+
 func openFlags(flags uint32) OpenFlags {
 	// on amd64, the 32-bit O_LARGEFILE flag is always seen;
 	// on i386, the flag probably depends on the app
@@ -0,0 +1,81 @@
+//go:build cgo && (illumos || solaris || (linux && libfuse))
+// +build cgo
+// +build illumos solaris linux,libfuse
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+// The calls into libfuse (2.x) used to mount on illumos and Solaris. On Linux
+// this builds only with the libfuse tag, against libfuse 2's headers, so that
+// it can be compiled where there is no illumos toolchain.
+
+/*
+#cgo CFLAGS: -D_FILE_OFFSET_BITS=64 -DFUSE_USE_VERSION=26
+#cgo linux CFLAGS: -I/usr/include/fuse
+#cgo LDFLAGS: -lfuse
+#include <errno.h>
+#include <stdlib.h>
+#include <fuse_lowlevel.h>
+
+static int mount_with_options(const char *mountpoint, const char *opts) {
+	struct fuse_args args = FUSE_ARGS_INIT(0, NULL);
+	struct fuse_chan *ch = NULL;
+
+	if (fuse_opt_add_arg(&args, "") == 0 &&
+	    fuse_opt_add_arg(&args, "-o") == 0 &&
+	    fuse_opt_add_arg(&args, opts) == 0) {
+		ch = fuse_mount(mountpoint, &args);
+	}
+
+	fuse_opt_free_args(&args);
+
+	// The channel is deliberately leaked: the device outlives it, and we
+	// unmount with umount(2) rather than fuse_unmount.
+	if (ch == NULL) {
+		if (errno == 0) {
+			errno = EIO;
+		}
+
+		return -1;
+	}
+
+	return fuse_chan_fd(ch);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Mount with libfuse, returning the file descriptor of the device it opened.
+// Mounting is complete when it returns.
+func libfuseMount(dir string, opts string) (int, error) {
+	cDir := C.CString(dir)
+	defer C.free(unsafe.Pointer(cDir))
+
+	cOpts := C.CString(opts)
+	defer C.free(unsafe.Pointer(cOpts))
+
+	// libfuse doesn't always set errno, so it is only a hint.
+	fd, err := C.mount_with_options(cDir, cOpts)
+	if fd < 0 {
+		return -1, fmt.Errorf("libfuse failed to mount %s: %v", dir, err)
+	}
+
+	return int(fd), nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Every op read from the kernel holds a buffer large enough for the largest
+// request, in which its inbound payload (e.g. WriteFileOp.Data) lives, and a
+// reply under construction. Buffers are kept for reuse when ops are answered,
+// so a file system that holds many ops at once, e.g. while waiting on a slow
+// backend, holds a buffer for each of them. File systems that copy inbound
+// payloads elsewhere may hand their buffers back early with ReleaseInbound.
+
+// OpMemory is the memory held by a single op. See OpMemoryUsage.
+type OpMemory struct {
+	// The size of the buffer holding the request from the kernel, or zero if
+	// it has been released with ReleaseInbound.
+	Inbound int
+
+	// The size of the reply built so far, including buffers set aside for the
+	// file system to fill in, e.g. ReadDirOp.Dst.
+	Outbound int
+}
+
+// OpMemoryUsage returns the memory held by the op whose context is supplied,
+// which must be a context returned by Connection.ReadOp.
+func OpMemoryUsage(ctx context.Context) OpMemory {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return OpMemory{}
+	}
+
+	var m OpMemory
+	if !state.mem.released.Load() {
+		m.Inbound = state.inMsg.Cap()
+	}
+	m.Outbound = state.outMsg.Len()
+
+	return m
+}
+
+// ReleaseInbound hands the buffer holding the request for the op whose
+// context is supplied back for reuse before the op is answered, for file
+// systems that have finished with its inbound payload. It clears the fields
+// of the op that refer to the buffer, WriteFileOp.Data and SetXattrOp.Value,
+// so the payload must have been copied elsewhere first if it is still needed.
+// A WriteFileOp still reports all of its data written if it succeeds, or
+// BytesWritten if set.
+//
+// It returns false, releasing nothing, for a ReadFileOp whose Dst lives in the
+// buffer (see MountConfig.UseVectoredRead), and for a context not returned by
+// Connection.ReadOp. Releasing a buffer twice is harmless.
+//
+// LOCKS_EXCLUDED(c.mu)
+func ReleaseInbound(ctx context.Context) bool {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return false
+	}
+
+	if o, ok := state.op.(*fuseops.ReadFileOp); ok && o.Dst != nil {
+		return false
+	}
+
+	if state.mem.released.Swap(true) {
+		return true
+	}
+
+	switch o := state.op.(type) {
+	case *fuseops.WriteFileOp:
+		state.mem.written = len(o.Data)
+		o.Data = nil
+
+	case *fuseops.SetXattrOp:
+		o.Value = nil
+	}
+
+	state.conn.putInMessage(state.inMsg)
+	return true
+}
+
+// MemoryStats describes the buffers held by a connection. See
+// Connection.MemoryStats.
+type MemoryStats struct {
+	// The bytes of inbound buffers held by ops being served.
+	InboundInUse int64
+
+	// The bytes of inbound buffers kept for reuse by later ops.
+	InboundFree int64
+}
+
+// MemoryStats returns the memory currently held by the connection's buffers.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) MemoryStats() MemoryStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return MemoryStats{
+		InboundInUse: c.inBytesInUse,
+		InboundFree:  c.inBytesFree,
+	}
+}
+
+// The part of an op's state concerned with its buffers, shared by every copy
+// of the opState.
+type opMemory struct {
+	// Whether inMsg has been put back early by ReleaseInbound.
+	released atomic.Bool
+
+	// For a WriteFileOp whose data was released, the length of that data.
+	written int
+}
+
+// Fix up the reply to an op whose inbound buffer was released early, after
+// kernelResponse has filled it in.
+func fixReleasedResponse(
+	outMsg *buffer.OutMessage,
+	op interface{},
+	mem *opMemory) {
+	if !mem.released.Load() || outMsg.Sglist == nil {
+		return
+	}
+
+	if o, ok := op.(*fuseops.WriteFileOp); ok {
+		out := (*fusekernel.WriteOut)(unsafe.Pointer(&outMsg.Sglist[1][0]))
+		out.Size = bytesWritten(o, mem.written)
+	}
+}
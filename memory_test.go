@@ -0,0 +1,151 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// What memoryServer saw while serving a write.
+type memoryReport struct {
+	data     string
+	before   OpMemory
+	after    OpMemory
+	released bool
+	stats    MemoryStats
+}
+
+// A server that copies the data of each write, releases its inbound buffer,
+// and reports what it saw.
+type memoryServer struct {
+	reports chan memoryReport
+}
+
+func (s memoryServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		var r memoryReport
+		if write, ok := op.(*fuseops.WriteFileOp); ok {
+			r.data = string(write.Data)
+			r.before = OpMemoryUsage(ctx)
+			r.released = ReleaseInbound(ctx)
+			r.after = OpMemoryUsage(ctx)
+			r.stats = c.MemoryStats()
+		}
+
+		s.reports <- r
+		c.Reply(ctx, nil)
+	}
+}
+
+func Test_ReleaseInbound(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	server := memoryServer{
+		reports: make(chan memoryReport, 1),
+	}
+
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		server,
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	const data = "taco burrito"
+	in := make([]byte, unsafe.Sizeof(fusekernel.WriteIn{}))
+	binary.LittleEndian.PutUint32(in[16:], uint32(len(data)))
+	body := append(in, data...)
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + len(body)),
+		Opcode: fusekernel.OpWrite,
+		Unique: 1,
+		Nodeid: 2,
+	})
+	msg.Write(body)
+
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	r := <-server.reports
+	if r.data != data {
+		t.Errorf("Data = %q, want %q", r.data, data)
+	}
+
+	if r.before.Inbound == 0 {
+		t.Errorf("Inbound before release = 0")
+	}
+
+	if !r.released {
+		t.Errorf("ReleaseInbound = false")
+	}
+
+	if r.after.Inbound != 0 {
+		t.Errorf("Inbound after release = %d, want 0", r.after.Inbound)
+	}
+
+	// The buffer is back on the freelist, and nothing else is in use.
+	if r.stats.InboundInUse != 0 || r.stats.InboundFree != int64(r.before.Inbound) {
+		t.Errorf("MemoryStats = %+v, want nothing in use and %d free", r.stats, r.before.Inbound)
+	}
+
+	// The reply still reports all of the data written.
+	buf := make([]byte, 4096)
+	n, err := kernel.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	var out fusekernel.WriteOut
+	headerSize := int(unsafe.Sizeof(fusekernel.OutHeader{}))
+	if err := binary.Read(bytes.NewReader(buf[headerSize:n]), binary.LittleEndian, &out); err != nil {
+		t.Fatalf("binary.Read: %v", err)
+	}
+
+	if out.Size != uint32(len(data)) {
+		t.Errorf("WriteOut.Size = %d, want %d", out.Size, len(data))
+	}
+
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
@@ -15,14 +15,10 @@
 package fuse
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"log"
-	"net"
 	"os"
-	"os/exec"
 	"strings"
-	"syscall"
 )
 
 // Server is an interface for any type that knows how to serve ops read from a
@@ -47,9 +43,16 @@ func Mount(
 		return nil, err
 	}
 
+	if config.AllowOther && config.AllowRoot {
+		return nil, errors.New("AllowOther and AllowRoot are mutually exclusive")
+	}
+
+	config = config.withLabelledLoggers()
+
 	// Initialize the struct.
 	mfs := &MountedFileSystem{
 		dir:                 dir,
+		mountOptions:        config.toOptionsString(),
 		joinStatusAvailable: make(chan struct{}),
 	}
 
@@ -60,17 +63,25 @@ func Mount(
 	ready := make(chan error, 1)
 	dev, err := mount(dir, config, ready)
 	if err != nil {
-		return nil, fmt.Errorf("mount: %v", err)
+		return nil, fmt.Errorf("mount: %w", err)
 	}
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Completed the mounting kickoff process")
 	}
 
+	if config.PollDevice {
+		pollable, err := pollableDevice(dev)
+		if err != nil {
+			abandonMount(dir, dev, ready)
+			return nil, fmt.Errorf("pollableDevice: %w", err)
+		}
+
+		dev = pollable
+	}
+
 	// Choose a parent context for ops.
 	cfgCopy := *config
-	if cfgCopy.OpContext == nil {
-		cfgCopy.OpContext = context.Background()
-	}
+	cfgCopy.OpContext = config.opContext()
 
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Creating a connection object")
@@ -80,20 +91,17 @@ func Mount(
 		cfgCopy,
 		config.DebugLogger,
 		config.ErrorLogger,
-		dev)
+		dev,
+		server)
 	if err != nil {
+		abandonMount(dir, dev, ready)
 		return nil, fmt.Errorf("newConnection: %v", err)
 	}
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Successfully created the connection")
 	}
 
-	// Serve the connection in the background. When done, set the join status.
-	go func() {
-		server.ServeOps(connection)
-		mfs.joinStatus = connection.close()
-		close(mfs.joinStatusAvailable)
-	}()
+	mfs.serve(server, connection)
 
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Waiting for mounting process to complete")
@@ -104,9 +112,31 @@ func Mount(
 		return nil, fmt.Errorf("mount (background): %v", err)
 	}
 
+	mfs.watchMountpoint()
 	return mfs, nil
 }
 
+// Undo a mount whose device can't be served, so that accesses to dir don't
+// hang waiting for answers that will never come.
+func abandonMount(dir string, dev *os.File, ready <-chan error) {
+	dev.Close()
+	if err := <-ready; err == nil {
+		unmount(dir)
+	}
+}
+
+// Serve the connection in the background. When done, set the join status.
+func (mfs *MountedFileSystem) serve(server Server, connection *Connection) {
+	mfs.conn = connection
+	mfs.deviceFD = connection.dev.Fd()
+
+	go func() {
+		server.ServeOps(connection)
+		mfs.joinStatus = connection.close()
+		close(mfs.joinStatusAvailable)
+	}()
+}
+
 func checkMountPoint(dir string) error {
 	if strings.HasPrefix(dir, "/dev/fd") {
 		return nil
@@ -126,107 +156,3 @@ func checkMountPoint(dir string) error {
 
 	return nil
 }
-
-func fusermount(binary string, argv []string, additionalEnv []string, wait bool, debugLogger *log.Logger) (*os.File, error) {
-	if debugLogger != nil {
-		debugLogger.Println("Creating a socket pair")
-	}
-	// Create a socket pair.
-	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
-	if err != nil {
-		return nil, fmt.Errorf("Socketpair: %v", err)
-	}
-
-	if debugLogger != nil {
-		debugLogger.Println("Creating files to wrap the sockets")
-	}
-	// Wrap the sockets into os.File objects that we will pass off to fusermount.
-	writeFile := os.NewFile(uintptr(fds[0]), "fusermount-child-writes")
-	defer writeFile.Close()
-
-	readFile := os.NewFile(uintptr(fds[1]), "fusermount-parent-reads")
-	defer readFile.Close()
-
-	if debugLogger != nil {
-		debugLogger.Println("Starting fusermount/os mount")
-	}
-	// Start fusermount/mount_macfuse/mount_osxfuse.
-	cmd := exec.Command(binary, argv...)
-	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
-	cmd.Env = append(cmd.Env, additionalEnv...)
-	cmd.ExtraFiles = []*os.File{writeFile}
-	cmd.Stderr = os.Stderr
-
-	// Run the command.
-	if wait {
-		err = cmd.Run()
-	} else {
-		err = cmd.Start()
-	}
-	if err != nil {
-		return nil, fmt.Errorf("running %v: %v", binary, err)
-	}
-
-	if debugLogger != nil {
-		debugLogger.Println("Wrapping socket pair in a connection")
-	}
-	// Wrap the socket file in a connection.
-	c, err := net.FileConn(readFile)
-	if err != nil {
-		return nil, fmt.Errorf("FileConn: %v", err)
-	}
-	defer c.Close()
-
-	if debugLogger != nil {
-		debugLogger.Println("Checking that we have a unix domain socket")
-	}
-	// We expect to have a Unix domain socket.
-	uc, ok := c.(*net.UnixConn)
-	if !ok {
-		return nil, fmt.Errorf("Expected UnixConn, got %T", c)
-	}
-
-	if debugLogger != nil {
-		debugLogger.Println("Read a message from socket")
-	}
-	// Read a message.
-	buf := make([]byte, 32) // expect 1 byte
-	oob := make([]byte, 32) // expect 24 bytes
-	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
-	if err != nil {
-		return nil, fmt.Errorf("ReadMsgUnix: %v", err)
-	}
-
-	// Parse the message.
-	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
-	if err != nil {
-		return nil, fmt.Errorf("ParseSocketControlMessage: %v", err)
-	}
-
-	// We expect one message.
-	if len(scms) != 1 {
-		return nil, fmt.Errorf("expected 1 SocketControlMessage; got scms = %#v", scms)
-	}
-
-	scm := scms[0]
-
-	if debugLogger != nil {
-		debugLogger.Println("Successfully read the socket message.")
-	}
-
-	// Pull out the FD returned by fusermount
-	gotFds, err := syscall.ParseUnixRights(&scm)
-	if err != nil {
-		return nil, fmt.Errorf("syscall.ParseUnixRights: %v", err)
-	}
-
-	if len(gotFds) != 1 {
-		return nil, fmt.Errorf("wanted 1 fd; got %#v", gotFds)
-	}
-
-	if debugLogger != nil {
-		debugLogger.Println("Converting FD into os.File")
-	}
-	// Turn the FD into an os.File.
-	return os.NewFile(uintptr(gotFds[0]), "/dev/fuse"), nil
-}
@@ -17,9 +17,13 @@ package fuse
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"runtime"
+	"sort"
 	"strings"
+
+	"github.com/jacobsa/timeutil"
 )
 
 // Optional configuration accepted by Mount.
@@ -28,16 +32,48 @@ type MountConfig struct {
 	// should inherit. If nil, context.Background() will be used.
 	OpContext context.Context
 
+	// Labels identifying the mount, such as a volume or tenant name. Ops read
+	// from the connection carry them in their contexts, where MountLabels finds
+	// them, so a server mounted at several mountpoints at once can tell which
+	// one an op arrived through, and hooks recording metrics or trace spans
+	// (see fuseutil.Hooks) can attach them. Every line written to ErrorLogger
+	// and DebugLogger for the mount starts with them, e.g.
+	// "{tenant=acme volume=home} ". The map must not be modified once mounted.
+	Labels map[string]string
+
 	// If non-empty, the name of the file system as displayed by e.g. `mount`.
 	// This is important because the `umount` command requires root privileges if
-	// it doesn't agree with /etc/fstab.
+	// it doesn't agree with /etc/fstab. On Linux it is the source, i.e. the
+	// first field, in /proc/mounts, may contain commas, and defaults to
+	// "some_fuse_file_system".
 	FSName string
 
 	// Mount the file system in read-only mode. File modes will appear as normal,
 	// but opening a file for writing and metadata operations like chmod,
 	// chtimes, etc. will fail.
+	//
+	// The mount is made with MS_RDONLY (-o ro for the mount helpers), so the
+	// kernel fails such calls with EROFS itself, and the file system never
+	// sees the ops. It has no effect on ServeDevice and Resume, whose devices
+	// were mounted elsewhere; see fuseutil.Freezer for those.
 	ReadOnly bool
 
+	// Let users other than the one who mounted the file system access it, as
+	// with the allow_other mount option. Without it, the kernel refuses access
+	// by anyone else, root included. Permissions are then up to the file
+	// system, or to the kernel unless DisableDefaultPermissions is set.
+	//
+	// On Linux an unprivileged user may only set this if /etc/fuse.conf
+	// contains the line user_allow_other; otherwise Mount fails with
+	// ErrUserAllowOther.
+	AllowOther bool
+
+	// Like AllowOther, but let in only root besides the user who mounted the
+	// file system, as with the allow_root mount option. On Linux, where the
+	// kernel knows only allow_other, the connection refuses ops from other
+	// users with EACCES. Must not be set along with AllowOther.
+	AllowRoot bool
+
 	// A logger to use for logging errors. All errors are logged, with the
 	// exception of a few blacklisted errors that are expected. If nil, no error
 	// logging is performed.
@@ -47,6 +83,17 @@ type MountConfig struct {
 	// performed.
 	DebugLogger *log.Logger
 
+	// The clock against which the expirations in ops' responses, e.g.
+	// ChildInodeEntry.EntryExpiration, are turned into the durations the
+	// kernel caches for. File systems that compute expirations from a
+	// timeutil.SimulatedClock in tests should pass the same clock here, so
+	// that the kernel sees the TTLs they intended. If nil, the real time is
+	// used.
+	//
+	// Entries written into ReadDirPlusOp.Dst by fuseutil.WriteDirentPlus are
+	// converted when written, using the real time.
+	Clock timeutil.Clock
+
 	// Linux only. OS X always behaves as if writeback caching is disabled.
 	//
 	// By default on Linux we allow the kernel to perform writeback caching
@@ -108,11 +155,42 @@ type MountConfig struct {
 	//     spontaneously change for reasons the kernel doesn't observe. See
 	//     http://goo.gl/V5WQCN for more discussion.
 	//
+	// *   Written back data arrives in WriteFileOps with Cached set, which
+	//     shouldn't update the file's times; the kernel sends the mtime and
+	//     ctime separately (see SetInodeAttributesOp.Ctime).
+	//
+	// Writeback caching is only enabled if the kernel supports it (Linux
+	// >= 3.15).
+	//
 	// Setting DisableWritebackCaching disables this behavior. Instead the file
 	// system is called one or more times for each write(2), and the user's
 	// syscall doesn't return until the file system returns.
 	DisableWritebackCaching bool
 
+	// Stop the kernel from caching anything the file system tells it about
+	// names and inodes, so that every lookup and every stat(2) is answered by
+	// the file system, for backends that can't tolerate the kernel serving
+	// stale metadata, or to rule the kernel's caches in or out when chasing a
+	// bug. It costs an op for each path component of each system call, and
+	// more. In particular:
+	//
+	//   - The expirations of entries and attributes in responses (e.g.
+	//     ChildInodeEntry.EntryExpiration, including those in
+	//     ReadDirPlusOp.Dst) are treated as already past, so nothing is cached,
+	//     negative entries included.
+	//
+	//   - Writeback caching and symlink caching are not negotiated, as though
+	//     DisableWritebackCaching were set and EnableSymlinkCaching not.
+	//
+	//   - OpenFileOp.KeepPageCache, OpenDirOp.KeepCache and OpenDirOp.CacheDir
+	//     are ignored, so the page cache is dropped each time a file is opened.
+	//     File contents are still cached while a file is open; use
+	//     OpenFileOp.UseDirectIO to send every read to the file system.
+	//
+	//   - On OS X the volume is mounted with novncache and noattrcache,
+	//     whatever EnableVnodeCaching says.
+	DisableKernelCaching bool
+
 	// OS X only.
 	//
 	// Normally on OS X we mount with the novncache option
@@ -128,6 +206,39 @@ type MountConfig struct {
 	// entries will be cached for an arbitrarily long time.
 	EnableVnodeCaching bool
 
+	// OS X only.
+	//
+	// Mount with the local option, marking the volume as a local disk rather
+	// than a network share. The Finder and other system services treat network
+	// volumes conservatively: they may poll them, skip Spotlight indexing, and
+	// copy files with slow fallbacks that avoid features like hard links and
+	// extended attributes. Set this for file systems backed by local storage.
+	LocalVolume bool
+
+	// OS X only.
+	//
+	// Advertise the volume as supporting renaming, so that the user can rename
+	// it in the Finder. The file system receives a SetVolumeNameOp, and should
+	// report the new name in later StatFSOps if it persists.
+	EnableVolumeRename bool
+
+	// OS X only.
+	//
+	// Ask the kernel to send GetXtimesOp when answering getattrlist(2) queries
+	// for backup and creation times, rather than using the creation time from
+	// InodeAttributes. Backup software such as Time Machine relies on the
+	// backup time.
+	EnableXtimes bool
+
+	// OS X only.
+	//
+	// Tell the kernel that the file system is case-insensitive, so that it
+	// folds names in its own name cache and reports the volume as
+	// case-insensitive to getattrlist(2) and pathconf(2). The file system must
+	// actually behave that way, e.g. by being wrapped with
+	// fuseutil.NewCaseInsensitiveFileSystem.
+	EnableCaseInsensitive bool
+
 	// Linux only.
 	//
 	// Linux 4.20 introduced caching symlink targets in the page cache:
@@ -154,6 +265,10 @@ type MountConfig struct {
 	// Disable FUSE default permissions.
 	// This is useful for situations where the backing data store (e.g., S3) doesn't
 	// actually utilise any form of qualifiable UNIX permissions.
+	//
+	// File systems that do want UNIX permissions but check them themselves can
+	// use fuseutil.CheckAccess and friends, and answer access(2) by
+	// implementing fuseops.AccessOp.
 	DisableDefaultPermissions bool
 
 	// Use vectored reads.
@@ -171,7 +286,16 @@ type MountConfig struct {
 
 	// Additional key=value options to pass unadulterated to the underlying mount
 	// command. See `man 8 mount`, the fuse documentation, etc. for
-	// system-specific information.
+	// system-specific information. An empty value gives a bare option, e.g.
+	// {"noatime": ""}. They override options set from other fields.
+	//
+	// On Linux they go into the data string given to mount(2), apart from
+	// those that are mount(2) flags, such as noexec, and those starting with
+	// "x-", such as x-gvfs-show, which are meant for other programs reading
+	// the mount table and aren't understood by the kernel. When mounting
+	// through fusermount(1) instead, they are passed to it with -o. On OS X
+	// they are passed to the mount helper with -o, and may not contain
+	// commas.
 	//
 	// For expert use only! May invalidate other guarantees made in the
 	// documentation for this package.
@@ -180,16 +304,234 @@ type MountConfig struct {
 	// Sets the filesystem type (third field in /etc/mtab). /etc/mtab and
 	// /proc/mounts will show the filesystem type as fuse.<Subtype>.
 	// If not set, /proc/mounts will show the filesystem type as fuse/fuseblk.
+	// A leading "fuse." is ignored, so "gcsfuse" and "fuse.gcsfuse" are the
+	// same.
 	Subtype string
 
 	// Flag to enable async reads that are received from
 	// the kernel
 	EnableAsyncReads bool
 
+	// Linux only.
+	//
+	// The most background requests, those that no process waits for directly
+	// such as readahead, writeback and asynchronous direct I/O, that the kernel
+	// sends before holding back further ones until some are answered, and the
+	// number at which it considers the connection congested and starts
+	// skipping readahead (see IsCongested). Raise them
+	// to let more reads and writes run in parallel against a backend that
+	// handles concurrency well; lower them to keep background traffic from
+	// crowding out interactive ops. Zero means the kernel's defaults of 12
+	// and 9; setting only MaxBackground makes the threshold three quarters of
+	// it.
+	//
+	// Unless the process mounting the file system has CAP_SYS_ADMIN, Linux
+	// caps them at /proc/sys/fs/fuse/max_user_bgreq and max_user_congthresh.
+	// The values given to the kernel are reported by
+	// Connection.ConnectionInfo.
+	MaxBackground       uint16
+	CongestionThreshold uint16
+
+	// Linux only.
+	//
+	// The largest write, in bytes, that the kernel may send in a single
+	// WriteFileOp, rounded down to whole pages. Fewer, larger writes cut the
+	// per-op overhead that dominates the throughput of bulk writes; each op in
+	// flight holds a buffer of this size (see OpMemoryUsage). Zero means the
+	// default of 1 MiB.
+	//
+	// Linux splits writes into pieces of at most fs.fuse.max_pages_limit
+	// pages, 256 unless changed (1 MiB with 4 KiB pages), whatever this says.
+	// The limit can be raised through /proc/sys/fs/fuse/max_pages_limit on
+	// Linux >= 6.13, and is reported by ProbeKernel.
+	MaxWrite uint32
+
+	// The most, in bytes, that the kernel may read ahead of sequential reads
+	// of a file, rounded down to whole pages. Larger windows suit file systems
+	// whose files are mostly read from start to end over high-latency
+	// backends; smaller ones save reads that latency-sensitive file systems
+	// with random access would have to wait behind. Any value smaller than a
+	// page, e.g. 1, turns readahead off. Zero means the default of 1 MiB.
+	//
+	// Linux uses the smaller of this and the window it offers when mounting,
+	// which is the backing device's read_ahead_kb, 128 KiB unless changed; it
+	// can be raised afterwards through /sys/class/bdi/<major>:<minor>/
+	// read_ahead_kb, using the device number of the mount. The value given to
+	// the kernel is reported by Connection.ConnectionInfo.
+	MaxReadahead uint32
+
 	// Flag to enable parallel lookup and readdir operations from the
 	// kernel
 	// Ref: https://github.com/torvalds/linux/commit/5c672ab3f0ee0f78f7acad183f34db0f8781a200
 	EnableParallelDirOps bool
+
+	// Linux only. Have the kernel list directories with ReadDirPlusOp rather
+	// than ReadDirOp, receiving the attributes of each entry along with its
+	// name, so that listing a large directory doesn't take a lookup per entry
+	// (Linux >= 3.9). The file system must support ReadDirPlusOp; the kernel
+	// doesn't fall back to ReadDirOp.
+	EnableReaddirplus bool
+
+	// With EnableReaddirplus, let the kernel choose between ReadDirPlusOp and
+	// ReadDirOp for each read, using ReadDirPlusOp only when entries are being
+	// looked up after being listed (as by "ls -l" but not "ls"). The file
+	// system must support both.
+	EnableReaddirplusAuto bool
+
+	// Linux only.
+	//
+	// Allow files opened with OpenFileOp.UseDirectIO to be mapped with
+	// MAP_SHARED (Linux >= 6.6, FUSE_DIRECT_IO_ALLOW_MMAP). Without this the
+	// kernel fails such mmap(2) calls with ENODEV, which breaks databases and
+	// other programs that use shared writable mappings. Whether the kernel
+	// agreed is reported in OpenFileOp.DirectIOMmap.
+	//
+	// Shared writable mappings always go through the kernel's page cache:
+	//
+	// *   For files opened without UseDirectIO they work regardless of this
+	//     field. Dirty pages are written back with WriteFileOp when the kernel
+	//     decides to, on msync(2), and on munmap(2), so file systems must be
+	//     prepared for writes that arrive after the file is closed (though
+	//     before its handle is released). Writeback caching (see
+	//     DisableWritebackCaching) additionally lets the kernel trust its own
+	//     idea of the file's size and mtime while pages are dirty.
+	//
+	// *   For files opened with UseDirectIO, setting this field makes the kernel
+	//     use the page cache for the mapping only, writing back and dropping
+	//     cached pages around each direct read and write to keep the two
+	//     coherent.
+	//
+	// In both cases file systems whose files change behind the kernel's back
+	// must invalidate the page cache (see Connection.NotifyInvalInode), or
+	// mapped readers will see stale data.
+	EnableDirectIOMmap bool
+
+	// Linux only.
+	//
+	// Ask the kernel to drop an inode's cached pages whenever it notices that
+	// the inode's mtime or size has changed, e.g. in the attributes returned
+	// by GetInodeAttributesOp once the attribute cache expires
+	// (FUSE_AUTO_INVAL_DATA).
+	//
+	// This suits file systems whose files change behind the kernel's back and
+	// that report accurate, fine-grained mtimes. It is off by default, in which
+	// case the kernel keeps cached pages until the file is opened without
+	// OpenFileOp.KeepPageCache or the file system invalidates them itself (see
+	// Connection.NotifyInvalInode). Leave it off for backends with coarse
+	// mtimes: every write the kernel didn't make itself then looks like a
+	// change, and the page cache is thrown away over and over.
+	EnableAutoInvalData bool
+
+	// Linux only.
+	//
+	// The SELinux security context to give every file in the file system, via
+	// the context= mount option, e.g. "u:object_r:app_fuse_file:s0" on Android.
+	// Without it, files get the policy's default label for fuse, which on
+	// Android and other SELinux-enforcing systems may prevent the intended
+	// users from accessing them.
+	SELinuxContext string
+
+	// The longest name, in bytes, that the file system can store. It is
+	// reported to statfs(2) and pathconf(2) callers, and ops that would create
+	// or look up a longer name are rejected with ENAMETOOLONG without being
+	// passed to the file system, protecting backends that would truncate or
+	// otherwise mangle such names. Zero means no limit is enforced, and 255 is
+	// reported.
+	MaxNameLength uint32
+
+	// The longest symlink target, in bytes, that the file system can store.
+	// Zero means no limit beyond the kernel's own (PATH_MAX). Longer targets
+	// are rejected with ENAMETOOLONG without being passed to the file system.
+	MaxSymlinkLength uint32
+
+	// Linux only.
+	//
+	// Enable passthrough I/O (Linux >= 6.9), letting the file system register
+	// backing files with Connection.OpenBackingFile and hand them out in
+	// OpenFileOp.BackingID, and declare how deeply this mount may be stacked
+	// on other file systems using passthrough, this one included. Use 1 if the
+	// backing files live on ordinary file systems, and 2 if they may live on
+	// another FUSE mount that itself uses passthrough; the kernel rejects
+	// backing files whose file system is stacked as deeply as this one, and
+	// allows no more than 2.
+	//
+	// The kernel doesn't support passthrough together with writeback caching,
+	// so this has no effect unless DisableWritebackCaching is also set. Zero,
+	// the default, disables passthrough.
+	MaxStackDepth uint32
+
+	// Linux only.
+	//
+	// Negotiate FUSE_HAS_RESEND (Linux >= 6.9), which lets a process that
+	// takes over serving the file system (see Resume) ask the kernel to send
+	// again the requests that the previous process read but never answered,
+	// rather than leaving the processes that made them hanging.
+	EnableResend bool
+
+	// Linux only.
+	//
+	// Negotiate FUSE_HAS_INODE_DAX (Linux >= 5.17), letting the file system
+	// choose per inode, via InodeAttributes.DAX, which files the kernel maps
+	// directly. This only matters when the file system is served over the
+	// virtiofs transport to a guest mounted with dax=inode; with dax=always
+	// every file is mapped, and with dax=never or on /dev/fuse none are.
+	EnablePerFileDAX bool
+
+	// Linux only.
+	//
+	// Negotiate FUSE_CREATE_SUPP_GROUP (Linux >= 6.3), asking the kernel to
+	// tell ops that create entries about the caller's membership in the
+	// parent directory's group, in OpContext.Groups.
+	EnableCreateSuppGroup bool
+
+	// Linux only.
+	//
+	// Negotiate FUSE_FLOCK_LOCKS (Linux >= 3.1), passing flock(2) requests to
+	// the file system as fuseops.FlockOp, so that whole-file locks taken on one
+	// client of a network file system are seen by the others. By default the
+	// kernel keeps track of them itself, per machine.
+	EnableFlockLocks bool
+
+	// Negotiate FUSE_POSIX_LOCKS, passing fcntl(2) record locks to the file
+	// system as fuseops.GetLkOp, SetLkOp and SetLkWaitOp, so that byte-range
+	// locks taken on one client of a network file system are seen by the
+	// others. By default the kernel keeps track of them itself, per machine.
+	EnablePosixLocks bool
+
+	// Linux only.
+	//
+	// Pass renameat2(2) flags (Linux >= 4.0) to the file system in
+	// fuseops.RenameOp.Flags. By default renames with flags fail with EINVAL
+	// without reaching the file system, so that file systems unaware of them
+	// don't, say, replace an entry when asked not to.
+	EnableRenameFlags bool
+
+	// Linux only.
+	//
+	// Negotiate FUSE_EXPORT_SUPPORT, so that the file system can be exported
+	// over NFS with knfsd. NFS clients hold on to file handles, i.e. inode IDs
+	// and generation numbers, for as long as they like, and the kernel asks
+	// for inodes that it has since forgotten with LookUpInodeOps named "."
+	// and ".."; see fuseutil.NewExportFileSystem. Inode IDs must therefore
+	// stay valid, and be given new generation numbers if reused, including
+	// after the file system restarts; see fuseutil.ExportChecker. The export
+	// also needs an fsid= option in exports(5).
+	EnableExportSupport bool
+
+	// Linux only.
+	//
+	// Put the fuse device in non-blocking mode and wait for requests with the
+	// Go runtime's poller (epoll), so that a server waiting for requests
+	// parks its goroutine instead of holding an OS thread blocked in read(2).
+	// Together with fuseutil.NewSingleThreadedFileSystemServer, this serves
+	// the file system on a single goroutine that uses no thread while idle,
+	// which suits small embedded file systems. Devices passed to Resume and
+	// ServeDevice are replaced by a non-blocking copy, and closed.
+	PollDevice bool
+
+	// The largest message the connection may carry, or zero for no limit
+	// beyond the usual ones. Set by MountSharded for relayed connections.
+	maxMessage int
 }
 
 // Create a map containing all of the key=value mount options to be given to
@@ -223,26 +565,53 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 		opts["fsname"] = fsname
 	}
 
-	subtype := c.Subtype
+	subtype := strings.TrimPrefix(c.Subtype, "fuse.")
 	if subtype != "" {
 		opts["subtype"] = subtype
 	}
 
+	// SELinux label? Categories are separated by commas, which must be quoted.
+	if c.SELinuxContext != "" {
+		if strings.Contains(c.SELinuxContext, ",") {
+			opts["context"] = `"` + c.SELinuxContext + `"`
+		} else {
+			opts["context"] = c.SELinuxContext
+		}
+	}
+
 	// Read only?
 	if c.ReadOnly {
 		opts["ro"] = ""
 	}
 
+	// Access by other users? Linux has no allow_root; see AllowRoot.
+	switch {
+	case c.AllowOther:
+		opts["allow_other"] = ""
+	case c.AllowRoot && isDarwin:
+		opts["allow_root"] = ""
+	case c.AllowRoot:
+		opts["allow_other"] = ""
+	}
+
 	// Handle OS X options.
 	if isDarwin {
-		if !c.EnableVnodeCaching {
+		if !c.EnableVnodeCaching || c.DisableKernelCaching {
 			opts["novncache"] = ""
 		}
 
+		if c.DisableKernelCaching {
+			opts["noattrcache"] = ""
+		}
+
 		if c.VolumeName != "" {
 			// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options#volname
 			opts["volname"] = c.VolumeName
 		}
+
+		if c.LocalVolume {
+			opts["local"] = ""
+		}
 	}
 
 	// OS X: disable the use of "Apple Double" (._foo and .DS_Store) files, which
@@ -272,6 +641,11 @@ func escapeOptionsKey(s string) (res string) {
 func mapToOptionsString(opts map[string]string) string {
 	var components []string
 	for k, v := range opts {
+		// fusermount(1) honours escaped commas only in these values.
+		if k == "fsname" || k == "subtype" {
+			v = escapeOptionsKey(v)
+		}
+
 		k = escapeOptionsKey(k)
 
 		component := k
@@ -285,6 +659,78 @@ func mapToOptionsString(opts map[string]string) string {
 	return strings.Join(components, ",")
 }
 
+// The context from which every op should inherit, carrying the mount's labels.
+func (c *MountConfig) opContext() context.Context {
+	ctx := c.OpContext
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if c.Labels != nil {
+		ctx = context.WithValue(ctx, labelsKey, c.Labels)
+	}
+
+	return ctx
+}
+
+// MountLabels returns the MountConfig.Labels of the mount through which the
+// op with the given context arrived, or nil if there are none.
+func MountLabels(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(labelsKey).(map[string]string)
+	return labels
+}
+
+// Return a copy of the config whose loggers start every line with the
+// mount's labels, or the config itself if it has none.
+func (c *MountConfig) withLabelledLoggers() *MountConfig {
+	if len(c.Labels) == 0 {
+		return c
+	}
+
+	keys := make([]string, 0, len(c.Labels))
+	for k := range c.Labels {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+c.Labels[k])
+	}
+
+	prefix := []byte("{" + strings.Join(pairs, " ") + "} ")
+
+	labelled := func(l *log.Logger) *log.Logger {
+		if l == nil {
+			return nil
+		}
+
+		w := &labelWriter{w: l.Writer(), prefix: prefix}
+		return log.New(w, l.Prefix(), l.Flags())
+	}
+
+	cfg := *c
+	cfg.ErrorLogger = labelled(c.ErrorLogger)
+	cfg.DebugLogger = labelled(c.DebugLogger)
+	return &cfg
+}
+
+// Prefixes each write, which the log package makes once per line.
+type labelWriter struct {
+	w      io.Writer
+	prefix []byte
+}
+
+func (w *labelWriter) Write(p []byte) (int, error) {
+	line := append(append([]byte(nil), w.prefix...), p...)
+	if _, err := w.w.Write(line); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
 // Create an options string suitable for passing to the mount helper.
 func (c *MountConfig) toOptionsString() string {
 	return mapToOptionsString(c.toMap())
@@ -0,0 +1,40 @@
+//go:build (illumos || solaris) && cgo
+// +build illumos solaris
+// +build cgo
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+)
+
+// On illumos and Solaris there is no documented way to mount a fuse device
+// other than the platform's libfuse (2.x), whose mount helper knows the
+// driver's conventions. libfuse is used only to mount: ops are not routed
+// through its lowlevel callbacks. The device it opened is served with the
+// kernel protocol, as on Linux, which works only where the driver speaks that
+// protocol on the device.
+func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
+	fd, err := libfuseMount(dir, cfg.toOptionsString())
+	if err != nil {
+		ready <- err
+		return nil, err
+	}
+
+	ready <- nil
+	return os.NewFile(uintptr(fd), "/dev/fuse"), nil
+}
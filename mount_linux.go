@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
@@ -52,6 +53,43 @@ var mountflagopts = map[string]func(uintptr) uintptr{
 	"dirsync": enableFunc(unix.MS_DIRSYNC),
 }
 
+// Split the options for a mount into the source, flags and file system type
+// to pass to mount(2), and the rest, which go to the kernel's fuse driver.
+func kernelMountOptions(cfg *MountConfig) (
+	source string,
+	mountflag uintptr,
+	fstype string,
+	opts map[string]string) {
+	// As per libfuse/fusermount.c:749: https://bit.ly/2SgtWYM#L749
+	mountflag = uintptr(unix.MS_NODEV | unix.MS_NOSUID)
+	opts = cfg.toMap()
+	for k := range opts {
+		fn, ok := mountflagopts[k]
+		if !ok {
+			continue
+		}
+		mountflag = fn(mountflag)
+		delete(opts, k)
+	}
+	source = opts["fsname"] // handled via source mount(2) parameter
+	delete(opts, "fsname")
+	fstype = "fuse"
+	if subtype, ok := opts["subtype"]; ok {
+		fstype += "." + subtype
+	}
+	delete(opts, "subtype")
+
+	// Options for userspace, e.g. x-gvfs-show for file managers, mean nothing
+	// to the fuse driver, which would refuse to mount.
+	for k := range opts {
+		if strings.HasPrefix(k, "x-") {
+			delete(opts, k)
+		}
+	}
+
+	return source, mountflag, fstype, opts
+}
+
 var errFallback = errors.New("sentinel: fallback to fusermount(1)")
 
 func directmount(dir string, cfg *MountConfig) (*os.File, error) {
@@ -62,7 +100,12 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	// is opened in blocking mode. When opened in non-blocking mode, the Go
 	// runtime tries to use poll(2), which does not work with /dev/fuse.
 	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0644)
-	if err != nil {
+	switch err {
+	case nil:
+	case syscall.ENOENT, syscall.ENODEV, syscall.ENXIO:
+		// fusermount(1) won't do any better.
+		return nil, deviceError(err)
+	default:
 		return nil, errFallback
 	}
 	dev := os.NewFile(uintptr(fd), "/dev/fuse")
@@ -73,34 +116,18 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	// As per libfuse/fusermount.c:847: https://bit.ly/2SgtWYM#L847
 	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d",
 		dev.Fd(), os.Getuid(), os.Getgid())
-	// As per libfuse/fusermount.c:749: https://bit.ly/2SgtWYM#L749
-	mountflag := uintptr(unix.MS_NODEV | unix.MS_NOSUID)
-	opts := cfg.toMap()
-	for k := range opts {
-		fn, ok := mountflagopts[k]
-		if !ok {
-			continue
-		}
-		mountflag = fn(mountflag)
-		delete(opts, k)
-	}
-	delete(opts, "fsname") // handled via fstype mount(2) parameter
-	fstype := "fuse"
-	if subtype, ok := opts["subtype"]; ok {
-		fstype += "." + subtype
-	}
-	delete(opts, "subtype")
+	source, mountflag, fstype, opts := kernelMountOptions(cfg)
 	data += "," + mapToOptionsString(opts)
 
 	if cfg.DebugLogger != nil {
 		cfg.DebugLogger.Println("Starting the unix mounting")
 	}
 	if err := unix.Mount(
-		cfg.FSName, // source
-		dir,        // target
-		fstype,     // fstype
-		mountflag,  // mountflag
-		data,       // data
+		source,    // source
+		dir,       // target
+		fstype,    // fstype
+		mountflag, // mountflag
+		data,      // data
 	); err != nil {
 		if err == syscall.EPERM {
 			return nil, errFallback
@@ -141,9 +168,29 @@ func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 			cfg.DebugLogger.Println("Directmount failed. Trying fallback.")
 		}
 		fusermountPath, err := findFusermount()
+		if err != nil && runtime.GOOS == "android" {
+			return nil, &ContainerError{
+				Op:  "mount",
+				Err: syscall.EPERM,
+				Advice: "Android apps can't mount file systems; obtain a mounted " +
+					"device from the system and use ServeDevice",
+			}
+		}
+		if err != nil && InUserNamespace() {
+			return nil, &ContainerError{
+				Op:  "mount",
+				Err: syscall.EPERM,
+				Advice: "in a user namespace, mount from a process with " +
+					"CAP_SYS_ADMIN in the namespace that owns its mount namespace " +
+					"(e.g. unshare -Urm), on Linux 4.18 or later",
+			}
+		}
 		if err != nil {
 			return nil, err
 		}
+		if (cfg.AllowOther || cfg.AllowRoot) && os.Geteuid() != 0 && !userAllowOther(fuseConfPath) {
+			return nil, ErrUserAllowOther
+		}
 		argv := []string{
 			"-o", cfg.toOptionsString(),
 			"--",
@@ -154,6 +201,26 @@ func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 	return dev, err
 }
 
+// The configuration file read by fusermount(1).
+const fuseConfPath = "/etc/fuse.conf"
+
+// Does the fusermount configuration at the given path let unprivileged users
+// mount with allow_other? A missing file doesn't.
+func userAllowOther(path string) bool {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.TrimSpace(line) == "user_allow_other" {
+			return true
+		}
+	}
+
+	return false
+}
+
 func parseFuseFd(dir string) (int, error) {
 	if !strings.HasPrefix(dir, "/dev/fd/") {
 		return -1, fmt.Errorf("not a /dev/fd path")
@@ -1,7 +1,15 @@
 package fuse
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func Test_parseFuseFd(t *testing.T) {
@@ -35,3 +43,133 @@ func Test_parseFuseFd(t *testing.T) {
 		}
 	})
 }
+
+func Test_kernelMountOptions(t *testing.T) {
+	cfg := &MountConfig{
+		FSName:  "foo",
+		Subtype: "bar",
+		Options: map[string]string{
+			"noexec":      "",
+			"max_read":    "4096",
+			"x-gvfs-show": "",
+		},
+	}
+
+	source, mountflag, fstype, opts := kernelMountOptions(cfg)
+	if source != "foo" {
+		t.Errorf("source = %q", source)
+	}
+
+	if want := uintptr(unix.MS_NODEV | unix.MS_NOSUID | unix.MS_NOEXEC); mountflag != want {
+		t.Errorf("mountflag = %#x, want %#x", mountflag, want)
+	}
+
+	if fstype != "fuse.bar" {
+		t.Errorf("fstype = %q", fstype)
+	}
+
+	want := map[string]string{
+		"default_permissions": "",
+		"max_read":            "4096",
+	}
+
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("opts = %v, want %v", opts, want)
+	}
+}
+
+func Test_kernelMountOptionsReadOnly(t *testing.T) {
+	_, mountflag, _, opts := kernelMountOptions(&MountConfig{ReadOnly: true})
+	if mountflag&unix.MS_RDONLY == 0 {
+		t.Errorf("mountflag = %#x, want MS_RDONLY", mountflag)
+	}
+
+	if _, ok := opts["ro"]; ok {
+		t.Errorf("ro passed to the fuse driver: %v", opts)
+	}
+}
+
+func Test_kernelMountOptionsNames(t *testing.T) {
+	testCases := []struct {
+		cfg        MountConfig
+		wantSource string
+		wantFstype string
+	}{
+		{MountConfig{}, "some_fuse_file_system", "fuse"},
+		{MountConfig{FSName: "mybucket", Subtype: "gcsfuse"}, "mybucket", "fuse.gcsfuse"},
+		{MountConfig{FSName: "a,b", Subtype: "fuse.gcsfuse"}, "a,b", "fuse.gcsfuse"},
+	}
+
+	for _, tc := range testCases {
+		source, _, fstype, _ := kernelMountOptions(&tc.cfg)
+		if source != tc.wantSource || fstype != tc.wantFstype {
+			t.Errorf("%+v: source %q, fstype %q; want %q, %q", tc.cfg, source, fstype, tc.wantSource, tc.wantFstype)
+		}
+	}
+}
+
+func Test_userAllowOther(t *testing.T) {
+	testCases := map[string]bool{
+		"":                                       false,
+		"# user_allow_other\n":                   false,
+		"mount_max = 1000\n\nuser_allow_other\n": true,
+		"  user_allow_other  ":                   true,
+	}
+
+	for contents, want := range testCases {
+		path := filepath.Join(t.TempDir(), "fuse.conf")
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := userAllowOther(path); got != want {
+			t.Errorf("%q: userAllowOther = %v, want %v", contents, got, want)
+		}
+	}
+
+	if userAllowOther(filepath.Join(t.TempDir(), "missing")) {
+		t.Errorf("Missing file allows allow_other")
+	}
+}
+
+func Test_pollableDevice(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	defer kernel.Close()
+
+	dev, err := pollableDevice(os.NewFile(uintptr(fds[1]), "dev"))
+	if err != nil {
+		t.Fatalf("pollableDevice: %v", err)
+	}
+	defer dev.Close()
+
+	// Only files registered with the poller support deadlines.
+	if err := dev.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	if _, err := dev.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// Writes through the raw descriptor, as done for replies, leave it
+	// non-blocking.
+	if _, err := syscall.Write(int(dev.Fd()), []byte("reply")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	flags, err := unix.FcntlInt(dev.Fd(), unix.F_GETFL, 0)
+	if err != nil || flags&unix.O_NONBLOCK == 0 {
+		t.Errorf("Flags after Fd: %#x, %v", flags, err)
+	}
+
+	n, err := kernel.Read(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("Read: %q, %v", buf[:n], err)
+	}
+}
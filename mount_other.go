@@ -0,0 +1,31 @@
+//go:build !linux && !darwin && !(illumos && cgo) && !(solaris && cgo)
+// +build !linux
+// +build !darwin
+// +build !illumos !cgo
+// +build !solaris !cgo
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
+	return nil, fmt.Errorf("%w: %s", ErrPlatformUnsupported, runtime.GOOS)
+}
@@ -17,6 +17,10 @@ package fuse
 import (
 	"context"
 	"fmt"
+	"os"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
 )
 
 // MountedFileSystem represents the status of a mount operation, with a method
@@ -24,9 +28,21 @@ import (
 type MountedFileSystem struct {
 	dir string
 
+	// The connection being served. Set before Mount returns.
+	conn *Connection
+
+	// See ConnectionInfo. Set before Mount returns.
+	deviceFD     uintptr
+	mountOptions string
+
 	// The result to return from Join. Not valid until the channel is closed.
 	joinStatus          error
 	joinStatusAvailable chan struct{}
+
+	// The connection's directory in the fuse control file system, if any,
+	// found on first use by WaitForQuiescence.
+	ctlOnce sync.Once
+	ctlDir  string
 }
 
 // Dir returns the directory on which the file system is mounted (or where we
@@ -41,7 +57,9 @@ func (mfs *MountedFileSystem) Dir() string {
 // in-flight ops).
 //
 // The return value will be non-nil if anything unexpected happened while
-// serving. May be called multiple times.
+// serving, e.g. ErrConnectionAborted or ErrMountpointGone if the kernel hung
+// up for a reason other than the file system being unmounted. May be called
+// multiple times.
 func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	select {
 	case <-mfs.joinStatusAvailable:
@@ -60,7 +78,65 @@ func (mfs *MountedFileSystem) GetFuseContext(ctx context.Context) (uid, gid, pid
 	if !ok {
 		return 0, 0, 0, fmt.Errorf("GetFuseContext called with invalid context: %#v", ctx)
 	}
-	inMsg := state.inMsg
-	header := inMsg.Header()
+	header := state.header
 	return header.Uid, header.Gid, header.Pid, nil
 }
+
+// MemoryStats returns the memory currently held by the connection's buffers.
+// See Connection.MemoryStats.
+func (mfs *MountedFileSystem) MemoryStats() MemoryStats {
+	return mfs.conn.MemoryStats()
+}
+
+// NotifyInvalInode asks the kernel to drop cached attributes and data for the
+// inode. See Connection.NotifyInvalInode.
+func (mfs *MountedFileSystem) NotifyInvalInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) error {
+	return mfs.conn.NotifyInvalInode(inode, off, length)
+}
+
+// NotifyInvalEntry asks the kernel to drop a cached dentry. See
+// Connection.NotifyInvalEntry.
+func (mfs *MountedFileSystem) NotifyInvalEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	return mfs.conn.NotifyInvalEntry(parent, name)
+}
+
+// NotifyPollWakeup wakes up the callers polling files with the given handle.
+// See Connection.NotifyPollWakeup.
+func (mfs *MountedFileSystem) NotifyPollWakeup(kh fuseops.PollHandle) error {
+	return mfs.conn.NotifyPollWakeup(kh)
+}
+
+// NotifyStore pushes data into the kernel's page cache for the inode. See
+// Connection.NotifyStore.
+func (mfs *MountedFileSystem) NotifyStore(
+	inode fuseops.InodeID,
+	offset uint64,
+	data []byte) error {
+	return mfs.conn.NotifyStore(inode, offset, data)
+}
+
+// NotifyRetrieve fetches the contents of the kernel's page cache for the
+// inode. See Connection.NotifyRetrieve.
+func (mfs *MountedFileSystem) NotifyRetrieve(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	offset uint64,
+	size uint32) ([]byte, error) {
+	return mfs.conn.NotifyRetrieve(ctx, inode, offset, size)
+}
+
+// OpenBackingFile registers a file for passthrough I/O. See
+// Connection.OpenBackingFile.
+func (mfs *MountedFileSystem) OpenBackingFile(f *os.File) (fuseops.BackingID, error) {
+	return mfs.conn.OpenBackingFile(f)
+}
+
+// CloseBackingFile releases a backing file. See Connection.CloseBackingFile.
+func (mfs *MountedFileSystem) CloseBackingFile(id fuseops.BackingID) error {
+	return mfs.conn.CloseBackingFile(id)
+}
@@ -0,0 +1,359 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Watch for the mountpoint of the file system disappearing (see
+// ErrMountpointGone) until it is unmounted, aborting the connection if it
+// does. The kernel signals changes to the mount table on
+// /proc/self/mountinfo, and all mounts in the process share one watcher, so
+// idle mounts make no system calls here either.
+func (mfs *MountedFileSystem) watchMountpoint() {
+	dir, err := filepath.Abs(mfs.dir)
+	if err != nil {
+		return
+	}
+
+	table, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return
+	}
+
+	dev, ok := findMount(table, dir)
+	if !ok {
+		return
+	}
+
+	if !mountpoints.add(mfs, watchedMount{dir: dir, dev: dev}) {
+		return
+	}
+
+	go func() {
+		<-mfs.joinStatusAvailable
+		mountpoints.remove(mfs)
+	}()
+}
+
+// A mount whose mountpoint is being watched.
+type watchedMount struct {
+	// The absolute path of the mountpoint.
+	dir string
+
+	// The device number of the file system mounted there.
+	dev [2]uint32
+}
+
+// Watches the mount table on behalf of all mounts in the process, with a
+// goroutine that runs for as long as there's a mount to watch.
+type mountinfoWatcher struct {
+	mu sync.Mutex
+
+	// The mounts being watched.
+	//
+	// GUARDED_BY(mu)
+	mounts map[*MountedFileSystem]watchedMount
+
+	// The write end of a pipe through which to wake the goroutine, so that it
+	// reads the table again, or -1 if it isn't running.
+	//
+	// GUARDED_BY(mu)
+	wake int
+}
+
+var mountpoints = mountinfoWatcher{wake: -1}
+
+// Start watching the mountpoint of the given mount, starting the goroutine
+// if need be. Return false if that can't be done.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *mountinfoWatcher) add(mfs *MountedFileSystem, m watchedMount) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.wake < 0 {
+		mountinfo, err := os.Open("/proc/self/mountinfo")
+		if err != nil {
+			return false
+		}
+
+		var p [2]int
+		if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+			mountinfo.Close()
+			return false
+		}
+
+		w.wake = p[1]
+		go w.run(mountinfo, p[0])
+	}
+
+	if w.mounts == nil {
+		w.mounts = make(map[*MountedFileSystem]watchedMount)
+	}
+
+	// The table may have changed since the caller read it, and since the
+	// goroutine last did, so have it check again.
+	w.mounts[mfs] = m
+	w.wakeLocked()
+	return true
+}
+
+// Stop watching the mountpoint of the given mount, if it still is.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *mountinfoWatcher) remove(mfs *MountedFileSystem) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.mounts[mfs]; !ok {
+		return
+	}
+
+	// Let the goroutine exit if this was the last.
+	delete(w.mounts, mfs)
+	if len(w.mounts) == 0 {
+		w.wakeLocked()
+	}
+}
+
+// LOCKS_REQUIRED(w.mu)
+func (w *mountinfoWatcher) wakeLocked() {
+	// If the pipe is full, the goroutine has yet to wake anyway.
+	if w.wake >= 0 {
+		unix.Write(w.wake, []byte{0})
+	}
+}
+
+// Stop the goroutine, forgetting every mount.
+//
+// LOCKS_REQUIRED(w.mu)
+func (w *mountinfoWatcher) stopLocked() {
+	if w.wake >= 0 {
+		unix.Close(w.wake)
+		w.wake = -1
+	}
+
+	w.mounts = nil
+}
+
+// Read the table each time it changes or the goroutine is woken, checking
+// every mount, until there are none left.
+func (w *mountinfoWatcher) run(mountinfo *os.File, wake int) {
+	defer mountinfo.Close()
+	defer unix.Close(wake)
+
+	buf := make([]byte, 64)
+	for {
+		// Reading the table is what rearms the notification.
+		table, err := readMountinfo(mountinfo)
+		if err != nil {
+			table = nil
+		}
+
+		if !w.check(table) {
+			return
+		}
+
+		fds := []unix.PollFd{
+			{Fd: int32(mountinfo.Fd()), Events: unix.POLLPRI},
+			{Fd: int32(wake), Events: unix.POLLIN},
+		}
+
+		for {
+			_, err = unix.Poll(fds, -1)
+			if err != unix.EINTR {
+				break
+			}
+		}
+
+		if err != nil {
+			w.check(nil)
+			return
+		}
+
+		if fds[1].Revents != 0 {
+			for {
+				if n, err := unix.Read(wake, buf); n <= 0 || err != nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+func readMountinfo(mountinfo *os.File) ([]byte, error) {
+	if _, err := mountinfo.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(mountinfo)
+}
+
+// Check every mount against the mount table, no longer watching those whose
+// mountpoints have gone. If table is nil, or no mounts are left, stop and
+// return false.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *mountinfoWatcher) check(table []byte) bool {
+	w.mu.Lock()
+	mounts := make(map[*MountedFileSystem]watchedMount, len(w.mounts))
+	for mfs, m := range w.mounts {
+		mounts[mfs] = m
+	}
+	w.mu.Unlock()
+
+	// Aborting connections involves the file system, so don't hold the lock.
+	var gone []*MountedFileSystem
+	if table != nil {
+		for mfs, m := range mounts {
+			if mfs.mountpointGone(table, m.dir, m.dev) {
+				gone = append(gone, mfs)
+			}
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, mfs := range gone {
+		delete(w.mounts, mfs)
+	}
+
+	if table == nil || len(w.mounts) == 0 {
+		w.stopLocked()
+		return false
+	}
+
+	return true
+}
+
+// Check whether the mountpoint has gone, given the mount table, and abort the
+// connection if so.
+func (mfs *MountedFileSystem) mountpointGone(table []byte, dir string, dev [2]uint32) bool {
+	if mounted(table, dev) {
+		return false
+	}
+
+	// Unmounted. If the directory is still there, it was the file system that
+	// was unmounted, perhaps lazily, leaving it to be served for as long as
+	// files are open in it. If not, and the connection is still alive, the
+	// mountpoint was taken away with the mount still on it.
+	_, err := os.Lstat(dir)
+	if !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.ENOTDIR) {
+		return false
+	}
+
+	// Without the connection's directory in the control file system, either
+	// the connection has already gone, or there's no way to abort it.
+	ctlDir := fusectlDirForDev(dev[0], dev[1])
+	if _, err := os.Stat(ctlDir); err != nil {
+		return true
+	}
+
+	mfs.conn.setHangupCause(ErrMountpointGone)
+	if err := os.WriteFile(path.Join(ctlDir, "abort"), []byte("1"), 0); err != nil {
+		if mfs.conn.errorLogger != nil {
+			mfs.conn.errorLogger.Printf("Mountpoint %s gone; aborting the connection: %v", dir, err)
+		}
+	}
+
+	return true
+}
+
+// Find the device number of the fuse file system mounted on top at dir in a
+// mount table in the format of /proc/self/mountinfo.
+func findMount(table []byte, dir string) (dev [2]uint32, ok bool) {
+	for _, line := range bytes.Split(table, []byte("\n")) {
+		// The fields are the mount ID, the parent's ID, major:minor, the root
+		// of the mount, the mountpoint, its options, optional fields ended by
+		// "-", the file system type, the source, and the superblock's options.
+		fields := strings.Fields(string(line))
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+
+		if sep < 5 || sep+1 >= len(fields) {
+			continue
+		}
+
+		fstype := fields[sep+1]
+		if fstype != "fuse" && fstype != "fuseblk" && !strings.HasPrefix(fstype, "fuse.") {
+			continue
+		}
+
+		if unescapeMountInfo(fields[4]) != dir {
+			continue
+		}
+
+		if d, err := parseDev(fields[2]); err == nil {
+			// Later entries are mounted on top of earlier ones.
+			dev, ok = d, true
+		}
+	}
+
+	return dev, ok
+}
+
+// Is a file system with the given device number in the mount table?
+func mounted(table []byte, dev [2]uint32) bool {
+	for _, line := range bytes.Split(table, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) < 3 {
+			continue
+		}
+
+		if d, err := parseDev(fields[2]); err == nil && d == dev {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parse a major:minor device number.
+func parseDev(s string) (dev [2]uint32, err error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return dev, fmt.Errorf("no colon in %q", s)
+	}
+
+	for j, part := range []string{s[:i], s[i+1:]} {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return dev, err
+		}
+
+		dev[j] = uint32(n)
+	}
+
+	return dev, nil
+}
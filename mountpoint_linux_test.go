@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const testMountinfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+35 22 0:44 / /mnt/with\040space rw,nosuid,nodev shared:20 - fuse.memfs memfs rw,user_id=1000
+36 22 0:45 / /mnt/stacked rw - fuse /dev/fuse rw,user_id=1000
+37 36 0:46 / /mnt/stacked rw master:3 - fuseblk /dev/sdb1 rw,user_id=0
+38 22 0:47 / /mnt/tmp rw - tmpfs tmpfs rw
+`
+
+func Test_findMount(t *testing.T) {
+	testCases := []struct {
+		dir string
+		dev [2]uint32
+		ok  bool
+	}{
+		{"/mnt/with space", [2]uint32{0, 44}, true},
+		{"/mnt/stacked", [2]uint32{0, 46}, true},
+		{"/mnt/tmp", [2]uint32{}, false},
+		{"/", [2]uint32{}, false},
+		{"/mnt/missing", [2]uint32{}, false},
+	}
+
+	for _, tc := range testCases {
+		dev, ok := findMount([]byte(testMountinfo), tc.dir)
+		if dev != tc.dev || ok != tc.ok {
+			t.Errorf("%q: got %v, %v; want %v, %v", tc.dir, dev, ok, tc.dev, tc.ok)
+		}
+	}
+}
+
+func Test_mountpointGone(t *testing.T) {
+	mfs := &MountedFileSystem{conn: &Connection{}}
+	table := []byte(testMountinfo)
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	// Still mounted.
+	if mfs.mountpointGone(table, missing, [2]uint32{0, 45}) {
+		t.Error("Gone while mounted")
+	}
+
+	// Unmounted, but the directory is still there.
+	if mfs.mountpointGone(table, t.TempDir(), [2]uint32{0, 99}) {
+		t.Error("Gone while the directory exists")
+	}
+
+	// Unmounted, with the directory gone. There's no connection to abort.
+	if !mfs.mountpointGone(table, missing, [2]uint32{0, 99}) {
+		t.Error("Not gone")
+	}
+
+	if mfs.conn.hangupCause != nil {
+		t.Errorf("Hangup cause: %v", mfs.conn.hangupCause)
+	}
+}
+
+func Test_mountinfoWatcher(t *testing.T) {
+	var p [2]int
+	if err := unix.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer unix.Close(p[0])
+
+	stays := &MountedFileSystem{conn: &Connection{}}
+	goes := &MountedFileSystem{conn: &Connection{}}
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	w := &mountinfoWatcher{
+		mounts: map[*MountedFileSystem]watchedMount{
+			stays: {dir: missing, dev: [2]uint32{0, 45}},
+			goes:  {dir: missing, dev: [2]uint32{0, 99}},
+		},
+		wake: p[1],
+	}
+
+	// One check of the table covers every mount.
+	if !w.check([]byte(testMountinfo)) {
+		t.Fatal("Stopped with a mount left")
+	}
+
+	if _, ok := w.mounts[goes]; ok || len(w.mounts) != 1 {
+		t.Errorf("Mounts after the check: %v", w.mounts)
+	}
+
+	// Once the last is unmounted, the watcher stops.
+	w.remove(stays)
+	if w.check([]byte(testMountinfo)) {
+		t.Error("Still running with no mounts")
+	}
+
+	if w.wake != -1 {
+		t.Errorf("Wake: %d", w.wake)
+	}
+}
+
+func Test_mountinfoWatcherStops(t *testing.T) {
+	w := &mountinfoWatcher{wake: -1}
+	mfs := &MountedFileSystem{conn: &Connection{}}
+
+	// The device isn't mounted, but the directory is still there, so the mount
+	// is watched until it is removed.
+	if !w.add(mfs, watchedMount{dir: t.TempDir(), dev: [2]uint32{0, 1 << 20}}) {
+		t.Fatal("add failed")
+	}
+
+	w.remove(mfs)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.mu.Lock()
+		wake := w.wake
+		w.mu.Unlock()
+
+		if wake == -1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("The watcher didn't stop")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_unescapeMountInfo(t *testing.T) {
+	testCases := map[string]string{
+		`/mnt/plain`:         "/mnt/plain",
+		`/mnt/a\040b`:        "/mnt/a b",
+		`/mnt/tab\011nl\012`: "/mnt/tab\tnl\n",
+		`/mnt/back\134slash`: `/mnt/back\slash`,
+		`/mnt/trailing\04`:   `/mnt/trailing\04`,
+	}
+
+	for in, want := range testCases {
+		if got := unescapeMountInfo(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
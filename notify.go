@@ -0,0 +1,287 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Notifications are messages sent to the kernel unprompted, rather than in
+// reply to an op. They are distinguished from replies by a zero unique ID,
+// with the notification code in the error field of the header. See
+// fuse_notify in fs/fuse/dev.c.
+
+// The protocol minor version in which the invalidation notifications were
+// introduced.
+const notifyInvalMinMinor = 12
+
+// NotifyInvalInode asks the kernel to drop its cached attributes for the
+// inode, along with any cached pages in the range [off, off+length). A
+// length of zero or less means "to the end of the file", and a negative off
+// invalidates attributes only.
+//
+// It is not an error if the kernel has no record of the inode, e.g. because it
+// has already been forgotten.
+func (c *Connection) NotifyInvalInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) error {
+	if c.protocol.Minor < notifyInvalMinMinor {
+		return ENOSYS
+	}
+
+	outMsg := c.getOutMessage()
+	defer c.putOutMessage(outMsg)
+
+	out := (*fusekernel.NotifyInvalInodeOut)(outMsg.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))))
+	out.Ino = uint64(inode)
+	out.Off = off
+	out.Len = length
+
+	return c.sendNotification(fusekernel.NotifyCodeInvalInode, outMsg)
+}
+
+// NotifyInvalEntry asks the kernel to drop its cached dentry for the given
+// name within parent, so that the next access causes a fresh LookUpInodeOp.
+//
+// As with NotifyInvalInode, it is not an error if the kernel has no such
+// entry cached. It must not be called while handling an op for the parent
+// directory, as the kernel holds the directory's lock for the duration of
+// such ops and the notification would deadlock waiting for it.
+func (c *Connection) NotifyInvalEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	if c.protocol.Minor < notifyInvalMinMinor {
+		return ENOSYS
+	}
+
+	outMsg := c.getOutMessage()
+	defer c.putOutMessage(outMsg)
+
+	out := (*fusekernel.NotifyInvalEntryOut)(outMsg.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))))
+	out.Parent = uint64(parent)
+	out.Namelen = uint32(len(name))
+
+	// The kernel expects the name to be NUL-terminated.
+	outMsg.AppendString(name)
+	outMsg.Append([]byte{0})
+
+	return c.sendNotification(fusekernel.NotifyCodeInvalEntry, outMsg)
+}
+
+// The protocol minor version in which FUSE_NOTIFY_POLL was introduced.
+const notifyPollMinMinor = 11
+
+// NotifyPollWakeup tells the kernel that events may have become ready on the
+// files polled with the given handle, waking up the callers waiting on them so
+// that they poll again. See fuseops.PollOp.
+//
+// It is not an error if nobody is waiting any more.
+func (c *Connection) NotifyPollWakeup(kh fuseops.PollHandle) error {
+	if c.protocol.Minor < notifyPollMinMinor {
+		return ENOSYS
+	}
+
+	outMsg := c.getOutMessage()
+	defer c.putOutMessage(outMsg)
+
+	out := (*fusekernel.NotifyPollWakeupOut)(outMsg.Grow(int(unsafe.Sizeof(fusekernel.NotifyPollWakeupOut{}))))
+	out.Kh = uint64(kh)
+
+	return c.sendNotification(fusekernel.NotifyCodePoll, outMsg)
+}
+
+// The protocol minor version in which FUSE_NOTIFY_STORE was introduced.
+const notifyStoreMinMinor = 15
+
+// NotifyStore pushes data into the kernel's page cache for the inode at the
+// given offset, as if it had been returned by a ReadFileOp. If the data
+// extends past the size of the file as known to the kernel, the kernel
+// extends the size to match. The data is copied before NotifyStore returns.
+//
+// Unlike the invalidation notifications, it is an error (ENOENT) to store
+// data for an inode the kernel doesn't know about.
+func (c *Connection) NotifyStore(
+	inode fuseops.InodeID,
+	offset uint64,
+	data []byte) error {
+	if c.protocol.Minor < notifyStoreMinMinor {
+		return ENOSYS
+	}
+
+	outMsg := c.getOutMessage()
+	defer c.putOutMessage(outMsg)
+
+	out := (*fusekernel.NotifyStoreOut)(outMsg.Grow(int(unsafe.Sizeof(fusekernel.NotifyStoreOut{}))))
+	out.Nodeid = uint64(inode)
+	out.Offset = offset
+	out.Size = uint32(len(data))
+	outMsg.Append(data)
+
+	return c.sendNotification(fusekernel.NotifyCodeStore, outMsg)
+}
+
+// The protocol minor version in which FUSE_NOTIFY_RETRIEVE was introduced.
+const notifyRetrieveMinMinor = 15
+
+// NotifyRetrieve asks the kernel for the contents of its page cache for the
+// inode in the range [offset, offset+size), and waits for the answer. The
+// kernel answers with the data up to the first page it doesn't have cached,
+// the size of the file as it knows it, or ConnectionInfo.MaxWrite bytes,
+// whichever comes first, so the result may be shorter than size or empty.
+//
+// The answer arrives as a request read by ReadOp, so ops must be being read
+// concurrently; in particular NotifyRetrieve must not be called from the
+// goroutine that calls ReadOp. It returns ctx.Err() if ctx is cancelled first,
+// e.g. because the file system has been unmounted. As with NotifyStore, it is
+// an error (ENOENT) to ask about an inode the kernel doesn't know about.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) NotifyRetrieve(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	offset uint64,
+	size uint32) ([]byte, error) {
+	if c.protocol.Minor < notifyRetrieveMinMinor {
+		return nil, ENOSYS
+	}
+
+	// Register to be handed the answer before asking for it.
+	reply := make(chan []byte, 1)
+
+	c.mu.Lock()
+	c.lastRetrieve++
+	unique := c.lastRetrieve
+	if c.retrieves == nil {
+		c.retrieves = make(map[uint64]chan []byte)
+	}
+	c.retrieves[unique] = reply
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.retrieves, unique)
+		c.mu.Unlock()
+	}()
+
+	outMsg := c.getOutMessage()
+	out := (*fusekernel.NotifyRetrieveOut)(outMsg.Grow(int(unsafe.Sizeof(fusekernel.NotifyRetrieveOut{}))))
+	out.NotifyUnique = unique
+	out.Nodeid = uint64(inode)
+	out.Offset = offset
+	out.Size = size
+
+	err := c.sendNotification(fusekernel.NotifyCodeRetrieve, outMsg)
+	c.putOutMessage(outMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case data := <-reply:
+		return data, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Hand the kernel's answer to a NotifyRetrieve call to the caller, if it is
+// still waiting.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) handleNotifyReply(op *notifyReplyOp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reply, ok := c.retrieves[op.NotifyUnique]
+	if !ok {
+		return
+	}
+
+	delete(c.retrieves, op.NotifyUnique)
+	reply <- op.Data
+}
+
+// NotifyResend asks the kernel to send again every request that it has sent
+// to the file system and that hasn't been answered, including any read by a
+// previous process serving the same mount. Requests sent again have
+// fusekernel.UniqueResend set in their unique ID, so answers to the original
+// copies are rejected by the kernel.
+//
+// It returns ENOSYS unless MountConfig.EnableResend was set and the kernel
+// supports it. Resume calls it automatically when appropriate.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) NotifyResend() error {
+	if !c.resend {
+		return ENOSYS
+	}
+
+	// Answers rejected from now on may be for requests about to be sent again.
+	c.mu.Lock()
+	c.resendEpoch++
+	c.mu.Unlock()
+
+	outMsg := c.getOutMessage()
+	defer c.putOutMessage(outMsg)
+
+	return c.sendNotification(fusekernel.NotifyCodeResend, outMsg)
+}
+
+// Write a notification, whose payload has already been appended to outMsg.
+func (c *Connection) sendNotification(
+	code int32,
+	outMsg *buffer.OutMessage) error {
+	h := outMsg.OutHeader()
+	h.Unique = 0
+	h.Error = code
+	h.Len = uint32(outMsg.Len())
+
+	if c.debugLogger != nil {
+		c.debugLog(0, 1, "<- notify %d (%d bytes)", code, h.Len)
+	}
+
+	// Notifications without a payload consist of the header alone.
+	sglist := outMsg.Sglist
+	if sglist == nil {
+		sglist = [][]byte{outMsg.OutHeaderBytes()}
+	}
+
+	err := c.writeDevice(sglist)
+	switch err {
+	case nil:
+		return nil
+
+	case syscall.ENOENT:
+		// For invalidations, the kernel doesn't know about the inode or entry,
+		// so there is nothing cached to invalidate.
+		if code == fusekernel.NotifyCodeStore || code == fusekernel.NotifyCodeRetrieve {
+			return ENOENT
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("writev: %v", err)
+	}
+}
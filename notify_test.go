@@ -0,0 +1,261 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Create a connection whose device is the write end of a pipe, returning the
+// read end.
+func newPipeConnection(t *testing.T, minor uint32) (*Connection, *os.File) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	c := &Connection{
+		dev:      w,
+		protocol: fusekernel.Protocol{Major: 7, Minor: minor},
+	}
+
+	return c, r
+}
+
+func readNotification(t *testing.T, r *os.File) (code int32, payload []byte) {
+	t.Helper()
+	buf := make([]byte, 4096)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	buf = buf[:n]
+	if got := binary.LittleEndian.Uint32(buf[0:4]); int(got) != n {
+		t.Errorf("Header length %d, message length %d", got, n)
+	}
+
+	if unique := binary.LittleEndian.Uint64(buf[8:16]); unique != 0 {
+		t.Errorf("Unique = %d, want 0", unique)
+	}
+
+	return int32(binary.LittleEndian.Uint32(buf[4:8])), buf[16:]
+}
+
+func Test_NotifyInvalInode(t *testing.T) {
+	c, r := newPipeConnection(t, 31)
+	if err := c.NotifyInvalInode(17, 4096, -1); err != nil {
+		t.Fatalf("NotifyInvalInode: %v", err)
+	}
+
+	code, payload := readNotification(t, r)
+	if code != fusekernel.NotifyCodeInvalInode {
+		t.Errorf("Code = %d", code)
+	}
+
+	want := make([]byte, 24)
+	binary.LittleEndian.PutUint64(want[0:], 17)
+	binary.LittleEndian.PutUint64(want[8:], 4096)
+	binary.LittleEndian.PutUint64(want[16:], ^uint64(0))
+	if !bytes.Equal(payload, want) {
+		t.Errorf("Payload = %x, want %x", payload, want)
+	}
+}
+
+func Test_NotifyInvalEntry(t *testing.T) {
+	c, r := newPipeConnection(t, 31)
+	if err := c.NotifyInvalEntry(3, "taco"); err != nil {
+		t.Fatalf("NotifyInvalEntry: %v", err)
+	}
+
+	code, payload := readNotification(t, r)
+	if code != fusekernel.NotifyCodeInvalEntry {
+		t.Errorf("Code = %d", code)
+	}
+
+	want := make([]byte, 16)
+	binary.LittleEndian.PutUint64(want[0:], 3)
+	binary.LittleEndian.PutUint32(want[8:], 4)
+	want = append(want, "taco\x00"...)
+	if !bytes.Equal(payload, want) {
+		t.Errorf("Payload = %x, want %x", payload, want)
+	}
+}
+
+func Test_NotifyOldProtocol(t *testing.T) {
+	c, _ := newPipeConnection(t, 11)
+	if err := c.NotifyInvalInode(17, 0, 0); err != ENOSYS {
+		t.Errorf("NotifyInvalInode: %v, want ENOSYS", err)
+	}
+}
+
+func Test_MountedFileSystemNotifyInval(t *testing.T) {
+	c, r := newPipeConnection(t, 31)
+	mfs := &MountedFileSystem{conn: c}
+
+	if err := mfs.NotifyInvalInode(17, 0, 0); err != nil {
+		t.Fatalf("NotifyInvalInode: %v", err)
+	}
+
+	if code, _ := readNotification(t, r); code != fusekernel.NotifyCodeInvalInode {
+		t.Errorf("Code = %d", code)
+	}
+
+	if err := mfs.NotifyInvalEntry(3, "taco"); err != nil {
+		t.Fatalf("NotifyInvalEntry: %v", err)
+	}
+
+	if code, _ := readNotification(t, r); code != fusekernel.NotifyCodeInvalEntry {
+		t.Errorf("Code = %d", code)
+	}
+}
+
+func Test_NotifyStore(t *testing.T) {
+	c, r := newPipeConnection(t, 31)
+	if err := c.NotifyStore(17, 4096, []byte("taco")); err != nil {
+		t.Fatalf("NotifyStore: %v", err)
+	}
+
+	code, payload := readNotification(t, r)
+	if code != fusekernel.NotifyCodeStore {
+		t.Errorf("Code = %d", code)
+	}
+
+	want := make([]byte, 24)
+	binary.LittleEndian.PutUint64(want[0:], 17)
+	binary.LittleEndian.PutUint64(want[8:], 4096)
+	binary.LittleEndian.PutUint32(want[16:], 4)
+	want = append(want, "taco"...)
+	if !bytes.Equal(payload, want) {
+		t.Errorf("Payload = %x, want %x", payload, want)
+	}
+}
+
+func Test_NotifyRetrieve(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+
+	mfs, err := Resume(
+		"/mnt",
+		dev,
+		Session{ProtocolMajor: 7, ProtocolMinor: 31},
+		enosysServer{},
+		&MountConfig{})
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result)
+	go func() {
+		data, err := mfs.NotifyRetrieve(context.Background(), 17, 4096, 8192)
+		done <- result{data, err}
+	}()
+
+	code, payload := readNotification(t, kernel)
+	if code != fusekernel.NotifyCodeRetrieve {
+		t.Fatalf("Code = %d", code)
+	}
+
+	if len(payload) != 32 {
+		t.Fatalf("Payload = %x", payload)
+	}
+
+	notifyUnique := binary.LittleEndian.Uint64(payload[0:])
+	want := make([]byte, 32)
+	binary.LittleEndian.PutUint64(want[0:], notifyUnique)
+	binary.LittleEndian.PutUint64(want[8:], 17)
+	binary.LittleEndian.PutUint64(want[16:], 4096)
+	binary.LittleEndian.PutUint32(want[24:], 8192)
+	if !bytes.Equal(payload, want) {
+		t.Errorf("Payload = %x, want %x", payload, want)
+	}
+
+	// Answer with less than was asked for, as if the rest weren't cached.
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, fusekernel.NotifyRetrieveIn{
+		Offset: 4096,
+		Size:   4,
+	})
+	body.WriteString("taco")
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + body.Len()),
+		Opcode: fusekernel.OpNotifyReply,
+		Unique: notifyUnique,
+		Nodeid: 17,
+	})
+	msg.Write(body.Bytes())
+	if _, err := kernel.Write(msg.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	r := <-done
+	if r.err != nil || string(r.data) != "taco" {
+		t.Errorf("NotifyRetrieve: %q, %v", r.data, r.err)
+	}
+
+	// No answer is expected to the reply; closing the device ends the session
+	// with nothing further sent.
+	kernel.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
+
+func Test_NotifyRetrieveCancelled(t *testing.T) {
+	c, r := newPipeConnection(t, 31)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := c.NotifyRetrieve(ctx, 17, 0, 4096)
+		done <- err
+	}()
+
+	readNotification(t, r)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("NotifyRetrieve: %v, want context.Canceled", err)
+	}
+
+	if len(c.retrieves) != 0 {
+		t.Errorf("Still waiting: %v", c.retrieves)
+	}
+}
@@ -31,18 +31,27 @@ type interruptOp struct {
 	FuseID uint64
 }
 
+// The kernel's answer to NotifyRetrieve, handed to the caller waiting for it.
+type notifyReplyOp struct {
+	NotifyUnique uint64
+	Data         []byte
+}
+
 // Required in order to mount on Linux and OS X.
 type initOp struct {
 	// In
 	Kernel fusekernel.Protocol
 
 	// In/out
-	Flags fusekernel.InitFlags
+	Flags  fusekernel.InitFlags
+	Flags2 fusekernel.InitFlags2
 
 	// Out
-	Library       fusekernel.Protocol
-	MaxReadahead  uint32
-	MaxBackground uint16
-	MaxWrite      uint32
-	MaxPages      uint16
+	Library             fusekernel.Protocol
+	MaxReadahead        uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	MaxPages            uint16
+	MaxStackDepth       uint32
 }
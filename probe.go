@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// KernelFeatures describes the fuse support of the running kernel, as
+// reported by ProbeKernel.
+type KernelFeatures struct {
+	// The kernel release, as printed by uname -r.
+	Release string
+
+	// Whether the protocol version and flags were learned from the init
+	// request of a throwaway mount. If not, ProbeErr says why, and the other
+	// fields are all that is known.
+	Probed   bool
+	ProbeErr error
+
+	// The protocol version and capability flags offered by the kernel, as in
+	// ConnectionInfo.
+	ProtocolMajor uint32
+	ProtocolMinor uint32
+	Flags         uint64
+
+	// The most pages the kernel allows in a single request, from
+	// /proc/sys/fs/fuse/max_pages_limit (Linux >= 6.13). Zero if unknown.
+	MaxPagesLimit uint32
+}
+
+// A MountConfig option that takes effect only if the kernel offers a
+// capability, and the Linux release in which the capability appeared.
+type kernelOption struct {
+	name    string
+	enabled func(*MountConfig) bool
+	flags   uint64
+	since   string
+}
+
+// Kept in step with Connection.Init.
+var kernelOptions = []kernelOption{
+	{
+		name:    "EnableSymlinkCaching",
+		enabled: func(c *MountConfig) bool { return c.EnableSymlinkCaching },
+		flags:   uint64(fusekernel.InitCacheSymlinks),
+		since:   "4.20",
+	},
+	{
+		name:    "EnableNoOpenSupport",
+		enabled: func(c *MountConfig) bool { return c.EnableNoOpenSupport },
+		flags:   uint64(fusekernel.InitNoOpenSupport),
+		since:   "3.16",
+	},
+	{
+		name:    "EnableNoOpendirSupport",
+		enabled: func(c *MountConfig) bool { return c.EnableNoOpendirSupport },
+		flags:   uint64(fusekernel.InitNoOpendirSupport),
+		since:   "5.1",
+	},
+	{
+		name:    "EnableParallelDirOps",
+		enabled: func(c *MountConfig) bool { return c.EnableParallelDirOps },
+		flags:   uint64(fusekernel.InitParallelDirOps),
+		since:   "4.7",
+	},
+	{
+		name:    "EnableReaddirplus",
+		enabled: func(c *MountConfig) bool { return c.EnableReaddirplus },
+		flags:   uint64(fusekernel.InitDoReaddirplus),
+		since:   "3.9",
+	},
+	{
+		name:    "EnableAutoInvalData",
+		enabled: func(c *MountConfig) bool { return c.EnableAutoInvalData },
+		flags:   uint64(fusekernel.InitAutoInvalData),
+		since:   "3.6",
+	},
+	{
+		name:    "EnableDirectIOMmap",
+		enabled: func(c *MountConfig) bool { return c.EnableDirectIOMmap },
+		flags:   uint64(fusekernel.InitDirectIOAllowMmap) << 32,
+		since:   "6.6",
+	},
+	{
+		name:    "MaxStackDepth",
+		enabled: func(c *MountConfig) bool { return c.MaxStackDepth > 0 },
+		flags:   uint64(fusekernel.InitPassthrough) << 32,
+		since:   "6.9",
+	},
+	{
+		name:    "EnableResend",
+		enabled: func(c *MountConfig) bool { return c.EnableResend },
+		flags:   uint64(fusekernel.InitHasResend) << 32,
+		since:   "6.9",
+	},
+	{
+		name:    "EnablePerFileDAX",
+		enabled: func(c *MountConfig) bool { return c.EnablePerFileDAX },
+		flags:   uint64(fusekernel.InitHasInodeDAX) << 32,
+		since:   "5.17",
+	},
+	{
+		name:    "EnableCreateSuppGroup",
+		enabled: func(c *MountConfig) bool { return c.EnableCreateSuppGroup },
+		flags:   uint64(fusekernel.InitCreateSuppGroup) << 32,
+		since:   "6.3",
+	},
+	{
+		name:    "EnableFlockLocks",
+		enabled: func(c *MountConfig) bool { return c.EnableFlockLocks },
+		flags:   uint64(fusekernel.InitFlockLocks),
+		since:   "3.1",
+	},
+	{
+		name:    "EnablePosixLocks",
+		enabled: func(c *MountConfig) bool { return c.EnablePosixLocks },
+		flags:   uint64(fusekernel.InitPosixLocks),
+		since:   "2.6.18",
+	},
+}
+
+// Unsupported returns the names of the options set in the config that the
+// kernel would ignore for want of the capabilities they need. If the kernel
+// wasn't probed, the answer is based on the Linux release in which each
+// capability appeared, which is wrong for kernels with backported features.
+func (kf KernelFeatures) Unsupported(cfg *MountConfig) []string {
+	major, minor, ok := parseRelease(kf.Release)
+
+	var names []string
+	for _, o := range kernelOptions {
+		if !o.enabled(cfg) {
+			continue
+		}
+
+		var supported bool
+		switch {
+		case kf.Probed:
+			supported = kf.Flags&o.flags != 0
+		case ok:
+			sinceMajor, sinceMinor, _ := parseRelease(o.since)
+			supported = major > sinceMajor || major == sinceMajor && minor >= sinceMinor
+		default:
+			supported = true
+		}
+
+		if !supported {
+			names = append(names, o.name)
+		}
+	}
+
+	return names
+}
+
+func (kf KernelFeatures) String() string {
+	s := fmt.Sprintf("release %q", kf.Release)
+	if kf.Probed {
+		s += fmt.Sprintf(
+			", protocol %d.%d, flags %v|%v",
+			kf.ProtocolMajor,
+			kf.ProtocolMinor,
+			fusekernel.InitFlags(kf.Flags),
+			fusekernel.InitFlags2(kf.Flags>>32))
+	} else {
+		s += fmt.Sprintf(", not probed (%v)", kf.ProbeErr)
+	}
+
+	if kf.MaxPagesLimit != 0 {
+		s += fmt.Sprintf(", max_pages_limit %d", kf.MaxPagesLimit)
+	}
+
+	return s
+}
+
+// Parse the major and minor version numbers from a Linux release such as
+// "6.8.0-45-generic".
+func parseRelease(release string) (major, minor int, ok bool) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	// The minor version may run straight into a suffix, as in "4.19-rc1".
+	digits := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if digits == -1 {
+		digits = len(parts[1])
+	}
+
+	minor, err = strconv.Atoi(parts[1][:digits])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return major, minor, true
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// ProbeKernel reports what the running kernel's fuse support offers, so that
+// applications can choose their MountConfig before mounting for real; see
+// KernelFeatures.Unsupported.
+//
+// The protocol version and capability flags are known only to the kernel's
+// fuse module, which sends them in the init request for each new mount. So
+// if the process may create a mount namespace (i.e. it has CAP_SYS_ADMIN),
+// ProbeKernel mounts a throwaway file system on a temporary directory, in a
+// private namespace that only it can see, reads the init request, and
+// unmounts it again without answering. Otherwise, or if that fails, only the
+// release and other information readable from /proc is reported.
+func ProbeKernel() (KernelFeatures, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return KernelFeatures{}, fmt.Errorf("uname: %w", err)
+	}
+
+	kf := KernelFeatures{
+		Release: unix.ByteSliceToString(uts.Release[:]),
+	}
+
+	if b, err := os.ReadFile("/proc/sys/fs/fuse/max_pages_limit"); err == nil {
+		if n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32); err == nil {
+			kf.MaxPagesLimit = uint32(n)
+		}
+	}
+
+	// The namespace belongs to the thread that creates it, which must not be
+	// used for anything else afterwards, so do it on a goroutine that exits
+	// while still locked to the thread, taking the thread with it.
+	probed := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		probed <- probeInit(&kf)
+	}()
+
+	if err := <-probed; err != nil {
+		kf.ProbeErr = err
+	} else {
+		kf.Probed = true
+	}
+
+	return kf, nil
+}
+
+// Mount a throwaway file system in a new mount namespace and fill in the
+// protocol version and flags from its init request.
+func probeInit(kf *KernelFeatures) error {
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("unshare: %w", err)
+	}
+
+	// Keep the mount from propagating back to the original namespace.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "fuse-probe")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	// Opened in blocking mode; see directmount.
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return deviceError(err)
+	}
+
+	dev := os.NewFile(uintptr(fd), "/dev/fuse")
+
+	data := fmt.Sprintf(
+		"fd=%d,rootmode=40000,user_id=%d,group_id=%d",
+		fd,
+		os.Getuid(),
+		os.Getgid())
+
+	if err := unix.Mount("probe", dir, "fuse", unix.MS_NODEV|unix.MS_NOSUID, data); err != nil {
+		dev.Close()
+		return fmt.Errorf("mount: %w", err)
+	}
+
+	// Closing the device first aborts the connection, so that unmounting
+	// doesn't wait for an answer to the init request.
+	defer unix.Unmount(dir, unix.MNT_DETACH)
+	defer dev.Close()
+
+	inMsg := buffer.NewInMessage()
+	if err := inMsg.Init(dev); err != nil {
+		return fmt.Errorf("reading init request: %w", err)
+	}
+
+	var outMsg buffer.OutMessage
+	op, err := convertInMessage(&MountConfig{}, inMsg, &outMsg, fusekernel.Protocol{})
+	if err != nil {
+		return err
+	}
+
+	initOp, ok := op.(*initOp)
+	if !ok {
+		return errors.New("first request was not init")
+	}
+
+	kf.ProtocolMajor = initOp.Kernel.Major
+	kf.ProtocolMinor = initOp.Kernel.Minor
+	kf.Flags = uint64(initOp.Flags) | uint64(initOp.Flags2)<<32
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func Test_ProbeKernel(t *testing.T) {
+	kf, err := ProbeKernel()
+	if err != nil {
+		t.Fatalf("ProbeKernel: %v", err)
+	}
+
+	t.Logf("%v", kf)
+	if kf.Release == "" {
+		t.Errorf("No release")
+	}
+
+	// A kernel that can be probed speaks a protocol we can use.
+	if kf.Probed && kf.ProtocolMajor != fusekernel.ProtoVersionMinMajor {
+		t.Errorf("Protocol %d.%d", kf.ProtocolMajor, kf.ProtocolMinor)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func Test_ParseRelease(t *testing.T) {
+	testCases := []struct {
+		release string
+		want    string
+	}{
+		{"6.8.0-45-generic", "6 8 true"},
+		{"4.19-rc1", "4 19 true"},
+		{"5.15.153.1-microsoft-standard-WSL2", "5 15 true"},
+		{"6", "0 0 false"},
+		{"", "0 0 false"},
+	}
+
+	for _, tc := range testCases {
+		major, minor, ok := parseRelease(tc.release)
+		if got := fmt.Sprint(major, minor, ok); got != tc.want {
+			t.Errorf("%q: got %s, want %s", tc.release, got, tc.want)
+		}
+	}
+}
+
+func Test_KernelFeaturesUnsupported(t *testing.T) {
+	cfg := &MountConfig{
+		EnableReaddirplus: true,
+		EnableResend:      true,
+		MaxStackDepth:     1,
+	}
+
+	// Without a probe, go by the release.
+	kf := KernelFeatures{Release: "6.6.30"}
+	if got := fmt.Sprint(kf.Unsupported(cfg)); got != "[MaxStackDepth EnableResend]" {
+		t.Errorf("6.6: %s", got)
+	}
+
+	kf.Release = "6.9.0"
+	if got := kf.Unsupported(cfg); len(got) != 0 {
+		t.Errorf("6.9: %v", got)
+	}
+
+	// With one, go by the flags, whatever the release.
+	kf.Probed = true
+	kf.Flags = uint64(fusekernel.InitDoReaddirplus) | uint64(fusekernel.InitHasResend)<<32
+	if got := fmt.Sprint(kf.Unsupported(cfg)); got != "[MaxStackDepth]" {
+		t.Errorf("Probed: %s", got)
+	}
+
+	// An unknown release is given the benefit of the doubt.
+	if got := (KernelFeatures{}).Unsupported(cfg); len(got) != 0 {
+		t.Errorf("Unknown: %v", got)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"time"
+)
+
+// How often WaitForQuiescence checks whether the kernel has drained its
+// queue, when it can tell.
+const quiescencePollInterval = 10 * time.Millisecond
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) beginInFlight() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inFlight++
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) finishInFlightLocked() {
+	c.inFlight--
+	if c.inFlight == 0 && c.idle != nil {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+// Block until every op read from the kernel has been replied to.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) waitIdle(ctx context.Context) error {
+	c.mu.Lock()
+	if c.inFlight == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+	}
+
+	idle := c.idle
+	c.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitForQuiescence blocks until every op read from the kernel has been
+// replied to and, on Linux with the fuse control file system mounted at
+// /sys/fs/fuse/connections, the kernel has no requests queued for the file
+// system either. Use it before unmounting, or before capturing the file
+// system's state, once whatever was using the file system has stopped; new
+// requests may arrive as soon as it returns otherwise.
+//
+// It must not be called while serving an op, which it would wait for.
+func (mfs *MountedFileSystem) WaitForQuiescence(ctx context.Context) error {
+	mfs.ctlOnce.Do(func() {
+		mfs.ctlDir = fusectlDir(mfs.dir)
+	})
+
+	for {
+		if err := mfs.conn.waitIdle(ctx); err != nil {
+			return err
+		}
+
+		// Requests the kernel counts as waiting include those being served, so
+		// none means nothing is queued either.
+		if n, ok := kernelWaiting(mfs.ctlDir); !ok || n == 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(quiescencePollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
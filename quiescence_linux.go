@@ -0,0 +1,69 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const fuseSuperMagic = 0x65735546
+
+// Return the directory in the fuse control file system describing the
+// connection for the file system mounted at dir, or the empty string if
+// there is none.
+func fusectlDir(dir string) string {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil || fs.Type != fuseSuperMagic {
+		return ""
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return ""
+	}
+
+	return fusectlDirForDev(unix.Major(st.Dev), unix.Minor(st.Dev))
+}
+
+// Return the directory in the fuse control file system describing the
+// connection for the file system with the given device number.
+func fusectlDirForDev(major, minor uint32) string {
+	// The directory is named after the kernel's internal encoding of the
+	// device number, which differs from the one user space sees.
+	dev := uint64(major)<<20 | uint64(minor)
+	return path.Join("/sys/fs/fuse/connections", fmt.Sprint(dev))
+}
+
+// Return the number of requests the kernel has queued for the connection or
+// is waiting for answers to, and whether that could be determined.
+func kernelWaiting(ctlDir string) (int, bool) {
+	if ctlDir == "" {
+		return 0, false
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(ctlDir, "waiting"))
+	if err != nil {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	return n, err == nil
+}
@@ -0,0 +1,356 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Create a socket over which to relay requests to a worker process, returning
+// our end, the worker's end, and the largest message that fits on it.
+func newRelaySocket() (sock *os.File, workerSock *os.File, maxMessage int, err error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("Socketpair: %w", err)
+	}
+
+	maxMessage = buffer.MaxWriteSize + os.Getpagesize()
+	for _, fd := range fds {
+		if n := growSendBuffer(fd, maxMessage); n < maxMessage {
+			maxMessage = n
+		}
+	}
+
+	// Make our end non-blocking, so that closing it interrupts reads.
+	syscall.SetNonblock(fds[0], true)
+	sock = os.NewFile(uintptr(fds[0]), "relay")
+	workerSock = os.NewFile(uintptr(fds[1]), "relay worker")
+	return sock, workerSock, maxMessage, nil
+}
+
+// Raise the socket's send buffer towards the supplied message size, beyond
+// the system limit if we're privileged, and return the largest message that
+// can now be sent.
+func growSendBuffer(fd int, size int) int {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, size); err != nil {
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, size)
+	}
+
+	n, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF)
+	if err != nil {
+		return 0
+	}
+
+	// The kernel reserves some of the buffer for bookkeeping.
+	return n - 32
+}
+
+// Start a worker process with the supplied file as an extra descriptor, whose
+// number is given to it in the environment variable fdEnv along with the
+// other supplied variables. Our copy of the file is closed.
+func startWorker(
+	worker *exec.Cmd,
+	f *os.File,
+	fdEnv string,
+	env ...string) error {
+	defer f.Close()
+
+	if worker.Env == nil {
+		worker.Env = os.Environ()
+	}
+
+	worker.ExtraFiles = append(worker.ExtraFiles, f)
+	worker.Env = append(worker.Env, fdEnv+"="+strconv.Itoa(2+len(worker.ExtraFiles)))
+	worker.Env = append(worker.Env, env...)
+
+	return worker.Start()
+}
+
+// relay copies requests from a fuse device to the sockets of one or more
+// workers, and answers back, in both cases one message at a time. Each
+// request goes to the worker chosen by the inode it concerns (see shard).
+type relay struct {
+	dev         *os.File
+	socks       []*os.File
+	errorLogger *log.Logger
+
+	mu sync.Mutex
+
+	// For each request sent to a worker and not yet answered, the worker's
+	// index.
+	//
+	// GUARDED_BY(mu)
+	pending map[uint64]int
+
+	// Whether each worker has hung up.
+	//
+	// GUARDED_BY(mu)
+	gone []bool
+}
+
+func newRelay(dev *os.File, socks []*os.File, errorLogger *log.Logger) *relay {
+	return &relay{
+		dev:         dev,
+		socks:       socks,
+		errorLogger: errorLogger,
+		pending:     make(map[uint64]int),
+		gone:        make([]bool, len(socks)),
+	}
+}
+
+// Return the index of the worker responsible for the inode.
+func (r *relay) shard(inode uint64) int {
+	return int(inode % uint64(len(r.socks)))
+}
+
+// Relay until the file system is unmounted and the workers have hung up.
+func (r *relay) run() error {
+	answersDone := make(chan error, len(r.socks))
+	for i := range r.socks {
+		go func(i int) { answersDone <- r.forwardAnswers(i) }(i)
+	}
+
+	err := r.forwardRequests()
+
+	// Tell the workers that the file system is gone.
+	for _, sock := range r.socks {
+		sock.Close()
+	}
+
+	for range r.socks {
+		if answersErr := <-answersDone; err == nil {
+			err = answersErr
+		}
+	}
+
+	return err
+}
+
+// Copy requests to the workers until the file system is unmounted. Requests
+// that can't be sent to their worker are answered with EIO.
+func (r *relay) forwardRequests() error {
+	req := make([]byte, os.Getpagesize()+buffer.MaxWriteSize)
+	for {
+		n, err := r.dev.Read(req)
+		switch {
+		case err == io.EOF || errors.Is(err, syscall.ENODEV):
+			return nil
+
+		// The request was interrupted before we read it.
+		case errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ENOENT):
+			continue
+
+		case err != nil:
+			return fmt.Errorf("reading request: %w", err)
+
+		case n < fusekernel.InHeaderSize:
+			return fmt.Errorf("short request: %d bytes", n)
+		}
+
+		msg := req[:n]
+		h := (*fusekernel.InHeader)(unsafe.Pointer(&msg[0]))
+		switch h.Opcode {
+		case fusekernel.OpForget, fusekernel.OpNotifyReply:
+			r.send(r.shard(h.Nodeid), msg, false)
+
+		case fusekernel.OpBatchForget:
+			r.forwardBatchForget(msg)
+
+		case fusekernel.OpInterrupt:
+			r.forwardInterrupt(msg)
+
+		default:
+			if !r.send(r.shard(h.Nodeid), msg, true) {
+				r.answerEIO(h.Unique)
+			}
+		}
+	}
+}
+
+// Send a request to a worker, recording that it awaits an answer if
+// answered is set. Return false if the worker couldn't take it.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *relay) send(worker int, msg []byte, answered bool) bool {
+	unique := (*fusekernel.InHeader)(unsafe.Pointer(&msg[0])).Unique
+
+	r.mu.Lock()
+	if r.gone[worker] {
+		r.mu.Unlock()
+		return false
+	}
+
+	if answered {
+		r.pending[unique] = worker
+	}
+	r.mu.Unlock()
+
+	_, err := r.socks[worker].Write(msg)
+	if err == nil {
+		return true
+	}
+
+	if r.errorLogger != nil && !errors.Is(err, syscall.EPIPE) {
+		r.errorLogger.Printf("Forwarding %d-byte request to worker %d: %v", len(msg), worker, err)
+	}
+
+	if answered {
+		r.mu.Lock()
+		delete(r.pending, unique)
+		r.mu.Unlock()
+	}
+
+	return false
+}
+
+// Send each worker a batch of forgets for the inodes it is responsible for.
+func (r *relay) forwardBatchForget(msg []byte) {
+	if len(r.socks) == 1 {
+		r.send(0, msg, false)
+		return
+	}
+
+	const (
+		countSize = int(unsafe.Sizeof(fusekernel.BatchForgetCountIn{}))
+		entrySize = int(unsafe.Sizeof(fusekernel.BatchForgetEntryIn{}))
+	)
+
+	prefix := fusekernel.InHeaderSize + countSize
+	if len(msg) < prefix {
+		return
+	}
+
+	batches := make([][]byte, len(r.socks))
+	for off := prefix; off+entrySize <= len(msg); off += entrySize {
+		e := (*fusekernel.BatchForgetEntryIn)(unsafe.Pointer(&msg[off]))
+		w := r.shard(uint64(e.Inode))
+		if batches[w] == nil {
+			batches[w] = append(batches[w], msg[:prefix]...)
+		}
+
+		batches[w] = append(batches[w], msg[off:off+entrySize]...)
+	}
+
+	for w, batch := range batches {
+		if batch == nil {
+			continue
+		}
+
+		(*fusekernel.InHeader)(unsafe.Pointer(&batch[0])).Len = uint32(len(batch))
+		count := (*fusekernel.BatchForgetCountIn)(unsafe.Pointer(&batch[fusekernel.InHeaderSize]))
+		count.Count = uint32((len(batch) - prefix) / entrySize)
+		r.send(w, batch, false)
+	}
+}
+
+// Send an interrupt to the worker handling the request it refers to, if any.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *relay) forwardInterrupt(msg []byte) {
+	if len(msg) < fusekernel.InHeaderSize+int(unsafe.Sizeof(fusekernel.InterruptIn{})) {
+		return
+	}
+
+	in := (*fusekernel.InterruptIn)(unsafe.Pointer(&msg[fusekernel.InHeaderSize]))
+
+	r.mu.Lock()
+	w, ok := r.pending[in.Unique]
+	r.mu.Unlock()
+
+	if ok {
+		r.send(w, msg, false)
+	}
+}
+
+// Copy answers and notifications from a worker until it hangs up, then
+// answer the requests it left unanswered with EIO.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *relay) forwardAnswers(worker int) error {
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		for unique, w := range r.pending {
+			if w == worker {
+				r.answerEIO(unique)
+				delete(r.pending, unique)
+			}
+		}
+
+		r.gone[worker] = true
+	}()
+
+	answer := make([]byte, os.Getpagesize()+buffer.MaxReadSize)
+	for {
+		n, err := r.socks[worker].Read(answer)
+		switch {
+		case err == io.EOF || errors.Is(err, os.ErrClosed):
+			return nil
+
+		case err != nil:
+			return fmt.Errorf("reading answer: %w", err)
+
+		case n < int(unsafe.Sizeof(fusekernel.OutHeader{})):
+			return fmt.Errorf("short answer: %d bytes", n)
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&answer[0]))
+		if h.Unique != 0 {
+			r.mu.Lock()
+			delete(r.pending, h.Unique)
+			r.mu.Unlock()
+		}
+
+		_, err = r.dev.Write(answer[:n])
+		switch {
+		// The request was interrupted, or has been answered already.
+		case errors.Is(err, syscall.ENOENT):
+
+		case errors.Is(err, syscall.ENODEV):
+			return nil
+
+		case err != nil:
+			return fmt.Errorf("forwarding answer: %w", err)
+		}
+	}
+}
+
+func (r *relay) answerEIO(unique uint64) {
+	h := fusekernel.OutHeader{
+		Error:  -int32(syscall.EIO),
+		Unique: unique,
+	}
+
+	h.Len = uint32(unsafe.Sizeof(h))
+	b := (*[unsafe.Sizeof(h)]byte)(unsafe.Pointer(&h))[:]
+	if _, err := r.dev.Write(b); err != nil && r.errorLogger != nil &&
+		!errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ENODEV) {
+		r.errorLogger.Printf("Answering request 0x%08x: %v", unique, err)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// When resend is negotiated (see MountConfig.EnableResend), the kernel sends
+// again every unanswered request each time anybody sends NotifyResend, with
+// fusekernel.UniqueResend set in its unique ID. That includes requests we are
+// still working on, and requests whose answers crossed with the notification
+// and were rejected because the kernel no longer knew the original ID.
+// Running such requests twice would repeat non-idempotent operations, so:
+//
+//  *  For a request we are still working on, we drop the copy and answer the
+//     original with the new ID.
+//
+//  *  For a request whose answer was rejected, we drop the copy and send the
+//     same answer again with the new ID.
+//
+// Other copies, e.g. of requests read by a previous process serving the
+// mount, are served as usual.
+//
+// Answers are also rejected for requests that the kernel has given up on,
+// e.g. interrupted ones, which will never be sent again. So rejected answers
+// are kept only if we have sent NotifyResend since the request arrived, and
+// only up to a limit.
+
+// The most bytes of rejected answers we keep waiting for their requests to be
+// sent again. The oldest are dropped first.
+const maxUnclaimedBytes = 4 << 20
+
+// A request being worked on while resend is in use.
+type unansweredRequest struct {
+	// The unique ID with which to answer it.
+	latest uint64
+
+	// The value of Connection.resendEpoch when it arrived.
+	epoch uint64
+}
+
+// Record that a request with the given unique ID is being worked on.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) beginUnanswered(opCode uint32, unique uint64) {
+	if !c.resend || opCode == fusekernel.OpForget || opCode == fusekernel.OpBatchForget {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.unanswered == nil {
+		c.unanswered = make(map[uint64]unansweredRequest)
+	}
+
+	c.unanswered[unique&^fusekernel.UniqueResend] = unansweredRequest{
+		latest: unique,
+		epoch:  c.resendEpoch,
+	}
+}
+
+// If the message is a copy of a request sent again that we have already seen,
+// deal with it and return true. Otherwise the request should be served.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) absorbResent(inMsg *buffer.InMessage) bool {
+	unique := inMsg.Header().Unique
+	if !c.resend || unique&fusekernel.UniqueResend == 0 {
+		return false
+	}
+
+	base := unique &^ fusekernel.UniqueResend
+
+	c.mu.Lock()
+	answer, rejected := c.unclaimed[base]
+	if rejected {
+		delete(c.unclaimed, base)
+		c.unclaimedBytes -= len(answer)
+	}
+
+	req, working := c.unanswered[base]
+	if working {
+		req.latest = unique
+		c.unanswered[base] = req
+	}
+	c.mu.Unlock()
+
+	switch {
+	case rejected:
+		if c.debugLogger != nil {
+			c.debugLog(unique, 1, "<- resent; answering again")
+		}
+
+		(*fusekernel.OutHeader)(unsafe.Pointer(&answer[0])).Unique = unique
+		if err := c.writeMessage(answer); err != nil && c.errorLogger != nil {
+			c.errorLogger.Printf("Answering resent request: %v", err)
+		}
+
+		return true
+
+	case working:
+		if c.debugLogger != nil {
+			c.debugLog(unique, 1, "<- resent; already in progress")
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Send the answer to a request that was recorded with beginUnanswered, using
+// its latest ID. If the kernel rejects it after we have asked for requests to
+// be sent again, it may be because the request is queued to be sent, so keep
+// the answer to send when the request arrives.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) sendAnswer(
+	outMsg *buffer.OutMessage,
+	unique uint64) error {
+	base := unique &^ fusekernel.UniqueResend
+
+	c.mu.Lock()
+	req, ok := c.unanswered[base]
+	c.mu.Unlock()
+
+	if !ok {
+		return c.writeOutMessage(outMsg)
+	}
+
+	latest := req.latest
+	for {
+		outMsg.OutHeader().Unique = latest
+		err := c.writeOutMessage(outMsg)
+
+		c.mu.Lock()
+		if err == syscall.ENOENT && c.unanswered[base].latest != latest {
+			// The request arrived again while we were answering.
+			latest = c.unanswered[base].latest
+			c.mu.Unlock()
+			continue
+		}
+
+		delete(c.unanswered, base)
+		if err == syscall.ENOENT && c.resendEpoch != req.epoch && c.stashAnswerLocked(base, outMsg) {
+			err = nil
+		}
+		c.mu.Unlock()
+
+		return err
+	}
+}
+
+// Keep a rejected answer, dropping the oldest kept answers to make room.
+// Return false if it is too large to keep at all.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) stashAnswerLocked(base uint64, outMsg *buffer.OutMessage) bool {
+	var answer []byte
+	if outMsg.Sglist == nil {
+		answer = append(answer, outMsg.OutHeaderBytes()...)
+	} else {
+		for _, b := range outMsg.Sglist {
+			answer = append(answer, b...)
+		}
+	}
+
+	if len(answer) > maxUnclaimedBytes {
+		return false
+	}
+
+	// Answers that have been claimed are still in the order, but not in the
+	// map.
+	for c.unclaimedBytes+len(answer) > maxUnclaimedBytes {
+		oldest := c.unclaimedOrder[0]
+		c.unclaimedOrder = c.unclaimedOrder[1:]
+		c.unclaimedBytes -= len(c.unclaimed[oldest])
+		delete(c.unclaimed, oldest)
+	}
+
+	if c.unclaimed == nil {
+		c.unclaimed = make(map[uint64][]byte)
+	}
+
+	c.unclaimed[base] = answer
+	c.unclaimedOrder = append(c.unclaimedOrder, base)
+	c.unclaimedBytes += len(answer)
+	return true
+}
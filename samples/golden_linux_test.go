@@ -0,0 +1,504 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package samples_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/hellofs"
+	"github.com/jacobsa/fuse/samples/memfs"
+	"github.com/jacobsa/timeutil"
+)
+
+// The golden traces in testdata record, for a scripted workload against each
+// sample, the ops the connection layer hands to the file system and the
+// replies the kernel gets back. A change in either shows up as a diff; if
+// the change is intended, regenerate the traces with:
+//
+//	go test ./samples -run Golden -update
+var update = flag.Bool("update", false, "rewrite the golden traces in testdata")
+
+////////////////////////////////////////////////////////////////////////
+// Trace recording
+////////////////////////////////////////////////////////////////////////
+
+// Collects debug log lines and kernel-side notes, in order.
+type trace struct {
+	mu    sync.Mutex
+	lines []string // GUARDED_BY(mu)
+}
+
+// Receive debug log output, dropping the op ID and file:line prefix, which
+// change with unrelated edits.
+func (tr *trace) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if i := strings.Index(line, "] "); i >= 0 {
+			line = line[i+2:]
+		}
+
+		tr.add("fs     " + line)
+	}
+
+	return len(p), nil
+}
+
+func (tr *trace) add(line string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.lines = append(tr.lines, line)
+}
+
+func (tr *trace) String() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return strings.Join(tr.lines, "\n") + "\n"
+}
+
+// A stand-in for the kernel that sends one request at a time over a socket
+// and waits for its reply, so the trace is deterministic.
+type fakeKernel struct {
+	t      *testing.T
+	f      *os.File
+	trace  *trace
+	unique uint64
+}
+
+func startKernel(t *testing.T, server fuse.Server) (*fakeKernel, *fuse.MountedFileSystem) {
+	// Sequenced packets preserve message boundaries, like the fuse device.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	k := &fakeKernel{
+		t:     t,
+		f:     os.NewFile(uintptr(fds[0]), "kernel"),
+		trace: &trace{},
+	}
+
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+
+	// The init request must be waiting before the connection is set up.
+	k.send(fusekernel.OpInit, 0, fusekernel.InitIn{
+		Major:        7,
+		Minor:        31,
+		MaxReadahead: 1 << 17,
+		Flags:        uint32(fusekernel.InitAsyncRead | fusekernel.InitBigWrites | fusekernel.InitWritebackCache),
+	})
+
+	cfg := &fuse.MountConfig{
+		DebugLogger: log.New(k.trace, "", 0),
+	}
+
+	mfs, err := fuse.ServeDevice("/mnt", dev, server, cfg)
+	if err != nil {
+		t.Fatalf("ServeDevice: %v", err)
+	}
+
+	if out := k.receive("INIT"); out != nil {
+		init := (*fusekernel.InitOut)(unsafe.Pointer(&out[0]))
+		k.note("INIT %d.%d, flags %v, max_write %d",
+			init.Major,
+			init.Minor,
+			fusekernel.InitFlags(init.Flags),
+			init.MaxWrite)
+	}
+
+	return k, mfs
+}
+
+func (k *fakeKernel) note(format string, v ...interface{}) {
+	k.trace.add("kernel " + fmt.Sprintf(format, v...))
+}
+
+// Send a request. Each argument is a string, which is sent NUL-terminated,
+// a byte slice, which is sent as is, or a fixed-size struct.
+func (k *fakeKernel) send(opcode uint32, node uint64, args ...interface{}) {
+	k.t.Helper()
+
+	var body bytes.Buffer
+	for _, a := range args {
+		switch a := a.(type) {
+		case string:
+			body.WriteString(a)
+			body.WriteByte(0)
+
+		case []byte:
+			body.Write(a)
+
+		default:
+			if err := binary.Write(&body, binary.LittleEndian, a); err != nil {
+				k.t.Fatalf("binary.Write(%T): %v", a, err)
+			}
+		}
+	}
+
+	k.unique++
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + body.Len()),
+		Opcode: opcode,
+		Unique: k.unique,
+		Nodeid: node,
+	})
+	msg.Write(body.Bytes())
+
+	if _, err := k.f.Write(msg.Bytes()); err != nil {
+		k.t.Fatalf("Write: %v", err)
+	}
+}
+
+// Wait for the reply to the last request and return its payload, or nil if
+// it failed, noting the failure in the trace.
+func (k *fakeKernel) receive(desc string) []byte {
+	k.t.Helper()
+
+	buf := make([]byte, 1<<20)
+	n, err := k.f.Read(buf)
+	if err != nil {
+		k.t.Fatalf("Read: %v", err)
+	}
+
+	var h fusekernel.OutHeader
+	binary.Read(bytes.NewReader(buf[:n]), binary.LittleEndian, &h)
+	if h.Unique != k.unique {
+		k.t.Fatalf("%s: reply to request %d, want %d", desc, h.Unique, k.unique)
+	}
+
+	if h.Error != 0 {
+		k.note("%s: %v", desc, syscall.Errno(-h.Error))
+		return nil
+	}
+
+	return buf[unsafe.Sizeof(h):n]
+}
+
+func (k *fakeKernel) call(desc string, opcode uint32, node uint64, args ...interface{}) []byte {
+	k.t.Helper()
+	k.send(opcode, node, args...)
+	return k.receive(desc)
+}
+
+func (k *fakeKernel) noteAttr(desc string, node uint64, attr *fusekernel.Attr) {
+	k.note("%s: inode %d, mode %v, size %d, nlink %d",
+		desc,
+		node,
+		os.FileMode(attr.Mode&0777)|modeType(attr.Mode),
+		attr.Size,
+		attr.Nlink)
+}
+
+func modeType(mode uint32) os.FileMode {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		return os.ModeDir
+	case syscall.S_IFLNK:
+		return os.ModeSymlink
+	}
+
+	return 0
+}
+
+// Record an entry reply and return its inode.
+func (k *fakeKernel) entry(desc string, out []byte) uint64 {
+	if out == nil {
+		return 0
+	}
+
+	e := (*fusekernel.EntryOut)(unsafe.Pointer(&out[0]))
+	k.noteAttr(desc, e.Nodeid, &e.Attr)
+	return e.Nodeid
+}
+
+////////////////////////////////////////////////////////////////////////
+// Requests
+////////////////////////////////////////////////////////////////////////
+
+func (k *fakeKernel) lookUp(parent uint64, name string) uint64 {
+	desc := fmt.Sprintf("LOOKUP %q", name)
+	return k.entry(desc, k.call(desc, fusekernel.OpLookup, parent, name))
+}
+
+func (k *fakeKernel) getattr(node uint64) {
+	out := k.call("GETATTR", fusekernel.OpGetattr, node, [16]byte{})
+	if out != nil {
+		a := (*fusekernel.AttrOut)(unsafe.Pointer(&out[0]))
+		k.noteAttr("GETATTR", node, &a.Attr)
+	}
+}
+
+func (k *fakeKernel) mkdir(parent uint64, name string) uint64 {
+	desc := fmt.Sprintf("MKDIR %q", name)
+	in := fusekernel.MkdirIn{Mode: syscall.S_IFDIR | 0755, Umask: 022}
+	return k.entry(desc, k.call(desc, fusekernel.OpMkdir, parent, in, name))
+}
+
+// Return the new inode and handle.
+func (k *fakeKernel) create(parent uint64, name string) (uint64, uint64) {
+	desc := fmt.Sprintf("CREATE %q", name)
+	in := fusekernel.CreateIn{
+		Flags: syscall.O_RDWR,
+		Mode:  syscall.S_IFREG | 0644,
+		Umask: 022,
+	}
+
+	out := k.call(desc, fusekernel.OpCreate, parent, in, name)
+	if out == nil {
+		return 0, 0
+	}
+
+	node := k.entry(desc, out)
+	open := (*fusekernel.OpenOut)(unsafe.Pointer(&out[unsafe.Sizeof(fusekernel.EntryOut{})]))
+	k.note("%s: handle %d", desc, open.Fh)
+	return node, open.Fh
+}
+
+func (k *fakeKernel) open(opcode uint32, node uint64) uint64 {
+	desc := "OPEN"
+	if opcode == fusekernel.OpOpendir {
+		desc = "OPENDIR"
+	}
+
+	out := k.call(desc, opcode, node, fusekernel.OpenIn{Flags: syscall.O_RDONLY})
+	if out == nil {
+		return 0
+	}
+
+	open := (*fusekernel.OpenOut)(unsafe.Pointer(&out[0]))
+	k.note("%s: inode %d, handle %d", desc, node, open.Fh)
+	return open.Fh
+}
+
+func (k *fakeKernel) release(opcode uint32, node, handle uint64) {
+	desc := "RELEASE"
+	if opcode == fusekernel.OpReleasedir {
+		desc = "RELEASEDIR"
+	}
+
+	if k.call(desc, opcode, node, fusekernel.ReleaseIn{Fh: handle}, uint32(0)) != nil {
+		k.note("%s: handle %d", desc, handle)
+	}
+}
+
+func (k *fakeKernel) read(node, handle, offset uint64, size uint32) {
+	in := fusekernel.ReadIn{Fh: handle, Offset: offset, Size: size}
+	if out := k.call("READ", fusekernel.OpRead, node, in); out != nil {
+		k.note("READ: offset %d, %q", offset, out)
+	}
+}
+
+func (k *fakeKernel) write(node, handle, offset uint64, data string) {
+	in := fusekernel.WriteIn{Fh: handle, Offset: offset, Size: uint32(len(data))}
+	if out := k.call("WRITE", fusekernel.OpWrite, node, in, []byte(data)); out != nil {
+		w := (*fusekernel.WriteOut)(unsafe.Pointer(&out[0]))
+		k.note("WRITE: offset %d, %d bytes", offset, w.Size)
+	}
+}
+
+func (k *fakeKernel) readdir(node, handle uint64) {
+	in := fusekernel.ReadIn{Fh: handle, Size: 4096}
+	out := k.call("READDIR", fusekernel.OpReaddir, node, in)
+	if out == nil {
+		return
+	}
+
+	var names []string
+	for len(out) >= fusekernel.DirentSize {
+		d := (*fusekernel.Dirent)(unsafe.Pointer(&out[0]))
+		name := out[fusekernel.DirentSize : fusekernel.DirentSize+int(d.Namelen)]
+		names = append(names, fmt.Sprintf("%s=%d", name, d.Ino))
+
+		n := (fusekernel.DirentSize + int(d.Namelen) + 7) &^ 7
+		if n > len(out) {
+			break
+		}
+
+		out = out[n:]
+	}
+
+	if len(names) == 0 {
+		names = append(names, "(empty)")
+	}
+
+	k.note("READDIR: %s", strings.Join(names, " "))
+}
+
+func (k *fakeKernel) unlink(opcode uint32, parent uint64, name string) {
+	desc := fmt.Sprintf("UNLINK %q", name)
+	if opcode == fusekernel.OpRmdir {
+		desc = fmt.Sprintf("RMDIR %q", name)
+	}
+
+	if k.call(desc, opcode, parent, name) != nil {
+		k.note("%s: OK", desc)
+	}
+}
+
+func (k *fakeKernel) rename(oldParent uint64, oldName string, newParent uint64, newName string) {
+	desc := fmt.Sprintf("RENAME %q %q", oldName, newName)
+	in := fusekernel.RenameIn{Newdir: newParent}
+	if k.call(desc, fusekernel.OpRename, oldParent, in, oldName, newName) != nil {
+		k.note("%s: OK", desc)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Golden comparison
+////////////////////////////////////////////////////////////////////////
+
+// Hang up and wait for the server to finish, then compare the trace with the
+// named golden file, or rewrite the file if -update is set.
+func checkGolden(
+	t *testing.T,
+	name string,
+	k *fakeKernel,
+	mfs *fuse.MountedFileSystem) {
+	t.Helper()
+
+	k.f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	got := k.trace.String()
+	path := filepath.Join("testdata", name+".golden")
+
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got == string(want) {
+		return
+	}
+
+	gotLines := strings.Split(got, "\n")
+	wantLines := strings.Split(string(want), "\n")
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+
+		if g != w {
+			t.Fatalf(
+				"Trace differs from %s at line %d:\n got: %s\nwant: %s\n\nFull trace:\n%s",
+				path, i+1, g, w, got)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Workloads
+////////////////////////////////////////////////////////////////////////
+
+func TestGoldenHelloFS(t *testing.T) {
+	server, err := hellofs.NewHelloFS(&timeutil.SimulatedClock{})
+	if err != nil {
+		t.Fatalf("NewHelloFS: %v", err)
+	}
+
+	k, mfs := startKernel(t, server)
+
+	// List the root.
+	k.getattr(1)
+	dh := k.open(fusekernel.OpOpendir, 1)
+	k.readdir(1, dh)
+	k.release(fusekernel.OpReleasedir, 1, dh)
+
+	// Read a file.
+	hello := k.lookUp(1, "hello")
+	k.getattr(hello)
+	fh := k.open(fusekernel.OpOpen, hello)
+	k.read(hello, fh, 0, 4096)
+	k.read(hello, fh, 7, 4096)
+	k.release(fusekernel.OpRelease, hello, fh)
+
+	// Walk into a directory, and miss.
+	dir := k.lookUp(1, "dir")
+	k.lookUp(dir, "world")
+	k.lookUp(1, "missing")
+
+	// Try something the file system doesn't support.
+	k.mkdir(1, "new")
+
+	checkGolden(t, "hellofs", k, mfs)
+}
+
+func TestGoldenMemFS(t *testing.T) {
+	k, mfs := startKernel(t, memfs.NewMemFS(0, 0))
+
+	// Make a directory holding a file with some contents.
+	dir := k.mkdir(1, "dir")
+	foo, fh := k.create(dir, "foo")
+	k.write(foo, fh, 0, "taco")
+	k.write(foo, fh, 4, "burrito")
+	k.read(foo, fh, 2, 4096)
+	k.release(fusekernel.OpRelease, foo, fh)
+	k.getattr(foo)
+
+	// Creating it again fails.
+	k.create(dir, "foo")
+
+	// Its directory can't be removed while it's there.
+	k.unlink(fusekernel.OpRmdir, 1, "dir")
+
+	// Move it to the root and list both directories.
+	k.rename(dir, "foo", 1, "bar")
+	for _, node := range []uint64{1, dir} {
+		dh := k.open(fusekernel.OpOpendir, node)
+		k.readdir(node, dh)
+		k.release(fusekernel.OpReleasedir, node, dh)
+	}
+
+	// Tear it all down.
+	k.unlink(fusekernel.OpUnlink, 1, "bar")
+	k.unlink(fusekernel.OpRmdir, 1, "dir")
+	k.lookUp(1, "bar")
+
+	checkGolden(t, "memfs", k, mfs)
+}
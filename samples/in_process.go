@@ -128,6 +128,12 @@ func (t *SampleTest) destroy() (err error) {
 		return nil
 	}
 
+	// Let ops still in flight from the test finish, so that unmounting
+	// doesn't find the file system busy.
+	if err := t.mfs.WaitForQuiescence(t.Ctx); err != nil {
+		return fmt.Errorf("WaitForQuiescence: %v", err)
+	}
+
 	// Unmount the file system.
 	if err := unmount(t.Dir); err != nil {
 		return fmt.Errorf("unmount: %v", err)
@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestCopyFileRange(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(0, 0, nil, nil)
+
+	create := func(name, contents string) fuseops.InodeID {
+		op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: name, Mode: 0600}
+		if err := fs.CreateFile(ctx, op); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+
+		write := &fuseops.WriteFileOp{Inode: op.Entry.Child, Data: []byte(contents)}
+		if err := fs.WriteFile(ctx, write); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		return op.Entry.Child
+	}
+
+	src := create("src", "tacoburrito")
+	dst := create("dst", "enchilada")
+
+	testCases := []struct {
+		in, out     fuseops.InodeID
+		inOffset    uint64
+		outOffset   uint64
+		length      uint64
+		wantCopied  uint64
+		wantContent string
+	}{
+		{src, dst, 4, 2, 3, 3, "enburlada"},
+
+		// The copy stops at the end of the input.
+		{src, dst, 8, 9, 100, 3, "enburladaito"},
+		{src, dst, 11, 0, 100, 0, "enburladaito"},
+
+		// The ranges may overlap within a file.
+		{dst, dst, 0, 2, 4, 4, "enenbuadaito"},
+	}
+
+	for i, tc := range testCases {
+		op := &fuseops.CopyFileRangeOp{
+			InputInode:   tc.in,
+			InputOffset:  tc.inOffset,
+			OutputInode:  tc.out,
+			OutputOffset: tc.outOffset,
+			Length:       tc.length,
+		}
+
+		if err := fs.CopyFileRange(ctx, op); err != nil {
+			t.Fatalf("Case %d: CopyFileRange: %v", i, err)
+		}
+
+		if op.BytesCopied != tc.wantCopied {
+			t.Errorf("Case %d: copied %d, want %d", i, op.BytesCopied, tc.wantCopied)
+		}
+
+		contents := &fs.getInodeOrDie(dst).contents
+		buf := make([]byte, contents.Size())
+		contents.ReadAt(buf, 0)
+		if got := string(buf); got != tc.wantContent {
+			t.Errorf("Case %d: contents %q, want %q", i, got, tc.wantContent)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestFallocateModes(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(0, 0, nil, nil)
+
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "f", Mode: 0600}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	in := create.Entry.Child
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: in, Data: []byte("tacoburrito")}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	testCases := []struct {
+		mode   fuseops.FallocateMode
+		offset uint64
+		length uint64
+		want   string
+		err    error
+	}{
+		// Punching a hole zeroes the range without changing the size.
+		{fuseops.FallocatePunchHole | fuseops.FallocateKeepSize, 2, 4, "ta\x00\x00\x00\x00rrito", nil},
+		{fuseops.FallocatePunchHole | fuseops.FallocateKeepSize, 9, 10, "ta\x00\x00\x00\x00rri\x00\x00", nil},
+
+		// Preallocating past the end extends the file unless told not to.
+		{fuseops.FallocateKeepSize, 0, 20, "ta\x00\x00\x00\x00rri\x00\x00", nil},
+		{0, 11, 2, "ta\x00\x00\x00\x00rri\x00\x00\x00\x00", nil},
+
+		// As does zeroing.
+		{fuseops.FallocateZeroRange, 6, 8, "ta\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", nil},
+
+		// The kernel won't let a hole be punched without KeepSize.
+		{fuseops.FallocatePunchHole, 0, 1, "ta\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", syscall.EOPNOTSUPP},
+	}
+
+	for _, tc := range testCases {
+		err := fs.Fallocate(ctx, &fuseops.FallocateOp{
+			Inode:  in,
+			Offset: tc.offset,
+			Length: tc.length,
+			Mode:   tc.mode,
+		})
+
+		if err != tc.err {
+			t.Errorf("%v: got error %v, want %v", tc.mode, err, tc.err)
+		}
+
+		read := &fuseops.ReadFileOp{Inode: in, Dst: make([]byte, 64)}
+		if err := fs.ReadFile(ctx, read); err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+
+		if got := string(read.Dst[:read.BytesRead]); got != tc.want {
+			t.Errorf("%v %d+%d: contents %q, want %q", tc.mode, tc.offset, tc.length, got, tc.want)
+		}
+	}
+}
@@ -16,12 +16,10 @@ package memfs
 
 import (
 	"fmt"
-	"io"
 	"io/fs"
 	"os"
 	"time"
 
-	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 )
@@ -42,7 +40,7 @@ type inode struct {
 	//
 	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink) == 0
 	// INVARIANT: !(isDir() && isSymlink())
-	// INVARIANT: attrs.Size == len(contents)
+	// INVARIANT: attrs.Size == contents.Size()
 	attrs fuseops.InodeAttributes
 
 	// For directories, entries describing the children of the directory. Unused
@@ -58,10 +56,10 @@ type inode struct {
 	// INVARIANT: Contains no duplicate names in used entries.
 	entries []fuseutil.Dirent
 
-	// For files, the current contents of the file.
+	// For files, the current contents of the file, which may have holes.
 	//
-	// INVARIANT: If !isFile(), len(contents) == 0
-	contents []byte
+	// INVARIANT: If !isFile(), contents.Size() == 0
+	contents fuseutil.SparseFile
 
 	// For symlinks, the target of the symlink.
 	//
@@ -103,12 +101,12 @@ func (in *inode) CheckInvariants() {
 		panic(fmt.Sprintf("Unexpected mode: %v", in.attrs.Mode))
 	}
 
-	// INVARIANT: attrs.Size == len(contents)
-	if in.attrs.Size != uint64(len(in.contents)) {
+	// INVARIANT: attrs.Size == contents.Size()
+	if in.attrs.Size != in.contents.Size() {
 		panic(fmt.Sprintf(
 			"Size mismatch: %d vs. %d",
 			in.attrs.Size,
-			len(in.contents)))
+			in.contents.Size()))
 	}
 
 	// INVARIANT: If !isDir(), len(entries) == 0
@@ -135,9 +133,9 @@ func (in *inode) CheckInvariants() {
 		}
 	}
 
-	// INVARIANT: If !isFile(), len(contents) == 0
-	if !in.isFile() && len(in.contents) != 0 {
-		panic(fmt.Sprintf("Unexpected length: %d", len(in.contents)))
+	// INVARIANT: If !isFile(), contents.Size() == 0
+	if !in.isFile() && in.contents.Size() != 0 {
+		panic(fmt.Sprintf("Unexpected length: %d", in.contents.Size()))
 	}
 
 	// INVARIANT: If !isSymlink(), len(target) == 0
@@ -308,18 +306,7 @@ func (in *inode) ReadAt(p []byte, off int64) (int, error) {
 		panic("ReadAt called on non-file.")
 	}
 
-	// Ensure the offset is in range.
-	if off > int64(len(in.contents)) {
-		return 0, io.EOF
-	}
-
-	// Read what we can.
-	n := copy(p, in.contents[off:])
-	if n < len(p) {
-		return n, io.EOF
-	}
-
-	return n, nil
+	return in.contents.ReadAt(p, off)
 }
 
 // Write to the file's contents. See documentation for ioutil.WriterAt.
@@ -333,16 +320,13 @@ func (in *inode) WriteAt(p []byte, off int64) (int, error) {
 	// Update the modification time.
 	in.attrs.Mtime = time.Now()
 
-	// Ensure that the contents slice is long enough.
-	newLen := int(off) + len(p)
-	if len(in.contents) < newLen {
-		padding := make([]byte, newLen-len(in.contents))
-		in.contents = append(in.contents, padding...)
-		in.attrs.Size = uint64(newLen)
+	// Copy in the data, growing the file if need be.
+	n, err := in.contents.WriteAt(p, off)
+	if err != nil {
+		return n, err
 	}
 
-	// Copy in the data.
-	n := copy(in.contents[off:], p)
+	in.attrs.Size = in.contents.Size()
 
 	// Sanity check.
 	if n != len(p) {
@@ -356,21 +340,15 @@ func (in *inode) WriteAt(p []byte, off int64) (int, error) {
 func (in *inode) SetAttributes(
 	size *uint64,
 	mode *os.FileMode,
-	mtime *time.Time) {
+	mtime *time.Time,
+	ctime *time.Time) {
 	// Update the modification time.
 	in.attrs.Mtime = time.Now()
 
 	// Truncate?
 	if size != nil {
-		intSize := int(*size)
-
 		// Update contents.
-		if intSize <= len(in.contents) {
-			in.contents = in.contents[:intSize]
-		} else {
-			padding := make([]byte, intSize-len(in.contents))
-			in.contents = append(in.contents, padding...)
-		}
+		in.contents.Truncate(*size)
 
 		// Update attributes.
 		in.attrs.Size = *size
@@ -386,17 +364,29 @@ func (in *inode) SetAttributes(
 	if mtime != nil {
 		in.attrs.Mtime = *mtime
 	}
+
+	// Change ctime? The kernel sends it along with mtime under writeback
+	// caching.
+	if ctime != nil {
+		in.attrs.Ctime = *ctime
+	}
 }
 
-func (in *inode) Fallocate(mode uint32, offset uint64, length uint64) error {
-	if mode != 0 {
-		return fuse.ENOSYS
+func (in *inode) Fallocate(
+	mode fuseops.FallocateMode,
+	offset uint64,
+	length uint64) error {
+	size := in.contents.Size()
+	if err := in.contents.Fallocate(mode, offset, length); err != nil {
+		return err
 	}
-	newSize := int(offset + length)
-	if newSize > len(in.contents) {
-		padding := make([]byte, newSize-len(in.contents))
-		in.contents = append(in.contents, padding...)
-		in.attrs.Size = offset + length
+
+	in.attrs.Size = in.contents.Size()
+
+	// Only changes to what the file reads as count as modifications.
+	if in.attrs.Size != size || mode&(fuseops.FallocatePunchHole|fuseops.FallocateZeroRange) != 0 {
+		in.attrs.Mtime = time.Now()
 	}
+
 	return nil
 }
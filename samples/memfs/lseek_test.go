@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestLseek(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(0, 0, nil, nil)
+
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "foo", Mode: 0600}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	write := &fuseops.WriteFileOp{Inode: create.Entry.Child, Data: []byte("taco")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	testCases := []struct {
+		offset  uint64
+		whence  fuseops.SeekWhence
+		want    uint64
+		wantErr error
+	}{
+		{0, fuseops.SeekData, 0, nil},
+		{2, fuseops.SeekData, 2, nil},
+		{0, fuseops.SeekHole, 4, nil},
+		{3, fuseops.SeekHole, 4, nil},
+
+		// Offsets at or past the end find nothing.
+		{4, fuseops.SeekData, 0, syscall.ENXIO},
+		{4, fuseops.SeekHole, 0, syscall.ENXIO},
+	}
+
+	for _, tc := range testCases {
+		op := &fuseops.LseekOp{
+			Inode:  create.Entry.Child,
+			Offset: tc.offset,
+			Whence: tc.whence,
+		}
+
+		err := fs.Lseek(ctx, op)
+		if err != tc.wantErr {
+			t.Errorf("%v from %d: %v, want %v", tc.whence, tc.offset, err, tc.wantErr)
+			continue
+		}
+
+		if err == nil && op.ResultOffset != tc.want {
+			t.Errorf("%v from %d: %d, want %d", tc.whence, tc.offset, op.ResultOffset, tc.want)
+		}
+	}
+}
+
+func TestLseekHoles(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(0, 0, nil, nil)
+
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "foo", Mode: 0600}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	// Data at 0 and 1 MiB, with a hole between, and another punched in the
+	// first run.
+	in := create.Entry.Child
+	for _, off := range []int64{0, 1 << 20} {
+		write := &fuseops.WriteFileOp{Inode: in, Offset: off, Data: []byte("tacoburrito")}
+		if err := fs.WriteFile(ctx, write); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	punch := &fuseops.FallocateOp{
+		Inode:  in,
+		Offset: 4,
+		Length: 3,
+		Mode:   fuseops.FallocatePunchHole | fuseops.FallocateKeepSize,
+	}
+
+	if err := fs.Fallocate(ctx, punch); err != nil {
+		t.Fatalf("Fallocate: %v", err)
+	}
+
+	testCases := []struct {
+		offset uint64
+		whence fuseops.SeekWhence
+		want   uint64
+	}{
+		{0, fuseops.SeekHole, 4},
+		{4, fuseops.SeekData, 7},
+		{7, fuseops.SeekHole, 11},
+		{11, fuseops.SeekData, 1 << 20},
+		{1 << 20, fuseops.SeekHole, 1<<20 + 11},
+	}
+
+	for _, tc := range testCases {
+		op := &fuseops.LseekOp{Inode: in, Offset: tc.offset, Whence: tc.whence}
+		if err := fs.Lseek(ctx, op); err != nil || op.ResultOffset != tc.want {
+			t.Errorf("%v from %d: %d, %v, want %d", tc.whence, tc.offset, op.ResultOffset, err, tc.want)
+		}
+	}
+}
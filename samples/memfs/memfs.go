@@ -83,11 +83,29 @@ func NewMemFS(
 	return NewMemFSWithCallbacks(uid, gid, nil, nil)
 }
 
+// NewFileSystem is like NewMemFS, but returns the file system itself rather
+// than a server for it, so that it can also be used directly, e.g. with
+// fuseutil.WriteTar and fuseutil.ReadTar to save and restore its contents.
+func NewFileSystem(
+	uid uint32,
+	gid uint32) fuseutil.FileSystem {
+	return newMemFS(uid, gid, nil, nil)
+}
+
 func NewMemFSWithCallbacks(
 	uid uint32,
 	gid uint32,
 	readFileCallback func(),
 	writeFileCallback func()) fuse.Server {
+	return fuseutil.NewFileSystemServer(
+		newMemFS(uid, gid, readFileCallback, writeFileCallback))
+}
+
+func newMemFS(
+	uid uint32,
+	gid uint32,
+	readFileCallback func(),
+	writeFileCallback func()) *memFS {
 	// Set up the basic struct.
 	fs := &memFS{
 		inodes:            make([]*inode, fuseops.RootInodeID+1),
@@ -109,7 +127,7 @@ func NewMemFSWithCallbacks(
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
-	return fuseutil.NewFileSystemServer(fs)
+	return fs
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -210,6 +228,13 @@ func (fs *memFS) StatFS(
 	return nil
 }
 
+func (fs *memFS) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	// Everything lives in memory, so there is nothing to flush.
+	return nil
+}
+
 func (fs *memFS) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) error {
@@ -259,6 +284,20 @@ func (fs *memFS) GetInodeAttributes(
 	return nil
 }
 
+func (fs *memFS) Statx(
+	ctx context.Context,
+	op *fuseops.StatxOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Crtime is set at creation, so the birth time is known.
+	inode := fs.getInodeOrDie(op.Inode)
+	op.Attributes = inode.attrs
+	op.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+
+	return nil
+}
+
 func (fs *memFS) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) error {
@@ -276,7 +315,7 @@ func (fs *memFS) SetInodeAttributes(
 	inode := fs.getInodeOrDie(op.Inode)
 
 	// Handle the request.
-	inode.SetAttributes(op.Size, op.Mode, op.Mtime)
+	inode.SetAttributes(op.Size, op.Mode, op.Mtime, op.Ctime)
 
 	// Fill in the response.
 	op.Attributes = inode.attrs
@@ -337,15 +376,36 @@ func (fs *memFS) MkNode(
 	defer fs.mu.Unlock()
 
 	var err error
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, op.Rdev)
 	return err
 }
 
+// Return the type of directory entry for an inode with the given mode.
+func direntType(mode os.FileMode) fuseutil.DirentType {
+	switch mode & os.ModeType {
+	case os.ModeDir:
+		return fuseutil.DT_Directory
+	case os.ModeSymlink:
+		return fuseutil.DT_Link
+	case os.ModeDevice | os.ModeCharDevice:
+		return fuseutil.DT_Char
+	case os.ModeDevice:
+		return fuseutil.DT_Block
+	case os.ModeNamedPipe:
+		return fuseutil.DT_FIFO
+	case os.ModeSocket:
+		return fuseutil.DT_Socket
+	default:
+		return fuseutil.DT_File
+	}
+}
+
 // LOCKS_REQUIRED(fs.mu)
 func (fs *memFS) createFile(
 	parentID fuseops.InodeID,
 	name string,
-	mode os.FileMode) (fuseops.ChildInodeEntry, error) {
+	mode os.FileMode,
+	rdev uint32) (fuseops.ChildInodeEntry, error) {
 	// Grab the parent, which we will update shortly.
 	parent := fs.getInodeOrDie(parentID)
 
@@ -361,6 +421,7 @@ func (fs *memFS) createFile(
 	childAttrs := fuseops.InodeAttributes{
 		Nlink:  1,
 		Mode:   mode,
+		Rdev:   rdev,
 		Atime:  now,
 		Mtime:  now,
 		Ctime:  now,
@@ -372,8 +433,9 @@ func (fs *memFS) createFile(
 	// Allocate a child.
 	childID, child := fs.allocateInode(childAttrs, name)
 
-	// Add an entry in the parent.
-	parent.AddChild(childID, name, fuseutil.DT_File)
+	// Add an entry in the parent. Whiteouts are listed as the character
+	// devices they are.
+	parent.AddChild(childID, name, direntType(mode))
 
 	// Fill in the response entry.
 	var entry fuseops.ChildInodeEntry
@@ -394,10 +456,43 @@ func (fs *memFS) CreateFile(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, 0)
 	return err
 }
 
+func (fs *memFS) CreateTmpfile(
+	ctx context.Context,
+	op *fuseops.CreateTmpfileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Set up attributes for the file, which has no links until it is given a
+	// name with CreateLink.
+	now := time.Now()
+	attrs := fuseops.InodeAttributes{
+		Mode:   op.Mode,
+		Atime:  now,
+		Mtime:  now,
+		Ctime:  now,
+		Crtime: now,
+		Uid:    fs.uid,
+		Gid:    fs.gid,
+	}
+
+	childID, child := fs.allocateInode(attrs, "")
+
+	// The kernel drops the link it is told about.
+	op.Entry.Child = childID
+	op.Entry.Attributes = child.attrs
+	op.Entry.Attributes.Nlink = 1
+
+	// We don't spontaneously mutate, so the kernel can cache as long as it wants
+	// (since it also handles invalidation).
+	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+
+	return nil
+}
+
 func (fs *memFS) CreateSymlink(
 	ctx context.Context,
 	op *fuseops.CreateSymlinkOp) error {
@@ -501,10 +596,34 @@ func (fs *memFS) Rename(
 		return fuse.ENOENT
 	}
 
+	// We support swapping entries, and declining to replace them, but not
+	// whiteouts.
+	if op.Flags&^(fuseops.RenameNoReplace|fuseops.RenameExchange) != 0 {
+		return fuse.EINVAL
+	}
+
 	// If the new name exists already in the new parent, make sure it's not a
 	// non-empty directory, then delete it.
 	newParent := fs.getInodeOrDie(op.NewParent)
-	existingID, _, ok := newParent.LookUpChild(op.NewName)
+	existingID, existingType, ok := newParent.LookUpChild(op.NewName)
+
+	if op.Flags&fuseops.RenameExchange != 0 {
+		if !ok {
+			return fuse.ENOENT
+		}
+
+		oldParent.RemoveChild(op.OldName)
+		newParent.RemoveChild(op.NewName)
+		oldParent.AddChild(existingID, op.OldName, existingType)
+		newParent.AddChild(childID, op.NewName, childType)
+
+		return nil
+	}
+
+	if ok && op.Flags&fuseops.RenameNoReplace != 0 {
+		return fuse.EEXIST
+	}
+
 	if ok {
 		existing := fs.getInodeOrDie(existingID)
 
@@ -514,6 +633,9 @@ func (fs *memFS) Rename(
 		}
 
 		newParent.RemoveChild(op.NewName)
+
+		// Mark the existing child as unlinked.
+		existing.attrs.Nlink--
 	}
 
 	// Link the new name.
@@ -620,6 +742,45 @@ func (fs *memFS) ReadDir(
 	return nil
 }
 
+func (fs *memFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Grab the directory.
+	inode := fs.getInodeOrDie(op.Inode)
+
+	// Serve the request, with the same expiration as LookUpInode.
+	expiration := time.Now().Add(365 * 24 * time.Hour)
+	for i := int(op.Offset); i < len(inode.entries); i++ {
+		e := inode.entries[i]
+
+		// Skip unused entries.
+		if e.Type == fuseutil.DT_Unknown {
+			continue
+		}
+
+		n := fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], fuseutil.DirentPlus{
+			Dirent: e,
+			Entry: fuseops.ChildInodeEntry{
+				Child:                e.Inode,
+				Attributes:           fs.getInodeOrDie(e.Inode).attrs,
+				AttributesExpiration: expiration,
+				EntryExpiration:      expiration,
+			},
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
 func (fs *memFS) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) error {
@@ -693,6 +854,48 @@ func (fs *memFS) WriteFile(
 	return err
 }
 
+func (fs *memFS) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	inode := fs.getInodeOrDie(op.Inode)
+
+	var err error
+	op.ResultOffset, err = inode.contents.Seek(op.Offset, op.Whence)
+	return err
+}
+
+func (fs *memFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInodeOrDie(op.InputInode)
+	out := fs.getInodeOrDie(op.OutputInode)
+
+	// Copy what the input has of the range, through a buffer in case the
+	// ranges overlap.
+	size := in.contents.Size()
+	if op.InputOffset >= size {
+		return nil
+	}
+
+	length := op.Length
+	if length > size-op.InputOffset {
+		length = size - op.InputOffset
+	}
+
+	data := make([]byte, length)
+	in.contents.ReadAt(data, int64(op.InputOffset))
+
+	n, err := out.WriteAt(data, int64(op.OutputOffset))
+	op.BytesCopied = uint64(n)
+	return err
+}
+
 func (fs *memFS) FlushFile(
 	ctx context.Context,
 	op *fuseops.FlushFileOp) (err error) {
@@ -806,6 +1009,5 @@ func (fs *memFS) Fallocate(ctx context.Context,
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	inode := fs.getInodeOrDie(op.Inode)
-	inode.Fallocate(op.Mode, op.Offset, op.Length)
-	return nil
+	return inode.Fallocate(op.Mode, op.Offset, op.Length)
 }
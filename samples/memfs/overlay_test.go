@@ -0,0 +1,79 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// memfs can serve as an overlayfs lower layer, holding whiteouts and opaque
+// directories.
+func TestOverlayLowerLayer(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(0, 0, nil, nil)
+
+	mknod := &fuseops.MkNodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "gone",
+		Mode:   fuseops.WhiteoutMode,
+	}
+
+	if err := fs.MkNode(ctx, mknod); err != nil {
+		t.Fatalf("MkNode: %v", err)
+	}
+
+	if !mknod.Entry.Attributes.IsWhiteout() {
+		t.Errorf("Not a whiteout: %+v", mknod.Entry.Attributes)
+	}
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "gone"}
+	if err := fs.LookUpInode(ctx, lookUp); err != nil || !lookUp.Entry.Attributes.IsWhiteout() {
+		t.Errorf("LookUpInode: %v, %+v", err, lookUp.Entry.Attributes)
+	}
+
+	if _, typ, _ := fs.getInodeOrDie(fuseops.RootInodeID).LookUpChild("gone"); typ != fuseutil.DT_Char {
+		t.Errorf("Whiteout listed with type %v", typ)
+	}
+
+	// Directories are marked opaque with an extended attribute.
+	mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: 0700}
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	err := fs.SetXattr(ctx, &fuseops.SetXattrOp{
+		Inode: mkdir.Entry.Child,
+		Name:  fuseops.OverlayOpaqueXattr,
+		Value: []byte(fuseops.OverlayOpaqueValue),
+	})
+
+	if err != nil {
+		t.Fatalf("SetXattr: %v", err)
+	}
+
+	getXattr := &fuseops.GetXattrOp{
+		Inode: mkdir.Entry.Child,
+		Name:  fuseops.OverlayOpaqueXattr,
+		Dst:   make([]byte, 16),
+	}
+
+	if err := fs.GetXattr(ctx, getXattr); err != nil || string(getXattr.Dst[:getXattr.BytesRead]) != fuseops.OverlayOpaqueValue {
+		t.Errorf("GetXattr: %v, %q", err, getXattr.Dst[:getXattr.BytesRead])
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestRenameFlags(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(0, 0, nil, nil)
+
+	create := func(name string) fuseops.InodeID {
+		op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: name, Mode: 0600}
+		if err := fs.CreateFile(ctx, op); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+
+		return op.Entry.Child
+	}
+
+	lookUp := func(name string) fuseops.InodeID {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+		if err := fs.LookUpInode(ctx, op); err != nil {
+			return 0
+		}
+
+		return op.Entry.Child
+	}
+
+	rename := func(from, to string, flags fuseops.RenameFlags) error {
+		return fs.Rename(ctx, &fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   from,
+			NewParent: fuseops.RootInodeID,
+			NewName:   to,
+			Flags:     flags,
+		})
+	}
+
+	foo := create("foo")
+	bar := create("bar")
+
+	// Declining to replace.
+	if err := rename("foo", "bar", fuseops.RenameNoReplace); err != syscall.EEXIST {
+		t.Errorf("NoReplace onto existing: %v, want EEXIST", err)
+	}
+
+	if err := rename("foo", "baz", fuseops.RenameNoReplace); err != nil {
+		t.Errorf("NoReplace onto new name: %v", err)
+	}
+
+	if lookUp("baz") != foo || lookUp("foo") != 0 {
+		t.Errorf("NoReplace didn't move foo to baz")
+	}
+
+	// Swapping.
+	if err := rename("baz", "qux", fuseops.RenameExchange); err != syscall.ENOENT {
+		t.Errorf("Exchange with missing entry: %v, want ENOENT", err)
+	}
+
+	if err := rename("baz", "bar", fuseops.RenameExchange); err != nil {
+		t.Errorf("Exchange: %v", err)
+	}
+
+	if lookUp("baz") != bar || lookUp("bar") != foo {
+		t.Errorf("Exchange didn't swap baz and bar")
+	}
+
+	// Whiteouts aren't supported.
+	if err := rename("baz", "qux", fuseops.RenameWhiteout); err != syscall.EINVAL {
+		t.Errorf("Whiteout: %v, want EINVAL", err)
+	}
+}
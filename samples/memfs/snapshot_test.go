@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Read the headers and contents of an archive, leaving out access times,
+// which memfs doesn't let be set.
+func readArchive(t *testing.T, b []byte) ([]tar.Header, map[string]string) {
+	var hdrs []tar.Header
+	contents := make(map[string]string)
+
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return hdrs, contents
+		}
+
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+
+		hdr.AccessTime = time.Time{}
+		delete(hdr.PAXRecords, "atime")
+		hdrs = append(hdrs, *hdr)
+		contents[hdr.Name] = string(data)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(17, 19, nil, nil)
+	mtime := time.Date(2015, 3, 4, 5, 6, 7, 8, time.UTC)
+
+	mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir", Mode: os.ModeDir | 0750}
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	dir := mkdir.Entry.Child
+
+	// A file larger than a single read.
+	large := bytes.Repeat([]byte("taco"), 300000)
+	create := &fuseops.CreateFileOp{Parent: dir, Name: "large", Mode: 0640}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	file := create.Entry.Child
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: file, Data: large}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: file, Name: "user.flavor", Value: []byte("carnitas")}); err != nil {
+		t.Fatalf("SetXattr: %v", err)
+	}
+
+	if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: file, Mtime: &mtime}); err != nil {
+		t.Fatalf("SetInodeAttributes: %v", err)
+	}
+
+	if err := fs.CreateLink(ctx, &fuseops.CreateLinkOp{Parent: fuseops.RootInodeID, Name: "link", Target: file}); err != nil {
+		t.Fatalf("CreateLink: %v", err)
+	}
+
+	if err := fs.CreateSymlink(ctx, &fuseops.CreateSymlinkOp{Parent: dir, Name: "symlink", Target: "large"}); err != nil {
+		t.Fatalf("CreateSymlink: %v", err)
+	}
+
+	if err := fs.MkNode(ctx, &fuseops.MkNodeOp{Parent: fuseops.RootInodeID, Name: "fifo", Mode: os.ModeNamedPipe | 0600}); err != nil {
+		t.Fatalf("MkNode: %v", err)
+	}
+
+	if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: dir, Mtime: &mtime}); err != nil {
+		t.Fatalf("SetInodeAttributes: %v", err)
+	}
+
+	var saved bytes.Buffer
+	if err := fuseutil.WriteTar(ctx, fs, &saved); err != nil {
+		t.Fatalf("WriteTar: %v", err)
+	}
+
+	hdrs, contents := readArchive(t, saved.Bytes())
+
+	var names []string
+	for _, hdr := range hdrs {
+		names = append(names, hdr.Name)
+	}
+
+	wantNames := []string{"./", "dir/", "dir/large", "dir/symlink", "fifo", "link"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("Names: %q, want %q", names, wantNames)
+	}
+
+	if hdrs[2].Mode != 0640 || hdrs[2].Uid != 17 || hdrs[2].Gid != 19 || !hdrs[2].ModTime.Equal(mtime) {
+		t.Errorf("Header for dir/large: %+v", hdrs[2])
+	}
+
+	if contents["dir/large"] != string(large) {
+		t.Errorf("Contents of dir/large: %d bytes, want %d", len(contents["dir/large"]), len(large))
+	}
+
+	if got := hdrs[2].PAXRecords["SCHILY.xattr.user.flavor"]; got != "carnitas" {
+		t.Errorf("Xattr: %q", got)
+	}
+
+	if hdrs[3].Typeflag != tar.TypeSymlink || hdrs[3].Linkname != "large" {
+		t.Errorf("Header for dir/symlink: %+v", hdrs[3])
+	}
+
+	if hdrs[4].Typeflag != tar.TypeFifo {
+		t.Errorf("Header for fifo: %+v", hdrs[4])
+	}
+
+	if hdrs[5].Typeflag != tar.TypeLink || hdrs[5].Linkname != "dir/large" {
+		t.Errorf("Header for link: %+v", hdrs[5])
+	}
+
+	// Restoring into a new file system and saving that gives the same
+	// archive.
+	restored := newMemFS(17, 19, nil, nil)
+	if err := fuseutil.ReadTar(ctx, restored, bytes.NewReader(saved.Bytes())); err != nil {
+		t.Fatalf("ReadTar: %v", err)
+	}
+
+	var resaved bytes.Buffer
+	if err := fuseutil.WriteTar(ctx, restored, &resaved); err != nil {
+		t.Fatalf("WriteTar: %v", err)
+	}
+
+	gotHdrs, gotContents := readArchive(t, resaved.Bytes())
+	if !reflect.DeepEqual(gotHdrs, hdrs) {
+		t.Errorf("Restored headers:\n%+v\nwant:\n%+v", gotHdrs, hdrs)
+	}
+
+	if !reflect.DeepEqual(gotContents, contents) {
+		t.Errorf("Restored contents differ")
+	}
+}
+
+func TestSnapshotRejectsEscapingNames(t *testing.T) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0600}); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := fuseutil.ReadTar(context.Background(), newMemFS(0, 0, nil, nil), &b); err == nil {
+		t.Errorf("ReadTar succeeded")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestCreateTmpfile(t *testing.T) {
+	ctx := context.Background()
+	fs := newMemFS(0, 0, nil, nil)
+
+	tmp := &fuseops.CreateTmpfileOp{Parent: fuseops.RootInodeID, Mode: 0600}
+	if err := fs.CreateTmpfile(ctx, tmp); err != nil {
+		t.Fatalf("CreateTmpfile: %v", err)
+	}
+
+	if n := tmp.Entry.Attributes.Nlink; n != 1 {
+		t.Errorf("Reported Nlink = %d, want 1", n)
+	}
+
+	// The file has no name, and no links of its own.
+	var buf [4096]byte
+	if n := fs.getInodeOrDie(fuseops.RootInodeID).ReadDir(buf[:], 0); n != 0 {
+		t.Errorf("Root lists %d bytes of entries", n)
+	}
+
+	getAttrs := &fuseops.GetInodeAttributesOp{Inode: tmp.Entry.Child}
+	if err := fs.GetInodeAttributes(ctx, getAttrs); err != nil {
+		t.Fatalf("GetInodeAttributes: %v", err)
+	}
+
+	if n := getAttrs.Attributes.Nlink; n != 0 {
+		t.Errorf("Nlink = %d, want 0", n)
+	}
+
+	write := &fuseops.WriteFileOp{Inode: tmp.Entry.Child, Data: []byte("taco")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// Give it a name, as linkat(2) with AT_EMPTY_PATH does.
+	link := &fuseops.CreateLinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Target: tmp.Entry.Child,
+	}
+
+	if err := fs.CreateLink(ctx, link); err != nil {
+		t.Fatalf("CreateLink: %v", err)
+	}
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "foo"}
+	if err := fs.LookUpInode(ctx, lookUp); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if lookUp.Entry.Child != tmp.Entry.Child {
+		t.Errorf("foo is inode %d, want %d", lookUp.Entry.Child, tmp.Entry.Child)
+	}
+
+	if a := lookUp.Entry.Attributes; a.Nlink != 1 || a.Size != 4 {
+		t.Errorf("Nlink = %d and Size = %d, want 1 and 4", a.Nlink, a.Size)
+	}
+}
@@ -16,16 +16,56 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
+	"os"
 	"os/user"
 	"strconv"
 
 	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/fuse/samples/memfs"
 )
 
 var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
+var fSnapshot = flag.String("snapshot", "", "Path to a tar archive to restore the file system from, if it exists, and to save it to once unmounted.")
+
+// Restore the file system from the snapshot, if there is one.
+func restore(fs fuseutil.FileSystem) error {
+	f, err := os.Open(*fSnapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	return fuseutil.ReadTar(context.Background(), fs, f)
+}
+
+// Save the file system to the snapshot, replacing it only once the new one
+// is complete.
+func save(fs fuseutil.FileSystem) error {
+	tmp := *fSnapshot + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := fuseutil.WriteTar(context.Background(), fs, f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, *fSnapshot)
+}
 
 func main() {
 	flag.Parse()
@@ -49,7 +89,14 @@ func main() {
 		panic(err)
 	}
 
-	server := memfs.NewMemFS(uint32(uid), uint32(gid))
+	fs := memfs.NewFileSystem(uint32(uid), uint32(gid))
+	if *fSnapshot != "" {
+		if err := restore(fs); err != nil {
+			log.Fatalf("Restoring %s: %v", *fSnapshot, err)
+		}
+	}
+
+	server := fuseutil.NewFileSystemServer(fs)
 
 	cfg := &fuse.MountConfig{
 		// Disable writeback caching so that pid is always available in OpContext
@@ -65,4 +112,10 @@ func main() {
 	if err = mfs.Join(context.Background()); err != nil {
 		log.Fatalf("Join: %v", err)
 	}
+
+	if *fSnapshot != "" {
+		if err := save(fs); err != nil {
+			log.Fatalf("Saving %s: %v", *fSnapshot, err)
+		}
+	}
 }
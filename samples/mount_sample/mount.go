@@ -41,6 +41,7 @@ var fFsyncError = flag.Int("flushfs.fsync_error", 0, "")
 
 var fReadOnly = flag.Bool("read_only", false, "Mount in read-only mode.")
 var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+var fDisableKernelCaching = flag.Bool("disable_kernel_caching", false, "Send every lookup and stat to the file system.")
 
 func makeFlushFS() (fuse.Server, error) {
 	// Check the flags.
@@ -128,7 +129,8 @@ func main() {
 	}
 
 	cfg := &fuse.MountConfig{
-		ReadOnly: *fReadOnly,
+		ReadOnly:             *fReadOnly,
+		DisableKernelCaching: *fDisableKernelCaching,
 	}
 
 	if *fDebug {
@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A command that soaks a FUSE file system with a mixed workload for a long
+// time, watching for leaks and stuck operations. By default it mounts memfs
+// in process; to soak another file system, mount it yourself and pass
+// --dir, along with --pid to watch the process serving it:
+//
+//	soak --dir /mnt/foo --pid $(pgrep foofs) --duration 12h
+//
+// The exit status is non-zero if anything was found.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+var fDir = flag.String("dir", "", "A directory in a mounted file system to soak. If unset, memfs is mounted on a temporary directory.")
+var fPID = flag.Int("pid", 0, "The process serving the file system in --dir, to watch.")
+var fDuration = flag.Duration("duration", time.Hour, "How long to run for.")
+var fWorkers = flag.Int("workers", 8, "The number of concurrent workers.")
+var fSampleInterval = flag.Duration("sample_interval", time.Minute, "How often to sample resource usage.")
+var fStuckTimeout = flag.Duration("stuck_timeout", time.Minute, "How long before an operation counts as stuck.")
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	cfg := fusetesting.SoakConfig{
+		Dir:            *fDir,
+		Duration:       *fDuration,
+		Workers:        *fWorkers,
+		SampleInterval: *fSampleInterval,
+		StuckTimeout:   *fStuckTimeout,
+		PID:            *fPID,
+		Logger:         log.New(os.Stderr, "soak: ", 0),
+	}
+
+	if cfg.Dir == "" {
+		dir, err := ioutil.TempDir("", "soak")
+		if err != nil {
+			return fmt.Errorf("TempDir: %v", err)
+		}
+
+		defer os.Remove(dir)
+
+		server := memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid()))
+		mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{})
+		if err != nil {
+			return fmt.Errorf("Mount: %v", err)
+		}
+
+		defer func() {
+			if err := fuse.Unmount(dir); err != nil {
+				log.Printf("Unmount: %v", err)
+			}
+
+			mfs.Join(context.Background())
+		}()
+
+		cfg.Dir = dir
+		cfg.PID = 0
+	}
+
+	// Stop early, but still report, on interrupt.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	report, err := fusetesting.Soak(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("Soak: %v", err)
+	}
+
+	for kind, n := range report.OpsByKind {
+		log.Printf("%s: %d ops, %d failed", kind, n, report.ErrorsByKind[kind])
+	}
+
+	for _, err := range report.Errors {
+		log.Print(err)
+	}
+
+	return report.Check()
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// The environment variables through which MountSandboxed tells a worker the
+// descriptor of its end of the socket, and the directory being served.
+const (
+	sandboxFDEnv  = "_FUSE_SANDBOX_FD"
+	sandboxDirEnv = "_FUSE_SANDBOX_DIR"
+)
+
+// Return the number of pages of data that fit in a message of the supplied
+// size, along with a request's headers.
+func messagePages(maxMessage int) int {
+	pageSize := os.Getpagesize()
+	if n := (maxMessage - pageSize) / pageSize; n > 1 {
+		return n
+	}
+
+	return 1
+}
+
+// SandboxedMount represents a file system mounted by MountSandboxed, with a
+// method that waits for unmounting.
+type SandboxedMount struct {
+	dir    string
+	worker *os.Process
+
+	// The result to return from Join. Not valid until the channel is closed.
+	joinStatus          error
+	joinStatusAvailable chan struct{}
+}
+
+// Dir returns the directory on which the file system is mounted.
+func (sm *SandboxedMount) Dir() string {
+	return sm.dir
+}
+
+// Worker returns the process serving the file system.
+func (sm *SandboxedMount) Worker() *os.Process {
+	return sm.worker
+}
+
+// Join blocks until the file system has been unmounted and the worker has
+// exited. The return value is non-nil if anything unexpected happened while
+// relaying, or if the worker didn't exit successfully. May be called multiple
+// times.
+func (sm *SandboxedMount) Join(ctx context.Context) error {
+	select {
+	case <-sm.joinStatusAvailable:
+		return sm.joinStatus
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ServeSandboxed serves a file system in a worker process started by
+// MountSandboxed, over the socket the front process passed to it. config
+// governs the connection to the kernel as it would for Mount, except for the
+// options given to the mount helper, which are taken from the front
+// process's config. The worker should restrict itself (e.g. with seccomp)
+// once this returns, having no further need to open the socket.
+func ServeSandboxed(
+	server Server,
+	config *MountConfig) (*MountedFileSystem, error) {
+	fd, err := strconv.Atoi(os.Getenv(sandboxFDEnv))
+	if err != nil {
+		return nil, fmt.Errorf("%s not set; not started by MountSandboxed?", sandboxFDEnv)
+	}
+
+	dir := os.Getenv(sandboxDirEnv)
+
+	// Don't pass the socket on to the worker's own children.
+	os.Unsetenv(sandboxFDEnv)
+	os.Unsetenv(sandboxDirEnv)
+
+	return ServeDevice(dir, os.NewFile(uintptr(fd), "sandbox"), server, config)
+}
@@ -0,0 +1,192 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// MountSandboxed mounts a file system on dir, like Mount, but serves it from
+// a separate worker process started with the supplied command, which should
+// call ServeSandboxed. This process keeps the device and relays requests and
+// answers between it and the worker over a socket, so a bug in the backend
+// can only do what the worker is allowed to do. Restrict the worker as
+// needed, e.g. with namespaces and credentials in worker.SysProcAttr, and
+// seccomp filters installed by the worker itself.
+//
+// The worker negotiates the connection with the kernel, so options other
+// than those given to the mount helper must be set in the worker's config.
+// Its limits on the sizes of reads and writes are lowered if necessary so
+// that every message fits on the socket.
+//
+// If the worker exits while the file system is mounted, requests it hadn't
+// answered, and any that follow, fail with EIO until the file system is
+// unmounted.
+func MountSandboxed(
+	dir string,
+	worker *exec.Cmd,
+	config *MountConfig) (*SandboxedMount, error) {
+	if err := checkMountPoint(dir); err != nil {
+		return nil, err
+	}
+
+	config = config.withLabelledLoggers()
+
+	ready := make(chan error, 1)
+	dev, err := mount(dir, config, ready)
+	if err != nil {
+		return nil, fmt.Errorf("mount: %w", err)
+	}
+
+	sm, err := startSandbox(dir, dev, worker, config)
+	if err != nil {
+		abandonMount(dir, dev, ready)
+		return nil, err
+	}
+
+	if err := <-ready; err != nil {
+		// Stop the worker, and the relay once the device goes away.
+		sm.worker.Kill()
+		if unmount(dir) == nil {
+			<-sm.joinStatusAvailable
+		}
+
+		return nil, fmt.Errorf("mount (background): %v", err)
+	}
+
+	return sm, nil
+}
+
+// Start the worker, relay the init handshake, and relay everything else in
+// the background.
+func startSandbox(
+	dir string,
+	dev *os.File,
+	worker *exec.Cmd,
+	config *MountConfig) (*SandboxedMount, error) {
+	sock, workerSock, maxMessage, err := newRelaySocket()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := startWorker(worker, workerSock, sandboxFDEnv, sandboxDirEnv+"="+dir); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("starting worker: %w", err)
+	}
+
+	if err := relayInit(dev, sock, maxMessage, config.DebugLogger); err != nil {
+		sock.Close()
+		worker.Process.Kill()
+		worker.Wait()
+		return nil, fmt.Errorf("init: %w", err)
+	}
+
+	sm := &SandboxedMount{
+		dir:                 dir,
+		worker:              worker.Process,
+		joinStatusAvailable: make(chan struct{}),
+	}
+
+	r := newRelay(dev, []*os.File{sock}, config.ErrorLogger)
+	go func() {
+		err := r.run()
+		if waitErr := worker.Wait(); err == nil && waitErr != nil {
+			err = fmt.Errorf("worker: %w", waitErr)
+		}
+
+		sm.joinStatus = err
+		close(sm.joinStatusAvailable)
+	}()
+
+	return sm, nil
+}
+
+// Relay the init request and the worker's answer, lowering the limits in the
+// answer to what fits on the socket.
+func relayInit(
+	dev *os.File,
+	sock *os.File,
+	maxMessage int,
+	debugLogger *log.Logger) error {
+	req := make([]byte, os.Getpagesize()+buffer.MaxWriteSize)
+	n, err := dev.Read(req)
+	if err != nil {
+		return fmt.Errorf("reading request: %w", err)
+	}
+
+	if n < fusekernel.InHeaderSize {
+		return fmt.Errorf("short request: %d bytes", n)
+	}
+
+	h := (*fusekernel.InHeader)(unsafe.Pointer(&req[0]))
+	if h.Opcode != fusekernel.OpInit {
+		return fmt.Errorf("expected init; got opcode %d", h.Opcode)
+	}
+
+	if _, err := sock.Write(req[:n]); err != nil {
+		return fmt.Errorf("forwarding request: %w", err)
+	}
+
+	answer := make([]byte, os.Getpagesize()+buffer.MaxReadSize)
+	n, err = sock.Read(answer)
+	if err != nil {
+		return fmt.Errorf("reading answer: %w", err)
+	}
+
+	if clampInit(answer[:n], messagePages(maxMessage)) && debugLogger != nil {
+		debugLogger.Printf("Lowered max_write to fit %d-byte messages", maxMessage)
+	}
+
+	if _, err := dev.Write(answer[:n]); err != nil {
+		return fmt.Errorf("forwarding answer: %w", err)
+	}
+
+	return nil
+}
+
+// Lower max_write and max_pages in an answer to an init request to the
+// supplied number of pages, returning true if they were higher. Older
+// protocol versions have shorter answers, lacking later fields.
+func clampInit(answer []byte, maxPages int) bool {
+	var out fusekernel.InitOut
+	base := int(unsafe.Sizeof(fusekernel.OutHeader{}))
+	le := binary.LittleEndian
+	clamped := false
+
+	maxWrite := uint32(maxPages * os.Getpagesize())
+	if off := base + int(unsafe.Offsetof(out.MaxWrite)); len(answer) >= off+4 {
+		if le.Uint32(answer[off:]) > maxWrite {
+			le.PutUint32(answer[off:], maxWrite)
+			clamped = true
+		}
+	}
+
+	if off := base + int(unsafe.Offsetof(out.MaxPages)); len(answer) >= off+2 {
+		if le.Uint16(answer[off:]) > uint16(maxPages) {
+			le.PutUint16(answer[off:], uint16(maxPages))
+			clamped = true
+		}
+	}
+
+	return clamped
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Run as the worker by Test_Sandbox, in a subprocess.
+func Test_SandboxWorker(t *testing.T) {
+	if os.Getenv("FUSE_TEST_SANDBOX_WORKER") == "" {
+		return
+	}
+
+	mfs, err := ServeSandboxed(enosysServer{}, &MountConfig{})
+	if err != nil {
+		t.Fatalf("ServeSandboxed: %v", err)
+	}
+
+	if mfs.Dir() != "/mnt" {
+		t.Errorf("Dir: %q", mfs.Dir())
+	}
+
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+}
+
+func Test_Sandbox(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernel := os.NewFile(uintptr(fds[0]), "kernel")
+	dev := os.NewFile(uintptr(fds[1]), "dev")
+	defer kernel.Close()
+	defer dev.Close()
+
+	send := func(opcode uint32, unique uint64, body interface{}) {
+		t.Helper()
+
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+			Len:    uint32(fusekernel.InHeaderSize + binary.Size(body)),
+			Opcode: opcode,
+			Unique: unique,
+			Nodeid: 1,
+		})
+		binary.Write(&msg, binary.LittleEndian, body)
+
+		if _, err := kernel.Write(msg.Bytes()); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	receive := func() (fusekernel.OutHeader, []byte) {
+		t.Helper()
+
+		buf := make([]byte, 4096)
+		n, err := kernel.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		h := *(*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		return h, buf[unsafe.Sizeof(h):n]
+	}
+
+	send(fusekernel.OpInit, 1, fusekernel.InitIn{
+		Major: 7,
+		Minor: 31,
+		Flags: uint32(fusekernel.InitMaxPages),
+	})
+
+	worker := exec.Command(os.Args[0], "-test.run=^Test_SandboxWorker$")
+	worker.Env = append(os.Environ(), "FUSE_TEST_SANDBOX_WORKER=1")
+	worker.Stderr = os.Stderr
+
+	sm, err := startSandbox("/mnt", dev, worker, &MountConfig{})
+	if err != nil {
+		t.Fatalf("startSandbox: %v", err)
+	}
+
+	// The worker answers init, within the limits of the socket.
+	h, body := receive()
+	var out fusekernel.InitOut
+	binary.Read(bytes.NewReader(body), binary.LittleEndian, &out)
+	if h.Unique != 1 || h.Error != 0 || out.Major != 7 {
+		t.Fatalf("Init answer: %+v %+v", h, out)
+	}
+
+	if out.MaxWrite == 0 || int(out.MaxPages)*os.Getpagesize() > int(out.MaxWrite) {
+		t.Errorf("Limits: max_write %d, max_pages %d", out.MaxWrite, out.MaxPages)
+	}
+
+	// And other requests.
+	send(fusekernel.OpGetattr, 2, fusekernel.GetattrIn{})
+	if h, _ := receive(); h.Unique != 2 || h.Error != -int32(syscall.ENOSYS) {
+		t.Errorf("Getattr answer: %+v", h)
+	}
+
+	// Once the worker is gone, requests fail rather than hang.
+	sm.Worker().Kill()
+	send(fusekernel.OpGetattr, 3, fusekernel.GetattrIn{})
+	if h, _ := receive(); h.Unique != 3 || h.Error != -int32(syscall.EIO) {
+		t.Errorf("Getattr answer without worker: %+v", h)
+	}
+
+	kernel.Close()
+	if err := sm.Join(context.Background()); err == nil {
+		t.Errorf("Join returned nil for a killed worker")
+	}
+}
+
+func Test_clampInit(t *testing.T) {
+	pageSize := os.Getpagesize()
+	maxPages := messagePages(4*pageSize + 100)
+
+	var answer bytes.Buffer
+	binary.Write(&answer, binary.LittleEndian, fusekernel.OutHeader{Unique: 1})
+	binary.Write(&answer, binary.LittleEndian, fusekernel.InitOut{
+		MaxWrite: 1 << 20,
+		MaxPages: 256,
+	})
+
+	b := answer.Bytes()
+	if !clampInit(b, maxPages) {
+		t.Errorf("clampInit returned false")
+	}
+
+	var out fusekernel.InitOut
+	binary.Read(bytes.NewReader(b[16:]), binary.LittleEndian, &out)
+	if out.MaxWrite != uint32(3*pageSize) || out.MaxPages != 3 {
+		t.Errorf("Clamped: max_write %d, max_pages %d", out.MaxWrite, out.MaxPages)
+	}
+
+	// Answers for older protocol versions end before max_pages.
+	clampInit(b[:16+24], maxPages)
+}
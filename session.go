@@ -0,0 +1,247 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Session is the state of a mounted file system's connection to the kernel
+// that is needed, along with the device, to serve the mount from another
+// process. See MountedFileSystem.Session and Resume.
+type Session struct {
+	// The protocol version negotiated when the file system was mounted.
+	ProtocolMajor uint32
+	ProtocolMinor uint32
+
+	// Whether the kernel agreed to resend unanswered requests. See
+	// MountConfig.EnableResend.
+	Resend bool
+
+	// Whether the kernel agreed to allow shared mappings of files opened with
+	// direct I/O. See MountConfig.EnableDirectIOMmap.
+	DirectIOMmap bool
+}
+
+// Session returns the device through which the file system is being served,
+// and the state needed to serve it elsewhere. The file remains owned by the
+// MountedFileSystem and must not be closed; pass it to another process (e.g.
+// with SendDevice) or duplicate it to keep the mount alive beyond this
+// process's lifetime.
+func (mfs *MountedFileSystem) Session() (*os.File, Session) {
+	p := mfs.conn.protocol
+	return mfs.conn.dev, Session{
+		ProtocolMajor: p.Major,
+		ProtocolMinor: p.Minor,
+		Resend:        mfs.conn.resend,
+		DirectIOMmap:  mfs.conn.directIOMmap,
+	}
+}
+
+// ConnectionInfo describes the parameters of a mounted file system's
+// connection to the kernel, for operational tooling and bug reports. Its
+// String method renders everything on one line.
+type ConnectionInfo struct {
+	// The protocol version offered by the kernel, and the one in use.
+	KernelProtocolMajor uint32
+	KernelProtocolMinor uint32
+	ProtocolMajor       uint32
+	ProtocolMinor       uint32
+
+	// The capability flags offered by the kernel in its init request, and
+	// those enabled in reply, with the second word of flags (FUSE_INIT_EXT) in
+	// the upper 32 bits.
+	KernelFlags uint64
+	Flags       uint64
+
+	// The limits given to the kernel in reply.
+	MaxWrite            uint32
+	MaxReadahead        uint32
+	MaxPages            uint16
+	MaxBackground       uint16
+	CongestionThreshold uint16
+
+	// The file descriptor number of the fuse device being served.
+	DeviceFD uintptr
+
+	// The options with which Mount mounted the file system. Empty for file
+	// systems served by ServeDevice or Resume, which were mounted by someone
+	// else.
+	MountOptions string
+}
+
+func (ci ConnectionInfo) String() string {
+	return fmt.Sprintf(
+		"protocol %d.%d (kernel %d.%d), flags %v|%v (kernel %v|%v), "+
+			"max_write %d, max_readahead %d, max_pages %d, "+
+			"max_background %d, congestion_threshold %d, fd %d, options %q",
+		ci.ProtocolMajor,
+		ci.ProtocolMinor,
+		ci.KernelProtocolMajor,
+		ci.KernelProtocolMinor,
+		fusekernel.InitFlags(ci.Flags),
+		fusekernel.InitFlags2(ci.Flags>>32),
+		fusekernel.InitFlags(ci.KernelFlags),
+		fusekernel.InitFlags2(ci.KernelFlags>>32),
+		ci.MaxWrite,
+		ci.MaxReadahead,
+		ci.MaxPages,
+		ci.MaxBackground,
+		ci.CongestionThreshold,
+		ci.DeviceFD,
+		ci.MountOptions)
+}
+
+// ConnectionInfo returns the parameters of the file system's connection to
+// the kernel. For a file system served by Resume there was no init exchange
+// in this process, so only the protocol version from the Session is known.
+func (mfs *MountedFileSystem) ConnectionInfo() ConnectionInfo {
+	info := mfs.conn.info
+	info.DeviceFD = mfs.deviceFD
+	info.MountOptions = mfs.mountOptions
+	return info
+}
+
+// Resume serves a file system that is already mounted on dir, given the
+// device and session obtained from MountedFileSystem.Session by the process
+// that mounted it, typically before that process exited. As long as some
+// process holds the device open, the kernel keeps the mount alive, so the
+// file system can be restarted without disturbing its users.
+//
+// If the session has Resend set (see MountConfig.EnableResend), requests that
+// the kernel sent to the old process and that weren't answered are sent again
+// to the new one, so the old process may be stopped at any time; it must not
+// answer anything after Resume is called. Otherwise such requests are lost,
+// and the processes that made them hang until the file system is unmounted or
+// the request is interrupted. Stop the old process only once it has answered
+// all of its requests (see MountedFileSystem.Join) to avoid this.
+//
+// config should match the configuration the file system was mounted with;
+// options that are negotiated at mount time can't be changed.
+func Resume(
+	dir string,
+	dev *os.File,
+	session Session,
+	server Server,
+	config *MountConfig) (*MountedFileSystem, error) {
+	config = config.withLabelledLoggers()
+
+	protocol := fusekernel.Protocol{
+		Major: session.ProtocolMajor,
+		Minor: session.ProtocolMinor,
+	}
+
+	min := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMinMajor,
+		Minor: fusekernel.ProtoVersionMinMinor,
+	}
+
+	max := fusekernel.Protocol{
+		Major: fusekernel.ProtoVersionMaxMajor,
+		Minor: fusekernel.ProtoVersionMaxMinor,
+	}
+
+	if protocol.LT(min) || max.LT(protocol) {
+		return nil, fmt.Errorf("Unsupported protocol version: %v", protocol)
+	}
+
+	mfs := &MountedFileSystem{
+		dir:                 dir,
+		joinStatusAvailable: make(chan struct{}),
+	}
+
+	cfgCopy := *config
+	cfgCopy.OpContext = config.opContext()
+
+	if config.PollDevice {
+		var err error
+		if dev, err = pollableDevice(dev); err != nil {
+			return nil, fmt.Errorf("pollableDevice: %w", err)
+		}
+	}
+
+	connection := &Connection{
+		cfg:          cfgCopy,
+		debugLogger:  config.DebugLogger,
+		errorLogger:  config.ErrorLogger,
+		dev:          dev,
+		protocol:     protocol,
+		resend:       session.Resend,
+		directIOMmap: session.DirectIOMmap,
+		info: ConnectionInfo{
+			ProtocolMajor: protocol.Major,
+			ProtocolMinor: protocol.Minor,
+		},
+		cancelFuncs: make(map[uint64]func()),
+	}
+
+	if session.Resend {
+		if err := connection.NotifyResend(); err != nil {
+			return nil, fmt.Errorf("NotifyResend: %v", err)
+		}
+	}
+
+	mfs.serve(server, connection)
+	return mfs, nil
+}
+
+// ServeDevice serves a file system on a fuse device that someone else has
+// mounted on dir, starting with the init handshake that a fresh mount
+// requires. Use it where this process can't mount file systems itself: on
+// Android, for example, apps have neither fusermount(1) nor the privileges
+// needed to mount, but can obtain a mounted device from the system (e.g. via
+// StorageManager.openProxyFileDescriptor and AppFuse, or from vold) and hand
+// it to Go.
+//
+// The file system's visibility depends on the mount namespace the device was
+// mounted in, which on Android is specific to each app.
+func ServeDevice(
+	dir string,
+	dev *os.File,
+	server Server,
+	config *MountConfig) (*MountedFileSystem, error) {
+	config = config.withLabelledLoggers()
+
+	mfs := &MountedFileSystem{
+		dir:                 dir,
+		joinStatusAvailable: make(chan struct{}),
+	}
+
+	cfgCopy := *config
+	cfgCopy.OpContext = config.opContext()
+
+	if config.PollDevice {
+		var err error
+		if dev, err = pollableDevice(dev); err != nil {
+			return nil, fmt.Errorf("pollableDevice: %w", err)
+		}
+	}
+
+	connection, err := newConnection(
+		cfgCopy,
+		config.DebugLogger,
+		config.ErrorLogger,
+		dev,
+		server)
+	if err != nil {
+		return nil, fmt.Errorf("newConnection: %v", err)
+	}
+
+	mfs.serve(server, connection)
+	return mfs, nil
+}
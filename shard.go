@@ -0,0 +1,145 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The environment variables through which MountSharded tells a worker the
+// descriptor it should serve, the directory and session being served, and
+// which shard it is, as "index/count".
+const (
+	shardFDEnv      = "_FUSE_SHARD_FD"
+	shardDirEnv     = "_FUSE_SHARD_DIR"
+	shardSessionEnv = "_FUSE_SHARD_SESSION"
+	shardEnv        = "_FUSE_SHARD"
+)
+
+// ShardPolicy says how MountSharded divides requests between workers.
+type ShardPolicy int
+
+const (
+	// Each worker reads requests from its own clone of the fuse device (see
+	// CloneDevice), and the kernel hands each request to whichever worker
+	// reads first. Requests about the same inode or handle may go to
+	// different workers, so they must share their state, e.g. through a
+	// common backend, and handle IDs must mean the same thing to all of them.
+	ShardByQueue ShardPolicy = iota
+
+	// Requests are relayed by the mounting process to the worker chosen by
+	// the ID of the inode they concern, modulo the number of workers, so
+	// each worker sees every request about the inodes it is responsible for
+	// and may keep their state, including handles, to itself. Requests
+	// naming other inodes too, e.g. RenameOp and CreateLinkOp, go to the
+	// worker for the inode in their header (the parent, for ops creating or
+	// removing entries). A worker allocating inode IDs can keep the inodes
+	// it creates to itself by choosing IDs in its own class (see Shard).
+	ShardByInode
+)
+
+// ShardedMount represents a file system mounted by MountSharded, with a
+// method that waits for unmounting.
+type ShardedMount struct {
+	mfs     *MountedFileSystem
+	workers []*os.Process
+
+	// The result to return from Join. Not valid until the channel is closed.
+	joinStatus          error
+	joinStatusAvailable chan struct{}
+}
+
+// Dir returns the directory on which the file system is mounted.
+func (sm *ShardedMount) Dir() string {
+	return sm.mfs.Dir()
+}
+
+// Workers returns the processes serving the file system.
+func (sm *ShardedMount) Workers() []*os.Process {
+	return sm.workers
+}
+
+// Join blocks until the file system has been unmounted and all workers have
+// exited. The return value is non-nil if anything unexpected happened while
+// serving, or if a worker didn't exit successfully. May be called multiple
+// times.
+func (sm *ShardedMount) Join(ctx context.Context) error {
+	select {
+	case <-sm.joinStatusAvailable:
+		return sm.joinStatus
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NotifyInvalInode asks the kernel to drop cached attributes and data for the
+// inode, for mounting processes that learn of changes to the backend. See
+// Connection.NotifyInvalInode.
+func (sm *ShardedMount) NotifyInvalInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) error {
+	return sm.mfs.NotifyInvalInode(inode, off, length)
+}
+
+// NotifyInvalEntry asks the kernel to drop a cached dentry. See
+// Connection.NotifyInvalEntry.
+func (sm *ShardedMount) NotifyInvalEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	return sm.mfs.NotifyInvalEntry(parent, name)
+}
+
+// ServeShard serves a share of a file system in a worker process started by
+// MountSharded. The connection has already been negotiated by the mounting
+// process, so config should match its config, as for Resume.
+func ServeShard(
+	server Server,
+	config *MountConfig) (*MountedFileSystem, error) {
+	fd, err := strconv.Atoi(os.Getenv(shardFDEnv))
+	if err != nil {
+		return nil, fmt.Errorf("%s not set; not started by MountSharded?", shardFDEnv)
+	}
+
+	var session Session
+	if err := json.Unmarshal([]byte(os.Getenv(shardSessionEnv)), &session); err != nil {
+		return nil, fmt.Errorf("%s: %w", shardSessionEnv, err)
+	}
+
+	dir := os.Getenv(shardDirEnv)
+
+	// Don't pass the device on to the worker's own children.
+	os.Unsetenv(shardFDEnv)
+	os.Unsetenv(shardDirEnv)
+	os.Unsetenv(shardSessionEnv)
+
+	return Resume(dir, os.NewFile(uintptr(fd), "shard"), session, server, config)
+}
+
+// Shard returns the index of the worker process among the count started by
+// MountSharded, or 0 and 1 in other processes.
+func Shard() (index int, count int) {
+	if _, err := fmt.Sscanf(os.Getenv(shardEnv), "%d/%d", &index, &count); err != nil {
+		return 0, 1
+	}
+
+	return index, count
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// CloneDevice opens a new descriptor for the fuse device and attaches it to
+// the same connection as dev (Linux >= 4.2). The kernel hands each request to
+// whichever descriptor is read first, and answers must be written to the
+// descriptor the request was read from.
+func CloneDevice(dev *os.File) (*os.File, error) {
+	clone, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := uint32(dev.Fd())
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		clone.Fd(),
+		fusekernel.DevIocClone,
+		uintptr(unsafe.Pointer(&fd)))
+	if errno != 0 {
+		clone.Close()
+		return nil, errno
+	}
+
+	return clone, nil
+}
+
+// MountSharded mounts a file system on dir, like Mount, and serves it from
+// several worker processes started with the supplied commands, each of which
+// should call ServeShard, so that file systems limited by CPU can use more
+// than one process. This process negotiates the connection with the kernel
+// according to config, and requests are divided between the workers
+// according to policy.
+//
+// If a worker exits while the file system is mounted, requests it was
+// serving are lost with ShardByQueue, and fail with EIO with ShardByInode,
+// as do requests for its inodes that follow. Once all workers have exited,
+// the connection is closed and further requests fail.
+func MountSharded(
+	dir string,
+	workers []*exec.Cmd,
+	policy ShardPolicy,
+	config *MountConfig) (*ShardedMount, error) {
+	if len(workers) == 0 {
+		return nil, errors.New("no workers")
+	}
+
+	cfg := *config
+	coord := &shardCoordinator{
+		policy:  policy,
+		workers: make(chan struct{}),
+	}
+
+	if policy == ShardByInode {
+		var err error
+		if cfg.maxMessage, err = coord.makeSockets(len(workers)); err != nil {
+			return nil, err
+		}
+	}
+
+	mfs, err := Mount(dir, coord, &cfg)
+	if err != nil {
+		coord.closeSockets()
+		return nil, err
+	}
+
+	sm, err := coord.startWorkers(mfs, workers)
+	if err != nil {
+		Unmount(dir)
+		return nil, err
+	}
+
+	return sm, nil
+}
+
+// shardCoordinator is the server for the mounting process's own connection
+// in MountSharded. It leaves requests to the workers, or relays them to the
+// workers with ShardByInode.
+type shardCoordinator struct {
+	policy ShardPolicy
+
+	// Our ends of the sockets to the workers, with ShardByInode.
+	socks       []*os.File
+	workerSocks []*os.File
+
+	// Closed once all workers have exited.
+	workers chan struct{}
+}
+
+// Create the sockets to relay requests to the workers over, returning the
+// largest message that fits on all of them.
+func (sc *shardCoordinator) makeSockets(n int) (int, error) {
+	var maxMessage int
+	for i := 0; i < n; i++ {
+		sock, workerSock, m, err := newRelaySocket()
+		if err != nil {
+			sc.closeSockets()
+			return 0, err
+		}
+
+		sc.socks = append(sc.socks, sock)
+		sc.workerSocks = append(sc.workerSocks, workerSock)
+		if i == 0 || m < maxMessage {
+			maxMessage = m
+		}
+	}
+
+	return maxMessage, nil
+}
+
+func (sc *shardCoordinator) closeSockets() {
+	for _, f := range append(sc.socks, sc.workerSocks...) {
+		f.Close()
+	}
+}
+
+func (sc *shardCoordinator) ServeOps(c *Connection) {
+	if sc.policy == ShardByInode {
+		if err := newRelay(c.dev, sc.socks, c.errorLogger).run(); err != nil && c.errorLogger != nil {
+			c.errorLogger.Printf("Relaying to workers: %v", err)
+		}
+	}
+
+	<-sc.workers
+}
+
+// Start the workers, giving each a clone of the device or a socket to be
+// relayed requests over, and return a ShardedMount that finishes once they
+// have exited and the connection is closed.
+func (sc *shardCoordinator) startWorkers(
+	mfs *MountedFileSystem,
+	workers []*exec.Cmd) (*ShardedMount, error) {
+	dev, session := mfs.Session()
+	encodedSession, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+
+	sm := &ShardedMount{
+		mfs:                 mfs,
+		joinStatusAvailable: make(chan struct{}),
+	}
+
+	for i, worker := range workers {
+		var f *os.File
+		if sc.policy == ShardByInode {
+			f = sc.workerSocks[i]
+		} else if f, err = CloneDevice(dev); err != nil {
+			err = fmt.Errorf("CloneDevice: %w", err)
+		}
+
+		if err == nil {
+			err = startWorker(
+				worker,
+				f,
+				shardFDEnv,
+				shardDirEnv+"="+mfs.Dir(),
+				shardSessionEnv+"="+string(encodedSession),
+				fmt.Sprintf("%s=%d/%d", shardEnv, i, len(workers)))
+		}
+
+		if err != nil {
+			for _, p := range sm.workers {
+				p.Kill()
+			}
+
+			sc.closeSockets()
+			return nil, fmt.Errorf("starting worker %d: %w", i, err)
+		}
+
+		sm.workers = append(sm.workers, worker.Process)
+	}
+
+	go func() {
+		var err error
+		for i, worker := range workers {
+			if waitErr := worker.Wait(); err == nil && waitErr != nil {
+				err = fmt.Errorf("worker %d: %w", i, waitErr)
+			}
+		}
+
+		close(sc.workers)
+		if joinErr := mfs.Join(context.Background()); err == nil {
+			err = joinErr
+		}
+
+		sm.joinStatus = err
+		close(sm.joinStatusAvailable)
+	}()
+
+	return sm, nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A fake kernel on one end of a socket, with the device on the other.
+type fakeKernel struct {
+	t      *testing.T
+	kernel *os.File
+	dev    *os.File
+}
+
+func newFakeKernel(t *testing.T) *fakeKernel {
+	// Workers mustn't inherit the kernel's end, or it won't hang up.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	return &fakeKernel{
+		t:      t,
+		kernel: os.NewFile(uintptr(fds[0]), "kernel"),
+		dev:    os.NewFile(uintptr(fds[1]), "dev"),
+	}
+}
+
+func (k *fakeKernel) send(opcode uint32, unique uint64, nodeid uint64, body ...interface{}) {
+	k.t.Helper()
+
+	var b bytes.Buffer
+	for _, x := range body {
+		binary.Write(&b, binary.LittleEndian, x)
+	}
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + b.Len()),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: nodeid,
+	})
+	msg.Write(b.Bytes())
+
+	if _, err := k.kernel.Write(msg.Bytes()); err != nil {
+		k.t.Fatalf("Write: %v", err)
+	}
+}
+
+func (k *fakeKernel) receive() (fusekernel.OutHeader, []byte) {
+	k.t.Helper()
+
+	buf := make([]byte, 4096)
+	n, err := k.kernel.Read(buf)
+	if err != nil {
+		k.t.Fatalf("Read: %v", err)
+	}
+
+	h := *(*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	return h, buf[unsafe.Sizeof(h):n]
+}
+
+// Read a request relayed to a worker.
+func readRelayed(t *testing.T, sock *os.File) (fusekernel.InHeader, []byte) {
+	t.Helper()
+
+	buf := make([]byte, 4096)
+	n, err := sock.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	h := *(*fusekernel.InHeader)(unsafe.Pointer(&buf[0]))
+	return h, buf[fusekernel.InHeaderSize:n]
+}
+
+func Test_RelayShardsByInode(t *testing.T) {
+	k := newFakeKernel(t)
+	defer k.kernel.Close()
+
+	var socks, workers []*os.File
+	for i := 0; i < 2; i++ {
+		sock, worker, _, err := newRelaySocket()
+		if err != nil {
+			t.Fatalf("newRelaySocket: %v", err)
+		}
+
+		socks = append(socks, sock)
+		workers = append(workers, worker)
+	}
+
+	done := make(chan error)
+	go func() { done <- newRelay(k.dev, socks, nil).run() }()
+
+	// Requests go to the worker for their inode.
+	k.send(fusekernel.OpGetattr, 10, 2, fusekernel.GetattrIn{})
+	if h, _ := readRelayed(t, workers[0]); h.Unique != 10 {
+		t.Errorf("Worker 0 got %+v", h)
+	}
+
+	k.send(fusekernel.OpGetattr, 11, 3, fusekernel.GetattrIn{})
+	if h, _ := readRelayed(t, workers[1]); h.Unique != 11 {
+		t.Errorf("Worker 1 got %+v", h)
+	}
+
+	// Interrupts go to the worker handling the request.
+	k.send(fusekernel.OpInterrupt, 12, 0, fusekernel.InterruptIn{Unique: 11})
+	if h, _ := readRelayed(t, workers[1]); h.Opcode != fusekernel.OpInterrupt {
+		t.Errorf("Worker 1 got %+v", h)
+	}
+
+	// Batches of forgets are split.
+	k.send(
+		fusekernel.OpBatchForget, 0, 0,
+		fusekernel.BatchForgetCountIn{Count: 3},
+		fusekernel.BatchForgetEntryIn{Inode: 2, Nlookup: 1},
+		fusekernel.BatchForgetEntryIn{Inode: 3, Nlookup: 1},
+		fusekernel.BatchForgetEntryIn{Inode: 4, Nlookup: 1})
+
+	for i, want := range []uint32{2, 1} {
+		h, body := readRelayed(t, workers[i])
+		count := (*fusekernel.BatchForgetCountIn)(unsafe.Pointer(&body[0])).Count
+		if h.Opcode != fusekernel.OpBatchForget || count != want || int(h.Len) != fusekernel.InHeaderSize+len(body) {
+			t.Errorf("Worker %d got %+v with count %d", i, h, count)
+		}
+	}
+
+	// Answers go back to the kernel.
+	answer := fusekernel.OutHeader{Unique: 11}
+	answer.Len = uint32(unsafe.Sizeof(answer))
+	workers[1].Write((*[unsafe.Sizeof(answer)]byte)(unsafe.Pointer(&answer))[:])
+	if h, _ := k.receive(); h.Unique != 11 || h.Error != 0 {
+		t.Errorf("Answer: %+v", h)
+	}
+
+	// When a worker hangs up, its requests fail.
+	workers[0].Close()
+	if h, _ := k.receive(); h.Unique != 10 || h.Error != -int32(syscall.EIO) {
+		t.Errorf("Answer for lost request: %+v", h)
+	}
+
+	k.send(fusekernel.OpGetattr, 13, 4, fusekernel.GetattrIn{})
+	if h, _ := k.receive(); h.Unique != 13 || h.Error != -int32(syscall.EIO) {
+		t.Errorf("Answer for request without a worker: %+v", h)
+	}
+
+	k.kernel.Close()
+	workers[1].Close()
+	if err := <-done; err != nil {
+		t.Errorf("run: %v", err)
+	}
+}
+
+// Run as a worker by Test_ShardByInode, in a subprocess.
+func Test_ShardWorker(t *testing.T) {
+	if os.Getenv("FUSE_TEST_SHARD_WORKER") == "" {
+		return
+	}
+
+	if _, count := Shard(); count != 2 {
+		t.Errorf("Shard count: %d", count)
+	}
+
+	mfs, err := ServeShard(enosysServer{}, &MountConfig{})
+	if err != nil {
+		t.Fatalf("ServeShard: %v", err)
+	}
+
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+}
+
+func Test_ShardByInode(t *testing.T) {
+	k := newFakeKernel(t)
+	defer k.kernel.Close()
+
+	coord := &shardCoordinator{
+		policy:  ShardByInode,
+		workers: make(chan struct{}),
+	}
+
+	maxMessage, err := coord.makeSockets(2)
+	if err != nil {
+		t.Fatalf("makeSockets: %v", err)
+	}
+
+	// The mounting process negotiates, within the limits of the sockets.
+	k.send(fusekernel.OpInit, 1, 0, fusekernel.InitIn{
+		Major: 7,
+		Minor: 31,
+		Flags: uint32(fusekernel.InitMaxPages),
+	})
+
+	mfs, err := ServeDevice("/mnt", k.dev, coord, &MountConfig{maxMessage: maxMessage})
+	if err != nil {
+		t.Fatalf("ServeDevice: %v", err)
+	}
+
+	h, body := k.receive()
+	var out fusekernel.InitOut
+	binary.Read(bytes.NewReader(body), binary.LittleEndian, &out)
+	if h.Error != 0 || int(out.MaxWrite) > maxMessage || int(out.MaxPages) != messagePages(maxMessage) {
+		t.Fatalf("Init answer: %+v %+v", h, out)
+	}
+
+	var workers []*exec.Cmd
+	for i := 0; i < 2; i++ {
+		worker := exec.Command(os.Args[0], "-test.run=^Test_ShardWorker$")
+		worker.Env = append(os.Environ(), "FUSE_TEST_SHARD_WORKER=1")
+		worker.Stderr = os.Stderr
+		workers = append(workers, worker)
+	}
+
+	sm, err := coord.startWorkers(mfs, workers)
+	if err != nil {
+		t.Fatalf("startWorkers: %v", err)
+	}
+
+	// The workers answer requests for their inodes.
+	for unique := uint64(2); unique < 6; unique++ {
+		k.send(fusekernel.OpGetattr, unique, unique, fusekernel.GetattrIn{})
+		if h, _ := k.receive(); h.Unique != unique || h.Error != -int32(syscall.ENOSYS) {
+			t.Errorf("Getattr answer: %+v", h)
+		}
+	}
+
+	if len(sm.Workers()) != 2 || sm.Dir() != "/mnt" {
+		t.Errorf("Workers %v, dir %q", sm.Workers(), sm.Dir())
+	}
+
+	// Unmounting stops the workers.
+	k.kernel.Close()
+	if err := sm.Join(context.Background()); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
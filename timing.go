@@ -0,0 +1,37 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"time"
+)
+
+// ReceivedAt returns the time at which the op whose context is supplied was
+// read from the fuse device, according to MountConfig.Clock, or the zero time
+// for contexts that don't belong to an op.
+//
+// The time between this and the file system starting work on the op is spent
+// waiting in this process, e.g. for a goroutine to be scheduled, or behind
+// other ops in a single-threaded server or one that limits its concurrency.
+// When it grows, latency comes from dispatch backlog rather than from the file
+// system's own code. See fuseutil.LatencyRecorder, which reports the two
+// separately. The kernel doesn't timestamp requests, so time spent in its
+// queue before being read isn't included; that shows up as a server that is
+// slow to call ReadOp again.
+func ReceivedAt(ctx context.Context) time.Time {
+	state, _ := ctx.Value(contextKey).(opState)
+	return state.received
+}
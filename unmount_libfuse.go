@@ -0,0 +1,33 @@
+//go:build (illumos || solaris) && cgo
+// +build illumos solaris
+// +build cgo
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func unmount(dir string) error {
+	if err := unix.Unmount(dir, 0); err != nil {
+		return &os.PathError{Op: "unmount", Path: dir, Err: err}
+	}
+
+	return nil
+}
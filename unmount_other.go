@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !(illumos && cgo) && !(solaris && cgo)
+// +build !linux
+// +build !darwin
+// +build !illumos !cgo
+// +build !solaris !cgo
+
+package fuse
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func unmount(dir string) error {
+	return fmt.Errorf("%w: %s", ErrPlatformUnsupported, runtime.GOOS)
+}
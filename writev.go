@@ -1,3 +1,6 @@
+//go:build !windows && !solaris && !illumos
+// +build !windows,!solaris,!illumos
+
 package fuse
 
 import (
@@ -0,0 +1,17 @@
+//go:build solaris || illumos
+// +build solaris illumos
+
+package fuse
+
+import "syscall"
+
+// The syscall package doesn't expose writev(2) here, so gather the packet
+// into a single buffer instead.
+func writev(fd int, packet [][]byte) (n int, err error) {
+	var msg []byte
+	for _, v := range packet {
+		msg = append(msg, v...)
+	}
+
+	return syscall.Write(fd, msg)
+}
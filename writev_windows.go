@@ -0,0 +1,14 @@
+package fuse
+
+import "syscall"
+
+// There is no fuse device to write to here; this exists only so that the
+// package compiles.
+func writev(fd int, packet [][]byte) (n int, err error) {
+	var msg []byte
+	for _, v := range packet {
+		msg = append(msg, v...)
+	}
+
+	return syscall.Write(syscall.Handle(fd), msg)
+}